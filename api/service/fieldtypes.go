@@ -0,0 +1,386 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"sync"
+
+	"github.com/chrneumann/htmlwidgets"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// FieldWidget describes the form widget of a field type provided by
+// a module.
+type FieldWidget struct {
+	// Type is one of "text" (the default), "textarea" and "hidden".
+	Type string
+	// Classes are added to the widget, e.g. to attach JavaScript.
+	Classes []string
+	// Value is the initial form value.
+	Value       string
+	Description string
+}
+
+// FieldType implements a field type provided by a module.
+//
+// Values are passed JSON encoded as stored in the node data. They are
+// nil for fields without value.
+type FieldType interface {
+	// RenderHTML returns the HTML of the value used by templates.
+	RenderHTML(value []byte, field *NodeField) (string, error)
+	// String returns a raw string representation of the value.
+	String(value []byte, field *NodeField) (string, error)
+	// FormWidget returns the widget to edit the value.
+	FormWidget(value []byte, field *NodeField, locale string) (
+		*FieldWidget, error)
+	// Parse returns the value of the submitted form value. If the form
+	// value is invalid, Parse returns a translated error message
+	// instead.
+	Parse(formValue string, field *NodeField, locale string) (
+		[]byte, string, error)
+}
+
+// FieldTypeArgs are the arguments of calls to a field type service.
+type FieldTypeArgs struct {
+	Type      string
+	Field     *NodeField
+	Value     []byte
+	FormValue string
+	Locale    string
+}
+
+// FieldTypeParseRet is the reply of the FieldType.Parse call.
+type FieldTypeParseRet struct {
+	Value []byte
+	// Invalid is the error message if the form value is invalid.
+	Invalid string
+}
+
+// fieldTypeService serves field types of a module.
+type fieldTypeService struct {
+	types map[string]FieldType
+}
+
+func (s *fieldTypeService) get(id string) (FieldType, error) {
+	fieldType, ok := s.types[id]
+	if !ok {
+		return nil, fmt.Errorf("Unknown field type %q", id)
+	}
+	return fieldType, nil
+}
+
+// Types returns the ids of the served field types.
+func (s *fieldTypeService) Types(_ int, reply *[]string) error {
+	*reply = make([]string, 0, len(s.types))
+	for id := range s.types {
+		*reply = append(*reply, id)
+	}
+	return nil
+}
+
+func (s *fieldTypeService) RenderHTML(args *FieldTypeArgs, reply *string) error {
+	fieldType, err := s.get(args.Type)
+	if err != nil {
+		return err
+	}
+	*reply, err = fieldType.RenderHTML(args.Value, args.Field)
+	return err
+}
+
+func (s *fieldTypeService) String(args *FieldTypeArgs, reply *string) error {
+	fieldType, err := s.get(args.Type)
+	if err != nil {
+		return err
+	}
+	*reply, err = fieldType.String(args.Value, args.Field)
+	return err
+}
+
+func (s *fieldTypeService) FormWidget(args *FieldTypeArgs,
+	reply *FieldWidget) error {
+	fieldType, err := s.get(args.Type)
+	if err != nil {
+		return err
+	}
+	widget, err := fieldType.FormWidget(args.Value, args.Field, args.Locale)
+	if err != nil {
+		return err
+	}
+	*reply = *widget
+	return nil
+}
+
+func (s *fieldTypeService) Parse(args *FieldTypeArgs,
+	reply *FieldTypeParseRet) error {
+	fieldType, err := s.get(args.Type)
+	if err != nil {
+		return err
+	}
+	reply.Value, reply.Invalid, err = fieldType.Parse(args.FormValue,
+		args.Field, args.Locale)
+	return err
+}
+
+// ServeFieldTypes serves the given field types on the unix domain
+// socket at path and publishes them to Monsti. The types are mapped
+// by their ids, e.g. "shop.Price".
+//
+// Field types must be published before nodes using them get loaded.
+func ServeFieldTypes(m *MonstiClient, path string,
+	types map[string]FieldType, logger *log.Logger) error {
+	provider := NewProvider("FieldType", &fieldTypeService{types})
+	provider.Logger = logger
+	if err := provider.Listen(path); err != nil {
+		return err
+	}
+	go func() {
+		if err := provider.Accept(); err != nil {
+			logger.Printf("Could not accept at field type service: %v", err)
+		}
+	}()
+	return m.PublishService("FieldType", path)
+}
+
+// GetFieldTypes returns the ids of the field types served at the given
+// unix domain socket.
+func GetFieldTypes(path string) ([]string, error) {
+	var reply []string
+	if err := callFieldType(path, "Types", 0, &reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+var (
+	// fieldTypeClients maps the paths of field type services to their
+	// connections.
+	fieldTypeClients = make(map[string]*Client)
+	// fieldTypePaths maps field types to the paths of their services.
+	fieldTypePaths        = make(map[string]string)
+	fieldTypeClientsMutex sync.Mutex
+)
+
+// getFieldTypePath returns the path of the service providing the given
+// field type or the empty string if it's unknown.
+//
+// Paths get cached until the connection to the service fails.
+func getFieldTypePath(m *MonstiClient, fieldType string) (string, error) {
+	fieldTypeClientsMutex.Lock()
+	path, ok := fieldTypePaths[fieldType]
+	fieldTypeClientsMutex.Unlock()
+	if ok {
+		return path, nil
+	}
+	path, err := m.GetFieldTypeService(fieldType)
+	if err != nil || path == "" {
+		return path, err
+	}
+	fieldTypeClientsMutex.Lock()
+	fieldTypePaths[fieldType] = path
+	fieldTypeClientsMutex.Unlock()
+	return path, nil
+}
+
+// evictFieldTypeClient closes the given connection to the field type
+// service at path and forgets it together with the cached paths of
+// the service's field types.
+func evictFieldTypeClient(path string, client *Client) {
+	fieldTypeClientsMutex.Lock()
+	defer fieldTypeClientsMutex.Unlock()
+	if fieldTypeClients[path] != client {
+		return
+	}
+	client.Close()
+	delete(fieldTypeClients, path)
+	for fieldType, typePath := range fieldTypePaths {
+		if typePath == path {
+			delete(fieldTypePaths, fieldType)
+		}
+	}
+}
+
+// isConnectionError returns true iff the error returned by an RPC
+// call is caused by a broken connection instead of the service.
+func isConnectionError(err error) bool {
+	if err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// callFieldType calls the given method of the field type service at
+// path. If the connection is broken, e.g. because the module has been
+// restarted, it redials once.
+func callFieldType(path, method string, args, reply interface{}) error {
+	var err error
+	for i := 0; i < 2; i++ {
+		var client *Client
+		client, err = getFieldTypeClient(path)
+		if err != nil {
+			return err
+		}
+		err = client.RPCClient.Call("FieldType."+method, args, reply)
+		if !isConnectionError(err) {
+			break
+		}
+		evictFieldTypeClient(path, client)
+	}
+	if err != nil {
+		return fmt.Errorf("service: FieldType.%v error: %v", method, err)
+	}
+	return nil
+}
+
+// getFieldTypeClient returns a connection to the field type service
+// at the given path.
+func getFieldTypeClient(path string) (*Client, error) {
+	fieldTypeClientsMutex.Lock()
+	defer fieldTypeClientsMutex.Unlock()
+	if client, ok := fieldTypeClients[path]; ok {
+		return client, nil
+	}
+	client := new(Client)
+	if err := client.Connect(path); err != nil {
+		return nil, fmt.Errorf("service: Could not connect to field type service: %v",
+			err)
+	}
+	fieldTypeClients[path] = client
+	return client, nil
+}
+
+// ModuleField is a field whose type is provided by a module.
+type ModuleField struct {
+	Type  string
+	Field *NodeField
+	// Value is the JSON encoded value.
+	Value []byte
+	// path is the path of the field type's service.
+	path string
+}
+
+func (t *ModuleField) Init(m *MonstiClient, site string) error {
+	if m == nil {
+		return fmt.Errorf("Unknown field type %q", t.Type)
+	}
+	path, err := getFieldTypePath(m, t.Type)
+	if err != nil {
+		return err
+	}
+	if path == "" {
+		return fmt.Errorf("Unknown field type %q", t.Type)
+	}
+	t.path = path
+	return nil
+}
+
+// call calls the given method of the field type's service.
+func (t ModuleField) call(method string, args *FieldTypeArgs,
+	reply interface{}) error {
+	args.Type = t.Type
+	args.Field = t.Field
+	args.Value = t.Value
+	return callFieldType(t.path, method, args, reply)
+}
+
+func (t ModuleField) String() string {
+	var reply string
+	if err := t.call("String", &FieldTypeArgs{}, &reply); err != nil {
+		return ""
+	}
+	return reply
+}
+
+func (t ModuleField) RenderHTML() interface{} {
+	var reply string
+	if err := t.call("RenderHTML", &FieldTypeArgs{}, &reply); err != nil {
+		return ""
+	}
+	return template.HTML(reply)
+}
+
+func (t *ModuleField) Load(f func(interface{}) error) error {
+	var value json.RawMessage
+	if err := f(&value); err != nil {
+		return err
+	}
+	t.Value = value
+	return nil
+}
+
+func (t ModuleField) Dump() interface{} {
+	if t.Value == nil {
+		return nil
+	}
+	value := json.RawMessage(t.Value)
+	return &value
+}
+
+func (t ModuleField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	var widget FieldWidget
+	if err := t.call("FormWidget", &FieldTypeArgs{Locale: locale},
+		&widget); err != nil {
+		widget = FieldWidget{Description: err.Error()}
+	}
+	data.Set(field.Id, widget.Value)
+	var formWidget htmlwidgets.Widget
+	switch widget.Type {
+	case "textarea":
+		formWidget = new(htmlwidgets.TextAreaWidget)
+	case "hidden":
+		formWidget = new(htmlwidgets.HiddenWidget)
+	default:
+		formWidget = new(htmlwidgets.TextWidget)
+	}
+	formWidget.Base().Classes = widget.Classes
+	form.AddWidget(formWidget, "Fields."+field.Id, field.Name[locale],
+		widget.Description)
+}
+
+// parse parses the form value of the field.
+func (t ModuleField) parse(data util.NestedMap, field *NodeField,
+	locale string) (*FieldTypeParseRet, error) {
+	var ret FieldTypeParseRet
+	formValue, _ := data.Get(field.Id).(string)
+	err := t.call("Parse", &FieldTypeArgs{FormValue: formValue,
+		Locale: locale}, &ret)
+	return &ret, err
+}
+
+func (t *ModuleField) FromFormField(data util.NestedMap, field *NodeField) {
+	ret, err := t.parse(data, field, "")
+	if err == nil && ret.Invalid == "" {
+		t.Value = ret.Value
+	}
+}
+
+func (t ModuleField) ValidateFormField(data util.NestedMap, field *NodeField,
+	locale string) string {
+	ret, err := t.parse(data, field, locale)
+	if err != nil {
+		return err.Error()
+	}
+	return ret.Invalid
+}
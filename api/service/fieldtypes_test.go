@@ -0,0 +1,126 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// upperFieldType stores upper case strings.
+type upperFieldType struct{}
+
+func (upperFieldType) String(value []byte, _ *NodeField) (string, error) {
+	var ret string
+	if value != nil {
+		err := json.Unmarshal(value, &ret)
+		return ret, err
+	}
+	return ret, nil
+}
+
+func (f upperFieldType) RenderHTML(value []byte, field *NodeField) (
+	string, error) {
+	ret, err := f.String(value, field)
+	return "<b>" + ret + "</b>", err
+}
+
+func (f upperFieldType) FormWidget(value []byte, field *NodeField,
+	locale string) (*FieldWidget, error) {
+	ret, err := f.String(value, field)
+	return &FieldWidget{Type: "textarea", Value: ret}, err
+}
+
+func (upperFieldType) Parse(formValue string, _ *NodeField, locale string) (
+	[]byte, string, error) {
+	if formValue == "" {
+		return nil, "Required.", nil
+	}
+	value, err := json.Marshal(strings.ToUpper(formValue))
+	return value, "", err
+}
+
+func TestModuleField(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-test")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fields.socket")
+	provider := NewProvider("FieldType", &fieldTypeService{
+		map[string]FieldType{"test.Upper": upperFieldType{}}})
+	if err := provider.Listen(path); err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	go provider.Accept()
+
+	types, err := GetFieldTypes(path)
+	if err != nil {
+		t.Fatalf("GetFieldTypes returned error: %v", err)
+	}
+	if !reflect.DeepEqual(types, []string{"test.Upper"}) {
+		t.Errorf(`GetFieldTypes(...) = %v, should be ["test.Upper"]`, types)
+	}
+
+	nodeField := &NodeField{Id: "test.Foo", Type: "test.Upper"}
+	field := &ModuleField{Type: "test.Upper", Field: nodeField, path: path}
+	if dump := field.Dump(); dump != nil {
+		t.Errorf("Dump() of empty field = %v, should be nil", dump)
+	}
+	if err := field.Load(func(in interface{}) error {
+		return json.Unmarshal([]byte(`"FOO"`), in)
+	}); err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if ret := field.String(); ret != "FOO" {
+		t.Errorf("String() = %q, should be %q", ret, "FOO")
+	}
+	if ret := field.RenderHTML(); ret != template.HTML("<b>FOO</b>") {
+		t.Errorf("RenderHTML() = %q, should be %q", ret, "<b>FOO</b>")
+	}
+
+	fieldTypeClientsMutex.Lock()
+	fieldTypeClients[path].Close()
+	fieldTypeClientsMutex.Unlock()
+	if ret := field.String(); ret != "FOO" {
+		t.Errorf("String() after connection loss = %q, should be %q", ret, "FOO")
+	}
+
+	data := util.NestedMap{}
+	data.Set("test.Foo", "")
+	if msg := field.ValidateFormField(data, nodeField, "en"); msg != "Required." {
+		t.Errorf("ValidateFormField(...) = %q, should be %q", msg, "Required.")
+	}
+	data.Set("test.Foo", "bar")
+	if msg := field.ValidateFormField(data, nodeField, "en"); msg != "" {
+		t.Errorf("ValidateFormField(...) = %q, should be empty", msg)
+	}
+	field.FromFormField(data, nodeField)
+	dump, err := json.Marshal(field.Dump())
+	if err != nil || string(dump) != `"BAR"` {
+		t.Errorf("Dump() after FromFormField = %s (%v), should be %q", dump, err,
+			`"BAR"`)
+	}
+}
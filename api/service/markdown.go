@@ -0,0 +1,96 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"crypto/sha1"
+	"html/template"
+	"sync"
+
+	"github.com/chrneumann/htmlwidgets"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/russross/blackfriday"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// maxMarkdownCacheEntries is the number of rendered Markdown sources
+// to keep. The cache gets cleared if it's full.
+const maxMarkdownCacheEntries = 1000
+
+// markdownCache maps hashes of Markdown sources to their renderings.
+var markdownCache = struct {
+	sync.Mutex
+	entries map[[sha1.Size]byte]template.HTML
+}{entries: make(map[[sha1.Size]byte]template.HTML)}
+
+// RenderMarkdown renders the given Markdown source to sanitized HTML.
+//
+// Raw HTML within the source is allowed as far as it's safe for user
+// generated content. Renderings are cached.
+func RenderMarkdown(source string) template.HTML {
+	key := sha1.Sum([]byte(source))
+	markdownCache.Lock()
+	rendered, ok := markdownCache.entries[key]
+	markdownCache.Unlock()
+	if ok {
+		return rendered
+	}
+	rendered = template.HTML(bluemonday.UGCPolicy().SanitizeBytes(
+		blackfriday.MarkdownCommon([]byte(source))))
+	markdownCache.Lock()
+	if len(markdownCache.entries) >= maxMarkdownCacheEntries {
+		markdownCache.entries = make(map[[sha1.Size]byte]template.HTML)
+	}
+	markdownCache.entries[key] = rendered
+	markdownCache.Unlock()
+	return rendered
+}
+
+// MarkdownField is a text area containing Markdown.
+type MarkdownField string
+
+func (t MarkdownField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t MarkdownField) String() string {
+	return string(t)
+}
+
+func (t MarkdownField) RenderHTML() interface{} {
+	return RenderMarkdown(string(t))
+}
+
+func (t *MarkdownField) Load(f func(interface{}) error) error {
+	return f(t)
+}
+
+func (t MarkdownField) Dump() interface{} {
+	return string(t)
+}
+
+func (t MarkdownField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	data.Set(field.Id, string(t))
+	widget := form.AddWidget(new(htmlwidgets.TextAreaWidget), "Fields."+field.Id,
+		field.Name[locale], "")
+	widget.Base().Classes = []string{"markdown-field"}
+}
+
+func (t *MarkdownField) FromFormField(data util.NestedMap, field *NodeField) {
+	*t = MarkdownField(data.Get(field.Id).(string))
+}
@@ -0,0 +1,120 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+
+	"github.com/chrneumann/htmlwidgets"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// MediaField is an uploaded video (field type "Video") or audio file
+// (field type "Audio"). The file is stored as node data
+// "__file_<field id>", the field holds its metadata.
+type MediaField struct {
+	// MIMEType is the detected type of the file, e.g. "video/mp4".
+	MIMEType string `json:",omitempty"`
+	// Duration is the play time of the file if it could be determined.
+	Duration time.Duration `json:",omitempty"`
+	// Poster is true if a poster frame of the video has been generated.
+	// It's stored as node data "__poster_<field id>".
+	Poster bool `json:",omitempty"`
+	// kind is either "video" or "audio".
+	kind string
+	// url is the URL of the file, e.g. "/foo/_files/example.Video".
+	url string
+}
+
+// Kind returns the kind of the field, i.e. "video" or "audio".
+func (t MediaField) Kind() string {
+	return t.kind
+}
+
+// URL returns the URL of the uploaded file. Posters are served at the
+// URL suffixed with "/poster".
+func (t MediaField) URL() string {
+	return t.url
+}
+
+func (t MediaField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+// RenderHTML returns a player with controls for the file.
+func (t MediaField) RenderHTML() interface{} {
+	return t.Player("controls")
+}
+
+// Player returns an HTML5 video or audio element playing the file.
+// The given attributes (e.g. "controls", "autoplay" or "loop") are
+// added to the element. Returns an empty string if no file has been
+// uploaded.
+func (t MediaField) Player(attributes ...string) template.HTML {
+	if t.MIMEType == "" || t.url == "" {
+		return ""
+	}
+	tag := "audio"
+	if t.kind == "video" {
+		tag = "video"
+	}
+	attrs := []string{`preload="metadata"`}
+	for _, attr := range attributes {
+		attrs = append(attrs, template.HTMLEscapeString(attr))
+	}
+	if t.Poster {
+		attrs = append(attrs, `poster="`+template.HTMLEscapeString(t.url)+
+			`/poster"`)
+	}
+	return template.HTML(fmt.Sprintf(
+		`<%v %v><source src="%v" type="%v"><a href="%v">%v</a></%v>`,
+		tag, strings.Join(attrs, " "), template.HTMLEscapeString(t.url),
+		template.HTMLEscapeString(t.MIMEType), template.HTMLEscapeString(t.url),
+		template.HTMLEscapeString(t.url), tag))
+}
+
+func (t MediaField) String() string {
+	if t.Duration > 0 {
+		return fmt.Sprintf("%v (%v)", t.MIMEType, t.Duration)
+	}
+	return t.MIMEType
+}
+
+func (t *MediaField) Load(f func(interface{}) error) error {
+	return f(t)
+}
+
+func (t MediaField) Dump() interface{} {
+	return t
+}
+
+// ToFormField adds a file widget. The daemon validates uploaded files
+// and sets the field's metadata.
+func (t MediaField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	data.Set(field.Id, "")
+	form.AddWidget(new(htmlwidgets.FileWidget), "Fields."+field.Id,
+		field.Name[locale], "")
+}
+
+// FromFormField keeps the field's metadata as it only changes with
+// uploaded files.
+func (t *MediaField) FromFormField(util.NestedMap, *NodeField) {
+}
@@ -22,6 +22,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"reflect"
 	"runtime/debug"
@@ -35,6 +36,8 @@ import (
 type MonstiClient struct {
 	Client
 	SignalHandlers map[string]func(interface{}) (interface{}, error)
+	// signalTrace is the span of the signal being handled, if traced.
+	signalTrace *SpanContext
 }
 
 // NewMonstiConnection establishes a new RPC connection to a Monsti service.
@@ -64,6 +67,92 @@ func (s *MonstiClient) ModuleInitDone(module string) error {
 	return nil
 }
 
+// ModuleStatus describes a module of the Monsti instance.
+type ModuleStatus struct {
+	Name string
+	// Ready is true if the module has finished its initialization.
+	Ready bool
+	// Since is the time the module became ready.
+	Since time.Time
+}
+
+// FailedSignal describes an emitted signal answered with an error.
+type FailedSignal struct {
+	Time   time.Time
+	Signal string
+	Error  string
+}
+
+// SystemStatus describes the state of the Monsti instance.
+type SystemStatus struct {
+	// Start is the start time of the daemon.
+	Start   time.Time
+	Modules []ModuleStatus
+	// FailedSignals are the latest failed signals, newest first.
+	FailedSignals []FailedSignal
+	// Mails counts the queued (Pending), sent and failed or bounced
+	// mails of the mail queue.
+	Mails struct {
+		Pending, Sent, Failed int
+	}
+	// Jobs counts the queued, running and dead jobs of the job queue.
+	Jobs struct {
+		Queued, Running, Dead int
+	}
+	// Tasks are the scheduled tasks ordered by id and site.
+	Tasks []TaskStatus
+}
+
+// TaskStatus describes a scheduled task, see Task.
+type TaskStatus struct {
+	// Task is the id of the task and Site the site it runs for, if
+	// any.
+	Task, Site, Schedule string
+	// Next is the time of the next run.
+	Next time.Time
+	// Running is set while the task runs.
+	Running bool
+	// LastRun is the start time of the last run, if any, Duration its
+	// duration and Error the reason why it failed.
+	LastRun  time.Time
+	Duration time.Duration
+	Error    string
+}
+
+// GetSystemStatus returns the state of the Monsti instance.
+func (s *MonstiClient) GetSystemStatus() (*SystemStatus, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	var reply SystemStatus
+	err := s.RPCClient.Call("Monsti.GetSystemStatus", 0, &reply)
+	if err != nil {
+		return nil, fmt.Errorf("service: GetSystemStatus error: %v", err)
+	}
+	return &reply, nil
+}
+
+// LogEntry is a line logged by the daemon or its modules.
+type LogEntry struct {
+	// Seq is the increasing sequence number of the entry.
+	Seq  int
+	Line string
+}
+
+// GetLog returns the entries logged after the entry with the given
+// sequence number, oldest first. Only the latest entries are kept by
+// the daemon. Use -1 to get all kept entries.
+func (s *MonstiClient) GetLog(after int) ([]*LogEntry, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	var reply []*LogEntry
+	if err := s.RPCClient.Call("Monsti.GetLog", after, &reply); err != nil {
+		return nil, fmt.Errorf("service: GetLog error: %v", err)
+	}
+	return reply, nil
+}
+
 // nodeToData converts the node to a JSON document.
 // The Path field will be omitted.
 func nodeToData(node *Node, indent bool) ([]byte, error) {
@@ -78,9 +167,21 @@ func nodeToData(node *Node, indent bool) ([]byte, error) {
 	var outNode nodeJSON
 	outNode.Node = *node
 	outNode.Type = node.Type.Id
+	outNode.SchemaVersion = node.Type.SchemaVersion()
 	outNode.Fields = make(map[string]map[string]*json.RawMessage)
+	if node.stored != nil && node.stored.SchemaVersion < outNode.SchemaVersion {
+		// Keep the pending schema so that the migrations can still be
+		// applied later.
+		outNode.SchemaVersion = node.stored.SchemaVersion
+		for namespace, values := range node.stored.Fields {
+			outNode.Fields[namespace] = make(map[string]*json.RawMessage)
+			for name, value := range values {
+				outNode.Fields[namespace][name] = value
+			}
+		}
+	}
 
-	nodeFields := append(node.Type.Fields, node.LocalFields...)
+	nodeFields := node.AllFields()
 	for _, field := range nodeFields {
 		parts := strings.SplitN(field.Id, ".", 2)
 		dump, err := json.Marshal(node.Fields[field.Id].Dump())
@@ -126,8 +227,11 @@ func (s *MonstiClient) WriteNode(site, path string, node *Node) error {
 
 type nodeJSON struct {
 	Node
-	Type   string
-	Fields map[string]map[string]*json.RawMessage
+	Type string
+	// SchemaVersion is the version of the node type's migrations the
+	// node has been written with.
+	SchemaVersion int `json:",omitempty"`
+	Fields        map[string]map[string]*json.RawMessage
 }
 
 // dataToNode unmarshals given data
@@ -153,7 +257,7 @@ func dataToNode(data []byte,
 	if err = ret.InitFields(m, site); err != nil {
 		return nil, fmt.Errorf("Could not init node fields: %v", err)
 	}
-	nodeFields := append(ret.Type.Fields, ret.LocalFields...)
+	nodeFields := ret.AllFields()
 	for _, field := range nodeFields {
 		parts := strings.SplitN(field.Id, ".", 2)
 		value := node.Fields[parts[0]][parts[1]]
@@ -163,6 +267,11 @@ func dataToNode(data []byte,
 			}
 			ret.Fields[field.Id].Load(f)
 		}
+		delete(node.Fields[parts[0]], parts[1])
+	}
+	if node.SchemaVersion < ret.Type.SchemaVersion() {
+		ret.stored = &storedSchema{SchemaVersion: node.SchemaVersion,
+			Fields: node.Fields}
 	}
 	return &ret, nil
 }
@@ -187,7 +296,28 @@ func (s *MonstiClient) GetNode(site, path string) (*Node, error) {
 	return node, nil
 }
 
-// GetChildren returns the children of the given node.
+// MarshalNode returns the JSON document of the node as stored in
+// node.json files. The path is omitted.
+func MarshalNode(node *Node) ([]byte, error) {
+	return nodeToData(node, true)
+}
+
+// UnmarshalNode converts the JSON document of a node of the given
+// site as returned by MarshalNode. The node type must be registered.
+func (s *MonstiClient) UnmarshalNode(site string, data []byte) (*Node,
+	error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	node, err := dataToNode(data, s.GetNodeType, s, site)
+	if err != nil {
+		return nil, fmt.Errorf("service: Could not convert node: %v", err)
+	}
+	return node, nil
+}
+
+// GetChildren returns the children of the given node in the order
+// they should be listed, see Node.ListedBefore.
 func (s *MonstiClient) GetChildren(site, path string) ([]*Node, error) {
 	if s.Error != nil {
 		return nil, s.Error
@@ -207,6 +337,7 @@ func (s *MonstiClient) GetChildren(site, path string) ([]*Node, error) {
 		}
 		nodes = append(nodes, node)
 	}
+	SortNodes(nodes)
 	return nodes, nil
 }
 
@@ -229,6 +360,20 @@ func (s *MonstiClient) GetNodeData(site, path, file string) ([]byte, error) {
 	return reply, nil
 }
 
+// GetNodeFiles returns the sorted names of the data files of the
+// given node, i.e. the files read by GetNodeData besides node.json.
+func (s *MonstiClient) GetNodeFiles(site, path string) ([]string, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct{ Site, Path string }{site, path}
+	var reply []string
+	if err := s.RPCClient.Call("Monsti.GetNodeFiles", args, &reply); err != nil {
+		return nil, fmt.Errorf("service: GetNodeFiles error: %v", err)
+	}
+	return reply, nil
+}
+
 // WriteNodeData writes data for some node.
 func (s *MonstiClient) WriteNodeData(site, path, file string,
 	content []byte) error {
@@ -260,6 +405,23 @@ func (s *MonstiClient) RemoveNode(site string, node string) error {
 	return nil
 }
 
+// ArchiveNode moves the subtree of the given site's node into a
+// compressed archive.
+//
+// Archived nodes can still be read but not changed.
+func (s *MonstiClient) ArchiveNode(site string, node string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct {
+		Site, Node string
+	}{site, node}
+	if err := s.RPCClient.Call("Monsti.ArchiveNode", args, new(int)); err != nil {
+		return fmt.Errorf("service: ArchiveNode error: %v", err)
+	}
+	return nil
+}
+
 // RenameNode renames (moves) the given site's node.
 //
 // Source and target path must be absolute
@@ -276,6 +438,508 @@ func (s *MonstiClient) RenameNode(site, source, target string) error {
 	return nil
 }
 
+// CopyNode copies the given site's node including its subtree. The
+// copy starts with an empty timeline.
+//
+// Source and target path must be absolute. The target must not exist.
+func (s *MonstiClient) CopyNode(site, source, target string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct {
+		Site, Source, Target string
+	}{site, source, target}
+	if err := s.RPCClient.Call("Monsti.CopyNode", args, new(int)); err != nil {
+		return fmt.Errorf("service: CopyNode error: %v", err)
+	}
+	return nil
+}
+
+// Types of node events recorded by Monsti. Modules may record events
+// of their own types, e.g. "example.Comment".
+const (
+	NodeCreatedEvent      = "core.Created"
+	NodeChangedEvent      = "core.Changed"
+	NodeRenamedEvent      = "core.Renamed"
+	NodeRescheduledEvent  = "core.Rescheduled"
+	NodeArchivedEvent     = "core.Archived"
+	ReferenceAddedEvent   = "core.ReferenceAdded"
+	ReferenceRemovedEvent = "core.ReferenceRemoved"
+)
+
+// NodeEvent is an entry in the timeline of a node.
+type NodeEvent struct {
+	Time time.Time
+	Type string
+	// User is the login of the user causing the event, if any.
+	User string `json:",omitempty"`
+	// From and To are the old and new paths of renamed nodes.
+	From, To string `json:",omitempty"`
+	// Target is the path of the added or removed reference.
+	Target string `json:",omitempty"`
+	// Description describes events of module defined types.
+	Description string `json:",omitempty"`
+}
+
+// AddNodeEvent appends the event to the timeline of the given site's
+// node. The time will be set to the current time if it's zero.
+func (s *MonstiClient) AddNodeEvent(site, path string, event *NodeEvent) error {
+	if s.Error != nil {
+		return nil
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	args := struct {
+		Site, Path string
+		Event      *NodeEvent
+	}{site, path, event}
+	if err := s.RPCClient.Call("Monsti.AddNodeEvent", args, new(int)); err != nil {
+		return fmt.Errorf("service: AddNodeEvent error: %v", err)
+	}
+	return nil
+}
+
+// GetNodeEvents returns the timeline of the given site's node, oldest
+// events first.
+func (s *MonstiClient) GetNodeEvents(site, path string) ([]*NodeEvent, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct{ Site, Path string }{site, path}
+	var reply []*NodeEvent
+	if err := s.RPCClient.Call("Monsti.GetNodeEvents", args, &reply); err != nil {
+		return nil, fmt.Errorf("service: GetNodeEvents error: %v", err)
+	}
+	return reply, nil
+}
+
+// Menu is a named menu of a site, e.g. "main" or "footer".
+type Menu struct {
+	Name string
+	// Entries are ordered as shown.
+	Entries []*MenuEntry
+}
+
+// MenuEntry is an entry of a menu linking either to a node or to an
+// external URL.
+type MenuEntry struct {
+	// Title is the shown text. Defaults to the node's title for entries
+	// linking to nodes.
+	Title string `json:",omitempty"`
+	// Node is the path of the linked node.
+	Node string `json:",omitempty"`
+	// URL is the linked external URL, used if Node is empty.
+	URL string `json:",omitempty"`
+}
+
+// GetMenu returns the named menu of the given site. Missing menus are
+// returned without entries.
+func (s *MonstiClient) GetMenu(site, name string) (*Menu, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct{ Site, Name string }{site, name}
+	var reply Menu
+	if err := s.RPCClient.Call("Monsti.GetMenu", args, &reply); err != nil {
+		return nil, fmt.Errorf("service: GetMenu error: %v", err)
+	}
+	return &reply, nil
+}
+
+// Block is a reusable piece of content shown in a region of the
+// master template, e.g. the sidebar.
+type Block struct {
+	Id string
+	// Type is one of "text", "image", "embed" and "listing".
+	Type  string
+	Title string `json:",omitempty"`
+	// Region is the name of the region showing the block.
+	Region string
+	// Node restricts the block to the node at this path. Blocks without
+	// a node are shown on all nodes of the site.
+	Node string `json:",omitempty"`
+	// Subtree is true if the block is also shown below Node.
+	Subtree bool `json:",omitempty"`
+	// Text is the sanitized HTML of text blocks or the embed code of
+	// embed blocks.
+	Text string `json:",omitempty"`
+	// Target is the path of the image node of image blocks or of the
+	// node whose children are listed by listing blocks.
+	Target string `json:",omitempty"`
+	// Limit is the maximum number of nodes listed by listing blocks.
+	// Zero lists all children.
+	Limit int `json:",omitempty"`
+}
+
+// GetBlocks returns the blocks of the given site in the order they
+// are shown.
+func (s *MonstiClient) GetBlocks(site string) ([]*Block, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct{ Site string }{site}
+	var reply []*Block
+	if err := s.RPCClient.Call("Monsti.GetBlocks", args, &reply); err != nil {
+		return nil, fmt.Errorf("service: GetBlocks error: %v", err)
+	}
+	return reply, nil
+}
+
+// NewSite describes a site to be created by CreateSite.
+type NewSite struct {
+	// Name of the site's configuration and data directories, e.g.
+	// "example".
+	Name string
+	// Title of the site. Defaults to the name.
+	Title string
+	// Hosts delivering the site, e.g. ["example.com"]. The first one is
+	// used for the base URL and the site's email address.
+	Hosts []string
+	// Locale of the site. Defaults to "en".
+	Locale string
+	// Login, email address and (unhashed) password of the site's
+	// initial administrator. The login defaults to "admin".
+	AdminLogin, AdminEmail, AdminPassword string
+}
+
+// SiteInfo describes a configured site.
+type SiteInfo struct {
+	Name, Title, Locale string
+	Hosts               []string
+	// Active is true if the site is served by the running daemon. New
+	// sites get served after restarting the daemon.
+	Active bool
+}
+
+// SiteClone describes a copy of a site made by CloneSite, e.g. a
+// staging site.
+type SiteClone struct {
+	// Source is the name of the copied site, Name the one of the copy.
+	Source, Name string
+	// Domains maps hosts of the source site to the ones of the copy,
+	// e.g. {"example.com": "staging.example.com"}. They get replaced in
+	// the copy's configuration and nodes.
+	Domains map[string]string
+}
+
+// CreateSite scaffolds a new site: its configuration, data
+// directories, initial administrator and home node.
+func (s *MonstiClient) CreateSite(site *NewSite) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	if err := s.RPCClient.Call("Monsti.CreateSite", site, new(int)); err != nil {
+		return fmt.Errorf("service: CreateSite error: %v", err)
+	}
+	return nil
+}
+
+// RemoveSite removes the configuration and all data of the given
+// site. Sites served by the running daemon can't be removed.
+func (s *MonstiClient) RemoveSite(name string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct{ Name string }{name}
+	if err := s.RPCClient.Call("Monsti.RemoveSite", args, new(int)); err != nil {
+		return fmt.Errorf("service: RemoveSite error: %v", err)
+	}
+	return nil
+}
+
+// CloneSite copies the nodes, configuration and users of a site to a
+// new site, rewriting its domains. The copy gets new signing keys.
+func (s *MonstiClient) CloneSite(clone *SiteClone) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	if err := s.RPCClient.Call("Monsti.CloneSite", clone, new(int)); err != nil {
+		return fmt.Errorf("service: CloneSite error: %v", err)
+	}
+	return nil
+}
+
+// PromoteSite swaps the nodes of the staging site (e.g. made by
+// CloneSite) and the production site. Promoting again reverts the
+// promotion.
+func (s *MonstiClient) PromoteSite(staging, production string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct{ Staging, Production string }{staging, production}
+	if err := s.RPCClient.Call("Monsti.PromoteSite", args, new(int)); err != nil {
+		return fmt.Errorf("service: PromoteSite error: %v", err)
+	}
+	return nil
+}
+
+// ExportSite writes the nodes, data files, configuration and users of
+// the site to a tar.gz archive at the given path on the daemon's host.
+func (s *MonstiClient) ExportSite(site, file string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct{ Site, File string }{site, file}
+	if err := s.RPCClient.Call("Monsti.ExportSite", args, new(int)); err != nil {
+		return fmt.Errorf("service: ExportSite error: %v", err)
+	}
+	return nil
+}
+
+// ImportSite restores a site from an archive written by ExportSite at
+// the given path on the daemon's host. If name is empty, the site gets
+// the name of the exported site.
+func (s *MonstiClient) ImportSite(file, name string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct{ File, Name string }{file, name}
+	if err := s.RPCClient.Call("Monsti.ImportSite", args, new(int)); err != nil {
+		return fmt.Errorf("service: ImportSite error: %v", err)
+	}
+	return nil
+}
+
+// ListSites returns the configured sites ordered by name.
+func (s *MonstiClient) ListSites() ([]*SiteInfo, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	var reply []*SiteInfo
+	if err := s.RPCClient.Call("Monsti.ListSites", 0, &reply); err != nil {
+		return nil, fmt.Errorf("service: ListSites error: %v", err)
+	}
+	return reply, nil
+}
+
+// BulkOp is an operation applied to multiple nodes by BulkNodeOp.
+type BulkOp string
+
+const (
+	// BulkRemove removes the nodes.
+	BulkRemove BulkOp = "remove"
+	// BulkMove moves the nodes below the target path.
+	BulkMove BulkOp = "move"
+	// BulkPublish and BulkUnpublish set the Public attribute of the
+	// nodes.
+	BulkPublish   BulkOp = "publish"
+	BulkUnpublish BulkOp = "unpublish"
+	// BulkChangeType changes the type of the nodes to the target node
+	// type. All fields of a node's type must exist with the same field
+	// type in the target type, so no field values get lost.
+	BulkChangeType BulkOp = "changetype"
+)
+
+// BulkNodeResult is the outcome of a bulk operation on one node.
+type BulkNodeResult struct {
+	// Path is the path of the node before the operation.
+	Path string
+	// NewPath is the path of the node after the operation, e.g. of a
+	// moved node. It's empty for removed nodes.
+	NewPath string
+	// Error describes why the operation failed for the node or is empty
+	// on success.
+	Error string `json:",omitempty"`
+}
+
+// BulkNodeOp applies the operation to the given site's nodes at the
+// given paths. The target is the path of the new parent for BulkMove
+// and the id of the new node type for BulkChangeType.
+//
+// Nodes are processed independently, failures for single nodes are
+// returned as results and don't stop the operation.
+func (s *MonstiClient) BulkNodeOp(site string, op BulkOp, paths []string,
+	target string) ([]BulkNodeResult, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct {
+		Site   string
+		Op     BulkOp
+		Paths  []string
+		Target string
+	}{site, op, paths, target}
+	var reply []BulkNodeResult
+	if err := s.RPCClient.Call("Monsti.BulkNodeOp", args, &reply); err != nil {
+		return nil, fmt.Errorf("service: BulkNodeOp error: %v", err)
+	}
+	return reply, nil
+}
+
+// MediaQuery selects items of the media library, see QueryMedia.
+type MediaQuery struct {
+	// Text must be contained in the path, title or alternative text of
+	// the items, ignoring case.
+	Text string
+	// Tags holds the tags the items must have.
+	Tags []string
+	// Type restricts the items to the given node type, i.e.
+	// "core.Image" or "core.File".
+	Type string
+}
+
+// MediaItem is an image or file node of a site's media library.
+type MediaItem struct {
+	Path, Title, Type string
+	Tags              []string
+	AltText           string
+	// UsedBy holds the paths of the nodes referencing the item.
+	UsedBy []string
+}
+
+// QueryMedia returns the image and file nodes of the given site
+// matching the query, ordered by path.
+func (s *MonstiClient) QueryMedia(site string, query *MediaQuery) (
+	[]*MediaItem, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct {
+		Site  string
+		Query *MediaQuery
+	}{site, query}
+	var reply []*MediaItem
+	if err := s.RPCClient.Call("Monsti.QueryMedia", args, &reply); err != nil {
+		return nil, fmt.Errorf("service: QueryMedia error: %v", err)
+	}
+	return reply, nil
+}
+
+// PendingMigration is a node whose data has to be migrated to the
+// schema version of its node type.
+type PendingMigration struct {
+	Path, NodeType string
+	// Version is the schema version of the node's data and Target the
+	// one of its node type.
+	Version, Target int
+}
+
+// PendingMigrations returns the nodes of the site which have to be
+// migrated, ordered by path. Archived nodes are not migrated.
+func (s *MonstiClient) PendingMigrations(site string) ([]*PendingMigration,
+	error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	var reply []*PendingMigration
+	if err := s.RPCClient.Call("Monsti.PendingMigrations", site,
+		&reply); err != nil {
+		return nil, fmt.Errorf("service: PendingMigrations error: %v", err)
+	}
+	return reply, nil
+}
+
+// MigrationResult describes the migration of a node.
+type MigrationResult struct {
+	// From and To are the schema versions before and after the
+	// migration.
+	From, To int
+	// Applied are the descriptions of the applied migrations.
+	Applied []string
+	// Data is the migrated node.json.
+	Data []byte
+}
+
+// MigrateNode migrates the data of the given node to the schema
+// version of its node type. If dryRun is set, the migrated node does
+// not get written.
+func (s *MonstiClient) MigrateNode(site, path string, dryRun bool) (
+	*MigrationResult, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct {
+		Site, Path string
+		DryRun     bool
+	}{site, path, dryRun}
+	var reply MigrationResult
+	if err := s.RPCClient.Call("Monsti.MigrateNode", args, &reply); err != nil {
+		return nil, fmt.Errorf("service: MigrateNode error: %v", err)
+	}
+	return &reply, nil
+}
+
+// Kinds of problems found by CheckNodes.
+const (
+	// IssueMalformedNode is a node.json which can't be parsed or lacks
+	// the node type.
+	IssueMalformedNode = "malformed-node"
+	// IssueUnknownType is a node of a node type which is not
+	// registered.
+	IssueUnknownType = "unknown-type"
+	// IssueDanglingRef is an embed or a MultiRef field referencing a
+	// missing node.
+	IssueDanglingRef = "dangling-ref"
+	// IssueOrphanedData is a file which does not belong to any node.
+	IssueOrphanedData = "orphaned-data"
+	// IssuePathMismatch is a node.json storing a path which differs
+	// from the node's location.
+	IssuePathMismatch = "path-mismatch"
+)
+
+// NodeIssue is a problem in the node tree of a site.
+type NodeIssue struct {
+	// Path is the path of the affected node or file.
+	Path string
+	// Check is the kind of the problem, e.g. IssueDanglingRef.
+	Check  string
+	Detail string
+	// Fixed is set if the problem has been repaired.
+	Fixed bool
+}
+
+// CheckNodes checks the node tree of the site for malformed nodes,
+// unknown node types, dangling references, orphaned data files and
+// mismatching paths, ordered by path. If fix is set, problems which
+// can be repaired safely get fixed: Dangling MultiRef paths and stored
+// paths get removed and orphaned files get moved to the lost+found
+// directory of the site's data directory.
+func (s *MonstiClient) CheckNodes(site string, fix bool) ([]*NodeIssue,
+	error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct {
+		Site string
+		Fix  bool
+	}{site, fix}
+	var reply []*NodeIssue
+	if err := s.RPCClient.Call("Monsti.CheckNodes", args, &reply); err != nil {
+		return nil, fmt.Errorf("service: CheckNodes error: %v", err)
+	}
+	return reply, nil
+}
+
+// PurgeCache purges the given node paths of the site from the caching
+// proxies configured by core.cache.purge.
+func (s *MonstiClient) PurgeCache(site string, paths []string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct {
+		Site  string
+		Paths []string
+	}{site, paths}
+	if err := s.RPCClient.Call("Monsti.PurgeCache", args, new(int)); err != nil {
+		return fmt.Errorf("service: PurgeCache error: %v", err)
+	}
+	return nil
+}
+
+// ClearTemplateCache clears the daemon's cache of template files, e.g.
+// after templates have been changed.
+func (s *MonstiClient) ClearTemplateCache() error {
+	if s.Error != nil {
+		return s.Error
+	}
+	if err := s.RPCClient.Call("Monsti.ClearTemplateCache", 0,
+		new(int)); err != nil {
+		return fmt.Errorf("service: ClearTemplateCache error: %v", err)
+	}
+	return nil
+}
+
 func getConfig(reply []byte, out interface{}) error {
 	if len(reply) == 0 {
 		return nil
@@ -309,6 +973,198 @@ func (s *MonstiClient) GetSiteConfig(site, name string, out interface{}) error {
 	return getConfig(reply, out)
 }
 
+// ConfigSchema describes the site local configuration of a module.
+type ConfigSchema struct {
+	// Id of the module, e.g. "core".
+	Id string
+	// The name of the configuration as shown in the web interface,
+	// specified as a translation map (language -> msg).
+	Name map[string]string
+	// Options of the configuration. The option ids are the names used
+	// by GetSiteConfig, e.g. "core.timezone".
+	Options []*NodeField
+	// Sections are the names of nested configuration sections which
+	// may hold arbitrary values, e.g. "core.image". They can't be
+	// edited using the settings page.
+	Sections []string
+}
+
+// GetLocalName returns the name of the configuration in the given
+// language.
+//
+// Falls back to the "en" locale or the id.
+func (s ConfigSchema) GetLocalName(locale string) string {
+	name, ok := s.Name[locale]
+	if !ok {
+		name, ok = s.Name["en"]
+	}
+	if !ok {
+		name = s.Id
+	}
+	return name
+}
+
+// RegisterConfigSchema registers the schema of a module's site local
+// configuration.
+//
+// The configuration files of all sites will be validated against the
+// schema. Problems, e.g. unknown keys, get logged by Monsti. Once
+// registered, GetSiteConfig fails for names not declared by the
+// schema.
+func (s *MonstiClient) RegisterConfigSchema(schema *ConfigSchema) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	err := s.RPCClient.Call("Monsti.RegisterConfigSchema", schema, new(int))
+	if err != nil {
+		return fmt.Errorf("service: RegisterConfigSchema error: %v", err)
+	}
+	return nil
+}
+
+// GetConfigSchemas returns all registered configuration schemas
+// ordered by their ids.
+func (s *MonstiClient) GetConfigSchemas() ([]*ConfigSchema, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	var schemas []*ConfigSchema
+	err := s.RPCClient.Call("Monsti.GetConfigSchemas", 0, &schemas)
+	if err != nil {
+		return nil, fmt.Errorf("service: GetConfigSchemas error: %v", err)
+	}
+	return schemas, nil
+}
+
+// TemplateFunc is a template function provided by a module. Modules
+// compute its results by handling the monsti.TemplateFunc signal.
+type TemplateFunc struct {
+	// Name of the function in templates, e.g. "exampleGreeting". It
+	// must not be taken by another function.
+	Name string
+	// Sandboxed functions may be called by site templates, too. Others
+	// are only available to the templates of Monsti and the themes'
+	// and sites' templates may not call them.
+	Sandboxed bool
+}
+
+// RegisterTemplateFunc registers a template function which Monsti
+// makes available to all templates it renders. See
+// NewTemplateFuncHandler.
+func (s *MonstiClient) RegisterTemplateFunc(fn *TemplateFunc) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	err := s.RPCClient.Call("Monsti.RegisterTemplateFunc", fn, new(int))
+	if err != nil {
+		return fmt.Errorf("service: RegisterTemplateFunc error: %v", err)
+	}
+	return nil
+}
+
+// GetTemplateFuncs returns all registered template functions ordered
+// by their names.
+func (s *MonstiClient) GetTemplateFuncs() ([]*TemplateFunc, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	var funcs []*TemplateFunc
+	err := s.RPCClient.Call("Monsti.GetTemplateFuncs", 0, &funcs)
+	if err != nil {
+		return nil, fmt.Errorf("service: GetTemplateFuncs error: %v", err)
+	}
+	return funcs, nil
+}
+
+// Shortcode is a shortcode provided by a module, e.g. [map lat=52.5
+// lon=13.4]. Modules expand it by handling the monsti.Shortcode
+// signal.
+type Shortcode struct {
+	// Name of the shortcode, e.g. "map". It must not be taken by
+	// another shortcode.
+	Name string
+}
+
+// RegisterShortcode registers a shortcode which Monsti expands in the
+// HTML fields of rendered nodes. See NewShortcodeHandler.
+func (s *MonstiClient) RegisterShortcode(code *Shortcode) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	err := s.RPCClient.Call("Monsti.RegisterShortcode", code, new(int))
+	if err != nil {
+		return fmt.Errorf("service: RegisterShortcode error: %v", err)
+	}
+	return nil
+}
+
+// GetShortcodes returns all registered shortcodes ordered by their
+// names. Shortcodes built into Monsti are not included.
+func (s *MonstiClient) GetShortcodes() ([]*Shortcode, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	var codes []*Shortcode
+	err := s.RPCClient.Call("Monsti.GetShortcodes", 0, &codes)
+	if err != nil {
+		return nil, fmt.Errorf("service: GetShortcodes error: %v", err)
+	}
+	return codes, nil
+}
+
+// Task is a recurring task, e.g. reindexing the search index each
+// night. Monsti emits the monsti.RunTask signal at the times given by
+// the schedule, see NewRunTaskHandler.
+type Task struct {
+	// Id of the task, e.g. "example.reindex". It must not be taken by
+	// another task.
+	Id string
+	// Schedule is a cron expression of the minutes, hours, days of the
+	// month, months and weekdays to run the task at, e.g. "30 2 * * *"
+	// for each night at 2:30, or one of @hourly, @daily, @weekly and
+	// @monthly.
+	Schedule string
+	// PerSite runs the task separately for each site. Otherwise, it
+	// runs once without site.
+	PerSite bool
+}
+
+// RegisterTask registers a recurring task.
+func (s *MonstiClient) RegisterTask(task *Task) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	if err := s.RPCClient.Call("Monsti.RegisterTask", task, new(int)); err != nil {
+		return fmt.Errorf("service: RegisterTask error: %v", err)
+	}
+	return nil
+}
+
+// SetSiteConfig sets the named site local configuration to the given
+// value.
+//
+// The value gets validated against the registered configuration
+// schema of the module.
+func (s *MonstiClient) SetSiteConfig(site, name string,
+	value interface{}) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("service: Could not encode configuration: %v", err)
+	}
+	args := struct {
+		Site, Name string
+		Value      []byte
+	}{site, name, encoded}
+	err = s.RPCClient.Call("Monsti.SetSiteConfig", args, new(int))
+	if err != nil {
+		return fmt.Errorf("service: SetSiteConfig error: %v", err)
+	}
+	return nil
+}
+
 /*
 
 // GetConfig puts the named global configuration into the variable out.
@@ -341,6 +1197,53 @@ func (s *MonstiClient) RegisterNodeType(nodeType *NodeType) error {
 	return nil
 }
 
+// UpdateNodeType replaces the registered node type with the same id.
+//
+// Existing nodes of the type are not modified. renamedFields maps ids
+// of fields which have been renamed to their new ids. It is passed to
+// the handlers of the monsti.NodeTypeChanged signal as a hint to
+// migrate the data of existing nodes. May be nil.
+func (s *MonstiClient) UpdateNodeType(nodeType *NodeType,
+	renamedFields map[string]string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct{ NodeType *NodeType }{nodeType}
+	var removed []string
+	err := s.RPCClient.Call("Monsti.UpdateNodeType", args, &removed)
+	if err != nil {
+		return fmt.Errorf("service: Error calling UpdateNodeType: %v", err)
+	}
+	return s.emitNodeTypeChanged(NodeTypeChangedArgs{
+		Id:            nodeType.Id,
+		RenamedFields: renamedFields,
+		RemovedFields: removed})
+}
+
+// UnregisterNodeType removes the given node type.
+//
+// Existing nodes of the type are not removed.
+func (s *MonstiClient) UnregisterNodeType(nodeTypeID string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	err := s.RPCClient.Call("Monsti.UnregisterNodeType", nodeTypeID, new(int))
+	if err != nil {
+		return fmt.Errorf("service: Error calling UnregisterNodeType: %v", err)
+	}
+	return s.emitNodeTypeChanged(NodeTypeChangedArgs{
+		Id: nodeTypeID, Removed: true})
+}
+
+// emitNodeTypeChanged emits the monsti.NodeTypeChanged signal.
+func (s *MonstiClient) emitNodeTypeChanged(args NodeTypeChangedArgs) error {
+	var ret []NodeTypeChangedRet
+	if err := s.EmitSignal("monsti.NodeTypeChanged", args, &ret); err != nil {
+		return fmt.Errorf("service: Could not emit signal: %v", err)
+	}
+	return nil
+}
+
 // GetNodeType requests information about the given node type.
 func (s *MonstiClient) GetNodeType(nodeTypeID string) (*NodeType,
 	error) {
@@ -408,20 +1311,74 @@ const (
 	RemoveAction
 	RequestPasswordTokenAction
 	ChangePasswordAction
+	PaymentCallbackAction
+	SettingsAction
+	FilesAction
+	CalendarAction
+	CustomCodeAction
+	BrokenReferencesAction
+	ArchiveAction
+	BrowseAction
+	MailsAction
+	HistoryAction
+	SitemapAction
+	MarkdownPreviewAction
+	UsersAction
+	HealthAction
+	QuarantineAction
+	SearchAction
+	TranslationsAction
+	MediaAction
+	UploadAction
+	DashboardAction
+	NewsletterAction
+	SubscribersAction
+	SendNewsletterAction
+	SubmissionsAction
+	FeedAction
+	CommentsAction
+	ModerateCommentsAction
+	RobotsTxtAction
+	RobotsAction
+	RedirectsAction
+	MenusAction
+	ChildrenAction
+	TreeAction
+	BlocksAction
+	GalleryUploadAction
+	ImportAction
 )
 
 // A request to be processed by a nodes service.
 type Request struct {
-	Id       uint
+	Id uint
+	// NodePath is the path of the requested node, e.g. "/blog" for
+	// "/blog/feed.xml".
 	NodePath string
 	// Site name
 	Site string
+	// Path and Host are the requested URL path and host.
+	Path, Host string
 	// The query values of the request URL.
 	Query url.Values
 	// Method of the request (GET,POST,...).
 	Method RequestMethod
+	// Header holds the request's Accept, Accept-Language, Dnt,
+	// If-Modified-Since, If-None-Match, Referer, User-Agent and
+	// X-Requested-With headers, if given.
+	Header http.Header
+	// ClientIP is the address of the client. For requests of trusted
+	// proxies, it is taken from the X-Forwarded-For header.
+	ClientIP string
+	// Secure is set for requests sent via HTTPS, including requests
+	// forwarded by trusted proxies setting X-Forwarded-Proto.
+	Secure bool
+	// RequestID identifies the request in the log.
+	RequestID string
 	// User session
 	Session *UserSession
+	// Locale is the language the node's content is shown in.
+	Locale string
 	// Action to perform (e.g. "edit").
 	Action Action
 	// FormData stores the requests form data.
@@ -521,6 +1478,36 @@ func (s *MonstiClient) PublishService(service, path string) error {
 	return nil
 }
 
+// GetFieldTypeService returns the path to the unix domain socket of
+// the service providing the given field type.
+//
+// Returns an empty string if no module provides the field type.
+func (s *MonstiClient) GetFieldTypeService(fieldType string) (string, error) {
+	if s.Error != nil {
+		return "", s.Error
+	}
+	var reply string
+	err := s.RPCClient.Call("Monsti.GetFieldTypeService", fieldType, &reply)
+	if err != nil {
+		return "", fmt.Errorf("service: GetFieldTypeService error: %v", err)
+	}
+	return reply, nil
+}
+
+// GetAvailableLocales returns the languages of the user interface,
+// e.g. to generate translation maps of node type names.
+func (s *MonstiClient) GetAvailableLocales() ([]string, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	var reply []string
+	err := s.RPCClient.Call("Monsti.GetAvailableLocales", 0, &reply)
+	if err != nil {
+		return nil, fmt.Errorf("service: GetAvailableLocales error: %v", err)
+	}
+	return reply, nil
+}
+
 /*
 // FindDataService requests a data client.
 func (s *MonstiClient) FindDataService() (*MonstiClient, error) {
@@ -548,6 +1535,35 @@ type User struct {
 	Password string
 	// PasswordChanged keeps the time of the last password change.
 	PasswordChanged time.Time
+	// Roles of the user, e.g. "editor".
+	Roles []string `json:",omitempty"`
+}
+
+// NewUser describes a user to be created by CreateUser.
+type NewUser struct {
+	Login, Name, Email string
+	// Password is the unhashed password. If empty, the user can't log
+	// in before choosing a password.
+	Password string
+	Roles    []string
+	// Invite sends the user a mail with a link to choose a password.
+	Invite bool
+}
+
+// CreateUser adds the given user to the site's user database. It
+// fails if the login is taken.
+func (s *MonstiClient) CreateUser(site string, user *NewUser) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct {
+		Site string
+		User *NewUser
+	}{site, user}
+	if err := s.RPCClient.Call("Monsti.CreateUser", args, new(int)); err != nil {
+		return fmt.Errorf("service: CreateUser error: %v", err)
+	}
+	return nil
 }
 
 // UserSession is a session of an authenticated or anonymous user.
@@ -558,7 +1574,8 @@ type UserSession struct {
 	Locale string
 }
 
-// Send given Monsti.
+// SendMail adds the given mail to Monsti's mail queue. It gets
+// delivered in the background, see GetMailQueue.
 func (s *MonstiClient) SendMail(m *mimemail.Mail) error {
 	if s.Error != nil {
 		return s.Error
@@ -570,6 +1587,271 @@ func (s *MonstiClient) SendMail(m *mimemail.Mail) error {
 	return nil
 }
 
+// SendSiteMail adds the given mail of the site to Monsti's mail
+// queue. It gets signed and sent using the site's mail settings.
+func (s *MonstiClient) SendSiteMail(site string, m *mimemail.Mail) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct {
+		Site string
+		Mail *mimemail.Mail
+	}{site, m}
+	if err := s.RPCClient.Call("Monsti.SendSiteMail", args, new(int)); err != nil {
+		return fmt.Errorf("service: Monsti.SendSiteMail error: %v", err)
+	}
+	return nil
+}
+
+// MailAttachment is a file attached to a mail.
+type MailAttachment struct {
+	// Name is the file name shown to the recipient.
+	Name string
+	// Type is the MIME type of the file, e.g. "application/pdf".
+	Type    string
+	Content []byte
+}
+
+// SendSiteMailWithAttachments is like SendSiteMail, but attaches the
+// given files to the mail.
+func (s *MonstiClient) SendSiteMailWithAttachments(site string,
+	m *mimemail.Mail, attachments []MailAttachment) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct {
+		Site        string
+		Mail        *mimemail.Mail
+		Attachments []MailAttachment
+	}{site, m, attachments}
+	if err := s.RPCClient.Call("Monsti.SendSiteMail", args, new(int)); err != nil {
+		return fmt.Errorf("service: Monsti.SendSiteMail error: %v", err)
+	}
+	return nil
+}
+
+// States of queued mails.
+const (
+	// MailQueued mails wait for their next delivery attempt.
+	MailQueued = "queued"
+	// MailSent mails have been accepted by the mail server.
+	MailSent = "sent"
+	// MailFailed mails have been rejected by the mail server or could
+	// not be delivered after several attempts.
+	MailFailed = "failed"
+	// MailBounced mails have been sent but reported as undeliverable,
+	// see ReportMailBounce.
+	MailBounced = "bounced"
+)
+
+// QueuedMail is an entry of the mail queue.
+type QueuedMail struct {
+	Id string
+	// Site is the name of the site sending the mail, if any.
+	Site string `json:",omitempty"`
+	Mail mimemail.Mail
+	// Attachments are the files attached to the mail, if any.
+	Attachments []MailAttachment `json:",omitempty"`
+	Status      string
+	Queued      time.Time
+	// Attempts is the number of delivery attempts.
+	Attempts int
+	// Next is the time of the next delivery attempt of queued mails.
+	Next time.Time
+	// Sent is the time the mail has been sent.
+	Sent time.Time
+	// Error is the reason of the last failed attempt or the bounce.
+	Error string
+}
+
+// GetMailQueue returns the mail queue, oldest mails first. Sent mails
+// are kept for some time to receive bounces.
+func (s *MonstiClient) GetMailQueue() ([]*QueuedMail, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	var reply []*QueuedMail
+	if err := s.RPCClient.Call("Monsti.GetMailQueue", 0, &reply); err != nil {
+		return nil, fmt.Errorf("service: GetMailQueue error: %v", err)
+	}
+	return reply, nil
+}
+
+// ReportMailBounce marks the queued mail with the given id as bounced,
+// e.g. by a module processing delivery status notifications sent to
+// the queue's return path.
+func (s *MonstiClient) ReportMailBounce(id, reason string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct{ Id, Reason string }{id, reason}
+	if err := s.RPCClient.Call("Monsti.ReportMailBounce", args,
+		new(int)); err != nil {
+		return fmt.Errorf("service: ReportMailBounce error: %v", err)
+	}
+	return nil
+}
+
+// RetryMail queues the failed or bounced mail of the site with the
+// given id for immediate delivery. An empty site allows mails of any
+// site.
+func (s *MonstiClient) RetryMail(site, id string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct{ Site, Id string }{site, id}
+	if err := s.RPCClient.Call("Monsti.RetryMail", args, new(int)); err != nil {
+		return fmt.Errorf("service: RetryMail error: %v", err)
+	}
+	return nil
+}
+
+// RemoveMail removes the mail of the site with the given id from the
+// mail queue. An empty site allows mails of any site.
+func (s *MonstiClient) RemoveMail(site, id string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct{ Site, Id string }{site, id}
+	if err := s.RPCClient.Call("Monsti.RemoveMail", args, new(int)); err != nil {
+		return fmt.Errorf("service: RemoveMail error: %v", err)
+	}
+	return nil
+}
+
+// States of queued jobs.
+const (
+	// JobQueued jobs wait for a worker.
+	JobQueued = "queued"
+	// JobRunning jobs have been leased by a worker, see WaitJob.
+	JobRunning = "running"
+	// JobDead jobs failed too often and wait for an administrator to
+	// retry or remove them.
+	JobDead = "dead"
+)
+
+// NewJob is a job to be added to the job queue, see EnqueueJob.
+type NewJob struct {
+	// Queue is the name of the queue, e.g. "example.transcode". Workers
+	// wait for jobs of the queues they process.
+	Queue string
+	// Site is the name of the site the job belongs to, if any.
+	Site string
+	// Data describes the work to be done, e.g. a JSON document.
+	Data []byte
+	// Attempts is the number of attempts before the job is dead.
+	// Defaults to the attempts configured for the queue.
+	Attempts int
+	// Delay postpones the first attempt.
+	Delay time.Duration
+}
+
+// Job is an entry of the job queue.
+type Job struct {
+	Id, Queue string
+	Site      string `json:",omitempty"`
+	Data      []byte
+	Status    string
+	Queued    time.Time
+	// Attempts is the number of leases of the job and MaxAttempts the
+	// number of attempts before the job is dead.
+	Attempts, MaxAttempts int
+	// Next is the time of the next attempt of queued jobs or the end of
+	// the lease of running jobs.
+	Next time.Time
+	// Lease identifies the lease of running jobs, see FinishJob.
+	Lease string `json:",omitempty"`
+	// Error is the reason of the last failed attempt.
+	Error string
+}
+
+// EnqueueJob adds the job to the job queue and returns its id.
+func (s *MonstiClient) EnqueueJob(job *NewJob) (string, error) {
+	if s.Error != nil {
+		return "", s.Error
+	}
+	var reply string
+	if err := s.RPCClient.Call("Monsti.EnqueueJob", job, &reply); err != nil {
+		return "", fmt.Errorf("service: EnqueueJob error: %v", err)
+	}
+	return reply, nil
+}
+
+// WaitJob waits for a due job of the given queues and leases it to the
+// caller for the given duration. If the lease ends before the job gets
+// finished, the job counts as failed and gets leased again. The
+// default lease is ten minutes.
+//
+// WaitJob blocks until there is a job, so better use a session
+// dedicated to the worker.
+func (s *MonstiClient) WaitJob(queues []string, lease time.Duration) (
+	*Job, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct {
+		Queues []string
+		Lease  time.Duration
+	}{queues, lease}
+	var reply Job
+	if err := s.RPCClient.Call("Monsti.WaitJob", args, &reply); err != nil {
+		return nil, fmt.Errorf("service: WaitJob error: %v", err)
+	}
+	return &reply, nil
+}
+
+// FinishJob finishes the leased job. If jobErr is nil, the job gets
+// removed from the queue. Otherwise, it gets retried later or marked as
+// dead after too many attempts. Fails if the lease has ended.
+func (s *MonstiClient) FinishJob(job *Job, jobErr error) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct{ Id, Lease, Error string }{Id: job.Id, Lease: job.Lease}
+	if jobErr != nil {
+		args.Error = jobErr.Error()
+	}
+	if err := s.RPCClient.Call("Monsti.FinishJob", args, new(int)); err != nil {
+		return fmt.Errorf("service: FinishJob error: %v", err)
+	}
+	return nil
+}
+
+// GetJobQueue returns the jobs of the job queue, oldest first.
+func (s *MonstiClient) GetJobQueue() ([]*Job, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	var reply []*Job
+	if err := s.RPCClient.Call("Monsti.GetJobQueue", 0, &reply); err != nil {
+		return nil, fmt.Errorf("service: GetJobQueue error: %v", err)
+	}
+	return reply, nil
+}
+
+// RetryJob queues the dead job with the given id for an immediate
+// attempt.
+func (s *MonstiClient) RetryJob(id string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	if err := s.RPCClient.Call("Monsti.RetryJob", id, new(int)); err != nil {
+		return fmt.Errorf("service: RetryJob error: %v", err)
+	}
+	return nil
+}
+
+// RemoveJob removes the job with the given id from the job queue.
+func (s *MonstiClient) RemoveJob(id string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	if err := s.RPCClient.Call("Monsti.RemoveJob", id, new(int)); err != nil {
+		return fmt.Errorf("service: RemoveJob error: %v", err)
+	}
+	return nil
+}
+
 // AddSignalHandler connects to a signal with the given signal handler.
 //
 // Currently, you can only set one handler per signal and MonstiClient.
@@ -607,6 +1889,8 @@ func (s *MonstiClient) EmitSignal(name string, args interface{},
 	var args_ struct {
 		Name string
 		Args []byte
+		// Trace is the traceparent of the emitting call, if traced.
+		Trace string
 	}
 	buffer := &bytes.Buffer{}
 	enc := gob.NewEncoder(buffer)
@@ -616,6 +1900,9 @@ func (s *MonstiClient) EmitSignal(name string, args interface{},
 	}
 	args_.Name = name
 	args_.Args = buffer.Bytes()
+	if trace := s.Trace(); trace != nil {
+		args_.Trace = trace.Traceparent()
+	}
 	var ret [][]byte
 	err = s.RPCClient.Call("Monsti.EmitSignal", args_, &ret)
 	if err != nil {
@@ -636,6 +1923,13 @@ func (s *MonstiClient) EmitSignal(name string, args interface{},
 	return nil
 }
 
+// SignalTrace returns the span of the signal being handled or nil if
+// it's not traced. Signal handlers may pass it to the SetTrace method
+// of other clients to include their calls in the trace.
+func (s *MonstiClient) SignalTrace() *SpanContext {
+	return s.signalTrace
+}
+
 // WaitSignal waits for the next emitted signal.
 //
 // You have to connect to some signals before. See AddSignalHandler.
@@ -646,8 +1940,9 @@ func (s *MonstiClient) WaitSignal() error {
 		return s.Error
 	}
 	signal := struct {
-		Name string
-		Args []byte
+		Name  string
+		Args  []byte
+		Trace string
 	}{}
 	err := s.RPCClient.Call("Monsti.WaitSignal", s.Id, &signal)
 	if err != nil {
@@ -662,6 +1957,13 @@ func (s *MonstiClient) WaitSignal() error {
 	}
 	var ret interface{}
 	var reterr error
+	var span *Span
+	if parent := ParseTraceparent(signal.Trace); parent != nil &&
+		DefaultTracer != nil {
+		span = StartSpan("signal "+signal.Name, ServerSpan, parent)
+		s.signalTrace = &span.Context
+		s.SetTrace(s.signalTrace)
+	}
 	func() {
 		defer func() {
 			if err := recover(); err != nil {
@@ -673,6 +1975,14 @@ func (s *MonstiClient) WaitSignal() error {
 		}()
 		ret, reterr = s.SignalHandlers[signal.Name](args_.Wrap)
 	}()
+	if span != nil {
+		s.signalTrace = nil
+		s.SetTrace(nil)
+		if reterr != nil {
+			span.Error = reterr.Error()
+		}
+		span.Finish()
+	}
 	signalRet := &struct {
 		Id  string
 		Err string
@@ -696,3 +2006,38 @@ func (s *MonstiClient) WaitSignal() error {
 	}
 	return nil
 }
+
+// ThemeTemplate is a template available to a site.
+type ThemeTemplate struct {
+	// Name of the template, e.g. "blocks/footer".
+	Name string
+	// Origin is "site" if the site overrides the template, "theme" if
+	// the site's theme provides it and "core" for Monsti's templates.
+	Origin string
+}
+
+// Theme describes the theme of a site.
+type Theme struct {
+	// Name of the theme or empty if the site does not use a theme.
+	Name string
+	// Title and Description of the theme as configured in its
+	// theme.yaml, if any.
+	Title, Description string
+	// Templates are the templates available to the site, sorted by
+	// name.
+	Templates []ThemeTemplate
+}
+
+// GetTheme returns the theme of the given site and the templates
+// available to it.
+func (s *MonstiClient) GetTheme(site string) (*Theme, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct{ Site string }{site}
+	var reply Theme
+	if err := s.RPCClient.Call("Monsti.GetTheme", args, &reply); err != nil {
+		return nil, fmt.Errorf("service: GetTheme error: %v", err)
+	}
+	return &reply, nil
+}
@@ -48,7 +48,8 @@ func TestDataToNode(t *testing.T) {
 		Id:   "foo.Bar",
 		Name: map[string]string{"en": "A Bar"},
 		Fields: []*NodeField{
-			{"foo.FooField", map[string]string{"en": "A FooField"}, false, "Text"},
+			{Id: "foo.FooField", Name: map[string]string{"en": "A FooField"},
+				Type: "Text"},
 		},
 		Embed: nil}
 	data := []byte(`
@@ -89,12 +90,12 @@ func TestNodeToData(t *testing.T) {
 		Type: &NodeType{
 			Id: "foo.Bar",
 			Fields: []*NodeField{
-				{"foo.FooField", nil, false, "Text"},
+				{Id: "foo.FooField", Type: "Text"},
 			},
 			Embed: nil,
 		},
 		LocalFields: []*NodeField{
-			{"foo.BarField", nil, false, "Text"},
+			{Id: "foo.BarField", Type: "Text"},
 		},
 	}
 	node.InitFields(nil, "")
@@ -152,4 +153,47 @@ func TestNodeToData(t *testing.T) {
 		t.Errorf("nodeToData(%v, true) is\n`%v`\n, should be\n`%v`", node,
 			trim(string(ret)), trim(expected))
 	}
+	node.Type.Migrations = []*Migration{{Version: 1}, {Version: 2}}
+	ret, err = nodeToData(&node, false)
+	if err != nil || !strings.Contains(string(ret), `"SchemaVersion":2,`) {
+		t.Errorf("nodeToData should stamp the schema version, got %s, %v", ret,
+			err)
+	}
+}
+
+func TestNodeToDataPendingMigration(t *testing.T) {
+	nodeType := NodeType{
+		Id: "foo.Bar",
+		Fields: []*NodeField{
+			{Id: "foo.Title", Type: "Text"},
+			{Id: "foo.Body", Type: "Text"}},
+		Migrations: []*Migration{{Version: 1,
+			RenameFields: map[string]string{"foo.Text": "foo.Body"}}}}
+	getNodeType := func(id string) (*NodeType, error) { return &nodeType, nil }
+	data := []byte(`{"Type": "foo.Bar",
+		"Fields": {"foo": {"Title": "Foo", "Text": "Old text"}}}`)
+	node, err := dataToNode(data, getNodeType, nil, "")
+	if err != nil {
+		t.Fatalf("dataToNode returns error: %v", err)
+	}
+	ret, err := nodeToData(node, false)
+	if err != nil {
+		t.Fatalf("nodeToData returns error: %v", err)
+	}
+	if strings.Contains(string(ret), `"SchemaVersion"`) ||
+		!strings.Contains(string(ret), `"Text":"Old text"`) ||
+		!strings.Contains(string(ret), `"Title":"Foo"`) {
+		t.Errorf("nodeToData of unmigrated node = %s, should keep version and"+
+			" unknown fields", ret)
+	}
+	data = []byte(`{"Type": "foo.Bar", "SchemaVersion": 1,
+		"Fields": {"foo": {"Title": "Foo", "Text": "Stale"}}}`)
+	if node, err = dataToNode(data, getNodeType, nil, ""); err != nil {
+		t.Fatalf("dataToNode returns error: %v", err)
+	}
+	ret, err = nodeToData(node, false)
+	if err != nil || !strings.Contains(string(ret), `"SchemaVersion":1`) ||
+		strings.Contains(string(ret), `"Text"`) {
+		t.Errorf("nodeToData of migrated node = %s, %v", ret, err)
+	}
 }
@@ -17,9 +17,14 @@
 package service
 
 import (
+	"encoding/json"
 	"fmt"
 	"html/template"
+	"math"
+	"net/url"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -49,6 +54,14 @@ type Field interface {
 	FromFormField(util.NestedMap, *NodeField)
 }
 
+// FormFieldValidator is implemented by fields validating their form
+// values beyond the validation of their widgets.
+type FormFieldValidator interface {
+	// ValidateFormField returns a translated error message if the
+	// submitted value is invalid.
+	ValidateFormField(util.NestedMap, *NodeField, string) string
+}
+
 // TextField is a basic unicode text field
 type TextField string
 
@@ -117,6 +130,8 @@ func (t HTMLField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
 	widget.Base().Classes = []string{"html-field"}
 }
 
+// FromFormField sets the field to the submitted HTML. It's not
+// sanitized, see SanitizeHTML.
 func (t *HTMLField) FromFormField(data util.NestedMap, field *NodeField) {
 	*t = HTMLField(data.Get(field.Id).(string))
 }
@@ -189,6 +204,9 @@ func (t *DateTimeField) Load(f func(interface{}) error) error {
 	if err != nil {
 		return fmt.Errorf("Could not parse the date value: %v", err)
 	}
+	if t.Location == nil {
+		t.Location = time.UTC
+	}
 	t.Time = val.In(t.Location)
 	return nil
 }
@@ -205,8 +223,517 @@ func (t DateTimeField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
 }
 
 func (t *DateTimeField) FromFormField(data util.NestedMap, field *NodeField) {
-	time := data.Get(field.Id).(time.Time)
-	*t = DateTimeField{Time: time}
+	t.Time = data.Get(field.Id).(time.Time)
+}
+
+// dateLayout and timeLayout are the layouts of dumped and submitted
+// DateField and TimeField values.
+const (
+	dateLayout = "2006-01-02"
+	timeLayout = "15:04"
+)
+
+// DateField is a calendar date without time of day and time zone,
+// e.g. the day of an event.
+type DateField struct {
+	Time time.Time
+}
+
+func (t DateField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+// format returns the date in dateLayout or an empty string if
+// the date is not set.
+func (t DateField) format() string {
+	if t.Time.IsZero() {
+		return ""
+	}
+	return t.Time.Format(dateLayout)
+}
+
+func (t DateField) RenderHTML() interface{} {
+	return t.format()
+}
+
+func (t DateField) String() string {
+	return t.format()
+}
+
+func (t *DateField) Load(f func(interface{}) error) error {
+	var date string
+	if err := f(&date); err != nil {
+		return err
+	}
+	if len(date) == 0 {
+		t.Time = time.Time{}
+		return nil
+	}
+	val, err := time.Parse(dateLayout, date)
+	if err != nil {
+		return fmt.Errorf("Could not parse the date value: %v", err)
+	}
+	t.Time = val
+	return nil
+}
+
+func (t DateField) Dump() interface{} {
+	return t.format()
+}
+
+func (t DateField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+	data.Set(field.Id, t.format())
+	widget := form.AddWidget(&htmlwidgets.TextWidget{
+		Regexp:          `^(\d{4}-\d{2}-\d{2})?$`,
+		ValidationError: G("Please enter a date like 2006-01-02.")},
+		"Fields."+field.Id, field.Name[locale], "")
+	widget.Base().Classes = []string{"date-field"}
+}
+
+func (t *DateField) FromFormField(data util.NestedMap, field *NodeField) {
+	t.Time, _ = time.Parse(dateLayout, data.Get(field.Id).(string))
+}
+
+// TimeField is a time of day without date and time zone, e.g. the
+// daily opening time of a shop.
+type TimeField struct {
+	Time time.Time
+}
+
+func (t TimeField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t TimeField) RenderHTML() interface{} {
+	return t.Time.Format(timeLayout)
+}
+
+func (t TimeField) String() string {
+	return t.Time.Format(timeLayout)
+}
+
+// parseTime parses a time of day with optional seconds.
+func parseTime(value string) (time.Time, error) {
+	if len(value) > len(timeLayout) {
+		return time.Parse(timeLayout+":05", value)
+	}
+	return time.Parse(timeLayout, value)
+}
+
+func (t *TimeField) Load(f func(interface{}) error) error {
+	var value string
+	if err := f(&value); err != nil {
+		return err
+	}
+	val, err := parseTime(value)
+	if err != nil {
+		return fmt.Errorf("Could not parse the time value: %v", err)
+	}
+	t.Time = val
+	return nil
+}
+
+func (t TimeField) Dump() interface{} {
+	return t.Time.Format(timeLayout)
+}
+
+func (t TimeField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+	data.Set(field.Id, t.Time.Format(timeLayout))
+	widget := form.AddWidget(&htmlwidgets.TextWidget{
+		Regexp:          `^\d{2}:\d{2}(:\d{2})?$`,
+		ValidationError: G("Please enter a time like 15:04.")},
+		"Fields."+field.Id, field.Name[locale], "")
+	widget.Base().Classes = []string{"time-field"}
+}
+
+func (t *TimeField) FromFormField(data util.NestedMap, field *NodeField) {
+	t.Time, _ = parseTime(data.Get(field.Id).(string))
+}
+
+// SelectField holds one value of a fixed set of options.
+type SelectField struct {
+	Value string
+	// Options are the valid options of the field.
+	Options []*FieldOption
+}
+
+func (t SelectField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t SelectField) RenderHTML() interface{} {
+	return t.Value
+}
+
+func (t SelectField) String() string {
+	return t.Value
+}
+
+// GetOption returns the option with the given value or nil if there
+// is no such option.
+func (t SelectField) GetOption(value string) *FieldOption {
+	for _, option := range t.Options {
+		if option.Value == value {
+			return option
+		}
+	}
+	return nil
+}
+
+// GetLocalLabel returns the label of the selected option in the given
+// language.
+func (t SelectField) GetLocalLabel(locale string) string {
+	option := t.GetOption(t.Value)
+	if option == nil {
+		return t.Value
+	}
+	return option.GetLocalLabel(locale)
+}
+
+func (t *SelectField) Load(f func(interface{}) error) error {
+	return f(&t.Value)
+}
+
+func (t SelectField) Dump() interface{} {
+	return t.Value
+}
+
+func (t SelectField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	data.Set(field.Id, t.Value)
+	options := make([]htmlwidgets.SelectOption, 0, len(field.Options)+1)
+	if !field.Required && !field.Radio {
+		options = append(options, htmlwidgets.SelectOption{"", "", false})
+	}
+	for _, option := range field.Options {
+		options = append(options, htmlwidgets.SelectOption{option.Value,
+			option.GetLocalLabel(locale), option.Value == t.Value})
+	}
+	widget := form.AddWidget(&htmlwidgets.SelectWidget{Options: options},
+		"Fields."+field.Id, field.Name[locale], "")
+	if field.Radio {
+		widget.Base().Classes = []string{"radio-field"}
+	}
+}
+
+// FromFormField sets the submitted value. Values which are not one
+// of the field's options will be ignored.
+func (t *SelectField) FromFormField(data util.NestedMap, field *NodeField) {
+	value, _ := data.Get(field.Id).(string)
+	if t.GetOption(value) != nil || (value == "" && !field.Required) {
+		t.Value = value
+	}
+}
+
+// MultiRefField is an ordered list of references to other nodes.
+type MultiRefField struct {
+	// Paths are the absolute paths of the referenced nodes.
+	Paths []string
+}
+
+func (t MultiRefField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t MultiRefField) RenderHTML() interface{} {
+	return t.Paths
+}
+
+func (t MultiRefField) String() string {
+	return strings.Join(t.Paths, ", ")
+}
+
+func (t *MultiRefField) Load(f func(interface{}) error) error {
+	return f(&t.Paths)
+}
+
+func (t MultiRefField) Dump() interface{} {
+	if t.Paths == nil {
+		return []string{}
+	}
+	return t.Paths
+}
+
+// ToFormField adds a hidden widget holding the paths, one per line. A
+// script turns it into a list with a node browser.
+func (t MultiRefField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	data.Set(field.Id, strings.Join(t.Paths, "\n"))
+	widget := form.AddWidget(new(htmlwidgets.HiddenWidget), "Fields."+field.Id,
+		field.Name[locale], "")
+	widget.Base().Classes = []string{"multiref-field"}
+}
+
+// FromFormField sets the submitted paths. Relative paths and empty
+// lines will be ignored.
+func (t *MultiRefField) FromFormField(data util.NestedMap, field *NodeField) {
+	value, _ := data.Get(field.Id).(string)
+	t.Paths = make([]string, 0)
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] != '/' {
+			continue
+		}
+		t.Paths = append(t.Paths, path.Clean(line))
+	}
+}
+
+// GeoField is a geographic location, e.g. of a venue.
+type GeoField struct {
+	Latitude, Longitude float64
+	// Zoom is the zoom level of maps showing the location. Defaults to
+	// defaultGeoZoom.
+	Zoom int `json:",omitempty"`
+}
+
+// defaultGeoZoom is the zoom level of maps if the field has none.
+const defaultGeoZoom = 15
+
+func (t GeoField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t GeoField) RenderHTML() interface{} {
+	return t.String()
+}
+
+func (t GeoField) String() string {
+	return strconv.FormatFloat(t.Latitude, 'f', -1, 64) + "," +
+		strconv.FormatFloat(t.Longitude, 'f', -1, 64)
+}
+
+// RenderMap returns an embedded OpenStreetMap map showing the
+// location.
+func (t GeoField) RenderMap() template.HTML {
+	zoom := t.Zoom
+	if zoom <= 0 {
+		zoom = defaultGeoZoom
+	}
+	lon := 180 / math.Pow(2, float64(zoom))
+	lat := lon / 2
+	format := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', 6, 64)
+	}
+	src := "https://www.openstreetmap.org/export/embed.html?" + url.Values{
+		"bbox": {strings.Join([]string{format(t.Longitude - lon),
+			format(t.Latitude - lat), format(t.Longitude + lon),
+			format(t.Latitude + lat)}, ",")},
+		"layer":  {"mapnik"},
+		"marker": {format(t.Latitude) + "," + format(t.Longitude)},
+	}.Encode()
+	return template.HTML(`<iframe class="geo-map" src="` +
+		template.HTMLEscapeString(src) + `"></iframe>`)
+}
+
+func (t *GeoField) Load(f func(interface{}) error) error {
+	return f(t)
+}
+
+func (t GeoField) Dump() interface{} {
+	return t
+}
+
+func (t GeoField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+	value := t.String()
+	if t.Zoom > 0 {
+		value += "," + strconv.Itoa(t.Zoom)
+	}
+	data.Set(field.Id, value)
+	widget := form.AddWidget(&htmlwidgets.TextWidget{
+		Regexp: `^-?\d+(\.\d+)?,-?\d+(\.\d+)?(,\d+)?$`,
+		ValidationError: G(
+			"Please enter latitude and longitude like 52.52,13.40.")},
+		"Fields."+field.Id, field.Name[locale], "")
+	widget.Base().Classes = []string{"geo-field"}
+}
+
+// FromFormField sets the submitted location given as
+// "latitude,longitude[,zoom]". Invalid locations will be ignored.
+func (t *GeoField) FromFormField(data util.NestedMap, field *NodeField) {
+	value, _ := data.Get(field.Id).(string)
+	parts := strings.Split(strings.Replace(value, " ", "", -1), ",")
+	if len(parts) < 2 || len(parts) > 3 {
+		return
+	}
+	lat, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return
+	}
+	lon, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return
+	}
+	zoom := 0
+	if len(parts) == 3 {
+		if zoom, err = strconv.Atoi(parts[2]); err != nil {
+			return
+		}
+	}
+	*t = GeoField{lat, lon, zoom}
+}
+
+// ListField is a repeatable group of fields, e.g. the members of a
+// team with name and photo.
+type ListField struct {
+	// Fields define the fields of each row.
+	Fields []*NodeField
+	// Rows map the ids of each row's fields to the fields.
+	Rows   []map[string]Field
+	monsti *MonstiClient
+	site   string
+}
+
+func (t *ListField) Init(m *MonstiClient, site string) error {
+	t.monsti = m
+	t.site = site
+	return nil
+}
+
+// newRow returns a row with initialized fields.
+func (t *ListField) newRow() (map[string]Field, error) {
+	row := make(map[string]Field, len(t.Fields))
+	for _, field := range t.Fields {
+		val := NewField(field.Type)
+		if val == nil && t.monsti != nil {
+			val = &ModuleField{Type: field.Type, Field: field}
+		}
+		if val == nil {
+			return nil, fmt.Errorf("Unknown field type %q", field.Type)
+		}
+		if err := val.Init(t.monsti, t.site); err != nil {
+			return nil, fmt.Errorf("Could not init field %q: %v", field.Id, err)
+		}
+		row[field.Id] = val
+	}
+	return row, nil
+}
+
+// loadRows sets the rows to the given dumped rows.
+func (t *ListField) loadRows(rows []map[string]*json.RawMessage) error {
+	t.Rows = make([]map[string]Field, 0, len(rows))
+	for _, values := range rows {
+		row, err := t.newRow()
+		if err != nil {
+			return err
+		}
+		for id, value := range values {
+			field, ok := row[id]
+			if !ok || value == nil {
+				continue
+			}
+			if err := field.Load(func(in interface{}) error {
+				return json.Unmarshal(*value, in)
+			}); err != nil {
+				return fmt.Errorf("Could not load field %q: %v", id, err)
+			}
+		}
+		t.Rows = append(t.Rows, row)
+	}
+	return nil
+}
+
+// RenderHTML returns the rows mapping field ids to the fields'
+// rendered values.
+func (t ListField) RenderHTML() interface{} {
+	rows := make([]map[string]interface{}, 0, len(t.Rows))
+	for _, row := range t.Rows {
+		rendered := make(map[string]interface{}, len(row))
+		for id, field := range row {
+			rendered[id] = field.RenderHTML()
+		}
+		rows = append(rows, rendered)
+	}
+	return rows
+}
+
+func (t ListField) String() string {
+	lines := make([]string, 0, len(t.Rows))
+	for _, row := range t.Rows {
+		values := make([]string, 0, len(t.Fields))
+		for _, field := range t.Fields {
+			if val, ok := row[field.Id]; ok {
+				values = append(values, val.String())
+			}
+		}
+		lines = append(lines, strings.Join(values, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (t *ListField) Load(f func(interface{}) error) error {
+	var rows []map[string]*json.RawMessage
+	if err := f(&rows); err != nil {
+		return err
+	}
+	return t.loadRows(rows)
+}
+
+func (t ListField) Dump() interface{} {
+	rows := make([]map[string]interface{}, 0, len(t.Rows))
+	for _, row := range t.Rows {
+		dumped := make(map[string]interface{}, len(row))
+		for id, field := range row {
+			dumped[id] = field.Dump()
+		}
+		rows = append(rows, dumped)
+	}
+	return rows
+}
+
+// listFormValue is the value of the hidden form input of list fields,
+// which gets edited by list-field.js.
+type listFormValue struct {
+	Fields []listFormField `json:",omitempty"`
+	Rows   []map[string]*json.RawMessage
+}
+
+type listFormField struct {
+	Id, Name, Type string
+	// Options are the options of Select fields.
+	Options []listFormOption `json:",omitempty"`
+}
+
+type listFormOption struct {
+	Value, Label string
+}
+
+func (t ListField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	value := listFormValue{Fields: make([]listFormField, 0, len(t.Fields))}
+	for _, field := range t.Fields {
+		formField := listFormField{Id: field.Id, Name: field.Name[locale],
+			Type: field.Type}
+		for _, option := range field.Options {
+			formField.Options = append(formField.Options,
+				listFormOption{option.Value, option.GetLocalLabel(locale)})
+		}
+		value.Fields = append(value.Fields, formField)
+	}
+	dump, _ := json.Marshal(t.Dump())
+	json.Unmarshal(dump, &value.Rows)
+	encoded, _ := json.Marshal(value)
+	data.Set(field.Id, string(encoded))
+	widget := form.AddWidget(new(htmlwidgets.HiddenWidget), "Fields."+field.Id,
+		field.Name[locale], "")
+	widget.Base().Classes = []string{"list-field"}
+}
+
+func (t *ListField) FromFormField(data util.NestedMap, field *NodeField) {
+	var value listFormValue
+	encoded, _ := data.Get(field.Id).(string)
+	if err := json.Unmarshal([]byte(encoded), &value); err != nil {
+		return
+	}
+	rows := t.Rows
+	if err := t.loadRows(value.Rows); err != nil {
+		t.Rows = rows
+	}
 }
 
 // TemplateOverwrite specifies a template that should be used instead
@@ -222,11 +749,17 @@ type Node struct {
 	Type  *NodeType `json:"-"`
 	Order int
 	// Don't show the node in navigations if Hide is true.
-	Hide               bool
+	Hide bool
+	// Pinned nodes are listed before other nodes regardless of their
+	// order, e.g. announcements.
+	Pinned             bool             `json:",omitempty"`
 	Fields             map[string]Field `json:"-"`
 	TemplateOverwrites map[string]TemplateOverwrite
 	Embed              []EmbedNode
 	LocalFields        []*NodeField
+	// View is the id of the view used to render the node, e.g.
+	// "teaser". Defaults to "view". Embeds may select another view.
+	View string `json:",omitempty"`
 	// Public controls wether the node or its content may be viewed by
 	// unauthenticated users.
 	Public bool
@@ -236,25 +769,240 @@ type Node struct {
 	// Changed is updated with the current time on every write to the
 	// database.
 	Changed time.Time
+	// FormSteps splits the form of form nodes (e.g. core.ContactForm)
+	// into several pages. If empty, the node type's default form is
+	// used.
+	FormSteps []FormStep `json:",omitempty"`
+	// Payment, if set, requires form submissions to be paid via a
+	// payment module before they get delivered.
+	Payment *FormPayment `json:",omitempty"`
+	// Experiment, if set, shows one of several variants of the node to
+	// each visitor.
+	Experiment *Experiment `json:",omitempty"`
+	// Locale is the language of the node's content, e.g. "de". Defaults
+	// to the site's locale.
+	Locale string `json:",omitempty"`
+	// Translations maps languages to the paths of translations of the
+	// node, e.g. {"de": "/de/ueber-uns"}.
+	Translations map[string]string `json:",omitempty"`
+	// FieldTranslations maps languages to the translated values of
+	// translatable fields, e.g. {"de": {"core.Title": "Über uns"}}.
+	// Fields without translation fall back to their value.
+	FieldTranslations map[string]map[string]*json.RawMessage `json:",omitempty"`
+	// LocalizedNames maps languages to the names of the node in URLs of
+	// that language, e.g. {"de": "ueber-uns"} for "/de/ueber-uns".
+	LocalizedNames map[string]string `json:",omitempty"`
+	// TranslationStatus maps languages to the status of the node's
+	// field translations, see TranslationDraft and
+	// TranslationComplete.
+	TranslationStatus map[string]string `json:",omitempty"`
+	// Tags categorize the node, e.g. images and files of the media
+	// library.
+	Tags []string `json:",omitempty"`
+	// AltText describes the content of image nodes for users who can't
+	// see them.
+	AltText string `json:",omitempty"`
+	// SEO holds the metadata of the node for search engines and social
+	// media.
+	SEO *SEOMetadata `json:",omitempty"`
+	// stored is the pending schema of the node.json the node has been
+	// read from, if its migrations have not been applied yet.
+	stored *storedSchema
+}
+
+// storedSchema is the schema of a node.json written before the latest
+// migrations of its node type.
+type storedSchema struct {
+	// SchemaVersion is the version of the node type's migrations the
+	// node.json has been written with.
+	SchemaVersion int
+	// Fields are the values of fields unknown to the node type, e.g.
+	// fields renamed by pending migrations.
+	Fields map[string]map[string]*json.RawMessage
+}
+
+// SEOMetadata is the metadata of a node for search engines and social
+// media. Empty values fall back to defaults derived from the node.
+type SEOMetadata struct {
+	// Description replaces the node's description in the description
+	// meta tag.
+	Description string `json:",omitempty"`
+	// Canonical is the canonical URL of the node's content, e.g. the
+	// URL of the original of copied content.
+	Canonical string `json:",omitempty"`
+	// Robots are the directives for search engine crawlers, e.g.
+	// "noindex, nofollow".
+	Robots string `json:",omitempty"`
+	// Title and Image are the title and the path or URL of the image of
+	// Open Graph and Twitter cards.
+	Title string `json:",omitempty"`
+	Image string `json:",omitempty"`
+}
+
+// Translation states of nodes. Field translations without status are
+// considered complete.
+const (
+	// TranslationDraft is the status of translations still being
+	// worked on, e.g. copies of the untranslated content.
+	TranslationDraft = "draft"
+	// TranslationComplete is the status of finished translations.
+	TranslationComplete = "complete"
+)
+
+// ListedBefore returns true iff the node should be listed before the
+// other node: pinned nodes come first, then nodes are ordered by Order
+// and path.
+func (n Node) ListedBefore(other *Node) bool {
+	if n.Pinned != other.Pinned {
+		return n.Pinned
+	}
+	if n.Order != other.Order {
+		return n.Order < other.Order
+	}
+	return n.Path < other.Path
+}
+
+type nodesByListing []*Node
+
+func (s nodesByListing) Len() int           { return len(s) }
+func (s nodesByListing) Less(i, j int) bool { return s[i].ListedBefore(s[j]) }
+func (s nodesByListing) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// SortNodes sorts the nodes in the order they should be listed, see
+// ListedBefore.
+func SortNodes(nodes []*Node) {
+	sort.Sort(nodesByListing(nodes))
+}
+
+// GetLocale returns the language of the node's content or the given
+// default locale if it's unknown.
+func (n Node) GetLocale(defaultLocale string) string {
+	if n.Locale != "" {
+		return n.Locale
+	}
+	return defaultLocale
+}
+
+// Experiment defines variants of a node for A/B testing.
+type Experiment struct {
+	// Id identifies the experiment within the site, e.g. "landing".
+	Id       string
+	Variants []ExperimentVariant
+	// Goal is the path of the node whose view counts as conversion,
+	// e.g. "/thanks/".
+	Goal string
+}
+
+// ExperimentVariant is a variant of a node.
+type ExperimentVariant struct {
+	Id string
+	// Weight is the share of visitors getting this variant relative to
+	// the other variants' weights.
+	Weight uint
+	// TemplateOverwrites are used instead of the node's template
+	// overwrites.
+	TemplateOverwrites map[string]TemplateOverwrite
+	// Fields maps field ids to dumped values which replace the node's
+	// field values.
+	Fields map[string]*json.RawMessage
+}
+
+// FormPayment configures the payment for submissions of a form node.
+type FormPayment struct {
+	// Amount to be paid in the smallest unit of the currency.
+	Amount uint
+	// Currency as ISO 4217 code, e.g. "EUR".
+	Currency string
+	// Description of the payment as shown by the payment provider.
+	Description string
+}
+
+// FormStep is one page of a multi-step form.
+type FormStep struct {
+	// The title of the step as shown in the web interface, specified
+	// as a translation map (language -> msg).
+	Title map[string]string
+	// The fields to be filled in at this step.
+	Fields []*NodeField
+}
+
+// GetLocalTitle returns the title of the step in the given language.
+//
+// Falls back to the "en" locale.
+func (s FormStep) GetLocalTitle(locale string) string {
+	title, ok := s.Title[locale]
+	if !ok {
+		title = s.Title["en"]
+	}
+	return title
+}
+
+// NewField returns a new, uninitialized field of the given type.
+//
+// Returns nil if the type is unknown.
+func NewField(fieldType string) Field {
+	switch fieldType {
+	case "Date":
+		return new(DateField)
+	case "DateTime":
+		return new(DateTimeField)
+	case "File":
+		return new(FileField)
+	case "Text":
+		return new(TextField)
+	case "Geo":
+		return new(GeoField)
+	case "HTMLArea":
+		return new(HTMLField)
+	case "Markdown":
+		return new(MarkdownField)
+	case "Select":
+		return new(SelectField)
+	case "Time":
+		return new(TimeField)
+	case "List":
+		return new(ListField)
+	case "MultiRef":
+		return new(MultiRefField)
+	case "Video":
+		return &MediaField{kind: "video"}
+	case "Audio":
+		return &MediaField{kind: "audio"}
+	}
+	return nil
+}
+
+// AllFields returns the fields of the node's type, if any, followed by
+// its local fields. The returned slice may be changed without
+// affecting the node type, which is shared by other nodes.
+func (n *Node) AllFields() []*NodeField {
+	var fields []*NodeField
+	if n.Type != nil {
+		fields = make([]*NodeField, 0, len(n.Type.Fields)+len(n.LocalFields))
+		fields = append(fields, n.Type.Fields...)
+	}
+	return append(fields, n.LocalFields...)
 }
 
 func (n *Node) InitFields(m *MonstiClient, site string) error {
 	n.Fields = make(map[string]Field)
-	nodeFields := append(n.Type.Fields, n.LocalFields...)
+	nodeFields := n.AllFields()
 	for _, field := range nodeFields {
-		var val Field
-		switch field.Type {
-		case "DateTime":
-			val = new(DateTimeField)
-		case "File":
-			val = new(FileField)
-		case "Text":
-			val = new(TextField)
-		case "HTMLArea":
-			val = new(HTMLField)
-		default:
+		val := NewField(field.Type)
+		if val == nil && m != nil {
+			val = &ModuleField{Type: field.Type, Field: field}
+		}
+		if val == nil {
 			return fmt.Errorf("Unknown field type %q for node %q", field.Type, n.Path)
 		}
+		switch val := val.(type) {
+		case *ListField:
+			val.Fields = field.Fields
+		case *SelectField:
+			val.Options = field.Options
+		case *MediaField:
+			val.url = path.Join(n.Path, "_files", field.Id)
+		}
 		err := val.Init(m, site)
 		if err != nil {
 			return fmt.Errorf("Could not init field %q: %v", field.Id, err)
@@ -337,11 +1085,55 @@ type NodeField struct {
 	Name     map[string]string
 	Required bool
 	Type     string
+	// Fields define the fields of each row of List fields. Their ids
+	// are local to the row, e.g. "Name".
+	Fields []*NodeField `json:",omitempty"`
+	// Options are the options of Select fields.
+	Options []*FieldOption `json:",omitempty"`
+	// Radio renders Select fields as radio group instead of a
+	// dropdown.
+	Radio bool `json:",omitempty"`
+	// Compute, if set, makes the field a computed field whose value is
+	// produced by the module handling the monsti.ComputeField signal
+	// for this id, e.g. "example.WordCount". Computed fields can't be
+	// edited.
+	Compute string `json:",omitempty"`
+	// ComputeOnRender computes the value each time the node gets
+	// rendered instead of when the node gets saved.
+	ComputeOnRender bool `json:",omitempty"`
+	// Translatable fields may be translated into the site's content
+	// languages (core.locales).
+	Translatable bool `json:",omitempty"`
+}
+
+// FieldOption is an option of a Select field.
+type FieldOption struct {
+	// Value is the stored value of the option.
+	Value string
+	// Label of the option as translation map (language -> msg).
+	Label map[string]string
+}
+
+// GetLocalLabel returns the label of the option in the given language.
+//
+// Falls back to the "en" locale and to the value.
+func (o FieldOption) GetLocalLabel(locale string) string {
+	label, ok := o.Label[locale]
+	if !ok {
+		label, ok = o.Label["en"]
+	}
+	if !ok {
+		label = o.Value
+	}
+	return label
 }
 
 type EmbedNode struct {
 	Id  string
 	URI string
+	// View is the id of the view used to render the embedded node,
+	// e.g. "teaser". Defaults to the embedded node's view.
+	View string `json:",omitempty"`
 }
 
 type NodeQuery struct {
@@ -375,6 +1167,60 @@ type NodeType struct {
 	//
 	// Supported values: $year, $month, $day
 	PathPrefix string
+	// Extends is the id of an already registered node type,
+	// e.g. "core.Document". Its fields, AddableTo entries and name
+	// translations will be merged into this node type.
+	Extends string
+	// Mixins are ids of already registered node types whose fields
+	// will be included into this node type.
+	Mixins []string
+	// Views are the views available for nodes of this type in addition
+	// to the default view "view".
+	Views []NodeTypeView
+	// Migrations convert existing nodes after changes of the node
+	// type's fields, ordered by version. See `monsti migrate`.
+	Migrations []*Migration
+}
+
+// Migration converts the data of nodes written before a change of
+// their node type.
+//
+// Nodes get stamped with the schema version of their node type, i.e.
+// the version of its latest migration, when written. Nodes without
+// stamp have version 0.
+type Migration struct {
+	// Version is the schema version of migrated nodes, starting at 1.
+	Version int
+	// Description of the change, e.g. "Rename foo.Bar to foo.Baz".
+	Description string
+	// RenameFields maps the ids of renamed fields to their new ids.
+	RenameFields map[string]string
+	// RemoveFields are the ids of fields to drop.
+	RemoveFields []string
+	// Convert is the id of a conversion done by modules handling the
+	// monsti.MigrateNode signal after renaming and removing fields,
+	// e.g. to change the type of a field.
+	Convert string
+}
+
+// SchemaVersion returns the version of the node type's latest
+// migration or 0 if there are none.
+func (n *NodeType) SchemaVersion() int {
+	if len(n.Migrations) == 0 {
+		return 0
+	}
+	return n.Migrations[len(n.Migrations)-1].Version
+}
+
+// NodeTypeView is a view of nodes of a node type, e.g. a teaser.
+type NodeTypeView struct {
+	// Id of the view, e.g. "teaser", "full" or "card". The default
+	// view has the id "view".
+	Id string
+	// Templates to render the view in order of preference. The first
+	// existing template is used. If empty, the template is
+	// "<namespace>/<type>-<view>", e.g. "core/Document-teaser".
+	Templates []string
 }
 
 // GetLocalName returns the name of the node type in the given language.
@@ -16,9 +16,15 @@
 package service
 
 import (
+	"crypto/sha1"
+	"encoding/json"
+	"html/template"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"pkg.monsti.org/monsti/api/util"
 )
 
 func TestNodeName(t *testing.T) {
@@ -39,6 +45,24 @@ func TestNodeName(t *testing.T) {
 	}
 }
 
+func TestSortNodes(t *testing.T) {
+	nodes := []*Node{
+		{Path: "/b"},
+		{Path: "/news", Pinned: true, Order: 10},
+		{Path: "/a"},
+		{Path: "/c", Order: -1},
+		{Path: "/event", Pinned: true},
+	}
+	SortNodes(nodes)
+	expected := []string{"/event", "/news", "/c", "/a", "/b"}
+	for i, node := range nodes {
+		if node.Path != expected[i] {
+			t.Errorf("SortNodes(...)[%v] = %q, should be %q", i, node.Path,
+				expected[i])
+		}
+	}
+}
+
 func TestFields(t *testing.T) {
 	fields := []Field{
 		new(TextField),
@@ -107,3 +131,225 @@ func TestGetPathPrefix(t *testing.T) {
 		}
 	}
 }
+
+func TestListField(t *testing.T) {
+	node := Node{Type: &NodeType{Fields: []*NodeField{{
+		Id:   "foo.Team",
+		Type: "List",
+		Fields: []*NodeField{
+			{Id: "Name", Type: "Text"},
+			{Id: "Photo", Type: "Text"}}}}}}
+	if err := node.InitFields(nil, ""); err != nil {
+		t.Fatalf("Could not init fields: %v", err)
+	}
+	field := node.GetField("foo.Team")
+	data := `[{"Name":"Alice","Photo":"/team/alice.jpg"},{"Name":"Bob"}]`
+	if err := field.Load(func(in interface{}) error {
+		return json.Unmarshal([]byte(data), in)
+	}); err != nil {
+		t.Fatalf("Could not load list field: %v", err)
+	}
+	if ret := field.String(); ret != "Alice, /team/alice.jpg\nBob, " {
+		t.Errorf("String() = %q", ret)
+	}
+	dump, err := json.Marshal(field.Dump())
+	if err != nil {
+		t.Fatalf("Could not marshal dump: %v", err)
+	}
+	expected := `[{"Name":"Alice","Photo":"/team/alice.jpg"},{"Name":"Bob","Photo":""}]`
+	if string(dump) != expected {
+		t.Errorf("Dump() = %s, should be %s", dump, expected)
+	}
+
+	form := util.NestedMap{}
+	form.Set("foo.Team", `{"Rows":[{"Name":"Carol"}]}`)
+	field.FromFormField(form, node.Type.Fields[0])
+	if ret := field.String(); ret != "Carol, " {
+		t.Errorf("String() after FromFormField = %q, should be %q", ret, "Carol, ")
+	}
+	form.Set("foo.Team", `invalid`)
+	field.FromFormField(form, node.Type.Fields[0])
+	if ret := field.String(); ret != "Carol, " {
+		t.Errorf("Invalid form value changed the field to %q", ret)
+	}
+}
+
+func TestDateAndTimeFields(t *testing.T) {
+	tests := []struct {
+		Type, Value, Form, Expected string
+	}{
+		{"Date", "2014-03-07", "2014-12-24", "2014-12-24"},
+		{"Date", "", "invalid", ""},
+		{"Time", "08:30", "17:45:10", "17:45"},
+	}
+	for i, test := range tests {
+		field := NewField(test.Type)
+		if err := field.Load(func(in interface{}) error {
+			return json.Unmarshal([]byte(`"`+test.Value+`"`), in)
+		}); err != nil {
+			t.Errorf("Test %v: Could not load %q: %v", i, test.Value, err)
+			continue
+		}
+		if ret := field.Dump(); ret != test.Value {
+			t.Errorf("Test %v: Dump() = %q, should be %q", i, ret, test.Value)
+		}
+		form := util.NestedMap{}
+		form.Set("foo", test.Form)
+		field.FromFormField(form, &NodeField{Id: "foo"})
+		if ret := field.String(); ret != test.Expected {
+			t.Errorf("Test %v: String() after submitting %q = %q, should be %q",
+				i, test.Form, ret, test.Expected)
+		}
+	}
+}
+
+func TestSelectField(t *testing.T) {
+	field := &NodeField{Id: "foo.Color", Type: "Select", Required: true,
+		Options: []*FieldOption{
+			{Value: "red", Label: map[string]string{"en": "Red", "de": "Rot"}},
+			{Value: "blue", Label: map[string]string{"en": "Blue"}}}}
+	node := Node{Type: &NodeType{Fields: []*NodeField{field}}}
+	if err := node.InitFields(nil, ""); err != nil {
+		t.Fatalf("Could not init fields: %v", err)
+	}
+	sel := node.GetField("foo.Color").(*SelectField)
+	tests := []struct {
+		Submitted, Value, Label string
+	}{
+		{"red", "red", "Rot"},
+		{"green", "red", "Rot"},
+		{"", "red", "Rot"},
+		{"blue", "blue", "Blue"},
+	}
+	for i, test := range tests {
+		form := util.NestedMap{}
+		form.Set(field.Id, test.Submitted)
+		sel.FromFormField(form, field)
+		if sel.Value != test.Value {
+			t.Errorf("Test %v: Value after submitting %q is %q, should be %q",
+				i, test.Submitted, sel.Value, test.Value)
+		}
+		if ret := sel.GetLocalLabel("de"); ret != test.Label {
+			t.Errorf("Test %v: GetLocalLabel(\"de\") = %q, should be %q",
+				i, ret, test.Label)
+		}
+	}
+}
+
+func TestMultiRefField(t *testing.T) {
+	field := NewField("MultiRef")
+	form := util.NestedMap{}
+	form.Set("foo", "/foo/bar/\n\n relative\n /foo//cruz \n")
+	field.FromFormField(form, &NodeField{Id: "foo"})
+	if ret := field.String(); ret != "/foo/bar, /foo/cruz" {
+		t.Errorf(`String() = %q, should be "/foo/bar, /foo/cruz"`, ret)
+	}
+}
+
+func TestGeoField(t *testing.T) {
+	tests := []struct {
+		Submitted string
+		Value     GeoField
+	}{
+		{"52.52,13.405", GeoField{52.52, 13.405, 0}},
+		{" -33.86, 151.2, 12", GeoField{-33.86, 151.2, 12}},
+		{"95,13.405", GeoField{1, 2, 3}},
+		{"52.52", GeoField{1, 2, 3}},
+		{"foo,bar", GeoField{1, 2, 3}},
+	}
+	for i, test := range tests {
+		field := GeoField{1, 2, 3}
+		form := util.NestedMap{}
+		form.Set("foo", test.Submitted)
+		field.FromFormField(form, &NodeField{Id: "foo"})
+		if field != test.Value {
+			t.Errorf("Test %v: Value after submitting %q is %v, should be %v",
+				i, test.Submitted, field, test.Value)
+		}
+	}
+	field := GeoField{Latitude: 52.52, Longitude: 13.405}
+	if ret := string(field.RenderMap()); !strings.Contains(ret,
+		"marker=52.520000%2C13.405000") {
+		t.Errorf("RenderMap() = %q, should contain the marker", ret)
+	}
+}
+
+func TestMarkdownField(t *testing.T) {
+	field := NewField("Markdown")
+	form := util.NestedMap{}
+	form.Set("foo", "Some **bold** text.\n\n<script>alert('foo');</script>")
+	field.FromFormField(form, &NodeField{Id: "foo"})
+	ret := string(field.RenderHTML().(template.HTML))
+	if !strings.Contains(ret, "<strong>bold</strong>") {
+		t.Errorf("RenderHTML() = %q, should contain rendered Markdown", ret)
+	}
+	if strings.Contains(ret, "<script") {
+		t.Errorf("RenderHTML() = %q, should be sanitized", ret)
+	}
+	if _, ok := markdownCache.entries[sha1.Sum([]byte(field.String()))]; !ok {
+		t.Errorf("Rendered Markdown should be cached")
+	}
+}
+
+func TestSanitizeHTML(t *testing.T) {
+	code := `<p class="intro" onclick="alert('foo')">Text</p>` +
+		`<img src="/img.jpg" srcset="/img.jpg/_sizes/medium 480w" alt="Image">` +
+		`<a href="javascript:alert('foo')">Link</a>` +
+		`<iframe src="https://example.com/"></iframe>` +
+		`<script>alert('foo');</script>`
+	tests := []struct {
+		Allowlist         *HTMLAllowlist
+		Contains, Missing []string
+	}{
+		{nil, []string{`class="intro"`, `srcset="`, `alt="Image"`, "Link"},
+			[]string{"<script", "onclick", "javascript:", "<iframe"}},
+		{&HTMLAllowlist{Elements: []string{"iframe"},
+			Attributes: map[string][]string{"iframe": {"src"}}},
+			[]string{`<iframe src="https://example.com/">`},
+			[]string{"<script", "onclick", "javascript:"}},
+	}
+	for i, test := range tests {
+		ret := SanitizeHTML(code, test.Allowlist)
+		for _, part := range test.Contains {
+			if !strings.Contains(ret, part) {
+				t.Errorf("Test %v: SanitizeHTML() = %q, should contain %q", i, ret,
+					part)
+			}
+		}
+		for _, part := range test.Missing {
+			if strings.Contains(ret, part) {
+				t.Errorf("Test %v: SanitizeHTML() = %q, should not contain %q", i,
+					ret, part)
+			}
+		}
+	}
+}
+
+func TestMediaField(t *testing.T) {
+	node := Node{Path: "/foo", Type: &NodeType{Fields: []*NodeField{
+		{Id: "example.Video", Type: "Video"},
+		{Id: "example.Audio", Type: "Audio"}}}}
+	if err := node.InitFields(nil, ""); err != nil {
+		t.Fatalf("Could not init fields: %v", err)
+	}
+	video := node.GetField("example.Video").(*MediaField)
+	if ret := video.Player(); ret != "" {
+		t.Errorf("Player() without file = %q, should be empty", ret)
+	}
+	video.MIMEType = "video/mp4"
+	video.Poster = true
+	ret := string(video.Player("controls"))
+	for _, part := range []string{"<video ", " controls",
+		`poster="/foo/_files/example.Video/poster"`,
+		`<source src="/foo/_files/example.Video" type="video/mp4">`} {
+		if !strings.Contains(ret, part) {
+			t.Errorf("Player() = %q, should contain %q", ret, part)
+		}
+	}
+	audio := node.GetField("example.Audio").(*MediaField)
+	audio.MIMEType = "audio/mpeg"
+	ret = string(audio.RenderHTML().(template.HTML))
+	if !strings.HasPrefix(ret, "<audio ") || strings.Contains(ret, "poster") {
+		t.Errorf("RenderHTML() = %q, should render an audio player", ret)
+	}
+}
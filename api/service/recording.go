@@ -0,0 +1,256 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net/rpc"
+	"sync"
+)
+
+// RecordedCall is an RPC call recorded by a client.
+//
+// Arguments and replies are gob encoded. Signals are recorded as the
+// Monsti.EmitSignal calls carrying their payloads.
+type RecordedCall struct {
+	Method string
+	Args   []byte
+	Reply  []byte
+	// Error is the error returned by the service, if any.
+	Error string
+	// replayed is true if the call has been used for a replay.
+	replayed bool
+}
+
+// Recording holds the RPC calls made by a client.
+type Recording struct {
+	Calls []*RecordedCall
+	mutex sync.Mutex
+}
+
+// add appends the given call to the recording.
+func (r *Recording) add(call *RecordedCall) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Calls = append(r.Calls, call)
+}
+
+// next returns the first call to the given method which has not been
+// replayed yet. Calls with the same arguments take precedence.
+//
+// Returns nil if there is no such call.
+func (r *Recording) next(method string, args []byte) *RecordedCall {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var ret *RecordedCall
+	for _, call := range r.Calls {
+		if call.replayed || call.Method != method {
+			continue
+		}
+		if bytes.Equal(call.Args, args) {
+			ret = call
+			break
+		}
+		if ret == nil {
+			ret = call
+		}
+	}
+	if ret != nil {
+		ret.replayed = true
+	}
+	return ret
+}
+
+// encodeValue gob encodes the given value on its own.
+//
+// Returns nil if the value can't be encoded.
+func encodeValue(value interface{}) []byte {
+	if value == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// recordingCodec is a gob client codec which records the calls of
+// its client while a recording is set.
+type recordingCodec struct {
+	rwc       io.ReadWriteCloser
+	dec       *gob.Decoder
+	enc       *gob.Encoder
+	encBuf    *bufio.Writer
+	recording *Recording
+	// pending maps sequence numbers of recorded calls to the calls.
+	pending map[uint64]*RecordedCall
+	// response is the header of the response being read.
+	response *rpc.Response
+	// trace is the parent of the spans of traced calls.
+	trace *SpanContext
+	// spans maps sequence numbers of traced calls to their spans.
+	spans map[uint64]*Span
+	mutex sync.Mutex
+}
+
+func newRecordingCodec(conn io.ReadWriteCloser) *recordingCodec {
+	encBuf := bufio.NewWriter(conn)
+	return &recordingCodec{
+		rwc:     conn,
+		dec:     gob.NewDecoder(conn),
+		enc:     gob.NewEncoder(encBuf),
+		encBuf:  encBuf,
+		pending: make(map[uint64]*RecordedCall),
+		spans:   make(map[uint64]*Span),
+	}
+}
+
+func (c *recordingCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	c.mutex.Lock()
+	if c.recording != nil {
+		c.pending[r.Seq] = &RecordedCall{
+			Method: r.ServiceMethod, Args: encodeValue(body)}
+	}
+	if c.trace != nil && DefaultTracer != nil {
+		c.spans[r.Seq] = StartSpan(r.ServiceMethod, ClientSpan, c.trace)
+	}
+	c.mutex.Unlock()
+	if err := c.enc.Encode(r); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *recordingCodec) ReadResponseHeader(r *rpc.Response) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	c.response = r
+	return nil
+}
+
+func (c *recordingCodec) ReadResponseBody(body interface{}) error {
+	if err := c.dec.Decode(body); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	call, ok := c.pending[c.response.Seq]
+	delete(c.pending, c.response.Seq)
+	recording := c.recording
+	span := c.spans[c.response.Seq]
+	delete(c.spans, c.response.Seq)
+	c.mutex.Unlock()
+	if span != nil {
+		span.Error = c.response.Error
+		span.Finish()
+	}
+	if ok && recording != nil {
+		call.Reply = encodeValue(body)
+		call.Error = c.response.Error
+		recording.add(call)
+	}
+	return nil
+}
+
+func (c *recordingCodec) Close() error {
+	return c.rwc.Close()
+}
+
+// replayCodec is a client codec answering calls with the replies of
+// a recording instead of contacting a service.
+type replayCodec struct {
+	recording *Recording
+	responses chan replayResponse
+	// call is the call whose response is being read.
+	call *RecordedCall
+}
+
+// replayResponse is a queued response of a replayCodec.
+type replayResponse struct {
+	Seq    uint64
+	Method string
+	Call   *RecordedCall
+}
+
+func (c *replayCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	c.responses <- replayResponse{r.Seq, r.ServiceMethod,
+		c.recording.next(r.ServiceMethod, encodeValue(body))}
+	return nil
+}
+
+func (c *replayCodec) ReadResponseHeader(r *rpc.Response) error {
+	response, ok := <-c.responses
+	if !ok {
+		return io.EOF
+	}
+	r.Seq = response.Seq
+	r.ServiceMethod = response.Method
+	c.call = response.Call
+	switch {
+	case c.call == nil:
+		r.Error = fmt.Sprintf("service: No recorded call to %v left to replay",
+			response.Method)
+	default:
+		r.Error = c.call.Error
+	}
+	return nil
+}
+
+func (c *replayCodec) ReadResponseBody(body interface{}) error {
+	if body == nil || c.call == nil || len(c.call.Reply) == 0 {
+		return nil
+	}
+	return gob.NewDecoder(bytes.NewReader(c.call.Reply)).Decode(body)
+}
+
+func (c *replayCodec) Close() error {
+	close(c.responses)
+	return nil
+}
+
+// Record starts recording all calls of the client to the given
+// recording. A nil recording stops the recording.
+//
+// Clients not connected to a service can't record calls.
+func (s *Client) Record(recording *Recording) error {
+	if s.codec == nil {
+		return fmt.Errorf("service: Client is not recordable")
+	}
+	s.codec.mutex.Lock()
+	defer s.codec.mutex.Unlock()
+	s.codec.recording = recording
+	return nil
+}
+
+// NewReplayMonstiClient returns a client answering all calls with the
+// replies of the given recording.
+func NewReplayMonstiClient(recording *Recording) *MonstiClient {
+	var client MonstiClient
+	client.Id = getConnectionId()
+	client.RPCClient = rpc.NewClientWithCodec(&replayCodec{
+		recording: recording,
+		responses: make(chan replayResponse, 1)})
+	return &client
+}
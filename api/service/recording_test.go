@@ -0,0 +1,90 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+)
+
+type recordingTestService struct{}
+
+func (recordingTestService) Upper(args string, reply *string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("empty")
+	}
+	*reply = strings.ToUpper(args)
+	return nil
+}
+
+func TestRecording(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Test", recordingTestService{}); err != nil {
+		t.Fatalf("Could not register service: %v", err)
+	}
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	var client Client
+	client.codec = newRecordingCodec(clientConn)
+	client.RPCClient = rpc.NewClientWithCodec(client.codec)
+	defer client.Close()
+
+	var reply string
+	client.RPCClient.Call("Test.Upper", "ignored", &reply)
+	var recording Recording
+	if err := client.Record(&recording); err != nil {
+		t.Fatalf("Could not start recording: %v", err)
+	}
+	for _, args := range []string{"foo", "bar", ""} {
+		client.RPCClient.Call("Test.Upper", args, &reply)
+	}
+	client.Record(nil)
+	client.RPCClient.Call("Test.Upper", "ignored", &reply)
+	if len(recording.Calls) != 3 {
+		t.Fatalf("Recorded %v calls, should be 3", len(recording.Calls))
+	}
+	if recording.Calls[2].Error != "empty" {
+		t.Errorf("Recorded error is %q, should be %q", recording.Calls[2].Error,
+			"empty")
+	}
+
+	replay := NewReplayMonstiClient(&recording)
+	defer replay.Close()
+	tests := []struct {
+		Args, Reply, Error string
+	}{
+		{"bar", "BAR", ""},
+		{"unknown", "FOO", ""},
+		{"", "", "empty"},
+		{"foo", "", "service: No recorded call to Test.Upper left to replay"},
+	}
+	for i, test := range tests {
+		var reply string
+		err := replay.RPCClient.Call("Test.Upper", test.Args, &reply)
+		errString := ""
+		if err != nil {
+			errString = err.Error()
+		}
+		if reply != test.Reply || errString != test.Error {
+			t.Errorf("Test %v: Replayed Upper(%q) = %q, %q, should be %q, %q",
+				i, test.Args, reply, errString, test.Reply, test.Error)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Route is a URL path prefix of requests served by a module, see
+// ServeRoutes.
+type Route struct {
+	// Prefix is the path of the route, e.g. "/shop/cart". It matches
+	// requests to the path itself and to all paths below.
+	Prefix string
+	// Site restricts the route to the named site. Empty matches all
+	// sites.
+	Site string
+	// Service is the path to the unix domain socket of the module's
+	// HTTP server. It is set by ServeRoutes.
+	Service string
+}
+
+// Headers of requests proxied to routes. Headers sent by clients
+// starting with X-Monsti- are removed.
+const (
+	// RouteRequestHeader holds the id of the request, see
+	// GetRouteRequest.
+	RouteRequestHeader = "X-Monsti-Request"
+	// RouteSiteHeader holds the name of the request's site.
+	RouteSiteHeader = "X-Monsti-Site"
+	// RouteUserHeader holds the login of the authenticated user. It is
+	// missing for anonymous requests.
+	RouteUserHeader = "X-Monsti-User"
+)
+
+// RegisterRoute registers a route served by the module, see
+// ServeRoutes.
+func (s *MonstiClient) RegisterRoute(route *Route) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	if err := s.RPCClient.Call("Monsti.RegisterRoute", route,
+		new(int)); err != nil {
+		return fmt.Errorf("service: RegisterRoute error: %v", err)
+	}
+	return nil
+}
+
+// ServeRoutes serves HTTP requests to the given routes using the
+// handler. Monsti proxies matching requests to the unix domain socket
+// at the given path. Request and response bodies get streamed, so
+// handlers may serve uploads, downloads or server-sent events.
+// Handlers may also hijack the connection of upgrade requests, e.g.
+// for WebSockets. Proxied requests are not limited by the daemon's
+// request timeout.
+//
+// The handler gets the request's original path, host and headers.
+// Use GetRouteRequest to get the site and session of the request.
+func ServeRoutes(m *MonstiClient, path string, routes []*Route,
+	handler http.Handler, logger *log.Logger) error {
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("service: Could not listen on unix domain socket %q: %v",
+			path, err)
+	}
+	go func() {
+		server := &http.Server{Handler: handler, ErrorLog: logger}
+		if err := server.Serve(listener); err != nil {
+			logger.Printf("Could not serve routes: %v", err)
+		}
+	}()
+	for _, route := range routes {
+		route.Service = path
+		if err := m.RegisterRoute(route); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetRouteRequest returns the request proxied to a route, see
+// ServeRoutes. It is valid until the handler returns.
+func (s *MonstiClient) GetRouteRequest(r *http.Request) (*Request, error) {
+	id, err := strconv.ParseUint(r.Header.Get(RouteRequestHeader), 10, 0)
+	if err != nil {
+		return nil, fmt.Errorf("service: Request has not been proxied by Monsti")
+	}
+	req, err := s.GetRequest(uint(id))
+	if err != nil {
+		return nil, err
+	}
+	if req == nil {
+		return nil, fmt.Errorf("service: Unknown request %v", id)
+	}
+	return req, nil
+}
@@ -0,0 +1,93 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"regexp"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// HTMLAllowlist lists markup kept by SanitizeHTML in addition to the
+// default allowlist of HTML fields.
+type HTMLAllowlist struct {
+	// Elements are the names of allowed elements, e.g. "iframe".
+	Elements []string
+	// Attributes maps element names to their allowed attributes.
+	// Attributes of the element "*" are allowed on all elements.
+	Attributes map[string][]string
+	// URLSchemes are the allowed schemes of URLs besides http, https
+	// and mailto, e.g. "tel".
+	URLSchemes []string
+}
+
+// policy returns the sanitization policy of the default allowlist
+// extended by the given one.
+//
+// The default allowlist extends the policy for user generated content
+// by the markup produced by the editor: classes, anchors, responsive
+// images and embedded video and audio files. URLs with other schemes
+// than the allowed ones, e.g. javascript: URLs, get removed.
+func (a *HTMLAllowlist) policy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("class").Matching(
+		regexp.MustCompile(`^[\w\- ]+$`)).Globally()
+	p.AllowAttrs("id", "name").Matching(
+		regexp.MustCompile(`^[\w\-:.]+$`)).OnElements("a")
+	p.AllowAttrs("srcset", "sizes").OnElements("img")
+	p.AllowElements("figure", "figcaption", "video", "audio", "source")
+	p.AllowAttrs("src", "poster", "controls", "width",
+		"height").OnElements("video")
+	p.AllowAttrs("src", "controls").OnElements("audio")
+	p.AllowAttrs("src", "type").OnElements("source")
+	p.RequireParseableURLs(true)
+	p.AllowURLSchemes("http", "https", "mailto")
+	if a == nil {
+		return p
+	}
+	if len(a.Elements) > 0 {
+		p.AllowElements(a.Elements...)
+	}
+	for element, attrs := range a.Attributes {
+		if len(attrs) == 0 {
+			continue
+		}
+		if element == "*" {
+			p.AllowAttrs(attrs...).Globally()
+		} else {
+			p.AllowAttrs(attrs...).OnElements(element)
+		}
+	}
+	if len(a.URLSchemes) > 0 {
+		p.AllowURLSchemes(a.URLSchemes...)
+	}
+	return p
+}
+
+// defaultHTMLPolicy is the policy of the default allowlist.
+var defaultHTMLPolicy = (*HTMLAllowlist)(nil).policy()
+
+// SanitizeHTML removes any elements and attributes from the given
+// HTML which are neither on the default allowlist of HTML fields nor
+// on the given one, which may be nil. Scripts, styles, event handlers
+// and javascript: URLs are always removed unless explicitly allowed.
+func SanitizeHTML(code string, allowlist *HTMLAllowlist) string {
+	if allowlist == nil {
+		return defaultHTMLPolicy.Sanitize(code)
+	}
+	return allowlist.policy().Sanitize(code)
+}
@@ -62,6 +62,8 @@ type Client struct {
 	Error error
 	// Id is a unique identifier for this client.
 	Id string
+	// codec is the codec of the connection, used for recording.
+	codec *recordingCodec
 }
 
 // Connect establishes a new RPC connection to the given service.
@@ -74,7 +76,8 @@ func (s *Client) Connect(path string) error {
 	}
 	s.Id = getConnectionId()
 	// TODO Fix id
-	s.RPCClient = rpc.NewClient(conn)
+	s.codec = newRecordingCodec(conn)
+	s.RPCClient = rpc.NewClientWithCodec(s.codec)
 	return nil
 }
 
@@ -26,7 +26,10 @@ type SessionPool struct {
 	Size int
 	// MonstiPath is the path to the Monsti service to be used.
 	MonstiPath string
-	monsti     chan *MonstiClient
+	// Replay, if set, makes sessions answer all calls with the replies
+	// of the recording instead of connecting to the Monsti service.
+	Replay *Recording
+	monsti chan *MonstiClient
 }
 
 // NewSessionPool returns a new session pool.
@@ -44,6 +47,10 @@ func NewSessionPool(size int, monstiPath string) *SessionPool {
 // New returns a session from the pool.
 func (s *SessionPool) New() (*Session, error) {
 	session := &Session{pool: s}
+	if s.Replay != nil {
+		session.monsti = NewReplayMonstiClient(s.Replay)
+		return session, nil
+	}
 	select {
 	case session.monsti = <-s.monsti:
 	default:
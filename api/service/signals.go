@@ -16,11 +16,41 @@
 
 package service
 
-import "encoding/gob"
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"time"
+)
 
 func init() {
 	gob.RegisterName("monsti.NodeContextArgs", NodeContextArgs{})
 	gob.RegisterName("monsti.NodeContextRet", map[string]string{})
+	gob.RegisterName("monsti.RequestPaymentArgs", RequestPaymentArgs{})
+	gob.RegisterName("monsti.RequestPaymentRet", RequestPaymentRet{})
+	gob.RegisterName("monsti.ConfirmPaymentArgs", ConfirmPaymentArgs{})
+	gob.RegisterName("monsti.ConfirmPaymentRet", ConfirmPaymentRet{})
+	gob.RegisterName("monsti.ExperimentEventArgs", ExperimentEventArgs{})
+	gob.RegisterName("monsti.ExperimentEventRet", ExperimentEventRet{})
+	gob.RegisterName("monsti.NodeTypeChangedArgs", NodeTypeChangedArgs{})
+	gob.RegisterName("monsti.NodeTypeChangedRet", NodeTypeChangedRet{})
+	gob.RegisterName("monsti.ComputeFieldArgs", ComputeFieldArgs{})
+	gob.RegisterName("monsti.ComputeFieldRet", ComputeFieldRet{})
+	gob.RegisterName("monsti.ScanUploadArgs", ScanUploadArgs{})
+	gob.RegisterName("monsti.ScanUploadRet", ScanUploadRet{})
+	gob.RegisterName("monsti.HookArgs", HookArgs{})
+	gob.RegisterName("monsti.HookRet", HookRet{})
+	gob.RegisterName("monsti.NewCommentArgs", NewCommentArgs{})
+	gob.RegisterName("monsti.NewCommentRet", NewCommentRet{})
+	gob.RegisterName("monsti.TemplateFuncArgs", TemplateFuncArgs{})
+	gob.RegisterName("monsti.TemplateFuncRet", TemplateFuncRet{})
+	gob.RegisterName("monsti.ShortcodeArgs", ShortcodeArgs{})
+	gob.RegisterName("monsti.ShortcodeRet", ShortcodeRet{})
+	gob.RegisterName("monsti.MigrateNodeArgs", MigrateNodeArgs{})
+	gob.RegisterName("monsti.MigrateNodeRet", MigrateNodeRet{})
+	gob.RegisterName("monsti.RunTaskArgs", RunTaskArgs{})
+	gob.RegisterName("monsti.RunTaskRet", RunTaskRet{})
 }
 
 // SignalHandler wraps a handler for a specific signal.
@@ -57,3 +87,537 @@ func NewNodeContextHandler(
 		embedNode *EmbedNode) map[string]string) SignalHandler {
 	return &nodeContextHandler{cb}
 }
+
+type requestPaymentHandler struct {
+	f func(args RequestPaymentArgs) (string, error)
+}
+
+func (r *requestPaymentHandler) Name() string {
+	return "monsti.RequestPayment"
+}
+
+// RequestPaymentArgs are the arguments of the monsti.RequestPayment
+// signal.
+type RequestPaymentArgs struct {
+	// Request is the id of the request which submitted the form.
+	Request uint
+	// Token identifies the pending form submission.
+	Token string
+	// Amount to be paid in the smallest unit of the currency.
+	Amount uint
+	// Currency as ISO 4217 code, e.g. "EUR".
+	Currency    string
+	Description string
+	// CallbackURL is the absolute URL the payment provider should
+	// redirect the user to after the payment.
+	CallbackURL string
+}
+
+// RequestPaymentRet is the return value of the monsti.RequestPayment
+// signal.
+type RequestPaymentRet struct {
+	// RedirectURL is the URL of the payment provider.
+	RedirectURL string
+}
+
+func (r *requestPaymentHandler) Handle(args interface{}) (interface{}, error) {
+	target, err := r.f(args.(RequestPaymentArgs))
+	return RequestPaymentRet{target}, err
+}
+
+// NewRequestPaymentHandler constructs a signal handler that hands a
+// validated form submission to a payment provider.
+//
+// The callback must return the URL of the payment provider the user
+// should be redirected to, or an empty string if it does not handle
+// the payment.
+func NewRequestPaymentHandler(
+	cb func(args RequestPaymentArgs) (string, error)) SignalHandler {
+	return &requestPaymentHandler{cb}
+}
+
+type confirmPaymentHandler struct {
+	f func(args ConfirmPaymentArgs) (bool, error)
+}
+
+func (r *confirmPaymentHandler) Name() string {
+	return "monsti.ConfirmPayment"
+}
+
+// ConfirmPaymentArgs are the arguments of the monsti.ConfirmPayment
+// signal.
+type ConfirmPaymentArgs struct {
+	// Request is the id of the callback request. Use GetRequest to
+	// access the query values set by the payment provider.
+	Request uint
+	// Token identifies the pending form submission.
+	Token string
+}
+
+// ConfirmPaymentRet is the return value of the monsti.ConfirmPayment
+// signal.
+type ConfirmPaymentRet struct {
+	Confirmed bool
+}
+
+func (r *confirmPaymentHandler) Handle(args interface{}) (interface{}, error) {
+	confirmed, err := r.f(args.(ConfirmPaymentArgs))
+	return ConfirmPaymentRet{confirmed}, err
+}
+
+// NewConfirmPaymentHandler constructs a signal handler that is
+// called when the payment provider redirects the user to the
+// payment callback URL.
+//
+// The callback must return true iff the payment has been completed.
+func NewConfirmPaymentHandler(
+	cb func(args ConfirmPaymentArgs) (bool, error)) SignalHandler {
+	return &confirmPaymentHandler{cb}
+}
+
+type experimentEventHandler struct {
+	f func(args ExperimentEventArgs) error
+}
+
+func (r *experimentEventHandler) Name() string {
+	return "monsti.ExperimentEvent"
+}
+
+// ExperimentEventArgs are the arguments of the monsti.ExperimentEvent
+// signal.
+type ExperimentEventArgs struct {
+	Request uint
+	Site    string
+	// Node is the path of the node defining the experiment.
+	Node       string
+	Experiment string
+	Variant    string
+	// Conversion is false if the visitor has just been assigned to the
+	// variant and true if the visitor reached the experiment's goal.
+	Conversion bool
+}
+
+// ExperimentEventRet is the return value of the monsti.ExperimentEvent
+// signal.
+type ExperimentEventRet struct {
+	Handled bool
+}
+
+func (r *experimentEventHandler) Handle(args interface{}) (interface{}, error) {
+	err := r.f(args.(ExperimentEventArgs))
+	return ExperimentEventRet{err == nil}, err
+}
+
+// NewExperimentEventHandler constructs a signal handler that gets
+// called when a visitor gets assigned to an experiment variant or
+// reaches the experiment's goal, e.g. to aggregate the results.
+func NewExperimentEventHandler(
+	cb func(args ExperimentEventArgs) error) SignalHandler {
+	return &experimentEventHandler{cb}
+}
+
+type nodeTypeChangedHandler struct {
+	f func(args NodeTypeChangedArgs) error
+}
+
+func (r *nodeTypeChangedHandler) Name() string {
+	return "monsti.NodeTypeChanged"
+}
+
+// NodeTypeChangedArgs are the arguments of the monsti.NodeTypeChanged
+// signal.
+type NodeTypeChangedArgs struct {
+	// Id of the changed node type.
+	Id string
+	// Removed is true if the node type has been unregistered.
+	Removed bool
+	// RenamedFields maps old to new ids of renamed fields.
+	RenamedFields map[string]string
+	// RemovedFields are the ids of fields which are no longer part of
+	// the node type.
+	RemovedFields []string
+}
+
+// NodeTypeChangedRet is the return value of the
+// monsti.NodeTypeChanged signal.
+type NodeTypeChangedRet struct {
+	Handled bool
+}
+
+func (r *nodeTypeChangedHandler) Handle(args interface{}) (interface{}, error) {
+	err := r.f(args.(NodeTypeChangedArgs))
+	return NodeTypeChangedRet{err == nil}, err
+}
+
+// NewNodeTypeChangedHandler constructs a signal handler that gets
+// called when a node type has been updated or unregistered, e.g. to
+// refresh cached node types.
+func NewNodeTypeChangedHandler(
+	cb func(args NodeTypeChangedArgs) error) SignalHandler {
+	return &nodeTypeChangedHandler{cb}
+}
+
+type computeFieldHandler struct {
+	f func(args ComputeFieldArgs) (interface{}, error)
+}
+
+func (r *computeFieldHandler) Name() string {
+	return "monsti.ComputeField"
+}
+
+// ComputeFieldArgs are the arguments of the monsti.ComputeField
+// signal.
+type ComputeFieldArgs struct {
+	Request uint
+	Site    string
+	// Node is the path of the node whose field should be computed.
+	Node     string
+	NodeType string
+	// Field is the id of the computed field.
+	Field string
+	// Compute is the id of the computation, i.e. the field's Compute
+	// setting.
+	Compute string
+	// Values maps the ids of the node's fields to their string
+	// representation.
+	Values map[string]string
+}
+
+// ComputeFieldRet is the return value of the monsti.ComputeField
+// signal.
+type ComputeFieldRet struct {
+	Handled bool
+	// Value is the JSON encoded value of the field, like it is stored
+	// in node.json.
+	Value []byte
+}
+
+func (r *computeFieldHandler) Handle(args interface{}) (interface{}, error) {
+	value, err := r.f(args.(ComputeFieldArgs))
+	if err != nil || value == nil {
+		return ComputeFieldRet{}, err
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return ComputeFieldRet{}, err
+	}
+	return ComputeFieldRet{true, encoded}, nil
+}
+
+// NewComputeFieldHandler constructs a signal handler that computes
+// the values of computed fields, e.g. the word count of a text.
+//
+// The callback must return the value of the field, e.g. a string for
+// Text fields, or nil if it does not handle the computation.
+func NewComputeFieldHandler(
+	cb func(args ComputeFieldArgs) (interface{}, error)) SignalHandler {
+	return &computeFieldHandler{cb}
+}
+
+type scanUploadHandler struct {
+	f func(args ScanUploadArgs) (string, error)
+}
+
+func (r *scanUploadHandler) Name() string {
+	return "monsti.ScanUpload"
+}
+
+// ScanUploadArgs are the arguments of the monsti.ScanUpload signal.
+type ScanUploadArgs struct {
+	Site string
+	// Login of the uploading user. It is empty for files submitted by
+	// visitors using forms.
+	Login string
+	// Name is the name of the uploaded file.
+	Name    string
+	Content []byte
+}
+
+// ScanUploadRet is the return value of the monsti.ScanUpload signal.
+type ScanUploadRet struct {
+	Flagged bool
+	// Reason describes why the file has been flagged, e.g. the name
+	// of the found virus.
+	Reason string
+}
+
+func (r *scanUploadHandler) Handle(args interface{}) (interface{}, error) {
+	reason, err := r.f(args.(ScanUploadArgs))
+	return ScanUploadRet{reason != "", reason}, err
+}
+
+// NewScanUploadHandler constructs a signal handler that scans
+// uploaded files, e.g. for viruses.
+//
+// The callback must return the reason why the file should be
+// quarantined, or an empty string if the file is clean.
+func NewScanUploadHandler(
+	cb func(args ScanUploadArgs) (string, error)) SignalHandler {
+	return &scanUploadHandler{cb}
+}
+
+type hookHandler struct {
+	f func(args HookArgs) error
+}
+
+func (r *hookHandler) Name() string {
+	return "monsti.Hook"
+}
+
+// HookArgs are the arguments of the monsti.Hook signal.
+type HookArgs struct {
+	// Operation is the name of the hooked operation, e.g. "publish".
+	Operation string
+	// Stage is either "pre" or "post".
+	Stage string
+	// Values describe the operation, e.g. the site and node path.
+	Values map[string]string
+}
+
+// HookRet is the return value of the monsti.Hook signal.
+type HookRet struct {
+	// Error describes why the hook failed, if it did.
+	Error string
+}
+
+func (r *hookHandler) Handle(args interface{}) (interface{}, error) {
+	if err := r.f(args.(HookArgs)); err != nil {
+		return HookRet{err.Error()}, nil
+	}
+	return HookRet{}, nil
+}
+
+// NewHookHandler constructs a signal handler that gets run by hooks
+// configured with signal set, e.g. to notify editors about published
+// nodes.
+//
+// Returning an error fails the hook. Depending on the hook's
+// configuration, this aborts the operation.
+func NewHookHandler(cb func(args HookArgs) error) SignalHandler {
+	return &hookHandler{cb}
+}
+
+type newCommentHandler struct {
+	f func(args NewCommentArgs) (string, error)
+}
+
+func (r *newCommentHandler) Name() string {
+	return "monsti.NewComment"
+}
+
+// NewCommentArgs are the arguments of the monsti.NewComment signal.
+type NewCommentArgs struct {
+	Site string
+	// Node is the path of the commented node.
+	Node string
+	// Name and Email as given by the author.
+	Name, Email string
+	// Login of the author. It is empty for comments of visitors.
+	Login string
+	Text  string
+	// IP and UserAgent of the author's request.
+	IP, UserAgent string
+}
+
+// NewCommentRet is the return value of the monsti.NewComment signal.
+type NewCommentRet struct {
+	Spam bool
+	// Reason describes why the comment has been flagged as spam.
+	Reason string
+}
+
+func (r *newCommentHandler) Handle(args interface{}) (interface{}, error) {
+	reason, err := r.f(args.(NewCommentArgs))
+	return NewCommentRet{reason != "", reason}, err
+}
+
+// NewNewCommentHandler constructs a signal handler that checks new
+// comments, e.g. for spam.
+//
+// The callback must return the reason why the comment is spam, or an
+// empty string if the comment is fine.
+func NewNewCommentHandler(
+	cb func(args NewCommentArgs) (string, error)) SignalHandler {
+	return &newCommentHandler{cb}
+}
+
+type templateFuncHandler struct {
+	f func(args TemplateFuncArgs) (interface{}, error)
+}
+
+func (r *templateFuncHandler) Name() string {
+	return "monsti.TemplateFunc"
+}
+
+// TemplateFuncArgs are the arguments of the monsti.TemplateFunc
+// signal.
+type TemplateFuncArgs struct {
+	// Name is the name of the called function, see RegisterTemplateFunc.
+	Name string
+	// Args are the string representations of the function's arguments.
+	Args []string
+}
+
+// TemplateFuncRet is the return value of the monsti.TemplateFunc
+// signal.
+type TemplateFuncRet struct {
+	Handled bool
+	Value   string
+	// HTML is true if Value is safe HTML which must not be escaped.
+	HTML bool
+}
+
+func (r *templateFuncHandler) Handle(args interface{}) (interface{}, error) {
+	value, err := r.f(args.(TemplateFuncArgs))
+	if err != nil || value == nil {
+		return TemplateFuncRet{}, err
+	}
+	if html, ok := value.(template.HTML); ok {
+		return TemplateFuncRet{true, string(html), true}, nil
+	}
+	return TemplateFuncRet{true, fmt.Sprint(value), false}, nil
+}
+
+// NewTemplateFuncHandler constructs a signal handler that computes
+// the results of template functions registered with
+// RegisterTemplateFunc.
+//
+// The callback must return the result of the function, which gets
+// escaped unless it's a template.HTML, or nil if it does not handle
+// the function.
+func NewTemplateFuncHandler(
+	cb func(args TemplateFuncArgs) (interface{}, error)) SignalHandler {
+	return &templateFuncHandler{cb}
+}
+
+type shortcodeHandler struct {
+	f func(args ShortcodeArgs) (string, bool, error)
+}
+
+func (r *shortcodeHandler) Name() string {
+	return "monsti.Shortcode"
+}
+
+// ShortcodeArgs are the arguments of the monsti.Shortcode signal.
+type ShortcodeArgs struct {
+	Request uint
+	Site    string
+	// Node is the path of the node containing the shortcode.
+	Node string
+	// Name is the name of the shortcode, see RegisterShortcode.
+	Name string
+	// Args are the positional arguments of the shortcode, e.g. "/about"
+	// for [form /about], and Attrs the named ones, e.g. "path" for
+	// [gallery path=/photos].
+	Args  []string
+	Attrs map[string]string
+}
+
+// ShortcodeRet is the return value of the monsti.Shortcode signal.
+type ShortcodeRet struct {
+	Handled bool
+	// HTML replaces the shortcode. It does not get escaped.
+	HTML string
+}
+
+func (r *shortcodeHandler) Handle(args interface{}) (interface{}, error) {
+	html, handled, err := r.f(args.(ShortcodeArgs))
+	return ShortcodeRet{handled, html}, err
+}
+
+// NewShortcodeHandler constructs a signal handler that expands
+// shortcodes registered with RegisterShortcode.
+//
+// The callback must return the HTML replacing the shortcode and true,
+// or false if it does not handle the shortcode.
+func NewShortcodeHandler(
+	cb func(args ShortcodeArgs) (string, bool, error)) SignalHandler {
+	return &shortcodeHandler{cb}
+}
+
+type migrateNodeHandler struct {
+	f func(args MigrateNodeArgs) (map[string][]byte, error)
+}
+
+func (r *migrateNodeHandler) Name() string {
+	return "monsti.MigrateNode"
+}
+
+// MigrateNodeArgs are the arguments of the monsti.MigrateNode signal.
+type MigrateNodeArgs struct {
+	Site string
+	// Node is the path of the migrated node.
+	Node     string
+	NodeType string
+	// Convert is the id of the conversion, i.e. the migration's Convert
+	// setting, and Version the migration's version.
+	Convert string
+	Version int
+	// Fields maps the ids of the node's fields to their JSON encoded
+	// values, like they are stored in node.json.
+	Fields map[string][]byte
+}
+
+// MigrateNodeRet is the return value of the monsti.MigrateNode signal.
+type MigrateNodeRet struct {
+	Handled bool
+	// Fields are all fields of the node after the conversion.
+	Fields map[string][]byte
+}
+
+func (r *migrateNodeHandler) Handle(args interface{}) (interface{}, error) {
+	fields, err := r.f(args.(MigrateNodeArgs))
+	return MigrateNodeRet{fields != nil, fields}, err
+}
+
+// NewMigrateNodeHandler constructs a signal handler that converts the
+// fields of nodes migrated by a Migration with a Convert setting.
+//
+// The callback must return all fields of the converted node, like
+// they are given in the arguments, or nil if it does not handle the
+// conversion.
+func NewMigrateNodeHandler(
+	cb func(args MigrateNodeArgs) (map[string][]byte, error)) SignalHandler {
+	return &migrateNodeHandler{cb}
+}
+
+type runTaskHandler struct {
+	f func(args RunTaskArgs) (bool, error)
+}
+
+func (r *runTaskHandler) Name() string {
+	return "monsti.RunTask"
+}
+
+// RunTaskArgs are the arguments of the monsti.RunTask signal.
+type RunTaskArgs struct {
+	// Task is the id of the task and Site the site to run it for, if
+	// any.
+	Task, Site string
+	// Time is the scheduled time of the run.
+	Time time.Time
+}
+
+// RunTaskRet is the return value of the monsti.RunTask signal.
+type RunTaskRet struct {
+	Handled bool
+	// Error describes why the task failed, if it did.
+	Error string
+}
+
+func (r *runTaskHandler) Handle(args interface{}) (interface{}, error) {
+	handled, err := r.f(args.(RunTaskArgs))
+	if err != nil {
+		return RunTaskRet{handled, err.Error()}, nil
+	}
+	return RunTaskRet{Handled: handled}, nil
+}
+
+// NewRunTaskHandler constructs a signal handler that runs scheduled
+// tasks, see Task.
+//
+// The callback must return false if it does not handle the task.
+// Returning an error marks the run as failed on the dashboard.
+func NewRunTaskHandler(cb func(args RunTaskArgs) (bool, error)) SignalHandler {
+	return &runTaskHandler{cb}
+}
@@ -0,0 +1,292 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// SpanContext identifies a span of a trace. It's propagated in the
+// W3C traceparent format, e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+type SpanContext struct {
+	// TraceID is the hex encoded 16 byte id of the trace.
+	TraceID string
+	// SpanID is the hex encoded 8 byte id of the span.
+	SpanID string
+}
+
+// randomID returns n random bytes, hex encoded.
+func randomID(n int) string {
+	id := make([]byte, n)
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Sprintf("service: Could not generate id: %v", err))
+	}
+	return hex.EncodeToString(id)
+}
+
+// NewSpanContext returns the context of a new span. The span belongs
+// to the trace of the parent or to a new trace if parent is nil.
+func NewSpanContext(parent *SpanContext) SpanContext {
+	ret := SpanContext{SpanID: randomID(8)}
+	if parent != nil {
+		ret.TraceID = parent.TraceID
+	} else {
+		ret.TraceID = randomID(16)
+	}
+	return ret
+}
+
+// Traceparent returns the span context in the W3C traceparent format.
+func (s SpanContext) Traceparent() string {
+	return "00-" + s.TraceID + "-" + s.SpanID + "-01"
+}
+
+var traceparentRegexp = regexp.MustCompile(
+	`^[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+// ParseTraceparent returns the span context given in the W3C
+// traceparent format or nil if the value is invalid.
+func ParseTraceparent(value string) *SpanContext {
+	match := traceparentRegexp.FindStringSubmatch(value)
+	if match == nil || match[1] == "00000000000000000000000000000000" ||
+		match[2] == "0000000000000000" {
+		return nil
+	}
+	return &SpanContext{TraceID: match[1], SpanID: match[2]}
+}
+
+// Span kinds.
+const (
+	InternalSpan = "internal"
+	// ServerSpan is used for handled requests and signals.
+	ServerSpan = "server"
+	// ClientSpan is used for RPC calls.
+	ClientSpan = "client"
+)
+
+// Span is an operation of a trace, e.g. an HTTP request or an RPC
+// call.
+type Span struct {
+	Name    string
+	Kind    string
+	Context SpanContext
+	// ParentID is the span id of the parent span. It's empty for root
+	// spans.
+	ParentID   string
+	Start, End time.Time
+	Attributes map[string]string
+	// Error describes why the operation failed, if it did.
+	Error string
+}
+
+// StartSpan starts a span of the given kind as child of the given
+// parent. A nil parent starts a new trace.
+func StartSpan(name, kind string, parent *SpanContext) *Span {
+	span := &Span{Name: name, Kind: kind, Context: NewSpanContext(parent),
+		Start: time.Now(), Attributes: make(map[string]string)}
+	if parent != nil {
+		span.ParentID = parent.SpanID
+	}
+	return span
+}
+
+// Finish ends the span and hands it to the DefaultTracer, if any.
+func (s *Span) Finish() {
+	s.End = time.Now()
+	if tracer := DefaultTracer; tracer != nil {
+		tracer.add(s)
+	}
+}
+
+// SpanExporter exports finished spans.
+type SpanExporter interface {
+	// ExportSpans exports the spans of the named service.
+	ExportSpans(service string, spans []*Span) error
+}
+
+// maxPendingSpans is the number of spans kept for the next export.
+// Further spans get dropped.
+const maxPendingSpans = 4096
+
+// Tracer collects finished spans and exports them periodically.
+type Tracer struct {
+	// Service is the name of the process, e.g. "monsti-daemon".
+	Service  string
+	Exporter SpanExporter
+	// Logger receives failed exports.
+	Logger  *log.Logger
+	mutex   sync.Mutex
+	pending []*Span
+}
+
+// NewTracer returns a tracer exporting the collected spans of the
+// given service every interval.
+func NewTracer(service string, exporter SpanExporter, interval time.Duration,
+	logger *log.Logger) *Tracer {
+	t := &Tracer{Service: service, Exporter: exporter, Logger: logger}
+	go func() {
+		for range time.Tick(interval) {
+			if err := t.Flush(); err != nil {
+				t.Logger.Printf("Could not export spans: %v", err)
+			}
+		}
+	}()
+	return t
+}
+
+// add queues the span for the next export.
+func (t *Tracer) add(span *Span) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.pending) < maxPendingSpans {
+		t.pending = append(t.pending, span)
+	}
+}
+
+// Flush exports the collected spans.
+func (t *Tracer) Flush() error {
+	t.mutex.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mutex.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	return t.Exporter.ExportSpans(t.Service, spans)
+}
+
+// DefaultTracer collects the spans of the process. Tracing is disabled
+// if it's nil.
+var DefaultTracer *Tracer
+
+// tracingInterval is the interval between span exports.
+const tracingInterval = 5 * time.Second
+
+// SetupTracing sets the DefaultTracer to export the spans of the named
+// service to the given OTLP/HTTP endpoint. Tracing stays disabled if
+// the endpoint is empty.
+func SetupTracing(service, endpoint string, logger *log.Logger) {
+	if endpoint == "" {
+		return
+	}
+	DefaultTracer = NewTracer(service, &OTLPExporter{URL: endpoint},
+		tracingInterval, logger)
+}
+
+// OTLPExporter exports spans to an OpenTelemetry collector using OTLP
+// over HTTP with JSON encoding.
+type OTLPExporter struct {
+	// URL of the collector's traces endpoint, e.g.
+	// "http://localhost:4318/v1/traces".
+	URL string
+}
+
+// otlpKinds maps span kinds to the OTLP span kind values.
+var otlpKinds = map[string]int{InternalSpan: 1, ServerSpan: 2, ClientSpan: 3}
+
+// otlpAttributes returns the attributes in OTLP's JSON encoding.
+func otlpAttributes(attributes map[string]string) []interface{} {
+	ret := make([]interface{}, 0, len(attributes))
+	for key, value := range attributes {
+		ret = append(ret, map[string]interface{}{
+			"key": key, "value": map[string]string{"stringValue": value}})
+	}
+	return ret
+}
+
+// otlpRequest returns the OTLP JSON request body exporting the spans.
+func otlpRequest(service string, spans []*Span) ([]byte, error) {
+	otlpSpans := make([]interface{}, 0, len(spans))
+	for _, span := range spans {
+		otlpSpan := map[string]interface{}{
+			"traceId":           span.Context.TraceID,
+			"spanId":            span.Context.SpanID,
+			"name":              span.Name,
+			"kind":              otlpKinds[span.Kind],
+			"startTimeUnixNano": fmt.Sprint(span.Start.UnixNano()),
+			"endTimeUnixNano":   fmt.Sprint(span.End.UnixNano()),
+			"attributes":        otlpAttributes(span.Attributes)}
+		if span.ParentID != "" {
+			otlpSpan["parentSpanId"] = span.ParentID
+		}
+		if span.Error != "" {
+			otlpSpan["status"] = map[string]interface{}{
+				"code": 2, "message": span.Error}
+		}
+		otlpSpans = append(otlpSpans, otlpSpan)
+	}
+	return json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]string{
+					"service.name": service})},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "pkg.monsti.org/monsti"},
+				"spans": otlpSpans}}}}})
+}
+
+// ExportSpans sends the spans to the collector.
+func (e *OTLPExporter) ExportSpans(service string, spans []*Span) error {
+	body, err := otlpRequest(service, spans)
+	if err != nil {
+		return fmt.Errorf("service: Could not encode spans: %v", err)
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	res, err := client.Post(e.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("service: Could not send spans: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("service: Collector answered %v", res.Status)
+	}
+	return nil
+}
+
+// SetTrace makes the client record its RPC calls as spans with the
+// given parent. A nil parent stops the tracing.
+//
+// Clients not connected to a service can't be traced.
+func (s *Client) SetTrace(parent *SpanContext) {
+	if s.codec == nil {
+		return
+	}
+	s.codec.mutex.Lock()
+	defer s.codec.mutex.Unlock()
+	s.codec.trace = parent
+}
+
+// Trace returns the parent of the spans of the client's calls or nil
+// if the client is not traced.
+func (s *Client) Trace() *SpanContext {
+	if s.codec == nil {
+		return nil
+	}
+	s.codec.mutex.Lock()
+	defer s.codec.mutex.Unlock()
+	return s.codec.trace
+}
@@ -0,0 +1,154 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		Value   string
+		Context *SpanContext
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			&SpanContext{"4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"}},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", nil},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", nil},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", nil},
+		{"00-4bf92f3577b34da6-00f067aa0ba902b7-01", nil},
+		{"", nil},
+	}
+	for i, test := range tests {
+		ret := ParseTraceparent(test.Value)
+		if (ret == nil) != (test.Context == nil) ||
+			(ret != nil && *ret != *test.Context) {
+			t.Errorf("Test %v: ParseTraceparent(%q) = %v, should be %v", i,
+				test.Value, ret, test.Context)
+		}
+	}
+	parent := NewSpanContext(nil)
+	child := NewSpanContext(&parent)
+	if child.TraceID != parent.TraceID || child.SpanID == parent.SpanID {
+		t.Errorf("NewSpanContext(%v) = %v, should be a new span of the trace",
+			parent, child)
+	}
+	if ret := ParseTraceparent(child.Traceparent()); ret == nil ||
+		*ret != child {
+		t.Errorf("ParseTraceparent(%q) = %v, should be %v",
+			child.Traceparent(), ret, child)
+	}
+}
+
+type testSpanExporter struct {
+	Spans []*Span
+}
+
+func (e *testSpanExporter) ExportSpans(service string, spans []*Span) error {
+	e.Spans = append(e.Spans, spans...)
+	return nil
+}
+
+func TestTracedClient(t *testing.T) {
+	exporter := new(testSpanExporter)
+	DefaultTracer = &Tracer{Service: "test", Exporter: exporter}
+	defer func() { DefaultTracer = nil }()
+	server := rpc.NewServer()
+	if err := server.RegisterName("Test", recordingTestService{}); err != nil {
+		t.Fatalf("Could not register service: %v", err)
+	}
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	var client Client
+	client.codec = newRecordingCodec(clientConn)
+	client.RPCClient = rpc.NewClientWithCodec(client.codec)
+	defer client.Close()
+
+	var reply string
+	client.RPCClient.Call("Test.Upper", "ignored", &reply)
+	parent := StartSpan("GET /", ServerSpan, nil)
+	client.SetTrace(&parent.Context)
+	client.RPCClient.Call("Test.Upper", "foo", &reply)
+	client.RPCClient.Call("Test.Upper", "", &reply)
+	client.SetTrace(nil)
+	client.RPCClient.Call("Test.Upper", "ignored", &reply)
+	if err := DefaultTracer.Flush(); err != nil {
+		t.Fatalf("Could not flush spans: %v", err)
+	}
+	if len(exporter.Spans) != 2 {
+		t.Fatalf("Traced %v calls, should be 2", len(exporter.Spans))
+	}
+	for i, span := range exporter.Spans {
+		if span.Name != "Test.Upper" || span.Kind != ClientSpan ||
+			span.ParentID != parent.Context.SpanID ||
+			span.Context.TraceID != parent.Context.TraceID {
+			t.Errorf("Span %v is %v, should be a child of %v", i, span,
+				parent.Context)
+		}
+	}
+	if exporter.Spans[0].Error != "" || exporter.Spans[1].Error != "empty" {
+		t.Errorf("Span errors are %q and %q, should be %q and %q",
+			exporter.Spans[0].Error, exporter.Spans[1].Error, "", "empty")
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			content, _ := ioutil.ReadAll(r.Body)
+			if err := json.Unmarshal(content, &body); err != nil {
+				t.Errorf("Could not decode request: %v", err)
+			}
+		}))
+	defer server.Close()
+	parent := StartSpan("GET /", ServerSpan, nil)
+	parent.End = parent.Start
+	child := StartSpan("Monsti.GetNode", ClientSpan, &parent.Context)
+	child.End = child.Start
+	child.Error = "failed"
+	exporter := &OTLPExporter{URL: server.URL}
+	if err := exporter.ExportSpans("monsti-daemon",
+		[]*Span{parent, child}); err != nil {
+		t.Fatalf("Could not export spans: %v", err)
+	}
+	resourceSpans := body["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	spans := resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	if len(spans) != 2 {
+		t.Fatalf("Exported %v spans, should be 2", len(spans))
+	}
+	exported := spans[1].(map[string]interface{})
+	if exported["traceId"] != parent.Context.TraceID ||
+		exported["parentSpanId"] != parent.Context.SpanID ||
+		exported["kind"] != float64(3) {
+		t.Errorf("Exported span is %v, should be a client child of %v",
+			exported, parent.Context)
+	}
+	if status, _ := exported["status"].(map[string]interface{}); status == nil ||
+		status["message"] != "failed" {
+		t.Errorf("Exported span status is %v, should be the error", status)
+	}
+	if _, ok := spans[0].(map[string]interface{})["parentSpanId"]; ok {
+		t.Errorf("Exported root span should not have a parent")
+	}
+}
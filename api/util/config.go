@@ -0,0 +1,248 @@
+// This file is part of monsti/util.
+// Copyright 2012-2014 Christian Neumann
+
+// monsti/util is free software: you can redistribute it and/or modify it under
+// the terms of the GNU Lesser General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+
+// monsti/util is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU Lesser General Public License for more
+// details.
+
+// You should have received a copy of the GNU Lesser General Public License
+// along with monsti/util. If not, see <http://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"launchpad.net/goyaml"
+)
+
+// ConfigExtensions are the supported configuration file extensions in
+// order of precedence.
+var ConfigExtensions = []string{".json", ".yaml", ".yml", ".toml"}
+
+// FindConfigFile returns the path of the configuration file with the
+// given path without extension, e.g. "/etc/monsti/sites/foo/core".
+//
+// If there are several candidates, the one with the extension coming
+// first in ConfigExtensions wins. If there is no such file, it returns
+// an empty string.
+func FindConfigFile(base string) (string, error) {
+	for _, ext := range ConfigExtensions {
+		path := base + ext
+		_, err := os.Stat(path)
+		if err == nil {
+			return path, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", fmt.Errorf("Could not stat configuration file: %v", err)
+		}
+	}
+	return "", nil
+}
+
+// ParseConfig unmarshals the given configuration file into out. The
+// format (JSON, YAML or TOML) is detected by the file extension.
+//
+// If out is a pointer to an empty interface, all maps will be of type
+// map[string]interface{} regardless of the format.
+//
+// References in string values will be replaced: `${NAME}` by the
+// value of the environment variable NAME and `${file:PATH}` by the
+// content of the file at PATH (relative to the configuration file)
+// without trailing newlines. Use `$${` to get a literal `${`.
+func ParseConfig(path string, out interface{}) error {
+	if err := ParseRawConfig(path, out); err != nil {
+		return err
+	}
+	if err := interpolateConfig(reflect.ValueOf(out),
+		filepath.Dir(path)); err != nil {
+		return fmt.Errorf("Could not interpolate configuration file %q: %v",
+			path, err)
+	}
+	return nil
+}
+
+// ParseRawConfig is like ParseConfig but does not replace references.
+func ParseRawConfig(path string, out interface{}) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Could not read configuration file: %v", err)
+	}
+	switch filepath.Ext(path) {
+	case ".json":
+		err = json.Unmarshal(content, out)
+	case ".yaml", ".yml":
+		err = goyaml.Unmarshal(content, out)
+		if generic, ok := out.(*interface{}); ok && err == nil {
+			*generic = normalizeConfig(*generic)
+		}
+	case ".toml":
+		_, err = toml.Decode(string(content), out)
+	default:
+		return fmt.Errorf("Unknown configuration format of %q", path)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not parse configuration file %q: %v", path, err)
+	}
+	return nil
+}
+
+// WriteConfig marshals the given value into the configuration file at
+// path. The format is detected by the file extension.
+func WriteConfig(path string, in interface{}) error {
+	var content []byte
+	var err error
+	switch filepath.Ext(path) {
+	case ".json":
+		content, err = json.MarshalIndent(in, "", "  ")
+	case ".yaml", ".yml":
+		content, err = goyaml.Marshal(in)
+	case ".toml":
+		var buf bytes.Buffer
+		err = toml.NewEncoder(&buf).Encode(in)
+		content = buf.Bytes()
+	default:
+		return fmt.Errorf("Unknown configuration format of %q", path)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not encode configuration: %v", err)
+	}
+	if err = ioutil.WriteFile(path, content, 0600); err != nil {
+		return fmt.Errorf("Could not write configuration file: %v", err)
+	}
+	return nil
+}
+
+// normalizeConfig converts the maps of YAML documents into
+// map[string]interface{} values.
+func normalizeConfig(in interface{}) interface{} {
+	switch value := in.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			out[fmt.Sprint(k)] = normalizeConfig(v)
+		}
+		return out
+	case map[string]interface{}:
+		for k, v := range value {
+			value[k] = normalizeConfig(v)
+		}
+	case []interface{}:
+		for i, v := range value {
+			value[i] = normalizeConfig(v)
+		}
+	}
+	return in
+}
+
+// interpolateString replaces the references in the given string (see
+// ParseConfig). Relative file paths are relative to dir.
+func interpolateString(in, dir string) (string, error) {
+	var out bytes.Buffer
+	for {
+		start := strings.Index(in, "${")
+		if start < 0 {
+			out.WriteString(in)
+			return out.String(), nil
+		}
+		if start > 0 && in[start-1] == '$' {
+			out.WriteString(in[:start])
+			out.WriteString("{")
+			in = in[start+2:]
+			continue
+		}
+		end := strings.Index(in[start:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("Unterminated reference in %q", in)
+		}
+		out.WriteString(in[:start])
+		ref := in[start+2 : start+end]
+		if strings.HasPrefix(ref, "file:") {
+			path := ref[len("file:"):]
+			MakeAbsolute(&path, dir)
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return "", fmt.Errorf("Could not read secret file: %v", err)
+			}
+			out.WriteString(strings.TrimRight(string(content), "\r\n"))
+		} else {
+			value, ok := os.LookupEnv(ref)
+			if !ok {
+				return "", fmt.Errorf("Environment variable %q is not set", ref)
+			}
+			out.WriteString(value)
+		}
+		in = in[start+end+1:]
+	}
+}
+
+// interpolateConfig replaces the references in all strings reachable
+// from the given value (see ParseConfig).
+func interpolateConfig(v reflect.Value, dir string) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return interpolateConfig(v.Elem(), dir)
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		elem := reflect.New(v.Elem().Type()).Elem()
+		elem.Set(v.Elem())
+		if err := interpolateConfig(elem, dir); err != nil {
+			return err
+		}
+		if v.CanSet() {
+			v.Set(elem)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if field := v.Field(i); field.CanSet() {
+				if err := interpolateConfig(field, dir); err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(key))
+			if err := interpolateConfig(elem, dir); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := interpolateConfig(v.Index(i), dir); err != nil {
+				return err
+			}
+		}
+	case reflect.String:
+		if !v.CanSet() {
+			return nil
+		}
+		value, err := interpolateString(v.String(), dir)
+		if err != nil {
+			return err
+		}
+		v.SetString(value)
+	}
+	return nil
+}
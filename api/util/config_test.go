@@ -0,0 +1,131 @@
+// This file is part of monsti/util.
+// Copyright 2012-2014 Christian Neumann
+
+// monsti/util is free software: you can redistribute it and/or modify it under
+// the terms of the GNU Lesser General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+
+// monsti/util is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU Lesser General Public License for more
+// details.
+
+// You should have received a copy of the GNU Lesser General Public License
+// along with monsti/util. If not, see <http://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestFindConfigFile(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/a.json": `{}`,
+		"/a.yaml": ``,
+		"/b.toml": ``,
+		"/b.yml":  ``,
+	}, "TestFindConfigFile")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct{ Base, Expected string }{
+		{"a", "a.json"},
+		{"b", "b.yml"},
+		{"c", ""},
+	}
+	for _, test := range tests {
+		ret, err := FindConfigFile(filepath.Join(root, test.Base))
+		if err != nil {
+			t.Errorf("FindConfigFile(%q) returned error: %v", test.Base, err)
+		}
+		if len(test.Expected) > 0 {
+			test.Expected = filepath.Join(root, test.Expected)
+		}
+		if ret != test.Expected {
+			t.Errorf("FindConfigFile(%q) = %q, should be %q", test.Base, ret,
+				test.Expected)
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/site.json": `{"title": "Foo", "locale": "de"}`,
+		"/site.yaml": "title: Foo\nlocale: de\n",
+		"/site.toml": "title = \"Foo\"\nlocale = \"de\"\n",
+		"/site.ini":  "",
+	}, "TestParseConfig")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	for _, file := range []string{"site.json", "site.yaml", "site.toml"} {
+		var settings SiteSettings
+		if err := ParseConfig(filepath.Join(root, file), &settings); err != nil {
+			t.Errorf("ParseConfig(%q) returned error: %v", file, err)
+		}
+		if settings.Title != "Foo" || settings.Locale != "de" {
+			t.Errorf("ParseConfig(%q) parsed %v, should have title Foo and locale de",
+				file, settings)
+		}
+	}
+	var settings SiteSettings
+	if err := ParseConfig(filepath.Join(root, "site.ini"), &settings); err == nil {
+		t.Errorf("ParseConfig should fail for unknown formats")
+	}
+}
+
+func TestParseConfigInterpolation(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/secrets/smtp":  "secret\n",
+		"/daemon.yaml":   "mail:\n  password: ${file:secrets/smtp}\n  user: ${MONSTI_TEST_USER}\n",
+		"/escaped.json":  `{"foo": "$${MONSTI_TEST_USER}", "bar": ["x${MONSTI_TEST_USER}x"]}`,
+		"/unknown.json":  `{"foo": "${MONSTI_TEST_UNKNOWN}"}`,
+		"/unclosed.json": `{"foo": "${MONSTI_TEST_USER"}`,
+	}, "TestParseConfigInterpolation")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	os.Setenv("MONSTI_TEST_USER", "monsti")
+	os.Unsetenv("MONSTI_TEST_UNKNOWN")
+
+	var settings struct {
+		Mail struct{ User, Password string }
+	}
+	if err := ParseConfig(filepath.Join(root, "daemon.yaml"), &settings); err != nil {
+		t.Fatalf("ParseConfig returned error: %v", err)
+	}
+	if settings.Mail.User != "monsti" || settings.Mail.Password != "secret" {
+		t.Errorf("Interpolated settings are %v, should be monsti and secret",
+			settings)
+	}
+
+	var generic interface{}
+	if err := ParseConfig(filepath.Join(root, "escaped.json"), &generic); err != nil {
+		t.Fatalf("ParseConfig returned error: %v", err)
+	}
+	expected := map[string]interface{}{
+		"foo": "${MONSTI_TEST_USER}",
+		"bar": []interface{}{"xmonstix"}}
+	if !reflect.DeepEqual(generic, expected) {
+		t.Errorf("Interpolated config is %v, should be %v", generic, expected)
+	}
+	var raw interface{}
+	if err := ParseRawConfig(filepath.Join(root, "unknown.json"), &raw); err != nil {
+		t.Errorf("ParseRawConfig returned error: %v", err)
+	}
+	for _, file := range []string{"unknown.json", "unclosed.json"} {
+		if err := ParseConfig(filepath.Join(root, file), &generic); err == nil {
+			t.Errorf("ParseConfig(%q) should fail", file)
+		}
+	}
+}
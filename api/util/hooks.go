@@ -0,0 +1,149 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultHookTimeout limits the run time of hooks without timeout.
+const DefaultHookTimeout = time.Minute
+
+// Hook is an external command or signal run before or after an
+// operation, e.g. to purge caches after publishing a node.
+type Hook struct {
+	// Command is the command to execute followed by its arguments.
+	Command []string
+	// Signal emits the monsti.Hook signal instead of executing a
+	// command.
+	Signal bool
+	// Timeout limits the hook's run time, e.g. "10s". Defaults to one
+	// minute.
+	Timeout string
+	// OnFailure is either "abort" to cancel the operation if the hook
+	// fails or times out or "warn" (the default) to only log the
+	// failure.
+	OnFailure string
+}
+
+// OperationHooks are the hooks run before (Pre) and after (Post) an
+// operation.
+type OperationHooks struct {
+	Pre, Post []Hook
+}
+
+// HookEnv describes the operation a hook is run for.
+type HookEnv struct {
+	// Operation is the name of the operation, e.g. "publish".
+	Operation string
+	// Stage is either "pre" or "post".
+	Stage string
+	// Values are additional values describing the operation, e.g. the
+	// site and node path. Commands get them as environment variables
+	// prefixed with MONSTI_, e.g. MONSTI_SITE.
+	Values map[string]string
+}
+
+// environ returns the environment of commands run for the hook.
+func (e HookEnv) environ() []string {
+	ret := append(os.Environ(), "MONSTI_OPERATION="+e.Operation,
+		"MONSTI_STAGE="+e.Stage)
+	for key, value := range e.Values {
+		ret = append(ret, "MONSTI_"+strings.ToUpper(key)+"="+value)
+	}
+	return ret
+}
+
+// withTimeout returns the error of fn or an error if fn does not
+// return in time. In the latter case, cancel gets called if not nil
+// and fn is expected to return soon after.
+func withTimeout(timeout time.Duration, fn func() error,
+	cancel func()) error {
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		if cancel != nil {
+			cancel()
+			<-done
+		}
+		return fmt.Errorf("Timed out after %v", timeout)
+	}
+}
+
+// run runs the hook. Signal hooks are run by calling signal.
+func (h Hook) run(env HookEnv, signal func(HookEnv) error) error {
+	timeout := DefaultHookTimeout
+	if h.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(h.Timeout); err != nil {
+			return fmt.Errorf("Invalid timeout %q: %v", h.Timeout, err)
+		}
+	}
+	if h.Signal {
+		if signal == nil {
+			return fmt.Errorf("Signal hooks are not supported by %v", env.Operation)
+		}
+		return withTimeout(timeout, func() error { return signal(env) }, nil)
+	}
+	if len(h.Command) == 0 {
+		return fmt.Errorf("Missing command")
+	}
+	cmd := exec.Command(h.Command[0], h.Command[1:]...)
+	cmd.Env = env.environ()
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	err := withTimeout(timeout, cmd.Wait, func() { cmd.Process.Kill() })
+	if err != nil && output.Len() > 0 {
+		return fmt.Errorf("%v: %v", err, strings.TrimSpace(output.String()))
+	}
+	return err
+}
+
+// RunHooks runs the given hooks in order. Signal hooks are run by
+// calling signal, which may be nil if signals are not available.
+//
+// Failures of hooks with OnFailure "abort" stop running further hooks
+// and get returned. Other failures only get logged.
+func RunHooks(hooks []Hook, env HookEnv, signal func(HookEnv) error,
+	logger *log.Logger) error {
+	for i, hook := range hooks {
+		err := hook.run(env, signal)
+		if err == nil {
+			continue
+		}
+		if hook.OnFailure == "abort" {
+			return fmt.Errorf("%v hook %v of %v failed: %v", env.Stage, i+1,
+				env.Operation, err)
+		}
+		logger.Printf("Ignoring failed %v hook %v of %v: %v", env.Stage, i+1,
+			env.Operation, err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-hooks")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	env := HookEnv{Operation: "publish", Stage: "post",
+		Values: map[string]string{"node": "/foo"}}
+	var signaled []string
+	signal := func(env HookEnv) error {
+		signaled = append(signaled, env.Operation+" "+env.Stage)
+		if env.Values["node"] == "/fail" {
+			return fmt.Errorf("signal failed")
+		}
+		return nil
+	}
+	var logged bytes.Buffer
+	logger := log.New(&logged, "", 0)
+
+	hooks := []Hook{
+		{Command: []string{"sh", "-c",
+			`echo "$MONSTI_OPERATION $MONSTI_STAGE $MONSTI_NODE" > ` + out}},
+		{Command: []string{"false"}},
+		{Signal: true},
+	}
+	if err := RunHooks(hooks, env, signal, logger); err != nil {
+		t.Errorf("RunHooks returned error: %v", err)
+	}
+	if content, _ := ioutil.ReadFile(out); string(content) !=
+		"publish post /foo\n" {
+		t.Errorf("Command got environment %q, should be \"publish post /foo\"",
+			content)
+	}
+	if !strings.Contains(logged.String(), "hook 2 of publish") {
+		t.Errorf("Failure of the second hook should be logged, got %q",
+			logged.String())
+	}
+	if len(signaled) != 1 || signaled[0] != "publish post" {
+		t.Errorf("Signal has been called with %v, should be [publish post]",
+			signaled)
+	}
+
+	tests := []struct {
+		Hook  Hook
+		Abort bool
+	}{
+		{Hook{Command: []string{"true"}, OnFailure: "abort"}, false},
+		{Hook{Command: []string{"false"}, OnFailure: "abort"}, true},
+		{Hook{Command: []string{"false"}, OnFailure: "warn"}, false},
+		{Hook{Command: []string{"sleep", "5"}, Timeout: "50ms",
+			OnFailure: "abort"}, true},
+		{Hook{Timeout: "foo", OnFailure: "abort"}, true},
+		{Hook{OnFailure: "abort"}, true},
+	}
+	for i, test := range tests {
+		err := RunHooks([]Hook{test.Hook, {Command: []string{"true"}}}, env,
+			signal, logger)
+		if (err != nil) != test.Abort {
+			t.Errorf("%v: RunHooks returned %v, should abort: %v", i, err,
+				test.Abort)
+		}
+	}
+	env.Values["node"] = "/fail"
+	if err := RunHooks([]Hook{{Signal: true, OnFailure: "abort"}}, env,
+		signal, logger); err == nil {
+		t.Errorf("RunHooks should fail if the signal handler fails")
+	}
+	if err := RunHooks([]Hook{{Signal: true, OnFailure: "abort"}}, env,
+		nil, logger); err == nil {
+		t.Errorf("RunHooks should fail if signals are not available")
+	}
+}
@@ -56,11 +56,15 @@ func StartModule(name string, setup func(context *ModuleContext) error) {
 	if err != nil {
 		logger.Fatal("Could not load settings: ", err)
 	}
+	service.SetupTracing("monsti-"+name, settings.Tracing.Endpoint, logger)
 	gettext.DefaultLocales.Domain = "monsti-" + name
 	gettext.DefaultLocales.LocaleDir = settings.Directories.Locale
 
 	renderer := mtemplate.Renderer{
 		Root: settings.GetTemplatesPath()}
+	if !settings.Development {
+		renderer.Cache = new(mtemplate.Cache)
+	}
 	monstiPath := settings.GetServicePath(service.MonstiService.String())
 	sessions := service.NewSessionPool(1, monstiPath)
 
@@ -74,7 +78,7 @@ func StartModule(name string, setup func(context *ModuleContext) error) {
 	}); err != nil {
 		logger.Fatalf("Could not setup module: %v", err)
 	}
-	if err := session.Monsti().ModuleInitDone("example-module"); err != nil {
+	if err := session.Monsti().ModuleInitDone(name); err != nil {
 		logger.Fatalf("Could not finish initialization: %v", err)
 	}
 	for {
@@ -0,0 +1,211 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package s3 implements a minimal client of S3 compatible object
+// storages.
+package s3
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Store is a bucket of an S3 compatible object storage.
+type Store struct {
+	// Endpoint is the URL of the storage, e.g. "https://s3.amazonaws.com".
+	Endpoint string
+	Region   string
+	Bucket   string
+	// AccessKey and SecretKey are the credentials.
+	AccessKey, SecretKey string
+}
+
+// s3Escape escapes the string as required for canonical requests.
+func s3Escape(in string, escapeSlash bool) string {
+	var out bytes.Buffer
+	for _, b := range []byte(in) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/' && !escapeSlash:
+			out.WriteByte(b)
+		default:
+			fmt.Fprintf(&out, "%%%02X", b)
+		}
+	}
+	return out.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// signRequest signs the request using AWS signature version 4.
+//
+// All headers set on the request at this point get signed.
+func signRequest(req *http.Request, payloadHash, accessKey, secretKey,
+	region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%v:%v\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	params := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			params = append(params, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	uri := req.URL.Path
+	if len(uri) == 0 {
+		uri = "/"
+	}
+	canonicalRequest := strings.Join([]string{req.Method, s3Escape(uri, false),
+		strings.Join(params, "&"), canonicalHeaders.String(), signedHeaders,
+		payloadHash}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		sha256Hex([]byte(canonicalRequest))
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// do performs a signed request on the given key of the bucket.
+func (s *Store) do(method, key string, query url.Values,
+	body []byte) ([]byte, error) {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid endpoint: %v", err)
+	}
+	endpoint.Path = "/" + s.Bucket + "/" + key
+	endpoint.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+	req, err := http.NewRequest(method, endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("Could not create request: %v", err)
+	}
+	signRequest(req, sha256Hex(body), s.AccessKey, s.SecretKey, s.Region,
+		time.Now())
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Could not perform request: %v", err)
+	}
+	defer res.Body.Close()
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read response: %v", err)
+	}
+	if res.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%v %v failed: %v: %s", method, key, res.Status,
+			content)
+	}
+	return content, nil
+}
+
+// Put stores the content under the given key.
+func (s *Store) Put(key string, content []byte) error {
+	_, err := s.do("PUT", key, nil, content)
+	return err
+}
+
+// Get returns the content stored under the given key.
+func (s *Store) Get(key string) ([]byte, error) {
+	return s.do("GET", key, nil, nil)
+}
+
+// Delete removes the given key.
+func (s *Store) Delete(key string) error {
+	_, err := s.do("DELETE", key, nil, nil)
+	return err
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List returns all keys with the given prefix.
+func (s *Store) List(prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if len(token) > 0 {
+			query.Set("continuation-token", token)
+		}
+		content, err := s.do("GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		if err := xml.Unmarshal(content, &result); err != nil {
+			return nil, fmt.Errorf("Could not parse bucket listing: %v", err)
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
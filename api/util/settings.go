@@ -7,17 +7,59 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 )
 
+// MailTransport configures how mails get delivered.
+type MailTransport struct {
+	// Type is the kind of transport: "smtp" (the default), "sendmail",
+	// "mailgun" or "ses".
+	Type string
+	// Host is the SMTP server as host:port.
+	Host string
+	// Username and Password authenticate at the SMTP server or HTTP API,
+	// e.g. the access key id and secret access key for SES.
+	Username, Password string
+	// Security of SMTP connections: "starttls" to require STARTTLS, "ssl"
+	// for implicit TLS (e.g. port 465). By default, STARTTLS gets used if
+	// offered by the server.
+	Security string
+	// Auth is the SMTP authentication mechanism used if Username is set:
+	// "plain" (the default), "login" or "cram-md5".
+	Auth string
+	// Command is the sendmail command followed by its arguments.
+	// Defaults to ["/usr/sbin/sendmail", "-i"].
+	Command []string
+	// URL of the HTTP API, e.g.
+	// "https://api.mailgun.net/v3/example.com/messages.mime" for Mailgun.
+	// Defaults to SES' v2 API endpoint of the Region.
+	URL string
+	// Region of the SES API, e.g. "eu-west-1".
+	Region string
+}
+
 // Site configuration.
 type SiteSettings struct {
 	// Name of the site for internal use.
 	Name string
 	// Title as used in HTML head.
 	Title string
-	// The hosts which should deliver this site.
+	// The hosts which should deliver this site, e.g. "example.com",
+	// "localhost:8080" or "*.example.com" for all subdomains. Hosts
+	// without port match any port.
 	Hosts []string
+	// Aliases are hosts redirecting to the site's canonical URL, i.e.
+	// its BaseURL or its first host without wildcard.
+	Aliases []string
+	// TLS configures the certificate used for HTTPS connections to the
+	// site's hosts and aliases.
+	TLS struct {
+		// Certificate and Key are the paths to the PEM encoded
+		// certificate (chain) and private key, relative to the site's
+		// configuration directory.
+		Certificate, Key string
+	}
 	// EmailName is used as name in the From header of outgoing site emails.
 	// BaseURL is the URL to the root of the site. Used to generate
 	// absolute URLs.
@@ -25,6 +67,22 @@ type SiteSettings struct {
 	EmailName string
 	// EmailAddress is used as address in the From header of outgoing site emails.
 	EmailAddress string
+	// ReturnPath is the envelope sender of outgoing site emails, e.g.
+	// "bounces+{id}@example.com". {id} gets replaced by the mail's queue
+	// id. Defaults to the return path of the mail queue.
+	ReturnPath string
+	// MailTransport delivers the site's emails instead of the daemon's
+	// mail transport, if set.
+	MailTransport *MailTransport
+	// DKIM configures the DKIM signatures of outgoing site emails.
+	DKIM struct {
+		// Domain and Selector locate the public key in the DNS at
+		// <Selector>._domainkey.<Domain>.
+		Domain, Selector string
+		// PrivateKey is the PEM encoded RSA private key, e.g.
+		// "${file:dkim.pem}". Mails are not signed if it's empty.
+		PrivateKey string
+	}
 	// Name and email address of site owner.
 	//
 	// The owner's address is used as recipient of contact form submissions.
@@ -37,6 +95,70 @@ type SiteSettings struct {
 	PasswordTokenKey string
 	// Locale used to translate monsti's web interface.
 	Locale string
+	// UserFileQuota is the maximum total size in bytes of the files in
+	// each user's file area. Zero means no limit.
+	UserFileQuota int64
+	// CodeEditors are the logins of the users allowed to change the
+	// site's custom code, i.e. CSS, JavaScript and meta tags, and the
+	// site settings.
+	CodeEditors []string
+	// Theme is the name of the site's theme in the themes directory, if
+	// any. The site's templates and static files override the theme's
+	// ones, which override Monsti's defaults.
+	Theme string
+	// Mounts show subtrees of other sites read-only within the site,
+	// e.g. shared legal pages.
+	Mounts []Mount
+	// RateLimits limit the requests of each client address, e.g. to
+	// protect contact forms and search from abuse.
+	RateLimits []RateLimit
+	// AdminAccess restricts the admin area, e.g. @@login and @@edit, to
+	// client addresses.
+	AdminAccess struct {
+		// Allow are the addresses or CIDR networks allowed to access the
+		// admin area, e.g. "10.0.0.0/8". Any address is allowed if empty.
+		Allow []string
+		// Deny are the addresses or CIDR networks not allowed to access
+		// the admin area, even if allowed by Allow.
+		Deny []string
+		// BreakGlassToken grants access from any address to browsers
+		// visiting an admin page with the query parameter
+		// breakglass=<token>, e.g. in emergencies. Disabled if empty.
+		BreakGlassToken string
+	}
+}
+
+// RateLimit limits the requests of each client to matching URL paths.
+type RateLimit struct {
+	// Prefix restricts the limit to requests to this URL path and the
+	// paths below it, e.g. "/contact". Defaults to all paths.
+	Prefix string
+	// Action restricts the limit to requests of this action, e.g.
+	// "search" for @@search.
+	Action string
+	// Method restricts the limit to requests of this method, e.g.
+	// "POST".
+	Method string
+	// Requests is the number of requests allowed per Period, e.g. 10.
+	Requests int
+	// Period is the duration in which Requests requests are allowed,
+	// e.g. "1m".
+	Period string
+	// Ban refuses all requests of clients exceeding the limit for this
+	// duration, e.g. "1h". Clients are not banned if it's empty.
+	Ban string
+}
+
+// Mount makes the subtree of another site visible within a site.
+type Mount struct {
+	// Path is the mount point within the site, e.g. "/legal".
+	Path string
+	// Site is the name of the mounted site. Its own mounts are not
+	// followed.
+	Site string
+	// Source is the path of the subtree's root node within the mounted
+	// site, e.g. "/shared/legal".
+	Source string
 }
 
 // MonstiSettings holds common Monsti settings.
@@ -54,6 +176,22 @@ type MonstiSettings struct {
 		// Runtime data directory
 		Run string
 	}
+	// Locales are the languages of the user interface, e.g. ["en",
+	// "de"]. Defaults to English and the languages found in the locale
+	// directory.
+	Locales []string
+	// Tracing configures the export of traces of requests, RPC calls, and
+	// signals.
+	Tracing struct {
+		// Endpoint is the URL of the OpenTelemetry collector's OTLP/HTTP
+		// traces endpoint, e.g. "http://localhost:4318/v1/traces".
+		// Tracing is disabled if empty.
+		Endpoint string
+	}
+	// Development enables the development mode: templates are read on
+	// every request instead of once, so changes show up without
+	// restarting Monsti.
+	Development bool
 	// Sites hosted by this monsti instance.
 	//
 	// Load settings with *MonstiSettings.LoadSiteSettings()
@@ -88,10 +226,29 @@ func (s MonstiSettings) GetSiteDataPath(site string) string {
 	return filepath.Join(s.Directories.Data, site)
 }
 
-// GetSiteTemplatesPath returns the path to the given site's templates
-// directory.
+// GetSiteTemplatesPath returns the template search path of the given
+// site: the path to the site's templates directory followed by the
+// path to its theme's templates directory, if any, separated by
+// filepath.ListSeparator.
 func (s MonstiSettings) GetSiteTemplatesPath(site string) string {
-	return filepath.Join(s.Directories.Data, site, "templates")
+	templates := filepath.Join(s.Directories.Data, site, "templates")
+	if theme := s.Sites[site].Theme; theme != "" {
+		templates += string(filepath.ListSeparator) +
+			filepath.Join(s.GetThemePath(theme), "templates")
+	}
+	return templates
+}
+
+// GetThemesPath returns the path to the directory of the themes.
+func (s MonstiSettings) GetThemesPath() string {
+	return filepath.Join(s.Directories.Share, "themes")
+}
+
+// GetThemePath returns the path to the given theme's directory. It
+// contains the theme's templates and static files in the directories
+// "templates" and "static".
+func (s MonstiSettings) GetThemePath(theme string) string {
+	return filepath.Join(s.GetThemesPath(), theme)
 }
 
 // GetStaticsPath returns the path to the global site-static directory.
@@ -115,14 +272,17 @@ func loadSiteSettings(sitesDir string) (map[string]SiteSettings, error) {
 	for _, siteDir := range siteDirs {
 		siteName := siteDir.Name()
 		sitePath := filepath.Join(sitesPath, siteName)
-		_, err := os.Stat(filepath.Join(sitePath, "site.yaml"))
+		path, err := FindConfigFile(filepath.Join(sitePath, "site"))
 		if err != nil {
-			log.Println(err)
+			return nil, fmt.Errorf("Could not find settings for site %q: %v",
+				siteName, err)
+		}
+		if len(path) == 0 {
+			log.Printf("No site settings found in %q", sitePath)
 			continue
 		}
 		var siteSettings SiteSettings
-		err = ParseYAML(filepath.Join(sitePath, "site.yaml"),
-			&siteSettings)
+		err = ParseConfig(path, &siteSettings)
 		if err != nil {
 			return nil, fmt.Errorf("Could not load settings for site %q: %v",
 				siteName, err)
@@ -130,6 +290,10 @@ func loadSiteSettings(sitesDir string) (map[string]SiteSettings, error) {
 		if len(siteSettings.Locale) == 0 {
 			siteSettings.Locale = "en"
 		}
+		if theme := siteSettings.Theme; theme != "" &&
+			(filepath.Base(theme) != theme || theme == "..") {
+			return nil, fmt.Errorf("Invalid theme %q of site %q", theme, siteName)
+		}
 		sites[siteName] = siteSettings
 	}
 	return sites, nil
@@ -145,6 +309,19 @@ func (s *MonstiSettings) LoadSiteSettings() error {
 	return nil
 }
 
+// parseSettings parses the settings file with the given path without
+// extension into out. Defaults to YAML if there is no such file.
+func parseSettings(base string, out interface{}) error {
+	path, err := FindConfigFile(base)
+	if err != nil {
+		return err
+	}
+	if len(path) == 0 {
+		path = base + ".yaml"
+	}
+	return ParseConfig(path, out)
+}
+
 // LoadModuleSettings loads the given module's configuration.
 //
 // module is the name of the module, e.g. "data"
@@ -168,8 +345,8 @@ func LoadModuleSettings(module, cfgPath string, settings interface{}) error {
 	}
 
 	// Load module settings
-	path := filepath.Join(cfgPath, module+".yaml")
-	if err := ParseYAML(path, settings); err != nil {
+	if err := parseSettings(filepath.Join(cfgPath, module),
+		settings); err != nil {
 		return fmt.Errorf("util: Could not parse module settings: %v", err)
 	}
 
@@ -183,9 +360,9 @@ func LoadModuleSettings(module, cfgPath string, settings interface{}) error {
 }
 
 func LoadMonstiSettings(cfgPath string) (*MonstiSettings, error) {
-	path := filepath.Join(cfgPath, "monsti.yaml")
 	var settings MonstiSettings
-	if err := ParseYAML(path, &settings); err != nil {
+	if err := parseSettings(filepath.Join(cfgPath, "monsti"),
+		&settings); err != nil {
 		return nil, fmt.Errorf("util: Could not parse Monsti settings: %v", err)
 	}
 	settings.Directories.Config = cfgPath
@@ -193,5 +370,38 @@ func LoadMonstiSettings(cfgPath string) (*MonstiSettings, error) {
 	MakeAbsolute(&settings.Directories.Share, cfgPath)
 	MakeAbsolute(&settings.Directories.Locale, cfgPath)
 	MakeAbsolute(&settings.Directories.Run, cfgPath)
+	if len(settings.Locales) == 0 {
+		locales, err := FindLocales(settings.Directories.Locale)
+		if err != nil {
+			return nil, fmt.Errorf("util: Could not find locales: %v", err)
+		}
+		settings.Locales = locales
+	}
 	return &settings, nil
 }
+
+// FindLocales returns the languages having message catalogs in the
+// given locale directory (<dir>/<locale>/LC_MESSAGES), sorted and
+// prefixed by English, the language of the messages.
+func FindLocales(dir string) ([]string, error) {
+	locales := []string{"en"}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return locales, nil
+		}
+		return nil, err
+	}
+	found := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if !info.IsDir() || info.Name() == "en" {
+			continue
+		}
+		messages, err := os.Stat(filepath.Join(dir, info.Name(), "LC_MESSAGES"))
+		if err == nil && messages.IsDir() {
+			found = append(found, info.Name())
+		}
+	}
+	sort.Strings(found)
+	return append(locales, found...), nil
+}
@@ -19,6 +19,7 @@ package util
 import (
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 
 	mtest "pkg.monsti.org/monsti/api/util/testing"
@@ -74,3 +75,51 @@ title: "Linked Example Site"
 			` ["localhost:8080"]`, entry.Hosts)
 	}
 }
+
+func TestGetSiteTemplatesPath(t *testing.T) {
+	var settings MonstiSettings
+	settings.Directories.Data = "/data"
+	settings.Directories.Share = "/share"
+	settings.Sites = map[string]SiteSettings{
+		"plain": {}, "themed": {Theme: "blue"}}
+	tests := []struct{ Site, Path string }{
+		{"plain", "/data/plain/templates"},
+		{"themed", "/data/themed/templates" + string(filepath.ListSeparator) +
+			"/share/themes/blue/templates"},
+	}
+	for _, test := range tests {
+		if ret := settings.GetSiteTemplatesPath(test.Site); ret != test.Path {
+			t.Errorf("GetSiteTemplatesPath(%q) = %q, should be %q", test.Site, ret,
+				test.Path)
+		}
+	}
+}
+
+func TestFindLocales(t *testing.T) {
+	files := map[string]string{
+		"/locale/monsti-daemon.pot":                  "",
+		"/locale/fr/LC_MESSAGES/monsti-daemon.mo":    "",
+		"/locale/de/LC_MESSAGES/monsti-daemon.mo":    "",
+		"/locale/en/LC_MESSAGES/monsti-daemon.mo":    "",
+		"/locale/templates/monsti-daemon.pot":        "",
+		"/locale/pt_BR/LC_MESSAGES/monsti-daemon.mo": "",
+	}
+	root, cleanup, err := mtest.CreateDirectoryTree(files, "TestFindLocales")
+	if err != nil {
+		t.Fatalf("Could not create test files: %v", err)
+	}
+	defer cleanup()
+	locales, err := FindLocales(filepath.Join(root, "locale"))
+	if err != nil {
+		t.Fatalf("FindLocales returned error: %v", err)
+	}
+	expected := []string{"en", "de", "fr", "pt_BR"}
+	if !reflect.DeepEqual(locales, expected) {
+		t.Errorf("FindLocales(...) = %v, should be %v", locales, expected)
+	}
+	locales, err = FindLocales(filepath.Join(root, "missing"))
+	if err != nil || !reflect.DeepEqual(locales, []string{"en"}) {
+		t.Errorf(`FindLocales of missing directory = %v, %v, should be ["en"]`,
+			locales, err)
+	}
+}
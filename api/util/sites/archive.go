@@ -0,0 +1,293 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package sites
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// archiveVersion is the version of the layout of site archives.
+const archiveVersion = 1
+
+// manifestName is the name of the manifest within site archives.
+const manifestName = "monsti-site.json"
+
+// archiveManifest describes a site archive. It's the archive's first
+// entry.
+type archiveManifest struct {
+	Version int
+	// Site is the name of the exported site.
+	Site    string
+	Created time.Time
+	// Base is the file name of the backup an incremental backup is
+	// based on. It's empty for full archives.
+	Base string `json:",omitempty"`
+	// Changes are the node changes since the base backup.
+	Changes []Change `json:",omitempty"`
+}
+
+// archiveName returns the name within site archives of the given
+// file of the site's data directory, i.e. "nodes/...", "users.json" or
+// "data/...".
+func archiveName(rel string) string {
+	rel = filepath.ToSlash(rel)
+	if rel == "nodes" || strings.HasPrefix(rel, "nodes/") || rel == "users.json" {
+		return rel
+	}
+	return "data/" + rel
+}
+
+// addTree adds the files of the directory to the archive, naming them
+// by the given function. Files named "" are left out.
+func addTree(archive *tar.Writer, dir string,
+	name func(rel string, info os.FileInfo) string) error {
+	return filepath.Walk(dir, func(file string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		archiveName := name(rel, info)
+		if archiveName == "" {
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = archiveName
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		in, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		_, err = io.Copy(archive, in)
+		return err
+	})
+}
+
+// Export writes the gzipped tar archive of the given site to w. It
+// contains the manifest "monsti-site.json" followed by the site's
+// configuration directory ("config/"), nodes ("nodes/"), users
+// ("users.json") and other data files ("data/").
+func Export(settings *util.MonstiSettings, site string, w io.Writer) error {
+	if err := checkSite(settings, site, true); err != nil {
+		return err
+	}
+	return writeArchive(settings, &archiveManifest{Version: archiveVersion,
+		Site: site, Created: time.Now().UTC()}, w,
+		func(string, os.FileInfo) bool { return true })
+}
+
+// writeArchive writes the archive of the manifest's site to w. Only
+// the data files accepted by include get archived.
+func writeArchive(settings *util.MonstiSettings, manifest *archiveManifest,
+	w io.Writer, include func(rel string, info os.FileInfo) bool) error {
+	compressed := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressed)
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not marshal manifest: %v", err)
+	}
+	if err := archive.WriteHeader(&tar.Header{Name: manifestName, Mode: 0644,
+		Size: int64(len(content)), ModTime: time.Now(),
+		Typeflag: tar.TypeReg}); err != nil {
+		return fmt.Errorf("Could not write manifest: %v", err)
+	}
+	if _, err := archive.Write(content); err != nil {
+		return fmt.Errorf("Could not write manifest: %v", err)
+	}
+	if err := addTree(archive, settings.GetSiteConfigPath(manifest.Site),
+		func(rel string, _ os.FileInfo) string {
+			return "config/" + filepath.ToSlash(rel)
+		}); err != nil {
+		return fmt.Errorf("Could not archive configuration: %v", err)
+	}
+	if err := addTree(archive, settings.GetSiteDataPath(manifest.Site),
+		func(rel string, info os.FileInfo) string {
+			if rel == journalName || !include(filepath.ToSlash(rel), info) {
+				return ""
+			}
+			return archiveName(rel)
+		}); err != nil {
+		return fmt.Errorf("Could not archive data: %v", err)
+	}
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("Could not write archive: %v", err)
+	}
+	return compressed.Close()
+}
+
+// extractPath returns the path of the given archive entry within the
+// configuration or data directory. Returns an empty string for
+// invalid names.
+func extractPath(name, configDir, dataDir string) string {
+	name = strings.TrimSuffix(name, "/")
+	if clean := path.Clean(name); clean != name || path.IsAbs(name) ||
+		strings.HasPrefix(name, "../") {
+		return ""
+	}
+	switch {
+	case name == "config" || name == "data":
+		return ""
+	case strings.HasPrefix(name, "config/"):
+		return filepath.Join(configDir, filepath.FromSlash(name[len("config/"):]))
+	case strings.HasPrefix(name, "data/"):
+		return filepath.Join(dataDir, filepath.FromSlash(name[len("data/"):]))
+	case name == "nodes" || strings.HasPrefix(name, "nodes/") ||
+		name == "users.json":
+		return filepath.Join(dataDir, filepath.FromSlash(name))
+	}
+	return ""
+}
+
+// readManifest opens the archive and reads its manifest.
+func readManifest(r io.Reader) (*tar.Reader, *archiveManifest, error) {
+	compressed, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid site archive: %v", err)
+	}
+	archive := tar.NewReader(compressed)
+	header, err := archive.Next()
+	if err != nil || header.Name != manifestName {
+		return nil, nil, fmt.Errorf("Invalid site archive: missing %v",
+			manifestName)
+	}
+	manifest := new(archiveManifest)
+	if err := json.NewDecoder(archive).Decode(manifest); err != nil {
+		return nil, nil, fmt.Errorf("Invalid site archive manifest: %v", err)
+	}
+	if manifest.Version != archiveVersion {
+		return nil, nil, fmt.Errorf("Unsupported site archive version %v",
+			manifest.Version)
+	}
+	return archive, manifest, nil
+}
+
+// Import restores a site from the archive written by Export. The site
+// gets the given name or, if empty, the one of the exported site. It
+// must not exist yet.
+func Import(settings *util.MonstiSettings, r io.Reader, name string) error {
+	_, err := importArchive(settings, r, name)
+	return err
+}
+
+// importArchive imports the full archive like Import and returns the
+// name of the imported site.
+func importArchive(settings *util.MonstiSettings, r io.Reader,
+	name string) (string, error) {
+	archive, manifest, err := readManifest(r)
+	if err != nil {
+		return "", err
+	}
+	if manifest.Base != "" {
+		return "", fmt.Errorf("Incremental backups have to be restored")
+	}
+	if name == "" {
+		name = manifest.Site
+	}
+	if err := checkSite(settings, name, false); err != nil {
+		return "", err
+	}
+	configDir := settings.GetSiteConfigPath(name)
+	dataDir := settings.GetSiteDataPath(name)
+	if err := extractArchive(archive, configDir, dataDir, false); err != nil {
+		os.RemoveAll(configDir)
+		os.RemoveAll(dataDir)
+		return "", fmt.Errorf("Could not import site: %v", err)
+	}
+	return name, nil
+}
+
+// extractArchive writes the remaining entries of the archive into the
+// configuration and data directories. Existing files get replaced if
+// overwrite is set.
+func extractArchive(archive *tar.Reader, configDir, dataDir string,
+	overwrite bool) error {
+	for _, dir := range []string{configDir, filepath.Join(dataDir, "nodes")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := extractPath(header.Name, configDir, dataDir)
+		if target == "" {
+			return fmt.Errorf("Invalid entry %q", header.Name)
+		}
+		mode := os.FileMode(header.Mode).Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+			if overwrite {
+				flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+			}
+			out, err := os.OpenFile(target, flags, mode)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, archive); err != nil {
+				out.Close()
+				return err
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("Unsupported entry %q", header.Name)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package sites
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// journalName is the name of the change journal in the site's data
+// directory.
+const journalName = "changes.journal"
+
+// journalMutex serializes the access to change journals.
+var journalMutex sync.Mutex
+
+// Change is a change of a node recorded in the change journal.
+type Change struct {
+	Time time.Time
+	// Path is the path of the changed node.
+	Path string
+	// Tree is set if the node's subtree changed, e.g. because the node
+	// got removed or renamed. Otherwise, only the node's own files
+	// changed.
+	Tree bool
+}
+
+// RecordChanges appends the changes to the site's change journal.
+// Changes without time get the current time.
+//
+// The journal gets started by the first backup, so nothing gets
+// recorded for sites without backups.
+func RecordChanges(settings *util.MonstiSettings, site string,
+	changes ...Change) error {
+	journalMutex.Lock()
+	defer journalMutex.Unlock()
+	file, err := os.OpenFile(
+		filepath.Join(settings.GetSiteDataPath(site), journalName),
+		os.O_WRONLY|os.O_APPEND, 0600)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Could not open change journal: %v", err)
+	}
+	encoder := json.NewEncoder(file)
+	for _, change := range changes {
+		change.Path = path.Clean("/" + change.Path)
+		if change.Time.IsZero() {
+			change.Time = time.Now().UTC()
+		}
+		if err := encoder.Encode(change); err != nil {
+			file.Close()
+			return fmt.Errorf("Could not record change: %v", err)
+		}
+	}
+	return file.Close()
+}
+
+// readChanges returns the changes of the site's change journal
+// recorded after the given time.
+func readChanges(settings *util.MonstiSettings, site string,
+	since time.Time) ([]Change, error) {
+	journalMutex.Lock()
+	defer journalMutex.Unlock()
+	file, err := os.Open(
+		filepath.Join(settings.GetSiteDataPath(site), journalName))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	changes := make([]Change, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var change Change
+		if err := json.Unmarshal(scanner.Bytes(), &change); err != nil {
+			return nil, fmt.Errorf("Invalid change journal: %v", err)
+		}
+		if change.Time.After(since) {
+			changes = append(changes, change)
+		}
+	}
+	return changes, scanner.Err()
+}
+
+// resetJournal starts an empty change journal for the site.
+func resetJournal(settings *util.MonstiSettings, site string) error {
+	journalMutex.Lock()
+	defer journalMutex.Unlock()
+	return ioutil.WriteFile(
+		filepath.Join(settings.GetSiteDataPath(site), journalName), nil, 0600)
+}
+
+// changedNode returns true iff the node at the given path changed
+// according to the changes. If files is set, only changes of the
+// node's own files are considered, i.e. also changes of the node
+// alone.
+func changedNode(changes []Change, nodePath string, files bool) bool {
+	for _, change := range changes {
+		if change.Tree && (change.Path == "/" || nodePath == change.Path ||
+			strings.HasPrefix(nodePath, change.Path+"/")) {
+			return true
+		}
+		if files && !change.Tree && nodePath == change.Path {
+			return true
+		}
+	}
+	return false
+}
+
+// BackupInfo describes a backup written by Backup.
+type BackupInfo struct {
+	// Name is the backup's file name, e.g.
+	// "20150102T030405Z-full.tar.gz".
+	Name    string
+	Created time.Time
+	// Full is set for full backups, otherwise the backup is incremental.
+	Full bool
+}
+
+// backupTimeFormat is the format of the creation times in backup
+// names.
+const backupTimeFormat = "20060102T150405Z"
+
+// parseBackupName returns the backup with the given file name or nil
+// if the name is not a backup's name.
+func parseBackupName(name string) *BackupInfo {
+	for _, full := range []bool{true, false} {
+		suffix := "-incremental.tar.gz"
+		if full {
+			suffix = "-full.tar.gz"
+		}
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		created, err := time.Parse(backupTimeFormat,
+			strings.TrimSuffix(name, suffix))
+		if err != nil {
+			return nil
+		}
+		return &BackupInfo{Name: name, Created: created, Full: full}
+	}
+	return nil
+}
+
+// Backups returns the backups in the given directory, oldest first.
+func Backups(dir string) ([]*BackupInfo, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Could not list backups: %v", err)
+	}
+	backups := make([]*BackupInfo, 0)
+	for _, file := range files {
+		if backup := parseBackupName(file.Name()); backup != nil {
+			backups = append(backups, backup)
+		}
+	}
+	return backups, nil
+}
+
+// Backup writes a backup of the site into the given directory.
+//
+// Unless full is set, the backup is incremental: It contains the
+// configuration, the nodes changed since the latest backup according
+// to the change journal and the other data files modified since then.
+// A full backup gets written if there is no previous backup or no
+// change journal. Full backups start a new change journal.
+//
+// Nodes must not be changed until Backup returns.
+func Backup(settings *util.MonstiSettings, site, dir string, full bool,
+	now time.Time) (*BackupInfo, error) {
+	if err := checkSite(settings, site, true); err != nil {
+		return nil, err
+	}
+	backups, err := Backups(dir)
+	if err != nil {
+		return nil, err
+	}
+	backup := &BackupInfo{Created: now.UTC().Truncate(time.Second)}
+	manifest := &archiveManifest{Version: archiveVersion, Site: site,
+		Created: backup.Created}
+	var base *BackupInfo
+	if len(backups) > 0 {
+		base = backups[len(backups)-1]
+	}
+	if !full && base != nil {
+		manifest.Changes, err = readChanges(settings, site, base.Created)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		full = err != nil
+	}
+	include := func(string, os.FileInfo) bool { return true }
+	if full || base == nil {
+		backup.Full = true
+		backup.Name = backup.Created.Format(backupTimeFormat) + "-full.tar.gz"
+		manifest.Changes = nil
+	} else {
+		backup.Name = backup.Created.Format(backupTimeFormat) +
+			"-incremental.tar.gz"
+		manifest.Base = base.Name
+		include = func(rel string, info os.FileInfo) bool {
+			if rel == "nodes" || strings.HasPrefix(rel, "nodes/") {
+				nodePath := "/" + strings.TrimPrefix(rel, "nodes")
+				if !info.IsDir() {
+					nodePath = path.Dir(nodePath)
+				}
+				return changedNode(manifest.Changes, path.Clean(nodePath),
+					!info.IsDir())
+			}
+			return !info.IsDir() && info.ModTime().After(base.Created)
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Could not create backup directory: %v", err)
+	}
+	file := filepath.Join(dir, backup.Name)
+	out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create backup: %v", err)
+	}
+	err = writeArchive(settings, manifest, out, include)
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(file)
+		return nil, err
+	}
+	if backup.Full {
+		if err := resetJournal(settings, site); err != nil {
+			return nil, fmt.Errorf("Could not start change journal: %v", err)
+		}
+	}
+	return backup, nil
+}
+
+// ExpiredBackups returns the backups, given oldest first, which are
+// not needed to keep the latest backup of each of the last dailies
+// days and weeklies weeks having backups. The latest backup is always
+// kept, as are the backups the kept incremental backups are based on.
+func ExpiredBackups(backups []*BackupInfo, dailies,
+	weeklies int) []*BackupInfo {
+	keep := make([]bool, len(backups))
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	for i := len(backups) - 1; i >= 0; i-- {
+		created := backups[i].Created.UTC()
+		day := created.Format("2006-01-02")
+		year, week := created.ISOWeek()
+		weekName := fmt.Sprintf("%v-%v", year, week)
+		if i == len(backups)-1 {
+			keep[i] = true
+		}
+		if !days[day] && len(days) < dailies {
+			days[day] = true
+			keep[i] = true
+		}
+		if !weeks[weekName] && len(weeks) < weeklies {
+			weeks[weekName] = true
+			keep[i] = true
+		}
+	}
+	expired := make([]*BackupInfo, 0)
+	needed := false
+	for i := len(backups) - 1; i >= 0; i-- {
+		needed = needed || keep[i]
+		if !needed {
+			expired = append(expired, backups[i])
+		}
+		if backups[i].Full {
+			needed = false
+		}
+	}
+	for i, j := 0, len(expired)-1; i < j; i, j = i+1, j-1 {
+		expired[i], expired[j] = expired[j], expired[i]
+	}
+	return expired
+}
+
+// Restore restores a site from the given backup. Incremental backups
+// get applied on top of the backups they are based on, which must be
+// in the same directory. The site gets the given name or, if empty,
+// the one of the backed up site. It must not exist yet.
+func Restore(settings *util.MonstiSettings, file, name string) error {
+	chain := []string{file}
+	for {
+		in, err := os.Open(chain[0])
+		if err != nil {
+			return fmt.Errorf("Could not open backup: %v", err)
+		}
+		_, manifest, err := readManifest(in)
+		in.Close()
+		if err != nil {
+			return err
+		}
+		if manifest.Base == "" {
+			break
+		}
+		if filepath.Base(manifest.Base) != manifest.Base ||
+			len(chain) > 10000 {
+			return fmt.Errorf("Invalid base backup %q", manifest.Base)
+		}
+		chain = append([]string{filepath.Join(filepath.Dir(file),
+			manifest.Base)}, chain...)
+	}
+	in, err := os.Open(chain[0])
+	if err != nil {
+		return fmt.Errorf("Could not open backup: %v", err)
+	}
+	name, err = importArchive(settings, in, name)
+	in.Close()
+	if err != nil {
+		return err
+	}
+	for _, backup := range chain[1:] {
+		if err := applyBackup(settings, name, backup); err != nil {
+			os.RemoveAll(settings.GetSiteConfigPath(name))
+			os.RemoveAll(settings.GetSiteDataPath(name))
+			return fmt.Errorf("Could not apply %v: %v", filepath.Base(backup),
+				err)
+		}
+	}
+	return nil
+}
+
+// validChangePath returns true if the path of a recorded change is a
+// clean absolute node path.
+func validChangePath(nodePath string) bool {
+	return path.Clean("/"+nodePath) == nodePath
+}
+
+// applyBackup applies the incremental backup to the site.
+func applyBackup(settings *util.MonstiSettings, site, file string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	archive, manifest, err := readManifest(in)
+	if err != nil {
+		return err
+	}
+	root := settings.GetSiteNodesPath(site)
+	for _, change := range manifest.Changes {
+		if !validChangePath(change.Path) {
+			return fmt.Errorf("Invalid path of changed node: %q", change.Path)
+		}
+		dir := filepath.Join(root, filepath.FromSlash(change.Path))
+		if change.Tree {
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+			continue
+		}
+		files, err := ioutil.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, file := range files {
+			if !file.IsDir() {
+				if err := os.Remove(filepath.Join(dir, file.Name())); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return extractArchive(archive, settings.GetSiteConfigPath(site),
+		settings.GetSiteDataPath(site), true)
+}
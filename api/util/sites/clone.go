@@ -0,0 +1,306 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package sites
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// keysRegexp matches the signing keys in site.yaml.
+var keysRegexp = regexp.MustCompile(
+	`(?m)^(sessionauthkey|passwordtokenkey):.*$`)
+
+type longestFirst []string
+
+func (s longestFirst) Len() int      { return len(s) }
+func (s longestFirst) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s longestFirst) Less(i, j int) bool {
+	if len(s[i]) != len(s[j]) {
+		return len(s[i]) > len(s[j])
+	}
+	return s[i] < s[j]
+}
+
+// domainReplacer returns a replacer of the given domains. Longer
+// domains are replaced first, e.g. www.example.com before example.com.
+func domainReplacer(domains map[string]string) *strings.Replacer {
+	sources := make([]string, 0, len(domains))
+	for source := range domains {
+		if source != "" {
+			sources = append(sources, source)
+		}
+	}
+	sort.Sort(longestFirst(sources))
+	pairs := make([]string, 0, 2*len(sources))
+	for _, source := range sources {
+		pairs = append(pairs, source, domains[source])
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// copyTree copies the directory source to target. Files for which
+// rewrite returns true get their content replaced by the replacer.
+func copyTree(source, target string, rewrite func(name string) bool,
+	replacer *strings.Replacer) error {
+	return filepath.Walk(source, func(file string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(source, file)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(target, name)
+		if info.IsDir() {
+			return os.Mkdir(dest, info.Mode().Perm())
+		}
+		if rewrite(file) {
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(dest,
+				[]byte(replacer.Replace(string(content))), info.Mode().Perm())
+		}
+		in, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+			info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
+
+// rewriteNodes replaces the domains in the node.json files below the
+// given nodes directory.
+func rewriteNodes(dir string, replacer *strings.Replacer) error {
+	return filepath.Walk(dir, func(file string, info os.FileInfo,
+		err error) error {
+		if err != nil || info.IsDir() || info.Name() != "node.json" {
+			return err
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		rewritten := replacer.Replace(string(content))
+		if rewritten == string(content) {
+			return nil
+		}
+		return ioutil.WriteFile(file, []byte(rewritten), info.Mode().Perm())
+	})
+}
+
+// reverseDomains returns the domain map replacing the hosts of the
+// copy by the ones of the source.
+func reverseDomains(domains map[string]string) map[string]string {
+	ret := make(map[string]string, len(domains))
+	for source, target := range domains {
+		ret[target] = source
+	}
+	return ret
+}
+
+// cloneFile is the name of the file in the data directory of a clone
+// which stores the clone's source and domain map.
+const cloneFile = "clone.json"
+
+// readClone returns the description of the given site's clone or nil
+// if it's not a clone.
+func readClone(settings *util.MonstiSettings, name string) (
+	*service.SiteClone, error) {
+	content, err := ioutil.ReadFile(filepath.Join(
+		settings.GetSiteDataPath(name), cloneFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Could not read clone: %v", err)
+	}
+	clone := new(service.SiteClone)
+	if err := json.Unmarshal(content, clone); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal clone: %v", err)
+	}
+	return clone, nil
+}
+
+// checkSite returns an error if the given site does not exist or,
+// if exists is false, if it does exist.
+func checkSite(settings *util.MonstiSettings, name string,
+	exists bool) error {
+	if !ValidName(name) {
+		return fmt.Errorf("Invalid site name %q", name)
+	}
+	for _, dir := range []string{settings.GetSiteConfigPath(name),
+		settings.GetSiteDataPath(name)} {
+		_, err := os.Stat(dir)
+		switch {
+		case err == nil && !exists:
+			return fmt.Errorf("Site %q does already exist: %v", name, dir)
+		case os.IsNotExist(err) && exists:
+			return fmt.Errorf("Site %q does not exist", name)
+		case err != nil && !os.IsNotExist(err):
+			return fmt.Errorf("Could not check site directory: %v", err)
+		}
+	}
+	return nil
+}
+
+// Clone copies the configuration and data of a site, i.e. its nodes,
+// users and static files, to a new site. The clone's domains get
+// replaced in its configuration and nodes and it gets new signing
+// keys. The domain map is stored in the clone's data directory for
+// Promote.
+func Clone(settings *util.MonstiSettings, clone *service.SiteClone) error {
+	if err := checkSite(settings, clone.Source, true); err != nil {
+		return err
+	}
+	if err := checkSite(settings, clone.Name, false); err != nil {
+		return err
+	}
+	replacer := domainReplacer(clone.Domains)
+	configDir := settings.GetSiteConfigPath(clone.Name)
+	dataDir := settings.GetSiteDataPath(clone.Name)
+	nodesDir := settings.GetSiteNodesPath(clone.Source)
+	err := copyTree(settings.GetSiteConfigPath(clone.Source), configDir,
+		func(string) bool { return true }, replacer)
+	if err == nil {
+		err = copyTree(settings.GetSiteDataPath(clone.Source), dataDir,
+			func(file string) bool {
+				return filepath.Base(file) == "node.json" &&
+					strings.HasPrefix(file, nodesDir+string(filepath.Separator))
+			}, replacer)
+	}
+	if err == nil {
+		err = renewKeys(filepath.Join(configDir, "site.yaml"))
+	}
+	if err == nil {
+		var content []byte
+		content, err = json.Marshal(clone)
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dataDir, cloneFile), content, 0600)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(configDir)
+		os.RemoveAll(dataDir)
+		return fmt.Errorf("Could not clone site: %v", err)
+	}
+	return nil
+}
+
+// renewKeys replaces the signing keys in the given site configuration
+// by random keys.
+func renewKeys(path string) error {
+	config, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var keyErr error
+	config = keysRegexp.ReplaceAllFunc(config, func(line []byte) []byte {
+		key, err := randomKey()
+		if err != nil {
+			keyErr = err
+		}
+		name := strings.SplitN(string(line), ":", 2)[0]
+		return []byte(name + ": " + key)
+	})
+	if keyErr != nil {
+		return keyErr
+	}
+	return ioutil.WriteFile(path, config, 0600)
+}
+
+// Promote swaps the node directories of the staging and the production
+// site. Promoting again reverts the promotion.
+//
+// If the staging site is a clone of the production site, the domains
+// replaced by Clone get replaced back in the promoted nodes and the
+// previous production nodes get the staging domains.
+//
+// The node directories get renamed, so the running daemon must not
+// access them meanwhile.
+func Promote(settings *util.MonstiSettings, staging, production string) error {
+	if staging == production {
+		return fmt.Errorf("Can't promote site %q to itself", staging)
+	}
+	for _, name := range []string{staging, production} {
+		if err := checkSite(settings, name, true); err != nil {
+			return err
+		}
+	}
+	stagingNodes := settings.GetSiteNodesPath(staging)
+	productionNodes := settings.GetSiteNodesPath(production)
+	previous := productionNodes + ".promote"
+	if _, err := os.Stat(previous); !os.IsNotExist(err) {
+		return fmt.Errorf("Unfinished promotion, check %v", previous)
+	}
+	if err := os.Rename(productionNodes, previous); err != nil {
+		return fmt.Errorf("Could not move production nodes: %v", err)
+	}
+	if err := os.Rename(stagingNodes, productionNodes); err != nil {
+		os.Rename(previous, productionNodes)
+		return fmt.Errorf("Could not move staging nodes: %v", err)
+	}
+	if err := os.Rename(previous, stagingNodes); err != nil {
+		return fmt.Errorf("Could not move previous production nodes: %v", err)
+	}
+	clone, err := readClone(settings, staging)
+	if err != nil {
+		return err
+	}
+	if clone != nil && clone.Source == production {
+		if err := rewriteNodes(productionNodes,
+			domainReplacer(reverseDomains(clone.Domains))); err != nil {
+			return fmt.Errorf("Could not replace domains of promoted nodes: %v",
+				err)
+		}
+		if err := rewriteNodes(stagingNodes,
+			domainReplacer(clone.Domains)); err != nil {
+			return fmt.Errorf("Could not replace domains of previous nodes: %v",
+				err)
+		}
+	}
+	for _, name := range []string{staging, production} {
+		if err := RecordChanges(settings, name,
+			Change{Path: "/", Tree: true}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+/*
+Package sites manages the sites of a Monsti installation: it creates,
+clones, promotes, exports, imports, backs up, removes and lists them.
+*/
+package sites
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.crypto/bcrypt"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// nameRegexp matches valid site names.
+var nameRegexp = regexp.MustCompile(`^[A-Za-z0-9][\w-]*$`)
+
+// ValidName returns true iff the given name may be used as site name,
+// i.e. as name of the site's directories.
+func ValidName(name string) bool {
+	return nameRegexp.MatchString(name)
+}
+
+// randomKey returns a random hex encoded key, e.g. to sign session
+// cookies.
+func randomKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// yamlString returns the given string as double quoted YAML scalar
+// which is not interpolated by util.ParseConfig.
+func yamlString(value string) string {
+	return fmt.Sprintf("%q", strings.Replace(value, "${", "$${", -1))
+}
+
+// siteConfig is the template of the configuration of new sites.
+const siteConfig = `title: %v
+hosts: [%v]
+baseurl: %v
+locale: %v
+
+# Name and address as used in mails composed by Monsti, e.g. password
+# change mails.
+emailname: %v
+emailaddress: %v
+
+# Name and email address of site owner.
+#
+# The owner's address is used as recipient of contact form submissions.
+owner:
+  name: %v
+  email: %v
+
+# Keys used for signing session cookie data and password request
+# tokens.
+sessionauthkey: %v
+passwordtokenkey: %v
+`
+
+// homeNode is the starter home node of new sites.
+type homeNode struct {
+	Public      bool
+	PublishTime time.Time
+	Changed     time.Time
+	Type        string
+	Fields      map[string]map[string]string
+}
+
+// Create scaffolds the given new site: its configuration and data
+// directories, the initial administrator and a home node.
+//
+// The site must not exist yet.
+func Create(settings *util.MonstiSettings, site *service.NewSite) error {
+	if !ValidName(site.Name) {
+		return fmt.Errorf("Invalid site name %q", site.Name)
+	}
+	if len(site.Hosts) == 0 {
+		return fmt.Errorf("Site %q needs at least one host", site.Name)
+	}
+	if site.AdminPassword == "" {
+		return fmt.Errorf("Missing password of the site's administrator")
+	}
+	title, locale, login := site.Title, site.Locale, site.AdminLogin
+	if title == "" {
+		title = site.Name
+	}
+	if locale == "" {
+		locale = "en"
+	}
+	if login == "" {
+		login = "admin"
+	}
+	configDir := settings.GetSiteConfigPath(site.Name)
+	dataDir := settings.GetSiteDataPath(site.Name)
+	for _, dir := range []string{configDir, dataDir} {
+		if _, err := os.Stat(dir); err == nil {
+			return fmt.Errorf("Site %q does already exist: %v", site.Name, dir)
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("Could not check site directory: %v", err)
+		}
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(site.AdminPassword), 0)
+	if err != nil {
+		return fmt.Errorf("Could not hash password: %v", err)
+	}
+	authKey, err := randomKey()
+	if err != nil {
+		return fmt.Errorf("Could not generate session key: %v", err)
+	}
+	tokenKey, err := randomKey()
+	if err != nil {
+		return fmt.Errorf("Could not generate token key: %v", err)
+	}
+	hosts := make([]string, 0, len(site.Hosts))
+	for _, host := range site.Hosts {
+		hosts = append(hosts, yamlString(host))
+	}
+	domain := site.Hosts[0]
+	if host, _, err := net.SplitHostPort(domain); err == nil {
+		domain = host
+	}
+	config := fmt.Sprintf(siteConfig, yamlString(title),
+		strings.Join(hosts, ", "), yamlString("http://"+site.Hosts[0]),
+		yamlString(locale), yamlString(title), yamlString("noreply@"+domain),
+		yamlString(login), yamlString(site.AdminEmail), authKey, tokenKey)
+
+	now := time.Now().UTC()
+	users, err := json.MarshalIndent(map[string]service.User{
+		login: {Login: login, Name: login, Email: site.AdminEmail,
+			Password: string(hash), PasswordChanged: now}}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not marshal user database: %v", err)
+	}
+	body := fmt.Sprintf("<p>Welcome to %v!</p>", html.EscapeString(title))
+	home, err := json.MarshalIndent(homeNode{
+		Public: true, PublishTime: now, Changed: now, Type: "core.Document",
+		Fields: map[string]map[string]string{
+			"core": {"Title": "Home", "Body": body}}}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not marshal home node: %v", err)
+	}
+
+	for _, dir := range []string{configDir, settings.GetSiteNodesPath(site.Name),
+		settings.GetSiteStaticsPath(site.Name),
+		filepath.Join(dataDir, "templates")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("Could not create site directory: %v", err)
+		}
+	}
+	files := []struct {
+		Path    string
+		Content []byte
+		Mode    os.FileMode
+	}{
+		{filepath.Join(configDir, "site.yaml"), []byte(config), 0600},
+		{filepath.Join(dataDir, "users.json"), users, 0600},
+		{filepath.Join(settings.GetSiteNodesPath(site.Name), "node.json"),
+			home, 0644},
+	}
+	for _, file := range files {
+		if err := ioutil.WriteFile(file.Path, file.Content,
+			file.Mode); err != nil {
+			return fmt.Errorf("Could not write site file: %v", err)
+		}
+	}
+	return nil
+}
+
+// Remove removes the configuration and data directories of the given
+// site.
+func Remove(settings *util.MonstiSettings, name string) error {
+	if !ValidName(name) {
+		return fmt.Errorf("Invalid site name %q", name)
+	}
+	configDir := settings.GetSiteConfigPath(name)
+	if _, err := os.Stat(configDir); os.IsNotExist(err) {
+		return fmt.Errorf("Site %q does not exist", name)
+	} else if err != nil {
+		return fmt.Errorf("Could not check site directory: %v", err)
+	}
+	for _, dir := range []string{settings.GetSiteDataPath(name), configDir} {
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("Could not remove site directory: %v", err)
+		}
+	}
+	return nil
+}
+
+type sitesByName []*service.SiteInfo
+
+func (s sitesByName) Len() int           { return len(s) }
+func (s sitesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s sitesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// List returns the sites configured in the configuration directory
+// ordered by name.
+func List(settings *util.MonstiSettings) ([]*service.SiteInfo, error) {
+	configured := *settings
+	if err := configured.LoadSiteSettings(); err != nil {
+		return nil, err
+	}
+	ret := make([]*service.SiteInfo, 0, len(configured.Sites))
+	for name, site := range configured.Sites {
+		ret = append(ret, &service.SiteInfo{Name: name, Title: site.Title,
+			Locale: site.Locale, Hosts: site.Hosts})
+	}
+	sort.Sort(sitesByName(ret))
+	return ret, nil
+}
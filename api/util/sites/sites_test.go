@@ -0,0 +1,441 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package sites
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.crypto/bcrypt"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestValidName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"example": true, "my-site_2": true, "": false, "../etc": false,
+		".hidden": false, "a b": false} {
+		if ValidName(name) != valid {
+			t.Errorf("ValidName(%q) should be %v", name, valid)
+		}
+	}
+}
+
+func TestSites(t *testing.T) {
+	root, err := ioutil.TempDir("", "monsti-sites")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	var settings util.MonstiSettings
+	settings.Directories.Config = filepath.Join(root, "config")
+	settings.Directories.Data = filepath.Join(root, "data")
+
+	site := &service.NewSite{Name: "foo", Title: "Foo ${HOME} <Site>",
+		Hosts:      []string{"foo.example.com:8080", "www.foo.example.com"},
+		AdminEmail: "admin@example.com", AdminPassword: "secret"}
+	if err := Create(&settings, site); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	if err := Create(&settings, site); err == nil {
+		t.Errorf("Create should fail for existing sites")
+	}
+	if err := Create(&settings, &service.NewSite{Name: "../bar",
+		Hosts: []string{"bar"}, AdminPassword: "secret"}); err == nil {
+		t.Errorf("Create should fail for invalid names")
+	}
+
+	if err := settings.LoadSiteSettings(); err != nil {
+		t.Fatalf("Could not load site settings: %v", err)
+	}
+	loaded := settings.Sites["foo"]
+	if loaded.Title != site.Title || loaded.Locale != "en" ||
+		loaded.BaseURL != "http://foo.example.com:8080" ||
+		len(loaded.Hosts) != 2 || loaded.Hosts[1] != "www.foo.example.com" ||
+		loaded.EmailAddress != "noreply@foo.example.com" ||
+		loaded.Owner.Email != "admin@example.com" ||
+		len(loaded.SessionAuthKey) != 64 ||
+		loaded.SessionAuthKey == loaded.PasswordTokenKey {
+		t.Errorf("Unexpected settings of created site: %+v", loaded)
+	}
+
+	var users map[string]service.User
+	if err := util.ParseConfig(filepath.Join(settings.GetSiteDataPath("foo"),
+		"users.json"), &users); err != nil {
+		t.Fatalf("Could not read users: %v", err)
+	}
+	admin, ok := users["admin"]
+	if !ok || admin.Email != "admin@example.com" ||
+		bcrypt.CompareHashAndPassword([]byte(admin.Password),
+			[]byte("secret")) != nil {
+		t.Errorf("Unexpected users of created site: %v", users)
+	}
+	var home map[string]interface{}
+	if err := util.ParseConfig(filepath.Join(settings.GetSiteNodesPath("foo"),
+		"node.json"), &home); err != nil {
+		t.Fatalf("Could not read home node: %v", err)
+	}
+	if home["Type"] != "core.Document" || home["Public"] != true {
+		t.Errorf("Unexpected home node: %v", home)
+	}
+
+	if err := Create(&settings, &service.NewSite{Name: "bar",
+		Hosts: []string{"bar.example.com"}, AdminPassword: "secret"}); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	list, err := List(&settings)
+	if err != nil {
+		t.Fatalf("List returned error: %v", err)
+	}
+	if len(list) != 2 || list[0].Name != "bar" || list[0].Title != "bar" ||
+		list[1].Name != "foo" {
+		t.Errorf("List returned %v", list)
+	}
+
+	if err := Remove(&settings, "foo"); err != nil {
+		t.Fatalf("Remove returned error: %v", err)
+	}
+	if err := Remove(&settings, "foo"); err == nil {
+		t.Errorf("Remove should fail for missing sites")
+	}
+	for _, dir := range []string{settings.GetSiteConfigPath("foo"),
+		settings.GetSiteDataPath("foo")} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("%v should have been removed", dir)
+		}
+	}
+	if list, err := List(&settings); err != nil || len(list) != 1 {
+		t.Errorf("List after Remove returned %v, %v", list, err)
+	}
+}
+
+func TestCloneAndPromote(t *testing.T) {
+	root, err := ioutil.TempDir("", "monsti-sites")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	var settings util.MonstiSettings
+	settings.Directories.Config = filepath.Join(root, "config")
+	settings.Directories.Data = filepath.Join(root, "data")
+	if err := Create(&settings, &service.NewSite{Name: "foo",
+		Hosts:         []string{"example.com", "www.example.com"},
+		AdminPassword: "secret"}); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	nodes := settings.GetSiteNodesPath("foo")
+	if err := os.Mkdir(filepath.Join(nodes, "about"), 0755); err != nil {
+		t.Fatalf("Could not create node: %v", err)
+	}
+	for file, content := range map[string]string{
+		"about/node.json": `{"Type":"core.Document","Fields":{"core":` +
+			`{"Body":"<a href=\"http://www.example.com/\">Home</a>"}}}`,
+		"about/photo.jpg": "www.example.com"} {
+		if err := ioutil.WriteFile(filepath.Join(nodes, file), []byte(content),
+			0644); err != nil {
+			t.Fatalf("Could not write node file: %v", err)
+		}
+	}
+
+	clone := &service.SiteClone{Source: "foo", Name: "foo-staging",
+		Domains: map[string]string{"example.com": "staging.example.com",
+			"www.example.com": "www.staging.example.com"}}
+	if err := Clone(&settings, clone); err != nil {
+		t.Fatalf("Clone returned error: %v", err)
+	}
+	if err := Clone(&settings, clone); err == nil {
+		t.Errorf("Clone should fail for existing sites")
+	}
+	if err := settings.LoadSiteSettings(); err != nil {
+		t.Fatalf("Could not load site settings: %v", err)
+	}
+	source, staging := settings.Sites["foo"], settings.Sites["foo-staging"]
+	if len(staging.Hosts) != 2 || staging.Hosts[0] != "staging.example.com" ||
+		staging.Hosts[1] != "www.staging.example.com" ||
+		staging.BaseURL != "http://staging.example.com" ||
+		len(staging.SessionAuthKey) != 64 ||
+		staging.SessionAuthKey == source.SessionAuthKey {
+		t.Errorf("Unexpected settings of cloned site: %+v", staging)
+	}
+	stagingNodes := settings.GetSiteNodesPath("foo-staging")
+	for file, expected := range map[string]string{
+		"about/node.json": `{"Type":"core.Document","Fields":{"core":` +
+			`{"Body":"<a href=\"http://www.staging.example.com/\">Home</a>"}}}`,
+		"about/photo.jpg": "www.example.com"} {
+		content, err := ioutil.ReadFile(filepath.Join(stagingNodes, file))
+		if err != nil || string(content) != expected {
+			t.Errorf("Cloned %v is %q (%v), should be %q", file, content, err,
+				expected)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(settings.GetSiteDataPath("foo-staging"),
+		"users.json")); err != nil {
+		t.Errorf("Users should have been cloned: %v", err)
+	}
+
+	if err := os.RemoveAll(filepath.Join(stagingNodes, "about")); err != nil {
+		t.Fatalf("Could not remove node: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(stagingNodes, "news"), 0755); err != nil {
+		t.Fatalf("Could not create node: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(stagingNodes, "news/node.json"),
+		[]byte(`{"Body":"http://www.staging.example.com/news/"}`),
+		0644); err != nil {
+		t.Fatalf("Could not write node: %v", err)
+	}
+	if err := Promote(&settings, "foo-staging", "foo"); err != nil {
+		t.Fatalf("Promote returned error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(nodes, "about")); !os.IsNotExist(err) {
+		t.Errorf("Production site should show the staging nodes")
+	}
+	if _, err := os.Stat(filepath.Join(stagingNodes, "about")); err != nil {
+		t.Errorf("Staging site should show the previous nodes: %v", err)
+	}
+	for file, expected := range map[string]string{
+		filepath.Join(nodes, "news/node.json"): `{"Body":"http://www.example.com/news/"}`,
+		filepath.Join(stagingNodes, "about/node.json"): `{"Type":"core.Document",` +
+			`"Fields":{"core":{"Body":"<a href=\"http://www.staging.example.com/\">` +
+			`Home</a>"}}}`} {
+		content, err := ioutil.ReadFile(file)
+		if err != nil || string(content) != expected {
+			t.Errorf("Promoted %v is %q (%v), should be %q", file, content, err,
+				expected)
+		}
+	}
+	if err := Promote(&settings, "foo", "foo"); err == nil {
+		t.Errorf("Promote should fail for the same site")
+	}
+	if err := Promote(&settings, "bar", "foo"); err == nil {
+		t.Errorf("Promote should fail for missing sites")
+	}
+}
+
+func TestExportAndImport(t *testing.T) {
+	root, err := ioutil.TempDir("", "monsti-sites")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	var settings util.MonstiSettings
+	settings.Directories.Config = filepath.Join(root, "config")
+	settings.Directories.Data = filepath.Join(root, "data")
+	if err := Create(&settings, &service.NewSite{Name: "foo",
+		Hosts: []string{"example.com"}, AdminPassword: "secret"}); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	static := filepath.Join(settings.GetSiteStaticsPath("foo"), "logo.png")
+	if err := ioutil.WriteFile(static, []byte("PNG"), 0644); err != nil {
+		t.Fatalf("Could not write static file: %v", err)
+	}
+
+	archive := new(bytes.Buffer)
+	if err := Export(&settings, "foo", archive); err != nil {
+		t.Fatalf("Export returned error: %v", err)
+	}
+	if err := Import(&settings, bytes.NewReader(archive.Bytes()),
+		""); err == nil {
+		t.Errorf("Import should fail for existing sites")
+	}
+	if err := Import(&settings, bytes.NewReader(archive.Bytes()),
+		"bar"); err != nil {
+		t.Fatalf("Import returned error: %v", err)
+	}
+	for source, target := range map[string]string{
+		static: filepath.Join(settings.GetSiteStaticsPath("bar"), "logo.png"),
+		filepath.Join(settings.GetSiteConfigPath("foo"), "site.yaml"): filepath.Join(
+			settings.GetSiteConfigPath("bar"), "site.yaml"),
+		filepath.Join(settings.GetSiteDataPath("foo"), "users.json"): filepath.Join(
+			settings.GetSiteDataPath("bar"), "users.json"),
+		filepath.Join(settings.GetSiteNodesPath("foo"), "node.json"): filepath.Join(
+			settings.GetSiteNodesPath("bar"), "node.json"),
+	} {
+		expected, _ := ioutil.ReadFile(source)
+		content, err := ioutil.ReadFile(target)
+		if err != nil || !bytes.Equal(content, expected) {
+			t.Errorf("Imported %v is %q (%v), should be %q", target, content, err,
+				expected)
+		}
+	}
+	if err := Import(&settings, strings.NewReader("foo"), "baz"); err == nil {
+		t.Errorf("Import should fail for invalid archives")
+	}
+	if _, err := os.Stat(settings.GetSiteDataPath("baz")); !os.IsNotExist(err) {
+		t.Errorf("Failed import should not leave a site behind")
+	}
+}
+
+func TestExtractPath(t *testing.T) {
+	for name, expected := range map[string]string{
+		"config/site.yaml": "/c/site.yaml",
+		"nodes/about/":     "/d/nodes/about",
+		"users.json":       "/d/users.json",
+		"data/site-static": "/d/site-static",
+		"../etc/passwd":    "",
+		"data/../../x":     "",
+		"/etc/passwd":      "",
+		"other":            "",
+		"config":           "",
+	} {
+		if ret := extractPath(name, "/c", "/d"); ret != expected {
+			t.Errorf("extractPath(%q) = %q, should be %q", name, ret, expected)
+		}
+	}
+}
+
+func TestValidChangePath(t *testing.T) {
+	for nodePath, expected := range map[string]bool{
+		"/":              true,
+		"/about":         true,
+		"/about/legal":   true,
+		"about":          false,
+		"/about/":        false,
+		"/../etc":        false,
+		"/about/../../x": false,
+		"":               false,
+	} {
+		if ret := validChangePath(nodePath); ret != expected {
+			t.Errorf("validChangePath(%q) = %v, should be %v", nodePath, ret,
+				expected)
+		}
+	}
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	root, err := ioutil.TempDir("", "monsti-sites")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	var settings util.MonstiSettings
+	settings.Directories.Config = filepath.Join(root, "config")
+	settings.Directories.Data = filepath.Join(root, "data")
+	if err := Create(&settings, &service.NewSite{Name: "foo",
+		Hosts: []string{"example.com"}, AdminPassword: "secret"}); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	nodes := settings.GetSiteNodesPath("foo")
+	write := func(name, content string) {
+		file := filepath.Join(nodes, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			t.Fatalf("Could not create node: %v", err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatalf("Could not write node: %v", err)
+		}
+	}
+	write("about/node.json", "about")
+	write("old/node.json", "old")
+	write("old/child/node.json", "old child")
+
+	dir := filepath.Join(root, "backups")
+	start := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	full, err := Backup(&settings, "foo", dir, false, start)
+	if err != nil || !full.Full ||
+		full.Name != "20150301T120000Z-full.tar.gz" {
+		t.Fatalf("Backup returned %v, %v, should be a full backup", full, err)
+	}
+
+	write("about/node.json", "changed about")
+	write("about/child/node.json", "unchanged child")
+	write("new/node.json", "new")
+	if err := os.RemoveAll(filepath.Join(nodes, "old")); err != nil {
+		t.Fatalf("Could not remove node: %v", err)
+	}
+	changed := start.Add(time.Hour)
+	if err := RecordChanges(&settings, "foo",
+		Change{Time: changed, Path: "/about"},
+		Change{Time: changed, Path: "/new", Tree: true},
+		Change{Time: changed, Path: "old", Tree: true}); err != nil {
+		t.Fatalf("RecordChanges returned error: %v", err)
+	}
+	incremental, err := Backup(&settings, "foo", dir, false,
+		start.Add(24*time.Hour))
+	if err != nil || incremental.Full {
+		t.Fatalf("Backup returned %v, %v, should be incremental", incremental,
+			err)
+	}
+	backups, err := Backups(dir)
+	if err != nil || len(backups) != 2 || backups[0].Name != full.Name ||
+		backups[1].Name != incremental.Name {
+		t.Errorf("Backups returned %v, %v", backups, err)
+	}
+
+	if err := Restore(&settings, filepath.Join(dir, incremental.Name),
+		"bar"); err != nil {
+		t.Fatalf("Restore returned error: %v", err)
+	}
+	restored := settings.GetSiteNodesPath("bar")
+	for name, expected := range map[string]string{
+		"about/node.json":     "changed about",
+		"new/node.json":       "new",
+		"old/node.json":       "",
+		"old/child/node.json": "",
+	} {
+		content, _ := ioutil.ReadFile(filepath.Join(restored,
+			filepath.FromSlash(name)))
+		if string(content) != expected {
+			t.Errorf("Restored %v is %q, should be %q", name, content, expected)
+		}
+	}
+	// Changes missing in the journal are not part of incremental
+	// backups.
+	if _, err := os.Stat(filepath.Join(restored, "about", "child")); err == nil {
+		t.Errorf("Nodes below changed nodes should not be backed up")
+	}
+	if _, err := os.Stat(filepath.Join(settings.GetSiteDataPath("bar"),
+		"users.json")); err != nil {
+		t.Errorf("Restored site is missing its users: %v", err)
+	}
+}
+
+func TestExpiredBackups(t *testing.T) {
+	backup := func(day int, hour int, full bool) *BackupInfo {
+		return &BackupInfo{Name: fmt.Sprintf("%v-%v", day, hour),
+			Created: time.Date(2015, 3, day, hour, 0, 0, 0, time.UTC),
+			Full:    full}
+	}
+	// 2015-03-02 is a Monday.
+	backups := []*BackupInfo{
+		backup(1, 0, true),
+		backup(2, 0, true),
+		backup(3, 0, false),
+		backup(4, 0, false),
+		backup(9, 0, true),
+		backup(10, 0, false),
+		backup(10, 12, false),
+		backup(11, 0, true),
+		backup(12, 0, false),
+	}
+	var ret []string
+	for _, backup := range ExpiredBackups(backups, 2, 2) {
+		ret = append(ret, backup.Name)
+	}
+	// Kept are 12, 11 (dailies), 4 (weekly) and its base backups 2 and 3.
+	expected := []string{"1-0", "9-0", "10-0", "10-12"}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Errorf("ExpiredBackups returned %v, should be %v", ret, expected)
+	}
+}
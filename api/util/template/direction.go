@@ -0,0 +1,42 @@
+// This file is part of monsti/util.
+// Copyright 2012-2014 Christian Neumann
+
+// monsti/util is free software: you can redistribute it and/or modify it under
+// the terms of the GNU Lesser General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+
+// monsti/util is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU Lesser General Public License for more
+// details.
+
+// You should have received a copy of the GNU Lesser General Public License
+// along with monsti/util. If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import "strings"
+
+// rtlLanguages are the languages written from right to left.
+var rtlLanguages = map[string]bool{
+	"ar": true, // Arabic
+	"dv": true, // Divehi
+	"fa": true, // Persian
+	"he": true, // Hebrew
+	"ps": true, // Pashto
+	"ur": true, // Urdu
+	"yi": true, // Yiddish
+}
+
+// TextDirection returns the direction of text written in the given
+// locale, either "rtl" or "ltr", e.g. "rtl" for "ar_EG".
+func TextDirection(locale string) string {
+	if i := strings.IndexAny(locale, "_-"); i > 0 {
+		locale = locale[:i]
+	}
+	if rtlLanguages[strings.ToLower(locale)] {
+		return "rtl"
+	}
+	return "ltr"
+}
@@ -0,0 +1,78 @@
+// This file is part of monsti/util.
+// Copyright 2012-2014 Christian Neumann
+
+// monsti/util is free software: you can redistribute it and/or modify it under
+// the terms of the GNU Lesser General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+
+// monsti/util is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU Lesser General Public License for more
+// details.
+
+// You should have received a copy of the GNU Lesser General Public License
+// along with monsti/util. If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"strings"
+	"time"
+)
+
+// timeLayouts are the layouts used to format dates and times for a
+// locale.
+type timeLayouts struct {
+	Date, Time string
+}
+
+// localeLayouts maps locales to their layouts. Month names get
+// translated.
+var localeLayouts = map[string]timeLayouts{
+	"en": {"Jan 2, 2006", "3:04 PM"},
+	"de": {"2. Jan 2006", "15:04"},
+}
+
+// getLayouts returns the layouts for the given locale.
+//
+// Falls back to the "en" locale.
+func getLayouts(locale string) timeLayouts {
+	if layouts, ok := localeLayouts[locale]; ok {
+		return layouts
+	}
+	if i := strings.IndexAny(locale, "_-"); i > 0 {
+		if layouts, ok := localeLayouts[locale[:i]]; ok {
+			return layouts
+		}
+	}
+	return localeLayouts["en"]
+}
+
+// formatTime formats the given time using the layout, translating
+// the abbreviated month name with G.
+func formatTime(t time.Time, layout string, G func(string) string) string {
+	ret := t.Format(layout)
+	if strings.Contains(layout, "Jan") {
+		month := t.Format("Jan")
+		ret = strings.Replace(ret, month, G(month), 1)
+	}
+	return ret
+}
+
+// dateFuncs returns the template functions to format dates and times
+// for the given locale.
+func dateFuncs(locale string, G func(string) string) map[string]interface{} {
+	layouts := getLayouts(locale)
+	return map[string]interface{}{
+		"formatDate": func(t time.Time) string {
+			return formatTime(t, layouts.Date, G)
+		},
+		"formatTime": func(t time.Time) string {
+			return formatTime(t, layouts.Time, G)
+		},
+		"formatDateTime": func(t time.Time) string {
+			return formatTime(t, layouts.Date+" "+layouts.Time, G)
+		},
+	}
+}
@@ -0,0 +1,30 @@
+// This file is part of monsti/util.
+// Copyright 2012-2014 Christian Neumann
+
+// monsti/util is free software: you can redistribute it and/or modify it under
+// the terms of the GNU Lesser General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+
+// monsti/util is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU Lesser General Public License for more
+// details.
+
+// You should have received a copy of the GNU Lesser General Public License
+// along with monsti/util. If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import "strings"
+
+// ImageURL returns the URL of the image node at the given path scaled
+// to the named size, e.g. "/foo.jpeg/_sizes/thumbnail" for "/foo.jpeg/"
+// and "thumbnail". An empty size returns the URL of the original image.
+func ImageURL(nodePath, size string) string {
+	nodePath = strings.TrimSuffix(nodePath, "/")
+	if size == "" {
+		return nodePath
+	}
+	return nodePath + "/_sizes/" + size
+}
@@ -25,9 +25,13 @@ import (
 	"fmt"
 	"html/template"
 	"io/ioutil"
+	"os"
 	"path"
 	"path/filepath"
 	"reflect"
+	"sync"
+	"text/template/parse"
+	"time"
 
 	"pkg.monsti.org/gettext"
 )
@@ -39,6 +43,107 @@ type Context map[string]interface{}
 type Renderer struct {
 	// Root is the absolute path to the template directory.
 	Root string
+	// Funcs are additional template functions, e.g. functions
+	// depending on the request. They may override the default
+	// functions.
+	Funcs template.FuncMap
+	// SandboxFuncs are the names of the functions of Funcs which site
+	// templates may call, too. See Render.
+	SandboxFuncs []string
+	// Cache holds the read template files if not nil. Templates are
+	// read on every rendering otherwise, e.g. while developing them.
+	// Cached files are read again once they have been modified.
+	Cache *Cache
+}
+
+// builtinFuncs are the names of the builtin functions of html/template
+// available to site templates. call is missing as it calls arbitrary
+// functions.
+var builtinFuncs = []string{"and", "html", "index", "slice", "js", "len",
+	"not", "or", "print", "printf", "println", "urlquery", "eq", "ge", "gt",
+	"le", "lt", "ne"}
+
+var (
+	// registeredFuncs are the functions registered with RegisterFunc.
+	registeredFuncs = make(template.FuncMap)
+	// sandboxedFuncs are the names of the registered functions
+	// available to site templates.
+	sandboxedFuncs      = make(map[string]bool)
+	registeredFuncsLock sync.RWMutex
+)
+
+// RegisterFunc makes the function available to the templates rendered
+// by all renderers of this process. Site templates may call it if
+// sandboxed is true. Registered functions don't override Monsti's
+// default functions, but functions of a Renderer's Funcs override
+// registered ones.
+func RegisterFunc(name string, fn interface{}, sandboxed bool) {
+	registeredFuncsLock.Lock()
+	defer registeredFuncsLock.Unlock()
+	registeredFuncs[name] = fn
+	if sandboxed {
+		sandboxedFuncs[name] = true
+	} else {
+		delete(sandboxedFuncs, name)
+	}
+}
+
+// Cache holds the contents of template files.
+type Cache struct {
+	mutex sync.Mutex
+	files map[string]cachedFile
+}
+
+// cachedFile is the content of a file with the file's size and
+// modification time at the time it has been read.
+type cachedFile struct {
+	content []byte
+	size    int64
+	modTime time.Time
+}
+
+// readFile returns the content of the given file, reading it from the
+// cache if it's not nil and the file has not been modified since.
+// Missing files are not cached, so templates added later, e.g. site
+// overrides, get found.
+func (c *Cache) readFile(path string) ([]byte, error) {
+	if c == nil {
+		return ioutil.ReadFile(path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	file, ok := c.files[path]
+	c.mutex.Unlock()
+	if ok && file.size == info.Size() && file.modTime.Equal(info.ModTime()) {
+		return file.content, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.files == nil {
+		c.files = make(map[string]cachedFile)
+	}
+	c.files[path] = cachedFile{content, info.Size(), info.ModTime()}
+	return content, nil
+}
+
+// Clear removes all cached files.
+func (c *Cache) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.files = nil
+}
+
+// templateRoots returns the template directories to search in order:
+// the site's template directories followed by the given root.
+func templateRoots(root, siteTemplates string) []string {
+	return append(filepath.SplitList(siteTemplates), root)
 }
 
 // getIncludes searches for include and template.include files.
@@ -49,6 +154,12 @@ type Renderer struct {
 //
 // Returns a list of templates to be included.
 func getIncludes(roots []string, name string) ([]string, error) {
+	return (*Cache)(nil).getIncludes(roots, name)
+}
+
+// getIncludes is like the function getIncludes, but reads the files
+// from the cache.
+func (c *Cache) getIncludes(roots []string, name string) ([]string, error) {
 	includes := make([]string, 0)
 	if len(name) == 0 || name[0] == filepath.Separator {
 		return nil, fmt.Errorf("Invalid template name: %q", name)
@@ -62,7 +173,7 @@ func getIncludes(roots []string, name string) ([]string, error) {
 	}
 	for _, root := range roots {
 		for _, path := range paths {
-			contents, err := ioutil.ReadFile(filepath.Join(root, path))
+			contents, err := c.readFile(filepath.Join(root, path))
 			if err != nil {
 				continue
 			}
@@ -86,9 +197,15 @@ func getIncludes(roots []string, name string) ([]string, error) {
 // name is the name of the template (e.g. "blocks/sidebar").
 // context is used as template context for rendering.
 // locale is the locale to use for translation strings in templates.
-// siteTemplates is the path to the site's overridden templates. If it's an empty
+// siteTemplates is the path to the site's overridden templates, or a list
+// of such paths separated by filepath.ListSeparator which are searched
+// in order, e.g. the site's and its theme's templates. If it's an empty
 // string, Render will not search for overridden templates.
 //
+// Site templates run in a sandbox: They may only call the builtin
+// functions except call, Monsti's default functions like G, and the
+// functions listed in SandboxFuncs or registered as sandboxed.
+//
 // Render searches for nested templates to include in these files:
 // <dir_of_template>/<template>.include
 // <dir_of_template>/include
@@ -111,18 +228,50 @@ func (r Renderer) Render(name string, context interface{},
 		"mapGet": func(in interface{}, key interface{}) interface{} {
 			return reflect.ValueOf(in).MapIndex(reflect.ValueOf(key)).Interface()
 		},
+		"locale":   func() string { return locale },
+		"textDir":  func() string { return TextDirection(locale) },
+		"imageURL": ImageURL,
+	}
+	for name, fn := range dateFuncs(locale, G) {
+		funcs[name] = fn
+	}
+	sandbox := make(map[string]interface{})
+	for _, name := range builtinFuncs {
+		sandbox[name] = true
+	}
+	for name := range funcs {
+		sandbox[name] = true
+	}
+	registeredFuncsLock.RLock()
+	for name, fn := range registeredFuncs {
+		if _, ok := funcs[name]; ok {
+			continue
+		}
+		funcs[name] = fn
+		if sandboxedFuncs[name] {
+			sandbox[name] = true
+		}
+	}
+	registeredFuncsLock.RUnlock()
+	for name, fn := range r.Funcs {
+		funcs[name] = fn
+		delete(sandbox, name)
+	}
+	for _, name := range r.SandboxFuncs {
+		sandbox[name] = true
 	}
 	tmpl.Funcs(funcs)
-	err := parse(name, tmpl, r.Root, siteTemplates)
+	roots := templateRoots(r.Root, siteTemplates)
+	err := r.Cache.parse(name, tmpl, roots, sandbox)
 	if err != nil {
 		return "", err
 	}
-	includes, err := getIncludes([]string{r.Root, siteTemplates}, name)
+	includes, err := r.Cache.getIncludes(roots, name)
 	if err != nil {
 		return "", err
 	}
 	for _, v := range includes {
-		err := parse(v, tmpl.New(v), r.Root, siteTemplates)
+		err := r.Cache.parse(v, tmpl.New(v), roots, sandbox)
 		if err != nil {
 			return "", err
 		}
@@ -134,30 +283,53 @@ func (r Renderer) Render(name string, context interface{},
 	return out.String(), nil
 }
 
+// Exists returns true iff the named template exists in the template
+// directory or in the given site templates directories (see Render).
+func (r Renderer) Exists(name string, siteTemplates string) bool {
+	return r.Origin(name, siteTemplates) != ""
+}
+
+// Origin returns the directory providing the named template, i.e. the
+// first of the given site templates directories (see Render) or the
+// template directory containing it. Returns an empty string if there
+// is no such template.
+func (r Renderer) Origin(name string, siteTemplates string) string {
+	for _, root := range templateRoots(r.Root, siteTemplates) {
+		if _, err := r.Cache.readFile(filepath.Join(root, name+".html")); err == nil {
+			return root
+		}
+	}
+	return ""
+}
+
 // Parse the named template and add to the existing template structure.
 //
 // name is the name of the template (e.g. "blocks/sidebar")
 // t is the existing template structure.
-// root is the path to monsti's template
-// siteRoot is the path to the sites' overriden templates.
-func parse(name string, t *template.Template, root string,
-	siteRoot string) error {
-	if len(siteRoot) > 0 {
-		path := filepath.Join(siteRoot, name+".html")
-		content, err := ioutil.ReadFile(path)
+// roots are the template directories searched in order, the last one
+// being monsti's template directory.
+// sandbox holds the names of the functions templates of the other
+// directories may call.
+func (c *Cache) parse(name string, t *template.Template, roots []string,
+	sandbox map[string]interface{}) error {
+	var content []byte
+	var err error
+	var i int
+	for i = range roots {
+		content, err = c.readFile(filepath.Join(roots[i], name+".html"))
 		if err == nil {
-			_, err = t.Parse(string(content))
-			if err != nil {
-				return fmt.Errorf("Could not parse template: %v", err)
-			}
-			return nil
+			break
 		}
 	}
-	path := filepath.Join(root, name+".html")
-	content, err := ioutil.ReadFile(path)
 	if err != nil {
 		return fmt.Errorf("Could not load template: %v", err)
 	}
+	if i < len(roots)-1 {
+		if _, err := parse.Parse(name, string(content), "", "",
+			sandbox); err != nil {
+			return fmt.Errorf("Could not parse site template: %v", err)
+		}
+	}
 	_, err = t.Parse(string(content))
 	if err != nil {
 		return fmt.Errorf("Could not parse template: %v", err)
@@ -1,10 +1,15 @@
 package template
 
 import (
+	"html/template"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	mtesting "pkg.monsti.org/monsti/api/util/testing"
 )
@@ -33,3 +38,184 @@ func TestGetIncludes(t *testing.T) {
 			includes, err, expected)
 	}
 }
+
+func TestDateFuncs(t *testing.T) {
+	date := time.Date(2014, time.March, 7, 14, 5, 0, 0, time.UTC)
+	G := func(in string) string {
+		if in == "Mar" {
+			return "Mär"
+		}
+		return in
+	}
+	noop := func(in string) string { return in }
+	tests := []struct {
+		Locale, Func, Expected string
+	}{
+		{"en", "formatDate", "Mar 7, 2014"},
+		{"en", "formatTime", "2:05 PM"},
+		{"en", "formatDateTime", "Mar 7, 2014 2:05 PM"},
+		{"de", "formatDate", "7. Mär 2014"},
+		{"de", "formatTime", "14:05"},
+		{"de_AT", "formatDateTime", "7. Mär 2014 14:05"},
+		{"foo", "formatDate", "Mar 7, 2014"},
+	}
+	for i, test := range tests {
+		translate := noop
+		if strings.HasPrefix(test.Locale, "de") {
+			translate = G
+		}
+		fn := dateFuncs(test.Locale, translate)[test.Func].(func(time.Time) string)
+		if ret := fn(date); ret != test.Expected {
+			t.Errorf("Test %v: %v(%v) for locale %q is %q, should be %q",
+				i, test.Func, date, test.Locale, ret, test.Expected)
+		}
+	}
+}
+
+func TestTextDirection(t *testing.T) {
+	tests := []struct {
+		Locale, Direction string
+	}{
+		{"", "ltr"},
+		{"en", "ltr"},
+		{"de_AT", "ltr"},
+		{"ar", "rtl"},
+		{"ar_EG", "rtl"},
+		{"he-IL", "rtl"},
+		{"fa", "rtl"},
+	}
+	for _, test := range tests {
+		if ret := TextDirection(test.Locale); ret != test.Direction {
+			t.Errorf("TextDirection(%q) = %q, should be %q", test.Locale, ret,
+				test.Direction)
+		}
+	}
+}
+
+func TestImageURL(t *testing.T) {
+	tests := []struct {
+		Path, Size, URL string
+	}{
+		{"/foo/image.jpeg/", "thumbnail", "/foo/image.jpeg/_sizes/thumbnail"},
+		{"/foo/image.jpeg", "large", "/foo/image.jpeg/_sizes/large"},
+		{"/foo/image.jpeg/", "", "/foo/image.jpeg"},
+	}
+	for i, test := range tests {
+		if ret := ImageURL(test.Path, test.Size); ret != test.URL {
+			t.Errorf("Test %v: ImageURL(%q, %q) = %q, should be %q", i,
+				test.Path, test.Size, ret, test.URL)
+		}
+	}
+}
+
+func TestRenderSearchPath(t *testing.T) {
+	root, cleanup, err := mtesting.CreateDirectoryTree(map[string]string{
+		"/core/page.html":      `core {{template "header"}} {{template "footer"}}`,
+		"/core/page.include":   "header\nfooter",
+		"/core/header.html":    "core-header",
+		"/core/footer.html":    "core-footer",
+		"/theme/header.html":   "theme-header",
+		"/theme/footer.html":   "theme-footer",
+		"/site/footer.html":    "site-footer",
+		"/site/unrelated.html": "unrelated"}, "TestRenderSearchPath")
+	if err != nil {
+		t.Fatalf("Could not create test directory tree: %v", err)
+	}
+	defer cleanup()
+	siteTemplates := filepath.Join(root, "site") + string(filepath.ListSeparator) +
+		filepath.Join(root, "theme")
+	renderer := Renderer{Root: filepath.Join(root, "core"), Cache: new(Cache)}
+	render := func() string {
+		ret, err := renderer.Render("page", nil, "en", siteTemplates)
+		if err != nil {
+			t.Fatalf("Render returned error: %v", err)
+		}
+		return ret
+	}
+	if ret, expected := render(), "core theme-header site-footer"; ret != expected {
+		t.Errorf("Render() = %q, should be %q", ret, expected)
+	}
+	for name, origin := range map[string]string{
+		"header": "theme", "footer": "site", "page": "core", "missing": ""} {
+		expected := ""
+		if origin != "" {
+			expected = filepath.Join(root, origin)
+		}
+		if ret := renderer.Origin(name, siteTemplates); ret != expected {
+			t.Errorf("Origin(%q) = %q, should be %q", name, ret, expected)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "site", "header.html"),
+		[]byte("site-header"), 0600); err != nil {
+		t.Fatalf("Could not write template: %v", err)
+	}
+	if ret, expected := render(), "core site-header site-footer"; ret != expected {
+		t.Errorf("Render() = %q with added template, should be %q", ret, expected)
+	}
+	footer := filepath.Join(root, "site", "footer.html")
+	if err := ioutil.WriteFile(footer, []byte("new-footer"), 0600); err != nil {
+		t.Fatalf("Could not write template: %v", err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(footer, later, later); err != nil {
+		t.Fatalf("Could not change modification time: %v", err)
+	}
+	if ret, expected := render(), "core site-header new-footer"; ret != expected {
+		t.Errorf("Render() = %q with modified template, should be %q", ret,
+			expected)
+	}
+	renderer.Cache.Clear()
+	if ret, expected := render(), "core site-header new-footer"; ret != expected {
+		t.Errorf("Render() = %q after clearing the cache, should be %q", ret,
+			expected)
+	}
+	renderer.Cache = nil
+	if ret, expected := render(), "core site-header new-footer"; ret != expected {
+		t.Errorf("Render() = %q without cache, should be %q", ret, expected)
+	}
+}
+
+func TestRenderSandbox(t *testing.T) {
+	root, cleanup, err := mtesting.CreateDirectoryTree(map[string]string{
+		"/core/core.html":       `{{secret}} {{registeredSecret}}`,
+		"/site/builtin.html":    `{{len "foo"}} {{pathJoin "a" "b"}}`,
+		"/site/secret.html":     `{{secret}}`,
+		"/site/public.html":     `{{public}} {{registeredPublic}}`,
+		"/site/registered.html": `{{registeredSecret}}`,
+		"/site/call.html":       `{{call .}}`,
+	}, "TestRenderSandbox")
+	if err != nil {
+		t.Fatalf("Could not create test directory tree: %v", err)
+	}
+	defer cleanup()
+	RegisterFunc("registeredSecret", func() string { return "rs" }, false)
+	RegisterFunc("registeredPublic", func() string { return "rp" }, true)
+	renderer := Renderer{Root: filepath.Join(root, "core"),
+		Funcs: template.FuncMap{
+			"secret": func() string { return "s" },
+			"public": func() string { return "p" },
+		},
+		SandboxFuncs: []string{"public"}}
+	tests := []struct {
+		Name, Rendered string
+	}{
+		{"core", "s rs"},
+		{"builtin", "3 a/b"},
+		{"secret", ""},
+		{"public", "p rp"},
+		{"registered", ""},
+		{"call", ""},
+	}
+	for _, test := range tests {
+		ret, err := renderer.Render(test.Name, func() string { return "c" }, "en",
+			filepath.Join(root, "site"))
+		if test.Rendered == "" {
+			if err == nil {
+				t.Errorf("Rendering %q should fail", test.Name)
+			}
+		} else if err != nil || ret != test.Rendered {
+			t.Errorf("Render(%q) = %q, %v, should be %q, nil", test.Name, ret, err,
+				test.Rendered)
+		}
+	}
+}
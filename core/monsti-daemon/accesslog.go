@@ -0,0 +1,295 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2013 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogSettings configure the access log.
+type accessLogSettings struct {
+	// Directory holds the access logs, one file per site named
+	// <site>.log. Requests to unknown hosts are logged to
+	// default.log. Empty disables the access log.
+	Directory string
+	// Format is either "combined" (the default) for Apache's combined
+	// log format or "json" for one JSON object per line.
+	Format string
+	// MaxSize is the size in bytes at which log files get rotated.
+	// Zero disables rotation.
+	MaxSize int64
+	// Backups is the number of rotated files to keep, e.g. site.log.1
+	// being the most recent one.
+	Backups int
+}
+
+// rotatingFile is a file getting rotated when it exceeds its maximum
+// size.
+type rotatingFile struct {
+	Path    string
+	MaxSize int64
+	Backups int
+	mutex   sync.Mutex
+	file    *os.File
+	size    int64
+}
+
+// rotate renames the file and its backups, dropping the oldest
+// backup.
+func (f *rotatingFile) rotate() error {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	if f.Backups <= 0 {
+		return os.Remove(f.Path)
+	}
+	for i := f.Backups - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%v.%v", f.Path, i),
+			fmt.Sprintf("%v.%v", f.Path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(f.Path, f.Path+".1")
+}
+
+// Write appends the data to the file, rotating it before if the data
+// would exceed its maximum size.
+func (f *rotatingFile) Write(data []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file != nil && f.MaxSize > 0 && f.size > 0 &&
+		f.size+int64(len(data)) > f.MaxSize {
+		if err := f.rotate(); err != nil {
+			return 0, fmt.Errorf("Could not rotate %v: %v", f.Path, err)
+		}
+	}
+	if f.file == nil {
+		file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+			0600)
+		if err != nil {
+			return 0, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return 0, err
+		}
+		f.file, f.size = file, info.Size()
+	}
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	return n, err
+}
+
+// accessLogEntry describes a served request.
+type accessLogEntry struct {
+	Time      time.Time
+	Remote    string
+	Host      string
+	Method    string
+	URI       string
+	Proto     string
+	Status    int
+	Size      int64
+	Referer   string
+	UserAgent string
+	// Duration is the time it took to serve the request.
+	Duration time.Duration
+	// RequestID is the id returned in the X-Request-Id header, if any.
+	RequestID string
+}
+
+// quoteLogValue returns the value for a quoted field of the combined
+// log format.
+func quoteLogValue(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return strings.Replace(strings.Replace(value, `\`, `\\`, -1), `"`, `\"`, -1)
+}
+
+// Combined returns the entry in Apache's combined log format.
+func (e *accessLogEntry) Combined() string {
+	size := "-"
+	if e.Size > 0 {
+		size = fmt.Sprint(e.Size)
+	}
+	return fmt.Sprintf("%v - - [%v] \"%v %v %v\" %v %v \"%v\" \"%v\"\n",
+		e.Remote, e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Method,
+		quoteLogValue(e.URI), e.Proto, e.Status, size,
+		quoteLogValue(e.Referer), quoteLogValue(e.UserAgent))
+}
+
+// JSON returns the entry as a line of JSON.
+func (e *accessLogEntry) JSON() string {
+	ret, _ := json.Marshal(map[string]interface{}{
+		"time":       e.Time.Format(time.RFC3339),
+		"remote":     e.Remote,
+		"host":       e.Host,
+		"method":     e.Method,
+		"uri":        e.URI,
+		"proto":      e.Proto,
+		"status":     e.Status,
+		"size":       e.Size,
+		"referer":    e.Referer,
+		"user_agent": e.UserAgent,
+		"duration":   e.Duration.Seconds(),
+		"request_id": e.RequestID})
+	return string(ret) + "\n"
+}
+
+// accessLogWriter records the status and size of a response.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.size += int64(n)
+	return n, err
+}
+
+// Flush sends buffered data to the client, e.g. for server-sent events.
+func (w *accessLogWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack takes over the connection, e.g. for WebSockets. The request
+// gets logged with status 101 Switching Protocols.
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("The connection does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// accessLog writes the access logs of the sites.
+type accessLog struct {
+	Settings accessLogSettings
+	// Hosts maps host patterns to site names.
+	Hosts hostTable
+	// Log receives failures to write the access log.
+	Log   *log.Logger
+	mutex sync.Mutex
+	files map[string]*rotatingFile
+}
+
+// file returns the log file of the given site.
+func (l *accessLog) file(site string) *rotatingFile {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.files == nil {
+		l.files = make(map[string]*rotatingFile)
+	}
+	if file, ok := l.files[site]; ok {
+		return file
+	}
+	file := &rotatingFile{
+		Path:    filepath.Join(l.Settings.Directory, site+".log"),
+		MaxSize: l.Settings.MaxSize,
+		Backups: l.Settings.Backups}
+	l.files[site] = file
+	return file
+}
+
+// redactedRequestURI returns the request URI with the values of secret
+// query parameters like breakglass replaced.
+func redactedRequestURI(r *http.Request) string {
+	uri, err := url.ParseRequestURI(r.RequestURI)
+	if err != nil || uri.RawQuery == "" {
+		return r.RequestURI
+	}
+	query := uri.Query()
+	for name := range query {
+		if isSecretField(name) {
+			uri.RawQuery = redactValues(query).Encode()
+			return uri.String()
+		}
+	}
+	return r.RequestURI
+}
+
+// Handler returns a handler logging the requests served by next.
+func (l *accessLog) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		writer := &accessLogWriter{ResponseWriter: w}
+		next.ServeHTTP(writer, r)
+		entry := accessLogEntry{
+			Time:      start,
+			Remote:    r.RemoteAddr,
+			Host:      r.Host,
+			Method:    r.Method,
+			URI:       redactedRequestURI(r),
+			Proto:     r.Proto,
+			Status:    writer.status,
+			Size:      writer.size,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+			Duration:  time.Since(start),
+			RequestID: w.Header().Get(requestIDHeader)}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			entry.Remote = host
+		}
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		line := entry.Combined()
+		if l.Settings.Format == "json" {
+			line = entry.JSON()
+		}
+		site, ok := l.Hosts.lookup(r.Host)
+		if !ok {
+			site = "default"
+		}
+		if _, err := l.file(site).Write([]byte(line)); err != nil {
+			l.Log.Printf("Could not write access log: %v", err)
+		}
+	})
+}
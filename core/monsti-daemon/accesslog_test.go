@@ -0,0 +1,122 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2013 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogEntry(t *testing.T) {
+	entry := accessLogEntry{
+		Time:      time.Date(2015, 10, 1, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+		Remote:    "127.0.0.1",
+		Method:    "GET",
+		URI:       "/foo/?q=\"bar\"",
+		Proto:     "HTTP/1.1",
+		Status:    200,
+		Size:      2326,
+		UserAgent: "Mozilla/4.08",
+		RequestID: "abc"}
+	expected := `127.0.0.1 - - [01/Oct/2015:13:55:36 -0700] "GET /foo/?q=\"bar\" HTTP/1.1" 200 2326 "-" "Mozilla/4.08"` + "\n"
+	if ret := entry.Combined(); ret != expected {
+		t.Errorf("Combined() = %q, should be %q", ret, expected)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(entry.JSON()), &decoded); err != nil {
+		t.Fatalf("Could not decode JSON entry: %v", err)
+	}
+	if decoded["uri"] != entry.URI || decoded["status"] != 200.0 ||
+		decoded["request_id"] != "abc" {
+		t.Errorf("JSON() = %v, does not describe the entry", decoded)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-TestRotatingFile")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := &rotatingFile{Path: filepath.Join(dir, "site.log"), MaxSize: 10,
+		Backups: 2}
+	for i := 0; i < 4; i++ {
+		if _, err := file.Write([]byte(fmt.Sprintf("line %v\n", i))); err != nil {
+			t.Fatalf("Could not write line %v: %v", i, err)
+		}
+	}
+	file.file.Close()
+	for name, content := range map[string]string{
+		"site.log":   "line 3\n",
+		"site.log.1": "line 2\n",
+		"site.log.2": "line 1\n",
+	} {
+		ret, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(ret) != content {
+			t.Errorf("%v contains %q (%v), should be %q", name, ret, err, content)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "site.log.3")); !os.IsNotExist(err) {
+		t.Errorf("Only two backups should be kept")
+	}
+}
+
+func TestAccessLogHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-TestAccessLogHandler")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	accessLog := &accessLog{
+		Settings: accessLogSettings{Directory: dir},
+		Hosts:    map[string]string{"example.com": "example"}}
+	handler := accessLog.Handler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "Not found")
+		}))
+	for _, host := range []string{"example.com", "unknown.com"} {
+		req, _ := http.NewRequest("GET", "http://"+host+"/foo", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.RequestURI = "/foo"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	for _, name := range []string{"example.log", "default.log"} {
+		ret, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || !strings.HasPrefix(string(ret), "10.0.0.1 - - [") ||
+			!strings.Contains(string(ret), `"GET /foo HTTP/1.1" 404 9 "-"`) {
+			t.Errorf("%v contains %q (%v), should log the request", name, ret, err)
+		}
+	}
+	req, _ := http.NewRequest("GET",
+		"http://example.com/@@login?breakglass=0123456789abcdef", nil)
+	req.RequestURI = "/@@login?breakglass=0123456789abcdef"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	ret, _ := ioutil.ReadFile(filepath.Join(dir, "example.log"))
+	if strings.Contains(string(ret), "0123456789abcdef") ||
+		!strings.Contains(string(ret), "/@@login?breakglass=REDACTED") {
+		t.Errorf("example.log contains %q, should redact the token", ret)
+	}
+}
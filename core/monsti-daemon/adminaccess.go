@@ -0,0 +1,143 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// minBreakGlassTokenLength is the minimum length of break-glass
+// tokens.
+const minBreakGlassTokenLength = 16
+
+// breakGlassDuration is the time break-glass access is granted to a
+// session.
+const breakGlassDuration = 8 * time.Hour
+
+// adminAccess restricts the admin area of a site to networks.
+type adminAccess struct {
+	Allow, Deny []*net.IPNet
+	// BreakGlassToken grants access from any address, if not empty.
+	BreakGlassToken string
+}
+
+// newAdminAccess returns the admin access restrictions of the given
+// sites. Sites without restrictions are missing.
+func newAdminAccess(sites map[string]util.SiteSettings) (
+	map[string]*adminAccess, error) {
+	ret := make(map[string]*adminAccess)
+	for name, site := range sites {
+		config := site.AdminAccess
+		if len(config.Allow) == 0 && len(config.Deny) == 0 {
+			continue
+		}
+		access := &adminAccess{BreakGlassToken: config.BreakGlassToken}
+		var err error
+		if access.Allow, err = parseNetworks(config.Allow); err != nil {
+			return nil, fmt.Errorf("Invalid allowed networks of site %v: %v",
+				name, err)
+		}
+		if access.Deny, err = parseNetworks(config.Deny); err != nil {
+			return nil, fmt.Errorf("Invalid denied networks of site %v: %v",
+				name, err)
+		}
+		if token := access.BreakGlassToken; token != "" &&
+			len(token) < minBreakGlassTokenLength {
+			return nil, fmt.Errorf("Break-glass token of site %v is shorter "+
+				"than %v characters", name, minBreakGlassTokenLength)
+		}
+		ret[name] = access
+	}
+	return ret, nil
+}
+
+// allows returns true iff clients with the given address may access
+// the admin area.
+func (a *adminAccess) allows(ip string) bool {
+	if inNetworks(ip, a.Deny) {
+		return false
+	}
+	return len(a.Allow) == 0 || inNetworks(ip, a.Allow)
+}
+
+// isAdminAction returns true iff the action belongs to the admin area,
+// i.e. it requires a login or deals with logins and passwords.
+func isAdminAction(action service.Action) bool {
+	switch action {
+	case service.LoginAction, service.RequestPasswordTokenAction,
+		service.ChangePasswordAction:
+		return true
+	}
+	return requiresLogin(action)
+}
+
+// checkAdminAccess checks if the client may access the requested admin
+// page. Otherwise, it writes the response and returns false.
+//
+// Requests with the site's break-glass token as breakglass query
+// parameter grant access to the browser's session from any address for
+// breakGlassDuration.
+func (h *nodeHandler) checkAdminAccess(c *reqContext) bool {
+	access, ok := h.AdminAccess[c.Site.Name]
+	if !ok || !isAdminAction(c.Action) || access.allows(c.ClientIP) {
+		return true
+	}
+	token := access.BreakGlassToken
+	if token != "" {
+		now := time.Now()
+		if granted, ok := c.Session.Values["breakglass-granted"].(int64); ok &&
+			now.Sub(time.Unix(granted, 0)) < breakGlassDuration &&
+			c.Session.Values["breakglass"] == generateToken(c.Site.Name, token,
+				fmt.Sprint(granted)) {
+			return true
+		}
+		query := c.Req.URL.Query()
+		if given := query.Get("breakglass"); given != "" {
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+				h.Log.Printf("[%v] Break-glass access to the admin area of site "+
+					"%v from %v", c.RequestID, c.Site.Name, c.ClientIP)
+				c.Session.Values["breakglass-granted"] = now.Unix()
+				c.Session.Values["breakglass"] = generateToken(c.Site.Name, token,
+					fmt.Sprint(now.Unix()))
+				if err := c.Session.Save(c.Req, c.Res); err != nil {
+					serveError("Could not save session: %v", err)
+				}
+				query.Del("breakglass")
+				target := *c.Req.URL
+				target.RawQuery = query.Encode()
+				http.Redirect(c.Res, c.Req, target.RequestURI(), http.StatusSeeOther)
+				return false
+			}
+			h.Log.Printf("[%v] Invalid break-glass token for site %v from %v",
+				c.RequestID, c.Site.Name, c.ClientIP)
+		}
+	}
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	c.ErrorMessage = fmt.Sprintf(
+		G("The admin area may not be accessed from your address: %v"),
+		c.ClientIP)
+	h.serveErrorPage(c, http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,142 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestNewAdminAccess(t *testing.T) {
+	access, err := newAdminAccess(map[string]util.SiteSettings{"foo": {}})
+	if err != nil || len(access) != 0 {
+		t.Errorf("newAdminAccess without restrictions = %v, %v, should be "+
+			"empty", access, err)
+	}
+	var site util.SiteSettings
+	site.AdminAccess.Allow = []string{"10.0.0.0/8"}
+	site.AdminAccess.BreakGlassToken = "secret"
+	if _, err := newAdminAccess(map[string]util.SiteSettings{
+		"foo": site}); err == nil {
+		t.Errorf("newAdminAccess should fail for short break-glass tokens")
+	}
+	site.AdminAccess.BreakGlassToken = ""
+	site.AdminAccess.Deny = []string{"foo"}
+	if _, err := newAdminAccess(map[string]util.SiteSettings{
+		"foo": site}); err == nil {
+		t.Errorf("newAdminAccess should fail for invalid networks")
+	}
+}
+
+func TestIsAdminAction(t *testing.T) {
+	for action, admin := range map[service.Action]bool{
+		service.ViewAction:                 false,
+		service.SearchAction:               false,
+		service.FeedAction:                 false,
+		service.LoginAction:                true,
+		service.RequestPasswordTokenAction: true,
+		service.EditAction:                 true,
+		service.DashboardAction:            true,
+	} {
+		if isAdminAction(action) != admin {
+			t.Errorf("isAdminAction(%v) should be %v", action, admin)
+		}
+	}
+}
+
+func TestCheckAdminAccess(t *testing.T) {
+	site := util.SiteSettings{Name: "foo", SessionAuthKey: "secret"}
+	site.AdminAccess.Allow = []string{"10.0.0.0/8"}
+	site.AdminAccess.Deny = []string{"10.6.6.6"}
+	site.AdminAccess.BreakGlassToken = "0123456789abcdef"
+	access, err := newAdminAccess(map[string]util.SiteSettings{"foo": site})
+	if err != nil {
+		t.Fatalf("newAdminAccess returned error: %v", err)
+	}
+	var logs bytes.Buffer
+	h := &nodeHandler{AdminAccess: access, Log: log.New(&logs, "", 0)}
+	// The browser's session, kept across the requests.
+	session, err := getSession(new(http.Request), site)
+	if err != nil {
+		t.Fatalf("getSession returned error: %v", err)
+	}
+	tests := []struct {
+		URL, ClientIP string
+		Action        service.Action
+		Allowed       bool
+		Status        int
+		Location      string
+	}{
+		{"/@@login", "10.1.2.3", service.LoginAction, true, 0, ""},
+		{"/", "1.2.3.4", service.ViewAction, true, 0, ""},
+		{"/@@login", "1.2.3.4", service.LoginAction, false, 403, ""},
+		{"/foo/@@edit", "10.6.6.6", service.EditAction, false, 403, ""},
+		{"/@@login?breakglass=foo", "1.2.3.4", service.LoginAction, false,
+			403, ""},
+		{"/@@login?breakglass=0123456789abcdef&next=%2F", "1.2.3.4",
+			service.LoginAction, false, 303, "/@@login?next=%2F"},
+		{"/@@login", "1.2.3.4", service.LoginAction, true, 0, ""},
+		{"/@@login", "1.2.3.4", service.LoginAction, false, 403, ""},
+	}
+	for i, test := range tests {
+		if i == len(tests)-1 {
+			// Let the granted access expire.
+			granted := time.Now().Add(-breakGlassDuration).Unix()
+			session.Values["breakglass-granted"] = granted
+			session.Values["breakglass"] = generateToken(site.Name,
+				site.AdminAccess.BreakGlassToken, fmt.Sprint(granted))
+		}
+		req, _ := http.NewRequest("GET", "http://foo.com"+test.URL, nil)
+		rec := httptest.NewRecorder()
+		c := &reqContext{Req: req, Res: rec, Site: &site, Session: session,
+			UserSession: new(service.UserSession), Action: test.Action,
+			ClientIP: test.ClientIP}
+		if allowed := h.checkAdminAccess(c); allowed != test.Allowed {
+			t.Errorf("%v: checkAdminAccess should return %v", i, test.Allowed)
+		}
+		if test.Allowed {
+			continue
+		}
+		if rec.Code != test.Status {
+			t.Errorf("%v: Status is %v, should be %v", i, rec.Code, test.Status)
+		}
+		if location := rec.Header().Get("Location"); location != test.Location {
+			t.Errorf("%v: Location is %q, should be %q", i, location,
+				test.Location)
+		}
+		if test.Status == http.StatusForbidden &&
+			!strings.Contains(rec.Body.String(), test.ClientIP) {
+			t.Errorf("%v: Error page does not explain the denial: %q", i,
+				rec.Body.String())
+		}
+	}
+	for _, msg := range []string{"Invalid break-glass token",
+		"Break-glass access to the admin area of site foo from 1.2.3.4"} {
+		if !strings.Contains(logs.String(), msg) {
+			t.Errorf("Log should contain %q: %q", msg, logs.String())
+		}
+	}
+}
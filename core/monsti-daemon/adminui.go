@@ -0,0 +1,88 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// alwaysShownActions are shown to every user regardless of the admin
+// UI configuration.
+var alwaysShownActions = []string{"", "view", "login", "logout",
+	"request-password-token", "change-password", "payment-callback", "search",
+	"newsletter", "feed", "comments", "robots.txt", "sitemap"}
+
+// impliedActions maps actions to the actions they depend on, e.g.
+// the editor uses the node browser.
+var impliedActions = map[string][]string{
+	"edit": {"browse", "markdown-preview", "media", "upload", "gallery-upload"},
+	"add":  {"browse", "markdown-preview", "media", "upload"},
+}
+
+// adminUI is the set of actions (e.g. "edit" or "files") shown to a
+// user. A nil adminUI shows all actions.
+type adminUI map[string]bool
+
+// Shows returns true iff the action with the given name is shown.
+func (ui adminUI) Shows(action string) bool {
+	return ui == nil || ui[action]
+}
+
+// newAdminUI returns the actions shown to the user given the site's
+// core.adminui configuration, which maps roles to the actions shown
+// to users with that role.
+//
+// Users are only restricted if all of their roles are configured. They
+// see the actions of all their roles.
+func newAdminUI(config map[string][]string, user *service.User) adminUI {
+	if user == nil || len(user.Roles) == 0 {
+		return nil
+	}
+	ui := make(adminUI)
+	for _, role := range user.Roles {
+		actions, ok := config[role]
+		if !ok {
+			return nil
+		}
+		for _, action := range actions {
+			ui[action] = true
+			for _, implied := range impliedActions[action] {
+				ui[implied] = true
+			}
+		}
+	}
+	for _, action := range alwaysShownActions {
+		ui[action] = true
+	}
+	return ui
+}
+
+// getAdminUI returns the actions shown to the given user of the site.
+func getAdminUI(s *service.Session, site string,
+	user *service.User) (adminUI, error) {
+	if user == nil {
+		return nil, nil
+	}
+	var config map[string][]string
+	if err := s.Monsti().GetSiteConfig(site, "core.adminui",
+		&config); err != nil {
+		return nil, fmt.Errorf("Could not get admin UI configuration: %v", err)
+	}
+	return newAdminUI(config, user), nil
+}
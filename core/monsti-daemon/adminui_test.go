@@ -0,0 +1,59 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestAdminUI(t *testing.T) {
+	config := map[string][]string{
+		"editor":    {"edit", "history"},
+		"publisher": {"calendar"},
+	}
+	tests := []struct {
+		Roles         []string
+		Shown, Hidden []string
+	}{
+		{nil, []string{"edit", "users", "health"}, nil},
+		{[]string{"admin"}, []string{"edit", "users"}, nil},
+		{[]string{"editor", "admin"}, []string{"edit", "users"}, nil},
+		{[]string{"editor"}, []string{"view", "edit", "browse", "history",
+			"logout", "change-password", "sitemap"},
+			[]string{"users", "calendar", "remove"}},
+		{[]string{"editor", "publisher"}, []string{"edit", "calendar"},
+			[]string{"users", "settings"}},
+	}
+	for i, test := range tests {
+		ui := newAdminUI(config, &service.User{Login: "foo", Roles: test.Roles})
+		for _, action := range test.Shown {
+			if !ui.Shows(action) {
+				t.Errorf("%v: Action %q should be shown", i, action)
+			}
+		}
+		for _, action := range test.Hidden {
+			if ui.Shows(action) {
+				t.Errorf("%v: Action %q should be hidden", i, action)
+			}
+		}
+	}
+	if ui := newAdminUI(config, nil); !ui.Shows("edit") {
+		t.Errorf("newAdminUI(_, nil) should not restrict actions")
+	}
+}
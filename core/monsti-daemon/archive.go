@@ -0,0 +1,265 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/chrneumann/htmlwidgets"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// archiveFile is the name of the file holding the archived subtree of
+// a node inside the node's directory.
+const archiveFile = "archive.zip"
+
+// findArchive returns the path to the archive containing the given
+// node and the node's path relative to the archive's root. If the
+// node is not archived, the returned archive path is empty.
+func findArchive(root, nodePath string) (archive, rel string) {
+	nodePath = path.Clean("/" + nodePath)
+	for dir := nodePath; ; dir = path.Dir(dir) {
+		candidate := filepath.Join(root, dir[1:], archiveFile)
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			rel = strings.TrimPrefix(strings.TrimPrefix(nodePath, dir), "/")
+			return candidate, rel
+		}
+		if dir == "/" {
+			return "", ""
+		}
+	}
+}
+
+// readArchiveFile reads the named file of the archive.
+//
+// The archive is opened on each call to only load the requested file
+// into memory. If there is no such file, it returns nil, nil.
+func readArchiveFile(archive, name string) ([]byte, error) {
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open archive: %v", err)
+	}
+	defer reader.Close()
+	for _, file := range reader.File {
+		if file.Name != name {
+			continue
+		}
+		content, err := file.Open()
+		if err != nil {
+			return nil, fmt.Errorf("Could not open archived file: %v", err)
+		}
+		defer content.Close()
+		return ioutil.ReadAll(content)
+	}
+	return nil, nil
+}
+
+// listArchiveDir returns the sorted names of the directories within
+// the given directory of the archive.
+func listArchiveDir(archive, dir string) ([]string, error) {
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open archive: %v", err)
+	}
+	defer reader.Close()
+	prefix := ""
+	if len(dir) > 0 {
+		prefix = dir + "/"
+	}
+	found := make(map[string]bool)
+	dirs := make([]string, 0)
+	for _, file := range reader.File {
+		if !strings.HasPrefix(file.Name, prefix) {
+			continue
+		}
+		parts := strings.SplitN(file.Name[len(prefix):], "/", 2)
+		if len(parts) == 2 && len(parts[0]) > 0 && !found[parts[0]] {
+			found[parts[0]] = true
+			dirs = append(dirs, parts[0])
+		}
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// listArchiveFiles returns the sorted names of the files within the
+// given directory of the archive.
+func listArchiveFiles(archive, dir string) ([]string, error) {
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open archive: %v", err)
+	}
+	defer reader.Close()
+	prefix := ""
+	if len(dir) > 0 {
+		prefix = dir + "/"
+	}
+	files := make([]string, 0)
+	for _, file := range reader.File {
+		name := strings.TrimPrefix(file.Name, prefix)
+		if strings.HasPrefix(file.Name, prefix) && len(name) > 0 &&
+			!strings.Contains(name, "/") {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// archiveNode moves the subtree of the given node into a compressed
+// archive inside the node's directory.
+func archiveNode(root, nodePath string) error {
+	nodePath = path.Clean("/" + nodePath)
+	if nodePath == "/" {
+		return fmt.Errorf("The root node can't be archived")
+	}
+	if archive, _ := findArchive(root, nodePath); len(archive) > 0 {
+		return fmt.Errorf("Node %v is already archived", nodePath)
+	}
+	dir := filepath.Join(root, nodePath[1:])
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("Could not find node directory: %v", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dir), ".archive")
+	if err != nil {
+		return fmt.Errorf("Could not create archive: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	writer := zip.NewWriter(tmp)
+	err = filepath.Walk(dir, func(file string, info os.FileInfo,
+		err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		header.Method = zip.Deflate
+		out, err := writer.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		in, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		_, err = io.Copy(out, in)
+		return err
+	})
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("Could not write archive: %v", err)
+	}
+	// Keep the archived files until the archive is in place, so they can
+	// be restored if anything fails.
+	aside := tmp.Name() + ".old"
+	if err := os.Rename(dir, aside); err != nil {
+		return fmt.Errorf("Could not move archived files: %v", err)
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		if restoreErr := os.Rename(aside, dir); restoreErr != nil {
+			return fmt.Errorf("Could not create node directory: %v. Could not "+
+				"restore %v from %v: %v", err, dir, aside, restoreErr)
+		}
+		return fmt.Errorf("Could not create node directory: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, archiveFile)); err != nil {
+		restoreErr := os.Remove(dir)
+		if restoreErr == nil {
+			restoreErr = os.Rename(aside, dir)
+		}
+		if restoreErr != nil {
+			return fmt.Errorf("Could not move archive: %v. Could not restore "+
+				"%v from %v: %v", err, dir, aside, restoreErr)
+		}
+		return fmt.Errorf("Could not move archive: %v", err)
+	}
+	if err := os.RemoveAll(aside); err != nil {
+		return fmt.Errorf("Node has been archived, but could not remove "+
+			"the archived files: %v", err)
+	}
+	return nil
+}
+
+type archiveFormData struct {
+	Confirm string
+}
+
+// Archive handles archive requests.
+func (h *nodeHandler) Archive(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	data := archiveFormData{}
+	form := htmlwidgets.NewForm(&data)
+	form.AddWidget(new(htmlwidgets.HiddenWidget), "Confirm", G("Confirm"), "")
+	switch c.Req.Method {
+	case "GET":
+		data.Confirm = "ok"
+	case "POST":
+		if err := c.Req.ParseForm(); err != nil {
+			return err
+		}
+		if form.Fill(c.Req.Form) && data.Confirm == "ok" {
+			// Archived nodes are read-only, so record the event first.
+			if err := recordNodeEvents(c, c.Node.Path, &service.NodeEvent{
+				Type: service.NodeArchivedEvent}); err != nil {
+				return err
+			}
+			if err := c.Serv.Monsti().ArchiveNode(c.Site.Name,
+				c.Node.Path); err != nil {
+				return fmt.Errorf("Could not archive node: %v", err)
+			}
+			http.Redirect(c.Res, c.Req, dirPath(c.Node.Path), http.StatusSeeOther)
+			return nil
+		}
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	body, err := h.Renderer.Render("actions/archiveform", template.Context{
+		"Form": form.RenderData(), "Node": c.Node},
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render node archive formular: %v", err)
+	}
+	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
+		Flags: EDIT_VIEW, Title: fmt.Sprintf(G("Archive \"%v\""), c.Node.Name())}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
@@ -0,0 +1,127 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestArchiveNode(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/news/node.json":                   `{"Type":"core.Document"}`,
+		"/news/2012/node.json":              `{"Type":"core.Document"}`,
+		"/news/2012/first/node.json":        `{"Type":"core.Document"}`,
+		"/news/2012/first/__file_core.File": "content",
+		"/news/2012/events/party/node.json": `{"Type":"core.Document"}`,
+		"/news/2013/node.json":              `{"Type":"core.Document"}`,
+	}, "TestArchiveNode")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	if err := archiveNode(root, "/"); err == nil {
+		t.Errorf("archiveNode should fail for the root node")
+	}
+	if err := archiveNode(root, "/news/2012"); err != nil {
+		t.Fatalf("archiveNode returned error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "news", "2012", "first")); err == nil {
+		t.Errorf("Archived files should have been removed")
+	}
+	if entries, err := ioutil.ReadDir(filepath.Join(root, "news")); err != nil ||
+		len(entries) != 3 {
+		t.Errorf("Archiving should leave no temporary files, got %v, %v",
+			entries, err)
+	}
+	if err := archiveNode(root, "/news/2012/first"); err == nil {
+		t.Errorf("archiveNode should fail for already archived nodes")
+	}
+
+	for _, nodePath := range []string{"/news/2012", "/news/2012/first",
+		"/news/2012/events/party"} {
+		node, err := getNode(root, nodePath)
+		if err != nil || node == nil {
+			t.Errorf("getNode(_, %q) = %s, %v, should find archived node",
+				nodePath, node, err)
+		}
+	}
+	if node, err := getNode(root, "/news/2012/unknown"); node != nil || err != nil {
+		t.Errorf("getNode for unknown archived node = %s, %v, should be nil, nil",
+			node, err)
+	}
+	content, err := readArchivedNodeFile(root, "/news/2012/first",
+		"__file_core.File")
+	if err != nil || string(content) != "content" {
+		t.Errorf(`readArchivedNodeFile(...) = %q, %v, should be "content", nil`,
+			content, err)
+	}
+	archive, _ := findArchive(root, "/news/2012")
+	files, err := listArchiveFiles(archive, "first")
+	if expected := []string{"__file_core.File", "node.json"}; err != nil ||
+		!reflect.DeepEqual(files, expected) {
+		t.Errorf("listArchiveFiles(_, %q) = %v, %v, should be %v", "first",
+			files, err, expected)
+	}
+
+	tests := []struct {
+		Path     string
+		Children []string
+	}{
+		{"/news", []string{
+			`{"Path":"/news/2012","Type":"core.Document"}`,
+			`{"Path":"/news/2013","Type":"core.Document"}`}},
+		{"/news/2012", []string{
+			`{"Path":"/news/2012/events","Type":"core.Path"}`,
+			`{"Path":"/news/2012/first","Type":"core.Document"}`}},
+		{"/news/2012/events", []string{
+			`{"Path":"/news/2012/events/party","Type":"core.Document"}`}},
+	}
+	for _, test := range tests {
+		children, err := getChildren(root, test.Path)
+		if err != nil {
+			t.Errorf("getChildren(_, %q) returned error: %v", test.Path, err)
+			continue
+		}
+		if len(children) != len(test.Children) {
+			t.Errorf("getChildren(_, %q) = %s, should be %v", test.Path, children,
+				test.Children)
+			continue
+		}
+		for i := range children {
+			if string(children[i]) != test.Children[i] {
+				t.Errorf("getChildren(_, %q)[%v] = %s, should be %v", test.Path, i,
+					children[i], test.Children[i])
+			}
+		}
+	}
+
+	if err := checkNotArchived(root, "/news/2012/first", true); err == nil {
+		t.Errorf("checkNotArchived should fail for nodes below archived nodes")
+	}
+	if err := checkNotArchived(root, "/news/2012", true); err != nil {
+		t.Errorf("checkNotArchived should allow the archived node: %v", err)
+	}
+	if err := checkNotArchived(root, "/news/2013", false); err != nil {
+		t.Errorf("checkNotArchived should allow not archived nodes: %v", err)
+	}
+}
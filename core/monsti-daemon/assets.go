@@ -0,0 +1,312 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2013 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	htmlT "html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// assetsPrefix is the URL path below which fingerprinted assets are
+// served, e.g. "/assets/0123456789ab/css/site.css".
+const assetsPrefix = "/assets/"
+
+// assetOptions configure how the assets of a site get built.
+type assetOptions struct {
+	// Minify removes comments and superfluous white space from CSS and
+	// JavaScript assets.
+	Minify bool
+	// Bundles maps names of assets to the files they concatenate, e.g.
+	// "js/all.js" to ["js/jquery.min.js", "js/site.js"].
+	Bundles map[string][]string
+}
+
+// getAssetOptions returns the asset options of the site, configured
+// in the core.assets section by minify and bundles.
+func getAssetOptions(s *service.Session, site string) (*assetOptions, error) {
+	options := new(assetOptions)
+	if err := s.Monsti().GetSiteConfig(site, "core.assets", options); err != nil {
+		return nil, fmt.Errorf("Could not get asset options: %v", err)
+	}
+	return options, nil
+}
+
+// asset is a built asset.
+type asset struct {
+	Content []byte
+	// Hash is the fingerprint of the content.
+	Hash string
+	// ModTime is the latest modification time of the asset's files.
+	ModTime time.Time
+	// key identifies the files and options the asset has been built
+	// from.
+	key string
+}
+
+// assetStore builds and caches the assets of a site.
+type assetStore struct {
+	// Dirs are searched in order for asset files, e.g. the site's
+	// statics followed by the global statics.
+	Dirs  []string
+	mutex sync.Mutex
+	cache map[string]*asset
+}
+
+// findFile returns the path to the named file in the first directory
+// containing it and its modification time. Returns an empty path if
+// no directory contains the file.
+func (s *assetStore) findFile(name string) (string, time.Time, error) {
+	for _, dir := range s.Dirs {
+		filePath := filepath.Join(dir, filepath.FromSlash(name))
+		info, err := os.Stat(filePath)
+		if err == nil && !info.IsDir() {
+			return filePath, info.ModTime(), nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return "", time.Time{}, err
+		}
+	}
+	return "", time.Time{}, nil
+}
+
+// Get returns the named asset. Returns nil if any of the asset's files
+// does not exist.
+//
+// The asset gets rebuilt if one of its files has been changed.
+func (s *assetStore) Get(name string, options *assetOptions) (*asset, error) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	files := options.Bundles[name]
+	if len(files) == 0 {
+		files = []string{name}
+	}
+	paths := make([]string, len(files))
+	var modTime time.Time
+	key := fmt.Sprintf("%v", options.Minify)
+	for i, file := range files {
+		filePath, fileTime, err := s.findFile(strings.TrimPrefix(
+			path.Clean("/"+file), "/"))
+		if err != nil {
+			return nil, fmt.Errorf("Could not find asset file %q: %v", file, err)
+		}
+		if filePath == "" {
+			return nil, nil
+		}
+		if fileTime.After(modTime) {
+			modTime = fileTime
+		}
+		paths[i] = filePath
+		key += fmt.Sprintf(" %v@%v", filePath, fileTime.UnixNano())
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if cached, ok := s.cache[name]; ok && cached.key == key {
+		return cached, nil
+	}
+	var content bytes.Buffer
+	for _, filePath := range paths {
+		fileContent, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read asset file: %v", err)
+		}
+		if content.Len() > 0 {
+			content.WriteString("\n")
+		}
+		content.Write(fileContent)
+	}
+	ret := &asset{Content: content.Bytes(), ModTime: modTime, key: key}
+	if options.Minify {
+		ret.Content = minifyAsset(name, ret.Content)
+	}
+	sum := sha1.Sum(ret.Content)
+	ret.Hash = hex.EncodeToString(sum[:6])
+	if s.cache == nil {
+		s.cache = make(map[string]*asset)
+	}
+	s.cache[name] = ret
+	return ret, nil
+}
+
+var (
+	cssCommentRegexp    = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	cssWhitespaceRegexp = regexp.MustCompile(`\s+`)
+	cssPunctuationRegexp = regexp.MustCompile(`\s*([{};,])\s*`)
+)
+
+// minifyAsset removes comments and superfluous white space from CSS
+// and JavaScript assets. Other assets are returned unchanged.
+//
+// JavaScript only gets its lines trimmed and empty lines removed to
+// not change the meaning of the code.
+func minifyAsset(name string, content []byte) []byte {
+	switch path.Ext(name) {
+	case ".css":
+		content = cssCommentRegexp.ReplaceAll(content, nil)
+		content = cssWhitespaceRegexp.ReplaceAll(content, []byte(" "))
+		content = cssPunctuationRegexp.ReplaceAll(content, []byte("$1"))
+		content = bytes.Replace(content, []byte(";}"), []byte("}"), -1)
+		return bytes.TrimSpace(content)
+	case ".js":
+		lines := bytes.Split(content, []byte("\n"))
+		ret := make([][]byte, 0, len(lines))
+		for _, line := range lines {
+			if line = bytes.TrimSpace(line); len(line) > 0 {
+				ret = append(ret, line)
+			}
+		}
+		return bytes.Join(ret, []byte("\n"))
+	}
+	return content
+}
+
+// assetURL returns the fingerprinted URL of the asset.
+func assetURL(name string, a *asset) string {
+	return assetsPrefix + a.Hash + "/" + strings.TrimPrefix(
+		path.Clean("/"+name), "/")
+}
+
+// splitAssetPath returns the fingerprint and name of the asset
+// given by the URL path. Returns an empty name for invalid paths.
+func splitAssetPath(urlPath string) (string, string) {
+	if !strings.HasPrefix(urlPath, assetsPrefix) {
+		return "", ""
+	}
+	parts := strings.SplitN(urlPath[len(assetsPrefix):], "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", ""
+	}
+	return parts[0], strings.TrimPrefix(path.Clean("/"+parts[1]), "/")
+}
+
+var (
+	// assetStores holds the asset stores of the sites.
+	assetStores      = make(map[string]*assetStore)
+	assetStoresMutex sync.Mutex
+)
+
+// getAssetStore returns the asset store of the given site. Assets are
+// searched in the site's, its theme's and the global statics. Assets of
+// an empty site are only searched in the global statics.
+func getAssetStore(settings *settings, site string) *assetStore {
+	assetStoresMutex.Lock()
+	defer assetStoresMutex.Unlock()
+	if store, ok := assetStores[site]; ok {
+		return store
+	}
+	store := &assetStore{Dirs: []string{settings.Monsti.GetStaticsPath()}}
+	if theme := settings.Monsti.Sites[site].Theme; theme != "" {
+		store.Dirs = append([]string{filepath.Join(
+			settings.Monsti.GetThemePath(theme), "static")}, store.Dirs...)
+	}
+	if site != "" {
+		store.Dirs = append([]string{settings.Monsti.GetSiteStaticsPath(site)},
+			store.Dirs...)
+	}
+	assetStores[site] = store
+	return store
+}
+
+// assetFuncs returns the template functions to link assets of the
+// given site. The site's asset options get fetched once on first use.
+func assetFuncs(settings *settings, site string,
+	s *service.Session) htmlT.FuncMap {
+	var options *assetOptions
+	store := getAssetStore(settings, site)
+	return htmlT.FuncMap{
+		// asset returns the fingerprinted URL of the named asset or an
+		// empty string if the asset does not exist.
+		"asset": func(name string) (string, error) {
+			if options == nil {
+				var err error
+				if options, err = getAssetOptions(s, site); err != nil {
+					return "", err
+				}
+			}
+			a, err := store.Get(name, options)
+			if err != nil || a == nil {
+				return "", err
+			}
+			return assetURL(name, a), nil
+		},
+	}
+}
+
+// assetHandler serves the assets of a site.
+type assetHandler struct {
+	Settings *settings
+	// Site is the name of the site or empty to serve the global
+	// statics.
+	Site     string
+	Sessions *service.SessionPool
+	Log      *log.Logger
+}
+
+// ServeHTTP serves the requested asset. Assets requested with their
+// current fingerprint may be cached forever.
+func (h *assetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hash, name := splitAssetPath(r.URL.Path)
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+	options := new(assetOptions)
+	if h.Site != "" {
+		session, err := h.Sessions.New()
+		if err != nil {
+			h.Log.Printf("Could not get session: %v", err)
+			http.Error(w, "Application error.", http.StatusInternalServerError)
+			return
+		}
+		defer h.Sessions.Free(session)
+		if options, err = getAssetOptions(session, h.Site); err != nil {
+			h.Log.Printf("(%v) %v", h.Site, err)
+			http.Error(w, "Application error.", http.StatusInternalServerError)
+			return
+		}
+	}
+	a, err := getAssetStore(h.Settings, h.Site).Get(name, options)
+	if err != nil {
+		h.Log.Printf("(%v) Could not get asset %q: %v", h.Site, name, err)
+		http.Error(w, "Application error.", http.StatusInternalServerError)
+		return
+	}
+	if a == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if hash == a.Hash {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("ETag", `"`+a.Hash+`"`)
+	http.ServeContent(w, r, name, a.ModTime, bytes.NewReader(a.Content))
+}
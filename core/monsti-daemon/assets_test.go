@@ -0,0 +1,146 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2013 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestAssetStore(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/site/css/site.css":   "body {\n  color: red; /* red */\n}\n",
+		"/site/js/site.js":     "  foo();\n\n  bar();\n",
+		"/global/css/site.css": "global",
+		"/global/js/base.js":   "base();"}, "_monsti_TestAssetStore")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	store := &assetStore{Dirs: []string{filepath.Join(root, "site"),
+		filepath.Join(root, "global")}}
+	options := &assetOptions{Bundles: map[string][]string{
+		"js/all.js": {"js/base.js", "js/site.js"}}}
+	tests := []struct {
+		Name    string
+		Minify  bool
+		Content string
+	}{
+		{"css/site.css", false, "body {\n  color: red; /* red */\n}\n"},
+		{"/css/../css/site.css", true, "body{color: red}"},
+		{"js/all.js", false, "base();\n  foo();\n\n  bar();\n"},
+		{"js/all.js", true, "base();\nfoo();\nbar();"},
+		{"js/base.js", false, "base();"},
+	}
+	for i, test := range tests {
+		options.Minify = test.Minify
+		ret, err := store.Get(test.Name, options)
+		if err != nil || ret == nil {
+			t.Errorf("Test %v: Get(%q) = %v, %v, should return asset", i,
+				test.Name, ret, err)
+			continue
+		}
+		if string(ret.Content) != test.Content {
+			t.Errorf("Test %v: Content of %q is %q, should be %q", i, test.Name,
+				ret.Content, test.Content)
+		}
+	}
+	if ret, err := store.Get("css/missing.css", options); ret != nil || err != nil {
+		t.Errorf("Get of missing asset = %v, %v, should be nil, nil", ret, err)
+	}
+	options.Minify = false
+	before, _ := store.Get("css/site.css", options)
+	filePath := filepath.Join(root, "site", "css", "site.css")
+	if err := ioutil.WriteFile(filePath, []byte("body {}"), 0600); err != nil {
+		t.Fatalf("Could not write asset file: %v", err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filePath, later, later); err != nil {
+		t.Fatalf("Could not change modification time: %v", err)
+	}
+	after, _ := store.Get("css/site.css", options)
+	if string(after.Content) != "body {}" || after.Hash == before.Hash {
+		t.Errorf("Changed asset should get rebuilt with a new fingerprint")
+	}
+}
+
+func TestSplitAssetPath(t *testing.T) {
+	tests := []struct {
+		Path, Hash, Name string
+	}{
+		{"/assets/0123/css/site.css", "0123", "css/site.css"},
+		{"/assets/0123/../../etc/passwd", "0123", "etc/passwd"},
+		{"/assets/0123/", "", ""},
+		{"/assets/0123", "", ""},
+		{"/static/css/site.css", "", ""},
+	}
+	for i, test := range tests {
+		hash, name := splitAssetPath(test.Path)
+		if hash != test.Hash || name != test.Name {
+			t.Errorf("Test %v: splitAssetPath(%q) = %q, %q, should be %q, %q", i,
+				test.Path, hash, name, test.Hash, test.Name)
+		}
+	}
+}
+
+func TestAssetHandler(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/share/static/css/monsti.css": "body {}"}, "_monsti_TestAssetHandler")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	settings := new(settings)
+	settings.Monsti.Directories.Share = filepath.Join(root, "share")
+	handler := &assetHandler{Settings: settings}
+	a, err := getAssetStore(settings, "").Get("css/monsti.css",
+		new(assetOptions))
+	if err != nil || a == nil {
+		t.Fatalf("Could not get asset: %v", err)
+	}
+	tests := []struct {
+		Path, CacheControl string
+		Code               int
+	}{
+		{assetURL("css/monsti.css", a), "public, max-age=31536000, immutable",
+			http.StatusOK},
+		{"/assets/outdated/css/monsti.css", "no-cache", http.StatusOK},
+		{"/assets/outdated/css/missing.css", "", http.StatusNotFound},
+	}
+	for i, test := range tests {
+		req, _ := http.NewRequest("GET", test.Path, nil)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		if res.Code != test.Code ||
+			res.Header().Get("Cache-Control") != test.CacheControl {
+			t.Errorf("Test %v: Got %v with Cache-Control %q, should be %v and %q",
+				i, res.Code, res.Header().Get("Cache-Control"), test.Code,
+				test.CacheControl)
+		}
+		if ret := res.Header().Get("Content-Type"); test.Code == http.StatusOK &&
+			ret != "text/css; charset=utf-8" {
+			t.Errorf("Test %v: Content-Type is %q, should be text/css", i, ret)
+		}
+	}
+}
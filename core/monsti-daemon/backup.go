@@ -0,0 +1,191 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"pkg.monsti.org/monsti/api/util/s3"
+	"pkg.monsti.org/monsti/api/util/sites"
+)
+
+// backupSettings configures the scheduled backups of all sites.
+type backupSettings struct {
+	// Interval between the backups, e.g. "24h". Empty or zero disables
+	// the backups.
+	Interval string
+	// Directory holds the backups, one directory per site. Defaults to
+	// .backups in the data directory.
+	Directory string
+	// FullInterval is the time between full backups, e.g. "168h".
+	// Backups in between are incremental. Defaults to one week.
+	FullInterval string
+	// Dailies and Weeklies are the number of days and weeks for which
+	// the latest backup is kept. Default to 7 and 4.
+	Dailies, Weeklies int
+	// S3 optionally uploads the backups to an S3 compatible storage.
+	// The credentials are read from the environment variables
+	// MONSTI_BACKUP_ACCESS_KEY and MONSTI_BACKUP_SECRET_KEY.
+	S3 struct {
+		// Endpoint is the URL of the storage. Defaults to
+		// "https://s3.amazonaws.com".
+		Endpoint string
+		// Region defaults to "us-east-1".
+		Region string
+		// Bucket to upload to. Empty disables the upload.
+		Bucket string
+		// Prefix is prepended to the keys, which are <site>/<backup>.
+		Prefix string
+	}
+}
+
+// backupDir returns the directory holding the backups of the site.
+func (s *backupSettings) backupDir(settings *settings, site string) string {
+	dir := s.Directory
+	if dir == "" {
+		dir = filepath.Join(settings.Monsti.Directories.Data, ".backups")
+	}
+	return filepath.Join(dir, site)
+}
+
+// store returns the S3 store backups get uploaded to or nil if
+// uploads are disabled.
+func (s *backupSettings) store() *s3.Store {
+	if s.S3.Bucket == "" {
+		return nil
+	}
+	store := &s3.Store{
+		Endpoint:  s.S3.Endpoint,
+		Region:    s.S3.Region,
+		Bucket:    s.S3.Bucket,
+		AccessKey: os.Getenv("MONSTI_BACKUP_ACCESS_KEY"),
+		SecretKey: os.Getenv("MONSTI_BACKUP_SECRET_KEY")}
+	if store.Endpoint == "" {
+		store.Endpoint = "https://s3.amazonaws.com"
+	}
+	if store.Region == "" {
+		store.Region = "us-east-1"
+	}
+	return store
+}
+
+// recordChanges records the changed nodes of the site in the change
+// journal used by incremental backups.
+func (i *MonstiService) recordChanges(site string, tree bool,
+	nodePaths ...string) error {
+	changes := make([]sites.Change, 0, len(nodePaths))
+	now := time.Now().UTC()
+	for _, nodePath := range nodePaths {
+		changes = append(changes, sites.Change{Time: now, Path: nodePath,
+			Tree: tree})
+	}
+	return sites.RecordChanges(&i.Settings.Monsti, site, changes...)
+}
+
+// backupSite writes a backup of the site, uploads it if configured
+// and removes expired backups.
+func backupSite(settings *settings, site string, fullInterval time.Duration,
+	now time.Time) (*sites.BackupInfo, error) {
+	config := &settings.Backup
+	dir := config.backupDir(settings, site)
+	backups, err := sites.Backups(dir)
+	if err != nil {
+		return nil, err
+	}
+	full := true
+	for _, backup := range backups {
+		if backup.Full && now.Sub(backup.Created) < fullInterval {
+			full = false
+		}
+	}
+	nodesMutex.Lock()
+	backup, err := sites.Backup(&settings.Monsti, site, dir, full, now)
+	nodesMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	store := config.store()
+	prefix := config.S3.Prefix + site + "/"
+	if store != nil {
+		content, err := ioutil.ReadFile(filepath.Join(dir, backup.Name))
+		if err != nil {
+			return nil, fmt.Errorf("Could not read backup: %v", err)
+		}
+		if err := store.Put(prefix+backup.Name, content); err != nil {
+			return nil, fmt.Errorf("Could not upload backup: %v", err)
+		}
+	}
+	dailies, weeklies := config.Dailies, config.Weeklies
+	if dailies <= 0 {
+		dailies = 7
+	}
+	if weeklies <= 0 {
+		weeklies = 4
+	}
+	for _, expired := range sites.ExpiredBackups(append(backups, backup),
+		dailies, weeklies) {
+		if err := os.Remove(filepath.Join(dir, expired.Name)); err != nil {
+			return nil, fmt.Errorf("Could not remove backup: %v", err)
+		}
+		if store != nil {
+			if err := store.Delete(prefix + expired.Name); err != nil {
+				return nil, fmt.Errorf("Could not remove uploaded backup: %v", err)
+			}
+		}
+	}
+	return backup, nil
+}
+
+// scheduleBackups periodically backs up all sites according to the
+// configured interval.
+func scheduleBackups(settings *settings, logger *log.Logger) {
+	if settings.Backup.Interval == "" {
+		return
+	}
+	interval, err := time.ParseDuration(settings.Backup.Interval)
+	if err != nil {
+		logger.Printf("Invalid backup interval: %v", err)
+		return
+	}
+	fullInterval := 7 * 24 * time.Hour
+	if settings.Backup.FullInterval != "" {
+		fullInterval, err = time.ParseDuration(settings.Backup.FullInterval)
+		if err != nil {
+			logger.Printf("Invalid full backup interval: %v", err)
+			return
+		}
+	}
+	if interval <= 0 {
+		return
+	}
+	for {
+		for site := range settings.Monsti.Sites {
+			backup, err := backupSite(settings, site, fullInterval, time.Now())
+			if err != nil {
+				logger.Printf("Could not back up site %q: %v", site, err)
+				continue
+			}
+			logger.Printf("Backed up site %q to %v", site, backup.Name)
+		}
+		time.Sleep(interval)
+	}
+}
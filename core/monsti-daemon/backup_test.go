@@ -0,0 +1,85 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+	"pkg.monsti.org/monsti/api/util/sites"
+)
+
+func TestBackupSite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-backup")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := MonstiService{Settings: new(settings),
+		Logger: log.New(ioutil.Discard, "", 0)}
+	m.Settings.Monsti.Directories.Config = filepath.Join(dir, "config")
+	m.Settings.Monsti.Directories.Data = filepath.Join(dir, "data")
+	m.Settings.Monsti.Sites = map[string]util.SiteSettings{"foo": {}}
+	m.Settings.Backup.Dailies, m.Settings.Backup.Weeklies = 2, 1
+	if err := sites.Create(&m.Settings.Monsti, &service.NewSite{Name: "foo",
+		Hosts: []string{"example.com"}, AdminPassword: "secret"}); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	week := 7 * 24 * time.Hour
+	start := time.Date(2015, 3, 2, 3, 0, 0, 0, time.UTC)
+	if backup, err := backupSite(m.Settings, "foo", week, start); err != nil ||
+		!backup.Full {
+		t.Fatalf("First backup is %v, %v, should be full", backup, err)
+	}
+	if err := m.WriteNodeData(&WriteNodeDataArgs{Site: "foo", Path: "/about",
+		File: "node.json", Content: []byte("{}")}, new(int)); err != nil {
+		t.Fatalf("WriteNodeData returned error: %v", err)
+	}
+	for day := 1; day < 10; day++ {
+		backup, err := backupSite(m.Settings, "foo", week,
+			start.Add(time.Duration(day)*24*time.Hour))
+		if err != nil {
+			t.Fatalf("backupSite returned error: %v", err)
+		}
+		if backup.Full != (day == 7) {
+			t.Errorf("Backup of day %v is %v, full should be %v", day, backup,
+				day == 7)
+		}
+	}
+	backups, err := sites.Backups(m.Settings.Backup.backupDir(m.Settings, "foo"))
+	// The full backup of day 7 and the incremental ones based on it are
+	// kept.
+	if err != nil || len(backups) != 3 || !backups[0].Full {
+		t.Fatalf("Backups returned %v, %v, should be 3 backups", backups, err)
+	}
+	if err := sites.Restore(&m.Settings.Monsti, filepath.Join(
+		m.Settings.Backup.backupDir(m.Settings, "foo"), backups[2].Name),
+		"restored"); err != nil {
+		t.Fatalf("Restore returned error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(
+		m.Settings.Monsti.GetSiteNodesPath("restored"), "about",
+		"node.json")); err != nil {
+		t.Errorf("Changed node has not been restored: %v", err)
+	}
+}
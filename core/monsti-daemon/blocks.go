@@ -0,0 +1,460 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	htmlT "html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// blockTypes are the types of blocks.
+var blockTypes = []string{"text", "image", "embed", "listing"}
+
+// defaultRegions are the regions of the master template, offered by
+// the block editor.
+var defaultRegions = []string{"sidebar", "footer"}
+
+// regionNameRegexp matches valid names of regions.
+var regionNameRegexp = regexp.MustCompile(`^[-\w]{1,64}$`)
+
+// blockIdRegexp matches valid ids of blocks.
+var blockIdRegexp = regexp.MustCompile(`^[0-9a-f]{8}$`)
+
+// blockImageSizes is the sizes attribute of images of image blocks.
+const blockImageSizes = "(max-width: 40em) 100vw, 20em"
+
+// blocksMutex serializes access to the blocks of sites.
+var blocksMutex sync.Mutex
+
+// blocksPath returns the path to the blocks inside the given site data
+// directory.
+func blocksPath(dataDir string) string {
+	return filepath.Join(dataDir, "blocks.json")
+}
+
+// readBlocks returns the blocks of the given site data directory in
+// the order they are shown.
+func readBlocks(dataDir string) ([]*service.Block, error) {
+	blocks := make([]*service.Block, 0)
+	content, err := ioutil.ReadFile(blocksPath(dataDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return blocks, nil
+		}
+		return nil, fmt.Errorf("Could not read blocks: %v", err)
+	}
+	if err := json.Unmarshal(content, &blocks); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal blocks: %v", err)
+	}
+	return blocks, nil
+}
+
+// updateBlocks replaces the blocks of the given site data directory
+// by the ones returned by the update function, which gets the current
+// blocks.
+func updateBlocks(dataDir string,
+	update func([]*service.Block) []*service.Block) error {
+	blocksMutex.Lock()
+	defer blocksMutex.Unlock()
+	blocks, err := readBlocks(dataDir)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(update(blocks))
+	if err != nil {
+		return fmt.Errorf("Could not marshal blocks: %v", err)
+	}
+	if err := ioutil.WriteFile(blocksPath(dataDir), content, 0600); err != nil {
+		return fmt.Errorf("Could not write blocks: %v", err)
+	}
+	return nil
+}
+
+// saveBlock replaces the block with the same id or appends it if there
+// is no such block.
+func saveBlock(blocks []*service.Block, block *service.Block) []*service.Block {
+	for i := range blocks {
+		if blocks[i].Id == block.Id {
+			blocks[i] = block
+			return blocks
+		}
+	}
+	return append(blocks, block)
+}
+
+// removeBlock returns the blocks without the one with the given id.
+func removeBlock(blocks []*service.Block, id string) []*service.Block {
+	kept := make([]*service.Block, 0, len(blocks))
+	for _, block := range blocks {
+		if block.Id != id {
+			kept = append(kept, block)
+		}
+	}
+	return kept
+}
+
+// orderBlocks returns the blocks ordered by the given ids. Blocks
+// missing in ids keep their relative order after the others.
+func orderBlocks(blocks []*service.Block, ids []string) []*service.Block {
+	byId := make(map[string]*service.Block, len(blocks))
+	for _, block := range blocks {
+		byId[block.Id] = block
+	}
+	ordered := make([]*service.Block, 0, len(blocks))
+	for _, id := range ids {
+		if block, ok := byId[id]; ok {
+			ordered = append(ordered, block)
+			delete(byId, id)
+		}
+	}
+	for _, block := range blocks {
+		if _, ok := byId[block.Id]; ok {
+			ordered = append(ordered, block)
+		}
+	}
+	return ordered
+}
+
+type GetBlocksArgs struct{ Site string }
+
+func (i *MonstiService) GetBlocks(args *GetBlocksArgs,
+	reply *[]*service.Block) error {
+	blocksMutex.Lock()
+	defer blocksMutex.Unlock()
+	blocks, err := readBlocks(i.Settings.Monsti.GetSiteDataPath(args.Site))
+	if err != nil {
+		return err
+	}
+	*reply = blocks
+	return nil
+}
+
+// blockShown returns true iff the block is shown on the node at the
+// given path.
+func blockShown(block *service.Block, nodePath string) bool {
+	if block.Node == "" || block.Node == nodePath {
+		return true
+	}
+	return block.Subtree && strings.HasPrefix(dirPath(nodePath),
+		dirPath(block.Node))
+}
+
+// blockView is a block as rendered by the blocks/block template.
+type blockView struct {
+	*service.Block
+	// Content is the HTML of text, embed and image blocks.
+	Content htmlT.HTML
+	// Links are the nodes listed by listing blocks.
+	Links navigation
+}
+
+// regionBlocks returns the blocks of the region shown on the node at
+// the given path.
+//
+// Image and listing blocks of missing nodes are skipped, as are those
+// of unpublished nodes if public is true. Titles of listed nodes are
+// shown in the given locale. imageFn renders the image nodes of image
+// blocks.
+func regionBlocks(blocks []*service.Block, region, nodePath, locale string,
+	public bool, getNodeFn getNodeFunc, getChildrenFn getChildrenFunc,
+	imageFn func(*service.Node) (htmlT.HTML, error)) ([]blockView, error) {
+	views := make([]blockView, 0)
+	now := time.Now()
+	for _, block := range blocks {
+		if block.Region != region || !blockShown(block, nodePath) {
+			continue
+		}
+		view := blockView{Block: block}
+		switch block.Type {
+		case "text", "embed":
+			view.Content = htmlT.HTML(block.Text)
+		case "image", "listing":
+			node, err := getNodeFn(block.Target)
+			if err != nil {
+				return nil, fmt.Errorf("Could not get block node: %v", err)
+			}
+			if node == nil || (public && !isPublished(node, now)) {
+				continue
+			}
+			if block.Type == "image" {
+				if node.Type == nil || node.Type.Id != "core.Image" {
+					continue
+				}
+				if view.Content, err = imageFn(node); err != nil {
+					return nil, fmt.Errorf("Could not render block image: %v", err)
+				}
+				break
+			}
+			children, err := getChildrenFn(node.Path)
+			if err != nil {
+				return nil, fmt.Errorf("Could not get listed nodes: %v", err)
+			}
+			view.Links, err = childLinks(children, "", block.Limit, locale,
+				public, now)
+			if err != nil {
+				return nil, err
+			}
+			if len(view.Links) == 0 {
+				continue
+			}
+		default:
+			continue
+		}
+		views = append(views, view)
+	}
+	return views, nil
+}
+
+// embedAllowlist returns the allowlist of embed blocks, which extends
+// the site's allowlist by iframes, e.g. of videos and maps. The site's
+// allowlist may be nil.
+func embedAllowlist(site *service.HTMLAllowlist) *service.HTMLAllowlist {
+	if site == nil {
+		site = new(service.HTMLAllowlist)
+	}
+	allowlist := &service.HTMLAllowlist{
+		Elements: append([]string{"iframe"}, site.Elements...),
+		Attributes: map[string][]string{"iframe": {"src", "width", "height",
+			"title", "allow", "allowfullscreen", "frameborder", "loading"}},
+		URLSchemes: site.URLSchemes}
+	for element, attrs := range site.Attributes {
+		allowlist.Attributes[element] = append(allowlist.Attributes[element],
+			attrs...)
+	}
+	return allowlist
+}
+
+// parseBlock returns the block given by the form values. The HTML of
+// text and embed blocks gets sanitized using the given site allowlist.
+//
+// The second return value holds translated messages about invalid
+// values.
+func parseBlock(form url.Values, G func(string) string,
+	allowlist *service.HTMLAllowlist, getNodeFn getNodeFunc) (
+	*service.Block, []string, error) {
+	block := &service.Block{
+		Type:    form.Get("Type"),
+		Title:   strings.TrimSpace(form.Get("Title")),
+		Region:  strings.TrimSpace(form.Get("Region")),
+		Subtree: form.Get("Subtree") != ""}
+	if !stringInSlice(block.Type, blockTypes) {
+		return nil, nil, fmt.Errorf("Unknown block type: %q", block.Type)
+	}
+	var problems []string
+	if !regionNameRegexp.MatchString(block.Region) {
+		problems = append(problems, G("Invalid region name."))
+	}
+	// node returns the path of the node given by the form value or
+	// adds a problem if there is no such node.
+	node := func(key string) (string, error) {
+		value := strings.TrimSpace(form.Get(key))
+		if value == "" {
+			return "", nil
+		}
+		node, err := getNodeFn(path.Clean("/" + value))
+		if err != nil {
+			return "", fmt.Errorf("Could not get block node: %v", err)
+		}
+		if node == nil {
+			problems = append(problems, fmt.Sprintf(
+				G("The node %q does not exist."), value))
+			return "", nil
+		}
+		return node.Path, nil
+	}
+	var err error
+	if block.Node, err = node("Node"); err != nil {
+		return nil, nil, err
+	}
+	if block.Node == "" {
+		block.Subtree = false
+	}
+	switch block.Type {
+	case "text", "embed":
+		if block.Type == "text" {
+			block.Text = service.SanitizeHTML(form.Get("Text"), allowlist)
+		} else {
+			block.Text = service.SanitizeHTML(form.Get("Text"),
+				embedAllowlist(allowlist))
+		}
+		if strings.TrimSpace(block.Text) == "" {
+			problems = append(problems, G("The block has no content."))
+		}
+	case "image", "listing":
+		if block.Target, err = node("Target"); err != nil {
+			return nil, nil, err
+		}
+		if block.Target == "" && strings.TrimSpace(form.Get("Target")) == "" {
+			problems = append(problems, G("Please choose a node."))
+		}
+		if block.Type == "listing" && form.Get("Limit") != "" {
+			limit, err := strconv.Atoi(form.Get("Limit"))
+			if err != nil || limit < 0 {
+				problems = append(problems, G("Invalid number of listed nodes."))
+			}
+			block.Limit = limit
+		}
+	}
+	return block, problems, nil
+}
+
+// newBlockId returns a random id for a new block.
+func newBlockId() (string, error) {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("Could not generate block id: %v", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Blocks lists, orders and removes the blocks of the site and edits
+// the block given by the form value "block". The value "new" adds a
+// block of the type given by the form value "Type".
+func (h *nodeHandler) Blocks(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if err := c.Req.ParseForm(); err != nil {
+		return err
+	}
+	dataDir := h.Settings.Monsti.GetSiteDataPath(c.Site.Name)
+	id := c.Req.Form.Get("block")
+	if id != "" && id != "new" && !blockIdRegexp.MatchString(id) {
+		return fmt.Errorf("Invalid block id: %q", id)
+	}
+	blocks, err := c.Serv.Monsti().GetBlocks(c.Site.Name)
+	if err != nil {
+		return fmt.Errorf("Could not get blocks: %v", err)
+	}
+	var block *service.Block
+	for _, b := range blocks {
+		if b.Id == id {
+			block = b
+		}
+	}
+	if id != "" && id != "new" && block == nil {
+		return fmt.Errorf("Unknown block: %q", id)
+	}
+	context := template.Context{}
+	switch c.Req.Method {
+	case "GET":
+		_, saved := c.Req.Form["saved"]
+		context["Saved"] = saved
+		if id == "new" {
+			block = &service.Block{Type: c.Req.Form.Get("Type"),
+				Region: defaultRegions[0]}
+			if !stringInSlice(block.Type, blockTypes) {
+				return fmt.Errorf("Unknown block type: %q", block.Type)
+			}
+		}
+	case "POST":
+		var update func([]*service.Block) []*service.Block
+		switch {
+		case c.Req.Form.Get("Remove") != "":
+			remove := c.Req.Form.Get("Remove")
+			update = func(blocks []*service.Block) []*service.Block {
+				return removeBlock(blocks, remove)
+			}
+		case id == "":
+			order := c.Req.Form["Order"]
+			update = func(blocks []*service.Block) []*service.Block {
+				return orderBlocks(blocks, order)
+			}
+		default:
+			allowlist, err := getHTMLAllowlist(c.Serv, c.Site.Name)
+			if err != nil {
+				return err
+			}
+			getNodeFn := func(nodePath string) (*service.Node, error) {
+				return c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
+			}
+			parsed, problems, err := parseBlock(c.Req.Form, G, allowlist,
+				getNodeFn)
+			if err != nil {
+				return err
+			}
+			if len(problems) > 0 {
+				parsed.Id = id
+				block = parsed
+				context["Problems"] = problems
+				break
+			}
+			if block != nil {
+				parsed.Id = block.Id
+			} else if parsed.Id, err = newBlockId(); err != nil {
+				return err
+			}
+			update = func(blocks []*service.Block) []*service.Block {
+				return saveBlock(blocks, parsed)
+			}
+		}
+		if update == nil {
+			break
+		}
+		if err := updateBlocks(dataDir, update); err != nil {
+			return err
+		}
+		http.Redirect(c.Res, c.Req, "@@blocks?"+url.Values{
+			"saved": {""}}.Encode(), http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	regions := append([]string{}, defaultRegions...)
+	for _, b := range blocks {
+		if !stringInSlice(b.Region, regions) {
+			regions = append(regions, b.Region)
+		}
+	}
+	sort.Strings(regions[len(defaultRegions):])
+	context["Regions"] = regions
+	context["Blocks"] = blocks
+	if block != nil {
+		context["Block"] = block
+		context["BlockId"] = id
+	}
+	body, err := h.Renderer.Render("actions/blocks", context,
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render block editor: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("Blocks"),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
@@ -0,0 +1,180 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	htmlT "html/template"
+	"net/url"
+	"strings"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestBlockShown(t *testing.T) {
+	tests := []struct {
+		Block    service.Block
+		NodePath string
+		Shown    bool
+	}{
+		{service.Block{}, "/about", true},
+		{service.Block{Node: "/about"}, "/about", true},
+		{service.Block{Node: "/about"}, "/about/team", false},
+		{service.Block{Node: "/about", Subtree: true}, "/about/team", true},
+		{service.Block{Node: "/about", Subtree: true}, "/aboutus", false},
+		{service.Block{Node: "/", Subtree: true}, "/contact", true},
+	}
+	for _, test := range tests {
+		if shown := blockShown(&test.Block, test.NodePath); shown != test.Shown {
+			t.Errorf("blockShown(%v, %q) = %v, should be %v", test.Block,
+				test.NodePath, shown, test.Shown)
+		}
+	}
+}
+
+func TestRegionBlocks(t *testing.T) {
+	newNode := func(nodePath, title, typ string, public bool) *service.Node {
+		titleField := service.TextField(title)
+		return &service.Node{Path: nodePath, Public: public,
+			Type:   &service.NodeType{Id: typ},
+			Fields: map[string]service.Field{"core.Title": &titleField}}
+	}
+	nodes := map[string]*service.Node{
+		"/logo":  newNode("/logo", "Logo", "core.Image", true),
+		"/draft": newNode("/draft", "Draft", "core.Image", false),
+		"/news":  newNode("/news", "News", "core.Document", true),
+	}
+	children := []*service.Node{
+		newNode("/news/a", "A", "core.Document", true),
+		newNode("/news/b", "B", "core.Document", false),
+		newNode("/news/c", "C", "core.Document", true),
+		newNode("/news/d", "D", "core.Document", true),
+	}
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		return nodes[nodePath], nil
+	}
+	getChildrenFn := func(nodePath string) ([]*service.Node, error) {
+		if nodePath == "/news" {
+			return children, nil
+		}
+		return nil, nil
+	}
+	imageFn := func(node *service.Node) (htmlT.HTML, error) {
+		return htmlT.HTML("<img:" + node.Path + ">"), nil
+	}
+	blocks := []*service.Block{
+		{Id: "1", Type: "text", Region: "sidebar", Text: "<p>Hi</p>"},
+		{Id: "2", Type: "text", Region: "footer", Text: "<p>Footer</p>"},
+		{Id: "3", Type: "image", Region: "sidebar", Target: "/logo",
+			Node: "/about"},
+		{Id: "4", Type: "image", Region: "sidebar", Target: "/draft"},
+		{Id: "5", Type: "image", Region: "sidebar", Target: "/missing"},
+		{Id: "6", Type: "listing", Region: "sidebar", Target: "/news", Limit: 2},
+		{Id: "7", Type: "image", Region: "sidebar", Target: "/news"},
+	}
+	tests := []struct {
+		NodePath string
+		Public   bool
+		Blocks   string
+	}{
+		{"/about", true, "1:<p>Hi</p> 3:<img:/logo> 6:[A C]"},
+		{"/contact", true, "1:<p>Hi</p> 6:[A C]"},
+		{"/contact", false, "1:<p>Hi</p> 4:<img:/draft> 6:[A B]"},
+	}
+	for _, test := range tests {
+		views, err := regionBlocks(blocks, "sidebar", test.NodePath, "",
+			test.Public, getNodeFn, getChildrenFn, imageFn)
+		if err != nil {
+			t.Fatalf("regionBlocks returned error: %v", err)
+		}
+		var shown []string
+		for _, view := range views {
+			content := string(view.Content)
+			if view.Links != nil {
+				var names []string
+				for _, link := range view.Links {
+					names = append(names, link.Name)
+				}
+				content = fmt.Sprint(names)
+			}
+			shown = append(shown, view.Id+":"+content)
+		}
+		if strings.Join(shown, " ") != test.Blocks {
+			t.Errorf("regionBlocks(_, %q, %v) = %v, should be %v",
+				test.NodePath, test.Public, shown, test.Blocks)
+		}
+	}
+}
+
+func TestParseBlock(t *testing.T) {
+	G := func(in string) string { return in }
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		if nodePath == "/about" {
+			return &service.Node{Path: nodePath}, nil
+		}
+		return nil, nil
+	}
+	tests := []struct {
+		Form     url.Values
+		Block    service.Block
+		Problems int
+	}{
+		{url.Values{"Type": {"text"}, "Region": {"sidebar"},
+			"Text": {`<p onclick="x()">Hi</p><script>x()</script>`}},
+			service.Block{Type: "text", Region: "sidebar", Text: "<p>Hi</p>"}, 0},
+		{url.Values{"Type": {"embed"}, "Region": {"footer"}, "Node": {"about/"},
+			"Subtree": {"true"},
+			"Text":    {`<iframe src="https://example.com/map"></iframe>`}},
+			service.Block{Type: "embed", Region: "footer", Node: "/about",
+				Subtree: true,
+				Text:    `<iframe src="https://example.com/map"></iframe>`}, 0},
+		{url.Values{"Type": {"text"}, "Region": {"sidebar"},
+			"Text": {`<iframe src="https://example.com/map"></iframe>`}},
+			service.Block{Type: "text", Region: "sidebar"}, 1},
+		{url.Values{"Type": {"listing"}, "Region": {"side bar"},
+			"Target": {"/missing"}, "Limit": {"-1"}, "Subtree": {"true"}},
+			service.Block{Type: "listing", Region: "side bar", Limit: -1}, 3},
+		{url.Values{"Type": {"image"}, "Region": {"sidebar"}},
+			service.Block{Type: "image", Region: "sidebar"}, 1},
+	}
+	for _, test := range tests {
+		block, problems, err := parseBlock(test.Form, G, nil, getNodeFn)
+		if err != nil {
+			t.Fatalf("parseBlock(%v) returned error: %v", test.Form, err)
+		}
+		if *block != test.Block || len(problems) != test.Problems {
+			t.Errorf("parseBlock(%v) = %v, %v, should be %v with %v problems",
+				test.Form, *block, problems, test.Block, test.Problems)
+		}
+	}
+	if _, _, err := parseBlock(url.Values{"Type": {"unknown"}}, G, nil,
+		getNodeFn); err == nil {
+		t.Errorf("parseBlock should fail for unknown block types")
+	}
+}
+
+func TestOrderBlocks(t *testing.T) {
+	blocks := []*service.Block{{Id: "a"}, {Id: "b"}, {Id: "c"}, {Id: "d"}}
+	var ids []string
+	for _, block := range orderBlocks(blocks, []string{"c", "x", "a"}) {
+		ids = append(ids, block.Id)
+	}
+	if fmt.Sprint(ids) != "[c a b d]" {
+		t.Errorf("orderBlocks returned %v, should be [c a b d]", ids)
+	}
+}
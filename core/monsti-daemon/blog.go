@@ -23,11 +23,15 @@ package main
 
 import (
 	"fmt"
+	"html"
 	"log"
 	"net/url"
-
+	"path"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
+
 	"pkg.monsti.org/monsti/api/service"
 	"pkg.monsti.org/monsti/api/util"
 	mtemplate "pkg.monsti.org/monsti/api/util/template"
@@ -50,8 +54,94 @@ func (s *nodeSort) Less(i, j int) bool {
 	return s.Sorter(s.Nodes[i], s.Nodes[j])
 }
 
+// defaultBlogPageSize is the number of posts per page of blogs
+// without core.blog.pagesize setting.
+const defaultBlogPageSize = 10
+
+// blogPost is a blog post as listed on blog pages.
+type blogPost struct {
+	Node *service.Node
+	// Teaser is the post's teaser or, if it has none, the beginning of
+	// its body.
+	Teaser string
+	Tags   []string
+}
+
+// blogTag is a tag of a blog's archive.
+type blogTag struct {
+	Name string
+	// Count is the number of posts with the tag.
+	Count int
+}
+
+// blogMonth is a month of a blog's archive.
+type blogMonth struct {
+	// Time is the beginning of the month.
+	Time time.Time
+	// Count is the number of posts published in the month.
+	Count int
+}
+
+// Id returns the month in the format used by the blog's "month" query
+// parameter, e.g. "2014-03".
+func (m blogMonth) Id() string {
+	return m.Time.Format("2006-01")
+}
+
+// maxBlogTeaserLength is the number of characters of teasers taken
+// from the post's body.
+const maxBlogTeaserLength = 300
+
+// blogPostTags returns the tags of the post.
+func blogPostTags(post *service.Node) []string {
+	if field := post.GetField("core.Tags"); field != nil {
+		return splitTags(field.String())
+	}
+	return []string{}
+}
+
+// blogPostTeaser returns the teaser of the post. For posts without
+// teaser, the beginning of the post's body is returned.
+func blogPostTeaser(post *service.Node) string {
+	if field := post.GetField("core.Teaser"); field != nil &&
+		strings.TrimSpace(field.String()) != "" {
+		return strings.TrimSpace(field.String())
+	}
+	var text string
+	if field := post.GetField("core.Body"); field != nil {
+		text = html.UnescapeString(tagRegexp.ReplaceAllString(field.String(), " "))
+	}
+	return truncateWords(text, maxBlogTeaserLength)
+}
+
+// truncateWords returns the words of the text shortened to less than
+// the given number of characters. Shortened texts end with " …".
+func truncateWords(text string, length int) string {
+	truncated := ""
+	for _, word := range strings.Fields(text) {
+		if len([]rune(truncated))+len([]rune(word)) >= length {
+			return truncated + " …"
+		}
+		if truncated != "" {
+			truncated += " "
+		}
+		truncated += word
+	}
+	return truncated
+}
+
+// blogPathOfPost returns the path of the blog containing the post
+// with the given path, i.e. the path without the post's name and its
+// "$year/$month" prefix.
+func blogPathOfPost(postPath string) string {
+	return path.Dir(path.Dir(path.Dir(postPath)))
+}
+
+// getBlogPosts returns the posts of the given blog, pinned posts first
+// followed by the newest ones. If public is true, only published posts
+// are returned.
 func getBlogPosts(req *service.Request, blogPath string, s *service.Session,
-	limit int) ([]*service.Node, error) {
+	public bool, now time.Time) ([]*service.Node, error) {
 	var posts []*service.Node
 	years, err := s.Monsti().GetChildren(req.Site, blogPath)
 	if err != nil {
@@ -67,16 +157,164 @@ func getBlogPosts(req *service.Request, blogPath string, s *service.Session,
 			if err != nil {
 				return nil, fmt.Errorf("Could not fetch month children: %v", err)
 			}
-			posts = append(posts, monthPosts...)
+			for _, post := range monthPosts {
+				if post.Type != nil && post.Type.Id == "core.BlogPost" &&
+					(!public || isPublished(post, now)) {
+					posts = append(posts, post)
+				}
+			}
 		}
 	}
+	// Pinned posts first, then the newest posts.
 	order := func(left, right *service.Node) bool {
-		return left.PublishTime.Before(right.PublishTime)
+		if left.Pinned != right.Pinned {
+			return left.Pinned
+		}
+		return left.PublishTime.After(right.PublishTime)
 	}
-	sort.Sort(sort.Reverse(&nodeSort{posts, order}))
+	sort.Sort(&nodeSort{posts, order})
 	return posts, nil
 }
 
+// filterBlogPosts returns the posts having the given tag, if not
+// empty, and being published in the given month ("2006-01"), if not
+// empty. Pinned posts are only kept in their position if no filter is
+// given.
+func filterBlogPosts(posts []*service.Node, tag, month string,
+	location *time.Location) []*service.Node {
+	if tag == "" && month == "" {
+		return posts
+	}
+	ret := make([]*service.Node, 0)
+	for _, post := range posts {
+		if month != "" && post.PublishTime.In(location).Format("2006-01") != month {
+			continue
+		}
+		if tag != "" {
+			found := false
+			for _, postTag := range blogPostTags(post) {
+				found = found || strings.EqualFold(postTag, tag)
+			}
+			if !found {
+				continue
+			}
+		}
+		ret = append(ret, post)
+	}
+	sort.Sort(&nodeSort{ret, func(left, right *service.Node) bool {
+		return left.PublishTime.After(right.PublishTime)
+	}})
+	return ret
+}
+
+// getBlogArchive returns the months with posts, newest first, and the
+// tags of the posts, most used first.
+func getBlogArchive(posts []*service.Node, location *time.Location) (
+	[]blogMonth, []blogTag) {
+	months := make([]blogMonth, 0)
+	monthIndex := make(map[string]int)
+	tags := make([]blogTag, 0)
+	tagIndex := make(map[string]int)
+	for _, post := range posts {
+		published := post.PublishTime.In(location)
+		id := published.Format("2006-01")
+		if i, ok := monthIndex[id]; ok {
+			months[i].Count++
+		} else {
+			monthIndex[id] = len(months)
+			months = append(months, blogMonth{time.Date(published.Year(),
+				published.Month(), 1, 0, 0, 0, 0, location), 1})
+		}
+		for _, tag := range blogPostTags(post) {
+			key := strings.ToLower(tag)
+			if i, ok := tagIndex[key]; ok {
+				tags[i].Count++
+			} else {
+				tagIndex[key] = len(tags)
+				tags = append(tags, blogTag{tag, 1})
+			}
+		}
+	}
+	sort.Sort(blogMonthsByTime(months))
+	sort.Sort(blogTagsByCount(tags))
+	return months, tags
+}
+
+type blogMonthsByTime []blogMonth
+
+func (s blogMonthsByTime) Len() int      { return len(s) }
+func (s blogMonthsByTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s blogMonthsByTime) Less(i, j int) bool {
+	return s[i].Time.After(s[j].Time)
+}
+
+type blogTagsByCount []blogTag
+
+func (s blogTagsByCount) Len() int      { return len(s) }
+func (s blogTagsByCount) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s blogTagsByCount) Less(i, j int) bool {
+	return s[i].Count > s[j].Count ||
+		(s[i].Count == s[j].Count && s[i].Name < s[j].Name)
+}
+
+// paginate returns the posts of the given page (starting at 1) and the
+// number of pages. Pages out of range are moved into range.
+func paginate(posts []*service.Node, page, size int) (
+	[]*service.Node, int, int) {
+	pages := (len(posts) + size - 1) / size
+	if pages < 1 {
+		pages = 1
+	}
+	if page < 1 {
+		page = 1
+	} else if page > pages {
+		page = pages
+	}
+	start := (page - 1) * size
+	end := start + size
+	if end > len(posts) {
+		end = len(posts)
+	}
+	return posts[start:end], page, pages
+}
+
+// blogURL returns the URL of the blog with the given query values,
+// ignoring empty ones and the first page.
+func blogURL(blogPath string, values map[string]string) string {
+	query := make(url.Values)
+	for key, value := range values {
+		if value != "" && !(key == "page" && value == "1") {
+			query.Set(key, value)
+		}
+	}
+	ret := dirPath(blogPath)
+	if len(query) > 0 {
+		ret += "?" + query.Encode()
+	}
+	return ret
+}
+
+// getSiteLocation returns the configured time zone of the site.
+func getSiteLocation(s *service.Session, site string) (*time.Location,
+	error) {
+	var timezone string
+	if err := s.Monsti().GetSiteConfig(site, "core.timezone",
+		&timezone); err != nil {
+		return nil, fmt.Errorf("Could not get timezone: %v", err)
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	return location, nil
+}
+
+// getBlogContext renders the listing of blog posts.
+//
+// Posts may be filtered by the query parameters "tag" and "month"
+// ("2006-01"). Blog pages are paginated by the query parameter "page"
+// while embedded blogs show the number of posts given by the embed
+// URI's "limit" query parameter.
 func getBlogContext(reqId uint, embed *service.EmbedNode,
 	s *service.Session, settings *settings, renderer *mtemplate.Renderer) (
 	map[string]string, error) {
@@ -94,19 +332,67 @@ func getBlogContext(reqId uint, embed *service.EmbedNode,
 		query = embedUrl.Query()
 		blogPath = embedUrl.Path
 	}
-	limit := -1
-	if limitParam, err := strconv.Atoi(query.Get("limit")); err == nil {
-		limit = limitParam
-		if limit < 1 {
-			limit = 1
-		}
+	location, err := getSiteLocation(s, req.Site)
+	if err != nil {
+		return nil, err
 	}
-	context := mtemplate.Context{}
-	context["Embedded"] = embed
-	context["Posts"], err = getBlogPosts(req, blogPath, s, limit)
+	posts, err := getBlogPosts(req, blogPath, s, req.Session.User == nil,
+		time.Now())
 	if err != nil {
 		return nil, fmt.Errorf("Could not retrieve blog posts: %v", err)
 	}
+	context := mtemplate.Context{}
+	context["Embedded"] = embed
+	context["BlogPath"] = dirPath(blogPath)
+	tag, month := strings.TrimSpace(query.Get("tag")), query.Get("month")
+	if month != "" {
+		if monthTime, err := time.Parse("2006-01", month); err == nil {
+			context["Month"] = monthTime
+		} else {
+			month = ""
+		}
+	}
+	context["Tag"] = tag
+	filtered := filterBlogPosts(posts, tag, month, location)
+	if embed != nil {
+		if limit, err := strconv.Atoi(query.Get("limit")); err == nil &&
+			limit < len(filtered) {
+			if limit < 1 {
+				limit = 1
+			}
+			filtered = filtered[:limit]
+		}
+	} else {
+		size := defaultBlogPageSize
+		if err := s.Monsti().GetSiteConfig(req.Site, "core.blog.pagesize",
+			&size); err != nil {
+			return nil, fmt.Errorf("Could not get blog page size: %v", err)
+		}
+		if size < 1 {
+			size = defaultBlogPageSize
+		}
+		page, _ := strconv.Atoi(query.Get("page"))
+		var pages int
+		filtered, page, pages = paginate(filtered, page, size)
+		pageURL := func(page int) string {
+			return blogURL(blogPath, map[string]string{"tag": tag, "month": month,
+				"page": strconv.Itoa(page)})
+		}
+		if page > 1 {
+			context["PreviousPage"] = pageURL(page - 1)
+		}
+		if page < pages {
+			context["NextPage"] = pageURL(page + 1)
+		}
+		context["Page"], context["Pages"] = page, pages
+		context["Months"], context["Tags"] = getBlogArchive(posts, location)
+	}
+	entries := make([]blogPost, 0, len(filtered))
+	for _, post := range filtered {
+		entries = append(entries, blogPost{post, blogPostTeaser(post),
+			blogPostTags(post)})
+	}
+	context["Posts"] = entries
 	rendered, err := renderer.Render("core/blogpost-list", context,
 		req.Session.Locale, settings.Monsti.GetSiteTemplatesPath(req.Site))
 	if err != nil {
@@ -115,6 +401,29 @@ func getBlogContext(reqId uint, embed *service.EmbedNode,
 	return map[string]string{"BlogPosts": rendered}, nil
 }
 
+// getBlogPostContext renders the publish date and the tags of the
+// requested blog post.
+func getBlogPostContext(reqId uint, s *service.Session, settings *settings,
+	renderer *mtemplate.Renderer) (map[string]string, error) {
+	req, err := s.Monsti().GetRequest(reqId)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get request: %v", err)
+	}
+	post, err := s.Monsti().GetNode(req.Site, req.NodePath)
+	if err != nil || post == nil {
+		return nil, fmt.Errorf("Could not get blog post: %v", err)
+	}
+	context := mtemplate.Context{
+		"BlogPath": dirPath(blogPathOfPost(post.Path)),
+		"Post":     blogPost{post, "", blogPostTags(post)}}
+	rendered, err := renderer.Render("core/blogpost-meta", context,
+		req.Session.Locale, settings.Monsti.GetSiteTemplatesPath(req.Site))
+	if err != nil {
+		return nil, fmt.Errorf("Could not render template: %v", err)
+	}
+	return map[string]string{"BlogPostMeta": rendered}, nil
+}
+
 func initBlog(settings *settings, session *service.Session, logger *log.Logger,
 	renderer *mtemplate.Renderer) error {
 	G := func(in string) string { return in }
@@ -137,7 +446,18 @@ func initBlog(settings *settings, session *service.Session, logger *log.Logger,
 		Name:      util.GenLanguageMap(G("Blog Post"), availableLocales),
 		Fields: []*service.NodeField{
 			{Id: "core.Title"},
+			{
+				Id:           "core.Teaser",
+				Name:         util.GenLanguageMap(G("Teaser"), availableLocales),
+				Type:         "Text",
+				Translatable: true,
+			},
 			{Id: "core.Body"},
+			{
+				Id:   "core.Tags",
+				Name: util.GenLanguageMap(G("Tags (comma separated)"), availableLocales),
+				Type: "Text",
+			},
 		},
 		Hide:       true,
 		PathPrefix: "$year/$month",
@@ -157,6 +477,12 @@ func initBlog(settings *settings, session *service.Session, logger *log.Logger,
 					logger.Printf("Could not get blog context: %v", err)
 				}
 				return ctx
+			case "core.BlogPost":
+				ctx, err := getBlogPostContext(req, session, settings, renderer)
+				if err != nil {
+					logger.Printf("Could not get blog post context: %v", err)
+				}
+				return ctx
 			default:
 				return nil
 			}
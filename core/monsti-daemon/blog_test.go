@@ -0,0 +1,159 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// newBlogPost returns a blog post with the given name, publish day in
+// March 2014 (or April for days above 31) and tags.
+func newBlogPost(name string, day int, tags string) *service.Node {
+	tagsField := service.TextField(tags)
+	return &service.Node{Path: "/blog/2014/03/" + name,
+		PublishTime: time.Date(2014, 3, day, 12, 0, 0, 0, time.UTC),
+		Fields:      map[string]service.Field{"core.Tags": &tagsField}}
+}
+
+func postNames(posts []*service.Node) []string {
+	names := make([]string, 0, len(posts))
+	for _, post := range posts {
+		names = append(names, post.Name())
+	}
+	return names
+}
+
+func TestBlogPostTeaser(t *testing.T) {
+	body := service.HTMLField("<p>Hello &amp; <b>welcome</b></p>")
+	post := &service.Node{Fields: map[string]service.Field{"core.Body": &body}}
+	if teaser := blogPostTeaser(post); teaser != "Hello & welcome" {
+		t.Errorf("blogPostTeaser() = %q, should be %q", teaser, "Hello & welcome")
+	}
+	body = service.HTMLField(strings.Repeat("word ", 100))
+	teaser := blogPostTeaser(post)
+	if !strings.HasSuffix(teaser, "word …") ||
+		len([]rune(teaser)) > maxBlogTeaserLength+2 {
+		t.Errorf("blogPostTeaser() of long body = %q", teaser)
+	}
+	text := service.TextField(" Summary ")
+	post.Fields["core.Teaser"] = &text
+	if teaser := blogPostTeaser(post); teaser != "Summary" {
+		t.Errorf("blogPostTeaser() = %q, should be %q", teaser, "Summary")
+	}
+}
+
+func TestFilterBlogPosts(t *testing.T) {
+	pinned := newBlogPost("pinned", 1, "News")
+	pinned.Pinned = true
+	posts := []*service.Node{pinned, newBlogPost("c", 33, "go, news"),
+		newBlogPost("b", 10, "Go"), newBlogPost("a", 2, "")}
+	tests := []struct {
+		Tag, Month string
+		Expected   []string
+	}{
+		{"", "", []string{"pinned", "c", "b", "a"}},
+		{"go", "", []string{"c", "b"}},
+		{"NEWS", "", []string{"c", "pinned"}},
+		{"", "2014-03", []string{"b", "a", "pinned"}},
+		{"news", "2014-03", []string{"pinned"}},
+		{"unknown", "", []string{}},
+	}
+	for _, test := range tests {
+		names := postNames(filterBlogPosts(posts, test.Tag, test.Month, time.UTC))
+		if !reflect.DeepEqual(names, test.Expected) {
+			t.Errorf("filterBlogPosts(%q, %q) = %v, should be %v", test.Tag,
+				test.Month, names, test.Expected)
+		}
+	}
+}
+
+func TestGetBlogArchive(t *testing.T) {
+	posts := []*service.Node{newBlogPost("c", 33, "go, news"),
+		newBlogPost("b", 10, "Go"), newBlogPost("a", 2, "Misc")}
+	months, tags := getBlogArchive(posts, time.UTC)
+	expectedMonths := []blogMonth{
+		{time.Date(2014, 4, 1, 0, 0, 0, 0, time.UTC), 1},
+		{time.Date(2014, 3, 1, 0, 0, 0, 0, time.UTC), 2}}
+	if !reflect.DeepEqual(months, expectedMonths) {
+		t.Errorf("getBlogArchive() months = %v, should be %v", months,
+			expectedMonths)
+	}
+	if months[0].Id() != "2014-04" {
+		t.Errorf("Id() = %q, should be %q", months[0].Id(), "2014-04")
+	}
+	expectedTags := []blogTag{{"go", 2}, {"Misc", 1}, {"news", 1}}
+	if !reflect.DeepEqual(tags, expectedTags) {
+		t.Errorf("getBlogArchive() tags = %v, should be %v", tags, expectedTags)
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	posts := []*service.Node{newBlogPost("a", 5, ""), newBlogPost("b", 4, ""),
+		newBlogPost("c", 3, ""), newBlogPost("d", 2, ""),
+		newBlogPost("e", 1, "")}
+	tests := []struct {
+		Page, Size        int
+		Expected          []string
+		ActualPage, Pages int
+	}{
+		{1, 2, []string{"a", "b"}, 1, 3},
+		{3, 2, []string{"e"}, 3, 3},
+		{0, 2, []string{"a", "b"}, 1, 3},
+		{7, 2, []string{"e"}, 3, 3},
+		{1, 10, []string{"a", "b", "c", "d", "e"}, 1, 1},
+	}
+	for _, test := range tests {
+		page, actual, pages := paginate(posts, test.Page, test.Size)
+		if names := postNames(page); !reflect.DeepEqual(names, test.Expected) ||
+			actual != test.ActualPage || pages != test.Pages {
+			t.Errorf("paginate(%v, %v) = %v, %v, %v, should be %v, %v, %v",
+				test.Page, test.Size, names, actual, pages, test.Expected,
+				test.ActualPage, test.Pages)
+		}
+	}
+	if page, actual, pages := paginate(nil, 2, 10); len(page) != 0 ||
+		actual != 1 || pages != 1 {
+		t.Errorf("paginate(nil, 2, 10) = %v, %v, %v, should be [], 1, 1",
+			page, actual, pages)
+	}
+}
+
+func TestBlogURL(t *testing.T) {
+	tests := []struct {
+		Values   map[string]string
+		Expected string
+	}{
+		{map[string]string{"page": "1", "tag": ""}, "/blog/"},
+		{map[string]string{"page": "2", "tag": "go lang"},
+			"/blog/?page=2&tag=go+lang"},
+		{map[string]string{"month": "2014-03"}, "/blog/?month=2014-03"},
+	}
+	for _, test := range tests {
+		if ret := blogURL("/blog", test.Values); ret != test.Expected {
+			t.Errorf("blogURL(%v) = %q, should be %q", test.Values, ret,
+				test.Expected)
+		}
+	}
+	if ret := blogPathOfPost("/blog/2014/03/hello"); ret != "/blog" {
+		t.Errorf("blogPathOfPost() = %q, should be %q", ret, "/blog")
+	}
+}
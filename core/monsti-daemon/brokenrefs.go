@@ -0,0 +1,252 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// errMissingEmbed is returned by RenderNode if the node to embed does
+// not exist.
+var errMissingEmbed = errors.New("Node to embed does not exist")
+
+// Modes of rendering broken references, set by the core.brokenreferences
+// site configuration option.
+const (
+	// brokenRefsWarning shows a warning to authenticated users and
+	// nothing to anonymous users. This is the default.
+	brokenRefsWarning = "warning"
+	// brokenRefsHide never shows anything.
+	brokenRefsHide = "hide"
+	// brokenRefsPlaceholder shows a placeholder to all users.
+	brokenRefsPlaceholder = "placeholder"
+)
+
+// embedPath returns the path of the node embedded into the given node.
+func embedPath(nodePath string, embed *service.EmbedNode) (string, error) {
+	embedURL, err := url.Parse(embed.URI)
+	if err != nil {
+		return "", fmt.Errorf("Could not parse embed URI: %v", err)
+	}
+	return path.Join(nodePath, embedURL.Path), nil
+}
+
+// renderBrokenReference renders the replacement of a missing embedded
+// node according to the site's configuration.
+func (h *nodeHandler) renderBrokenReference(c *reqContext,
+	embed *service.EmbedNode) ([]byte, error) {
+	var mode string
+	err := c.Serv.Monsti().GetSiteConfig(c.Site.Name, "core.brokenreferences",
+		&mode)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get broken references mode: %v", err)
+	}
+	warning := false
+	switch mode {
+	case brokenRefsHide:
+		return nil, nil
+	case brokenRefsPlaceholder:
+	default:
+		if c.UserSession.User == nil {
+			return nil, nil
+		}
+		warning = true
+	}
+	target, err := embedPath(c.Node.Path, embed)
+	if err != nil {
+		return nil, err
+	}
+	rendered, err := h.Renderer.Render("blocks/broken-reference",
+		template.Context{
+			"Embed":   embed,
+			"Path":    target,
+			"Warning": warning}, c.UserSession.Locale,
+		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return nil, fmt.Errorf("Could not render template: %v", err)
+	}
+	return []byte(rendered), nil
+}
+
+// brokenReference is a reference to a missing node.
+type brokenReference struct {
+	// Node is the path of the referencing node.
+	Node string
+	// Embed is the id of the embed option or of the MultiRef field
+	// holding the reference.
+	Embed string
+	// Target is the path of the missing node.
+	Target string
+}
+
+// nodeReferences returns the references of the given node to other
+// nodes, i.e. its embeds and the paths of its MultiRef fields.
+func nodeReferences(node *service.Node) ([]brokenReference, error) {
+	refs := make([]brokenReference, 0)
+	embeds := node.Embed
+	if node.Type != nil {
+		embeds = append(append([]service.EmbedNode(nil), node.Type.Embed...),
+			embeds...)
+	}
+	fields := node.AllFields()
+	for i := range embeds {
+		target, err := embedPath(node.Path, &embeds[i])
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, brokenReference{node.Path, embeds[i].Id, target})
+	}
+	for _, field := range fields {
+		multiRef, ok := node.GetField(field.Id).(*service.MultiRefField)
+		if !ok {
+			continue
+		}
+		for _, target := range multiRef.Paths {
+			refs = append(refs, brokenReference{node.Path, field.Id, target})
+		}
+	}
+	return refs, nil
+}
+
+// walkNodes calls fn for root and all nodes below root.
+func walkNodes(root string, getNodeFn getNodeFunc,
+	getChildrenFn getChildrenFunc, fn func(*service.Node) error) error {
+	var walk func(nodePath string) error
+	walk = func(nodePath string) error {
+		children, err := getChildrenFn(nodePath)
+		if err != nil {
+			return fmt.Errorf("Could not get children of %q: %v", nodePath, err)
+		}
+		for _, child := range children {
+			if err := fn(child); err != nil {
+				return err
+			}
+			if err := walk(child.Path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	node, err := getNodeFn(root)
+	if err != nil {
+		return fmt.Errorf("Could not get node %q: %v", root, err)
+	}
+	if node != nil {
+		if err := fn(node); err != nil {
+			return err
+		}
+	}
+	return walk(root)
+}
+
+// getBrokenReferences returns the broken references of all nodes
+// below root (including root).
+func getBrokenReferences(root string, getNodeFn getNodeFunc,
+	getChildrenFn getChildrenFunc) ([]brokenReference, error) {
+	broken := make([]brokenReference, 0)
+	err := walkNodes(root, getNodeFn, getChildrenFn,
+		func(node *service.Node) error {
+			refs, err := nodeReferences(node)
+			if err != nil {
+				return err
+			}
+			for _, ref := range refs {
+				target, err := getNodeFn(ref.Target)
+				if err != nil {
+					return fmt.Errorf("Could not get node %q: %v", ref.Target, err)
+				}
+				if target == nil {
+					broken = append(broken, ref)
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return broken, nil
+}
+
+// getReferencesTo returns the references of nodes outside of the
+// given subtree to nodes inside of it.
+//
+// These references would break if the subtree gets removed.
+func getReferencesTo(subtree string, getNodeFn getNodeFunc,
+	getChildrenFn getChildrenFunc) ([]brokenReference, error) {
+	within := func(nodePath string) bool {
+		return nodePath == subtree || strings.HasPrefix(nodePath, subtree+"/")
+	}
+	ret := make([]brokenReference, 0)
+	err := walkNodes("/", getNodeFn, getChildrenFn,
+		func(node *service.Node) error {
+			if within(node.Path) {
+				return nil
+			}
+			refs, err := nodeReferences(node)
+			if err != nil {
+				return err
+			}
+			for _, ref := range refs {
+				if within(ref.Target) {
+					ret = append(ret, ref)
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// BrokenReferences shows a report of all broken references of the
+// site.
+func (h *nodeHandler) BrokenReferences(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		return c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
+	}
+	getChildrenFn := func(nodePath string) ([]*service.Node, error) {
+		return c.Serv.Monsti().GetChildren(c.Site.Name, nodePath)
+	}
+	refs, err := getBrokenReferences("/", getNodeFn, getChildrenFn)
+	if err != nil {
+		return fmt.Errorf("Could not get broken references: %v", err)
+	}
+	body, err := h.Renderer.Render("actions/broken-references",
+		template.Context{"References": refs}, c.UserSession.Locale,
+		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render broken references report: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("Broken references"),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
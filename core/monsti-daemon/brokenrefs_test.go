@@ -0,0 +1,82 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"path"
+	"reflect"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestGetBrokenReferences(t *testing.T) {
+	nodeType := &service.NodeType{Id: "core.Document"}
+	refType := &service.NodeType{Id: "foo.Links",
+		Fields: []*service.NodeField{{Id: "foo.Related", Type: "MultiRef"}}}
+	listType := &service.NodeType{Id: "foo.List",
+		Embed: []service.EmbedNode{{Id: "recent", URI: "recent?limit=3"}}}
+	nodes := map[string]*service.Node{
+		"/": {Path: "/", Type: nodeType,
+			Embed: []service.EmbedNode{{Id: "news", URI: "news"}}},
+		"/news": {Path: "/news", Type: listType},
+		"/news/recent": {Path: "/news/recent", Type: nodeType,
+			Embed: []service.EmbedNode{{Id: "up", URI: "../../"},
+				{Id: "gone", URI: "gone"}}},
+		"/about": {Path: "/about", Type: listType},
+		"/links": {Path: "/links", Type: refType,
+			Fields: map[string]service.Field{"foo.Related": &service.MultiRefField{
+				Paths: []string{"/news", "/removed"}}}},
+	}
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		return nodes[nodePath], nil
+	}
+	getChildrenFn := func(nodePath string) ([]*service.Node, error) {
+		children := make([]*service.Node, 0)
+		for _, paths := range []string{"/news", "/news/recent", "/about",
+			"/links"} {
+			if path.Dir(paths) == nodePath {
+				children = append(children, nodes[paths])
+			}
+		}
+		return children, nil
+	}
+	refs, err := getBrokenReferences("/", getNodeFn, getChildrenFn)
+	if err != nil {
+		t.Fatalf("getBrokenReferences returned error: %v", err)
+	}
+	expected := []brokenReference{
+		{"/news/recent", "gone", "/news/recent/gone"},
+		{"/about", "recent", "/about/recent"},
+		{"/links", "foo.Related", "/removed"},
+	}
+	if !reflect.DeepEqual(refs, expected) {
+		t.Errorf("getBrokenReferences(...) = %v, should be %v", refs, expected)
+	}
+	refs, err = getReferencesTo("/news", getNodeFn, getChildrenFn)
+	if err != nil {
+		t.Fatalf("getReferencesTo returned error: %v", err)
+	}
+	expected = []brokenReference{
+		{"/", "news", "/news"},
+		{"/links", "foo.Related", "/news"},
+	}
+	if !reflect.DeepEqual(refs, expected) {
+		t.Errorf(`getReferencesTo("/news", ...) = %v, should be %v`, refs,
+			expected)
+	}
+}
@@ -0,0 +1,80 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// browseNode is a node as listed by the node browser.
+type browseNode struct {
+	Path, Title, Type string
+}
+
+// browseListing is the response of the node browser.
+type browseListing struct {
+	browseNode
+	// Parent is the path of the parent node or empty for the root.
+	Parent   string
+	Children []browseNode
+}
+
+// newBrowseNode returns the node browser entry of the given node.
+func newBrowseNode(node *service.Node, locale string) browseNode {
+	return browseNode{path.Clean(node.Path), getNodeTitle(node),
+		node.Type.GetLocalName(locale)}
+}
+
+// Browse returns a JSON listing of the requested node and its
+// children to be used by the node browser of MultiRef fields.
+func (h *nodeHandler) Browse(c *reqContext) error {
+	children, err := c.Serv.Monsti().GetChildren(c.Site.Name, c.Node.Path)
+	if err != nil {
+		return fmt.Errorf("Could not get children: %v", err)
+	}
+	locale := c.UserSession.Locale
+	listing := browseListing{
+		browseNode: newBrowseNode(c.Node, locale),
+		Children:   make([]browseNode, 0, len(children)),
+	}
+	if listing.Path != "/" {
+		listing.Parent = path.Dir(listing.Path)
+	}
+	for _, child := range children {
+		listing.Children = append(listing.Children, newBrowseNode(child, locale))
+	}
+	sort.Sort(browseNodes(listing.Children))
+	content, err := json.Marshal(listing)
+	if err != nil {
+		return fmt.Errorf("Could not marshal listing: %v", err)
+	}
+	c.Res.Header().Set("Content-Type", "application/json")
+	c.Res.Write(content)
+	return nil
+}
+
+// browseNodes sorts node browser entries by path.
+type browseNodes []browseNode
+
+func (n browseNodes) Len() int           { return len(n) }
+func (n browseNodes) Less(i, j int) bool { return n[i].Path < n[j].Path }
+func (n browseNodes) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
@@ -0,0 +1,164 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// compatibleNodeTypes returns true iff nodes of the type from may be
+// changed to the type to without losing field values, i.e. all fields
+// of from exist with the same field type in to.
+func compatibleNodeTypes(from, to *service.NodeType) bool {
+	for _, field := range from.Fields {
+		found := false
+		for _, other := range to.Fields {
+			if other.Id == field.Id {
+				found = other.Type == field.Type
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+type BulkNodeOpArgs struct {
+	Site   string
+	Op     service.BulkOp
+	Paths  []string
+	Target string
+}
+
+func (i *MonstiService) BulkNodeOp(args *BulkNodeOpArgs,
+	reply *[]service.BulkNodeResult) error {
+	root := i.Settings.Monsti.GetSiteNodesPath(args.Site)
+	var targetType *service.NodeType
+	switch args.Op {
+	case service.BulkRemove, service.BulkPublish, service.BulkUnpublish:
+	case service.BulkMove:
+		target := path.Clean("/" + args.Target)
+		if info, err := os.Stat(filepath.Join(root, target[1:])); err != nil ||
+			!info.IsDir() {
+			return fmt.Errorf("Unknown target %q", args.Target)
+		}
+		args.Target = target
+	case service.BulkChangeType:
+		i.mutex.RLock()
+		targetType = i.Settings.Config.NodeTypes[args.Target]
+		i.mutex.RUnlock()
+		if targetType == nil {
+			return fmt.Errorf("Unknown node type %q", args.Target)
+		}
+	default:
+		return fmt.Errorf("Unknown bulk operation %q", args.Op)
+	}
+	results := make([]service.BulkNodeResult, 0, len(args.Paths))
+	for _, nodePath := range args.Paths {
+		result := service.BulkNodeResult{Path: nodePath, NewPath: nodePath}
+		if err := i.bulkNodeOp(root, args, targetType, &result); err != nil {
+			result.NewPath = ""
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	*reply = results
+	return nil
+}
+
+// bulkNodeOp applies the bulk operation to the node of the result.
+func (i *MonstiService) bulkNodeOp(root string, args *BulkNodeOpArgs,
+	targetType *service.NodeType, result *service.BulkNodeResult) error {
+	nodePath := result.Path
+	if nodePath == "/" || !strings.HasPrefix(nodePath, "/") ||
+		nodePath != path.Clean(nodePath) {
+		return fmt.Errorf("Invalid node path %q", nodePath)
+	}
+	if err := i.checkNotMounted(args.Site, nodePath); err != nil {
+		return err
+	}
+	switch args.Op {
+	case service.BulkRemove:
+		result.NewPath = ""
+		return i.RemoveNode(&RemoveNodeArgs{args.Site, nodePath}, new(int))
+	case service.BulkMove:
+		target := path.Join(args.Target, path.Base(nodePath))
+		if target == nodePath {
+			return nil
+		}
+		if strings.HasPrefix(args.Target+"/", nodePath+"/") {
+			return fmt.Errorf("Can't move node below itself")
+		}
+		if _, err := os.Stat(filepath.Join(root, target[1:])); err == nil {
+			return fmt.Errorf("A node with this name does already exist")
+		}
+		result.NewPath = target
+		return i.RenameNode(&RenameNodeArgs{args.Site, nodePath, target},
+			new(int))
+	}
+	data, err := getNode(root, nodePath)
+	if err != nil {
+		return fmt.Errorf("Could not read node: %v", err)
+	}
+	if data == nil {
+		return fmt.Errorf("Node not found")
+	}
+	// Unknown attributes and field values are kept as they are.
+	var node map[string]json.RawMessage
+	if err := json.Unmarshal(data, &node); err != nil {
+		return fmt.Errorf("Could not unmarshal node: %v", err)
+	}
+	delete(node, "Path")
+	set := func(key string, value interface{}) {
+		node[key], _ = json.Marshal(value)
+	}
+	switch args.Op {
+	case service.BulkPublish, service.BulkUnpublish:
+		set("Public", args.Op == service.BulkPublish)
+	case service.BulkChangeType:
+		var typeID string
+		json.Unmarshal(node["Type"], &typeID)
+		i.mutex.RLock()
+		nodeType := i.Settings.Config.NodeTypes[typeID]
+		i.mutex.RUnlock()
+		if nodeType == nil {
+			return fmt.Errorf("Unknown node type %q", typeID)
+		}
+		if !compatibleNodeTypes(nodeType, targetType) {
+			return fmt.Errorf("Node type %q is not compatible to %q", typeID,
+				targetType.Id)
+		}
+		set("Type", targetType.Id)
+	}
+	set("Changed", time.Now().UTC())
+	content, err := json.Marshal(node)
+	if err != nil {
+		return fmt.Errorf("Could not marshal node: %v", err)
+	}
+	return i.WriteNodeData(&WriteNodeDataArgs{Site: args.Site, Path: nodePath,
+		File: "node.json", Content: content}, new(int))
+}
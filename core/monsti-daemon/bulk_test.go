@@ -0,0 +1,136 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestCompatibleNodeTypes(t *testing.T) {
+	document := &service.NodeType{Fields: []*service.NodeField{
+		{Id: "core.Title", Type: "Text"}, {Id: "core.Body", Type: "HTMLArea"}}}
+	post := &service.NodeType{Fields: append([]*service.NodeField{
+		{Id: "core.Tags", Type: "List"}}, document.Fields...)}
+	event := &service.NodeType{Fields: []*service.NodeField{
+		{Id: "core.Title", Type: "Text"}, {Id: "core.Body", Type: "Markdown"}}}
+	tests := []struct {
+		From, To   *service.NodeType
+		Compatible bool
+	}{
+		{document, document, true},
+		{document, post, true},
+		{post, document, false},
+		{document, event, false},
+	}
+	for i, test := range tests {
+		if ret := compatibleNodeTypes(test.From, test.To); ret != test.Compatible {
+			t.Errorf("Test %v: compatibleNodeTypes() = %v, should be %v", i, ret,
+				test.Compatible)
+		}
+	}
+}
+
+func TestBulkNodeOp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-bulk")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := MonstiService{Settings: new(settings),
+		Logger: log.New(ioutil.Discard, "", 0)}
+	m.Settings.Monsti.Directories.Data = dir
+	m.Settings.Monsti.Directories.Config = dir
+	m.Settings.Config.NodeTypes = map[string]*service.NodeType{
+		"core.Document": {Id: "core.Document", Fields: []*service.NodeField{
+			{Id: "core.Title", Type: "Text"}}},
+		"core.Image": {Id: "core.Image", Fields: []*service.NodeField{
+			{Id: "core.File", Type: "File"}}},
+	}
+	root := m.Settings.Monsti.GetSiteNodesPath("example")
+	for _, node := range []string{"news/a", "news/b", "news/c", "archive"} {
+		if err := os.MkdirAll(filepath.Join(root, node), 0700); err != nil {
+			t.Fatalf("Could not create node: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, node, "node.json"),
+			[]byte(`{"Type":"core.Document","Public":true,"Order":3,`+
+				`"Fields":{"core.Title":{"":"Foo"}}}`), 0600); err != nil {
+			t.Fatalf("Could not write node: %v", err)
+		}
+	}
+	bulk := func(op service.BulkOp, paths []string, target string) []string {
+		var results []service.BulkNodeResult
+		if err := m.BulkNodeOp(&BulkNodeOpArgs{"example", op, paths, target},
+			&results); err != nil {
+			t.Fatalf("BulkNodeOp(%v) returned error: %v", op, err)
+		}
+		ret := make([]string, 0, len(results))
+		for _, result := range results {
+			ret = append(ret, result.NewPath+" "+result.Error)
+		}
+		return ret
+	}
+	ret := bulk(service.BulkUnpublish, []string{"/news/a", "/news/x"}, "")
+	if ret[0] != "/news/a " || !strings.HasPrefix(ret[1], " Node not found") {
+		t.Errorf("BulkNodeOp(unpublish) = %q", ret)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(root, "news/a/node.json"))
+	if err != nil || !strings.Contains(string(content), `"Public":false`) ||
+		!strings.Contains(string(content), `"Order":3`) ||
+		strings.Contains(string(content), `"Path"`) {
+		t.Errorf("Unpublished node is %s (%v)", content, err)
+	}
+	ret = bulk(service.BulkChangeType, []string{"/news/b"}, "core.Image")
+	if !strings.Contains(ret[0], "not compatible") {
+		t.Errorf("BulkNodeOp(changetype) = %q, should fail", ret)
+	}
+	ret = bulk(service.BulkMove, []string{"/news/a", "/archive"}, "/archive")
+	if ret[0] != "/archive/a " ||
+		!strings.Contains(ret[1], "below itself") {
+		t.Errorf("BulkNodeOp(move) = %q", ret)
+	}
+	if _, err := os.Stat(filepath.Join(root, "archive/a/node.json")); err != nil {
+		t.Errorf("Node should have been moved: %v", err)
+	}
+	ret = bulk(service.BulkRemove, []string{"/news/b", "/news/c"}, "")
+	if !reflect.DeepEqual(ret, []string{" ", " "}) {
+		t.Errorf("BulkNodeOp(remove) = %q", ret)
+	}
+	if _, err := os.Stat(filepath.Join(root, "news/b")); !os.IsNotExist(err) {
+		t.Errorf("Node should have been removed: %v", err)
+	}
+	ret = bulk(service.BulkRemove, []string{"/news/../..", "/archive/"}, "")
+	if !strings.Contains(ret[0], "Invalid node path") ||
+		!strings.Contains(ret[1], "Invalid node path") {
+		t.Errorf("BulkNodeOp(remove) of unclean paths = %q, should fail", ret)
+	}
+	if _, err := os.Stat(root); err != nil {
+		t.Errorf("Nodes directory has been removed: %v", err)
+	}
+	var results []service.BulkNodeResult
+	if err := m.BulkNodeOp(&BulkNodeOpArgs{"example", service.BulkMove,
+		[]string{"/archive/a"}, "/unknown"}, &results); err == nil {
+		t.Errorf("BulkNodeOp should fail for unknown targets")
+	}
+}
@@ -0,0 +1,280 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2013 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// cacheSettings configure the caching of a site's responses, see
+// core.cache.
+type cacheSettings struct {
+	// Control maps node type ids to the Cache-Control header of
+	// responses to anonymous requests. The id "*" applies to node types
+	// without an entry.
+	Control map[string]string
+	// Purge configures purge requests sent to caching proxies when
+	// nodes change.
+	Purge struct {
+		// URLs of the caching proxies, e.g. "http://localhost:6081".
+		URLs []string
+		// Method of the purge requests. Defaults to "PURGE".
+		Method string
+		// Headers are added to the purge requests, e.g. API keys.
+		Headers map[string]string
+	}
+}
+
+// getCacheSettings returns the cache settings of the site.
+func getCacheSettings(s *service.Session, site string) (*cacheSettings,
+	error) {
+	settings := new(cacheSettings)
+	if err := s.Monsti().GetSiteConfig(site, "core.cache", settings); err != nil {
+		return nil, fmt.Errorf("Could not get cache settings: %v", err)
+	}
+	return settings, nil
+}
+
+// CacheControl returns the Cache-Control header for responses showing
+// nodes of the given type. Responses to authenticated users or
+// requests other than GET and HEAD must not be cached by proxies.
+//
+// Returns an empty string if no header has been configured.
+func (s *cacheSettings) CacheControl(nodeType string, public bool) string {
+	value, ok := s.Control[nodeType]
+	if !ok {
+		value = s.Control["*"]
+	}
+	if value != "" && !public {
+		return "private, no-cache"
+	}
+	return value
+}
+
+// setCacheHeaders sets the configured Cache-Control header of the
+// response showing the requested node.
+func setCacheHeaders(c *reqContext) error {
+	settings, err := getCacheSettings(c.Serv, c.Site.Name)
+	if err != nil {
+		return err
+	}
+	public := c.UserSession.User == nil &&
+		(c.Req.Method == "GET" || c.Req.Method == "HEAD")
+	if value := settings.CacheControl(c.Node.Type.Id, public); value != "" {
+		c.Res.Header().Set("Cache-Control", value)
+	}
+	return nil
+}
+
+// nodePurgePaths returns the URL paths to be purged if the given node
+// changes, i.e. the paths of the node and its parent.
+func nodePurgePaths(nodePath string) []string {
+	nodePath = path.Clean("/" + nodePath)
+	if nodePath == "/" {
+		return []string{"/"}
+	}
+	return []string{nodePath, nodePath + "/",
+		strings.TrimSuffix(path.Dir(nodePath), "/") + "/"}
+}
+
+// purgesCache returns true iff writing the given node file changes the
+// node's pages, i.e. for the node itself and its content files like
+// "__file_core.File". Runtime data like comments does not purge the
+// node.
+func purgesCache(file string) bool {
+	return file == "node.json" || strings.HasPrefix(file, "__")
+}
+
+// nodeURLPaths returns the URL paths to be purged if the given nodes
+// of the site change, including the paths of the nodes in the site's
+// locales, e.g. "/de/ueber-uns/" using the localized names of the
+// nodes.
+func (i *MonstiService) nodeURLPaths(site string, nodePaths []string) (
+	[]string, error) {
+	var locales []string
+	if err := i.siteConfig(site, "core.locales", &locales); err != nil {
+		return nil, err
+	}
+	var prefixAll bool
+	if err := i.siteConfig(site, "core.prefixlocales", &prefixAll); err != nil {
+		return nil, err
+	}
+	siteLocale := i.Settings.Monsti.Sites[site].Locale
+	locales = append([]string{siteLocale}, locales...)
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		var raw []byte
+		if err := i.GetNode(&GetNodeDataArgs{Site: site, Path: nodePath},
+			&raw); err != nil || raw == nil {
+			return nil, err
+		}
+		node := new(service.Node)
+		if err := json.Unmarshal(raw, &struct {
+			LocalizedNames *map[string]string
+		}{&node.LocalizedNames}); err != nil {
+			return nil, fmt.Errorf("Could not decode node: %v", err)
+		}
+		return node, nil
+	}
+	paths := make([]string, 0)
+	seen := make(map[string]bool)
+	add := func(nodePath string) {
+		for _, urlPath := range nodePurgePaths(nodePath) {
+			if !seen[urlPath] {
+				seen[urlPath] = true
+				paths = append(paths, urlPath)
+			}
+		}
+	}
+	for _, nodePath := range nodePaths {
+		add(nodePath)
+		for j, locale := range locales {
+			if j > 0 && locale == siteLocale {
+				continue
+			}
+			localized, err := localizedNodePath(locale, false, nodePath, getNodeFn)
+			if err != nil {
+				return nil, err
+			}
+			if prefixAll || locale != siteLocale {
+				add(localizedPath(locale, localized))
+			} else {
+				add(localized)
+			}
+		}
+	}
+	return paths, nil
+}
+
+// purgeRequests returns the purge requests for the given paths of the
+// site served at the given hosts.
+func purgeRequests(settings *cacheSettings, hosts, paths []string) (
+	[]*http.Request, error) {
+	method := settings.Purge.Method
+	if method == "" {
+		method = "PURGE"
+	}
+	reqs := make([]*http.Request, 0)
+	for _, base := range settings.Purge.URLs {
+		for _, host := range hosts {
+			// Wildcard hosts don't name a cached host.
+			if strings.HasPrefix(host, "*.") {
+				continue
+			}
+			for _, urlPath := range paths {
+				target, err := url.Parse(strings.TrimSuffix(base, "/"))
+				if err != nil {
+					return nil, fmt.Errorf("Invalid purge URL %q: %v", base, err)
+				}
+				target.Path += urlPath
+				req, err := http.NewRequest(method, target.String(), nil)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid purge URL %q: %v", base, err)
+				}
+				req.Host = host
+				for key, value := range settings.Purge.Headers {
+					req.Header.Set(key, value)
+				}
+				reqs = append(reqs, req)
+			}
+		}
+	}
+	return reqs, nil
+}
+
+// purgeClient sends purge requests.
+var purgeClient = &http.Client{Timeout: 10 * time.Second}
+
+// purgeCache purges the given paths of the site from the configured
+// caching proxies.
+func (i *MonstiService) purgeCache(site string, paths []string) error {
+	var settings *cacheSettings
+	if err := i.siteConfig(site, "core.cache", &settings); err != nil {
+		return err
+	}
+	if settings == nil {
+		return nil
+	}
+	reqs, err := purgeRequests(settings, i.Settings.Monsti.Sites[site].Hosts,
+		paths)
+	if err != nil {
+		return err
+	}
+	for _, req := range reqs {
+		res, err := purgeClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("Could not purge %v: %v", req.URL, err)
+		}
+		res.Body.Close()
+		if res.StatusCode >= 400 && res.StatusCode != http.StatusNotFound {
+			return fmt.Errorf("Could not purge %v: %v", req.URL, res.Status)
+		}
+	}
+	return nil
+}
+
+// purgeNodes purges the given changed nodes of the site in the
+// background, including the nodes' paths in sites mounting them.
+func (i *MonstiService) purgeNodes(site string, nodePaths ...string) {
+	sitePaths := mountedPaths(i.Settings.Monsti.Sites, site, nodePaths)
+	sitePaths[site] = append(sitePaths[site], nodePaths...)
+	for site, nodePaths := range sitePaths {
+		go func(site string, nodePaths []string) {
+			paths, err := i.nodeURLPaths(site, nodePaths)
+			if err == nil {
+				err = i.purgeCache(site, paths)
+			}
+			if err != nil {
+				i.Logger.Printf("(%v) %v", site, err)
+			}
+		}(site, nodePaths)
+	}
+}
+
+type PurgeCacheArgs struct {
+	Site  string
+	Paths []string
+}
+
+func (i *MonstiService) PurgeCache(args *PurgeCacheArgs, reply *int) error {
+	if _, ok := i.Settings.Monsti.Sites[args.Site]; !ok {
+		return fmt.Errorf("Unknown site %q", args.Site)
+	}
+	nodePaths := make([]string, 0, len(args.Paths))
+	for _, nodePath := range args.Paths {
+		nodePaths = append(nodePaths, path.Clean("/"+nodePath))
+	}
+	paths, err := i.nodeURLPaths(args.Site, nodePaths)
+	if err != nil {
+		return err
+	}
+	return i.purgeCache(args.Site, paths)
+}
+
+func (i *MonstiService) ClearTemplateCache(args int, reply *int) error {
+	if i.Handler != nil && i.Handler.Renderer.Cache != nil {
+		i.Handler.Renderer.Cache.Clear()
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2013 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestCacheControl(t *testing.T) {
+	settings := &cacheSettings{Control: map[string]string{
+		"*":          "public, max-age=60",
+		"core.Image": "public, max-age=86400",
+		"core.Blog":  ""}}
+	tests := []struct {
+		NodeType string
+		Public   bool
+		Value    string
+	}{
+		{"core.Document", true, "public, max-age=60"},
+		{"core.Image", true, "public, max-age=86400"},
+		{"core.Image", false, "private, no-cache"},
+		{"core.Blog", true, ""},
+		{"core.Blog", false, ""},
+	}
+	for i, test := range tests {
+		if ret := settings.CacheControl(test.NodeType, test.Public); ret != test.Value {
+			t.Errorf("Test %v: CacheControl(%q, %v) = %q, should be %q", i,
+				test.NodeType, test.Public, ret, test.Value)
+		}
+	}
+	if ret := new(cacheSettings).CacheControl("core.Document", false); ret != "" {
+		t.Errorf("CacheControl without settings = %q, should be empty", ret)
+	}
+}
+
+func TestNodePurgePaths(t *testing.T) {
+	tests := []struct {
+		Node  string
+		Paths []string
+	}{
+		{"/", []string{"/"}},
+		{"/foo", []string{"/foo", "/foo/", "/"}},
+		{"/foo/bar/", []string{"/foo/bar", "/foo/bar/", "/foo/"}},
+	}
+	for i, test := range tests {
+		if ret := nodePurgePaths(test.Node); !reflect.DeepEqual(ret, test.Paths) {
+			t.Errorf("Test %v: nodePurgePaths(%q) = %v, should be %v", i,
+				test.Node, ret, test.Paths)
+		}
+	}
+}
+
+func TestPurgeRequests(t *testing.T) {
+	settings := new(cacheSettings)
+	settings.Purge.URLs = []string{"http://localhost:6081/"}
+	settings.Purge.Headers = map[string]string{"Fastly-Key": "secret"}
+	reqs, err := purgeRequests(settings, []string{"example.com",
+		"www.example.com"}, []string{"/foo", "/foo/"})
+	if err != nil {
+		t.Fatalf("purgeRequests returned error: %v", err)
+	}
+	expected := []string{
+		"PURGE example.com http://localhost:6081/foo",
+		"PURGE example.com http://localhost:6081/foo/",
+		"PURGE www.example.com http://localhost:6081/foo",
+		"PURGE www.example.com http://localhost:6081/foo/"}
+	if len(reqs) != len(expected) {
+		t.Fatalf("Got %v requests, should be %v", len(reqs), len(expected))
+	}
+	for i, req := range reqs {
+		ret := req.Method + " " + req.Host + " " + req.URL.String()
+		if ret != expected[i] || req.Header.Get("Fastly-Key") != "secret" {
+			t.Errorf("Request %v is %q with headers %v, should be %q", i, ret,
+				req.Header, expected[i])
+		}
+	}
+	settings.Purge.Method = "BAN"
+	if reqs, _ := purgeRequests(settings, []string{"example.com"},
+		[]string{"/"}); reqs[0].Method != "BAN" {
+		t.Errorf("Method is %q, should be BAN", reqs[0].Method)
+	}
+}
+
+func TestPurgesCache(t *testing.T) {
+	for file, purges := range map[string]bool{
+		"node.json":        true,
+		"__file_core.File": true,
+		"__image_200x100":  true,
+		"comments.json":    false,
+		"events.json":      false,
+	} {
+		if ret := purgesCache(file); ret != purges {
+			t.Errorf("purgesCache(%q) = %v, should be %v", file, ret, purges)
+		}
+	}
+}
+
+func TestNodeURLPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-cache")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := MonstiService{Settings: new(settings),
+		Logger: log.New(ioutil.Discard, "", 0)}
+	m.Settings.Monsti.Directories.Data = dir
+	m.Settings.Monsti.Directories.Config = dir
+	m.Settings.Monsti.Sites = map[string]util.SiteSettings{
+		"example": {Locale: "en"}}
+	root := m.Settings.Monsti.GetSiteNodesPath("example")
+	if err := os.MkdirAll(filepath.Join(root, "about"), 0700); err != nil {
+		t.Fatalf("Could not create node: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "about", "node.json"),
+		[]byte(`{"Type":"core.Document","LocalizedNames":{"de":"ueber-uns"}}`),
+		0600); err != nil {
+		t.Fatalf("Could not write node: %v", err)
+	}
+	if err := setConfig(filepath.Join(m.Settings.Monsti.GetSiteConfigPath(
+		"example"), "core.json"), "locales", []byte(`["de"]`)); err != nil {
+		t.Fatalf("Could not write site configuration: %v", err)
+	}
+	paths, err := m.nodeURLPaths("example", []string{"/about"})
+	if err != nil {
+		t.Fatalf("nodeURLPaths returned error: %v", err)
+	}
+	expected := []string{"/about", "/about/", "/", "/de/ueber-uns",
+		"/de/ueber-uns/", "/de/"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("nodeURLPaths() = %v, should be %v", paths, expected)
+	}
+	if err := m.PurgeCache(&PurgeCacheArgs{Site: "unknown"},
+		new(int)); err == nil {
+		t.Errorf("PurgeCache should fail for unknown sites")
+	}
+}
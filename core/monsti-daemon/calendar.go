@@ -0,0 +1,201 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// calendarEntry is a node's event shown in the content calendar.
+type calendarEntry struct {
+	Path, Title string
+	// Scheduled is true if the node has not been published yet.
+	Scheduled bool
+	Time      time.Time
+}
+
+type calendarEntriesByTime []calendarEntry
+
+func (s calendarEntriesByTime) Len() int { return len(s) }
+func (s calendarEntriesByTime) Less(i, j int) bool {
+	return s[i].Time.Before(s[j].Time)
+}
+func (s calendarEntriesByTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// calendarDay is a day of the content calendar.
+type calendarDay struct {
+	Date time.Time
+	// InMonth is false for days of the previous or next month.
+	InMonth bool
+	Entries []calendarEntry
+}
+
+// getCalendarEntries returns the publish times of all nodes below
+// root (including root) within [from, to), ordered by time.
+func getCalendarEntries(root string, from, to, now time.Time,
+	getChildrenFn getChildrenFunc) ([]calendarEntry, error) {
+	entries := make([]calendarEntry, 0)
+	var walk func(nodePath string) error
+	walk = func(nodePath string) error {
+		children, err := getChildrenFn(nodePath)
+		if err != nil {
+			return fmt.Errorf("Could not get children of %q: %v", nodePath, err)
+		}
+		for _, child := range children {
+			if child.Type.Id != "core.Path" &&
+				!child.PublishTime.Before(from) && child.PublishTime.Before(to) {
+				entries = append(entries, calendarEntry{
+					Path:      child.Path,
+					Title:     getNodeTitle(child),
+					Scheduled: child.PublishTime.After(now),
+					Time:      child.PublishTime})
+			}
+			if err := walk(child.Path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(root); err != nil {
+		return nil, err
+	}
+	sort.Sort(calendarEntriesByTime(entries))
+	return entries, nil
+}
+
+// getCalendarWeeks returns the weeks (starting on Monday) of the
+// month containing the given time with the entries sorted into the
+// days.
+func getCalendarWeeks(month time.Time,
+	entries []calendarEntry) [][]calendarDay {
+	loc := month.Location()
+	first := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, loc)
+	offset := (int(first.Weekday()) + 6) % 7
+	day := first.AddDate(0, 0, -offset)
+	weeks := make([][]calendarDay, 0, 6)
+	for len(weeks) == 0 || day.Month() == month.Month() {
+		week := make([]calendarDay, 7)
+		for i := range week {
+			week[i] = calendarDay{Date: day, InMonth: day.Month() == month.Month()}
+			next := day.AddDate(0, 0, 1)
+			for _, entry := range entries {
+				t := entry.Time.In(loc)
+				if !t.Before(day) && t.Before(next) {
+					week[i].Entries = append(week[i].Entries, entry)
+				}
+			}
+			day = next
+		}
+		weeks = append(weeks, week)
+	}
+	return weeks
+}
+
+// Calendar shows the publish times of the site's nodes per month.
+//
+// Nodes may be rescheduled by posting the node's path and the new
+// date. The time of day is kept.
+func (h *nodeHandler) Calendar(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	var timezone string
+	err := c.Serv.Monsti().GetSiteConfig(c.Site.Name, "core.timezone", &timezone)
+	if err != nil {
+		return fmt.Errorf("Could not get timezone: %v", err)
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	c.Req.ParseForm()
+	now := time.Now().In(location)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, location)
+	if value := c.Req.Form.Get("month"); len(value) > 0 {
+		if parsed, err := time.ParseInLocation("2006-01", value,
+			location); err == nil {
+			month = parsed
+		}
+	}
+
+	switch c.Req.Method {
+	case "GET":
+	case "POST":
+		node, err := c.Serv.Monsti().GetNode(c.Site.Name, c.Req.Form.Get("Node"))
+		if err != nil {
+			return fmt.Errorf("Could not get node to reschedule: %v", err)
+		}
+		if node == nil {
+			h.serveErrorPage(c, http.StatusNotFound)
+			return nil
+		}
+		date, err := time.ParseInLocation("2006-01-02", c.Req.Form.Get("Date"),
+			location)
+		if err != nil {
+			return fmt.Errorf("Could not parse date: %v", err)
+		}
+		old := node.PublishTime.In(location)
+		node.PublishTime = time.Date(date.Year(), date.Month(), date.Day(),
+			old.Hour(), old.Minute(), old.Second(), 0, location).UTC()
+		if err := c.Serv.Monsti().WriteNode(c.Site.Name, node.Path,
+			node); err != nil {
+			return fmt.Errorf("Could not update node: %v", err)
+		}
+		if err := recordNodeEvents(c, node.Path, &service.NodeEvent{
+			Type: service.NodeRescheduledEvent}); err != nil {
+			return err
+		}
+		http.Redirect(c.Res, c.Req, "@@calendar?"+url.Values{
+			"month": {month.Format("2006-01")}}.Encode(), http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+
+	getChildrenFn := func(nodePath string) ([]*service.Node, error) {
+		return c.Serv.Monsti().GetChildren(c.Site.Name, nodePath)
+	}
+	entries, err := getCalendarEntries("/", month, month.AddDate(0, 1, 0),
+		now, getChildrenFn)
+	if err != nil {
+		return fmt.Errorf("Could not get calendar entries: %v", err)
+	}
+	body, err := h.Renderer.Render("actions/calendar",
+		template.Context{
+			"Month":    month,
+			"Previous": month.AddDate(0, -1, 0).Format("2006-01"),
+			"Next":     month.AddDate(0, 1, 0).Format("2006-01"),
+			"Weeks":    getCalendarWeeks(month, entries)}, c.UserSession.Locale,
+		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render calendar: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("Calendar"),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
@@ -0,0 +1,77 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestGetCalendarEntries(t *testing.T) {
+	date := func(day int) time.Time {
+		return time.Date(2014, time.December, day, 12, 0, 0, 0, time.UTC)
+	}
+	nodes := map[string][]*service.Node{
+		"/": {
+			{Path: "/foo", PublishTime: date(10)},
+			{Path: "/dir", Type: &service.NodeType{Id: "core.Path"}}},
+		"/dir": {
+			{Path: "/dir/bar", PublishTime: date(20)},
+			{Path: "/dir/old", PublishTime: date(1).AddDate(0, -1, 0)}},
+	}
+	getChildrenFn := func(nodePath string) ([]*service.Node, error) {
+		for _, node := range nodes[nodePath] {
+			if node.Type == nil {
+				node.Type = &service.NodeType{Id: "core.Document"}
+			}
+		}
+		return nodes[nodePath], nil
+	}
+	from := time.Date(2014, time.December, 1, 0, 0, 0, 0, time.UTC)
+	entries, err := getCalendarEntries("/", from, from.AddDate(0, 1, 0),
+		date(15), getChildrenFn)
+	if err != nil {
+		t.Fatalf("getCalendarEntries returned error: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("getCalendarEntries returned %v entries, should be 2",
+			len(entries))
+	}
+	if entries[0].Path != "/foo" || entries[0].Scheduled ||
+		entries[1].Path != "/dir/bar" || !entries[1].Scheduled {
+		t.Errorf("getCalendarEntries = %v, should be /foo (published) and "+
+			"/dir/bar (scheduled)", entries)
+	}
+
+	weeks := getCalendarWeeks(from, entries)
+	if len(weeks) != 5 {
+		t.Errorf("December 2014 should have 5 weeks, got %v", len(weeks))
+	}
+	if first := weeks[0][0]; first.Date.Day() != 1 || !first.InMonth {
+		t.Errorf("First calendar day should be Monday, December 1st, got %v",
+			first.Date)
+	}
+	if last := weeks[4][6]; last.Date.Day() != 4 || last.InMonth {
+		t.Errorf("Last calendar day should be Sunday, January 4th, got %v",
+			last.Date)
+	}
+	if day := weeks[1][2]; len(day.Entries) != 1 || day.Entries[0].Path != "/foo" {
+		t.Errorf("December 10th should contain /foo, got %v", day.Entries)
+	}
+}
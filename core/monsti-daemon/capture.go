@@ -0,0 +1,234 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// captureBundle is a captured request together with all RPC calls
+// and signals made while processing it.
+type captureBundle struct {
+	Time   time.Time
+	Site   string
+	Method string
+	// URL is the request URL including host and query.
+	URL    string
+	Header http.Header
+	Body   []byte
+	// User is the authenticated user without password, if any.
+	User  *service.User
+	Calls []*service.RecordedCall
+}
+
+// capture is a running capture of a request.
+type capture struct {
+	Bundle    captureBundle
+	Recording service.Recording
+}
+
+// shouldCapture returns true iff the request to the given host and
+// path should be captured.
+func shouldCapture(urls []string, host, path string) bool {
+	for _, url := range urls {
+		if url == host+path {
+			return true
+		}
+	}
+	return false
+}
+
+// redacted replaces secrets in captured requests.
+const redacted = "REDACTED"
+
+// isSecretField returns true iff the form field or query parameter
+// with the given name may contain a secret, e.g. a password.
+func isSecretField(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range []string{"password", "passwd", "token", "secret",
+		"breakglass"} {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactValues replaces the values of secret fields.
+func redactValues(values url.Values) url.Values {
+	for name := range values {
+		if isSecretField(name) {
+			values[name] = []string{redacted}
+		}
+	}
+	return values
+}
+
+// redactHeader returns a copy of the header without cookies and
+// credentials.
+func redactHeader(header http.Header) http.Header {
+	ret := make(http.Header, len(header))
+	for name, values := range header {
+		switch http.CanonicalHeaderKey(name) {
+		case "Cookie", "Authorization", "Proxy-Authorization":
+			values = []string{redacted}
+		}
+		ret[name] = values
+	}
+	return ret
+}
+
+// redactBody returns the body with secret form fields replaced.
+//
+// Only url encoded bodies get redacted, other bodies are returned as
+// is.
+func redactBody(contentType string, body []byte) []byte {
+	if !strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		return body
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return []byte(redacted)
+	}
+	return []byte(redactValues(values).Encode())
+}
+
+// startCapture starts capturing the request if it's configured to be
+// captured.
+//
+// Cookies, credentials and secret form fields get redacted. Requests
+// to log in or to change passwords are never captured.
+//
+// Returns nil if the request should not be captured.
+func startCapture(c *reqContext, h *nodeHandler) (*capture, error) {
+	if h.Replay != nil ||
+		!shouldCapture(h.Settings.Capture.URLs, c.Req.Host, c.Req.URL.Path) {
+		return nil, nil
+	}
+	switch c.Action {
+	case service.LoginAction, service.RequestPasswordTokenAction,
+		service.ChangePasswordAction:
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(c.Req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read request body: %v", err)
+	}
+	c.Req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	url := *c.Req.URL
+	url.Scheme = "http"
+	url.Host = c.Req.Host
+	url.RawQuery = redactValues(url.Query()).Encode()
+	ret := &capture{Bundle: captureBundle{
+		Time:   time.Now().UTC(),
+		Site:   c.Site.Name,
+		Method: c.Req.Method,
+		URL:    url.String(),
+		Header: redactHeader(c.Req.Header),
+		Body:   redactBody(c.Req.Header.Get("Content-Type"), body),
+	}}
+	if err := c.Serv.Monsti().Record(&ret.Recording); err != nil {
+		return nil, fmt.Errorf("Could not start recording: %v", err)
+	}
+	return ret, nil
+}
+
+// finish stops the capture and writes the bundle into the site's
+// captures directory.
+//
+// Returns the path to the written bundle.
+func (p *capture) finish(c *reqContext, h *nodeHandler) (string, error) {
+	if err := c.Serv.Monsti().Record(nil); err != nil {
+		return "", fmt.Errorf("Could not stop recording: %v", err)
+	}
+	if c.UserSession != nil && c.UserSession.User != nil {
+		user := *c.UserSession.User
+		user.Password = ""
+		p.Bundle.User = &user
+	}
+	p.Bundle.Calls = p.Recording.Calls
+	dir := filepath.Join(h.Settings.Monsti.GetSiteDataPath(c.Site.Name),
+		"captures")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("Could not create captures directory: %v", err)
+	}
+	content, err := json.MarshalIndent(p.Bundle, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("Could not marshal capture: %v", err)
+	}
+	path := filepath.Join(dir, strconv.FormatInt(p.Bundle.Time.UnixNano(), 10)+
+		"-"+strconv.FormatUint(uint64(c.Id), 10)+".json")
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		return "", fmt.Errorf("Could not write capture: %v", err)
+	}
+	return path, nil
+}
+
+// readCaptureBundle reads the capture bundle at the given path.
+func readCaptureBundle(path string) (*captureBundle, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read capture: %v", err)
+	}
+	bundle := new(captureBundle)
+	if err := json.Unmarshal(content, bundle); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal capture: %v", err)
+	}
+	return bundle, nil
+}
+
+// replayCapture processes the captured request using the given
+// handler. All RPC calls get answered with the captured replies.
+//
+// The response will be written to out.
+func replayCapture(bundle *captureBundle, h *nodeHandler, out io.Writer) error {
+	req, err := http.NewRequest(bundle.Method, bundle.URL,
+		bytes.NewReader(bundle.Body))
+	if err != nil {
+		return fmt.Errorf("Could not create request: %v", err)
+	}
+	req.Header = bundle.Header
+	h.Replay = bundle
+	h.Sessions = service.NewSessionPool(1, "")
+	h.Sessions.Replay = &service.Recording{Calls: bundle.Calls}
+	h.Hosts = map[string]string{req.Host: bundle.Site}
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	fmt.Fprintf(out, "HTTP %v\n", res.Code)
+	if err := res.HeaderMap.Write(out); err != nil {
+		return fmt.Errorf("Could not write response header: %v", err)
+	}
+	fmt.Fprintln(out)
+	if _, err := res.Body.WriteTo(out); err != nil {
+		return fmt.Errorf("Could not write response body: %v", err)
+	}
+	return nil
+}
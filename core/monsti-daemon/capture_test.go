@@ -0,0 +1,73 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestShouldCapture(t *testing.T) {
+	urls := []string{"example.com/foo/", "localhost:8080/"}
+	tests := []struct {
+		Host, Path string
+		Capture    bool
+	}{
+		{"example.com", "/foo/", true},
+		{"example.com", "/foo/bar/", false},
+		{"example.com", "/", false},
+		{"localhost:8080", "/", true},
+	}
+	for i, test := range tests {
+		if ret := shouldCapture(urls, test.Host, test.Path); ret != test.Capture {
+			t.Errorf("Test %v: shouldCapture(_, %q, %q) = %v, should be %v",
+				i, test.Host, test.Path, ret, test.Capture)
+		}
+	}
+}
+
+func TestRedactCapture(t *testing.T) {
+	header := http.Header{
+		"Cookie":        {"monsti-session=secret"},
+		"Authorization": {"Basic c2VjcmV0"},
+		"Accept":        {"text/html"}}
+	ret := redactHeader(header)
+	if ret.Get("Cookie") != redacted || ret.Get("Authorization") != redacted ||
+		ret.Get("Accept") != "text/html" {
+		t.Errorf("redactHeader(_) = %v", ret)
+	}
+	if header.Get("Cookie") != "monsti-session=secret" {
+		t.Errorf("redactHeader modified the request header")
+	}
+	tests := []struct {
+		ContentType, Body, Expected string
+	}{
+		{"application/x-www-form-urlencoded",
+			"Login=alice&Password=secret&NewPasswordRepeat=secret",
+			"Login=alice&NewPasswordRepeat=REDACTED&Password=REDACTED"},
+		{"application/x-www-form-urlencoded; charset=UTF-8",
+			"Token=abc", "Token=REDACTED"},
+		{"text/plain", "Password=secret", "Password=secret"},
+	}
+	for i, test := range tests {
+		ret := string(redactBody(test.ContentType, []byte(test.Body)))
+		if ret != test.Expected {
+			t.Errorf("Test %v: redactBody(%q, %q) = %q, should be %q",
+				i, test.ContentType, test.Body, ret, test.Expected)
+		}
+	}
+}
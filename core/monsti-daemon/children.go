@@ -0,0 +1,242 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// childEntry is a child as shown by the child listing.
+type childEntry struct {
+	browseNode
+	Name                 string
+	Order                int
+	Pinned, Hide, Public bool
+}
+
+// nodeTypeOption is a node type children may be changed to.
+type nodeTypeOption struct {
+	Id, Name string
+}
+
+// reorderChildren sets the Order of the children to their position in
+// the given paths, starting with 1. Children missing in the paths are
+// moved behind the given ones, keeping their relative order.
+//
+// Returns the children whose Order has changed.
+func reorderChildren(children []*service.Node, paths []string) (
+	[]*service.Node, error) {
+	byPath := make(map[string]*service.Node, len(children))
+	for _, child := range children {
+		byPath[child.Path] = child
+	}
+	ordered := make([]*service.Node, 0, len(children))
+	for _, childPath := range paths {
+		child, ok := byPath[childPath]
+		if !ok {
+			return nil, fmt.Errorf("Unknown child: %q", childPath)
+		}
+		delete(byPath, childPath)
+		ordered = append(ordered, child)
+	}
+	for _, child := range children {
+		if _, ok := byPath[child.Path]; ok {
+			ordered = append(ordered, child)
+		}
+	}
+	changed := make([]*service.Node, 0)
+	for i, child := range ordered {
+		if child.Order != i+1 {
+			child.Order = i + 1
+			changed = append(changed, child)
+		}
+	}
+	return changed, nil
+}
+
+// batchChildren applies the batch operation to the children at the
+// given paths using BulkNodeOp and records the changes in the
+// children's timelines. Returns the results of failed children.
+//
+// All paths must be paths of the given children of the node.
+func batchChildren(c *reqContext, children []*service.Node,
+	op service.BulkOp, paths []string, target string) (
+	[]service.BulkNodeResult, error) {
+	known := make(map[string]bool, len(children))
+	for _, child := range children {
+		known[child.Path] = true
+	}
+	for _, childPath := range paths {
+		if childPath != path.Clean(childPath) || !known[childPath] {
+			return nil, fmt.Errorf("Not a child of %q: %q", c.Node.Path, childPath)
+		}
+	}
+	results, err := c.Serv.Monsti().BulkNodeOp(c.Site.Name, op, paths, target)
+	if err != nil {
+		return nil, fmt.Errorf("Could not apply batch action: %v", err)
+	}
+	return recordBulkResults(c, op, results)
+}
+
+// recordBulkResults records the changes of the bulk operation in the
+// timelines of the changed nodes. Returns the results of failed nodes.
+func recordBulkResults(c *reqContext, op service.BulkOp,
+	results []service.BulkNodeResult) ([]service.BulkNodeResult, error) {
+	failed := make([]service.BulkNodeResult, 0)
+	for _, result := range results {
+		if result.Error != "" {
+			failed = append(failed, result)
+			continue
+		}
+		var event *service.NodeEvent
+		switch op {
+		case service.BulkRemove:
+			continue
+		case service.BulkMove:
+			if result.NewPath == result.Path {
+				continue
+			}
+			event = &service.NodeEvent{Type: service.NodeRenamedEvent,
+				From: result.Path, To: result.NewPath}
+		default:
+			event = &service.NodeEvent{Type: service.NodeChangedEvent,
+				Description: fmt.Sprintf("Batch action (%v)", op)}
+		}
+		if err := recordNodeEvents(c, result.NewPath, event); err != nil {
+			return nil, err
+		}
+	}
+	return failed, nil
+}
+
+// writeChildOrder writes the children whose order has been changed by
+// reorderChildren.
+func writeChildOrder(c *reqContext, changed []*service.Node) error {
+	for _, child := range changed {
+		// Directories without node have nothing to store the order in.
+		if child.Type.Id == "core.Path" {
+			continue
+		}
+		if err := c.Serv.Monsti().WriteNode(c.Site.Name, child.Path,
+			child); err != nil {
+			return fmt.Errorf("Could not update child: %v", err)
+		}
+	}
+	return nil
+}
+
+// Children lists the children of the node and saves their order given
+// by the form values "Child", i.e. the children's paths in order.
+//
+// If the form value "Batch" is set, the batch operation "Op" gets
+// applied to the children selected by the form values "Selected"
+// instead. The form values "Target" and "NodeType" are the targets of
+// moves and type changes.
+func (h *nodeHandler) Children(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if err := c.Req.ParseForm(); err != nil {
+		return err
+	}
+	children, err := c.Serv.Monsti().GetChildren(c.Site.Name, c.Node.Path)
+	if err != nil {
+		return fmt.Errorf("Could not get children: %v", err)
+	}
+	context := template.Context{}
+	switch c.Req.Method {
+	case "GET":
+		_, saved := c.Req.Form["saved"]
+		context["Saved"] = saved
+		context["Done"] = c.Req.Form.Get("done")
+	case "POST":
+		if len(c.Req.Form.Get("Batch")) > 0 {
+			op := service.BulkOp(c.Req.Form.Get("Op"))
+			target := c.Req.Form.Get("Target")
+			if op == service.BulkChangeType {
+				target = c.Req.Form.Get("NodeType")
+			}
+			selected := c.Req.Form["Selected"]
+			failed, err := batchChildren(c, children, op, selected, target)
+			if err != nil {
+				return err
+			}
+			if len(failed) == 0 {
+				http.Redirect(c.Res, c.Req, "@@children?done="+
+					strconv.Itoa(len(selected)), http.StatusSeeOther)
+				return nil
+			}
+			context["Failed"] = failed
+			children, err = c.Serv.Monsti().GetChildren(c.Site.Name, c.Node.Path)
+			if err != nil {
+				return fmt.Errorf("Could not get children: %v", err)
+			}
+			break
+		}
+		changed, err := reorderChildren(children, c.Req.Form["Child"])
+		if err != nil {
+			return err
+		}
+		if err := writeChildOrder(c, changed); err != nil {
+			return err
+		}
+		http.Redirect(c.Res, c.Req, "@@children?saved", http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	entries := make([]childEntry, 0, len(children))
+	for _, child := range children {
+		entries = append(entries, childEntry{
+			newBrowseNode(child, c.UserSession.Locale), child.Name(), child.Order,
+			child.Pinned, child.Hide, child.Public})
+	}
+	context["Children"] = entries
+	typeIDs, err := c.Serv.Monsti().GetAddableNodeTypes(c.Site.Name,
+		c.Node.Type.Id)
+	if err != nil {
+		return fmt.Errorf("Could not get addable node types: %v", err)
+	}
+	nodeTypes := make([]nodeTypeOption, 0, len(typeIDs))
+	for _, id := range typeIDs {
+		nodeType, err := c.Serv.Monsti().GetNodeType(id)
+		if err != nil {
+			return fmt.Errorf("Could not get node type: %v", err)
+		}
+		nodeTypes = append(nodeTypes, nodeTypeOption{nodeType.Id,
+			nodeType.GetLocalName(c.UserSession.Locale)})
+	}
+	context["NodeTypes"] = nodeTypes
+	body, err := h.Renderer.Render("actions/children", context,
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render children: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   fmt.Sprintf(G("Children of \"%v\""), getNodeTitle(c.Node)),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
@@ -0,0 +1,50 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestReorderChildren(t *testing.T) {
+	children := []*service.Node{
+		{Path: "/a", Order: 1}, {Path: "/b", Order: 5}, {Path: "/c"},
+		{Path: "/d", Order: 4}}
+	changed, err := reorderChildren(children, []string{"/c", "/a"})
+	if err != nil {
+		t.Fatalf("reorderChildren returned error: %v", err)
+	}
+	var orders, paths []string
+	for _, child := range children {
+		orders = append(orders, fmt.Sprintf("%v:%v", child.Path, child.Order))
+	}
+	for _, child := range changed {
+		paths = append(paths, child.Path)
+	}
+	if fmt.Sprint(orders) != "[/a:2 /b:3 /c:1 /d:4]" {
+		t.Errorf("reorderChildren set orders %v", orders)
+	}
+	if fmt.Sprint(paths) != "[/c /a /b]" {
+		t.Errorf("reorderChildren changed %v, should be [/c /a /b]", paths)
+	}
+	if _, err := reorderChildren(children, []string{"/x"}); err == nil {
+		t.Errorf("reorderChildren should fail for unknown children")
+	}
+}
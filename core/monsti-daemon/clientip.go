@@ -0,0 +1,125 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseNetworks parses addresses and CIDR networks, e.g. "127.0.0.1"
+// or "10.0.0.0/8". Addresses become networks of a single address.
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	ret := make([]*net.IPNet, 0, len(networks))
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid address: %q", network)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, parsed, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network: %v", err)
+		}
+		ret = append(ret, parsed)
+	}
+	return ret, nil
+}
+
+// inNetworks returns true iff the address is in one of the
+// networks.
+func inNetworks(addr string, networks []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteHost returns the host of the request's remote address.
+func remoteHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// clientIP returns the address of the client sending the request. If
+// the request comes from a trusted proxy, the address is the last one
+// of the X-Forwarded-For header not being a trusted proxy itself.
+func clientIP(r *http.Request, proxies []*net.IPNet) string {
+	ip := remoteHost(r)
+	if !inNetworks(ip, proxies) {
+		return ip
+	}
+	var forwarded []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(addr) == nil {
+			break
+		}
+		ip = addr
+		if !inNetworks(addr, proxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// isSecureRequest returns true iff the request has been sent via
+// HTTPS, possibly to a trusted proxy setting X-Forwarded-Proto.
+func isSecureRequest(r *http.Request, proxies []*net.IPNet) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return inNetworks(remoteHost(r), proxies) &&
+		strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// requestHeaders are the headers of requests passed to modules, see
+// GetRequest.
+var requestHeaders = []string{"Accept", "Accept-Language", "Dnt",
+	"If-Modified-Since", "If-None-Match", "Referer", "User-Agent",
+	"X-Requested-With"}
+
+// selectHeaders returns the requestHeaders of the given header.
+func selectHeaders(header http.Header) http.Header {
+	ret := make(http.Header)
+	for _, name := range requestHeaders {
+		if values, ok := header[name]; ok {
+			ret[name] = values
+		}
+	}
+	return ret
+}
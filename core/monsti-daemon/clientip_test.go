@@ -0,0 +1,84 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestParseNetworks(t *testing.T) {
+	for _, proxies := range [][]string{{"foo"}, {"10.0.0.0/33"}} {
+		if _, err := parseNetworks(proxies); err == nil {
+			t.Errorf("parseNetworks(%v) should fail", proxies)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseNetworks([]string{"127.0.0.1", "10.0.0.0/8",
+		"::1"})
+	if err != nil {
+		t.Fatalf("parseNetworks returned error: %v", err)
+	}
+	tests := []struct {
+		Remote, Forwarded, Proto, ClientIP string
+		Secure                             bool
+	}{
+		{"1.2.3.4:1234", "", "", "1.2.3.4", false},
+		{"1.2.3.4:1234", "5.6.7.8", "https", "1.2.3.4", false},
+		{"127.0.0.1:1234", "", "", "127.0.0.1", false},
+		{"127.0.0.1:1234", "5.6.7.8", "https", "5.6.7.8", true},
+		{"[::1]:1234", "5.6.7.8", "http", "5.6.7.8", false},
+		{"127.0.0.1:1234", "6.6.6.6, 5.6.7.8, 10.1.2.3", "", "5.6.7.8", false},
+		{"127.0.0.1:1234", "10.1.2.3, 10.1.2.4", "", "10.1.2.3", false},
+		{"127.0.0.1:1234", "5.6.7.8, foo", "", "127.0.0.1", false},
+	}
+	for i, test := range tests {
+		r := &http.Request{RemoteAddr: test.Remote, Header: make(http.Header)}
+		if test.Forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.Forwarded)
+		}
+		if test.Proto != "" {
+			r.Header.Set("X-Forwarded-Proto", test.Proto)
+		}
+		if ret := clientIP(r, proxies); ret != test.ClientIP {
+			t.Errorf("%v: clientIP returned %q, should be %q", i, ret,
+				test.ClientIP)
+		}
+		if ret := isSecureRequest(r, proxies); ret != test.Secure {
+			t.Errorf("%v: isSecureRequest returned %v, should be %v", i, ret,
+				test.Secure)
+		}
+	}
+	r := &http.Request{RemoteAddr: "1.2.3.4:1234", TLS: &tls.ConnectionState{}}
+	if !isSecureRequest(r, proxies) {
+		t.Errorf("TLS requests should be secure")
+	}
+}
+
+func TestSelectHeaders(t *testing.T) {
+	header := http.Header{"Accept-Language": {"de"}, "Cookie": {"foo=bar"},
+		"User-Agent": {"Foo/1.0"}, "Authorization": {"Basic Zm9v"}}
+	ret := fmt.Sprint(selectHeaders(header))
+	if expected := "map[Accept-Language:[de] User-Agent:[Foo/1.0]]"; ret !=
+		expected {
+		t.Errorf("selectHeaders returned %v, should be %v", ret, expected)
+	}
+}
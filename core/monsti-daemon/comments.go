@@ -0,0 +1,624 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/chrneumann/htmlwidgets"
+	"github.com/chrneumann/mimemail"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// Status of comments.
+const (
+	commentPending  = "pending"
+	commentApproved = "approved"
+	commentSpam     = "spam"
+)
+
+// comment is a comment posted to a node.
+type comment struct {
+	Id   string
+	Time time.Time
+	// Name and Email as given by the author. The email address is
+	// never shown to visitors.
+	Name, Email string
+	// Login of the author. It is empty for comments of visitors.
+	Login string
+	Text  string
+	// Status is either commentPending, commentApproved or commentSpam.
+	Status string
+	// Reason is the reason given by the module flagging the comment as
+	// spam.
+	Reason string `json:",omitempty"`
+}
+
+// commentRef references a comment held for moderation.
+type commentRef struct {
+	// Node is the path of the commented node.
+	Node, Id string
+}
+
+// commentsFile is the node data file holding the node's comments.
+const commentsFile = "comments.json"
+
+// maxCommentLength is the maximum length of comments in characters,
+// maxCommentRequestSize the maximum size of requests posting comments.
+const (
+	maxCommentLength      = 10000
+	maxCommentRequestSize = 64 << 10
+)
+
+// commentsMutex serializes updates of comments and the moderation
+// queue.
+var commentsMutex sync.Mutex
+
+// validCommentId returns true iff the id may be the id of a comment.
+func validCommentId(id string) bool {
+	_, err := strconv.ParseUint(id, 10, 64)
+	return err == nil
+}
+
+// commentSettings are the per-site settings of comments
+// (core.comments).
+type commentSettings struct {
+	// NodeTypes are the ids of the node types accepting comments.
+	NodeTypes []string
+	// Moderate is true if comments of visitors are held for
+	// moderation.
+	Moderate bool
+}
+
+// getCommentSettings returns the comment settings of the site.
+// Comments are moderated by default.
+func getCommentSettings(s *service.Session, site string) (*commentSettings,
+	error) {
+	settings := &commentSettings{Moderate: true}
+	if err := s.Monsti().GetSiteConfig(site, "core.comments.nodetypes",
+		&settings.NodeTypes); err != nil {
+		return nil, fmt.Errorf("Could not get commentable node types: %v", err)
+	}
+	if err := s.Monsti().GetSiteConfig(site, "core.comments.moderate",
+		&settings.Moderate); err != nil {
+		return nil, fmt.Errorf("Could not get comment moderation setting: %v",
+			err)
+	}
+	return settings, nil
+}
+
+// Accepts returns true iff nodes of the given type accept comments.
+func (s *commentSettings) Accepts(nodeType string) bool {
+	for _, id := range s.NodeTypes {
+		if id == nodeType {
+			return true
+		}
+	}
+	return false
+}
+
+// parseComments returns the comments stored in the given content of a
+// comments file.
+func parseComments(content []byte) ([]*comment, error) {
+	comments := make([]*comment, 0)
+	if len(content) == 0 {
+		return comments, nil
+	}
+	if err := json.Unmarshal(content, &comments); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal comments: %v", err)
+	}
+	return comments, nil
+}
+
+// readComments returns the comments of the given node ordered by time.
+func readComments(c *reqContext, nodePath string) ([]*comment, error) {
+	content, err := c.Serv.Monsti().GetNodeData(c.Site.Name, nodePath,
+		commentsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read comments: %v", err)
+	}
+	return parseComments(content)
+}
+
+// writeComments writes the comments of the given node.
+func writeComments(c *reqContext, nodePath string, comments []*comment) error {
+	content, err := json.MarshalIndent(comments, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not marshal comments: %v", err)
+	}
+	if err := c.Serv.Monsti().WriteNodeData(c.Site.Name, nodePath,
+		commentsFile, content); err != nil {
+		return fmt.Errorf("Could not write comments: %v", err)
+	}
+	return nil
+}
+
+// approvedComments returns the approved comments.
+func approvedComments(comments []*comment) []*comment {
+	approved := make([]*comment, 0, len(comments))
+	for _, comment := range comments {
+		if comment.Status == commentApproved {
+			approved = append(approved, comment)
+		}
+	}
+	return approved
+}
+
+// moderateComment applies the decision ("approve", "spam" or "delete")
+// to the comment with the given id.
+//
+// Returns the changed comments and the moderated comment, which is nil
+// if there is no such comment.
+func moderateComment(comments []*comment, id, decision string) (
+	[]*comment, *comment, error) {
+	for i, comment := range comments {
+		if comment.Id != id {
+			continue
+		}
+		switch decision {
+		case "approve":
+			comment.Status = commentApproved
+		case "spam":
+			comment.Status = commentSpam
+		case "delete":
+			comments = append(comments[:i:i], comments[i+1:]...)
+		default:
+			return nil, nil, fmt.Errorf("Unknown decision %q", decision)
+		}
+		return comments, comment, nil
+	}
+	return comments, nil, nil
+}
+
+// commentQueuePath returns the path to the moderation queue inside the
+// given site data directory.
+func commentQueuePath(dataDir string) string {
+	return filepath.Join(dataDir, "comment-queue.json")
+}
+
+// readCommentQueue returns the comments held for moderation in the
+// given site data directory.
+func readCommentQueue(dataDir string) ([]commentRef, error) {
+	queue := make([]commentRef, 0)
+	content, err := ioutil.ReadFile(commentQueuePath(dataDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return queue, nil
+		}
+		return nil, fmt.Errorf("Could not read comment queue: %v", err)
+	}
+	if err := json.Unmarshal(content, &queue); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal comment queue: %v", err)
+	}
+	return queue, nil
+}
+
+// writeCommentQueue writes the moderation queue of the given site data
+// directory.
+func writeCommentQueue(dataDir string, queue []commentRef) error {
+	content, err := json.Marshal(queue)
+	if err != nil {
+		return fmt.Errorf("Could not marshal comment queue: %v", err)
+	}
+	if err := ioutil.WriteFile(commentQueuePath(dataDir), content,
+		0600); err != nil {
+		return fmt.Errorf("Could not write comment queue: %v", err)
+	}
+	return nil
+}
+
+// removeCommentRef returns the queue without the given reference.
+func removeCommentRef(queue []commentRef, ref commentRef) []commentRef {
+	ret := make([]commentRef, 0, len(queue))
+	for _, entry := range queue {
+		if entry != ref {
+			ret = append(ret, entry)
+		}
+	}
+	return ret
+}
+
+// queuedComment is a comment held for moderation.
+type queuedComment struct {
+	*comment
+	// Node is the path of the commented node.
+	Node string
+}
+
+type queuedCommentsByTime []queuedComment
+
+func (s queuedCommentsByTime) Len() int      { return len(s) }
+func (s queuedCommentsByTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s queuedCommentsByTime) Less(i, j int) bool {
+	leftSpam, rightSpam := s[i].Status == commentSpam, s[j].Status == commentSpam
+	return (!leftSpam && rightSpam) ||
+		(leftSpam == rightSpam && s[i].Time.Before(s[j].Time))
+}
+
+// getQueuedComments returns the comments of the queue ordered by time,
+// pending ones before spam. References to missing comments are
+// skipped.
+//
+// getCommentsFn returns the comments of the given node.
+func getQueuedComments(queue []commentRef,
+	getCommentsFn func(nodePath string) ([]*comment, error)) (
+	[]queuedComment, error) {
+	threads := make(map[string][]*comment)
+	queued := make([]queuedComment, 0, len(queue))
+	for _, ref := range queue {
+		comments, ok := threads[ref.Node]
+		if !ok {
+			var err error
+			if comments, err = getCommentsFn(ref.Node); err != nil {
+				return nil, err
+			}
+			threads[ref.Node] = comments
+		}
+		for _, comment := range comments {
+			if comment.Id == ref.Id {
+				queued = append(queued, queuedComment{comment, ref.Node})
+			}
+		}
+	}
+	sort.Sort(queuedCommentsByTime(queued))
+	return queued, nil
+}
+
+type commentFormData struct {
+	Name, Email, Text string
+}
+
+// commentForm returns the form to post comments. Authenticated users
+// don't have to give their name and email address.
+func commentForm(data *commentFormData, G func(string) string,
+	authenticated bool) *htmlwidgets.Form {
+	form := htmlwidgets.NewForm(data)
+	if !authenticated {
+		form.AddWidget(&htmlwidgets.TextWidget{MinLength: 1, MaxLength: 100,
+			ValidationError: G("Required.")}, "Name", G("Name"), "")
+		form.AddWidget(&htmlwidgets.TextWidget{MaxLength: 254,
+			Regexp:          `^[^@\s]+@[^@\s]+$`,
+			ValidationError: G("Please enter a valid email address.")},
+			"Email", G("Email (will not be published)"), "")
+	}
+	form.AddWidget(&htmlwidgets.TextAreaWidget{MinLength: 1,
+		ValidationError: G("Required.")}, "Text", G("Comment"), "")
+	form.Action = "@@comments"
+	return form
+}
+
+// checkComment lets modules check the new comment for spam.
+//
+// Returns the reason if a module flagged the comment.
+func checkComment(c *reqContext, comment *comment) (string, error) {
+	var ret []service.NewCommentRet
+	err := c.Serv.Monsti().EmitSignal("monsti.NewComment",
+		service.NewCommentArgs{c.Site.Name, c.Node.Path, comment.Name,
+			comment.Email, comment.Login, comment.Text, c.ClientIP,
+			c.Req.UserAgent()}, &ret)
+	if err != nil {
+		return "", fmt.Errorf("Could not emit signal: %v", err)
+	}
+	for _, result := range ret {
+		if result.Spam {
+			return result.Reason, nil
+		}
+	}
+	return "", nil
+}
+
+// commentMail returns the mail notifying the site owner about a new
+// comment.
+func commentMail(site util.SiteSettings, G func(string) string,
+	node *service.Node, comment *comment) *mimemail.Mail {
+	nodeTitle := getNodeTitle(node)
+	link := site.BaseURL + "/@@moderate-comments"
+	note := G("The comment is held for moderation:")
+	if comment.Status == commentApproved {
+		link = site.BaseURL + dirPath(node.Path) + "#comments"
+		note = G("The comment has been published:")
+	}
+	mail := mimemail.Mail{
+		From:    mimemail.Address{site.EmailName, site.EmailAddress},
+		Subject: fmt.Sprintf(G("New comment on %q"), nodeTitle),
+		Body: []byte(fmt.Sprintf(`Hello,
+
+%v <%v> commented on %q at "%v":
+
+%v
+
+%v
+%v
+
+This is an automatically generated email. Please don't reply to it.
+`, comment.Name, comment.Email, nodeTitle, site.Title, comment.Text,
+			note, link))}
+	mail.To = []mimemail.Address{
+		mimemail.Address{site.Owner.Name, site.Owner.Email}}
+	return &mail
+}
+
+// addComment stores the new comment of the requested node and queues it
+// for moderation unless it has been approved.
+func addComment(c *reqContext, h *nodeHandler, comment *comment) error {
+	commentsMutex.Lock()
+	defer commentsMutex.Unlock()
+	comments, err := readComments(c, c.Node.Path)
+	if err != nil {
+		return err
+	}
+	if err := writeComments(c, c.Node.Path,
+		append(comments, comment)); err != nil {
+		return err
+	}
+	if comment.Status == commentApproved {
+		return nil
+	}
+	dataDir := h.Settings.Monsti.GetSiteDataPath(c.Site.Name)
+	queue, err := readCommentQueue(dataDir)
+	if err != nil {
+		return err
+	}
+	return writeCommentQueue(dataDir, append(queue,
+		commentRef{c.Node.Path, comment.Id}))
+}
+
+// renderComments renders the approved comments of the requested node
+// and the form to post new ones.
+//
+// Returns nil if the node's type does not accept comments.
+func renderComments(c *reqContext, h *nodeHandler) ([]byte, error) {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	settings, err := getCommentSettings(c.Serv, c.Site.Name)
+	if err != nil {
+		return nil, err
+	}
+	if !settings.Accepts(c.Node.Type.Id) {
+		return nil, nil
+	}
+	comments, err := readComments(c, c.Node.Path)
+	if err != nil {
+		return nil, err
+	}
+	form := commentForm(new(commentFormData), G, c.UserSession.User != nil)
+	body, err := h.Renderer.Render("blocks/comments", template.Context{
+		"Node":     c.Node,
+		"Session":  c.UserSession,
+		"Comments": approvedComments(comments),
+		"Posted":   c.Req.Form.Get("commented"),
+		"Form":     form.RenderData()}, c.UserSession.Locale,
+		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return nil, fmt.Errorf("Can't render comments: %v", err)
+	}
+	return []byte(body), nil
+}
+
+// Comments handles comments posted to the requested node.
+func (h *nodeHandler) Comments(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	c.Req.Body = http.MaxBytesReader(c.Res, c.Req.Body, maxCommentRequestSize)
+	if err := c.Req.ParseForm(); err != nil {
+		return err
+	}
+	settings, err := getCommentSettings(c.Serv, c.Site.Name)
+	if err != nil {
+		return err
+	}
+	if !settings.Accepts(c.Node.Type.Id) {
+		h.serveErrorPage(c, http.StatusNotFound)
+		return nil
+	}
+	user := c.UserSession.User
+	data := commentFormData{}
+	form := commentForm(&data, G, user != nil)
+	switch c.Req.Method {
+	case "GET":
+		http.Redirect(c.Res, c.Req, dirPath(c.Node.Path)+"#comments",
+			http.StatusSeeOther)
+		return nil
+	case "POST":
+		if !form.Fill(c.Req.Form) {
+			break
+		}
+		if utf8.RuneCountInString(data.Text) > maxCommentLength {
+			form.AddError("Text", fmt.Sprintf(
+				G("Comments may have at most %v characters."), maxCommentLength))
+			break
+		}
+		newComment := &comment{
+			Time:   time.Now().UTC(),
+			Name:   strings.TrimSpace(data.Name),
+			Email:  strings.TrimSpace(data.Email),
+			Text:   strings.TrimSpace(data.Text),
+			Status: commentPending}
+		newComment.Id = strconv.FormatInt(newComment.Time.UnixNano(), 10)
+		if user != nil {
+			newComment.Name, newComment.Email = user.Name, user.Email
+			newComment.Login = user.Login
+			if newComment.Name == "" {
+				newComment.Name = user.Login
+			}
+		}
+		if user != nil || !settings.Moderate {
+			newComment.Status = commentApproved
+		}
+		reason, err := checkComment(c, newComment)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			newComment.Status, newComment.Reason = commentSpam, reason
+		}
+		if err := addComment(c, h, newComment); err != nil {
+			return fmt.Errorf("Could not add comment: %v", err)
+		}
+		site := h.Settings.Monsti.Sites[c.Site.Name]
+		if newComment.Status != commentSpam && site.Owner.Email != "" {
+			siteG, _, _, _ := gettext.DefaultLocales.Use("", c.Site.Locale)
+			mail := commentMail(site, siteG, c.Node, newComment)
+			if err := c.Serv.Monsti().SendSiteMail(c.Site.Name, mail); err != nil {
+				return fmt.Errorf("Could not send notification: %v", err)
+			}
+		}
+		// Don't reveal whether the comment has been flagged.
+		posted := commentPending
+		if newComment.Status == commentApproved {
+			posted = commentApproved
+		}
+		http.Redirect(c.Res, c.Req, dirPath(c.Node.Path)+"?"+url.Values{
+			"commented": {posted}}.Encode()+"#comments", http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	body, err := h.Renderer.Render("actions/comments", template.Context{
+		"Form": form.RenderData()}, c.UserSession.Locale,
+		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render comment form: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("Comment")}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
+
+// moderate applies the decision ("approve", "spam" or "delete") to
+// the referenced comment and updates the moderation queue.
+//
+// Returns false if there is no such comment.
+func moderate(c *reqContext, h *nodeHandler, ref commentRef,
+	decision string) (bool, error) {
+	commentsMutex.Lock()
+	defer commentsMutex.Unlock()
+	comments, err := readComments(c, ref.Node)
+	if err != nil {
+		return false, err
+	}
+	comments, moderated, err := moderateComment(comments, ref.Id, decision)
+	if err != nil || moderated == nil {
+		return false, err
+	}
+	if err := writeComments(c, ref.Node, comments); err != nil {
+		return false, err
+	}
+	dataDir := h.Settings.Monsti.GetSiteDataPath(c.Site.Name)
+	queue, err := readCommentQueue(dataDir)
+	if err != nil {
+		return false, err
+	}
+	queue = removeCommentRef(queue, ref)
+	if decision == "spam" {
+		queue = append(queue, ref)
+	}
+	return true, writeCommentQueue(dataDir, queue)
+}
+
+// ModerateComments shows the comments held for moderation and handles
+// their approval, deletion or flagging as spam.
+//
+// Comments may also be deleted from the node's view. In this case, the
+// form value "Return" holds the path to return to.
+func (h *nodeHandler) ModerateComments(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if err := c.Req.ParseForm(); err != nil {
+		return err
+	}
+	dataDir := h.Settings.Monsti.GetSiteDataPath(c.Site.Name)
+	context := template.Context{}
+	switch c.Req.Method {
+	case "GET":
+		context["Done"] = c.Req.Form.Get("done")
+	case "POST":
+		ref := commentRef{c.Req.Form.Get("Node"), c.Req.Form.Get("Id")}
+		if !validCommentId(ref.Id) || !strings.HasPrefix(ref.Node, "/") ||
+			path.Clean(ref.Node) != ref.Node {
+			return fmt.Errorf("Invalid comment %q of %q", ref.Id, ref.Node)
+		}
+		node, err := c.Serv.Monsti().GetNode(c.Site.Name, ref.Node)
+		if err != nil {
+			return fmt.Errorf("Could not get commented node: %v", err)
+		}
+		if node == nil {
+			return fmt.Errorf("Invalid comment %q of %q", ref.Id, ref.Node)
+		}
+		decision := c.Req.Form.Get("Decision")
+		found, err := moderate(c, h, ref, decision)
+		if err != nil {
+			return fmt.Errorf("Could not moderate comment: %v", err)
+		}
+		if !found {
+			context["Error"] = G("The comment does not exist.")
+			break
+		}
+		target := "@@moderate-comments?" + url.Values{
+			"done": {decision}}.Encode()
+		if ret := c.Req.Form.Get("Return"); strings.HasPrefix(ret, "/") &&
+			!strings.HasPrefix(ret, "//") {
+			target = dirPath(ret) + "#comments"
+		}
+		http.Redirect(c.Res, c.Req, target, http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	queue, err := readCommentQueue(dataDir)
+	if err != nil {
+		return err
+	}
+	comments, err := getQueuedComments(queue,
+		func(nodePath string) ([]*comment, error) {
+			return readComments(c, nodePath)
+		})
+	if err != nil {
+		return err
+	}
+	context["Comments"] = comments
+	body, err := h.Renderer.Render("actions/moderate-comments", context,
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render comment moderation: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("Comments"),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
@@ -0,0 +1,167 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestModerateComment(t *testing.T) {
+	newComments := func() []*comment {
+		return []*comment{
+			{Id: "1", Status: commentApproved},
+			{Id: "2", Status: commentPending},
+			{Id: "3", Status: commentPending}}
+	}
+	tests := []struct {
+		Id, Decision string
+		Ids          []string
+		Status       string
+	}{
+		{"2", "approve", []string{"1", "2", "3"}, commentApproved},
+		{"2", "spam", []string{"1", "2", "3"}, commentSpam},
+		{"2", "delete", []string{"1", "3"}, commentPending},
+		{"4", "delete", []string{"1", "2", "3"}, ""},
+	}
+	for i, test := range tests {
+		comments, moderated, err := moderateComment(newComments(), test.Id,
+			test.Decision)
+		if err != nil {
+			t.Errorf("%v: moderateComment returned error: %v", i, err)
+			continue
+		}
+		var ids []string
+		for _, comment := range comments {
+			ids = append(ids, comment.Id)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(test.Ids) {
+			t.Errorf("%v: moderateComment left %v, should be %v", i, ids, test.Ids)
+		}
+		if test.Status == "" {
+			if moderated != nil {
+				t.Errorf("%v: moderateComment should not find missing comment", i)
+			}
+		} else if moderated == nil || moderated.Id != test.Id ||
+			moderated.Status != test.Status {
+			t.Errorf("%v: moderateComment moderated %v, should be %v with status %v",
+				i, moderated, test.Id, test.Status)
+		}
+	}
+	if _, _, err := moderateComment(newComments(), "2", "foo"); err == nil {
+		t.Errorf("moderateComment should fail for unknown decisions")
+	}
+}
+
+func TestApprovedComments(t *testing.T) {
+	comments, err := parseComments([]byte(`[
+{"Id": "1", "Name": "Jane", "Status": "approved"},
+{"Id": "2", "Name": "Joe", "Status": "pending"},
+{"Id": "3", "Name": "Bob", "Status": "spam"}]`))
+	if err != nil {
+		t.Fatalf("parseComments returned error: %v", err)
+	}
+	approved := approvedComments(comments)
+	if len(approved) != 1 || approved[0].Name != "Jane" {
+		t.Errorf("approvedComments(...) = %v, should be [Jane]", approved)
+	}
+	if comments, err := parseComments(nil); err != nil || len(comments) != 0 {
+		t.Errorf("parseComments(nil) = %v, %v, should be empty", comments, err)
+	}
+}
+
+func TestCommentQueue(t *testing.T) {
+	root, err := ioutil.TempDir("", "monsti-test")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	queue, err := readCommentQueue(root)
+	if err != nil || len(queue) != 0 {
+		t.Fatalf("readCommentQueue of missing queue = %v, %v", queue, err)
+	}
+	queue = []commentRef{{"/foo", "1"}, {"/bar", "2"}, {"/foo", "3"},
+		{"/foo", "4"}}
+	if err := writeCommentQueue(root, queue); err != nil {
+		t.Fatalf("writeCommentQueue returned error: %v", err)
+	}
+	if queue, err = readCommentQueue(root); err != nil || len(queue) != 4 {
+		t.Fatalf("readCommentQueue(...) = %v, %v", queue, err)
+	}
+	queue = removeCommentRef(queue, commentRef{"/bar", "2"})
+	if fmt.Sprint(queue) != "[{/foo 1} {/foo 3} {/foo 4}]" {
+		t.Errorf("removeCommentRef(...) = %v", queue)
+	}
+	now := time.Date(2015, 1, 10, 12, 0, 0, 0, time.UTC)
+	reads := 0
+	queued, err := getQueuedComments(queue,
+		func(nodePath string) ([]*comment, error) {
+			reads++
+			return []*comment{
+				{Id: "1", Time: now.Add(time.Minute), Status: commentPending},
+				{Id: "2", Time: now, Status: commentApproved},
+				{Id: "3", Time: now.Add(-time.Minute), Status: commentSpam}}, nil
+		})
+	if err != nil {
+		t.Fatalf("getQueuedComments returned error: %v", err)
+	}
+	if reads != 1 {
+		t.Errorf("getQueuedComments read the comments %v times, should be 1",
+			reads)
+	}
+	if len(queued) != 2 || queued[0].Id != "1" || queued[1].Id != "3" ||
+		queued[0].Node != "/foo" {
+		t.Errorf("getQueuedComments(...) = %v, should be [1 3] of /foo", queued)
+	}
+}
+
+func TestCommentMail(t *testing.T) {
+	site := util.SiteSettings{Title: "Example", BaseURL: "http://example.com",
+		EmailAddress: "site@example.com"}
+	site.Owner.Email = "owner@example.com"
+	title := service.TextField("Hello World")
+	node := &service.Node{Path: "/blog/post",
+		Fields: map[string]service.Field{"core.Title": &title}}
+	G := func(in string) string { return in }
+	comment := &comment{Name: "Jane", Email: "jane@example.com",
+		Text: "Nice post!", Status: commentPending}
+	mail := commentMail(site, G, node, comment)
+	if len(mail.To) != 1 || mail.To[0].Email != "owner@example.com" {
+		t.Errorf("commentMail should be sent to the owner, got %v", mail.To)
+	}
+	if mail.Subject != `New comment on "Hello World"` {
+		t.Errorf("commentMail has subject %q", mail.Subject)
+	}
+	body := string(mail.Body)
+	if !strings.Contains(body, "Nice post!") ||
+		!strings.Contains(body, "http://example.com/@@moderate-comments") {
+		t.Errorf("commentMail body should contain comment and moderation link:\n%v",
+			body)
+	}
+	comment.Status = commentApproved
+	body = string(commentMail(site, G, node, comment).Body)
+	if !strings.Contains(body, "http://example.com/blog/post/#comments") {
+		t.Errorf("commentMail body should link to the comment:\n%v", body)
+	}
+}
@@ -0,0 +1,85 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// computeFieldFunc asks the modules to compute a field.
+type computeFieldFunc func(args service.ComputeFieldArgs) (
+	[]service.ComputeFieldRet, error)
+
+// computeFields sets the values of the node's computed fields.
+//
+// If onRender is true, only fields computed on rendering get set,
+// otherwise only fields computed on saving. Fields no module computes
+// keep their values.
+func computeFields(node *service.Node, args service.ComputeFieldArgs,
+	onRender bool, computeFn computeFieldFunc) error {
+	var values map[string]string
+	for _, field := range node.AllFields() {
+		if field.Compute == "" || field.ComputeOnRender != onRender {
+			continue
+		}
+		if values == nil {
+			values = make(map[string]string)
+			for id, value := range node.Fields {
+				values[id] = value.String()
+			}
+		}
+		args.Node = node.Path
+		args.NodeType = node.Type.Id
+		args.Field = field.Id
+		args.Compute = field.Compute
+		args.Values = values
+		ret, err := computeFn(args)
+		if err != nil {
+			return fmt.Errorf("Could not compute field %q: %v", field.Id, err)
+		}
+		for _, r := range ret {
+			if !r.Handled {
+				continue
+			}
+			err := node.GetField(field.Id).Load(func(in interface{}) error {
+				return json.Unmarshal(r.Value, in)
+			})
+			if err != nil {
+				return fmt.Errorf("Could not load value of computed field %q: %v",
+					field.Id, err)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// computeRequestFields sets the values of the node's computed fields
+// using the modules handling the monsti.ComputeField signal.
+func computeRequestFields(c *reqContext, node *service.Node,
+	onRender bool) error {
+	return computeFields(node, service.ComputeFieldArgs{
+		Request: c.Id, Site: c.Site.Name}, onRender,
+		func(args service.ComputeFieldArgs) ([]service.ComputeFieldRet, error) {
+			var ret []service.ComputeFieldRet
+			err := c.Serv.Monsti().EmitSignal("monsti.ComputeField", args, &ret)
+			return ret, err
+		})
+}
@@ -0,0 +1,83 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestComputeFields(t *testing.T) {
+	node := service.Node{Path: "/foo", Type: &service.NodeType{
+		Id: "foo.Article",
+		Fields: []*service.NodeField{
+			{Id: "foo.Body", Type: "Text"},
+			{Id: "foo.WordCount", Type: "Text", Compute: "foo.WordCount"},
+			{Id: "foo.Now", Type: "Text", Compute: "foo.Now",
+				ComputeOnRender: true},
+			{Id: "foo.Unknown", Type: "Text", Compute: "foo.Unknown"},
+		}}}
+	if err := node.InitFields(nil, ""); err != nil {
+		t.Fatalf("Could not init fields: %v", err)
+	}
+	*(node.GetField("foo.Body").(*service.TextField)) = "Hello computed world"
+	*(node.GetField("foo.Unknown").(*service.TextField)) = "unchanged"
+	var computed []string
+	computeFn := func(args service.ComputeFieldArgs) (
+		[]service.ComputeFieldRet, error) {
+		computed = append(computed, args.Field)
+		if args.Site != "example" || args.Node != "/foo" ||
+			args.NodeType != "foo.Article" {
+			return nil, fmt.Errorf("Invalid arguments: %v", args)
+		}
+		switch args.Compute {
+		case "foo.WordCount":
+			count := len(strings.Fields(args.Values["foo.Body"]))
+			return []service.ComputeFieldRet{{},
+				{true, []byte(fmt.Sprintf(`"%v words"`, count))}}, nil
+		case "foo.Now":
+			return []service.ComputeFieldRet{{true, []byte(`"now"`)}}, nil
+		}
+		return []service.ComputeFieldRet{{}}, nil
+	}
+	err := computeFields(&node, service.ComputeFieldArgs{Site: "example"},
+		false, computeFn)
+	if err != nil {
+		t.Fatalf("computeFields returned error: %v", err)
+	}
+	if strings.Join(computed, ",") != "foo.WordCount,foo.Unknown" {
+		t.Errorf("Computed fields on save: %v", computed)
+	}
+	for id, value := range map[string]string{
+		"foo.WordCount": "3 words", "foo.Now": "", "foo.Unknown": "unchanged"} {
+		if ret := node.GetField(id).String(); ret != value {
+			t.Errorf("Value of %v is %q, should be %q", id, ret, value)
+		}
+	}
+	computed = nil
+	err = computeFields(&node, service.ComputeFieldArgs{Site: "example"},
+		true, computeFn)
+	if err != nil {
+		t.Fatalf("computeFields returned error: %v", err)
+	}
+	if ret := node.GetField("foo.Now").String(); ret != "now" {
+		t.Errorf("Value of foo.Now is %q, should be \"now\"", ret)
+	}
+}
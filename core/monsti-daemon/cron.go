@@ -0,0 +1,169 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed cron expression. Each field is a bit set of
+// the matching values.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are set if the day of the month or the weekday
+	// is not restricted. If both are restricted, days matching either
+	// match.
+	domAny, dowAny bool
+}
+
+// cronShortcuts maps shortcuts to the cron expressions they stand
+// for.
+var cronShortcuts = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// parseCron parses a cron expression of five fields (minute, hour,
+// day of the month, month and weekday) or a shortcut like @daily.
+// Fields are lists of values, ranges and steps, e.g. "*/15" or
+// "1-5,0". Sunday is both 0 and 7.
+func parseCron(expr string) (*cronSchedule, error) {
+	if shortcut, ok := cronShortcuts[strings.TrimSpace(expr)]; ok {
+		expr = shortcut
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid cron expression %q: Expected five "+
+			"fields", expr)
+	}
+	schedule := new(cronSchedule)
+	for i, field := range []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&schedule.minute, 0, 59},
+		{&schedule.hour, 0, 23},
+		{&schedule.dom, 1, 31},
+		{&schedule.month, 1, 12},
+		{&schedule.dow, 0, 7},
+	} {
+		bits, err := parseCronField(fields[i], field.min, field.max)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cron expression %q: %v", expr, err)
+		}
+		*field.bits = bits
+	}
+	if schedule.dow&(1<<7) != 0 {
+		schedule.dow |= 1
+	}
+	schedule.domAny = fields[2] == "*"
+	schedule.dowAny = fields[4] == "*"
+	return schedule, nil
+}
+
+// parseCronField returns the bit set of the values matched by the
+// field.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("Invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("Invalid value %q", part)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("Invalid value %q", part)
+				}
+			} else if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("%q is out of range %v-%v", part, min, max)
+		}
+		for value := from; value <= to; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+// matchesDay returns true iff the schedule runs at the day of the
+// given time.
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	if s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// matches returns true iff the schedule runs at the minute of the
+// given time.
+func (s *cronSchedule) matches(t time.Time) bool {
+	return s.matchesDay(t) && s.hour&(1<<uint(t.Hour())) != 0 &&
+		s.minute&(1<<uint(t.Minute())) != 0
+}
+
+// next returns the first minute after the given time the schedule
+// runs at. Returns the zero time if there is none within five years,
+// e.g. for the 31st of February.
+func (s *cronSchedule) next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := after.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0,
+				t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0,
+				t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
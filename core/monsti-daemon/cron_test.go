@@ -0,0 +1,68 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *",
+		"* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *",
+		"5-1 * * * *", "a * * * *", "@yearly"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) should fail", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// 2014-06-14 is a Saturday.
+	after := time.Date(2014, 6, 14, 10, 30, 20, 0, time.UTC)
+	tests := []struct {
+		Expr, Next string
+	}{
+		{"* * * * *", "2014-06-14 10:31"},
+		{"*/15 * * * *", "2014-06-14 10:45"},
+		{"@hourly", "2014-06-14 11:00"},
+		{"@daily", "2014-06-15 00:00"},
+		{"@weekly", "2014-06-15 00:00"},
+		{"@monthly", "2014-07-01 00:00"},
+		{"30 3 * * 1-5", "2014-06-16 03:30"},
+		{"0 8 * * 7", "2014-06-15 08:00"},
+		{"0 0 20 * 1", "2014-06-16 00:00"},
+		{"0 0 15,20 * *", "2014-06-15 00:00"},
+		{"10/20 9-11 * * *", "2014-06-14 10:50"},
+		{"0 12 29 2 *", "2016-02-29 12:00"},
+		{"0 0 31 2 *", "0001-01-01 00:00"},
+	}
+	for _, test := range tests {
+		schedule, err := parseCron(test.Expr)
+		if err != nil {
+			t.Errorf("parseCron(%q) returned error: %v", test.Expr, err)
+			continue
+		}
+		next := schedule.next(after)
+		if ret := next.Format("2006-01-02 15:04"); ret != test.Next {
+			t.Errorf("next of %q is %v, should be %v", test.Expr, ret, test.Next)
+		}
+		if !next.IsZero() && !schedule.matches(next) {
+			t.Errorf("%q should match %v", test.Expr, next)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	htmlT "html/template"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/chrneumann/htmlwidgets"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// customCodeLimit is the maximum size in bytes of each part of the
+// custom code.
+const customCodeLimit = 64 << 10
+
+// customCode is the custom code of a site injected by the master
+// template. It's stored in the site configuration as core.customcode.
+type customCode struct {
+	// CSS is put into a style element in the head.
+	CSS string
+	// JS is put into a script element at the end of the body.
+	JS string
+	// Meta maps names to contents of meta tags, e.g. for site
+	// verification.
+	Meta map[string]string
+}
+
+// metaTag is a meta tag as passed to the master template.
+type metaTag struct {
+	Name, Content string
+}
+
+// getCustomCode returns the custom code of the given site.
+func getCustomCode(s *service.Session, site string) (*customCode, error) {
+	code := new(customCode)
+	err := s.Monsti().GetSiteConfig(site, "core.customcode", code)
+	if err != nil {
+		return nil, err
+	}
+	return code, nil
+}
+
+// templateData returns the custom code as passed to the master
+// template.
+func (c *customCode) templateData() template.Context {
+	names := make([]string, 0, len(c.Meta))
+	for name := range c.Meta {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	meta := make([]metaTag, 0, len(names))
+	for _, name := range names {
+		meta = append(meta, metaTag{name, c.Meta[name]})
+	}
+	return template.Context{
+		"CSS":  htmlT.CSS(escapeEndTags(c.CSS)),
+		"JS":   htmlT.JS(escapeEndTags(c.JS)),
+		"Meta": meta,
+	}
+}
+
+// escapeEndTags escapes end tags in code so that it can't leave the
+// surrounding style or script element.
+func escapeEndTags(code string) string {
+	return strings.Replace(code, "</", `<\/`, -1)
+}
+
+var metaNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9._:-]+$`)
+
+// parseMetaTags parses lines of the form `name=content` into a map.
+func parseMetaTags(in string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, line := range strings.Split(in, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || !metaNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("Invalid meta tag %q", line)
+		}
+		tags[name] = strings.TrimSpace(parts[1])
+	}
+	return tags, nil
+}
+
+// formatMetaTags formats the meta tags as parsed by parseMetaTags.
+func formatMetaTags(tags map[string]string) string {
+	lines := make([]string, 0, len(tags))
+	for name, content := range tags {
+		lines = append(lines, name+"="+content)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// isCodeEditor returns true iff the given user is one of the site's
+// code editors. Code editors may change the custom code of the site,
+// which gets injected into all pages.
+func isCodeEditor(site *util.SiteSettings, user *service.User) bool {
+	if user == nil {
+		return false
+	}
+	for _, login := range site.CodeEditors {
+		if login == user.Login {
+			return true
+		}
+	}
+	return false
+}
+
+type customCodeFormData struct {
+	CSS, JS, Meta string
+}
+
+// CustomCode handles the form to change the site's custom code.
+func (h *nodeHandler) CustomCode(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	// CSS and meta tags may inject scripts as well as JavaScript.
+	if !isCodeEditor(c.Site, c.UserSession.User) {
+		c.ErrorMessage = G("Only code editors may change the custom code.")
+		h.serveErrorPage(c, http.StatusForbidden)
+		return nil
+	}
+	code, err := getCustomCode(c.Serv, c.Site.Name)
+	if err != nil {
+		return fmt.Errorf("Could not get custom code: %v", err)
+	}
+	data := customCodeFormData{
+		CSS:  code.CSS,
+		JS:   code.JS,
+		Meta: formatMetaTags(code.Meta)}
+	form := htmlwidgets.NewForm(&data)
+	form.AddWidget(new(htmlwidgets.TextAreaWidget), "CSS", G("CSS"),
+		G("Added to the head of each page."))
+	form.AddWidget(new(htmlwidgets.TextAreaWidget), "JS", G("JavaScript"),
+		G("Added to the end of each page."))
+	form.AddWidget(new(htmlwidgets.TextAreaWidget), "Meta", G("Meta tags"),
+		G("One tag per line, e.g. google-site-verification=abc"))
+
+	c.Req.ParseForm()
+	saved := false
+	switch c.Req.Method {
+	case "GET":
+		_, saved = c.Req.Form["saved"]
+	case "POST":
+		if !form.Fill(c.Req.Form) {
+			break
+		}
+		meta, err := parseMetaTags(data.Meta)
+		valid := true
+		if err != nil {
+			form.AddError("Meta", G("Please use one name=content pair per line."))
+			valid = false
+		}
+		for _, part := range []struct{ Id, Value string }{
+			{"CSS", data.CSS}, {"JS", data.JS}, {"Meta", data.Meta}} {
+			if len(part.Value) > customCodeLimit {
+				form.AddError(part.Id, G("Too long."))
+				valid = false
+			}
+		}
+		if !valid {
+			break
+		}
+		code.CSS = data.CSS
+		code.JS = data.JS
+		code.Meta = meta
+		if err := c.Serv.Monsti().SetSiteConfig(c.Site.Name, "core.customcode",
+			code); err != nil {
+			return fmt.Errorf("Could not set custom code: %v", err)
+		}
+		http.Redirect(c.Res, c.Req, "@@custom-code?saved", http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+
+	body, err := h.Renderer.Render("actions/custom-code",
+		template.Context{
+			"Saved": saved,
+			"Form":  form.RenderData()}, c.UserSession.Locale,
+		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render custom code form: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("Custom code"),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
@@ -0,0 +1,83 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestParseMetaTags(t *testing.T) {
+	tests := []struct {
+		In   string
+		Tags map[string]string
+		Err  bool
+	}{
+		{"", map[string]string{}, false},
+		{"google-site-verification=abc=\n\n p:domain_verify = 123 ",
+			map[string]string{"google-site-verification": "abc=",
+				"p:domain_verify": "123"}, false},
+		{"foo", nil, true},
+		{`foo" onload="x=1`, nil, true},
+	}
+	for i, v := range tests {
+		ret, err := parseMetaTags(v.In)
+		if (err != nil) != v.Err || !v.Err && !reflect.DeepEqual(ret, v.Tags) {
+			t.Errorf("%v: parseMetaTags(%q) = %v, %v, should be %v (error: %v)",
+				i, v.In, ret, err, v.Tags, v.Err)
+		}
+	}
+}
+
+func TestEscapeEndTags(t *testing.T) {
+	in := `alert("</script><script>evil()</SCRIPT>")`
+	expected := `alert("<\/script><script>evil()<\/SCRIPT>")`
+	if ret := escapeEndTags(in); ret != expected {
+		t.Errorf("escapeEndTags(%q) = %q, should be %q", in, ret, expected)
+	}
+}
+
+func TestCustomCodeEditors(t *testing.T) {
+	site := &util.SiteSettings{Name: "foo", CodeEditors: []string{"alice"}}
+	if isCodeEditor(site, nil) {
+		t.Errorf("Anonymous users should not be code editors")
+	}
+	if !isCodeEditor(site, &service.User{Login: "alice"}) {
+		t.Errorf("alice should be a code editor")
+	}
+	h := &nodeHandler{Log: log.New(ioutil.Discard, "", 0)}
+	req, _ := http.NewRequest("POST", "http://foo.com/@@custom-code",
+		strings.NewReader("CSS=body{}"))
+	rec := httptest.NewRecorder()
+	c := &reqContext{Req: req, Res: rec, Site: site,
+		UserSession: &service.UserSession{User: &service.User{Login: "bob"}}}
+	if err := h.CustomCode(c); err != nil {
+		t.Fatalf("CustomCode returned error: %v", err)
+	}
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Status for other users is %v, should be %v", rec.Code,
+			http.StatusForbidden)
+	}
+}
@@ -25,6 +25,8 @@ import (
 	"bytes"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"log/syslog"
 	"net/http"
@@ -32,7 +34,9 @@ import (
 	"os/exec"
 	"path/filepath"
 	"sync"
+	"time"
 
+	"github.com/chrneumann/mimemail"
 	"pkg.monsti.org/monsti/api/service"
 	"pkg.monsti.org/monsti/api/util"
 
@@ -45,17 +49,70 @@ type settings struct {
 	Monsti util.MonstiSettings
 	// Listen is the host and port to listen for incoming HTTP connections.
 	Listen string
+	// ListenTLS is the host and port to listen for incoming HTTPS
+	// connections, e.g. ":443". The certificates are configured per
+	// site.
+	ListenTLS string
+	// TrustedProxies are the addresses or CIDR networks of reverse
+	// proxies whose X-Forwarded-For and X-Forwarded-Proto headers are
+	// trusted, e.g. "127.0.0.1".
+	TrustedProxies []string
 	// List of modules to be activated.
 	Modules []string
 	Config  struct {
 		NodeTypes  map[string]*service.NodeType
 		NodeFields map[string]*service.NodeField
+		// ConfigSchemas maps module ids to their configuration schemas.
+		ConfigSchemas map[string]*service.ConfigSchema
+		// TemplateFuncs maps names to the template functions registered by
+		// modules.
+		TemplateFuncs map[string]*service.TemplateFunc
+		// Shortcodes maps names to the shortcodes registered by modules.
+		Shortcodes map[string]*service.Shortcode
+		// Tasks maps ids to the recurring tasks registered by modules.
+		Tasks map[string]*service.Task
 	}
 	Mail struct {
+		// Transport delivers the mails unless configured per site.
+		Transport util.MailTransport
+		// Host, Username and Password configure an SMTP transport if
+		// Transport is not set.
+		//
+		// Deprecated: Use Transport.
 		Host     string
 		Username string
 		Password string
 		Debug    bool
+		// Queue configures the queue of outgoing mails.
+		Queue mailQueueSettings
+	}
+	Capture struct {
+		// URLs of the requests to capture, e.g. "example.com/foo/".
+		URLs []string
+	}
+	Health struct {
+		// Interval between the health analyses of all sites, e.g. "24h".
+		// Defaults to 24 hours. Zero disables the analysis.
+		Interval string
+	}
+	// Backup configures the scheduled backups of all sites.
+	Backup backupSettings
+	// Jobs configures the job queue of modules.
+	Jobs jobQueueSettings
+	// Timeout limits the time to process a request, e.g. "30s".
+	// Defaults to one minute. Zero disables the limit. Requests
+	// transferring files, e.g. uploads, are not limited.
+	Timeout string
+	// AccessLog configures the HTTP access log.
+	AccessLog accessLogSettings
+	// Hooks run around operations.
+	Hooks struct {
+		// Publish hooks run when saving public nodes in the editor.
+		Publish util.OperationHooks
+		// Poster hooks generate poster frames of uploaded videos. They get
+		// the path to the video as MONSTI_INPUT and write the poster image
+		// to MONSTI_OUTPUT.
+		Poster []util.Hook
 	}
 }
 
@@ -77,19 +134,32 @@ func (s moduleLog) Write(p []byte) (int, error) {
 
 func main() {
 	useSyslog := flag.Bool("syslog", false, "use syslog")
+	replay := flag.String("replay", "",
+		"replay the captured request and write the response to stdout")
+	exportUsersSite := flag.String("export-users", "",
+		"write the users of the given site to stdout")
+	importUsersSite := flag.String("import-users", "",
+		"import users read from stdin into the given site")
+	usersFormat := flag.String("users-format", "csv",
+		"format of exported and imported users (csv or json)")
+	invite := flag.Bool("invite", false,
+		"send invitation mails to imported users")
 
 	flag.Parse()
 
+	// Log entries are kept for monsti-ctl, see GetLog.
+	logs := new(logBuffer)
 	var logger *log.Logger
 	if *useSyslog {
-		var err error
-		logger, err = syslog.NewLogger(syslog.LOG_INFO|syslog.LOG_DAEMON, 0)
+		writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "")
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Could not setup syslog logger: %v\n", err)
 			os.Exit(1)
 		}
+		logger = log.New(io.MultiWriter(writer, logs), "", 0)
 	} else {
-		logger = log.New(os.Stderr, "monsti ", log.LstdFlags)
+		logger = log.New(io.MultiWriter(os.Stderr, logs), "monsti ",
+			log.LstdFlags)
 	}
 
 	// Load configuration
@@ -106,18 +176,101 @@ func main() {
 	if err := (&settings).Monsti.LoadSiteSettings(); err != nil {
 		logger.Fatal("Could not load site settings: ", err)
 	}
+	for name, site := range settings.Monsti.Sites {
+		if _, err := newDKIMSigner(site); err != nil {
+			logger.Fatalf("Invalid DKIM settings of site %q: %v", name, err)
+		}
+		if _, err := settings.mailTransport(name); err != nil &&
+			!settings.Mail.Debug {
+			if err != errMissingSMTPHost {
+				logger.Fatalf("Invalid mail transport of site %q: %v", name, err)
+			}
+			logger.Printf("Site %q has no mail transport configured, mails "+
+				"will not be sent", name)
+		}
+	}
 
 	gettext.DefaultLocales.Domain = "monsti-daemon"
 	gettext.DefaultLocales.LocaleDir = settings.Monsti.Directories.Locale
+	availableLocales = settings.Monsti.Locales
+	logger.Printf("Available locales: %v", availableLocales)
+
+	if len(*replay) > 0 {
+		bundle, err := readCaptureBundle(*replay)
+		if err != nil {
+			logger.Fatalf("Could not read capture: %v", err)
+		}
+		handler := nodeHandler{
+			Renderer: template.Renderer{Root: settings.Monsti.GetTemplatesPath()},
+			Settings: &settings,
+			Log:      logger,
+		}
+		if err := replayCapture(bundle, &handler, os.Stdout); err != nil {
+			logger.Fatalf("Could not replay capture: %v", err)
+		}
+		return
+	}
+
+	if len(*exportUsersSite) > 0 {
+		users, err := getUserDatabase(
+			settings.Monsti.GetSiteDataPath(*exportUsersSite))
+		if err != nil {
+			logger.Fatalf("Could not get user database: %v", err)
+		}
+		if err := exportUsers(users, *usersFormat, os.Stdout); err != nil {
+			logger.Fatalf("Could not export users: %v", err)
+		}
+		return
+	}
+
+	if len(*importUsersSite) > 0 {
+		content, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			logger.Fatalf("Could not read users: %v", err)
+		}
+		records, err := parseUsers(content, *usersFormat)
+		if err != nil {
+			logger.Fatalf("Could not parse users: %v", err)
+		}
+		monsti := &MonstiService{Settings: &settings, Logger: logger}
+		monsti.mails, err = newMailQueue(&settings, monsti.deliverMail, logger)
+		if err != nil {
+			logger.Fatalf("Could not setup mail queue: %v", err)
+		}
+		created, updated, err := importSiteUsers(&settings, *importUsersSite,
+			records, *invite, func(mail *mimemail.Mail) error {
+				return monsti.SendSiteMail(&SendSiteMailArgs{*importUsersSite,
+					mail, nil}, nil)
+			})
+		if err != nil {
+			logger.Fatalf("Could not import users: %v", err)
+		}
+		logger.Printf("Imported users: %v created, %v updated", created, updated)
+		return
+	}
 
 	var waitGroup sync.WaitGroup
 
+	service.SetupTracing("monsti-daemon", settings.Monsti.Tracing.Endpoint,
+		logger)
+
 	// Start service handler
 	logger.Println("Setting up service")
 	monstiPath := settings.Monsti.GetServicePath(service.MonstiService.String())
 	monsti := new(MonstiService)
 	monsti.Settings = &settings
 	monsti.Logger = logger
+	monsti.status.start = time.Now()
+	monsti.logs = logs
+	mails, err := newMailQueue(&settings, monsti.deliverMail, logger)
+	if err != nil {
+		logger.Fatalf("Could not setup mail queue: %v", err)
+	}
+	monsti.mails = mails
+	go monsti.mails.Run()
+	if monsti.jobs, err = newJobQueue(&settings, logger); err != nil {
+		logger.Fatalf("Could not setup job queue: %v", err)
+	}
 	provider := service.NewProvider("Monsti", monsti)
 	provider.Logger = logger
 	if err := provider.Listen(monstiPath); err != nil {
@@ -146,6 +299,11 @@ func main() {
 
 	sessions := service.NewSessionPool(1, monstiPath)
 	renderer := template.Renderer{Root: settings.Monsti.GetTemplatesPath()}
+	if !settings.Monsti.Development {
+		renderer.Cache = new(template.Cache)
+	} else {
+		logger.Printf("Development mode enabled")
+	}
 
 	// Init core functionality
 	session, err := sessions.New()
@@ -158,6 +316,9 @@ func main() {
 	if err := initBlog(&settings, session, logger, &renderer); err != nil {
 		logger.Fatalf("Could not init blog: %v", err)
 	}
+	if err := initConfigSchemas(&settings, session, logger); err != nil {
+		logger.Fatalf("Could not init configuration schemas: %v", err)
+	}
 
 	// Wait for signals
 	go func() {
@@ -168,33 +329,108 @@ func main() {
 		}
 	}()
 
+	go monsti.checkSites()
+	go scheduleHealthAnalysis(&settings, sessions, logger)
+	go scheduleBackups(&settings, logger)
+	go scheduleFormStateCleanup(&settings, logger)
+	go scheduleNotFoundFlush(&settings, logger)
+	go scheduleSearchQueriesFlush(&settings, logger)
+
 	// Setup up httpd
 	handler := nodeHandler{
 		Renderer: renderer,
 		Settings: &settings,
 		Log:      logger,
 		Sessions: sessions,
+		Routes:   &monsti.routes,
 	}
 	monsti.Handler = &handler
+	go monsti.scheduleTasks()
+	handler.Timeout = time.Minute
+	if settings.Timeout != "" {
+		handler.Timeout, err = time.ParseDuration(settings.Timeout)
+		if err != nil {
+			logger.Fatalf("Invalid request timeout: %v", err)
+		}
+	}
+	if handler.TrustedProxies, err = parseNetworks(
+		settings.TrustedProxies); err != nil {
+		logger.Fatalf("Invalid trusted proxies: %v", err)
+	}
 
+	if err := checkMounts(settings.Monsti.Sites); err != nil {
+		logger.Fatalf("Invalid site mounts: %v", err)
+	}
+	hosts, aliases, err := newHostTables(settings.Monsti.Sites)
+	if err != nil {
+		logger.Fatalf("Invalid site hosts: %v", err)
+	}
+	handler.Hosts = hosts
+	if handler.RateLimits, err = newRateLimiter(
+		settings.Monsti.Sites); err != nil {
+		logger.Fatalf("Invalid rate limits: %v", err)
+	}
+	if handler.AdminAccess, err = newAdminAccess(
+		settings.Monsti.Sites); err != nil {
+		logger.Fatalf("Invalid admin access: %v", err)
+	}
+	fallback := http.NewServeMux()
+	fallback.Handle(assetsPrefix, &assetHandler{Settings: &settings,
+		Sessions: sessions, Log: logger})
+	fallback.Handle("/", &handler)
+	router := &siteRouter{Hosts: hosts, Aliases: aliases, Settings: &settings,
+		Sites: make(map[string]http.Handler), Default: fallback}
+	for site_title := range settings.Monsti.Sites {
+		siteMux := http.NewServeMux()
+		siteMux.Handle("/site-static/", http.FileServer(http.Dir(
+			filepath.Dir(settings.Monsti.GetSiteStaticsPath(site_title)))))
+		siteMux.Handle(assetsPrefix, &assetHandler{Settings: &settings,
+			Site: site_title, Sessions: sessions, Log: logger})
+		siteMux.Handle("/", &handler)
+		router.Sites[site_title] = siteMux
+	}
 	http.Handle("/static/", http.FileServer(http.Dir(
 		filepath.Dir(settings.Monsti.GetStaticsPath()))))
-	handler.Hosts = make(map[string]string)
-	for site_title, site := range settings.Monsti.Sites {
-		for _, host := range site.Hosts {
-			handler.Hosts[host] = site_title
-			http.Handle(host+"/site-static/", http.FileServer(http.Dir(
-				filepath.Dir(settings.Monsti.GetSiteStaticsPath(site_title)))))
+	http.Handle("/", router)
+	var httpHandler http.Handler = http.DefaultServeMux
+	if settings.AccessLog.Directory != "" {
+		if err := os.MkdirAll(settings.AccessLog.Directory, 0700); err != nil {
+			logger.Fatalf("Could not create access log directory: %v", err)
+		}
+		// Redirected requests to aliases are logged for their sites.
+		logHosts := make(hostTable)
+		for _, table := range []hostTable{aliases, hosts} {
+			for pattern, site := range table {
+				logHosts[pattern] = site
+			}
 		}
+		accessLog := &accessLog{Settings: settings.AccessLog,
+			Hosts: logHosts, Log: logger}
+		httpHandler = accessLog.Handler(httpHandler)
 	}
-	http.Handle("/", &handler)
 	waitGroup.Add(1)
 	go func() {
-		if err := http.ListenAndServe(settings.Listen, nil); err != nil {
+		if err := http.ListenAndServe(settings.Listen, httpHandler); err != nil {
 			logger.Fatal("HTTP Listener failed: ", err)
 		}
 		waitGroup.Done()
 	}()
+	if settings.ListenTLS != "" {
+		certs, err := loadSiteCertificates(&settings)
+		if err != nil {
+			logger.Fatalf("Could not load certificates: %v", err)
+		}
+		server := &http.Server{Addr: settings.ListenTLS, Handler: httpHandler,
+			TLSConfig: siteTLSConfig(hosts, aliases, certs)}
+		waitGroup.Add(1)
+		go func() {
+			if err := server.ListenAndServeTLS("", ""); err != nil {
+				logger.Fatal("HTTPS Listener failed: ", err)
+			}
+			waitGroup.Done()
+		}()
+		logger.Printf("Listening for HTTPS connections on %q", settings.ListenTLS)
+	}
 
 	logger.Printf("Monsti is up and running, listening on %q", settings.Listen)
 	waitGroup.Wait()
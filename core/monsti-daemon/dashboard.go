@@ -0,0 +1,374 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// maxFailedSignals is the number of failed signals kept for the
+// dashboard.
+const maxFailedSignals = 20
+
+// systemStatus collects the state of the Monsti instance.
+type systemStatus struct {
+	mutex sync.Mutex
+	start time.Time
+	// modules maps the names of initialized modules to the time they
+	// became ready.
+	modules       map[string]time.Time
+	failedSignals []service.FailedSignal
+}
+
+// moduleReady records that the named module finished its
+// initialization.
+func (s *systemStatus) moduleReady(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.modules == nil {
+		s.modules = make(map[string]time.Time)
+	}
+	s.modules[name] = time.Now()
+}
+
+// signalFailed records a signal answered with the given error.
+func (s *systemStatus) signalFailed(name, err string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	failed := service.FailedSignal{Time: time.Now(), Signal: name, Error: err}
+	s.failedSignals = append([]service.FailedSignal{failed}, s.failedSignals...)
+	if len(s.failedSignals) > maxFailedSignals {
+		s.failedSignals = s.failedSignals[:maxFailedSignals]
+	}
+}
+
+// get returns the status. Configured modules which did not finish
+// their initialization are included as not ready.
+func (s *systemStatus) get(modules []string) *service.SystemStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ret := &service.SystemStatus{Start: s.start}
+	names := append([]string{}, modules...)
+	for name := range s.modules {
+		if !stringInSlice(name, modules) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		since, ready := s.modules[name]
+		ret.Modules = append(ret.Modules, service.ModuleStatus{
+			Name: name, Ready: ready, Since: since})
+	}
+	ret.FailedSignals = append([]service.FailedSignal{}, s.failedSignals...)
+	return ret
+}
+
+// stringInSlice returns true if the slice contains the string.
+func stringInSlice(str string, slice []string) bool {
+	for _, entry := range slice {
+		if entry == str {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *MonstiService) GetSystemStatus(args int,
+	reply *service.SystemStatus) error {
+	*reply = *i.status.get(i.Settings.Modules)
+	mails, err := i.mails.List()
+	if err != nil {
+		return err
+	}
+	reply.Mails.Pending, reply.Mails.Sent, reply.Mails.Failed = countMails(mails)
+	jobs, err := i.jobs.List()
+	if err != nil {
+		return err
+	}
+	reply.Jobs.Queued, reply.Jobs.Running, reply.Jobs.Dead = countJobs(jobs)
+	reply.Tasks = i.taskStatus(time.Now())
+	return nil
+}
+
+// nodeTypeCount is the number of nodes of a node type.
+type nodeTypeCount struct {
+	Type, Name string
+	Count      int
+}
+
+type nodeTypeCountsByCount []nodeTypeCount
+
+func (s nodeTypeCountsByCount) Len() int      { return len(s) }
+func (s nodeTypeCountsByCount) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s nodeTypeCountsByCount) Less(i, j int) bool {
+	return s[i].Count > s[j].Count ||
+		(s[i].Count == s[j].Count && s[i].Type < s[j].Type)
+}
+
+// nodeEdit is an event of the timeline of a node.
+type nodeEdit struct {
+	Path  string
+	Event *service.NodeEvent
+}
+
+type nodeEditsByTime []nodeEdit
+
+func (s nodeEditsByTime) Len() int      { return len(s) }
+func (s nodeEditsByTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s nodeEditsByTime) Less(i, j int) bool {
+	return s[i].Event.Time.After(s[j].Event.Time)
+}
+
+// maxRecentEdits is the number of edits shown on the dashboard.
+const maxRecentEdits = 10
+
+// siteStatistics are the node counts and recent edits of a site.
+type siteStatistics struct {
+	// Nodes are the node counts per type, most frequent types first.
+	Nodes []nodeTypeCount
+	// Edits are the latest node creations, changes and renames, newest
+	// first.
+	Edits []nodeEdit
+}
+
+// getSiteStatistics returns the statistics of the nodes below root
+// (including root). Type names are translated to the given locale.
+func getSiteStatistics(root, locale string, getNodeFn getNodeFunc,
+	getChildrenFn getChildrenFunc,
+	getEventsFn func(nodePath string) ([]*service.NodeEvent, error)) (
+	*siteStatistics, error) {
+	counts := make(map[string]*nodeTypeCount)
+	stats := &siteStatistics{Nodes: make([]nodeTypeCount, 0),
+		Edits: make([]nodeEdit, 0)}
+	err := walkNodes(root, getNodeFn, getChildrenFn,
+		func(node *service.Node) error {
+			if node.Type != nil {
+				count, ok := counts[node.Type.Id]
+				if !ok {
+					count = &nodeTypeCount{Type: node.Type.Id,
+						Name: node.Type.GetLocalName(locale)}
+					counts[node.Type.Id] = count
+				}
+				count.Count++
+			}
+			events, err := getEventsFn(node.Path)
+			if err != nil {
+				return fmt.Errorf("Could not get events of %q: %v", node.Path, err)
+			}
+			for _, event := range events {
+				switch event.Type {
+				case service.NodeCreatedEvent, service.NodeChangedEvent,
+					service.NodeRenamedEvent:
+					stats.Edits = append(stats.Edits, nodeEdit{node.Path, event})
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	for _, count := range counts {
+		stats.Nodes = append(stats.Nodes, *count)
+	}
+	sort.Sort(nodeTypeCountsByCount(stats.Nodes))
+	sort.Stable(nodeEditsByTime(stats.Edits))
+	if len(stats.Edits) > maxRecentEdits {
+		stats.Edits = stats.Edits[:maxRecentEdits]
+	}
+	return stats, nil
+}
+
+// storageUsage is the size of an entry of a site's data directory.
+type storageUsage struct {
+	Name string
+	Size int64
+}
+
+type storageUsagesBySize []storageUsage
+
+func (s storageUsagesBySize) Len() int      { return len(s) }
+func (s storageUsagesBySize) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s storageUsagesBySize) Less(i, j int) bool {
+	return s[i].Size > s[j].Size ||
+		(s[i].Size == s[j].Size && s[i].Name < s[j].Name)
+}
+
+// getStorageUsage returns the size of the entries of the given
+// directory, largest first, and their total size.
+func getStorageUsage(dir string) ([]storageUsage, int64, error) {
+	entries := make(map[string]int64)
+	var total int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name := strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+		entries[name] += info.Size()
+		total += info.Size()
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, fmt.Errorf("Could not get storage usage: %v", err)
+	}
+	usage := make([]storageUsage, 0, len(entries))
+	for name, size := range entries {
+		usage = append(usage, storageUsage{name, size})
+	}
+	sort.Sort(storageUsagesBySize(usage))
+	return usage, total, nil
+}
+
+// dashboardCacheTime is the time the site statistics and storage
+// usage shown on the dashboard get cached, as computing them walks all
+// nodes and files of the site.
+const dashboardCacheTime = 5 * time.Minute
+
+// siteUsage holds the cached statistics and storage usage of a site.
+type siteUsage struct {
+	Statistics   *siteStatistics
+	Storage      []storageUsage
+	StorageTotal int64
+	// Updated is the time the usage has been computed.
+	Updated time.Time
+}
+
+var (
+	// siteUsages caches the usage of the sites by the site name and
+	// the locale of the type names.
+	siteUsages      = make(map[string]*siteUsage)
+	siteUsagesMutex sync.Mutex
+)
+
+// getSiteUsage returns the cached usage of the site for the given
+// locale, calling computeFn to compute it if it's missing or older
+// than dashboardCacheTime.
+func getSiteUsage(site, locale string, now time.Time,
+	computeFn func() (*siteUsage, error)) (*siteUsage, error) {
+	key := site + " " + locale
+	siteUsagesMutex.Lock()
+	usage := siteUsages[key]
+	siteUsagesMutex.Unlock()
+	if usage != nil && now.Sub(usage.Updated) < dashboardCacheTime {
+		return usage, nil
+	}
+	usage, err := computeFn()
+	if err != nil {
+		return nil, err
+	}
+	usage.Updated = now
+	siteUsagesMutex.Lock()
+	siteUsages[key] = usage
+	siteUsagesMutex.Unlock()
+	return usage, nil
+}
+
+// filterTasks returns the tasks that run for the given site or
+// without site.
+func filterTasks(tasks []service.TaskStatus, site string) []service.TaskStatus {
+	var ret []service.TaskStatus
+	for _, task := range tasks {
+		if task.Site == "" || task.Site == site {
+			ret = append(ret, task)
+		}
+	}
+	return ret
+}
+
+// Dashboard shows the state of the Monsti instance and statistics of
+// the site.
+func (h *nodeHandler) Dashboard(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	status, err := c.Serv.Monsti().GetSystemStatus()
+	if err != nil {
+		return fmt.Errorf("Could not get system status: %v", err)
+	}
+	usage, err := getSiteUsage(c.Site.Name, c.UserSession.Locale,
+		time.Now().UTC(), func() (*siteUsage, error) {
+			stats, err := getSiteStatistics("/", c.UserSession.Locale,
+				func(nodePath string) (*service.Node, error) {
+					return c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
+				},
+				func(nodePath string) ([]*service.Node, error) {
+					return c.Serv.Monsti().GetChildren(c.Site.Name, nodePath)
+				},
+				func(nodePath string) ([]*service.NodeEvent, error) {
+					return c.Serv.Monsti().GetNodeEvents(c.Site.Name, nodePath)
+				})
+			if err != nil {
+				return nil, fmt.Errorf("Could not get site statistics: %v", err)
+			}
+			storage, total, err := getStorageUsage(
+				h.Settings.Monsti.GetSiteDataPath(c.Site.Name))
+			if err != nil {
+				return nil, err
+			}
+			return &siteUsage{Statistics: stats, Storage: storage,
+				StorageTotal: total}, nil
+		})
+	if err != nil {
+		return err
+	}
+	health, err := readHealthReport(h.Settings, c.Site.Name)
+	if err != nil {
+		return err
+	}
+	ui, err := getAdminUI(c.Serv, c.Site.Name, c.UserSession.User)
+	if err != nil {
+		return err
+	}
+	body, err := h.Renderer.Render("actions/dashboard", template.Context{
+		"AdminUI":      ui,
+		"Status":       status,
+		"Statistics":   usage.Statistics,
+		"Storage":      usage.Storage,
+		"StorageTotal": usage.StorageTotal,
+		"UsageUpdated": usage.Updated,
+		"Health":       health,
+		"Tasks":        filterTasks(status.Tasks, c.Site.Name)},
+		c.UserSession.Locale,
+		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render dashboard: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("Dashboard"),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
@@ -0,0 +1,206 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/template"
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestSystemStatus(t *testing.T) {
+	var status systemStatus
+	status.moduleReady("extra")
+	status.moduleReady("example-module")
+	for i := 0; i < maxFailedSignals+1; i++ {
+		status.signalFailed("foo.Signal", "failed")
+	}
+	status.signalFailed("foo.Last", "last")
+	ret := status.get([]string{"example-module", "other-module"})
+	modules := make([]string, 0)
+	for _, module := range ret.Modules {
+		if module.Ready == module.Since.IsZero() {
+			t.Errorf("Module %q is ready %v, since %v", module.Name, module.Ready,
+				module.Since)
+		}
+		modules = append(modules, module.Name)
+	}
+	expected := []string{"example-module", "extra", "other-module"}
+	if !reflect.DeepEqual(modules, expected) {
+		t.Errorf("Modules are %v, should be %v", modules, expected)
+	}
+	if ret.Modules[2].Ready {
+		t.Errorf("other-module should not be ready")
+	}
+	if len(ret.FailedSignals) != maxFailedSignals ||
+		ret.FailedSignals[0].Signal != "foo.Last" {
+		t.Errorf("Failed signals are %v, should be latest %v, newest first",
+			ret.FailedSignals, maxFailedSignals)
+	}
+}
+
+func TestGetSiteStatistics(t *testing.T) {
+	document := &service.NodeType{Id: "core.Document",
+		Name: map[string]string{"en": "Document"}}
+	image := &service.NodeType{Id: "core.Image"}
+	nodes := map[string]*service.Node{
+		"/":          {Path: "/", Type: document},
+		"/foo":       {Path: "/foo", Type: document},
+		"/foo/image": {Path: "/foo/image", Type: image},
+		"/bar":       {Path: "/bar", Type: document},
+	}
+	start := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := map[string][]*service.NodeEvent{
+		"/foo": {
+			{Time: start, Type: service.NodeCreatedEvent},
+			{Time: start.Add(2 * time.Hour), Type: service.NodeChangedEvent},
+			{Time: start.Add(3 * time.Hour), Type: service.ReferenceAddedEvent}},
+		"/bar": {{Time: start.Add(time.Hour), Type: service.NodeCreatedEvent}},
+	}
+	for i := 0; i < maxRecentEdits; i++ {
+		events["/foo/image"] = append(events["/foo/image"], &service.NodeEvent{
+			Time: start.Add(-time.Duration(i+1) * time.Hour),
+			Type: service.NodeChangedEvent})
+	}
+	stats, err := getSiteStatistics("/", "de",
+		func(nodePath string) (*service.Node, error) {
+			return nodes[nodePath], nil
+		},
+		func(nodePath string) ([]*service.Node, error) {
+			children := make([]*service.Node, 0)
+			for _, childPath := range []string{"/foo", "/foo/image", "/bar"} {
+				if path.Dir(childPath) == nodePath {
+					children = append(children, nodes[childPath])
+				}
+			}
+			return children, nil
+		},
+		func(nodePath string) ([]*service.NodeEvent, error) {
+			return events[nodePath], nil
+		})
+	if err != nil {
+		t.Fatalf("getSiteStatistics returned error: %v", err)
+	}
+	expectedNodes := []nodeTypeCount{
+		{"core.Document", "Document", 3}, {"core.Image", "core.Image", 1}}
+	if !reflect.DeepEqual(stats.Nodes, expectedNodes) {
+		t.Errorf("Node counts are %v, should be %v", stats.Nodes, expectedNodes)
+	}
+	if len(stats.Edits) != maxRecentEdits {
+		t.Fatalf("Got %v edits, should be %v", len(stats.Edits), maxRecentEdits)
+	}
+	for i, expected := range []nodeEdit{
+		{"/foo", events["/foo"][1]}, {"/bar", events["/bar"][0]},
+		{"/foo", events["/foo"][0]}, {"/foo/image", events["/foo/image"][0]},
+	} {
+		if !reflect.DeepEqual(stats.Edits[i], expected) {
+			t.Errorf("Edit %v is %v, should be %v", i, stats.Edits[i], expected)
+		}
+	}
+}
+
+func TestGetStorageUsage(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/nodes/node.json":          "12345",
+		"/nodes/foo/node.json":      "123",
+		"/site-static/css/site.css": "1234567890",
+		"/health.json":              "12",
+	}, "TestGetStorageUsage")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	usage, total, err := getStorageUsage(root)
+	if err != nil {
+		t.Fatalf("getStorageUsage returned error: %v", err)
+	}
+	expected := []storageUsage{
+		{"site-static", 10}, {"nodes", 8}, {"health.json", 2}}
+	if !reflect.DeepEqual(usage, expected) || total != 20 {
+		t.Errorf("getStorageUsage(...) = %v, %v, should be %v, 20", usage,
+			total, expected)
+	}
+	usage, total, err = getStorageUsage(root + "/unknown")
+	if err != nil || len(usage) != 0 || total != 0 {
+		t.Errorf("getStorageUsage of missing directory = %v, %v, %v, should be empty",
+			usage, total, err)
+	}
+}
+
+func TestGetSiteUsage(t *testing.T) {
+	now := time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)
+	computed := 0
+	computeFn := func() (*siteUsage, error) {
+		computed++
+		return &siteUsage{StorageTotal: int64(computed)}, nil
+	}
+	tests := []struct {
+		Locale string
+		Time   time.Time
+		Total  int64
+	}{
+		{"en", now, 1},
+		{"en", now.Add(time.Minute), 1},
+		{"de", now.Add(time.Minute), 2},
+		{"en", now.Add(dashboardCacheTime), 3},
+	}
+	for i, test := range tests {
+		usage, err := getSiteUsage("TestGetSiteUsage", test.Locale, test.Time,
+			computeFn)
+		if err != nil {
+			t.Fatalf("getSiteUsage returned error: %v", err)
+		}
+		if usage.StorageTotal != test.Total {
+			t.Errorf("Test %v: Usage has been computed for the %v. time, should "+
+				"be the %v. time", i, usage.StorageTotal, test.Total)
+		}
+	}
+}
+
+func TestDashboardAdminUI(t *testing.T) {
+	renderer := template.Renderer{Root: "../../templates"}
+	edit := nodeEdit{"/foo", &service.NodeEvent{Type: service.NodeChangedEvent}}
+	tests := []struct {
+		UI    adminUI
+		Shown bool
+	}{
+		{nil, true},
+		{adminUI{"dashboard": true}, false},
+	}
+	for i, test := range tests {
+		body, err := renderer.Render("actions/dashboard", template.Context{
+			"AdminUI":    test.UI,
+			"Status":     &service.SystemStatus{},
+			"Statistics": &siteStatistics{Edits: []nodeEdit{edit}},
+			"Health":     &healthReport{}}, "en", "")
+		if err != nil {
+			t.Fatalf("%v: Could not render dashboard: %v", i, err)
+		}
+		for _, link := range []string{"@@health", "@@mails", "@@history"} {
+			if strings.Contains(body, link) != test.Shown {
+				t.Errorf("%v: Link to %v shown: %v, should be %v", i, link,
+					!test.Shown, test.Shown)
+			}
+		}
+	}
+}
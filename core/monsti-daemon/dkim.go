@@ -0,0 +1,181 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// dkimHeaders are the headers signed if present.
+var dkimHeaders = []string{"From", "Reply-To", "Subject", "Date", "To", "Cc",
+	"Message-Id", "Mime-Version", "Content-Type", "Content-Transfer-Encoding",
+	"List-Unsubscribe", "List-Unsubscribe-Post"}
+
+// dkimSigner signs mails using DKIM (RFC 6376) with the rsa-sha256
+// algorithm and relaxed canonicalization.
+type dkimSigner struct {
+	Domain, Selector string
+	Key              *rsa.PrivateKey
+}
+
+// newDKIMSigner returns the signer configured for the site or nil if
+// the site's mails should not be signed.
+func newDKIMSigner(site util.SiteSettings) (*dkimSigner, error) {
+	config := site.DKIM
+	if config.PrivateKey == "" {
+		return nil, nil
+	}
+	if config.Domain == "" || config.Selector == "" {
+		return nil, fmt.Errorf("DKIM domain and selector must be set")
+	}
+	block, _ := pem.Decode([]byte(config.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("DKIM private key is not PEM encoded")
+	}
+	var key *rsa.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		var err error
+		if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("Could not parse DKIM private key: %v", err)
+		}
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse DKIM private key: %v", err)
+		}
+		var ok bool
+		if key, ok = parsed.(*rsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("DKIM private key is not an RSA key")
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported DKIM private key type %q", block.Type)
+	}
+	return &dkimSigner{config.Domain, config.Selector, key}, nil
+}
+
+var whitespaceRegexp = regexp.MustCompile(`[ \t]+`)
+
+// dkimRelaxedHeader returns the relaxed canonicalization of the given
+// header field, which may be folded.
+func dkimRelaxedHeader(name, value string) string {
+	value = strings.Replace(value, "\r\n", "", -1)
+	value = strings.TrimSpace(whitespaceRegexp.ReplaceAllString(value, " "))
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value
+}
+
+// dkimRelaxedBody returns the relaxed canonicalization of the body.
+func dkimRelaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(whitespaceRegexp.ReplaceAllString(line, " "),
+			" ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// dkimHeaderField is a header field of a message. Value includes
+// folding whitespace.
+type dkimHeaderField struct {
+	Name, Value string
+}
+
+// crlfMessage returns the message with CRLF line endings.
+func crlfMessage(message []byte) []byte {
+	message = bytes.Replace(message, []byte("\r\n"), []byte("\n"), -1)
+	return bytes.Replace(message, []byte("\n"), []byte("\r\n"), -1)
+}
+
+// splitMessage returns the header fields and the body of the message,
+// which must use CRLF line endings.
+func splitMessage(message []byte) ([]dkimHeaderField, []byte) {
+	header, body := message, []byte(nil)
+	if i := bytes.Index(message, []byte("\r\n\r\n")); i >= 0 {
+		header, body = message[:i+2], message[i+4:]
+	}
+	fields := make([]dkimHeaderField, 0)
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].Value += line
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields = append(fields, dkimHeaderField{parts[0], parts[1]})
+	}
+	for i := range fields {
+		fields[i].Value = strings.TrimSuffix(fields[i].Value, "\r\n")
+	}
+	return fields, body
+}
+
+// Sign returns the message with a prepended DKIM-Signature header and
+// CRLF line endings.
+func (s *dkimSigner) Sign(message []byte, now time.Time) ([]byte, error) {
+	message = crlfMessage(message)
+	fields, body := splitMessage(message)
+	bodyHash := sha256.Sum256(dkimRelaxedBody(body))
+	var signed []string
+	hash := sha256.New()
+	for _, name := range dkimHeaders {
+		// Sign multiple instances of a field from the bottom up.
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.EqualFold(strings.TrimSpace(fields[i].Name), name) {
+				signed = append(signed, strings.ToLower(name))
+				hash.Write([]byte(dkimRelaxedHeader(fields[i].Name,
+					fields[i].Value) + "\r\n"))
+			}
+		}
+	}
+	value := fmt.Sprintf(
+		" v=1; a=rsa-sha256; c=relaxed/relaxed; d=%v; s=%v; t=%v; h=%v; bh=%v; b=",
+		s.Domain, s.Selector, now.Unix(), strings.Join(signed, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+	hash.Write([]byte(dkimRelaxedHeader("DKIM-Signature", value)))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.Key, crypto.SHA256,
+		hash.Sum(nil))
+	if err != nil {
+		return nil, fmt.Errorf("Could not sign mail: %v", err)
+	}
+	header := "DKIM-Signature:" + value +
+		base64.StdEncoding.EncodeToString(signature) + "\r\n"
+	return append([]byte(header), message...), nil
+}
@@ -0,0 +1,112 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestDKIMRelaxed(t *testing.T) {
+	// Examples of RFC 6376, section 3.4.5.
+	if ret := dkimRelaxedHeader("A", " X"); ret != "a:X" {
+		t.Errorf("dkimRelaxedHeader(\"A\", \" X\") = %q, should be %q", ret, "a:X")
+	}
+	if ret := dkimRelaxedHeader("B ", " Y\t\r\n\tZ  "); ret != "b:Y Z" {
+		t.Errorf("dkimRelaxedHeader(...) = %q, should be %q", ret, "b:Y Z")
+	}
+	body := dkimRelaxedBody([]byte(" C \r\nD \t E\r\n\r\n\r\n"))
+	if string(body) != " C\r\nD E\r\n" {
+		t.Errorf("dkimRelaxedBody(...) = %q, should be %q", body, " C\r\nD E\r\n")
+	}
+	if body := dkimRelaxedBody([]byte("\r\n\r\n")); len(body) != 0 {
+		t.Errorf("dkimRelaxedBody of empty lines = %q, should be empty", body)
+	}
+}
+
+func TestDKIMSign(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	var site util.SiteSettings
+	site.DKIM.Domain = "example.com"
+	site.DKIM.Selector = "monsti"
+	if signer, err := newDKIMSigner(site); signer != nil || err != nil {
+		t.Errorf("newDKIMSigner without key = %v, %v, should be nil, nil",
+			signer, err)
+	}
+	site.DKIM.PrivateKey = "invalid"
+	if _, err := newDKIMSigner(site); err == nil {
+		t.Errorf("newDKIMSigner should fail for invalid keys")
+	}
+	site.DKIM.PrivateKey = string(pem.EncodeToMemory(&pem.Block{
+		Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	signer, err := newDKIMSigner(site)
+	if err != nil {
+		t.Fatalf("newDKIMSigner returned error: %v", err)
+	}
+	message := "From: Foo <foo@example.com>\nTo: bar@example.com\n" +
+		"Subject: Hello\n  World\nX-Unsigned: foo\n\nHello  World!\n\n"
+	signed, err := signer.Sign([]byte(message), time.Unix(1400000000, 0))
+	if err != nil {
+		t.Fatalf("Sign returned error: %v", err)
+	}
+	parts := strings.SplitN(string(signed), "\r\n", 2)
+	if parts[1] != strings.Replace(message, "\n", "\r\n", -1) {
+		t.Errorf("Signed message is %q, should end with the CRLF message", signed)
+	}
+	header := parts[0]
+	for _, tag := range []string{"d=example.com;", "s=monsti;", "t=1400000000;",
+		"h=from:subject:to;", "c=relaxed/relaxed;"} {
+		if !strings.Contains(header, tag) {
+			t.Errorf("Signature %q should contain %q", header, tag)
+		}
+	}
+	bodyHash := sha256.Sum256([]byte("Hello World!\r\n"))
+	if !strings.Contains(header, "bh="+
+		base64.StdEncoding.EncodeToString(bodyHash[:])+";") {
+		t.Errorf("Signature %q has wrong body hash", header)
+	}
+	match := regexp.MustCompile(`^DKIM-Signature:(.* b=)(.*)$`).
+		FindStringSubmatch(header)
+	if match == nil {
+		t.Fatalf("Invalid signature header: %q", header)
+	}
+	signature, err := base64.StdEncoding.DecodeString(match[2])
+	if err != nil {
+		t.Fatalf("Could not decode signature: %v", err)
+	}
+	hash := sha256.Sum256([]byte("from:Foo <foo@example.com>\r\n" +
+		"subject:Hello World\r\nto:bar@example.com\r\n" +
+		"dkim-signature:" + strings.TrimSpace(match[1])))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:],
+		signature); err != nil {
+		t.Errorf("Could not verify signature: %v", err)
+	}
+}
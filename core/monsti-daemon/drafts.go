@@ -0,0 +1,166 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// draft holds the unsaved values of an edit form, autosaved while
+// editing.
+type draft struct {
+	// User is the login of the editing user.
+	User string
+	// Path is the path of the edited node or of the parent of the added
+	// node.
+	Path string
+	// NodeType is the type of the added node or empty if an existing
+	// node is edited.
+	NodeType string
+	// Values are the submitted form values.
+	Values url.Values
+	Saved  time.Time
+}
+
+// draftExpiry is the time after which unsaved drafts get discarded.
+const draftExpiry = 30 * 24 * time.Hour
+
+// draftsMutex serializes updates of the drafts.
+var draftsMutex sync.Mutex
+
+// draftsPath returns the path to the drafts file of the given user
+// inside the given site data directory.
+func draftsPath(dataDir, user string) string {
+	return filepath.Join(dataDir, "drafts",
+		hex.EncodeToString([]byte(user))+".json")
+}
+
+// draftKey returns the key of the draft of the given user editing the
+// node at nodePath or adding a node of the given type below it.
+func draftKey(user, nodePath, nodeType string) string {
+	return user + " " + nodeType + " " + nodePath
+}
+
+// readDrafts returns the drafts of the given user by their keys,
+// without the ones expired at the given time.
+func readDrafts(dataDir, user string, now time.Time) (map[string]*draft,
+	error) {
+	drafts := make(map[string]*draft)
+	if err := readJSONFile(draftsPath(dataDir, user), &drafts); err != nil {
+		return nil, fmt.Errorf("Could not read drafts: %v", err)
+	}
+	for key, d := range drafts {
+		if now.Sub(d.Saved) > draftExpiry {
+			delete(drafts, key)
+		}
+	}
+	return drafts, nil
+}
+
+// getDraft returns the draft of the given user editing the node at
+// nodePath or adding a node of the given type below it, or nil if
+// there is no such draft.
+func getDraft(dataDir, user, nodePath, nodeType string) (*draft, error) {
+	draftsMutex.Lock()
+	defer draftsMutex.Unlock()
+	drafts, err := readDrafts(dataDir, user, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	return drafts[draftKey(user, nodePath, nodeType)], nil
+}
+
+// updateDrafts applies fn to the drafts of the given user and writes
+// them, dropping expired ones. The file of the user gets removed if
+// there are no drafts left.
+func updateDrafts(dataDir, user string, fn func(map[string]*draft)) error {
+	draftsMutex.Lock()
+	defer draftsMutex.Unlock()
+	drafts, err := readDrafts(dataDir, user, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	fn(drafts)
+	path := draftsPath(dataDir, user)
+	if len(drafts) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Could not remove drafts: %v", err)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("Could not create drafts directory: %v", err)
+	}
+	if err := writeJSONFile(path, drafts); err != nil {
+		return fmt.Errorf("Could not write drafts: %v", err)
+	}
+	return nil
+}
+
+// saveDraft adds or replaces the given draft.
+func saveDraft(dataDir string, d *draft) error {
+	return updateDrafts(dataDir, d.User, func(drafts map[string]*draft) {
+		drafts[draftKey(d.User, d.Path, d.NodeType)] = d
+	})
+}
+
+// removeDraft removes the draft of the given user editing the node at
+// nodePath or adding a node of the given type below it.
+func removeDraft(dataDir, user, nodePath, nodeType string) error {
+	return updateDrafts(dataDir, user, func(drafts map[string]*draft) {
+		delete(drafts, draftKey(user, nodePath, nodeType))
+	})
+}
+
+// draftFormValues returns the submitted form values to be kept in a
+// draft, i.e. without the values of the autosave and preview buttons.
+func draftFormValues(values url.Values) url.Values {
+	kept := make(url.Values)
+	for key, value := range values {
+		if key != "Autosave" && key != "Preview" && key != "Draft" {
+			kept[key] = value
+		}
+	}
+	return kept
+}
+
+// draftAge returns the time passed between saving a draft and now,
+// e.g. "10 minutes ago".
+func draftAge(saved, now time.Time, G func(string) string) string {
+	age := now.Sub(saved)
+	switch {
+	case age < time.Minute:
+		return G("less than a minute ago")
+	case age < 2*time.Minute:
+		return G("a minute ago")
+	case age < time.Hour:
+		return fmt.Sprintf(G("%v minutes ago"), int(age/time.Minute))
+	case age < 2*time.Hour:
+		return G("an hour ago")
+	case age < 24*time.Hour:
+		return fmt.Sprintf(G("%v hours ago"), int(age/time.Hour))
+	case age < 48*time.Hour:
+		return G("a day ago")
+	}
+	return fmt.Sprintf(G("%v days ago"), int(age/(24*time.Hour)))
+}
@@ -0,0 +1,107 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDrafts(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "monsti-drafts")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dataDir)
+	saved := time.Now().UTC().Add(-time.Hour)
+	drafts := []*draft{
+		{User: "foo", Path: "/about", Saved: saved,
+			Values: draftFormValues(url.Values{"Name": {"about"},
+				"Autosave": {"1"}, "Preview": {"1"}})},
+		{User: "foo", Path: "/", NodeType: "core.Document", Saved: saved},
+		{User: "bar", Path: "/about", Saved: saved},
+		{User: "baz", Path: "/about", Saved: saved.Add(-draftExpiry)},
+	}
+	for _, d := range drafts {
+		if err := saveDraft(dataDir, d); err != nil {
+			t.Fatalf("saveDraft returned error: %v", err)
+		}
+	}
+	d, err := getDraft(dataDir, "foo", "/about", "")
+	if err != nil {
+		t.Fatalf("getDraft returned error: %v", err)
+	}
+	if d == nil || !d.Saved.Equal(saved) || len(d.Values) != 1 ||
+		d.Values.Get("Name") != "about" {
+		t.Errorf("getDraft(_, foo, /about, ) = %v, should be the first draft", d)
+	}
+	if err := removeDraft(dataDir, "foo", "/about", ""); err != nil {
+		t.Fatalf("removeDraft returned error: %v", err)
+	}
+	tests := []struct {
+		User, Path, NodeType string
+		Exists               bool
+	}{
+		{"foo", "/about", "", false},
+		{"foo", "/", "core.Document", true},
+		{"foo", "/", "", false},
+		{"bar", "/about", "", true},
+		{"baz", "/about", "", false},
+	}
+	for _, test := range tests {
+		d, err := getDraft(dataDir, test.User, test.Path, test.NodeType)
+		if err != nil {
+			t.Fatalf("getDraft returned error: %v", err)
+		}
+		if (d != nil) != test.Exists {
+			t.Errorf("getDraft(_, %q, %q, %q) = %v, existence should be %v",
+				test.User, test.Path, test.NodeType, d, test.Exists)
+		}
+	}
+	if err := removeDraft(dataDir, "bar", "/about", ""); err != nil {
+		t.Fatalf("removeDraft returned error: %v", err)
+	}
+	if _, err := os.Stat(draftsPath(dataDir, "bar")); !os.IsNotExist(err) {
+		t.Errorf("Drafts file without drafts should be removed: %v", err)
+	}
+}
+
+func TestDraftAge(t *testing.T) {
+	G := func(in string) string { return in }
+	now := time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		Age      time.Duration
+		Expected string
+	}{
+		{10 * time.Second, "less than a minute ago"},
+		{90 * time.Second, "a minute ago"},
+		{10 * time.Minute, "10 minutes ago"},
+		{61 * time.Minute, "an hour ago"},
+		{5 * time.Hour, "5 hours ago"},
+		{30 * time.Hour, "a day ago"},
+		{72 * time.Hour, "3 days ago"},
+	}
+	for _, test := range tests {
+		if ret := draftAge(now.Add(-test.Age), now, G); ret != test.Expected {
+			t.Errorf("draftAge(%v) = %q, should be %q", test.Age, ret,
+				test.Expected)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// editorConfig is the site's configuration of the rich-text editor of
+// HTML fields. It is passed to static/js/editor.js by the edit views.
+type editorConfig struct {
+	// Options are settings of TinyMCE overriding the defaults, e.g.
+	// "toolbar" or "external_plugins" to plug in further editor
+	// plugins.
+	Options map[string]interface{} `json:"options"`
+	// ImageSizes is the sizes attribute of images inserted from the
+	// media library.
+	ImageSizes string `json:"imageSizes"`
+}
+
+// getEditorConfig returns the editor configuration of the site as
+// configured by the core.editor section.
+func getEditorConfig(s *service.Session, site string) (*editorConfig, error) {
+	config := new(editorConfig)
+	if err := s.Monsti().GetSiteConfig(site, "core.editor.tinymce",
+		&config.Options); err != nil {
+		return nil, fmt.Errorf("Could not get editor options: %v", err)
+	}
+	if err := s.Monsti().GetSiteConfig(site, "core.editor.imagesizes",
+		&config.ImageSizes); err != nil {
+		return nil, fmt.Errorf("Could not get editor image sizes: %v", err)
+	}
+	if config.ImageSizes == "" {
+		config.ImageSizes = "100vw"
+	}
+	return config, nil
+}
+
+// getHTMLAllowlist returns the site's additions to the allowlist of
+// HTML fields as configured by the core.sanitize section.
+func getHTMLAllowlist(s *service.Session, site string) (
+	*service.HTMLAllowlist, error) {
+	allowlist := new(service.HTMLAllowlist)
+	if err := s.Monsti().GetSiteConfig(site, "core.sanitize",
+		allowlist); err != nil {
+		return nil, fmt.Errorf("Could not get HTML allowlist: %v", err)
+	}
+	return allowlist, nil
+}
+
+// sanitizeHTMLFields sanitizes the node's HTML fields, including the
+// ones in the rows of list fields, using the given allowlist, see
+// service.SanitizeHTML.
+func sanitizeHTMLFields(node *service.Node, allowlist *service.HTMLAllowlist) {
+	for _, field := range node.AllFields() {
+		sanitizeHTMLField(node.GetField(field.Id), allowlist)
+	}
+}
+
+// sanitizeHTMLField sanitizes the field if it's an HTML field or the
+// HTML fields of its rows if it's a list field.
+func sanitizeHTMLField(field service.Field, allowlist *service.HTMLAllowlist) {
+	switch value := field.(type) {
+	case *service.HTMLField:
+		*value = service.HTMLField(service.SanitizeHTML(string(*value),
+			allowlist))
+	case *service.ListField:
+		for _, row := range value.Rows {
+			for _, field := range row {
+				sanitizeHTMLField(field, allowlist)
+			}
+		}
+	}
+}
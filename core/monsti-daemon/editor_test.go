@@ -0,0 +1,75 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestSanitizeHTMLFields(t *testing.T) {
+	node := service.Node{
+		Type: &service.NodeType{Fields: []*service.NodeField{
+			{Id: "core.Body", Type: "HTMLArea"},
+			{Id: "core.Title", Type: "Text"}}},
+		LocalFields: []*service.NodeField{{Id: "local.Box", Type: "HTMLArea"}}}
+	if err := node.InitFields(nil, ""); err != nil {
+		t.Fatalf("Could not init fields: %v", err)
+	}
+	code := `<p>Text</p><script>alert('foo');</script>`
+	for _, id := range []string{"core.Body", "core.Title", "local.Box"} {
+		node.GetField(id).Load(func(in interface{}) error {
+			switch in := in.(type) {
+			case *service.HTMLField:
+				*in = service.HTMLField(code)
+			case *service.TextField:
+				*in = service.TextField(code)
+			}
+			return nil
+		})
+	}
+	list := new(service.ListField)
+	html := service.HTMLField(code)
+	list.Rows = []map[string]service.Field{{"core.Text": &html}}
+	node.Fields["core.Items"] = list
+	// Leave spare capacity to check that the node type's fields don't
+	// get changed.
+	fields := make([]*service.NodeField, 3, 4)
+	copy(fields, node.Type.Fields)
+	fields[2] = &service.NodeField{Id: "core.Items", Type: "List"}
+	node.Type.Fields = fields
+	sanitizeHTMLFields(&node, nil)
+	if ret := html.String(); strings.Contains(ret, "<script") {
+		t.Errorf("HTML field of list row = %q, should be sanitized", ret)
+	}
+	for _, id := range []string{"core.Body", "local.Box"} {
+		if ret := node.GetField(id).String(); strings.Contains(ret, "<script") ||
+			!strings.Contains(ret, "<p>Text</p>") {
+			t.Errorf("Field %v = %q, should be sanitized", id, ret)
+		}
+	}
+	if ret := node.GetField("core.Title").String(); ret != code {
+		t.Errorf("Field core.Title = %q, should not change", ret)
+	}
+	if spare := node.Type.Fields[:cap(node.Type.Fields)]; len(spare) > 3 &&
+		spare[3] != nil {
+		t.Errorf("sanitizeHTMLFields wrote %v into the node type's fields",
+			spare[3].Id)
+	}
+}
@@ -0,0 +1,236 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	mtemplate "pkg.monsti.org/monsti/api/util/template"
+)
+
+// errorTitles are the untranslated titles of the error pages.
+var errorTitles = map[int]string{
+	http.StatusForbidden:           "Access denied",
+	http.StatusNotFound:            "Page not found",
+	http.StatusInternalServerError: "Application error",
+}
+
+// maxSuggestions is the number of nodes suggested on 404 pages.
+const maxSuggestions = 5
+
+// maxSuggestionTerms and maxSuggestionTermLength bound the words of a
+// missing path used to search for suggestions.
+const (
+	maxSuggestionTerms      = 4
+	maxSuggestionTermLength = 32
+)
+
+var pathWordRegexp = regexp.MustCompile(`[\pL\pN]{3,}`)
+
+// pathTerms returns the distinct lower case words of the request path
+// without its action and file extension, e.g. "about" and "team" for
+// "/about-us/team.html". Words shorter than three or longer than
+// maxSuggestionTermLength characters are skipped and at most
+// maxSuggestionTerms words are returned.
+func pathTerms(reqPath string) []string {
+	reqPath, _ = splitAction(reqPath)
+	reqPath = strings.TrimSuffix(reqPath, path.Ext(reqPath))
+	terms := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, word := range pathWordRegexp.FindAllString(
+		strings.ToLower(reqPath), -1) {
+		if seen[word] || utf8.RuneCountInString(word) > maxSuggestionTermLength {
+			continue
+		}
+		seen[word] = true
+		terms = append(terms, word)
+		if len(terms) == maxSuggestionTerms {
+			break
+		}
+	}
+	return terms
+}
+
+// suggestNodes returns up to maxSuggestions nodes matching any word of
+// the missing request path, best matches first. As the search walks
+// the node tree, suggestions must be enabled for the site
+// (core.errorpages.suggestions). Returns nil otherwise.
+func suggestNodes(c *reqContext) ([]searchResult, error) {
+	var enabled bool
+	if err := c.Serv.Monsti().GetSiteConfig(c.Site.Name,
+		"core.errorpages.suggestions", &enabled); err != nil {
+		return nil, fmt.Errorf("Could not get suggestions configuration: %v", err)
+	}
+	terms := pathTerms(c.Req.URL.Path)
+	if !enabled || len(terms) == 0 {
+		return nil, nil
+	}
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		return c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
+	}
+	getChildrenFn := func(nodePath string) ([]*service.Node, error) {
+		return c.Serv.Monsti().GetChildren(c.Site.Name, nodePath)
+	}
+	results, err := findNodes(terms, false,
+		c.UserSession.Locale, c.UserSession.User == nil, time.Now(), getNodeFn,
+		getChildrenFn)
+	if err != nil {
+		return nil, fmt.Errorf("Could not search nodes: %v", err)
+	}
+	if len(results) > maxSuggestions {
+		results = results[:maxSuggestions]
+	}
+	return results, nil
+}
+
+// getErrorNode returns the node configured to be shown for the given
+// status (core.errorpages.<status>) or nil if there is none or if it's
+// not published.
+func getErrorNode(c *reqContext, status int) (*service.Node, error) {
+	var nodePath string
+	if err := c.Serv.Monsti().GetSiteConfig(c.Site.Name,
+		"core.errorpages."+strconv.Itoa(status), &nodePath); err != nil {
+		return nil, fmt.Errorf("Could not get error page configuration: %v", err)
+	}
+	if nodePath == "" {
+		return nil, nil
+	}
+	node, err := c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get error page node: %v", err)
+	}
+	if node == nil || !isPublished(node, time.Now()) {
+		return nil, nil
+	}
+	return translateNode(node, c.UserSession.Locale)
+}
+
+// renderSiteErrorPage renders the error page of the given status
+// inside the master template. The page shows the content of the
+// configured error node, if any, and the template errors/<status>. The
+// templates get the request path, the request's error message and, for
+// 404 pages, suggestions of similar nodes.
+//
+// The internal server error page only gets rendered if there is a
+// configured node. Returns an empty page if the request has not been
+// associated with a site yet.
+func (h *nodeHandler) renderSiteErrorPage(c *reqContext, status int) (
+	page string, err error) {
+	if c.Site == nil || c.Serv == nil || c.UserSession == nil {
+		return "", nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	node, err := getErrorNode(c, status)
+	if err != nil {
+		return "", err
+	}
+	if node == nil && status == http.StatusInternalServerError {
+		return "", nil
+	}
+	context := mtemplate.Context{"Path": c.Req.URL.Path,
+		"RequestID": c.RequestID, "Message": c.ErrorMessage}
+	// The master template needs a node, e.g. for its body classes.
+	env := masterTmplEnv{Node: &service.Node{Path: "/",
+		Type: &service.NodeType{Id: "core.Error"}},
+		Session: c.UserSession, Title: G(errorTitles[status])}
+	var body []byte
+	if node != nil {
+		reqNode := c.Node
+		c.Node = node
+		body, err = h.RenderNode(c, nil)
+		c.Node = reqNode
+		if err != nil {
+			return "", fmt.Errorf("Could not render error page node: %v", err)
+		}
+		env.Node, env.Title = node, ""
+		context["Content"] = template.HTML(body)
+	}
+	if status != http.StatusInternalServerError {
+		if status == http.StatusNotFound {
+			context["Suggestions"], err = suggestNodes(c)
+			if err != nil {
+				return "", err
+			}
+		}
+		rendered, err := h.Renderer.Render("errors/"+strconv.Itoa(status),
+			context, c.UserSession.Locale,
+			h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+		if err != nil {
+			return "", fmt.Errorf("Could not render error template: %v", err)
+		}
+		body = []byte(rendered)
+	}
+	return renderInMaster(h.Renderer, body, env, h.Settings, *c.Site,
+		c.UserSession.Locale, c.Serv), nil
+}
+
+// serveErrorPage writes the error page of the given status, i.e. 403,
+// 404 or 500. Falls back to plain text if the page can't be rendered.
+func (h *nodeHandler) serveErrorPage(c *reqContext, status int) {
+	page, err := h.renderSiteErrorPage(c, status)
+	if err != nil {
+		h.Log.Printf("[%v] Could not render %v page: %v", c.RequestID, status,
+			err)
+	}
+	if page == "" && status == http.StatusInternalServerError {
+		page, err = h.renderStandaloneErrorPage(c)
+		if err != nil {
+			h.Log.Printf("[%v] Could not render error page: %v", c.RequestID, err)
+		}
+	}
+	if page == "" {
+		text := http.StatusText(status)
+		if c.ErrorMessage != "" {
+			text = c.ErrorMessage
+		}
+		http.Error(c.Res, text, status)
+		return
+	}
+	c.Res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	c.Res.WriteHeader(status)
+	fmt.Fprint(c.Res, page)
+}
+
+// renderStandaloneErrorPage renders the internal server error page
+// without the master template (errors/500).
+func (h *nodeHandler) renderStandaloneErrorPage(c *reqContext) (string, error) {
+	var siteTemplates, locale string
+	if c.Site != nil {
+		siteTemplates = h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name)
+		locale = c.Site.Locale
+	}
+	if c.UserSession != nil && c.UserSession.Locale != "" {
+		locale = c.UserSession.Locale
+	}
+	return h.Renderer.Render("errors/500", mtemplate.Context{
+		"RequestID": c.RequestID}, locale, siteTemplates)
+}
@@ -0,0 +1,44 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPathTerms(t *testing.T) {
+	tests := []struct {
+		Path  string
+		Terms []string
+	}{
+		{"/", []string{}},
+		{"/about-us/team.html", []string{"about", "team"}},
+		{"/Über/über_uns/", []string{"über", "uns"}},
+		{"/blog/2015/@@edit", []string{"blog", "2015"}},
+		{"/a/to/foo.bar.php", []string{"foo", "bar"}},
+		{"/one/two/three/four/five/", []string{"one", "two", "three", "four"}},
+		{"/" + strings.Repeat("x", 33) + "/team", []string{"team"}},
+	}
+	for _, test := range tests {
+		if terms := pathTerms(test.Path); !reflect.DeepEqual(terms, test.Terms) {
+			t.Errorf("pathTerms(%q) = %v, should be %v", test.Path, terms,
+				test.Terms)
+		}
+	}
+}
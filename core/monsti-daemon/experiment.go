@@ -0,0 +1,190 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// pickVariant returns the variant for the given number in [0, sum of
+// weights). Returns nil if there are no variants with a weight.
+func pickVariant(variants []service.ExperimentVariant,
+	n uint) *service.ExperimentVariant {
+	for i := range variants {
+		if n < variants[i].Weight {
+			return &variants[i]
+		}
+		n -= variants[i].Weight
+	}
+	return nil
+}
+
+// findVariant returns the variant with the given id or nil.
+func findVariant(variants []service.ExperimentVariant,
+	id string) *service.ExperimentVariant {
+	for i := range variants {
+		if variants[i].Id == id {
+			return &variants[i]
+		}
+	}
+	return nil
+}
+
+// applyVariant returns a copy of the node with the variant's template
+// overwrites and field values.
+func applyVariant(node *service.Node,
+	variant *service.ExperimentVariant) (*service.Node, error) {
+	ret := *node
+	if variant.TemplateOverwrites != nil {
+		ret.TemplateOverwrites = variant.TemplateOverwrites
+	}
+	if len(variant.Fields) == 0 {
+		return &ret, nil
+	}
+	return withFieldValues(&ret, variant.Fields)
+}
+
+// withFieldValues returns a copy of the node with the given JSON
+// encoded values of its fields. Values of unknown fields are ignored.
+func withFieldValues(node *service.Node,
+	values map[string]*json.RawMessage) (*service.Node, error) {
+	ret := *node
+	ret.Fields = make(map[string]service.Field, len(node.Fields))
+	for id, field := range node.Fields {
+		ret.Fields[id] = field
+	}
+	for id, value := range values {
+		if _, ok := node.Fields[id]; !ok || value == nil {
+			continue
+		}
+		field := service.NewField(fieldType(node, id))
+		if field == nil {
+			continue
+		}
+		// Keep field initialization (e.g. the time zone of DateTime
+		// fields) by loading into a copy of the dumped original.
+		dump, err := json.Marshal(node.Fields[id].Dump())
+		if err != nil {
+			return nil, fmt.Errorf("Could not marshal field %q: %v", id, err)
+		}
+		for _, data := range []json.RawMessage{dump, *value} {
+			data := data
+			if err := field.Load(func(in interface{}) error {
+				return json.Unmarshal(data, in)
+			}); err != nil {
+				return nil, fmt.Errorf("Could not load value of field %q: %v",
+					id, err)
+			}
+		}
+		ret.Fields[id] = field
+	}
+	return &ret, nil
+}
+
+// fieldType returns the type of the node's field with the given id.
+func fieldType(node *service.Node, id string) string {
+	for _, field := range node.AllFields() {
+		if field.Id == id {
+			return field.Type
+		}
+	}
+	return ""
+}
+
+// emitExperimentEvent emits the monsti.ExperimentEvent signal.
+func emitExperimentEvent(c *reqContext, node, experiment, variant string,
+	conversion bool) error {
+	var ret []service.ExperimentEventRet
+	err := c.Serv.Monsti().EmitSignal("monsti.ExperimentEvent",
+		service.ExperimentEventArgs{
+			Request:    c.Id,
+			Site:       c.Site.Name,
+			Node:       node,
+			Experiment: experiment,
+			Variant:    variant,
+			Conversion: conversion}, &ret)
+	if err != nil {
+		return fmt.Errorf("Could not emit signal: %v", err)
+	}
+	return nil
+}
+
+// handleExperiments assigns the visitor to a variant if the requested
+// node defines an experiment and replaces c.Node by the variant. It
+// also tracks conversions of the visitor's experiments.
+//
+// Returns true if the session has been changed and needs to be saved.
+func handleExperiments(c *reqContext) (bool, error) {
+	changed := false
+	for key, value := range c.Session.Values {
+		name, ok := key.(string)
+		if !ok || !strings.HasPrefix(name, "experiment-goal:") {
+			continue
+		}
+		id := name[len("experiment-goal:"):]
+		goal, _ := value.(string)
+		if dirPath(goal) != dirPath(c.Node.Path) ||
+			c.Session.Values["experiment-converted:"+id] != nil {
+			continue
+		}
+		variant, _ := c.Session.Values["experiment:"+id].(string)
+		node, _ := c.Session.Values["experiment-node:"+id].(string)
+		if err := emitExperimentEvent(c, node, id, variant, true); err != nil {
+			return false, err
+		}
+		c.Session.Values["experiment-converted:"+id] = true
+		changed = true
+	}
+
+	experiment := c.Node.Experiment
+	if experiment == nil || len(experiment.Variants) == 0 {
+		return changed, nil
+	}
+	key := "experiment:" + experiment.Id
+	id, _ := c.Session.Values[key].(string)
+	variant := findVariant(experiment.Variants, id)
+	if variant == nil {
+		var total uint
+		for _, variant := range experiment.Variants {
+			total += variant.Weight
+		}
+		if total == 0 {
+			return changed, nil
+		}
+		variant = pickVariant(experiment.Variants, uint(rand.Int63n(int64(total))))
+		c.Session.Values[key] = variant.Id
+		c.Session.Values["experiment-node:"+experiment.Id] = c.Node.Path
+		c.Session.Values["experiment-goal:"+experiment.Id] = experiment.Goal
+		delete(c.Session.Values, "experiment-converted:"+experiment.Id)
+		if err := emitExperimentEvent(c, c.Node.Path, experiment.Id, variant.Id,
+			false); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	node, err := applyVariant(c.Node, variant)
+	if err != nil {
+		return false, fmt.Errorf("Could not apply variant %q: %v", variant.Id, err)
+	}
+	c.Node = node
+	return changed, nil
+}
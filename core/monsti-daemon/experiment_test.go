@@ -0,0 +1,84 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestPickVariant(t *testing.T) {
+	variants := []service.ExperimentVariant{
+		{Id: "a", Weight: 1}, {Id: "b", Weight: 0}, {Id: "c", Weight: 2}}
+	tests := []struct {
+		N       uint
+		Variant string
+	}{
+		{0, "a"},
+		{1, "c"},
+		{2, "c"},
+		{3, ""},
+	}
+	for i, v := range tests {
+		ret := pickVariant(variants, v.N)
+		id := ""
+		if ret != nil {
+			id = ret.Id
+		}
+		if id != v.Variant {
+			t.Errorf("%v: pickVariant(_, %v) = %q, should be %q", i, v.N, id,
+				v.Variant)
+		}
+	}
+}
+
+func TestApplyVariant(t *testing.T) {
+	fields := []*service.NodeField{
+		{Id: "core.Title", Type: "Text"},
+		{Id: "core.Body", Type: "HTMLArea"},
+	}
+	node := service.Node{
+		Type: &service.NodeType{Fields: fields},
+		TemplateOverwrites: map[string]service.TemplateOverwrite{
+			"core/Document-view": {Template: "original"}}}
+	if err := node.InitFields(nil, ""); err != nil {
+		t.Fatalf("Could not init fields: %v", err)
+	}
+	*(node.GetField("core.Title").(*service.TextField)) = "Original"
+	title := json.RawMessage(`"Variant"`)
+	variant := service.ExperimentVariant{
+		Id: "b",
+		TemplateOverwrites: map[string]service.TemplateOverwrite{
+			"core/Document-view": {Template: "variant"}},
+		Fields: map[string]*json.RawMessage{"core.Title": &title}}
+	ret, err := applyVariant(&node, &variant)
+	if err != nil {
+		t.Fatalf("applyVariant(_, _) returned error: %v", err)
+	}
+	if title := ret.GetField("core.Title").String(); title != "Variant" {
+		t.Errorf(`Title of variant is %q, should be "Variant"`, title)
+	}
+	if tmpl := ret.TemplateOverwrites["core/Document-view"].Template; tmpl !=
+		"variant" {
+		t.Errorf(`Template overwrite of variant is %q, should be "variant"`, tmpl)
+	}
+	if title := node.GetField("core.Title").String(); title != "Original" {
+		t.Errorf(`Title of original node is %q, should be "Original"`, title)
+	}
+}
@@ -0,0 +1,342 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// defaultFeedItems is the number of items of feeds without
+// core.feed.items setting.
+const defaultFeedItems = 20
+
+// feedFiles map the names of feed files to their formats.
+var feedFiles = map[string]string{"feed.xml": "rss", "atom.xml": "atom"}
+
+// splitFeed splits the given path into the node path and the format
+// of the requested feed ("rss" for "/foo/feed.xml" and "atom" for
+// "/foo/atom.xml").
+//
+// Returns the unchanged path and an empty format if the path does not
+// point to a feed.
+func splitFeed(nodePath string) (string, string) {
+	format, ok := feedFiles[path.Base(nodePath)]
+	if !ok {
+		return nodePath, ""
+	}
+	return path.Dir(nodePath), format
+}
+
+// feedSettings are the per-site settings of feeds (core.feed).
+type feedSettings struct {
+	// Items is the maximum number of items.
+	Items int
+	// FullText is true if items contain the node's body instead of its
+	// teaser.
+	FullText bool
+}
+
+// getFeedSettings returns the feed settings of the site.
+func getFeedSettings(s *service.Session, site string) (*feedSettings,
+	error) {
+	settings := &feedSettings{Items: defaultFeedItems}
+	if err := s.Monsti().GetSiteConfig(site, "core.feed.items",
+		&settings.Items); err != nil {
+		return nil, fmt.Errorf("Could not get feed item count: %v", err)
+	}
+	if err := s.Monsti().GetSiteConfig(site, "core.feed.fulltext",
+		&settings.FullText); err != nil {
+		return nil, fmt.Errorf("Could not get feed full text setting: %v", err)
+	}
+	if settings.Items < 1 {
+		settings.Items = defaultFeedItems
+	}
+	return settings, nil
+}
+
+// getFeedNodes returns the published nodes listed in the feed of the
+// given node, newest first.
+//
+// These are the posts of blogs and the children of other nodes except
+// those of hidden node types like files.
+func getFeedNodes(node *service.Node, now time.Time,
+	getChildrenFn getChildrenFunc) ([]*service.Node, error) {
+	// Blog posts are stored in year and month nodes below the blog.
+	depth := 1
+	if node.Type != nil && node.Type.Id == "core.Blog" {
+		depth = 3
+	}
+	parents := []*service.Node{node}
+	for ; depth > 1; depth-- {
+		var children []*service.Node
+		for _, parent := range parents {
+			nodes, err := getChildrenFn(parent.Path)
+			if err != nil {
+				return nil, fmt.Errorf("Could not get children of %q: %v",
+					parent.Path, err)
+			}
+			children = append(children, nodes...)
+		}
+		parents = children
+	}
+	ret := make([]*service.Node, 0)
+	for _, parent := range parents {
+		children, err := getChildrenFn(parent.Path)
+		if err != nil {
+			return nil, fmt.Errorf("Could not get children of %q: %v",
+				parent.Path, err)
+		}
+		for _, child := range children {
+			if child.Type == nil || !isPublished(child, now) {
+				continue
+			}
+			if node.Type != nil && node.Type.Id == "core.Blog" {
+				if child.Type.Id != "core.BlogPost" {
+					continue
+				}
+			} else if child.Type.Hide || child.Type.Id == "core.Path" {
+				continue
+			}
+			ret = append(ret, child)
+		}
+	}
+	sort.Sort(&nodeSort{ret, func(left, right *service.Node) bool {
+		return left.PublishTime.After(right.PublishTime)
+	}})
+	return ret, nil
+}
+
+// feedItem is an item of a feed independent of its format.
+type feedItem struct {
+	Title, URL string
+	Published  time.Time
+	// Description is a plain text teaser or, for full text feeds, the
+	// HTML body of the node.
+	Description string
+	HTML        bool
+}
+
+// getFeedItems returns the items of the feed of the given nodes.
+func getFeedItems(nodes []*service.Node, baseURL, locale string,
+	settings *feedSettings) ([]feedItem, error) {
+	if len(nodes) > settings.Items {
+		nodes = nodes[:settings.Items]
+	}
+	items := make([]feedItem, 0, len(nodes))
+	for _, node := range nodes {
+		translated, err := translateNode(node, locale)
+		if err != nil {
+			return nil, fmt.Errorf("Could not translate node %q: %v", node.Path,
+				err)
+		}
+		item := feedItem{Title: getNodeTitle(translated),
+			URL: baseURL + dirPath(node.Path), Published: node.PublishTime}
+		body := translated.GetField("core.Body")
+		if settings.FullText && body != nil && body.String() != "" {
+			item.Description, item.HTML = body.String(), true
+		} else {
+			item.Description = blogPostTeaser(translated)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+type rssLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description,omitempty"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	Language      string    `xml:"language,omitempty"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Self          rssLink   `xml:"atom:link"`
+	Items         []rssItem `xml:"item"`
+}
+
+// rssFeed is a RSS 2.0 feed (http://www.rssboard.org/rss-specification).
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomText struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title     string    `xml:"title"`
+	Id        string    `xml:"id"`
+	Link      atomLink  `xml:"link"`
+	Published string    `xml:"published"`
+	Updated   string    `xml:"updated"`
+	Summary   *atomText `xml:"summary,omitempty"`
+	Content   *atomText `xml:"content,omitempty"`
+}
+
+// atomFeed is an Atom feed (RFC 4287).
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Lang    string      `xml:"xml:lang,attr,omitempty"`
+	Title   string      `xml:"title"`
+	Id      string      `xml:"id"`
+	Links   []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Author  string      `xml:"author>name"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// feedUpdated returns the publish time of the newest item or, for
+// feeds without items, the given time.
+func feedUpdated(items []feedItem, fallback time.Time) time.Time {
+	if len(items) > 0 {
+		return items[0].Published
+	}
+	return fallback
+}
+
+// newRSSFeed returns the RSS feed of the given node with the given
+// items.
+func newRSSFeed(title, nodeURL, locale string, items []feedItem,
+	now time.Time) *rssFeed {
+	feed := &rssFeed{Version: "2.0", Atom: "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title:         title,
+			Link:          nodeURL,
+			Description:   title,
+			Language:      locale,
+			LastBuildDate: feedUpdated(items, now).UTC().Format(time.RFC1123Z),
+			Self: rssLink{Href: nodeURL + "feed.xml", Rel: "self",
+				Type: "application/rss+xml"},
+			Items: make([]rssItem, 0, len(items))}}
+	for _, item := range items {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       item.Title,
+			Link:        item.URL,
+			GUID:        rssGUID{true, item.URL},
+			PubDate:     item.Published.UTC().Format(time.RFC1123Z),
+			Description: item.Description})
+	}
+	return feed
+}
+
+// newAtomFeed returns the Atom feed of the given node with the given
+// items.
+func newAtomFeed(title, author, nodeURL, locale string, items []feedItem,
+	now time.Time) *atomFeed {
+	feed := &atomFeed{
+		Lang:  locale,
+		Title: title,
+		Id:    nodeURL,
+		Links: []atomLink{{Href: nodeURL},
+			{Href: nodeURL + "atom.xml", Rel: "self"}},
+		Updated: feedUpdated(items, now).UTC().Format(time.RFC3339),
+		Author:  author,
+		Entries: make([]atomEntry, 0, len(items))}
+	for _, item := range items {
+		entry := atomEntry{
+			Title:     item.Title,
+			Id:        item.URL,
+			Link:      atomLink{Href: item.URL},
+			Published: item.Published.UTC().Format(time.RFC3339),
+			Updated:   item.Published.UTC().Format(time.RFC3339)}
+		if item.HTML {
+			entry.Content = &atomText{"html", item.Description}
+		} else if item.Description != "" {
+			entry.Summary = &atomText{"text", item.Description}
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	return feed
+}
+
+// Feed serves the RSS ("feed.xml") or Atom ("atom.xml") feed of the
+// requested node listing its newest children.
+func (h *nodeHandler) Feed(c *reqContext) error {
+	settings, err := getFeedSettings(c.Serv, c.Site.Name)
+	if err != nil {
+		return err
+	}
+	nodes, err := getFeedNodes(c.Node, time.Now(),
+		func(nodePath string) ([]*service.Node, error) {
+			return c.Serv.Monsti().GetChildren(c.Site.Name, nodePath)
+		})
+	if err != nil {
+		return fmt.Errorf("Could not get feed nodes: %v", err)
+	}
+	items, err := getFeedItems(nodes, c.Site.BaseURL, c.Locale, settings)
+	if err != nil {
+		return err
+	}
+	translated, err := translateNode(c.Node, c.Locale)
+	if err != nil {
+		return fmt.Errorf("Could not translate node: %v", err)
+	}
+	title := getNodeTitle(translated)
+	if c.Node.Path == "/" || title == "Untitled" {
+		title = c.Site.Title
+	}
+	nodeURL := c.Site.BaseURL + dirPath(c.Node.Path)
+	var feed interface{}
+	contentType := "application/rss+xml; charset=utf-8"
+	if c.Feed == "atom" {
+		feed = newAtomFeed(title, c.Site.Title, nodeURL, c.Locale, items,
+			time.Now())
+		contentType = "application/atom+xml; charset=utf-8"
+	} else {
+		feed = newRSSFeed(title, nodeURL, c.Locale, items, time.Now())
+	}
+	content, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not marshal feed: %v", err)
+	}
+	c.Res.Header().Set("Content-Type", contentType)
+	c.Res.Write([]byte(xml.Header))
+	c.Res.Write(content)
+	return nil
+}
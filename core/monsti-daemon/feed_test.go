@@ -0,0 +1,150 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestSplitFeed(t *testing.T) {
+	tests := []struct {
+		Path, NodePath, Format string
+	}{
+		{"/blog/feed.xml", "/blog", "rss"},
+		{"/blog/atom.xml", "/blog", "atom"},
+		{"/feed.xml", "/", "rss"},
+		{"/blog/other.xml", "/blog/other.xml", ""},
+		{"/blog", "/blog", ""},
+	}
+	for _, test := range tests {
+		nodePath, format := splitFeed(test.Path)
+		if nodePath != test.NodePath || format != test.Format {
+			t.Errorf("splitFeed(%q) = %q, %q, should be %q, %q", test.Path,
+				nodePath, format, test.NodePath, test.Format)
+		}
+	}
+}
+
+func TestGetFeedNodes(t *testing.T) {
+	now := time.Date(2014, 3, 8, 12, 0, 0, 0, time.UTC)
+	node := func(nodePath, nodeType string, published time.Time,
+		public bool) *service.Node {
+		return &service.Node{Path: nodePath, Public: public,
+			PublishTime: published, Type: &service.NodeType{Id: nodeType,
+				Hide: nodeType == "core.File" || nodeType == "core.BlogPost"}}
+	}
+	day := func(day int) time.Time {
+		return time.Date(2014, 3, day, 0, 0, 0, 0, time.UTC)
+	}
+	children := map[string][]*service.Node{
+		"/news": {node("/news/a", "core.Document", day(1), true),
+			node("/news/b", "core.Document", day(5), true),
+			node("/news/draft", "core.Document", day(2), false),
+			node("/news/future", "core.Document", day(9), true),
+			node("/news/file", "core.File", day(3), true)},
+		"/blog":      {node("/blog/2014", "core.Path", day(1), true)},
+		"/blog/2014": {node("/blog/2014/03", "core.Path", day(1), true)},
+		"/blog/2014/03": {node("/blog/2014/03/a", "core.BlogPost", day(3), true),
+			node("/blog/2014/03/b", "core.BlogPost", day(7), true)},
+	}
+	getChildrenFn := func(nodePath string) ([]*service.Node, error) {
+		return children[nodePath], nil
+	}
+	tests := []struct {
+		Node     *service.Node
+		Expected []string
+	}{
+		{node("/news", "core.Document", day(1), true), []string{"b", "a"}},
+		{node("/blog", "core.Blog", day(1), true), []string{"b", "a"}},
+	}
+	for _, test := range tests {
+		nodes, err := getFeedNodes(test.Node, now, getChildrenFn)
+		if err != nil {
+			t.Fatalf("getFeedNodes(%q) returned error: %v", test.Node.Path, err)
+		}
+		if names := postNames(nodes); !reflect.DeepEqual(names, test.Expected) {
+			t.Errorf("getFeedNodes(%q) = %v, should be %v", test.Node.Path, names,
+				test.Expected)
+		}
+	}
+}
+
+func TestFeeds(t *testing.T) {
+	now := time.Date(2014, 3, 8, 12, 0, 0, 0, time.UTC)
+	title := service.TextField("Hello")
+	body := service.HTMLField("<p>Hello <b>world</b></p>")
+	nodes := []*service.Node{
+		{Path: "/blog/2014/03/hello", PublishTime: now,
+			Fields: map[string]service.Field{"core.Title": &title,
+				"core.Body": &body}},
+		{Path: "/blog/2014/03/old", PublishTime: now.Add(-time.Hour)}}
+	settings := &feedSettings{Items: 1}
+	items, err := getFeedItems(nodes, "http://example.com", "en", settings)
+	if err != nil {
+		t.Fatalf("getFeedItems returned error: %v", err)
+	}
+	expected := []feedItem{{Title: "Hello",
+		URL:       "http://example.com/blog/2014/03/hello/",
+		Published: now, Description: "Hello world"}}
+	if !reflect.DeepEqual(items, expected) {
+		t.Errorf("getFeedItems() = %v, should be %v", items, expected)
+	}
+
+	rss, err := xml.Marshal(newRSSFeed("Blog", "http://example.com/blog/", "en",
+		items, now))
+	if err != nil {
+		t.Fatalf("Could not marshal RSS feed: %v", err)
+	}
+	for _, part := range []string{`<rss version="2.0"`,
+		`<atom:link href="http://example.com/blog/feed.xml" rel="self"`,
+		"<lastBuildDate>Sat, 08 Mar 2014 12:00:00 +0000</lastBuildDate>",
+		`<guid isPermaLink="true">http://example.com/blog/2014/03/hello/</guid>`,
+		"<description>Hello world</description>"} {
+		if !strings.Contains(string(rss), part) {
+			t.Errorf("RSS feed %s should contain %s", rss, part)
+		}
+	}
+
+	settings.FullText = true
+	if items, err = getFeedItems(nodes, "http://example.com", "en",
+		settings); err != nil {
+		t.Fatalf("getFeedItems returned error: %v", err)
+	}
+	if !items[0].HTML || items[0].Description != string(body) {
+		t.Errorf("Full text item is %v", items[0])
+	}
+	atom, err := xml.Marshal(newAtomFeed("Blog", "Example", "http://example.com/blog/",
+		"en", items, now))
+	if err != nil {
+		t.Fatalf("Could not marshal Atom feed: %v", err)
+	}
+	for _, part := range []string{`<feed xmlns="http://www.w3.org/2005/Atom"`,
+		`<link href="http://example.com/blog/atom.xml" rel="self">`,
+		"<updated>2014-03-08T12:00:00Z</updated>",
+		"<author><name>Example</name></author>",
+		`<content type="html">&lt;p&gt;Hello &lt;b&gt;world&lt;/b&gt;&lt;/p&gt;</content>`} {
+		if !strings.Contains(string(atom), part) {
+			t.Errorf("Atom feed %s should contain %s", atom, part)
+		}
+	}
+}
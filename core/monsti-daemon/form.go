@@ -0,0 +1,777 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chrneumann/htmlwidgets"
+	"github.com/chrneumann/mimemail"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// maxFormUploadSize limits the size of form submissions with file
+// uploads.
+const maxFormUploadSize = 10 * 1024 * 1024
+
+// formField is a field of a core.Form node as defined in the editor.
+type formField struct {
+	// Id identifies the field's value in the form and in stored
+	// submissions.
+	Id       string
+	Label    string
+	Type     string
+	Required bool
+	// Options are the choices of select fields or the accepted types of
+	// file fields, either MIME types like "application/pdf" and
+	// "image/*" or file extensions like ".pdf".
+	Options []string
+	// MaxSize limits the size of files uploaded to file fields in
+	// bytes. Zero means maxFormUploadSize.
+	MaxSize int64
+}
+
+// formFieldTypes are the available types of form fields.
+var formFieldTypes = []string{"text", "textarea", "select", "checkbox", "file"}
+
+// defaultFormFields returns the fields of forms without defined
+// fields, i.e. those of a classic contact form.
+func defaultFormFields(G func(string) string) []formField {
+	return []formField{
+		{Id: "name", Label: G("Name"), Type: "text", Required: true},
+		{Id: "email", Label: G("Email"), Type: "text", Required: true},
+		{Id: "subject", Label: G("Subject"), Type: "text", Required: true},
+		{Id: "message", Label: G("Message"), Type: "textarea", Required: true},
+	}
+}
+
+// getFormFields returns the fields defined by the core.FormFields
+// field of the given form node. Rows without label are skipped.
+func getFormFields(node *service.Node, G func(string) string) []formField {
+	list, ok := node.GetField("core.FormFields").(*service.ListField)
+	if !ok || len(list.Rows) == 0 {
+		return defaultFormFields(G)
+	}
+	fields := make([]formField, 0, len(list.Rows))
+	for i, row := range list.Rows {
+		get := func(id string) string {
+			if value, ok := row[id]; ok {
+				return strings.TrimSpace(value.String())
+			}
+			return ""
+		}
+		field := formField{
+			Id:       fmt.Sprintf("field%d", i+1),
+			Label:    get("Label"),
+			Type:     "text",
+			Required: get("Required") == "required"}
+		if field.Label == "" {
+			continue
+		}
+		for _, fieldType := range formFieldTypes {
+			if get("Type") == fieldType {
+				field.Type = fieldType
+			}
+		}
+		for _, option := range strings.Split(get("Options"), ",") {
+			if option = strings.TrimSpace(option); option != "" {
+				field.Options = append(field.Options, option)
+			}
+		}
+		if size, err := strconv.ParseFloat(get("MaxSize"), 64); err == nil &&
+			size > 0 && size*1024*1024 < maxFormUploadSize {
+			field.MaxSize = int64(size * 1024 * 1024)
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// uploadMIMEType returns the MIME type of the uploaded file according
+// to its extension or, if unknown, its content.
+func uploadMIMEType(name string, content []byte) string {
+	mimeType := mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+	if mimeType == "" {
+		mimeType = http.DetectContentType(content)
+	}
+	if i := strings.Index(mimeType, ";"); i >= 0 {
+		mimeType = mimeType[:i]
+	}
+	return strings.TrimSpace(mimeType)
+}
+
+// acceptsFile returns true if the file field accepts files with the
+// given name and MIME type. Fields without types accept all files.
+func (f formField) acceptsFile(name, mimeType string) bool {
+	if len(f.Options) == 0 {
+		return true
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, accepted := range f.Options {
+		accepted = strings.ToLower(accepted)
+		switch {
+		case strings.HasPrefix(accepted, "."):
+			if ext == accepted {
+				return true
+			}
+		case strings.HasSuffix(accepted, "/*"):
+			if strings.HasPrefix(mimeType, strings.TrimSuffix(accepted, "*")) {
+				return true
+			}
+		case mimeType == accepted:
+			return true
+		}
+	}
+	return false
+}
+
+// maxFileSize returns the maximum size of files uploaded to the field.
+func (f formField) maxFileSize() int64 {
+	if f.MaxSize > 0 {
+		return f.MaxSize
+	}
+	return maxFormUploadSize
+}
+
+// getFormSubmit returns how submissions of the form node get
+// handled: "mail" (the default), "store" or "mail-store".
+func getFormSubmit(node *service.Node) string {
+	if field := node.GetField("core.FormSubmit"); field != nil &&
+		field.String() != "" {
+		return field.String()
+	}
+	return "mail"
+}
+
+type formSubmissionData struct {
+	Fields util.NestedMap
+}
+
+// addFormWidget adds the widget of the field to the form.
+func addFormWidget(form *htmlwidgets.Form, data util.NestedMap,
+	field formField, G func(string) string) {
+	id := "Fields." + field.Id
+	minLength := 0
+	if field.Required {
+		minLength = 1
+	}
+	switch field.Type {
+	case "textarea":
+		data.Set(field.Id, "")
+		form.AddWidget(&htmlwidgets.TextAreaWidget{MinLength: minLength,
+			ValidationError: G("Required.")}, id, field.Label, "")
+	case "select":
+		data.Set(field.Id, "")
+		options := make([]htmlwidgets.SelectOption, 0, len(field.Options)+1)
+		if !field.Required {
+			options = append(options, htmlwidgets.SelectOption{"", "", false})
+		}
+		for i, option := range field.Options {
+			options = append(options, htmlwidgets.SelectOption{option, option,
+				field.Required && i == 0})
+		}
+		form.AddWidget(&htmlwidgets.SelectWidget{Options: options}, id,
+			field.Label, "")
+	case "checkbox":
+		data.Set(field.Id, false)
+		form.AddWidget(new(htmlwidgets.BoolWidget), id, field.Label, "")
+	case "file":
+		data.Set(field.Id, "")
+		form.AddWidget(new(htmlwidgets.FileWidget), id, field.Label, "")
+	default:
+		data.Set(field.Id, "")
+		form.AddWidget(&htmlwidgets.TextWidget{MinLength: minLength,
+			ValidationError: G("Required.")}, id, field.Label, "")
+	}
+}
+
+// formSubmission holds the submitted values of a form.
+type formSubmission struct {
+	// Values map field ids to the submitted values. The value of file
+	// fields is the file name.
+	Values map[string]string
+	// Files map the ids of file fields to the uploaded files.
+	Files map[string]*uploadedFile
+}
+
+// getFormSubmission validates and returns the submitted values of the
+// filled form. It returns nil if the submission is invalid.
+//
+// Uploaded files must match the size and types of their fields. They
+// get scanned by modules, flagged files are rejected.
+func getFormSubmission(c *reqContext, form *htmlwidgets.Form,
+	data util.NestedMap, fields []formField, G func(string) string) (
+	*formSubmission, error) {
+	submission := &formSubmission{make(map[string]string),
+		make(map[string]*uploadedFile)}
+	valid := true
+	for _, field := range fields {
+		id := "Fields." + field.Id
+		switch field.Type {
+		case "select":
+			value, _ := data.Get(field.Id).(string)
+			known := value == "" && !field.Required
+			for _, option := range field.Options {
+				known = known || option == value
+			}
+			if !known {
+				form.AddError(id, G("Please choose an option."))
+				valid = false
+			}
+			submission.Values[field.Id] = value
+		case "checkbox":
+			checked, _ := data.Get(field.Id).(bool)
+			if field.Required && !checked {
+				form.AddError(id, G("Required."))
+				valid = false
+			}
+			submission.Values[field.Id] = G("No")
+			if checked {
+				submission.Values[field.Id] = G("Yes")
+			}
+		case "file":
+			var file *uploadedFile
+			if c.Req.MultipartForm != nil {
+				if upload, header, err := c.Req.FormFile(id); err == nil {
+					content, err := ioutil.ReadAll(upload)
+					upload.Close()
+					if err != nil {
+						return nil, fmt.Errorf("Could not read multipart file: %v", err)
+					}
+					file = &uploadedFile{Name: filepath.Base(header.Filename),
+						Content: content}
+				}
+			}
+			if file == nil {
+				if field.Required {
+					form.AddError(id, G("Please choose a file."))
+					valid = false
+				}
+				submission.Values[field.Id] = ""
+				continue
+			}
+			if size := field.maxFileSize(); int64(len(file.Content)) > size {
+				form.AddError(id, fmt.Sprintf(G("The file is too large (at most %v MiB)."),
+					strconv.FormatFloat(float64(size)/(1024*1024), 'f', -1, 64)))
+				valid = false
+			} else if !field.acceptsFile(file.Name,
+				uploadMIMEType(file.Name, file.Content)) {
+				form.AddError(id, fmt.Sprintf(G("Please choose a file of type %v."),
+					strings.Join(field.Options, ", ")))
+				valid = false
+			} else {
+				reason, err := scanUpload(c, file.Name, file.Content)
+				if err != nil {
+					return nil, fmt.Errorf("Could not scan upload: %v", err)
+				}
+				if reason != "" {
+					form.AddError(id, fmt.Sprintf(G("The file has been rejected: %v"),
+						reason))
+					valid = false
+				}
+			}
+			submission.Values[field.Id] = file.Name
+			submission.Files[field.Id] = file
+		default:
+			value, _ := data.Get(field.Id).(string)
+			submission.Values[field.Id] = strings.TrimSpace(value)
+		}
+	}
+	if !valid {
+		return nil, nil
+	}
+	return submission, nil
+}
+
+// attachments returns the uploaded files of the submission as mail
+// attachments in the order of the given fields.
+func (s *formSubmission) attachments(fields []formField) []service.MailAttachment {
+	var ret []service.MailAttachment
+	for _, field := range fields {
+		if file, ok := s.Files[field.Id]; ok {
+			ret = append(ret, service.MailAttachment{Name: file.Name,
+				Type: uploadMIMEType(file.Name, file.Content), Content: file.Content})
+		}
+	}
+	return ret
+}
+
+// formSubmissionMail returns a mail to the site owner containing the
+// submitted values.
+func formSubmissionMail(site util.SiteSettings, title string,
+	fields []formField, submission *formSubmission) *mimemail.Mail {
+	var body bytes.Buffer
+	for _, field := range fields {
+		fmt.Fprintf(&body, "%v:\n%v\n\n", field.Label,
+			submission.Values[field.Id])
+	}
+	mail := mimemail.Mail{
+		From:    mimemail.Address{site.EmailName, site.EmailAddress},
+		Subject: title,
+		Body:    body.Bytes()}
+	owner := mimemail.Address{site.Owner.Name, site.Owner.Email}
+	mail.To = []mimemail.Address{owner}
+	return &mail
+}
+
+// submissionFieldId returns the id of the local field holding the
+// value of the given form field in stored submissions.
+func submissionFieldId(field formField) string {
+	return "submission." + field.Id
+}
+
+// storeFormSubmission stores the submission as hidden, non-public
+// child node of the form node and returns the submission's path.
+// Uploaded files are stored as node data of the submission.
+func storeFormSubmission(c *reqContext, fields []formField,
+	submission *formSubmission, now time.Time) (string, error) {
+	nodeType, err := c.Serv.Monsti().GetNodeType("core.FormSubmission")
+	if err != nil {
+		return "", fmt.Errorf("Could not get submission node type: %v", err)
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("Could not generate submission name: %v", err)
+	}
+	node := service.Node{
+		Path: path.Join(c.Node.Path, "submission-"+
+			now.Format("20060102-150405")+"-"+hex.EncodeToString(suffix)),
+		Type:        nodeType,
+		Hide:        true,
+		PublishTime: now}
+	for _, field := range fields {
+		name := make(map[string]string, len(availableLocales))
+		for _, locale := range availableLocales {
+			name[locale] = field.Label
+		}
+		node.LocalFields = append(node.LocalFields, &service.NodeField{
+			Id: submissionFieldId(field), Name: name, Type: "Text"})
+	}
+	if err := node.InitFields(c.Serv.Monsti(), c.Site.Name); err != nil {
+		return "", fmt.Errorf("Could not init submission fields: %v", err)
+	}
+	*(node.GetField("core.Title").(*service.TextField)) = service.TextField(
+		now.Format("2006-01-02 15:04:05 MST"))
+	for _, field := range fields {
+		*(node.GetField(submissionFieldId(field)).(*service.TextField)) =
+			service.TextField(submission.Values[field.Id])
+	}
+	if err := c.Serv.Monsti().WriteNode(c.Site.Name, node.Path,
+		&node); err != nil {
+		return "", fmt.Errorf("Could not write submission: %v", err)
+	}
+	for _, field := range fields {
+		file, ok := submission.Files[field.Id]
+		if !ok {
+			continue
+		}
+		if err := c.Serv.Monsti().WriteNodeData(c.Site.Name, node.Path,
+			"__file_"+submissionFieldId(field), file.Content); err != nil {
+			return "", fmt.Errorf("Could not save file: %v", err)
+		}
+	}
+	return node.Path, nil
+}
+
+// submitFormValues handles the valid submission of the requested form
+// node and returns the URL to redirect the visitor to.
+//
+// Depending on the node's core.FormSubmit field, the submission gets
+// mailed and/or stored as child node. Uploaded files get attached to
+// the mail. The mail of stored submissions links to them. If the mail
+// of a submission without payment can't be sent, the submission gets
+// stored instead, so it does not get lost.
+func submitFormValues(c *reqContext, h *nodeHandler, fields []formField,
+	submission *formSubmission, mail *mimemail.Mail) (string, error) {
+	submit := getFormSubmit(c.Node)
+	target := dirPath(c.Node.Path) + "?submitted"
+	var storedPath string
+	if submit != "mail" {
+		var err error
+		storedPath, err = storeFormSubmission(c, fields, submission,
+			time.Now().UTC())
+		if err != nil {
+			return "", err
+		}
+	}
+	if submit == "store" {
+		return target, nil
+	}
+	if storedPath != "" {
+		mail.Body = append(mail.Body, fmt.Sprintf("\n%v%v/\n",
+			h.Settings.Monsti.Sites[c.Site.Name].BaseURL, storedPath)...)
+	}
+	mailTarget, err := submitFormMail(c, h, mail,
+		submission.attachments(fields))
+	if err != nil && storedPath == "" && c.Node.Payment == nil {
+		h.Log.Printf("Storing submission of %q which could not be mailed: %v",
+			c.Node.Path, err)
+		if _, err := storeFormSubmission(c, fields, submission,
+			time.Now().UTC()); err != nil {
+			return "", err
+		}
+		return target, nil
+	}
+	return mailTarget, err
+}
+
+// wizardFormFields returns the form fields of the given fields of a
+// multi-step form.
+func wizardFormFields(fields []*service.NodeField, locale string) []formField {
+	ret := make([]formField, 0, len(fields))
+	for _, field := range fields {
+		ret = append(ret, formField{Id: field.Id, Label: field.Name[locale],
+			Type: "text"})
+	}
+	return ret
+}
+
+// submissionFields returns the fields of submissions of the given
+// form node.
+func submissionFields(node *service.Node, locale string) []formField {
+	G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+	if len(node.FormSteps) > 0 {
+		return wizardFormFields(formStepsFields(node.FormSteps), locale)
+	}
+	return getFormFields(node, G)
+}
+
+// renderForm renders the form of the requested core.Form node and
+// handles its submission (see submitFormValues).
+func renderForm(c *reqContext, context template.Context,
+	formValues url.Values, h *nodeHandler) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.Site.Locale)
+	fields := getFormFields(c.Node, G)
+	data := formSubmissionData{Fields: make(util.NestedMap)}
+	form := htmlwidgets.NewForm(&data)
+	form.Action = c.FormAction
+	hasFiles := false
+	for _, field := range fields {
+		addFormWidget(form, data.Fields, field, G)
+		hasFiles = hasFiles || field.Type == "file"
+	}
+
+	switch c.Req.Method {
+	case "GET":
+		if _, submitted := formValues["submitted"]; submitted {
+			context["Submitted"] = 1
+		}
+		if _, failed := formValues["payment-failed"]; failed {
+			context["PaymentFailed"] = 1
+		}
+	case "POST":
+		if hasFiles {
+			c.Req.Body = http.MaxBytesReader(c.Res, c.Req.Body, maxFormUploadSize)
+			if err := c.Req.ParseMultipartForm(1024 * 1024); err != nil &&
+				err != http.ErrNotMultipart {
+				form.AddError("", G("The submitted files are too large."))
+				break
+			}
+		}
+		if !form.Fill(formValues) {
+			break
+		}
+		submission, err := getFormSubmission(c, form, data.Fields, fields, G)
+		if err != nil {
+			return err
+		}
+		if submission == nil {
+			break
+		}
+		mail := formSubmissionMail(h.Settings.Monsti.Sites[c.Site.Name],
+			getNodeTitle(c.Node), fields, submission)
+		target, err := submitFormValues(c, h, fields, submission, mail)
+		if err != nil {
+			return fmt.Errorf("Could not submit form: %v", err)
+		}
+		http.Redirect(c.Res, c.Req, target, http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	context["Form"] = form.RenderData()
+	return nil
+}
+
+// storedSubmission is a stored form submission as listed and exported.
+type storedSubmission struct {
+	Name string
+	Time time.Time
+	// Values map column ids to values.
+	Values map[string]string
+}
+
+// submissionColumn is a column of listed or exported submissions.
+type submissionColumn struct {
+	Id, Label string
+	// File is true for columns of file fields.
+	File bool
+}
+
+type storedSubmissionsByTime []*storedSubmission
+
+func (s storedSubmissionsByTime) Len() int      { return len(s) }
+func (s storedSubmissionsByTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s storedSubmissionsByTime) Less(i, j int) bool {
+	return s[i].Time.After(s[j].Time)
+}
+
+// getStoredSubmissions returns the submissions stored below the given
+// form node, latest first, and the columns of all submissions in the
+// order of the form's current fields. Columns of removed fields
+// follow.
+func getStoredSubmissions(c *reqContext, node *service.Node,
+	fields []formField, locale string) (
+	[]*storedSubmission, []submissionColumn, error) {
+	children, err := c.Serv.Monsti().GetChildren(c.Site.Name, node.Path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not get submissions: %v", err)
+	}
+	columns := make([]submissionColumn, 0, len(fields))
+	known := make(map[string]bool)
+	for _, field := range fields {
+		columns = append(columns, submissionColumn{submissionFieldId(field),
+			field.Label, field.Type == "file"})
+		known[submissionFieldId(field)] = true
+	}
+	submissions := make([]*storedSubmission, 0)
+	for _, child := range children {
+		if child.Type == nil || child.Type.Id != "core.FormSubmission" {
+			continue
+		}
+		submission := &storedSubmission{Name: child.Name(),
+			Time: child.PublishTime, Values: make(map[string]string)}
+		for _, field := range child.LocalFields {
+			if !known[field.Id] {
+				label, ok := field.Name[locale]
+				if !ok {
+					label = field.Id
+				}
+				columns = append(columns, submissionColumn{field.Id, label, false})
+				known[field.Id] = true
+			}
+			if value := child.GetField(field.Id); value != nil {
+				submission.Values[field.Id] = value.String()
+			}
+		}
+		submissions = append(submissions, submission)
+	}
+	sort.Sort(storedSubmissionsByTime(submissions))
+	return submissions, columns, nil
+}
+
+// matches returns true if the submission's values contain all the
+// given lower case terms.
+func (s *storedSubmission) matches(terms []string) bool {
+	values := make([]string, 0, len(s.Values))
+	for _, value := range s.Values {
+		values = append(values, value)
+	}
+	text := strings.ToLower(strings.Join(values, " "))
+	for _, term := range terms {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterSubmissions returns the submissions matching all terms of the
+// query.
+func filterSubmissions(submissions []*storedSubmission,
+	query string) []*storedSubmission {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return submissions
+	}
+	ret := make([]*storedSubmission, 0)
+	for _, submission := range submissions {
+		if submission.matches(terms) {
+			ret = append(ret, submission)
+		}
+	}
+	return ret
+}
+
+// submissionRecord is an exported submission in JSON files.
+type submissionRecord struct {
+	Submitted time.Time
+	// Values map column labels to values.
+	Values map[string]string
+}
+
+// exportSubmissions writes the submissions in the given format ("csv"
+// or "json"). The first CSV column holds the submission time according
+// to RFC 3339.
+func exportSubmissions(submissions []*storedSubmission,
+	columns []submissionColumn, format string, w io.Writer) error {
+	switch format {
+	case "csv":
+		writer := csv.NewWriter(w)
+		header := []string{"Submitted"}
+		for _, column := range columns {
+			header = append(header, column.Label)
+		}
+		writer.Write(header)
+		for _, submission := range submissions {
+			record := []string{submission.Time.UTC().Format(time.RFC3339)}
+			for _, column := range columns {
+				record = append(record, submission.Values[column.Id])
+			}
+			writer.Write(record)
+		}
+		writer.Flush()
+		return writer.Error()
+	case "json":
+		records := make([]submissionRecord, 0, len(submissions))
+		for _, submission := range submissions {
+			record := submissionRecord{submission.Time.UTC(),
+				make(map[string]string)}
+			for _, column := range columns {
+				if value, ok := submission.Values[column.Id]; ok {
+					record.Values[column.Label] = value
+				}
+			}
+			records = append(records, record)
+		}
+		content, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			return fmt.Errorf("Could not marshal submissions: %v", err)
+		}
+		_, err = w.Write(content)
+		return err
+	}
+	return fmt.Errorf("Unknown format %q", format)
+}
+
+// Submissions lists the submissions stored below the requested form
+// node and handles their search (form value "q"), export, download of
+// uploaded files (form values "submission" and "file") and removal.
+func (h *nodeHandler) Submissions(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if c.Node.Type == nil || (c.Node.Type.Id != "core.Form" &&
+		c.Node.Type.Id != "core.ContactForm") {
+		return fmt.Errorf("Node %q is not a form", c.Node.Path)
+	}
+	if err := c.Req.ParseForm(); err != nil {
+		return fmt.Errorf("Could not parse form: %v", err)
+	}
+	var submission *service.Node
+	if name := c.Req.Form.Get("submission"); name != "" {
+		var err error
+		submission, err = c.Serv.Monsti().GetNode(c.Site.Name,
+			path.Join(c.Node.Path, path.Base("/"+name)))
+		if err != nil {
+			return fmt.Errorf("Could not get submission: %v", err)
+		}
+		if submission != nil && (submission.Type == nil ||
+			submission.Type.Id != "core.FormSubmission") {
+			submission = nil
+		}
+	}
+	switch c.Req.Method {
+	case "GET":
+		if file := c.Req.Form.Get("file"); file != "" {
+			var value service.Field
+			if submission != nil {
+				value = submission.GetField(file)
+			}
+			if value == nil || value.String() == "" {
+				h.serveErrorPage(c, http.StatusNotFound)
+				return nil
+			}
+			content, err := c.Serv.Monsti().GetNodeData(c.Site.Name,
+				submission.Path, "__file_"+file)
+			if err != nil {
+				return fmt.Errorf("Could not read submitted file: %v", err)
+			}
+			c.Res.Header().Set("Content-Disposition", mime.FormatMediaType(
+				"attachment", map[string]string{"filename": value.String()}))
+			serveNodeFile(c, value.String(), content)
+			return nil
+		}
+	case "POST":
+		if submission != nil {
+			if err := c.Serv.Monsti().RemoveNode(c.Site.Name,
+				submission.Path); err != nil {
+				return fmt.Errorf("Could not remove submission: %v", err)
+			}
+		}
+		http.Redirect(c.Res, c.Req, "@@submissions", http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	submissions, columns, err := getStoredSubmissions(c, c.Node,
+		submissionFields(c.Node, c.Site.Locale), c.UserSession.Locale)
+	if err != nil {
+		return err
+	}
+	query := strings.TrimSpace(c.Req.Form.Get("q"))
+	submissions = filterSubmissions(submissions, query)
+	if format := c.Req.Form.Get("export"); format != "" {
+		var out bytes.Buffer
+		if err := exportSubmissions(submissions, columns, format,
+			&out); err != nil {
+			return fmt.Errorf("Could not export submissions: %v", err)
+		}
+		if format == "csv" {
+			c.Res.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		} else {
+			c.Res.Header().Set("Content-Type", "application/json")
+		}
+		c.Res.Header().Set("Content-Disposition",
+			fmt.Sprintf("attachment; filename=submissions.%v", format))
+		c.Res.Write(out.Bytes())
+		return nil
+	}
+	body, err := h.Renderer.Render("actions/submissions", template.Context{
+		"Query":       query,
+		"Submissions": submissions,
+		"Columns":     columns}, c.UserSession.Locale,
+		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render submissions: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   fmt.Sprintf(G("Submissions of \"%v\""), c.Node.Path),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
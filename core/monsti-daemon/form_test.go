@@ -0,0 +1,257 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrneumann/htmlwidgets"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// newFormNode returns a core.Form node with the given rows of
+// core.FormFields.
+func newFormNode(t *testing.T, rows []map[string]string) *service.Node {
+	nodeType := service.NodeType{Id: "core.Form", Fields: []*service.NodeField{
+		{Id: "core.FormFields", Type: "List", Fields: []*service.NodeField{
+			{Id: "Label", Type: "Text"}, {Id: "Type", Type: "Text"},
+			{Id: "Required", Type: "Text"}, {Id: "Options", Type: "Text"},
+			{Id: "MaxSize", Type: "Text"}}},
+		{Id: "core.FormSubmit", Type: "Select"}}}
+	node := service.Node{Path: "/form", Type: &nodeType}
+	if err := node.InitFields(nil, ""); err != nil {
+		t.Fatalf("Could not init fields: %v", err)
+	}
+	list := node.GetField("core.FormFields").(*service.ListField)
+	for _, values := range rows {
+		row := make(map[string]service.Field)
+		for id, value := range values {
+			text := service.TextField(value)
+			row[id] = &text
+		}
+		list.Rows = append(list.Rows, row)
+	}
+	return &node
+}
+
+func TestGetFormFields(t *testing.T) {
+	G := func(in string) string { return in }
+	node := newFormNode(t, nil)
+	if fields := getFormFields(node, G); !reflect.DeepEqual(fields,
+		defaultFormFields(G)) {
+		t.Errorf("Fields of form without rows are %v, should be defaults",
+			fields)
+	}
+	if submit := getFormSubmit(node); submit != "mail" {
+		t.Errorf("getFormSubmit() = %q, should be %q", submit, "mail")
+	}
+	node = newFormNode(t, []map[string]string{
+		{"Label": "Name", "Type": "text", "Required": "required"},
+		{"Label": ""},
+		{"Label": "Topic", "Type": "select", "Options": " A, B ,,C"},
+		{"Label": "Other", "Type": "unknown"},
+		{"Label": "CV", "Type": "file", "Options": ".pdf", "MaxSize": "0.5"},
+		{"Label": "Photo", "Type": "file", "MaxSize": "100"}})
+	expected := []formField{
+		{Id: "field1", Label: "Name", Type: "text", Required: true},
+		{Id: "field3", Label: "Topic", Type: "select",
+			Options: []string{"A", "B", "C"}},
+		{Id: "field4", Label: "Other", Type: "text"},
+		{Id: "field5", Label: "CV", Type: "file", Options: []string{".pdf"},
+			MaxSize: 512 * 1024},
+		{Id: "field6", Label: "Photo", Type: "file"}}
+	if fields := getFormFields(node, G); !reflect.DeepEqual(fields, expected) {
+		t.Errorf("getFormFields() = %v, should be %v", fields, expected)
+	}
+}
+
+func TestAcceptsFile(t *testing.T) {
+	tests := []struct {
+		Types          []string
+		Name, MIMEType string
+		Accepted       bool
+	}{
+		{nil, "cv.exe", "application/octet-stream", true},
+		{[]string{".pdf"}, "CV.PDF", "application/pdf", true},
+		{[]string{".pdf"}, "cv.doc", "application/msword", false},
+		{[]string{"image/*"}, "photo.jpg", "image/jpeg", true},
+		{[]string{"image/*"}, "photo.pdf", "application/pdf", false},
+		{[]string{".doc", "application/pdf"}, "cv", "application/pdf", true},
+	}
+	for _, test := range tests {
+		field := formField{Type: "file", Options: test.Types}
+		if accepted := field.acceptsFile(test.Name, test.MIMEType); accepted !=
+			test.Accepted {
+			t.Errorf("acceptsFile(%q, %q) with types %v = %v, should be %v",
+				test.Name, test.MIMEType, test.Types, accepted, test.Accepted)
+		}
+	}
+	if mimeType := uploadMIMEType("cv.pdf", nil); mimeType != "application/pdf" {
+		t.Errorf("uploadMIMEType(\"cv.pdf\") = %q, should be application/pdf",
+			mimeType)
+	}
+	if mimeType := uploadMIMEType("file", []byte("%PDF-1.4")); mimeType !=
+		"application/pdf" {
+		t.Errorf("uploadMIMEType(\"file\") = %q, should be application/pdf",
+			mimeType)
+	}
+}
+
+func TestGetFormSubmission(t *testing.T) {
+	G := func(in string) string { return in }
+	fields := []formField{
+		{Id: "name", Label: "Name", Type: "text"},
+		{Id: "topic", Label: "Topic", Type: "select", Options: []string{"A", "B"},
+			Required: true},
+		{Id: "terms", Label: "Terms", Type: "checkbox", Required: true}}
+	req, _ := http.NewRequest("POST", "/form/", nil)
+	c := &reqContext{Req: req}
+	tests := []struct {
+		Values   map[string]interface{}
+		Expected map[string]string
+	}{
+		{map[string]interface{}{"name": " Jane ", "topic": "B", "terms": true},
+			map[string]string{"name": "Jane", "topic": "B", "terms": "Yes"}},
+		{map[string]interface{}{"name": "", "topic": "C", "terms": true}, nil},
+		{map[string]interface{}{"name": "", "topic": "A", "terms": false}, nil},
+	}
+	for i, test := range tests {
+		data := make(util.NestedMap)
+		form := htmlwidgets.NewForm(&formSubmissionData{data})
+		for _, field := range fields {
+			addFormWidget(form, data, field, G)
+		}
+		for id, value := range test.Values {
+			data.Set(id, value)
+		}
+		submission, err := getFormSubmission(c, form, data, fields, G)
+		if err != nil {
+			t.Fatalf("Test %v: getFormSubmission returned error: %v", i, err)
+		}
+		if test.Expected == nil {
+			if submission != nil {
+				t.Errorf("Test %v: Submission %v should be invalid", i,
+					submission.Values)
+			}
+			continue
+		}
+		if submission == nil || !reflect.DeepEqual(submission.Values,
+			test.Expected) {
+			t.Errorf("Test %v: getFormSubmission(...) = %v, should be %v", i,
+				submission, test.Expected)
+		}
+	}
+}
+
+func TestFormSubmissionMail(t *testing.T) {
+	site := util.SiteSettings{BaseURL: "http://example.com",
+		EmailAddress: "site@example.com"}
+	site.Owner.Email = "owner@example.com"
+	fields := []formField{{Id: "name", Label: "Name"},
+		{Id: "file", Label: "File", Type: "file"}}
+	submission := &formSubmission{Values: map[string]string{"name": "Jane",
+		"file": "cv.pdf"}}
+	mail := formSubmissionMail(site, "Application", fields, submission)
+	expected := "Name:\nJane\n\nFile:\ncv.pdf\n\n"
+	if string(mail.Body) != expected {
+		t.Errorf("Mail body is %q, should be %q", mail.Body, expected)
+	}
+	if mail.Subject != "Application" || mail.To[0].Email != "owner@example.com" {
+		t.Errorf("Mail is %v", mail)
+	}
+}
+
+func TestExportSubmissions(t *testing.T) {
+	submissions := []*storedSubmission{
+		{Name: "b", Time: time.Date(2014, 3, 8, 10, 0, 0, 0, time.UTC),
+			Values: map[string]string{"submission.field1": "Jane",
+				"submission.old": "x"}},
+		{Name: "a", Time: time.Date(2014, 3, 7, 10, 0, 0, 0, time.UTC),
+			Values: map[string]string{"submission.field1": "John, Jr."}}}
+	columns := []submissionColumn{{"submission.field1", "Name", false},
+		{"submission.old", "Old", false}}
+	tests := []struct {
+		Format, Expected string
+	}{
+		{"csv", strings.Join([]string{"Submitted,Name,Old",
+			"2014-03-08T10:00:00Z,Jane,x",
+			`2014-03-07T10:00:00Z,"John, Jr.",`, ""}, "\n")},
+		{"json", `[
+  {
+    "Submitted": "2014-03-08T10:00:00Z",
+    "Values": {
+      "Name": "Jane",
+      "Old": "x"
+    }
+  },
+  {
+    "Submitted": "2014-03-07T10:00:00Z",
+    "Values": {
+      "Name": "John, Jr."
+    }
+  }
+]`}}
+	for _, test := range tests {
+		var out bytes.Buffer
+		if err := exportSubmissions(submissions, columns, test.Format,
+			&out); err != nil {
+			t.Fatalf("exportSubmissions(%q) returned error: %v", test.Format, err)
+		}
+		if out.String() != test.Expected {
+			t.Errorf("exportSubmissions(%q) wrote\n%v\nshould be\n%v",
+				test.Format, out.String(), test.Expected)
+		}
+	}
+	if err := exportSubmissions(submissions, columns, "xml",
+		new(bytes.Buffer)); err == nil {
+		t.Errorf("exportSubmissions(\"xml\") should return an error")
+	}
+}
+
+func TestFilterSubmissions(t *testing.T) {
+	submissions := []*storedSubmission{
+		{Name: "a", Values: map[string]string{"name": "Jane Doe",
+			"message": "Hello"}},
+		{Name: "b", Values: map[string]string{"name": "John Doe",
+			"message": "Bye"}}}
+	tests := []struct {
+		Query    string
+		Expected []string
+	}{
+		{"", []string{"a", "b"}},
+		{"doe", []string{"a", "b"}},
+		{"JANE", []string{"a"}},
+		{"doe bye", []string{"b"}},
+		{"jane bye", []string{}},
+	}
+	for _, test := range tests {
+		names := make([]string, 0)
+		for _, submission := range filterSubmissions(submissions, test.Query) {
+			names = append(names, submission.Name)
+		}
+		if !reflect.DeepEqual(names, test.Expected) {
+			t.Errorf("filterSubmissions(%q) = %v, should be %v", test.Query,
+				names, test.Expected)
+		}
+	}
+}
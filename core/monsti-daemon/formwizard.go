@@ -0,0 +1,370 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chrneumann/htmlwidgets"
+	"github.com/chrneumann/mimemail"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// formState is the server side state of a multi-step form.
+type formState struct {
+	// Step is the index of the current step. If it equals the number
+	// of steps, the user is at the final review step.
+	Step int
+	// Values maps field ids to the dumped field values of already
+	// completed steps.
+	Values map[string]*json.RawMessage
+}
+
+// newFormStateToken returns a random token to identify a form state.
+func newFormStateToken() (string, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.EncodeToString(buf), nil
+}
+
+// validFormStateToken returns true iff token may have been generated
+// by newFormStateToken, i.e. if it can't point outside of the
+// directory of the form states or pending payments.
+func validFormStateToken(token string) bool {
+	buf, err := base32.StdEncoding.DecodeString(token)
+	return err == nil && len(buf) == 20
+}
+
+// formStatePath returns the path to the form state with the given
+// token inside the given site data directory.
+func formStatePath(dataDir, token string) string {
+	return filepath.Join(dataDir, "form-states", token+".json")
+}
+
+// getFormState reads the form state with the given token.
+//
+// If there is no such state, it returns nil, nil.
+func getFormState(dataDir, token string) (*formState, error) {
+	content, err := ioutil.ReadFile(formStatePath(dataDir, token))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Could not read form state: %v", err)
+	}
+	state := new(formState)
+	if err = json.Unmarshal(content, state); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal form state: %v", err)
+	}
+	return state, nil
+}
+
+// writeFormState writes the form state with the given token.
+func writeFormState(dataDir, token string, state *formState) error {
+	path := formStatePath(dataDir, token)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("Could not create form state directory: %v", err)
+	}
+	content, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("Could not marshal form state: %v", err)
+	}
+	if err = ioutil.WriteFile(path, content, 0600); err != nil {
+		return fmt.Errorf("Could not write form state: %v", err)
+	}
+	return nil
+}
+
+// removeFormState removes the form state with the given token.
+func removeFormState(dataDir, token string) error {
+	err := os.Remove(formStatePath(dataDir, token))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Could not remove form state: %v", err)
+	}
+	return nil
+}
+
+// formStateExpiry is the time after which form states get removed. It
+// equals the lifetime of session cookies, whose tokens identify the
+// states.
+const formStateExpiry = 30 * 24 * time.Hour
+
+// removeExpiredFormStates removes the form states of the given site
+// data directory last written more than formStateExpiry before now.
+func removeExpiredFormStates(dataDir string, now time.Time) error {
+	dir := filepath.Join(dataDir, "form-states")
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Could not read form states directory: %v", err)
+	}
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".json" ||
+			now.Sub(file.ModTime()) < formStateExpiry {
+			continue
+		}
+		err := os.Remove(filepath.Join(dir, file.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Could not remove form state: %v", err)
+		}
+	}
+	return nil
+}
+
+// scheduleFormStateCleanup removes the expired form states of all
+// sites once a day.
+func scheduleFormStateCleanup(settings *settings, logger *log.Logger) {
+	for {
+		for site := range settings.Monsti.Sites {
+			if err := removeExpiredFormStates(
+				settings.Monsti.GetSiteDataPath(site), time.Now()); err != nil {
+				logger.Printf("Could not remove expired form states of site %q: %v",
+					site, err)
+			}
+		}
+		time.Sleep(24 * time.Hour)
+	}
+}
+
+// loadFormValues loads the state's values into the given node's fields.
+func (s *formState) loadFormValues(node *service.Node) error {
+	for id, value := range s.Values {
+		field := node.GetField(id)
+		if field == nil || value == nil {
+			continue
+		}
+		f := func(in interface{}) error {
+			return json.Unmarshal(*value, in)
+		}
+		if err := field.Load(f); err != nil {
+			return fmt.Errorf("Could not load value of field %q: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// dumpFormValues stores the values of the given fields into the state.
+func (s *formState) dumpFormValues(node *service.Node,
+	fields []*service.NodeField) error {
+	if s.Values == nil {
+		s.Values = make(map[string]*json.RawMessage)
+	}
+	for _, field := range fields {
+		dump, err := json.Marshal(node.GetField(field.Id).Dump())
+		if err != nil {
+			return fmt.Errorf("Could not marshal field %q: %v", field.Id, err)
+		}
+		msg := json.RawMessage(dump)
+		s.Values[field.Id] = &msg
+	}
+	return nil
+}
+
+// formReviewEntry is a field value as shown at the review step.
+type formReviewEntry struct {
+	Label string
+	Value interface{}
+}
+
+type formWizardData struct {
+	Fields util.NestedMap
+}
+
+// formStepsFields returns the fields of all given steps.
+func formStepsFields(steps []service.FormStep) []*service.NodeField {
+	fields := make([]*service.NodeField, 0)
+	for _, step := range steps {
+		fields = append(fields, step.Fields...)
+	}
+	return fields
+}
+
+// renderFormWizard renders the multi-step form of the requested form node.
+//
+// The already entered values are kept on the server side. The
+// session only stores a token to identify the state.
+func renderFormWizard(c *reqContext, context template.Context,
+	formValues url.Values, h *nodeHandler) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.Site.Locale)
+	locale := c.UserSession.Locale
+	steps := c.Node.FormSteps
+	dataDir := h.Settings.Monsti.GetSiteDataPath(c.Site.Name)
+	sessionKey := "form-state:" + c.Node.Path
+
+	var state *formState
+	token, _ := c.Session.Values[sessionKey].(string)
+	if len(token) > 0 {
+		var err error
+		if state, err = getFormState(dataDir, token); err != nil {
+			return fmt.Errorf("Could not get form state: %v", err)
+		}
+	}
+	if state == nil {
+		var err error
+		if token, err = newFormStateToken(); err != nil {
+			return fmt.Errorf("Could not generate form state token: %v", err)
+		}
+		state = &formState{}
+	}
+	if state.Step > len(steps) {
+		state.Step = len(steps)
+	}
+
+	fields := formStepsFields(steps)
+	values := service.Node{
+		Path: c.Node.Path,
+		Type: &service.NodeType{Id: c.Node.Type.Id, Fields: fields}}
+	if err := values.InitFields(c.Serv.Monsti(), c.Site.Name); err != nil {
+		return fmt.Errorf("Could not init form fields: %v", err)
+	}
+	if err := state.loadFormValues(&values); err != nil {
+		return fmt.Errorf("Could not load form values: %v", err)
+	}
+
+	review := state.Step == len(steps)
+	data := formWizardData{Fields: make(util.NestedMap)}
+	form := htmlwidgets.NewForm(&data)
+	if !review {
+		for _, field := range steps[state.Step].Fields {
+			values.GetField(field.Id).ToFormField(form, data.Fields, field, locale)
+		}
+	}
+
+	switch c.Req.Method {
+	case "GET":
+		if _, submitted := formValues["submitted"]; submitted {
+			context["Submitted"] = 1
+			return nil
+		}
+		if _, failed := formValues["payment-failed"]; failed {
+			context["PaymentFailed"] = 1
+		}
+	case "POST":
+		changed := false
+		switch {
+		case len(formValues.Get("FormBack")) > 0:
+			if state.Step > 0 {
+				state.Step -= 1
+			}
+			changed = true
+		case review:
+			submission := &formSubmission{Values: make(map[string]string)}
+			for _, field := range fields {
+				if value := values.GetField(field.Id); value != nil {
+					submission.Values[field.Id] = value.String()
+				}
+			}
+			target, err := submitFormValues(c, h,
+				wizardFormFields(fields, c.Site.Locale), submission,
+				formValuesMail(c, h, &values, fields))
+			if err != nil {
+				return fmt.Errorf("Could not submit form values: %v", err)
+			}
+			if err := removeFormState(dataDir, token); err != nil {
+				return err
+			}
+			delete(c.Session.Values, sessionKey)
+			if err := c.Session.Save(c.Req, c.Res); err != nil {
+				return fmt.Errorf("Could not save user session: %v", err)
+			}
+			http.Redirect(c.Res, c.Req, target, http.StatusSeeOther)
+			return nil
+		case form.Fill(formValues):
+			for _, field := range steps[state.Step].Fields {
+				values.GetField(field.Id).FromFormField(data.Fields, field)
+			}
+			if err := state.dumpFormValues(&values,
+				steps[state.Step].Fields); err != nil {
+				return fmt.Errorf("Could not store form values: %v", err)
+			}
+			state.Step += 1
+			changed = true
+		}
+		if changed {
+			if err := writeFormState(dataDir, token, state); err != nil {
+				return err
+			}
+			c.Session.Values[sessionKey] = token
+			if err := c.Session.Save(c.Req, c.Res); err != nil {
+				return fmt.Errorf("Could not save user session: %v", err)
+			}
+			http.Redirect(c.Res, c.Req, dirPath(c.Node.Path), http.StatusSeeOther)
+			return nil
+		}
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+
+	wizard := template.Context{
+		"Step":   state.Step + 1,
+		"Steps":  len(steps) + 1,
+		"Review": review,
+		"Form":   form.RenderData(),
+	}
+	if review {
+		wizard["Title"] = G("Review")
+		entries := make([]formReviewEntry, 0, len(fields))
+		for _, field := range fields {
+			entries = append(entries, formReviewEntry{
+				Label: field.Name[locale],
+				Value: values.GetField(field.Id).RenderHTML()})
+		}
+		wizard["Entries"] = entries
+	} else {
+		wizard["Title"] = steps[state.Step].GetLocalTitle(locale)
+	}
+	context["Wizard"] = wizard
+	return nil
+}
+
+// formValuesMail returns a mail to the site owner containing the
+// submitted values of a multi-step form.
+func formValuesMail(c *reqContext, h *nodeHandler, values *service.Node,
+	fields []*service.NodeField) *mimemail.Mail {
+	var body bytes.Buffer
+	for _, field := range fields {
+		fmt.Fprintf(&body, "%v:\n%v\n\n", field.Name[c.Site.Locale],
+			strings.TrimSpace(values.GetField(field.Id).String()))
+	}
+	site := h.Settings.Monsti.Sites[c.Site.Name]
+	mail := mimemail.Mail{
+		From:    mimemail.Address{site.EmailName, site.EmailAddress},
+		Subject: getNodeTitle(c.Node),
+		Body:    body.Bytes()}
+	owner := mimemail.Address{site.Owner.Name, site.Owner.Email}
+	mail.To = []mimemail.Address{owner}
+	return &mail
+}
@@ -0,0 +1,106 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestFormState(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{},
+		"TestFormState")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	state, err := getFormState(root, "unknown")
+	if state != nil || err != nil {
+		t.Errorf(`getFormState(_, "unknown") = %v, %v, should be nil, nil`,
+			state, err)
+	}
+
+	fields := []*service.NodeField{
+		{Id: "foo.Name", Type: "Text"},
+		{Id: "foo.Message", Type: "Text"},
+	}
+	node := service.Node{Type: &service.NodeType{Fields: fields}}
+	if err := node.InitFields(nil, ""); err != nil {
+		t.Fatalf("Could not init fields: %v", err)
+	}
+	*(node.GetField("foo.Name").(*service.TextField)) = "Foo"
+	state = &formState{Step: 1}
+	if err := state.dumpFormValues(&node, fields[:1]); err != nil {
+		t.Fatalf("Could not dump form values: %v", err)
+	}
+	if err := writeFormState(root, "token", state); err != nil {
+		t.Fatalf("Could not write form state: %v", err)
+	}
+	state, err = getFormState(root, "token")
+	if err != nil || state == nil {
+		t.Fatalf("Could not read form state: %v", err)
+	}
+	if state.Step != 1 || len(state.Values) != 1 {
+		t.Errorf("Read form state is %v, should have step 1 and one value", state)
+	}
+	other := service.Node{Type: &service.NodeType{Fields: fields}}
+	other.InitFields(nil, "")
+	if err := state.loadFormValues(&other); err != nil {
+		t.Fatalf("Could not load form values: %v", err)
+	}
+	if ret := other.GetField("foo.Name").String(); ret != "Foo" {
+		t.Errorf(`Loaded value of foo.Name is %q, should be "Foo"`, ret)
+	}
+	if err := removeFormState(root, "token"); err != nil {
+		t.Errorf("Could not remove form state: %v", err)
+	}
+	if state, _ = getFormState(root, "token"); state != nil {
+		t.Errorf("Form state still exists after removal")
+	}
+}
+
+func TestRemoveExpiredFormStates(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{},
+		"TestRemoveExpiredFormStates")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	if err := removeExpiredFormStates(root, time.Now()); err != nil {
+		t.Errorf("removeExpiredFormStates without states returned error: %v", err)
+	}
+	if err := writeFormState(root, "token", &formState{}); err != nil {
+		t.Fatalf("Could not write form state: %v", err)
+	}
+	if err := removeExpiredFormStates(root, time.Now()); err != nil {
+		t.Errorf("removeExpiredFormStates returned error: %v", err)
+	}
+	if state, _ := getFormState(root, "token"); state == nil {
+		t.Errorf("Current form state has been removed")
+	}
+	err = removeExpiredFormStates(root,
+		time.Now().Add(formStateExpiry+time.Minute))
+	if err != nil {
+		t.Errorf("removeExpiredFormStates returned error: %v", err)
+	}
+	if state, _ := getFormState(root, "token"); state != nil {
+		t.Errorf("Expired form state has not been removed")
+	}
+}
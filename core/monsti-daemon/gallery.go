@@ -0,0 +1,267 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+const (
+	// maxGalleryUploadSize limits the size of all images uploaded at
+	// once to a gallery.
+	maxGalleryUploadSize = 100 * 1024 * 1024
+	// maxGalleryImageSize limits the size of each uploaded image.
+	maxGalleryImageSize = 20 * 1024 * 1024
+)
+
+// galleryItem is an image shown by gallery nodes. Id is the id of the
+// image's lightbox, Previous and Next are the ids of the neighbouring
+// lightboxes.
+type galleryItem struct {
+	Id, Path, Title, Alt string
+	Thumbnail, Large     string
+	Previous, Next       string
+}
+
+// galleryItems returns the items of the images below a gallery, i.e.
+// the children of type core.Image. If public is true, unpublished
+// images are skipped.
+func galleryItems(children []*service.Node, public bool,
+	now time.Time) []galleryItem {
+	items := make([]galleryItem, 0)
+	for _, child := range children {
+		if child.Type == nil || child.Type.Id != "core.Image" ||
+			(public && !isPublished(child, now)) {
+			continue
+		}
+		title := getNodeTitle(child)
+		alt := child.AltText
+		if alt == "" {
+			alt = title
+		}
+		items = append(items, galleryItem{
+			Id:        fmt.Sprintf("gallery-image-%v", len(items)+1),
+			Path:      dirPath(child.Path),
+			Title:     title,
+			Alt:       alt,
+			Thumbnail: template.ImageURL(child.Path, "thumbnail"),
+			Large:     template.ImageURL(child.Path, "large"),
+		})
+	}
+	for i := range items {
+		if i > 0 {
+			items[i].Previous = items[i-1].Id
+		}
+		if i < len(items)-1 {
+			items[i].Next = items[i+1].Id
+		}
+	}
+	return items
+}
+
+// renderGallery adds the images of the gallery node to the context.
+func renderGallery(c *reqContext, context template.Context,
+	gallery *service.Node) error {
+	children, err := c.Serv.Monsti().GetChildren(c.Site.Name, gallery.Path)
+	if err != nil {
+		return fmt.Errorf("Could not get children: %v", err)
+	}
+	context["Images"] = galleryItems(children, c.UserSession.User == nil,
+		time.Now())
+	return nil
+}
+
+// galleryNameRegexp matches characters replaced in node names of
+// uploaded gallery images.
+var galleryNameRegexp = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// galleryImageName returns the node name for an image uploaded into a
+// gallery, e.g. "my-photo.jpg" for "My Photo.JPG".
+func galleryImageName(fileName string) string {
+	name := strings.ToLower(filepath.Base(fileName))
+	name = galleryNameRegexp.ReplaceAllString(name, "-")
+	name = strings.Trim(strings.Replace(name, "-.", ".", -1), "-._")
+	if name == "" {
+		return "image"
+	}
+	return name
+}
+
+// galleryImageTitle returns the title for an image uploaded into a
+// gallery, i.e. the file name without extension, e.g. "My photo" for
+// "My_photo.jpg".
+func galleryImageTitle(fileName string) string {
+	base := filepath.Base(fileName)
+	title := strings.TrimSuffix(base, filepath.Ext(base))
+	title = strings.NewReplacer("_", " ", "-", " ").Replace(title)
+	if title = strings.TrimSpace(title); title == "" {
+		return base
+	}
+	return title
+}
+
+// addGalleryImage adds the uploaded image as image node below the
+// requested gallery. New images are published if the gallery is.
+//
+// Returns a translated message if the image can't be added.
+func addGalleryImage(c *reqContext, h *nodeHandler, imageType *service.NodeType,
+	fileName string, content []byte, now time.Time) (string, error) {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if _, _, err := image.DecodeConfig(bytes.NewReader(content)); err != nil {
+		return G("The file is not a supported image."), nil
+	}
+	reason, err := screenUpload(c, h, quarantinedFile{Name: fileName}, content)
+	if err != nil {
+		return "", fmt.Errorf("Could not scan upload: %v", err)
+	}
+	if reason != "" {
+		return fmt.Sprintf(G("The file has been quarantined for review: %v"),
+			reason), nil
+	}
+	name, err := freeNodeName(func(nodePath string) (bool, error) {
+		node, err := c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
+		return node != nil, err
+	}, c.Node.Path, galleryImageName(fileName))
+	if err != nil {
+		return "", fmt.Errorf("Could not get free node name: %v", err)
+	}
+	node := service.Node{
+		Path:        path.Join(c.Node.Path, name),
+		Type:        imageType,
+		Hide:        true,
+		Public:      c.Node.Public,
+		PublishTime: now}
+	if err := node.InitFields(c.Serv.Monsti(), c.Site.Name); err != nil {
+		return "", fmt.Errorf("Could not init image fields: %v", err)
+	}
+	*(node.GetField("core.Title").(*service.TextField)) = service.TextField(
+		galleryImageTitle(fileName))
+	return writeNodeWithHooks(c, h, &node, func() error {
+		return writeImageUpload(c, h, node.Path, content)
+	}, &service.NodeEvent{Type: service.NodeCreatedEvent})
+}
+
+// galleryUploadError is a file which could not be added to a gallery.
+type galleryUploadError struct {
+	Name, Message string
+}
+
+// GalleryUpload adds the images uploaded all at once (form value
+// "Images") to the requested gallery.
+func (h *nodeHandler) GalleryUpload(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if c.Node.Type == nil || c.Node.Type.Id != "core.Gallery" {
+		return fmt.Errorf("Node %q is not a gallery", c.Node.Path)
+	}
+	context := template.Context{}
+	if c.Req.Method == "POST" {
+		c.Req.Body = http.MaxBytesReader(c.Res, c.Req.Body, maxGalleryUploadSize)
+	}
+	tooLarge := false
+	if err := c.Req.ParseMultipartForm(1024 * 1024); err != nil {
+		if err != http.ErrNotMultipart {
+			if c.Req.Method != "POST" {
+				return fmt.Errorf("Could not parse form: %v", err)
+			}
+			tooLarge = true
+		}
+	}
+	switch c.Req.Method {
+	case "GET":
+		context["Added"] = c.Req.Form.Get("added")
+	case "POST":
+		if tooLarge {
+			context["Error"] = G("The uploaded images are too large.")
+			break
+		}
+		if c.Req.MultipartForm == nil ||
+			len(c.Req.MultipartForm.File["Images"]) == 0 {
+			context["Error"] = G("Please choose one or more images.")
+			break
+		}
+		imageType, err := c.Serv.Monsti().GetNodeType("core.Image")
+		if err != nil {
+			return fmt.Errorf("Could not get image node type: %v", err)
+		}
+		now := time.Now().UTC()
+		added := 0
+		failed := make([]galleryUploadError, 0)
+		for _, header := range c.Req.MultipartForm.File["Images"] {
+			file, err := header.Open()
+			if err != nil {
+				return fmt.Errorf("Could not open multipart file: %v", err)
+			}
+			content, err := ioutil.ReadAll(io.LimitReader(file,
+				maxGalleryImageSize+1))
+			file.Close()
+			if err != nil {
+				return fmt.Errorf("Could not read multipart file: %v", err)
+			}
+			name := filepath.Base(header.Filename)
+			if len(content) > maxGalleryImageSize {
+				failed = append(failed, galleryUploadError{name,
+					G("The image is too large.")})
+				continue
+			}
+			msg, err := addGalleryImage(c, h, imageType, name, content, now)
+			if err != nil {
+				return err
+			}
+			if msg != "" {
+				failed = append(failed, galleryUploadError{name, msg})
+				continue
+			}
+			added++
+		}
+		if len(failed) == 0 {
+			http.Redirect(c.Res, c.Req, "@@gallery-upload?added="+
+				fmt.Sprint(added), http.StatusSeeOther)
+			return nil
+		}
+		context["Added"] = fmt.Sprint(added)
+		context["Errors"] = failed
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	body, err := h.Renderer.Render("actions/gallery-upload", context,
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render gallery upload form: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   fmt.Sprintf(G("Upload images to \"%v\""), getNodeTitle(c.Node)),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
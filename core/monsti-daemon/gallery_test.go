@@ -0,0 +1,87 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestGalleryItems(t *testing.T) {
+	imageType := &service.NodeType{Id: "core.Image"}
+	now := time.Now()
+	image := func(nodePath, title, alt string, public bool) *service.Node {
+		titleField := service.TextField(title)
+		return &service.Node{Path: nodePath, Type: imageType, Public: public,
+			AltText: alt, Hide: true,
+			Fields: map[string]service.Field{"core.Title": &titleField}}
+	}
+	children := []*service.Node{
+		image("/photos/a.jpg", "A", "", true),
+		{Path: "/photos/doc", Type: &service.NodeType{Id: "core.Document"},
+			Public: true},
+		image("/photos/b.jpg", "B", "Alt B", false),
+		image("/photos/c.jpg", "C", "", true),
+	}
+	items := galleryItems(children, true, now)
+	if len(items) != 2 {
+		t.Fatalf("galleryItems(public) returned %v items, should be 2",
+			len(items))
+	}
+	expected := galleryItem{Id: "gallery-image-1", Path: "/photos/a.jpg/",
+		Title: "A", Alt: "A", Thumbnail: "/photos/a.jpg/_sizes/thumbnail",
+		Large: "/photos/a.jpg/_sizes/large", Next: "gallery-image-2"}
+	if items[0] != expected {
+		t.Errorf("galleryItems(public)[0] = %+v, should be %+v", items[0],
+			expected)
+	}
+	if items[1].Path != "/photos/c.jpg/" || items[1].Previous !=
+		"gallery-image-1" || items[1].Next != "" {
+		t.Errorf("galleryItems(public)[1] = %+v", items[1])
+	}
+	items = galleryItems(children, false, now)
+	if len(items) != 3 || items[1].Alt != "Alt B" ||
+		items[2].Id != "gallery-image-3" {
+		t.Errorf("galleryItems(not public) = %+v", items)
+	}
+}
+
+func TestGalleryImageName(t *testing.T) {
+	tests := []struct {
+		FileName, Name, Title string
+	}{
+		{"photo.jpg", "photo.jpg", "photo"},
+		{"My Photo.JPG", "my-photo.jpg", "My Photo"},
+		{"Summer_2015-beach.png", "summer_2015-beach.png", "Summer 2015 beach"},
+		{"../../etc/@@edit.gif", "edit.gif", "@@edit"},
+		{"Ärger!.jpeg", "rger.jpeg", "Ärger!"},
+		{"___.jpg", "jpg", "___.jpg"},
+		{"???", "image", "???"},
+	}
+	for _, test := range tests {
+		if name := galleryImageName(test.FileName); name != test.Name {
+			t.Errorf("galleryImageName(%q) = %q, should be %q", test.FileName,
+				name, test.Name)
+		}
+		if title := galleryImageTitle(test.FileName); title != test.Title {
+			t.Errorf("galleryImageTitle(%q) = %q, should be %q", test.FileName,
+				title, test.Title)
+		}
+	}
+}
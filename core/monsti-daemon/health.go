@@ -0,0 +1,419 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// defaultMaxImageSize is the size in bytes above which images get
+// reported if core.image.maxsize is not set.
+const defaultMaxImageSize = 1024 * 1024
+
+// minKeyLength is the minimum length of the site's secret keys.
+const minKeyLength = 32
+
+// healthCheck is a check of the site health analysis.
+type healthCheck struct {
+	Id string
+	// Title and Recommendation are untranslated.
+	Title          string
+	Recommendation string
+	// Penalty is subtracted from the score for each issue, up to
+	// MaxPenalty for all issues of the check.
+	Penalty, MaxPenalty int
+}
+
+// healthChecks are the checks of the analysis. Their maximum
+// penalties sum up to 100.
+var healthChecks = []healthCheck{
+	{"insecure-base-url", "Site not served via HTTPS",
+		"Serve the site via HTTPS and set its BaseURL to the https:// URL.",
+		20, 20},
+	{"weak-key", "Weak secret key",
+		"Use random keys of at least 32 characters for SessionAuthKey and PasswordTokenKey.",
+		15, 30},
+	{"missing-email", "Missing email address",
+		"Set EmailAddress so that outgoing mails have a valid sender.", 5, 5},
+	{"missing-alt", "Missing alternative text",
+		"Add alt attributes to the images or set the titles of the image nodes.",
+		2, 20},
+	{"huge-image", "Huge image",
+		"Upload a smaller version of the image.", 3, 15},
+	{"orphaned-node", "Orphaned node",
+		"Link the node from other nodes, show it in the navigation or remove it.",
+		2, 10},
+}
+
+// getHealthCheck returns the check with the given id or nil if there
+// is no such check.
+func getHealthCheck(id string) *healthCheck {
+	for i := range healthChecks {
+		if healthChecks[i].Id == id {
+			return &healthChecks[i]
+		}
+	}
+	return nil
+}
+
+// healthIssue is an issue found by a check.
+type healthIssue struct {
+	Check string
+	// Node is the path of the affected node, if any.
+	Node string
+	// Detail is an untranslated detail, e.g. the affected setting.
+	Detail string
+}
+
+// healthReport is the result of a site health analysis.
+type healthReport struct {
+	Time   time.Time
+	Score  int
+	Issues []healthIssue
+}
+
+// healthResult are the issues found by a check.
+type healthResult struct {
+	Check  *healthCheck
+	Issues []healthIssue
+}
+
+// Results returns the issues of the report grouped by check. Checks
+// without issues are omitted.
+func (r *healthReport) Results() []healthResult {
+	ret := make([]healthResult, 0)
+	for i := range healthChecks {
+		result := healthResult{Check: &healthChecks[i]}
+		for _, issue := range r.Issues {
+			if issue.Check == healthChecks[i].Id {
+				result.Issues = append(result.Issues, issue)
+			}
+		}
+		if len(result.Issues) > 0 {
+			ret = append(ret, result)
+		}
+	}
+	return ret
+}
+
+// healthScore returns the score between 0 and 100 for the given
+// issues.
+func healthScore(issues []healthIssue) int {
+	penalties := make(map[string]int)
+	for _, issue := range issues {
+		if check := getHealthCheck(issue.Check); check != nil {
+			penalties[check.Id] += check.Penalty
+			if penalties[check.Id] > check.MaxPenalty {
+				penalties[check.Id] = check.MaxPenalty
+			}
+		}
+	}
+	score := 100
+	for _, penalty := range penalties {
+		score -= penalty
+	}
+	if score < 0 {
+		score = 0
+	}
+	return score
+}
+
+// checkSiteSettings returns the issues of the site's settings.
+func checkSiteSettings(site util.SiteSettings) []healthIssue {
+	issues := make([]healthIssue, 0)
+	if !strings.HasPrefix(site.BaseURL, "https://") {
+		issues = append(issues, healthIssue{Check: "insecure-base-url",
+			Detail: site.BaseURL})
+	}
+	for _, key := range []struct{ Name, Value string }{
+		{"SessionAuthKey", site.SessionAuthKey},
+		{"PasswordTokenKey", site.PasswordTokenKey}} {
+		if len(key.Value) < minKeyLength {
+			issues = append(issues, healthIssue{Check: "weak-key",
+				Detail: key.Name})
+		}
+	}
+	if site.EmailAddress == "" {
+		issues = append(issues, healthIssue{Check: "missing-email"})
+	}
+	return issues
+}
+
+var (
+	imgTagRegexp   = regexp.MustCompile(`(?i)<img\b[^>]*>`)
+	altAttrRegexp  = regexp.MustCompile(`(?i)\salt\s*=`)
+	linkAttrRegexp = regexp.MustCompile(
+		`(?i)\s(?:href|src)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+)
+
+// nodeHTML returns the HTML of the node's HTML and Markdown fields.
+func nodeHTML(node *service.Node) []string {
+	ret := make([]string, 0)
+	fields := node.AllFields()
+	for _, field := range fields {
+		switch value := node.GetField(field.Id).(type) {
+		case *service.HTMLField:
+			ret = append(ret, string(*value))
+		case *service.MarkdownField:
+			ret = append(ret, string(service.RenderMarkdown(string(*value))))
+		}
+	}
+	return ret
+}
+
+// linkAttrs returns the values of the href and src attributes of the
+// given HTML.
+func linkAttrs(html string) []string {
+	ret := make([]string, 0)
+	for _, match := range linkAttrRegexp.FindAllStringSubmatch(html, -1) {
+		ret = append(ret, match[1]+match[2])
+	}
+	return ret
+}
+
+// linkTargets returns the paths of the site's nodes linked by the
+// given HTML of the node at nodePath. Absolute links count if they
+// point to the host of baseURL.
+func linkTargets(nodePath, html, baseURL string) []string {
+	base, _ := url.Parse(baseURL)
+	ret := make([]string, 0)
+	for _, attr := range linkAttrs(html) {
+		link, err := url.Parse(attr)
+		if err != nil || link.Path == "" {
+			continue
+		}
+		if link.Host != "" && (base == nil || link.Host != base.Host) {
+			continue
+		}
+		target := link.Path
+		if !path.IsAbs(target) {
+			target = path.Join(nodePath, target)
+		}
+		ret = append(ret, path.Clean(target))
+	}
+	return ret
+}
+
+// analyzeSite checks the site's settings and all of its nodes.
+//
+// getDataFn returns the content of a node's file.
+func analyzeSite(site util.SiteSettings, maxImageSize int,
+	getNodeFn getNodeFunc, getChildrenFn getChildrenFunc,
+	getDataFn func(nodePath, file string) ([]byte, error),
+	now time.Time) (*healthReport, error) {
+	issues := checkSiteSettings(site)
+	hidden := make([]string, 0)
+	referenced := make(map[string]bool)
+	err := walkNodes("/", getNodeFn, getChildrenFn,
+		func(node *service.Node) error {
+			refs, err := nodeReferences(node)
+			if err != nil {
+				return err
+			}
+			for _, ref := range refs {
+				referenced[ref.Target] = true
+			}
+			for _, html := range nodeHTML(node) {
+				for _, tag := range imgTagRegexp.FindAllString(html, -1) {
+					if !altAttrRegexp.MatchString(tag) {
+						issues = append(issues, healthIssue{Check: "missing-alt",
+							Node: node.Path, Detail: tag})
+					}
+				}
+				for _, target := range linkTargets(node.Path, html, site.BaseURL) {
+					referenced[target] = true
+				}
+			}
+			if node.Type != nil && node.Type.Id == "core.Image" {
+				if title := node.Fields["core.Title"]; title == nil ||
+					title.String() == "" {
+					issues = append(issues, healthIssue{Check: "missing-alt",
+						Node: node.Path})
+				}
+				data, err := getDataFn(node.Path, "__file_core.File")
+				if err != nil {
+					return fmt.Errorf("Could not get image of %q: %v", node.Path, err)
+				}
+				if len(data) > maxImageSize {
+					issues = append(issues, healthIssue{Check: "huge-image",
+						Node: node.Path, Detail: fmt.Sprintf("%d KiB", len(data)/1024)})
+				}
+			}
+			if node.Hide && isPublished(node, now) {
+				hidden = append(hidden, node.Path)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	for _, nodePath := range hidden {
+		if nodePath != "/" && !referenced[nodePath] {
+			issues = append(issues, healthIssue{Check: "orphaned-node",
+				Node: nodePath})
+		}
+	}
+	return &healthReport{Time: now, Score: healthScore(issues),
+		Issues: issues}, nil
+}
+
+// healthReportPath returns the path to the site's latest health
+// report.
+func healthReportPath(settings *settings, site string) string {
+	return filepath.Join(settings.Monsti.GetSiteDataPath(site), "health.json")
+}
+
+// readHealthReport reads the site's latest health report.
+//
+// Returns nil if the site has not been analyzed yet.
+func readHealthReport(settings *settings, site string) (*healthReport, error) {
+	content, err := ioutil.ReadFile(healthReportPath(settings, site))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Could not read health report: %v", err)
+	}
+	report := new(healthReport)
+	if err := json.Unmarshal(content, report); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal health report: %v", err)
+	}
+	return report, nil
+}
+
+// analyzeSiteHealth analyzes the given site and writes the report to
+// the site's data directory.
+func analyzeSiteHealth(settings *settings, monsti *service.MonstiClient,
+	site string) (*healthReport, error) {
+	maxImageSize := 0
+	err := monsti.GetSiteConfig(site, "core.image.maxsize", &maxImageSize)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get maximum image size: %v", err)
+	}
+	if maxImageSize == 0 {
+		maxImageSize = defaultMaxImageSize
+	}
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		return monsti.GetNode(site, nodePath)
+	}
+	getChildrenFn := func(nodePath string) ([]*service.Node, error) {
+		return monsti.GetChildren(site, nodePath)
+	}
+	getDataFn := func(nodePath, file string) ([]byte, error) {
+		return monsti.GetNodeData(site, nodePath, file)
+	}
+	report, err := analyzeSite(settings.Monsti.Sites[site], maxImageSize,
+		getNodeFn, getChildrenFn, getDataFn, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("Could not analyze site: %v", err)
+	}
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("Could not marshal health report: %v", err)
+	}
+	err = ioutil.WriteFile(healthReportPath(settings, site), content, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Could not write health report: %v", err)
+	}
+	return report, nil
+}
+
+// scheduleHealthAnalysis periodically analyzes all sites according
+// to the configured interval.
+func scheduleHealthAnalysis(settings *settings, sessions *service.SessionPool,
+	logger *log.Logger) {
+	interval := 24 * time.Hour
+	if settings.Health.Interval != "" {
+		var err error
+		interval, err = time.ParseDuration(settings.Health.Interval)
+		if err != nil {
+			logger.Printf("Invalid health analysis interval: %v", err)
+			return
+		}
+	}
+	if interval <= 0 {
+		return
+	}
+	for {
+		session, err := sessions.New()
+		if err != nil {
+			logger.Printf("Could not get session for health analysis: %v", err)
+		} else {
+			for site := range settings.Monsti.Sites {
+				if _, err := analyzeSiteHealth(settings, session.Monsti(),
+					site); err != nil {
+					logger.Printf("Could not analyze health of site %q: %v", site, err)
+				}
+			}
+			sessions.Free(session)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Health shows the latest health report of the site. POST requests
+// start a new analysis.
+func (h *nodeHandler) Health(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	var report *healthReport
+	var err error
+	switch c.Req.Method {
+	case "GET":
+		report, err = readHealthReport(h.Settings, c.Site.Name)
+	case "POST":
+		_, err = analyzeSiteHealth(h.Settings, c.Serv.Monsti(), c.Site.Name)
+		if err == nil {
+			http.Redirect(c.Res, c.Req, "@@health", http.StatusSeeOther)
+			return nil
+		}
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	if err != nil {
+		return err
+	}
+	body, err := h.Renderer.Render("actions/health",
+		template.Context{"Report": report}, c.UserSession.Locale,
+		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render health report: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("Site health"),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
@@ -0,0 +1,145 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestHealthScore(t *testing.T) {
+	tests := []struct {
+		Issues []healthIssue
+		Score  int
+	}{
+		{nil, 100},
+		{[]healthIssue{{Check: "missing-alt"}}, 98},
+		{[]healthIssue{{Check: "missing-email"}, {Check: "unknown"}}, 95},
+		{[]healthIssue{{Check: "weak-key"}, {Check: "weak-key"},
+			{Check: "weak-key"}}, 70},
+	}
+	for i, test := range tests {
+		if score := healthScore(test.Issues); score != test.Score {
+			t.Errorf("Test %d: healthScore(...) = %d, should be %d", i, score,
+				test.Score)
+		}
+	}
+}
+
+func TestCheckSiteSettings(t *testing.T) {
+	key := "0123456789abcdef0123456789abcdef"
+	site := util.SiteSettings{BaseURL: "https://example.com",
+		SessionAuthKey: key, PasswordTokenKey: key,
+		EmailAddress: "monsti@example.com"}
+	if issues := checkSiteSettings(site); len(issues) != 0 {
+		t.Errorf("checkSiteSettings(...) = %v, should be empty", issues)
+	}
+	site = util.SiteSettings{BaseURL: "http://example.com",
+		SessionAuthKey: key, PasswordTokenKey: "secret"}
+	expected := []healthIssue{
+		{Check: "insecure-base-url", Detail: "http://example.com"},
+		{Check: "weak-key", Detail: "PasswordTokenKey"},
+		{Check: "missing-email"},
+	}
+	if issues := checkSiteSettings(site); !reflect.DeepEqual(issues, expected) {
+		t.Errorf("checkSiteSettings(...) = %v, should be %v", issues, expected)
+	}
+}
+
+func TestLinkTargets(t *testing.T) {
+	html := `<a href="bar">Bar</a> <a href="/baz/?raw=1">Baz</a>
+<img src="../img.png" alt=""> <a href="#top">Top</a>
+<a href="http://example.com/qux/">Qux</a> <a href="http://other.com/x">X</a>`
+	targets := linkTargets("/foo", html, "http://example.com")
+	expected := []string{"/foo/bar", "/baz", "/img.png", "/qux"}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Errorf("linkTargets(...) = %v, should be %v", targets, expected)
+	}
+}
+
+func TestAnalyzeSite(t *testing.T) {
+	key := "0123456789abcdef0123456789abcdef"
+	site := util.SiteSettings{BaseURL: "https://example.com",
+		SessionAuthKey: key, PasswordTokenKey: key,
+		EmailAddress: "monsti@example.com"}
+	docType := &service.NodeType{Id: "core.Document",
+		Fields: []*service.NodeField{{Id: "core.Body", Type: "HTMLArea"}}}
+	imageType := &service.NodeType{Id: "core.Image",
+		Fields: []*service.NodeField{{Id: "core.Title", Type: "Text"}}}
+	title := service.TextField("Photo")
+	empty := service.TextField("")
+	body := service.HTMLField(`<img src="photo/?raw=1"><a href="linked">L</a>`)
+	nodes := map[string]*service.Node{
+		"/": {Path: "/", Type: docType, Public: true,
+			Fields: map[string]service.Field{"core.Body": &body}},
+		"/photo": {Path: "/photo", Type: imageType, Public: true, Hide: true,
+			Fields: map[string]service.Field{"core.Title": &title}},
+		"/huge": {Path: "/huge", Type: imageType, Public: true,
+			Fields: map[string]service.Field{"core.Title": &empty}},
+		"/linked":   {Path: "/linked", Type: docType, Public: true, Hide: true},
+		"/orphaned": {Path: "/orphaned", Type: docType, Public: true, Hide: true},
+		"/draft":    {Path: "/draft", Type: docType, Hide: true},
+	}
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		return nodes[nodePath], nil
+	}
+	getChildrenFn := func(nodePath string) ([]*service.Node, error) {
+		children := make([]*service.Node, 0)
+		for _, child := range []string{"/photo", "/huge", "/linked",
+			"/orphaned", "/draft"} {
+			if path.Dir(child) == nodePath {
+				children = append(children, nodes[child])
+			}
+		}
+		return children, nil
+	}
+	getDataFn := func(nodePath, file string) ([]byte, error) {
+		if nodePath == "/huge" {
+			return make([]byte, 2048), nil
+		}
+		return make([]byte, 10), nil
+	}
+	now := time.Date(2014, 12, 20, 12, 0, 0, 0, time.UTC)
+	report, err := analyzeSite(site, 1024, getNodeFn, getChildrenFn,
+		getDataFn, now)
+	if err != nil {
+		t.Fatalf("analyzeSite returned error: %v", err)
+	}
+	expected := []healthIssue{
+		{Check: "missing-alt", Node: "/", Detail: `<img src="photo/?raw=1">`},
+		{Check: "missing-alt", Node: "/huge"},
+		{Check: "huge-image", Node: "/huge", Detail: "2 KiB"},
+		{Check: "orphaned-node", Node: "/orphaned"},
+	}
+	if !reflect.DeepEqual(report.Issues, expected) {
+		t.Errorf("analyzeSite(...).Issues = %v, should be %v", report.Issues,
+			expected)
+	}
+	if report.Score != 91 || !report.Time.Equal(now) {
+		t.Errorf("analyzeSite(...) = %v, should have score 91", report)
+	}
+	results := report.Results()
+	if len(results) != 3 || results[0].Check.Id != "missing-alt" ||
+		len(results[0].Issues) != 2 {
+		t.Errorf("Results() = %v, should group issues by check", results)
+	}
+}
@@ -0,0 +1,122 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// referenceTargets returns the distinct targets of the node's
+// references in order of appearance.
+func referenceTargets(node *service.Node) ([]string, error) {
+	targets := make([]string, 0)
+	if node == nil {
+		return targets, nil
+	}
+	refs, err := nodeReferences(node)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, ref := range refs {
+		if !seen[ref.Target] {
+			seen[ref.Target] = true
+			targets = append(targets, ref.Target)
+		}
+	}
+	return targets, nil
+}
+
+// referenceEvents returns the events for references added or removed
+// by changing the old node into the new one. The old node may be nil
+// for newly created nodes.
+func referenceEvents(old, new *service.Node) ([]*service.NodeEvent, error) {
+	oldTargets, err := referenceTargets(old)
+	if err != nil {
+		return nil, err
+	}
+	newTargets, err := referenceTargets(new)
+	if err != nil {
+		return nil, err
+	}
+	diff := func(a, b []string, eventType string) []*service.NodeEvent {
+		inB := make(map[string]bool)
+		for _, target := range b {
+			inB[target] = true
+		}
+		events := make([]*service.NodeEvent, 0)
+		for _, target := range a {
+			if !inB[target] {
+				events = append(events, &service.NodeEvent{
+					Type: eventType, Target: target})
+			}
+		}
+		return events
+	}
+	return append(diff(newTargets, oldTargets, service.ReferenceAddedEvent),
+		diff(oldTargets, newTargets, service.ReferenceRemovedEvent)...), nil
+}
+
+// recordNodeEvents adds the events caused by the request's user to
+// the timeline of the given node.
+func recordNodeEvents(c *reqContext, nodePath string,
+	events ...*service.NodeEvent) error {
+	now := time.Now().UTC()
+	for _, event := range events {
+		event.Time = now
+		if c.UserSession.User != nil {
+			event.User = c.UserSession.User.Login
+		}
+		if err := c.Serv.Monsti().AddNodeEvent(c.Site.Name, nodePath,
+			event); err != nil {
+			return fmt.Errorf("Could not record node event: %v", err)
+		}
+	}
+	return nil
+}
+
+// History shows the timeline of the node.
+func (h *nodeHandler) History(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	events, err := c.Serv.Monsti().GetNodeEvents(c.Site.Name, c.Node.Path)
+	if err != nil {
+		return fmt.Errorf("Could not get node events: %v", err)
+	}
+	// Show latest events first.
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	body, err := h.Renderer.Render("actions/history",
+		template.Context{"Events": events}, c.UserSession.Locale,
+		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render node history: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   fmt.Sprintf(G("History of \"%v\""), c.Node.Path),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
@@ -0,0 +1,95 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestReferenceEvents(t *testing.T) {
+	nodeType := &service.NodeType{Id: "foo.Links",
+		Fields: []*service.NodeField{{Id: "foo.Related", Type: "MultiRef"}}}
+	links := func(paths ...string) *service.Node {
+		return &service.Node{Path: "/links", Type: nodeType,
+			Fields: map[string]service.Field{
+				"foo.Related": &service.MultiRefField{Paths: paths}}}
+	}
+	tests := []struct {
+		Old, New *service.Node
+		Events   []*service.NodeEvent
+	}{
+		{nil, links("/a"), []*service.NodeEvent{
+			{Type: service.ReferenceAddedEvent, Target: "/a"}}},
+		{links("/a", "/b"), links("/b", "/a"), []*service.NodeEvent{}},
+		{links("/a", "/b"), links("/c", "/b", "/c"), []*service.NodeEvent{
+			{Type: service.ReferenceAddedEvent, Target: "/c"},
+			{Type: service.ReferenceRemovedEvent, Target: "/a"}}},
+	}
+	for i, test := range tests {
+		events, err := referenceEvents(test.Old, test.New)
+		if err != nil {
+			t.Errorf("Test %v: referenceEvents returned error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(events, test.Events) {
+			t.Errorf("Test %v: referenceEvents(...) = %v, should be %v", i,
+				events, test.Events)
+		}
+	}
+}
+
+func TestNodeEvents(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.json": `{"Type":"core.Document"}`,
+	}, "TestNodeEvents")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	events, err := readNodeEvents(root, "/foo")
+	if err != nil || len(events) != 0 {
+		t.Errorf(`readNodeEvents(_, "/foo") = %v, %v, should be empty`, events,
+			err)
+	}
+	expected := []*service.NodeEvent{
+		{Time: time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC),
+			Type: service.NodeCreatedEvent, User: "alice"},
+		{Time: time.Date(2015, 1, 3, 3, 4, 5, 0, time.UTC),
+			Type: service.ReferenceAddedEvent, Target: "/bar"},
+	}
+	for _, event := range expected {
+		if err := addNodeEvent(root, "/foo", event); err != nil {
+			t.Fatalf("addNodeEvent returned error: %v", err)
+		}
+	}
+	if err := archiveNode(root, "/foo"); err != nil {
+		t.Fatalf("archiveNode returned error: %v", err)
+	}
+	events, err = readNodeEvents(root, "/foo")
+	if err != nil || !reflect.DeepEqual(events, expected) {
+		t.Errorf(`readNodeEvents(_, "/foo") = %v, %v, should be %v`, events,
+			err, expected)
+	}
+	if err := addNodeEvent(root, "/foo", expected[0]); err == nil {
+		t.Errorf("addNodeEvent should fail for archived nodes")
+	}
+}
@@ -0,0 +1,117 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// publishHookEnv returns the environment of the publish hooks of the
+// given stage run for the node at nodePath.
+func publishHookEnv(c *reqContext, stage, nodePath string) util.HookEnv {
+	return util.HookEnv{
+		Operation: "publish",
+		Stage:     stage,
+		Values: map[string]string{
+			"site":  c.Site.Name,
+			"node":  nodePath,
+			"login": c.UserSession.User.Login}}
+}
+
+// writeNodeWithHooks writes the node and records the given events,
+// running the publish hooks around it if the node is public. The
+// function write, if not nil, writes the node's data files.
+//
+// Returns a translated message if the node can't be published.
+func writeNodeWithHooks(c *reqContext, h *nodeHandler, node *service.Node,
+	write func() error, events ...*service.NodeEvent) (string, error) {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if node.Public {
+		if err := h.runHooks(c, h.Settings.Hooks.Publish.Pre,
+			publishHookEnv(c, "pre", node.Path)); err != nil {
+			return fmt.Sprintf(G("The node could not be published: %v"), err), nil
+		}
+	}
+	if err := c.Serv.Monsti().WriteNode(c.Site.Name, node.Path,
+		node); err != nil {
+		return "", fmt.Errorf("Could not write node: %v", err)
+	}
+	if err := recordNodeEvents(c, node.Path, events...); err != nil {
+		return "", err
+	}
+	if write != nil {
+		if err := write(); err != nil {
+			return "", err
+		}
+	}
+	if node.Public {
+		h.runPostHooks(c, h.Settings.Hooks.Publish.Post,
+			publishHookEnv(c, "post", node.Path))
+	}
+	return "", nil
+}
+
+// maxHookFailureLength limits the length of hook failures kept in the
+// session to be shown to the editor.
+const maxHookFailureLength = 500
+
+// runPostHooks runs the given hooks after the operation has been
+// done. As the operation can't be cancelled anymore, the failure of an
+// aborting hook gets logged and returned as translated message, or an
+// empty string if all hooks succeeded.
+func (h *nodeHandler) runPostHooks(c *reqContext, hooks []util.Hook,
+	env util.HookEnv) string {
+	err := h.runHooks(c, hooks, env)
+	if err == nil {
+		return ""
+	}
+	h.Log.Printf("Failed %v of %v on site %v: %v", env.Stage, env.Operation,
+		c.Site.Name, err)
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	msg := []rune(fmt.Sprintf(G("The node has been saved, but a hook failed: %v"),
+		err))
+	if len(msg) > maxHookFailureLength {
+		msg = append(msg[:maxHookFailureLength], '…')
+	}
+	return string(msg)
+}
+
+// runHooks runs the given hooks. Signal hooks emit the monsti.Hook
+// signal.
+func (h *nodeHandler) runHooks(c *reqContext, hooks []util.Hook,
+	env util.HookEnv) error {
+	signal := func(env util.HookEnv) error {
+		var ret []service.HookRet
+		err := c.Serv.Monsti().EmitSignal("monsti.Hook",
+			service.HookArgs{env.Operation, env.Stage, env.Values}, &ret)
+		if err != nil {
+			return fmt.Errorf("Could not emit signal: %v", err)
+		}
+		for _, result := range ret {
+			if result.Error != "" {
+				return errors.New(result.Error)
+			}
+		}
+		return nil
+	}
+	return util.RunHooks(hooks, env, signal, h.Log)
+}
@@ -0,0 +1,518 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// exifOrientation returns the EXIF orientation (1 to 8) of the given
+// JPEG data.
+//
+// Returns 1 (i.e. no transformation) if the orientation is unknown.
+func exifOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for pos := 2; pos+4 <= len(data) && data[pos] == 0xFF; {
+		marker := data[pos+1]
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if marker == 0xDA || length < 2 || end > len(data) {
+			break
+		}
+		segment := data[pos+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		pos = end
+	}
+	return 1
+}
+
+// tiffOrientation returns the orientation tag of the first IFD of the
+// given TIFF data.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// orientImage transforms the image according to the given EXIF
+// orientation so that it will be displayed upright.
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	out := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			out.Set(x, y, img.At(bounds.Min.X+sx, bounds.Min.Y+sy))
+		}
+	}
+	return out
+}
+
+// autoRotateImage rotates the given JPEG data according to its EXIF
+// orientation.
+//
+// Returns the unchanged data if there is nothing to rotate.
+func autoRotateImage(data []byte) ([]byte, error) {
+	orientation := exifOrientation(data)
+	if orientation == 1 {
+		return data, nil
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode image: %v", err)
+	}
+	var out bytes.Buffer
+	err = jpeg.Encode(&out, orientImage(img, orientation),
+		&jpeg.Options{Quality: 90})
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode rotated image: %v", err)
+	}
+	return out.Bytes(), nil
+}
+
+// strippedJPEGMarkers are the markers of JPEG segments holding
+// metadata: APP1 (EXIF including GPS data, XMP), APP12 (Ducky) and
+// APP13 (Photoshop, IPTC). Segments needed for correct display, e.g.
+// APP2 holding ICC profiles, are kept.
+var strippedJPEGMarkers = map[byte]bool{0xE1: true, 0xEC: true, 0xED: true}
+
+// strippedPNGChunks are the types of PNG chunks holding metadata.
+var strippedPNGChunks = map[string]bool{
+	"eXIf": true, "tEXt": true, "iTXt": true, "zTXt": true, "tIME": true}
+
+// pngSignature starts every PNG file.
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// stripImageMetadata removes metadata like EXIF and GPS data from the
+// given JPEG or PNG data without re-encoding the image.
+//
+// Returns the unchanged data for other or malformed images.
+func stripImageMetadata(data []byte) []byte {
+	switch {
+	case len(data) >= 4 && data[0] == 0xFF && data[1] == 0xD8:
+		out := make([]byte, 0, len(data))
+		out = append(out, data[:2]...)
+		pos := 2
+		for pos+4 <= len(data) && data[pos] == 0xFF {
+			marker := data[pos+1]
+			if marker == 0xDA {
+				break
+			}
+			length := int(binary.BigEndian.Uint16(data[pos+2:]))
+			end := pos + 2 + length
+			if length < 2 || end > len(data) {
+				return data
+			}
+			if !strippedJPEGMarkers[marker] {
+				out = append(out, data[pos:end]...)
+			}
+			pos = end
+		}
+		return append(out, data[pos:]...)
+	case bytes.HasPrefix(data, []byte(pngSignature)):
+		out := make([]byte, 0, len(data))
+		out = append(out, pngSignature...)
+		for pos := len(pngSignature); pos < len(data); {
+			if pos+12 > len(data) {
+				return data
+			}
+			end := pos + 12 + int(binary.BigEndian.Uint32(data[pos:]))
+			if end > len(data) || end < pos {
+				return data
+			}
+			if !strippedPNGChunks[string(data[pos+4:pos+8])] {
+				out = append(out, data[pos:end]...)
+			}
+			pos = end
+		}
+		return out
+	}
+	return data
+}
+
+// limitImageDimension scales down JPEG and PNG images whose width or
+// height exceed the given maximum, keeping their aspect ratio and
+// format.
+//
+// Returns the unchanged data for smaller or other images.
+func limitImageDimension(data []byte, max uint) ([]byte, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || (format != "jpeg" && format != "png") ||
+		(uint(config.Width) <= max && uint(config.Height) <= max) {
+		return data, nil
+	}
+	return resizeImage(data, imageSize{max, max}, "")
+}
+
+// processImageUpload prepares uploaded image data to be stored
+// according to the given settings.
+func processImageUpload(data []byte, settings *imageSettings) ([]byte,
+	error) {
+	var err error
+	// Stripping removes the orientation, so the image has to be rotated
+	// beforehand.
+	if settings.AutoRotate || !settings.KeepMetadata {
+		if data, err = autoRotateImage(data); err != nil {
+			return nil, fmt.Errorf("Could not rotate image: %v", err)
+		}
+	}
+	if !settings.KeepMetadata {
+		data = stripImageMetadata(data)
+	}
+	if settings.MaxDimension > 0 {
+		if data, err = limitImageDimension(data, settings.MaxDimension); err != nil {
+			return nil, fmt.Errorf("Could not limit image dimension: %v", err)
+		}
+	}
+	return data, nil
+}
+
+// imageFormats maps the supported derivative formats to their MIME
+// types and the commands to convert an image file into the format.
+var imageFormats = map[string]struct {
+	MIMEType string
+	Command  func(in, out string) *exec.Cmd
+}{
+	"webp": {"image/webp", func(in, out string) *exec.Cmd {
+		return exec.Command("cwebp", "-quiet", "-q", "80", in, "-o", out)
+	}},
+	"avif": {"image/avif", func(in, out string) *exec.Cmd {
+		return exec.Command("avifenc", in, out)
+	}},
+}
+
+// convertImage converts the given image data into the given format.
+func convertImage(data []byte, format string) ([]byte, error) {
+	conv, ok := imageFormats[format]
+	if !ok {
+		return nil, fmt.Errorf("Unknown image format %q", format)
+	}
+	dir, err := ioutil.TempDir("", "monsti-image")
+	if err != nil {
+		return nil, fmt.Errorf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out."+format)
+	if err := ioutil.WriteFile(in, data, 0600); err != nil {
+		return nil, fmt.Errorf("Could not write image: %v", err)
+	}
+	if output, err := conv.Command(in, out).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("Could not convert image to %v: %v (%s)", format,
+			err, output)
+	}
+	return ioutil.ReadFile(out)
+}
+
+type imageSize struct{ Width, Height uint }
+
+func (s imageSize) String() string {
+	return fmt.Sprintf("%vx%v", s.Width, s.Height)
+}
+
+// defaultImageSizes are the image sizes available on every site. Sites
+// may override them and add further sizes using core.image.sizes.
+var defaultImageSizes = map[string]imageSize{
+	"thumbnail": {150, 150},
+	"medium":    {480, 480},
+	"large":     {1024, 1024},
+}
+
+// imageSizesDir is the pseudo directory below image nodes to access
+// their sizes, e.g. "/foo/image.jpeg/_sizes/thumbnail".
+const imageSizesDir = "/_sizes/"
+
+// splitImageSize splits and returns the node path and size name of the
+// given path.
+//
+// Returns the unchanged path and an empty size name if the path does
+// not point to an image size.
+func splitImageSize(nodePath string) (string, string) {
+	i := strings.LastIndex(nodePath, imageSizesDir)
+	if i <= 0 {
+		return nodePath, ""
+	}
+	name := nodePath[i+len(imageSizesDir):]
+	if name == "" || strings.Contains(name, "/") {
+		return nodePath, ""
+	}
+	return nodePath[:i], name
+}
+
+// imageDerivativeName returns the name of the node data file holding
+// the image derivative of the given size and format. An empty format
+// denotes the format of the original image.
+func imageDerivativeName(size imageSize, format string) string {
+	name := "__image_" + size.String()
+	if format != "" {
+		name += "." + format
+	}
+	return name
+}
+
+// resizeImage scales the given image data to fit into the given size,
+// keeping its aspect ratio, and encodes it in the given format. An
+// empty format keeps PNG and GIF images as PNG and encodes everything
+// else as JPEG.
+func resizeImage(data []byte, size imageSize, format string) ([]byte, error) {
+	img, original, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode image: %v", err)
+	}
+	img = resize.Thumbnail(size.Width, size.Height, img, resize.Lanczos3)
+	var out bytes.Buffer
+	if format != "" || original == "png" || original == "gif" {
+		err = png.Encode(&out, img)
+	} else {
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: 90})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode resized image: %v", err)
+	}
+	if format != "" {
+		return convertImage(out.Bytes(), format)
+	}
+	return out.Bytes(), nil
+}
+
+// getSizedImage returns the derivative of the given size and format of
+// the image node. Derivatives get generated on first request and
+// cached in the node's directory.
+func getSizedImage(c *reqContext, nodePath string, size imageSize,
+	format string) ([]byte, error) {
+	name := imageDerivativeName(size, format)
+	body, err := c.Serv.Monsti().GetNodeData(c.Site.Name, nodePath, name)
+	if err == nil && len(body) > 0 {
+		return body, nil
+	}
+	original, err := c.Serv.Monsti().GetNodeData(c.Site.Name, nodePath,
+		"__file_core.File")
+	if err != nil {
+		return nil, fmt.Errorf("Could not get image data: %v", err)
+	}
+	if body, err = resizeImage(original, size, format); err != nil {
+		return nil, err
+	}
+	if err := c.Serv.Monsti().WriteNodeData(c.Site.Name, nodePath, name,
+		body); err != nil {
+		return nil, fmt.Errorf("Could not write resized image data: %v", err)
+	}
+	return body, nil
+}
+
+// imageSettings are the image processing settings of a site.
+type imageSettings struct {
+	// AutoRotate rotates uploaded JPEG images according to their EXIF
+	// orientation.
+	AutoRotate bool
+	// Formats are the formats of derivatives to generate for uploaded
+	// images, e.g. "webp".
+	Formats []string
+	// Sizes are the available image sizes by name, i.e. the default
+	// sizes merged with the sizes configured for the site.
+	Sizes map[string]imageSize
+	// Pregenerate generates all sizes on upload instead of on first
+	// request.
+	Pregenerate bool
+	// KeepMetadata keeps metadata like EXIF and GPS data of uploaded
+	// images, which gets stripped by default.
+	KeepMetadata bool
+	// MaxDimension is the maximum width and height of uploaded images.
+	// Larger images get scaled down. Zero allows any dimension.
+	MaxDimension uint
+}
+
+// getImageSettings returns the image processing settings of the
+// request's site.
+func getImageSettings(c *reqContext) (*imageSettings, error) {
+	settings := new(imageSettings)
+	err := c.Serv.Monsti().GetSiteConfig(c.Site.Name, "core.image.autorotate",
+		&settings.AutoRotate)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get auto rotation setting: %v", err)
+	}
+	err = c.Serv.Monsti().GetSiteConfig(c.Site.Name, "core.image.formats",
+		&settings.Formats)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get image formats: %v", err)
+	}
+	err = c.Serv.Monsti().GetSiteConfig(c.Site.Name, "core.image.pregenerate",
+		&settings.Pregenerate)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get pregeneration setting: %v", err)
+	}
+	err = c.Serv.Monsti().GetSiteConfig(c.Site.Name, "core.image.keepmetadata",
+		&settings.KeepMetadata)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get metadata setting: %v", err)
+	}
+	err = c.Serv.Monsti().GetSiteConfig(c.Site.Name, "core.image.maxdimension",
+		&settings.MaxDimension)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get maximum image dimension: %v", err)
+	}
+	var sizes map[string]imageSize
+	err = c.Serv.Monsti().GetSiteConfig(c.Site.Name, "core.image.sizes", &sizes)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get image sizes: %v", err)
+	}
+	settings.Sizes = make(map[string]imageSize)
+	for name, size := range defaultImageSizes {
+		settings.Sizes[name] = size
+	}
+	for name, size := range sizes {
+		if size.Width > 0 || size.Height > 0 {
+			settings.Sizes[name] = size
+		}
+	}
+	return settings, nil
+}
+
+// writeImageUpload processes and writes the uploaded image of the
+// given image node. Sized derivatives of a previous upload get
+// replaced if the site pregenerates sizes and cleared otherwise.
+//
+// Derivatives which can't be generated will be logged and skipped.
+func writeImageUpload(c *reqContext, h *nodeHandler, nodePath string,
+	content []byte) error {
+	settings, err := getImageSettings(c)
+	if err != nil {
+		return err
+	}
+	if content, err = processImageUpload(content, settings); err != nil {
+		return err
+	}
+	if err := c.Serv.Monsti().WriteNodeData(c.Site.Name, nodePath,
+		imageDimensionFile, []byte{}); err != nil {
+		return fmt.Errorf("Could not clear image dimension: %v", err)
+	}
+	if err := c.Serv.Monsti().WriteNodeData(c.Site.Name, nodePath,
+		"__file_core.File", content); err != nil {
+		return fmt.Errorf("Could not save image: %v", err)
+	}
+	for _, format := range settings.Formats {
+		derivative, err := convertImage(content, format)
+		if err != nil {
+			// Clear any outdated derivative of a previous upload.
+			h.Log.Printf("Could not generate derivative of %q: %v", nodePath, err)
+			derivative = []byte{}
+		}
+		if err := c.Serv.Monsti().WriteNodeData(c.Site.Name, nodePath,
+			"__image_"+format, derivative); err != nil {
+			return fmt.Errorf("Could not save image derivative: %v", err)
+		}
+	}
+	formats := append([]string{""}, settings.Formats...)
+	for _, size := range settings.Sizes {
+		for _, format := range formats {
+			derivative := []byte{}
+			if settings.Pregenerate {
+				if derivative, err = resizeImage(content, size, format); err != nil {
+					h.Log.Printf("Could not generate size %v of %q: %v", size,
+						nodePath, err)
+					derivative = []byte{}
+				}
+			}
+			if err := c.Serv.Monsti().WriteNodeData(c.Site.Name, nodePath,
+				imageDerivativeName(size, format), derivative); err != nil {
+				return fmt.Errorf("Could not save image derivative: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// acceptedImageFormat returns the first of the given formats accepted
+// by the request or an empty string if none of them is accepted.
+func acceptedImageFormat(c *reqContext, formats []string) string {
+	accept := c.Req.Header.Get("Accept")
+	for _, format := range formats {
+		if conv, ok := imageFormats[format]; ok &&
+			strings.Contains(accept, conv.MIMEType) {
+			return format
+		}
+	}
+	return ""
+}
@@ -0,0 +1,212 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// exifJPEG returns a JPEG image of the given size with an EXIF
+// orientation tag using the given byte order ("II" or "MM").
+func exifJPEG(t *testing.T, width, height, orientation int,
+	order string) []byte {
+	var buf bytes.Buffer
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatalf("Could not encode test image: %v", err)
+	}
+	tiff := []byte(order + "\x00\x2a\x00\x00\x00\x08\x00\x01" +
+		"\x01\x12\x00\x03\x00\x00\x00\x01" + string([]byte{0, byte(orientation)}) +
+		"\x00\x00\x00\x00\x00\x00")
+	if order == "II" {
+		tiff = []byte("II\x2a\x00\x08\x00\x00\x00\x01\x00" +
+			"\x12\x01\x03\x00\x01\x00\x00\x00" + string([]byte{byte(orientation), 0}) +
+			"\x00\x00\x00\x00\x00\x00")
+	}
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	length := len(segment) + 2
+	app1 := append([]byte{0xFF, 0xE1, byte(length >> 8), byte(length)},
+		segment...)
+	data := buf.Bytes()
+	return append(append([]byte{0xFF, 0xD8}, app1...), data[2:]...)
+}
+
+func TestExifOrientation(t *testing.T) {
+	tests := []struct {
+		Data        []byte
+		Orientation int
+	}{
+		{nil, 1},
+		{[]byte("no jpeg"), 1},
+		{exifJPEG(t, 2, 1, 6, "MM"), 6},
+		{exifJPEG(t, 2, 1, 8, "II"), 8},
+		{exifJPEG(t, 2, 1, 42, "II"), 1},
+	}
+	for i, test := range tests {
+		if ret := exifOrientation(test.Data); ret != test.Orientation {
+			t.Errorf("Test %v: exifOrientation(_) = %v, should be %v", i, ret,
+				test.Orientation)
+		}
+	}
+}
+
+func TestOrientImage(t *testing.T) {
+	// 3x2 image with a white pixel in the top left corner.
+	img := image.NewGray(image.Rect(0, 0, 3, 2))
+	img.SetGray(0, 0, color.Gray{255})
+	tests := []struct {
+		Orientation, Width, Height, X, Y int
+	}{
+		{1, 3, 2, 0, 0},
+		{2, 3, 2, 2, 0},
+		{3, 3, 2, 2, 1},
+		{4, 3, 2, 0, 1},
+		{5, 2, 3, 0, 0},
+		{6, 2, 3, 1, 0},
+		{7, 2, 3, 1, 2},
+		{8, 2, 3, 0, 2},
+	}
+	for _, test := range tests {
+		ret := orientImage(img, test.Orientation)
+		bounds := ret.Bounds()
+		if bounds.Dx() != test.Width || bounds.Dy() != test.Height {
+			t.Errorf("Orientation %v: size is %vx%v, should be %vx%v",
+				test.Orientation, bounds.Dx(), bounds.Dy(), test.Width, test.Height)
+			continue
+		}
+		if r, _, _, _ := ret.At(test.X, test.Y).RGBA(); r != 0xFFFF {
+			t.Errorf("Orientation %v: corner pixel not at %v,%v",
+				test.Orientation, test.X, test.Y)
+		}
+	}
+}
+
+func TestAutoRotateImage(t *testing.T) {
+	ret, err := autoRotateImage(exifJPEG(t, 4, 2, 6, "MM"))
+	if err != nil {
+		t.Fatalf("Could not rotate image: %v", err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(ret))
+	if err != nil {
+		t.Fatalf("Could not decode rotated image: %v", err)
+	}
+	if bounds := img.Bounds(); bounds.Dx() != 2 || bounds.Dy() != 4 {
+		t.Errorf("Rotated image is %vx%v, should be 2x4", bounds.Dx(), bounds.Dy())
+	}
+}
+
+func TestSplitImageSize(t *testing.T) {
+	tests := []struct {
+		Path, NodePath, Size string
+	}{
+		{"/foo/image.jpeg/_sizes/thumbnail", "/foo/image.jpeg", "thumbnail"},
+		{"/foo/image.jpeg", "/foo/image.jpeg", ""},
+		{"/foo/image.jpeg/_sizes/", "/foo/image.jpeg/_sizes/", ""},
+		{"/_sizes/thumbnail", "/_sizes/thumbnail", ""},
+		{"/foo/_sizes/bar/baz", "/foo/_sizes/bar/baz", ""},
+	}
+	for i, test := range tests {
+		nodePath, size := splitImageSize(test.Path)
+		if nodePath != test.NodePath || size != test.Size {
+			t.Errorf("Test %v: splitImageSize(%q) = %q, %q, should be %q, %q", i,
+				test.Path, nodePath, size, test.NodePath, test.Size)
+		}
+	}
+}
+
+func TestResizeImage(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 40, 20))); err != nil {
+		t.Fatalf("Could not encode test image: %v", err)
+	}
+	ret, err := resizeImage(buf.Bytes(), imageSize{10, 10}, "")
+	if err != nil {
+		t.Fatalf("Could not resize image: %v", err)
+	}
+	img, format, err := image.Decode(bytes.NewReader(ret))
+	if err != nil {
+		t.Fatalf("Could not decode resized image: %v", err)
+	}
+	if format != "png" {
+		t.Errorf("Resized image is encoded as %v, should be png", format)
+	}
+	if bounds := img.Bounds(); bounds.Dx() != 10 || bounds.Dy() != 5 {
+		t.Errorf("Resized image is %vx%v, should be 10x5", bounds.Dx(), bounds.Dy())
+	}
+}
+
+func TestStripImageMetadata(t *testing.T) {
+	ret := stripImageMetadata(exifJPEG(t, 4, 2, 6, "MM"))
+	if bytes.Contains(ret, []byte("Exif")) {
+		t.Errorf("Stripped JPEG image still contains EXIF data")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(ret)); err != nil {
+		t.Errorf("Could not decode stripped JPEG image: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatalf("Could not encode test image: %v", err)
+	}
+	// Insert a text chunk after the IHDR chunk.
+	data := buf.Bytes()
+	ihdrEnd := len(pngSignature) + 12 + 13
+	text := []byte("\x00\x00\x00\x08tEXtGPS\x00here\x00\x00\x00\x00")
+	data = append(append(append([]byte{}, data[:ihdrEnd]...), text...),
+		data[ihdrEnd:]...)
+	ret = stripImageMetadata(data)
+	if bytes.Contains(ret, []byte("tEXt")) {
+		t.Errorf("Stripped PNG image still contains text chunk")
+	}
+	if _, err := png.Decode(bytes.NewReader(ret)); err != nil {
+		t.Errorf("Could not decode stripped PNG image: %v", err)
+	}
+
+	if ret := stripImageMetadata([]byte("no image")); string(ret) != "no image" {
+		t.Errorf("stripImageMetadata changed unknown data to %q", ret)
+	}
+}
+
+func TestProcessImageUpload(t *testing.T) {
+	ret, err := processImageUpload(exifJPEG(t, 4, 2, 6, "II"),
+		&imageSettings{MaxDimension: 10})
+	if err != nil {
+		t.Fatalf("Could not process image: %v", err)
+	}
+	if exifOrientation(ret) != 1 || bytes.Contains(ret, []byte("Exif")) {
+		t.Errorf("Processed image still contains EXIF data")
+	}
+	img, err := jpeg.Decode(bytes.NewReader(ret))
+	if err != nil {
+		t.Fatalf("Could not decode processed image: %v", err)
+	}
+	if bounds := img.Bounds(); bounds.Dx() != 2 || bounds.Dy() != 4 {
+		t.Errorf("Processed image is %vx%v, should be 2x4", bounds.Dx(),
+			bounds.Dy())
+	}
+	data := exifJPEG(t, 4, 2, 6, "II")
+	ret, err = processImageUpload(data, &imageSettings{KeepMetadata: true})
+	if err != nil || !bytes.Equal(ret, data) {
+		t.Errorf("processImageUpload(_, KeepMetadata) = _, %v, should keep data",
+			err)
+	}
+}
@@ -0,0 +1,1027 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"image"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// importItem is a post or page read by an import adapter.
+type importItem struct {
+	// Kind is "post" or "page". It selects the node type of the item.
+	Kind string
+	// Path of the item within the import, e.g. "about/team". Parents
+	// precede their children.
+	Path  string
+	Title string
+	// Body is the item's HTML content.
+	Body      string
+	Published time.Time
+	Public    bool
+	// Media are the media referenced by the body.
+	Media []*importMedia `json:",omitempty"`
+}
+
+// importMedia is a medium referenced by an imported item, e.g. an
+// image.
+type importMedia struct {
+	// Source is the URL of the medium as referenced by the item's body.
+	Source string
+	// Content is the medium if it's contained in the imported file, e.g.
+	// in a Markdown archive. Otherwise, it gets downloaded from Source.
+	Content []byte `json:",omitempty"`
+}
+
+// importAdapter reads the items of an exported site.
+type importAdapter func(data []byte) ([]*importItem, error)
+
+// importAdapters maps the supported import formats to their adapters.
+var importAdapters = map[string]importAdapter{
+	"wxr":      parseWXR,
+	"markdown": parseMarkdownTree,
+	"rss":      parseRSS,
+}
+
+// importNameRegexp matches characters replaced in node names of
+// imported items.
+var importNameRegexp = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// importNodeName returns the node name for an imported item with the
+// given name or title, e.g. "hello-world" for "Hello World!".
+func importNodeName(name string) string {
+	name = importNameRegexp.ReplaceAllString(strings.ToLower(name), "-")
+	if name = strings.Trim(name, "-_"); name == "" {
+		return "item"
+	}
+	return name
+}
+
+// importMediaRegexp matches the sources of images, videos and audio
+// files in HTML.
+var importMediaRegexp = regexp.MustCompile(
+	`<(?:img|video|audio|source)\b[^>]*?\ssrc\s*=\s*["']([^"']+)["']`)
+
+// importMediaSources returns the sources of the media embedded by the
+// given HTML in order of their first occurrence.
+func importMediaSources(body string) []string {
+	sources := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, match := range importMediaRegexp.FindAllStringSubmatch(body, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			sources = append(sources, match[1])
+		}
+	}
+	return sources
+}
+
+// remoteMedia returns the media of the given HTML to be downloaded,
+// i.e. the ones with absolute HTTP(S) URLs.
+func remoteMedia(body string) []*importMedia {
+	media := make([]*importMedia, 0)
+	for _, source := range importMediaSources(body) {
+		if u, err := url.Parse(html.UnescapeString(source)); err == nil &&
+			(u.Scheme == "http" || u.Scheme == "https") {
+			media = append(media, &importMedia{Source: source})
+		}
+	}
+	return media
+}
+
+// blankLinesRegexp matches blank lines separating paragraphs.
+var blankLinesRegexp = regexp.MustCompile(`\r?\n\s*\r?\n`)
+
+// autoParagraphs wraps the blocks of the given text separated by
+// blank lines in paragraphs if it doesn't contain any, like WordPress
+// does when showing posts.
+func autoParagraphs(text string) string {
+	if strings.Contains(text, "<p>") || strings.Contains(text, "<p ") {
+		return text
+	}
+	blocks := blankLinesRegexp.Split(strings.TrimSpace(text), -1)
+	paragraphs := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		if block = strings.TrimSpace(block); block != "" {
+			paragraphs = append(paragraphs, "<p>"+block+"</p>")
+		}
+	}
+	return strings.Join(paragraphs, "\n")
+}
+
+// feedTimeLayouts are the layouts of dates in RSS feeds.
+var feedTimeLayouts = []string{time.RFC1123Z, time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700", "Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700", time.RFC3339}
+
+// parseFeedTime parses the given date of an RSS feed. Returns the zero
+// time if the date is invalid.
+func parseFeedTime(value string) time.Time {
+	value = strings.TrimSpace(value)
+	for _, layout := range feedTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC()
+		}
+	}
+	return time.Time{}
+}
+
+// wxrItem is an item of a WordPress export (WXR), i.e. a post, page or
+// attachment.
+type wxrItem struct {
+	Title         string `xml:"title"`
+	Link          string `xml:"link"`
+	PubDate       string `xml:"pubDate"`
+	Content       string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	Id            int    `xml:"post_id"`
+	Date          string `xml:"post_date_gmt"`
+	Name          string `xml:"post_name"`
+	Status        string `xml:"status"`
+	Parent        int    `xml:"post_parent"`
+	Type          string `xml:"post_type"`
+	AttachmentURL string `xml:"attachment_url"`
+}
+
+// parseWXR reads the published posts, pages and drafts of a WordPress
+// export. Pages keep their hierarchy.
+func parseWXR(data []byte) ([]*importItem, error) {
+	var export struct {
+		Items []*wxrItem `xml:"channel>item"`
+	}
+	if err := xml.Unmarshal(data, &export); err != nil {
+		return nil, fmt.Errorf("Invalid WXR file: %v", err)
+	}
+	pages := make(map[int]*wxrItem)
+	attachments := make(map[string]bool)
+	for _, item := range export.Items {
+		switch item.Type {
+		case "page":
+			pages[item.Id] = item
+		case "attachment":
+			attachments[item.AttachmentURL] = true
+		}
+	}
+	name := func(item *wxrItem) string {
+		if item.Name != "" {
+			return importNodeName(item.Name)
+		}
+		if item.Title != "" {
+			return importNodeName(item.Title)
+		}
+		return fmt.Sprintf("%v-%v", item.Type, item.Id)
+	}
+	items := make([]*importItem, 0)
+	for _, item := range export.Items {
+		if item.Type != "post" && item.Type != "page" ||
+			item.Status == "trash" || item.Status == "auto-draft" {
+			continue
+		}
+		itemPath := name(item)
+		// Loops of parents are broken after the number of pages.
+		for parent, depth := pages[item.Parent], 0; item.Type == "page" &&
+			parent != nil && depth < len(pages); depth++ {
+			itemPath = name(parent) + "/" + itemPath
+			parent = pages[parent.Parent]
+		}
+		published, err := time.Parse("2006-01-02 15:04:05", item.Date)
+		if err != nil || published.Year() < 1 {
+			published = parseFeedTime(item.PubDate)
+		}
+		body := autoParagraphs(item.Content)
+		media := remoteMedia(body)
+		// Links to attachments, e.g. PDF files, are media, too.
+		for _, link := range linkAttrs(body) {
+			if attachments[html.UnescapeString(link)] {
+				media = append(media, &importMedia{Source: link})
+			}
+		}
+		items = append(items, &importItem{
+			Kind:      item.Type,
+			Path:      itemPath,
+			Title:     item.Title,
+			Body:      body,
+			Published: published,
+			Public:    item.Status == "publish",
+			Media:     uniqueMedia(media)})
+	}
+	sortImportItems(items)
+	return items, nil
+}
+
+// uniqueMedia returns the given media without duplicate sources.
+func uniqueMedia(media []*importMedia) []*importMedia {
+	unique := make([]*importMedia, 0, len(media))
+	seen := make(map[string]bool)
+	for _, medium := range media {
+		if !seen[medium.Source] {
+			seen[medium.Source] = true
+			unique = append(unique, medium)
+		}
+	}
+	return unique
+}
+
+type importItemsByDepth []*importItem
+
+func (s importItemsByDepth) Len() int { return len(s) }
+func (s importItemsByDepth) Less(i, j int) bool {
+	return strings.Count(s[i].Path, "/") < strings.Count(s[j].Path, "/")
+}
+func (s importItemsByDepth) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// sortImportItems sorts the items so that parents precede their
+// children, keeping the order of siblings.
+func sortImportItems(items []*importItem) {
+	sort.Stable(importItemsByDepth(items))
+}
+
+// parseRSS reads the items of an RSS feed as posts. Enclosures get
+// linked at the end of the posts.
+func parseRSS(data []byte) ([]*importItem, error) {
+	var feed struct {
+		Items []struct {
+			Title       string `xml:"title"`
+			Link        string `xml:"link"`
+			Description string `xml:"description"`
+			Content     string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+			PubDate     string `xml:"pubDate"`
+			Enclosures  []struct {
+				URL string `xml:"url,attr"`
+			} `xml:"enclosure"`
+		} `xml:"channel>item"`
+	}
+	if err := xml.Unmarshal(data, &feed); err != nil {
+		return nil, fmt.Errorf("Invalid RSS feed: %v", err)
+	}
+	items := make([]*importItem, 0, len(feed.Items))
+	for _, item := range feed.Items {
+		body := item.Content
+		if body == "" {
+			body = autoParagraphs(item.Description)
+		}
+		for _, enclosure := range item.Enclosures {
+			if enclosure.URL != "" {
+				body += fmt.Sprintf("\n<p><a href=\"%v\">%v</a></p>",
+					html.EscapeString(enclosure.URL),
+					html.EscapeString(path.Base(enclosure.URL)))
+			}
+		}
+		media := remoteMedia(body)
+		for _, enclosure := range item.Enclosures {
+			if enclosure.URL != "" {
+				media = append(media, &importMedia{
+					Source: html.EscapeString(enclosure.URL)})
+			}
+		}
+		name := item.Title
+		if link, err := url.Parse(item.Link); err == nil &&
+			strings.Trim(link.Path, "/") != "" {
+			base := path.Base(link.Path)
+			name = strings.TrimSuffix(base, path.Ext(base))
+		}
+		items = append(items, &importItem{
+			Kind:      "post",
+			Path:      importNodeName(name),
+			Title:     item.Title,
+			Body:      body,
+			Published: parseFeedTime(item.PubDate),
+			Public:    true,
+			Media:     uniqueMedia(media)})
+	}
+	return items, nil
+}
+
+// parseFrontMatter splits the given Markdown source into the values of
+// its front matter (e.g. "title: Hello" between lines "---") and the
+// rest of the source.
+func parseFrontMatter(source string) (map[string]string, string) {
+	values := make(map[string]string)
+	source = strings.Replace(source, "\r\n", "\n", -1)
+	if !strings.HasPrefix(source, "---\n") {
+		return values, source
+	}
+	parts := strings.SplitN(source[4:], "\n---\n", 2)
+	if len(parts) != 2 {
+		return values, source
+	}
+	for _, line := range strings.Split(parts[0], "\n") {
+		pair := strings.SplitN(line, ":", 2)
+		if len(pair) == 2 {
+			values[strings.ToLower(strings.TrimSpace(pair[0]))] =
+				strings.Trim(strings.TrimSpace(pair[1]), `"'`)
+		}
+	}
+	return values, parts[1]
+}
+
+// parseMarkdownTime parses the date of a Markdown front matter.
+func parseMarkdownTime(value string) time.Time {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04",
+		"2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC()
+		}
+	}
+	return time.Time{}
+}
+
+// parseMarkdownTree reads the Markdown files of a ZIP archive as
+// pages. Directories become parents, their index.md files their
+// content. Front matter may set the title, date and draft status.
+// Images referenced by relative paths are taken from the archive.
+func parseMarkdownTree(data []byte) ([]*importItem, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ZIP archive: %v", err)
+	}
+	files := make(map[string]*zip.File)
+	for _, file := range archive.File {
+		files[path.Clean(file.Name)] = file
+	}
+	read := func(file *zip.File) ([]byte, error) {
+		reader, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	}
+	items := make([]*importItem, 0)
+	for _, file := range archive.File {
+		ext := strings.ToLower(path.Ext(file.Name))
+		if ext != ".md" && ext != ".markdown" {
+			continue
+		}
+		content, err := read(file)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read %v: %v", file.Name, err)
+		}
+		values, source := parseFrontMatter(string(content))
+		title := values["title"]
+		if lines := strings.SplitN(strings.TrimLeft(source, "\n"), "\n",
+			2); title == "" && strings.HasPrefix(lines[0], "# ") {
+			title = strings.TrimSpace(lines[0][2:])
+			source = ""
+			if len(lines) > 1 {
+				source = lines[1]
+			}
+		}
+		filePath := strings.TrimSuffix(path.Clean(file.Name), path.Ext(file.Name))
+		if path.Base(filePath) == "index" && path.Dir(filePath) != "." {
+			filePath = path.Dir(filePath)
+		}
+		if title == "" {
+			title = galleryImageTitle(filePath)
+		}
+		segments := strings.Split(filePath, "/")
+		for i := range segments {
+			segments[i] = importNodeName(segments[i])
+		}
+		published := parseMarkdownTime(values["date"])
+		// Archives without modification times have DOS' epoch of 1980.
+		if published.IsZero() && file.Modified.Year() > 1980 {
+			published = file.Modified.UTC()
+		}
+		body := string(service.RenderMarkdown(source))
+		media := remoteMedia(body)
+		for _, source := range importMediaSources(body) {
+			target, err := url.Parse(html.UnescapeString(source))
+			if err != nil || target.Scheme != "" || target.Host != "" {
+				continue
+			}
+			medium, ok := files[path.Join(path.Dir(file.Name), target.Path)]
+			if !ok {
+				continue
+			}
+			content, err := read(medium)
+			if err != nil {
+				return nil, fmt.Errorf("Could not read %v: %v", medium.Name, err)
+			}
+			media = append(media, &importMedia{Source: source, Content: content})
+		}
+		items = append(items, &importItem{
+			Kind:      "page",
+			Path:      strings.Join(segments, "/"),
+			Title:     title,
+			Body:      body,
+			Published: published,
+			Public:    values["draft"] != "true",
+			Media:     media})
+	}
+	sortImportItems(items)
+	return items, nil
+}
+
+// importExpiry is the time after which unconfirmed imports get
+// removed.
+const importExpiry = 24 * time.Hour
+
+// pendingImport is an import shown as dry run and waiting for
+// confirmation. It's stored in the imports directory of the site's
+// data directory.
+type pendingImport struct {
+	Id string `json:"-"`
+	// Login is the login of the importing user.
+	Login string
+	// Parent is the path of the node below which the items get
+	// imported.
+	Parent string
+	// Types maps item kinds to the ids of the node types of the
+	// imported nodes.
+	Types map[string]string
+	Items []*importItem
+}
+
+// importsPath returns the path to the pending imports inside the given
+// site data directory.
+func importsPath(dataDir string) string {
+	return filepath.Join(dataDir, "imports")
+}
+
+// savePendingImport stores the import under a new id. Expired imports
+// get removed.
+func savePendingImport(dataDir string, pending *pendingImport) error {
+	dir := importsPath(dataDir)
+	if err := removeExpiredImports(dir, time.Now()); err != nil {
+		return err
+	}
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Errorf("Could not generate import id: %v", err)
+	}
+	pending.Id = base32.StdEncoding.EncodeToString(buf)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Could not create imports directory: %v", err)
+	}
+	content, err := json.Marshal(pending)
+	if err != nil {
+		return fmt.Errorf("Could not marshal import: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, pending.Id+".json"), content,
+		0600); err != nil {
+		return fmt.Errorf("Could not write import: %v", err)
+	}
+	return nil
+}
+
+// getPendingImport returns the pending import with the given id.
+//
+// If there is no such import, it returns nil, nil.
+func getPendingImport(dataDir, id string) (*pendingImport, error) {
+	if !validUploadId(id) {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(filepath.Join(importsPath(dataDir),
+		id+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Could not read import: %v", err)
+	}
+	pending := &pendingImport{Id: id}
+	if err := json.Unmarshal(content, pending); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal import: %v", err)
+	}
+	return pending, nil
+}
+
+// removePendingImport removes the pending import with the given id.
+func removePendingImport(dataDir, id string) error {
+	if !validUploadId(id) {
+		return nil
+	}
+	err := os.Remove(filepath.Join(importsPath(dataDir), id+".json"))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Could not remove import: %v", err)
+	}
+	return nil
+}
+
+// removeExpiredImports removes the imports of the given directory
+// saved more than importExpiry before now.
+func removeExpiredImports(dir string, now time.Time) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Could not read imports directory: %v", err)
+	}
+	for _, file := range files {
+		if now.Sub(file.ModTime()) < importExpiry {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, file.Name())); err != nil {
+			return fmt.Errorf("Could not remove import: %v", err)
+		}
+	}
+	return nil
+}
+
+// importPlanItem is an imported item as it will be written.
+type importPlanItem struct {
+	Item *importItem
+	// Path and Type are the path and the node type id of the item's
+	// node.
+	Path, Type string
+	Published  time.Time
+}
+
+// planImport returns the nodes to be written for the pending import.
+// Items get free names below their parents, considering the path
+// prefixes of their node types. Items without publication date get
+// published now.
+func planImport(pending *pendingImport, types map[string]*service.NodeType,
+	exists func(nodePath string) (bool, error), now time.Time) (
+	[]*importPlanItem, error) {
+	planned := make(map[string]string)
+	taken := make(map[string]bool)
+	free := func(nodePath string) (bool, error) {
+		if taken[nodePath] {
+			return true, nil
+		}
+		return exists(nodePath)
+	}
+	plan := make([]*importPlanItem, 0, len(pending.Items))
+	for _, item := range pending.Items {
+		nodeType := types[item.Kind]
+		if nodeType == nil {
+			return nil, fmt.Errorf("No node type for %v items", item.Kind)
+		}
+		published := item.Published
+		if published.IsZero() {
+			published = now
+		}
+		parent := pending.Parent
+		if dir := path.Dir(item.Path); dir != "." {
+			if nodePath, ok := planned[dir]; ok {
+				parent = nodePath
+			} else {
+				parent = path.Join(parent, dir)
+			}
+		}
+		node := service.Node{Type: nodeType, PublishTime: published}
+		parent = path.Join(parent, node.GetPathPrefix())
+		name, err := freeNodeName(free, parent, path.Base(item.Path))
+		if err != nil {
+			return nil, fmt.Errorf("Could not get free node name: %v", err)
+		}
+		nodePath := path.Join(parent, name)
+		planned[item.Path] = nodePath
+		taken[nodePath] = true
+		plan = append(plan, &importPlanItem{item, nodePath, nodeType.Id,
+			published})
+	}
+	return plan, nil
+}
+
+// plannedMedia returns the media of the planned items without
+// duplicates. Media referenced by a public item are public.
+func plannedMedia(plan []*importPlanItem) ([]*importMedia, map[string]bool) {
+	media := make([]*importMedia, 0)
+	public := make(map[string]bool)
+	for _, item := range plan {
+		for _, medium := range item.Item.Media {
+			if _, ok := public[medium.Source]; !ok {
+				media = append(media, medium)
+			}
+			public[medium.Source] = public[medium.Source] || item.Item.Public
+		}
+	}
+	return media, public
+}
+
+// replaceImportMedia returns the body with the sources of the given
+// media replaced by the paths of their nodes. Media without node are
+// left unchanged.
+func replaceImportMedia(body string, media []*importMedia,
+	nodePaths map[string]string) string {
+	pairs := make([]string, 0)
+	for _, medium := range media {
+		if nodePath := nodePaths[medium.Source]; nodePath != "" {
+			for _, quote := range []string{`"`, `'`} {
+				pairs = append(pairs, quote+medium.Source+quote,
+					quote+nodePath+quote)
+			}
+		}
+	}
+	return strings.NewReplacer(pairs...).Replace(body)
+}
+
+// nonPublicNetworks are the loopback, private, link-local and other
+// special purpose networks media of imports can't be downloaded from.
+var nonPublicNetworks = func() []*net.IPNet {
+	networks, err := parseNetworks([]string{"0.0.0.0/8", "10.0.0.0/8",
+		"100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+		"192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/3",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8"})
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}()
+
+// dialPublic connects to the address like net.Dial, but refuses to
+// connect to hosts resolving to non-public addresses.
+func dialPublic(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no address found for %v", host)
+	}
+	for _, ip := range ips {
+		if inNetworks(ip.String(), nonPublicNetworks) {
+			return nil, fmt.Errorf("%v resolves to non-public address %v", host, ip)
+		}
+	}
+	return net.DialTimeout(network, net.JoinHostPort(ips[0].String(), port),
+		30*time.Second)
+}
+
+// importClient downloads the media of imported items. It only connects
+// to public addresses, also when following redirects.
+var importClient = &http.Client{Timeout: 30 * time.Second,
+	Transport: &http.Transport{Dial: dialPublic,
+		TLSHandshakeTimeout: 10 * time.Second}}
+
+// maxImportMediaSize is the maximum size in bytes of downloaded media.
+const maxImportMediaSize = 32 << 20
+
+// downloadImportMedia downloads the medium at the given HTTP(S) URL.
+func downloadImportMedia(source string) ([]byte, error) {
+	res, err := importClient.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v", res.Status)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(res.Body,
+		maxImportMediaSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > maxImportMediaSize {
+		return nil, fmt.Errorf("larger than %v bytes", maxImportMediaSize)
+	}
+	return content, nil
+}
+
+// importMediaNode writes the medium as image or file node into the
+// given folder and returns the node's path.
+//
+// Returns a translated message if the medium can't be imported.
+func importMediaNode(c *reqContext, h *nodeHandler, medium *importMedia,
+	folder string, public bool, now time.Time) (string, string, error) {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	source := html.UnescapeString(medium.Source)
+	content := medium.Content
+	if content == nil {
+		var err error
+		if content, err = downloadImportMedia(source); err != nil {
+			return "", fmt.Sprintf(G("The file could not be downloaded: %v"),
+				err), nil
+		}
+	}
+	fileName := path.Base(source)
+	if u, err := url.Parse(source); err == nil {
+		fileName = path.Base(u.Path)
+	}
+	reason, err := screenUpload(c, h, quarantinedFile{Name: fileName}, content)
+	if err != nil {
+		return "", "", fmt.Errorf("Could not scan upload: %v", err)
+	}
+	if reason != "" {
+		return "", fmt.Sprintf(G("The file has been quarantined for review: %v"),
+			reason), nil
+	}
+	typeId := "core.File"
+	if _, _, err := image.DecodeConfig(bytes.NewReader(content)); err == nil {
+		typeId = "core.Image"
+	}
+	nodeType, err := c.Serv.Monsti().GetNodeType(typeId)
+	if err != nil {
+		return "", "", fmt.Errorf("Could not get node type: %v", err)
+	}
+	name, err := freeNodeName(func(nodePath string) (bool, error) {
+		node, err := c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
+		return node != nil, err
+	}, folder, galleryImageName(fileName))
+	if err != nil {
+		return "", "", fmt.Errorf("Could not get free node name: %v", err)
+	}
+	node := service.Node{
+		Path:        path.Join(folder, name),
+		Type:        nodeType,
+		Hide:        true,
+		Public:      public,
+		PublishTime: now}
+	if err := node.InitFields(c.Serv.Monsti(), c.Site.Name); err != nil {
+		return "", "", fmt.Errorf("Could not init media fields: %v", err)
+	}
+	*(node.GetField("core.Title").(*service.TextField)) = service.TextField(
+		galleryImageTitle(fileName))
+	msg, err := writeNodeWithHooks(c, h, &node, func() error {
+		if typeId == "core.Image" {
+			return writeImageUpload(c, h, node.Path, content)
+		}
+		if err := c.Serv.Monsti().WriteNodeData(c.Site.Name, node.Path,
+			"__file_core.File", content); err != nil {
+			return fmt.Errorf("Could not save file: %v", err)
+		}
+		return nil
+	}, &service.NodeEvent{Type: service.NodeCreatedEvent})
+	return node.Path, msg, err
+}
+
+// importResult summarizes a finished import.
+type importResult struct {
+	Nodes, Media int
+	// Errors are translated messages about items and media which could
+	// not be imported.
+	Errors []string
+}
+
+// runImport writes the planned nodes. Media get written into the
+// folder "media" below the import's parent and the bodies of the items
+// get changed to reference them.
+func runImport(c *reqContext, h *nodeHandler, pending *pendingImport,
+	plan []*importPlanItem, types map[string]*service.NodeType,
+	now time.Time) (*importResult, error) {
+	result := &importResult{Errors: make([]string, 0)}
+	allowlist, err := getHTMLAllowlist(c.Serv, c.Site.Name)
+	if err != nil {
+		return nil, err
+	}
+	media, public := plannedMedia(plan)
+	nodePaths := make(map[string]string)
+	folder := path.Join(pending.Parent, "media")
+	for _, medium := range media {
+		nodePath, msg, err := importMediaNode(c, h, medium, folder,
+			public[medium.Source], now)
+		if err != nil {
+			return nil, err
+		}
+		if msg != "" {
+			result.Errors = append(result.Errors, fmt.Sprintf("%v: %v",
+				html.UnescapeString(medium.Source), msg))
+			continue
+		}
+		nodePaths[medium.Source] = nodePath
+		result.Media++
+	}
+	for _, item := range plan {
+		node := service.Node{
+			Path:        item.Path,
+			Type:        types[item.Item.Kind],
+			Public:      item.Item.Public,
+			PublishTime: item.Published}
+		if err := node.InitFields(c.Serv.Monsti(), c.Site.Name); err != nil {
+			return nil, fmt.Errorf("Could not init node fields: %v", err)
+		}
+		if title, ok := node.GetField("core.Title").(*service.TextField); ok {
+			*title = service.TextField(item.Item.Title)
+		}
+		if body, ok := node.GetField("core.Body").(*service.HTMLField); ok {
+			*body = service.HTMLField(replaceImportMedia(item.Item.Body,
+				item.Item.Media, nodePaths))
+		}
+		sanitizeHTMLFields(&node, allowlist)
+		msg, err := writeNodeWithHooks(c, h, &node, nil,
+			&service.NodeEvent{Type: service.NodeCreatedEvent})
+		if err != nil {
+			return nil, err
+		}
+		if msg != "" {
+			result.Errors = append(result.Errors, fmt.Sprintf("%v: %v",
+				item.Path, msg))
+			continue
+		}
+		result.Nodes++
+	}
+	return result, nil
+}
+
+// importNodeTypes returns the node types which may be used for
+// imported items below the requested node, i.e. the addable ones
+// having a title and a body.
+func importNodeTypes(c *reqContext) (map[string]*service.NodeType,
+	[]nodeTypeOption, error) {
+	ids, err := c.Serv.Monsti().GetAddableNodeTypes(c.Site.Name,
+		c.Node.Type.Id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not get addable node types: %v", err)
+	}
+	types := make(map[string]*service.NodeType)
+	options := make([]nodeTypeOption, 0, len(ids))
+	for _, id := range ids {
+		nodeType, err := c.Serv.Monsti().GetNodeType(id)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not get node type: %v", err)
+		}
+		var title, body bool
+		for _, field := range nodeType.Fields {
+			title = title || field.Id == "core.Title"
+			body = body || field.Id == "core.Body"
+		}
+		if title && body {
+			types[id] = nodeType
+			options = append(options, nodeTypeOption{nodeType.Id,
+				nodeType.GetLocalName(c.UserSession.Locale)})
+		}
+	}
+	return types, options, nil
+}
+
+// defaultImportType returns the first of the preferred node type ids
+// which may be used for imported items.
+func defaultImportType(types map[string]*service.NodeType,
+	preferred ...string) string {
+	for _, id := range preferred {
+		if types[id] != nil {
+			return id
+		}
+	}
+	return ""
+}
+
+// Import imports the posts and pages of an uploaded file (form value
+// "File") of the format given by the form value "Adapter" below the
+// requested node. It first shows a dry run of the import which has to
+// be confirmed.
+func (h *nodeHandler) Import(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if err := c.Req.ParseMultipartForm(1024 * 1024); err != nil {
+		if err != http.ErrNotMultipart {
+			return fmt.Errorf("Could not parse form: %v", err)
+		}
+	}
+	dataDir := h.Settings.Monsti.GetSiteDataPath(c.Site.Name)
+	types, options, err := importNodeTypes(c)
+	if err != nil {
+		return err
+	}
+	context := template.Context{
+		"NodeTypes": options,
+		"PostType":  defaultImportType(types, "core.BlogPost", "core.Document"),
+		"PageType":  defaultImportType(types, "core.Document")}
+	exists := func(nodePath string) (bool, error) {
+		node, err := c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
+		return node != nil, err
+	}
+	itemTypes := func(pending *pendingImport) map[string]*service.NodeType {
+		ret := make(map[string]*service.NodeType)
+		for kind, id := range pending.Types {
+			ret[kind] = types[id]
+		}
+		return ret
+	}
+	switch c.Req.Method {
+	case "GET":
+		context["Imported"] = c.Req.Form.Get("imported")
+	case "POST":
+		now := time.Now().UTC()
+		if id := c.Req.Form.Get("Id"); id != "" {
+			pending, err := getPendingImport(dataDir, id)
+			if err != nil {
+				return err
+			}
+			if pending == nil || pending.Login != c.UserSession.User.Login ||
+				pending.Parent != c.Node.Path {
+				context["Error"] = G("The import has expired. Please upload the file again.")
+				break
+			}
+			plan, err := planImport(pending, itemTypes(pending), exists, now)
+			if err != nil {
+				return err
+			}
+			result, err := runImport(c, h, pending, plan, itemTypes(pending), now)
+			if err != nil {
+				return err
+			}
+			if err := removePendingImport(dataDir, id); err != nil {
+				return err
+			}
+			if len(result.Errors) == 0 {
+				http.Redirect(c.Res, c.Req, "@@import?imported="+
+					fmt.Sprint(result.Nodes), http.StatusSeeOther)
+				return nil
+			}
+			context["Imported"] = fmt.Sprint(result.Nodes)
+			context["Errors"] = result.Errors
+			break
+		}
+		adapter := importAdapters[c.Req.Form.Get("Adapter")]
+		pending := &pendingImport{
+			Login:  c.UserSession.User.Login,
+			Parent: c.Node.Path,
+			Types: map[string]string{
+				"post": c.Req.Form.Get("PostType"),
+				"page": c.Req.Form.Get("PageType")}}
+		context["PostType"] = pending.Types["post"]
+		context["PageType"] = pending.Types["page"]
+		if adapter == nil {
+			context["Error"] = G("Please choose the format of the file.")
+			break
+		}
+		if types[pending.Types["post"]] == nil ||
+			types[pending.Types["page"]] == nil {
+			context["Error"] = G("Please choose the node types of the imported items.")
+			break
+		}
+		file, _, err := c.Req.FormFile("File")
+		if err != nil {
+			context["Error"] = G("Please choose a file to import.")
+			break
+		}
+		content, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("Could not read multipart file: %v", err)
+		}
+		if pending.Items, err = adapter(content); err != nil {
+			context["Error"] = fmt.Sprintf(G("The file could not be read: %v"),
+				err)
+			break
+		}
+		if len(pending.Items) == 0 {
+			context["Error"] = G("The file does not contain any posts or pages.")
+			break
+		}
+		plan, err := planImport(pending, itemTypes(pending), exists, now)
+		if err != nil {
+			return err
+		}
+		if err := savePendingImport(dataDir, pending); err != nil {
+			return err
+		}
+		media, _ := plannedMedia(plan)
+		sources := make([]string, 0, len(media))
+		for _, medium := range media {
+			sources = append(sources, html.UnescapeString(medium.Source))
+		}
+		context["Id"] = pending.Id
+		context["Plan"] = plan
+		context["Media"] = sources
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	body, err := h.Renderer.Render("actions/import", context,
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render import form: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   fmt.Sprintf(G("Import below \"%v\""), getNodeTitle(c.Node)),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
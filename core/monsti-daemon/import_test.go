@@ -0,0 +1,277 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+const testWXR = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:content="http://purl.org/rss/1.0/modules/content/"
+  xmlns:wp="http://wordpress.org/export/1.2/">
+<channel>
+  <item>
+    <title>About us</title>
+    <content:encoded><![CDATA[We are <img src="http://example.com/team.jpg">.
+
+Really.]]></content:encoded>
+    <wp:post_id>2</wp:post_id>
+    <wp:post_date_gmt>2014-03-01 10:00:00</wp:post_date_gmt>
+    <wp:post_name>about</wp:post_name>
+    <wp:status>publish</wp:status>
+    <wp:post_parent>0</wp:post_parent>
+    <wp:post_type>page</wp:post_type>
+  </item>
+  <item>
+    <title>Our Team</title>
+    <content:encoded><![CDATA[<p>See <a href="http://example.com/cv.pdf">CV</a></p>]]></content:encoded>
+    <wp:post_id>3</wp:post_id>
+    <wp:post_date_gmt>0000-00-00 00:00:00</wp:post_date_gmt>
+    <wp:status>draft</wp:status>
+    <wp:post_parent>2</wp:post_parent>
+    <wp:post_type>page</wp:post_type>
+  </item>
+  <item>
+    <title>Hello World!</title>
+    <pubDate>Sat, 01 Feb 2014 08:00:00 +0000</pubDate>
+    <content:encoded><![CDATA[<p>Hi</p>]]></content:encoded>
+    <wp:post_id>4</wp:post_id>
+    <wp:post_date_gmt>2014-02-01 08:00:00</wp:post_date_gmt>
+    <wp:post_name>hello-world</wp:post_name>
+    <wp:status>publish</wp:status>
+    <wp:post_type>post</wp:post_type>
+  </item>
+  <item>
+    <title>cv</title>
+    <wp:post_id>5</wp:post_id>
+    <wp:status>inherit</wp:status>
+    <wp:post_type>attachment</wp:post_type>
+    <wp:attachment_url>http://example.com/cv.pdf</wp:attachment_url>
+  </item>
+  <item>
+    <title>Removed</title>
+    <wp:post_id>6</wp:post_id>
+    <wp:status>trash</wp:status>
+    <wp:post_type>post</wp:post_type>
+  </item>
+</channel>
+</rss>`
+
+func TestParseWXR(t *testing.T) {
+	items, err := parseWXR([]byte(testWXR))
+	if err != nil {
+		t.Fatalf("parseWXR returned error: %v", err)
+	}
+	expected := []*importItem{
+		{Kind: "page", Path: "about", Title: "About us",
+			Body:      "<p>We are <img src=\"http://example.com/team.jpg\">.</p>\n<p>Really.</p>",
+			Published: time.Date(2014, 3, 1, 10, 0, 0, 0, time.UTC), Public: true,
+			Media: []*importMedia{{Source: "http://example.com/team.jpg"}}},
+		{Kind: "post", Path: "hello-world", Title: "Hello World!",
+			Body:      "<p>Hi</p>",
+			Published: time.Date(2014, 2, 1, 8, 0, 0, 0, time.UTC), Public: true,
+			Media: []*importMedia{}},
+		{Kind: "page", Path: "about/our-team", Title: "Our Team",
+			Body:  `<p>See <a href="http://example.com/cv.pdf">CV</a></p>`,
+			Media: []*importMedia{{Source: "http://example.com/cv.pdf"}}},
+	}
+	if !reflect.DeepEqual(items, expected) {
+		for i, item := range items {
+			t.Errorf("Item %v: %+v", i, item)
+		}
+	}
+}
+
+func TestParseRSS(t *testing.T) {
+	feed := `<?xml version="1.0"?>
+<rss version="2.0"><channel>
+  <item>
+    <title>Episode 1</title>
+    <link>http://example.com/podcast/episode-1.html</link>
+    <description>First
+
+Episode</description>
+    <pubDate>Mon, 3 Mar 2014 12:00:00 +0100</pubDate>
+    <enclosure url="http://example.com/e1.mp3" type="audio/mpeg"/>
+  </item>
+</channel></rss>`
+	items, err := parseRSS([]byte(feed))
+	if err != nil {
+		t.Fatalf("parseRSS returned error: %v", err)
+	}
+	expected := []*importItem{{Kind: "post", Path: "episode-1",
+		Title: "Episode 1",
+		Body: "<p>First</p>\n<p>Episode</p>\n" +
+			`<p><a href="http://example.com/e1.mp3">e1.mp3</a></p>`,
+		Published: time.Date(2014, 3, 3, 11, 0, 0, 0, time.UTC), Public: true,
+		Media: []*importMedia{{Source: "http://example.com/e1.mp3"}}}}
+	if !reflect.DeepEqual(items, expected) {
+		t.Errorf("parseRSS returned %+v, should be %+v", items[0], expected[0])
+	}
+}
+
+func TestParseMarkdownTree(t *testing.T) {
+	buf := new(bytes.Buffer)
+	archive := zip.NewWriter(buf)
+	for name, content := range map[string]string{
+		"docs/index.md": "# Documentation\n\n<img src=\"img/logo.png\" alt=\"Logo\">\n",
+		"docs/install.md": "---\ntitle: \"Installing\"\ndate: 2014-05-01\n" +
+			"draft: true\n---\nRun it.\n",
+		"docs/img/logo.png": "PNG",
+	} {
+		writer, err := archive.Create(name)
+		if err != nil {
+			t.Fatalf("Could not create archive: %v", err)
+		}
+		writer.Write([]byte(content))
+	}
+	archive.Close()
+	items, err := parseMarkdownTree(buf.Bytes())
+	if err != nil {
+		t.Fatalf("parseMarkdownTree returned error: %v", err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("parseMarkdownTree returned %v items, should be 2", len(items))
+	}
+	docs, install := items[0], items[1]
+	if docs.Path != "docs" || docs.Title != "Documentation" ||
+		len(docs.Media) != 1 || docs.Media[0].Source != "img/logo.png" ||
+		string(docs.Media[0].Content) != "PNG" || !docs.Public ||
+		!docs.Published.IsZero() {
+		t.Errorf("Unexpected index item: %+v", docs)
+	}
+	if install.Path != "docs/install" || install.Title != "Installing" ||
+		install.Public || install.Body != "<p>Run it.</p>\n" ||
+		!install.Published.Equal(time.Date(2014, 5, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected item: %+v", install)
+	}
+}
+
+func TestPlanImport(t *testing.T) {
+	now := time.Date(2015, 1, 2, 0, 0, 0, 0, time.UTC)
+	types := map[string]*service.NodeType{
+		"post": {Id: "core.BlogPost", PathPrefix: "$year/$month"},
+		"page": {Id: "core.Document"}}
+	pending := &pendingImport{Parent: "/blog", Items: []*importItem{
+		{Kind: "page", Path: "about"},
+		{Kind: "page", Path: "about"},
+		{Kind: "post", Path: "hello",
+			Published: time.Date(2014, 2, 1, 8, 0, 0, 0, time.UTC)},
+		{Kind: "post", Path: "new"},
+		{Kind: "page", Path: "about/team"},
+		{Kind: "page", Path: "docs/install"},
+	}}
+	exists := func(nodePath string) (bool, error) {
+		return nodePath == "/blog/about", nil
+	}
+	plan, err := planImport(pending, types, exists, now)
+	if err != nil {
+		t.Fatalf("planImport returned error: %v", err)
+	}
+	paths := make([]string, 0, len(plan))
+	for _, item := range plan {
+		paths = append(paths, item.Path)
+	}
+	expected := []string{"/blog/about-2", "/blog/about-3",
+		"/blog/2014/02/hello", "/blog/2015/01/new", "/blog/about-3/team",
+		"/blog/docs/install"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("planImport returned %v, should be %v", paths, expected)
+	}
+	if !plan[3].Published.Equal(now) || plan[2].Type != "core.BlogPost" {
+		t.Errorf("Unexpected planned post: %+v", plan[3])
+	}
+	pending.Items = append(pending.Items, &importItem{Kind: "other"})
+	if _, err := planImport(pending, types, exists, now); err == nil {
+		t.Errorf("planImport should fail for items without node type")
+	}
+}
+
+func TestReplaceImportMedia(t *testing.T) {
+	media := []*importMedia{{Source: "http://example.com/a.jpg"},
+		{Source: "b.png"}, {Source: "missing.png"}}
+	body := `<img src="http://example.com/a.jpg"> <img src='b.png'> ` +
+		`<img src="missing.png"> <img src="xb.png">`
+	ret := replaceImportMedia(body, media, map[string]string{
+		"http://example.com/a.jpg": "/media/a.jpg", "b.png": "/media/b.png"})
+	expected := `<img src="/media/a.jpg"> <img src='/media/b.png'> ` +
+		`<img src="missing.png"> <img src="xb.png">`
+	if ret != expected {
+		t.Errorf("replaceImportMedia returned %q, should be %q", ret, expected)
+	}
+}
+
+func TestPendingImports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-import")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	pending := &pendingImport{Login: "admin", Parent: "/",
+		Items: []*importItem{{Kind: "page", Path: "a", Title: "A"}}}
+	if err := savePendingImport(dir, pending); err != nil {
+		t.Fatalf("savePendingImport returned error: %v", err)
+	}
+	ret, err := getPendingImport(dir, pending.Id)
+	if err != nil || !reflect.DeepEqual(ret, pending) {
+		t.Errorf("getPendingImport returned %+v, %v", ret, err)
+	}
+	if ret, err := getPendingImport(dir, "../foo"); ret != nil || err != nil {
+		t.Errorf("getPendingImport should ignore invalid ids")
+	}
+	if err := removeExpiredImports(importsPath(dir),
+		time.Now().Add(2*importExpiry)); err != nil {
+		t.Errorf("removeExpiredImports returned error: %v", err)
+	}
+	if ret, err := getPendingImport(dir, pending.Id); ret != nil || err != nil {
+		t.Errorf("Expired import should have been removed: %v, %v", ret, err)
+	}
+}
+
+func TestDownloadImportMediaPublic(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "secret")
+		}))
+	defer server.Close()
+	content, err := downloadImportMedia(server.URL + "/foo.png")
+	if err == nil || !strings.Contains(err.Error(), "non-public") {
+		t.Errorf("downloadImportMedia(%q) = %q, %v, should be refused",
+			server.URL, content, err)
+	}
+	for _, addr := range []string{"10.1.2.3", "::1", "::ffff:127.0.0.1",
+		"169.254.169.254", "fd00::1"} {
+		if !inNetworks(addr, nonPublicNetworks) {
+			t.Errorf("%v should not be public", addr)
+		}
+	}
+	if inNetworks("93.184.216.34", nonPublicNetworks) {
+		t.Errorf("93.184.216.34 should be public")
+	}
+}
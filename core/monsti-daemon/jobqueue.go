@@ -0,0 +1,436 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// jobQueueSettings configures the job queue.
+type jobQueueSettings struct {
+	// Directory holds the queued jobs. Defaults to .jobs in the data
+	// directory.
+	Directory string
+	// Attempts is the number of attempts before a job is dead unless
+	// given by the job. Defaults to 5.
+	Attempts int
+	// Backoff is the delay after the first failed attempt, e.g. "1m".
+	// It doubles with each further attempt up to 24 hours. Defaults to
+	// one minute.
+	Backoff string
+}
+
+const (
+	defaultJobAttempts = 5
+	defaultJobBackoff  = time.Minute
+	maxJobBackoff      = 24 * time.Hour
+	defaultJobLease    = 10 * time.Minute
+	// jobQueuePoll is the interval between scans of the queue directory
+	// by waiting workers, e.g. to find jobs with ended leases.
+	jobQueuePoll = 30 * time.Second
+)
+
+// jobQueue keeps the jobs of modules until workers finish them. The
+// queue is stored in a directory with a JSON file per job.
+type jobQueue struct {
+	Dir      string
+	Attempts int
+	Backoff  time.Duration
+	Log      *log.Logger
+	mutex    sync.Mutex
+	// changed gets closed and replaced when jobs become due.
+	changed chan struct{}
+}
+
+// newJobQueue returns the job queue configured by the settings.
+func newJobQueue(settings *settings, logger *log.Logger) (*jobQueue, error) {
+	config := settings.Jobs
+	queue := &jobQueue{
+		Dir:      config.Directory,
+		Attempts: config.Attempts,
+		Backoff:  defaultJobBackoff,
+		Log:      logger,
+		changed:  make(chan struct{})}
+	if queue.Dir == "" {
+		queue.Dir = filepath.Join(settings.Monsti.Directories.Data, ".jobs")
+	}
+	if queue.Attempts <= 0 {
+		queue.Attempts = defaultJobAttempts
+	}
+	if config.Backoff != "" {
+		var err error
+		if queue.Backoff, err = time.ParseDuration(config.Backoff); err != nil {
+			return nil, fmt.Errorf("Invalid job queue backoff: %v", err)
+		}
+	}
+	if err := os.MkdirAll(queue.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("Could not create job queue directory: %v", err)
+	}
+	return queue, nil
+}
+
+// randomHex returns n random bytes encoded in hex.
+func randomHex(n int) (string, error) {
+	id := make([]byte, n)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// path returns the path to the file of the job.
+func (q *jobQueue) path(id string) string {
+	return filepath.Join(q.Dir, id+".json")
+}
+
+// read returns the job with the given id or nil if there is no such
+// job.
+func (q *jobQueue) read(id string) (*service.Job, error) {
+	content, err := ioutil.ReadFile(q.path(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Could not read job: %v", err)
+	}
+	job := new(service.Job)
+	if err := json.Unmarshal(content, job); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal job %q: %v", id, err)
+	}
+	return job, nil
+}
+
+// write stores the job.
+func (q *jobQueue) write(job *service.Job) error {
+	content, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("Could not marshal job: %v", err)
+	}
+	tmp := q.path(job.Id) + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return fmt.Errorf("Could not write job: %v", err)
+	}
+	if err := os.Rename(tmp, q.path(job.Id)); err != nil {
+		return fmt.Errorf("Could not write job: %v", err)
+	}
+	return nil
+}
+
+// notify wakes up the waiting workers. The caller must hold the mutex.
+func (q *jobQueue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// Add queues the job.
+func (q *jobQueue) Add(newJob *service.NewJob, now time.Time) (string,
+	error) {
+	if newJob.Queue == "" {
+		return "", fmt.Errorf("Missing queue of job")
+	}
+	id, err := randomHex(4)
+	if err != nil {
+		return "", fmt.Errorf("Could not generate job id: %v", err)
+	}
+	job := &service.Job{
+		Id:          fmt.Sprintf("%d-%s", now.UnixNano(), id),
+		Queue:       newJob.Queue,
+		Site:        newJob.Site,
+		Data:        newJob.Data,
+		Status:      service.JobQueued,
+		Queued:      now,
+		MaxAttempts: newJob.Attempts,
+		Next:        now.Add(newJob.Delay)}
+	if job.MaxAttempts <= 0 {
+		job.MaxAttempts = q.Attempts
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if err := q.write(job); err != nil {
+		return "", err
+	}
+	q.notify()
+	return job.Id, nil
+}
+
+type jobsByTime []*service.Job
+
+func (s jobsByTime) Len() int      { return len(s) }
+func (s jobsByTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s jobsByTime) Less(i, j int) bool {
+	return s[i].Queued.Before(s[j].Queued) ||
+		(s[i].Queued.Equal(s[j].Queued) && s[i].Id < s[j].Id)
+}
+
+// List returns the jobs, oldest first.
+func (q *jobQueue) List() ([]*service.Job, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.list()
+}
+
+func (q *jobQueue) list() ([]*service.Job, error) {
+	files, err := ioutil.ReadDir(q.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read job queue: %v", err)
+	}
+	jobs := make([]*service.Job, 0, len(files))
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		job, err := q.read(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		if job != nil {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Sort(jobsByTime(jobs))
+	return jobs, nil
+}
+
+// backoff returns the delay after the given number of failed
+// attempts.
+func (q *jobQueue) backoff(attempts int) time.Duration {
+	delay := q.Backoff
+	for i := 1; i < attempts && delay < maxJobBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxJobBackoff {
+		delay = maxJobBackoff
+	}
+	return delay
+}
+
+// fail records a failed attempt of the job. The caller must hold the
+// mutex.
+func (q *jobQueue) fail(job *service.Job, reason string, now time.Time) {
+	job.Lease = ""
+	job.Error = reason
+	if job.Attempts >= job.MaxAttempts {
+		job.Status = service.JobDead
+		q.Log.Printf("Job %v of queue %q is dead: %v", job.Id, job.Queue, reason)
+		return
+	}
+	job.Status = service.JobQueued
+	job.Next = now.Add(q.backoff(job.Attempts))
+}
+
+// Lease leases the oldest due job of the given queues for the given
+// duration. If there is none, it returns the time the next job of
+// these queues becomes due or the zero time.
+func (q *jobQueue) Lease(queues []string, lease time.Duration,
+	now time.Time) (*service.Job, time.Time, error) {
+	if lease <= 0 {
+		lease = defaultJobLease
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	jobs, err := q.list()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var next time.Time
+	for _, job := range jobs {
+		if !stringInSlice(job.Queue, queues) || job.Status == service.JobDead {
+			continue
+		}
+		if job.Status == service.JobRunning && !job.Next.After(now) {
+			q.fail(job, "Lease ended", now)
+			if err := q.write(job); err != nil {
+				return nil, time.Time{}, err
+			}
+			if job.Status == service.JobDead {
+				continue
+			}
+		}
+		if job.Next.After(now) {
+			if next.IsZero() || job.Next.Before(next) {
+				next = job.Next
+			}
+			continue
+		}
+		token, err := randomHex(8)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("Could not generate lease: %v", err)
+		}
+		job.Status = service.JobRunning
+		job.Attempts++
+		job.Lease = token
+		job.Next = now.Add(lease)
+		if err := q.write(job); err != nil {
+			return nil, time.Time{}, err
+		}
+		return job, time.Time{}, nil
+	}
+	return nil, next, nil
+}
+
+// Wait waits for a due job of the given queues and leases it.
+func (q *jobQueue) Wait(queues []string, lease time.Duration) (
+	*service.Job, error) {
+	for {
+		q.mutex.Lock()
+		changed := q.changed
+		q.mutex.Unlock()
+		now := time.Now().UTC()
+		job, next, err := q.Lease(queues, lease, now)
+		if err != nil || job != nil {
+			return job, err
+		}
+		delay := jobQueuePoll
+		if !next.IsZero() && next.Sub(now) < delay {
+			delay = next.Sub(now)
+		}
+		select {
+		case <-changed:
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Finish finishes the job leased with the given token. It removes the
+// job if there is no error.
+func (q *jobQueue) Finish(id, lease, jobErr string, now time.Time) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	job, err := q.read(id)
+	if err != nil {
+		return err
+	}
+	if job == nil || job.Status != service.JobRunning || job.Lease != lease {
+		return fmt.Errorf("Job %q is not leased by the worker", id)
+	}
+	if jobErr == "" {
+		if err := os.Remove(q.path(id)); err != nil {
+			return fmt.Errorf("Could not remove job: %v", err)
+		}
+		return nil
+	}
+	q.fail(job, jobErr, now)
+	if err := q.write(job); err != nil {
+		return err
+	}
+	q.notify()
+	return nil
+}
+
+// Retry queues a dead job for an immediate attempt.
+func (q *jobQueue) Retry(id string, now time.Time) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	job, err := q.read(id)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return fmt.Errorf("Unknown job %q", id)
+	}
+	if job.Status != service.JobDead {
+		return fmt.Errorf("Job %q is not dead", id)
+	}
+	job.Status = service.JobQueued
+	job.Attempts = 0
+	job.Next = now
+	if err := q.write(job); err != nil {
+		return err
+	}
+	q.notify()
+	return nil
+}
+
+// Remove removes the job from the queue.
+func (q *jobQueue) Remove(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if err := os.Remove(q.path(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Could not remove job: %v", err)
+	}
+	return nil
+}
+
+// countJobs returns the number of queued, running and dead jobs.
+func countJobs(jobs []*service.Job) (queued, running, dead int) {
+	for _, job := range jobs {
+		switch job.Status {
+		case service.JobQueued:
+			queued++
+		case service.JobRunning:
+			running++
+		default:
+			dead++
+		}
+	}
+	return
+}
+
+func (m *MonstiService) EnqueueJob(job *service.NewJob, reply *string) error {
+	id, err := m.jobs.Add(job, time.Now().UTC())
+	*reply = id
+	return err
+}
+
+type WaitJobArgs struct {
+	Queues []string
+	Lease  time.Duration
+}
+
+func (m *MonstiService) WaitJob(args *WaitJobArgs, reply *service.Job) error {
+	job, err := m.jobs.Wait(args.Queues, args.Lease)
+	if err != nil {
+		return err
+	}
+	*reply = *job
+	return nil
+}
+
+type FinishJobArgs struct {
+	Id, Lease, Error string
+}
+
+func (m *MonstiService) FinishJob(args *FinishJobArgs, reply *int) error {
+	return m.jobs.Finish(args.Id, args.Lease, args.Error, time.Now().UTC())
+}
+
+func (m *MonstiService) GetJobQueue(args int, reply *[]*service.Job) error {
+	jobs, err := m.jobs.List()
+	*reply = jobs
+	return err
+}
+
+func (m *MonstiService) RetryJob(id string, reply *int) error {
+	return m.jobs.Retry(id, time.Now().UTC())
+}
+
+func (m *MonstiService) RemoveJob(id string, reply *int) error {
+	return m.jobs.Remove(id)
+}
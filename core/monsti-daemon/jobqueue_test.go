@@ -0,0 +1,145 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestJobQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-job-queue")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	queue := &jobQueue{Dir: dir, Attempts: 2, Backoff: time.Minute,
+		Log: log.New(ioutil.Discard, "", 0), changed: make(chan struct{})}
+	now := time.Date(2014, 6, 14, 10, 30, 0, 0, time.UTC)
+	lease := func(step string, queues []string, at time.Time) *service.Job {
+		job, _, err := queue.Lease(queues, time.Minute, at)
+		if err != nil {
+			t.Fatalf("%v: Lease returned error: %v", step, err)
+		}
+		return job
+	}
+	if _, err := queue.Add(&service.NewJob{}, now); err == nil {
+		t.Errorf("Add should fail for jobs without queue")
+	}
+	transcode, err := queue.Add(&service.NewJob{Queue: "transcode",
+		Site: "example", Data: []byte("video.mp4")}, now)
+	if err != nil {
+		t.Fatalf("Could not add job: %v", err)
+	}
+	if _, err := queue.Add(&service.NewJob{Queue: "mail", Attempts: 1,
+		Delay: time.Hour}, now); err != nil {
+		t.Fatalf("Could not add job: %v", err)
+	}
+
+	job := lease("first", []string{"transcode"}, now)
+	if job == nil || job.Id != transcode || string(job.Data) != "video.mp4" ||
+		job.Site != "example" || job.Attempts != 1 {
+		t.Fatalf("Leased job is %v, should be %v", job, transcode)
+	}
+	if other := lease("leased", []string{"transcode"}, now); other != nil {
+		t.Errorf("Leased jobs should not get leased again")
+	}
+	if _, next, _ := queue.Lease([]string{"mail"}, 0, now); !next.Equal(
+		now.Add(time.Hour)) {
+		t.Errorf("Next job of delayed queue is due at %v, should be %v", next,
+			now.Add(time.Hour))
+	}
+
+	// Ended lease
+	second := lease("ended lease", []string{"transcode"}, now.Add(time.Minute))
+	if second != nil {
+		t.Errorf("Jobs with ended lease should wait for the backoff")
+	}
+	if err := queue.Finish(job.Id, job.Lease, "", now); err == nil {
+		t.Errorf("Finish should fail for ended leases")
+	}
+	second = lease("retry", []string{"transcode"}, now.Add(2*time.Minute))
+	if second == nil || second.Attempts != 2 || second.Error != "Lease ended" {
+		t.Fatalf("Second lease is %v", second)
+	}
+
+	// Dead letters
+	if err := queue.Finish(second.Id, second.Lease, "boom",
+		now.Add(2*time.Minute)); err != nil {
+		t.Fatalf("Could not finish job: %v", err)
+	}
+	jobs, err := queue.List()
+	if err != nil {
+		t.Fatalf("Could not list jobs: %v", err)
+	}
+	if queued, running, dead := countJobs(jobs); queued != 1 || running != 0 ||
+		dead != 1 {
+		t.Errorf("countJobs returned %v, %v, %v, should be 1, 0, 1", queued,
+			running, dead)
+	}
+	for _, job := range jobs {
+		if job.Id == transcode && (job.Status != service.JobDead ||
+			job.Error != "boom") {
+			t.Errorf("Job is %v, should be dead", job)
+		}
+	}
+	if job := lease("dead", []string{"transcode"},
+		now.Add(time.Hour)); job != nil {
+		t.Errorf("Dead jobs should not get leased")
+	}
+	if err := queue.Retry(transcode, now.Add(time.Hour)); err != nil {
+		t.Fatalf("Could not retry job: %v", err)
+	}
+	job = lease("retried", []string{"transcode"}, now.Add(time.Hour))
+	if job == nil || job.Attempts != 1 {
+		t.Fatalf("Retried job is %v", job)
+	}
+	if err := queue.Finish(job.Id, job.Lease, "", now); err != nil {
+		t.Fatalf("Could not finish job: %v", err)
+	}
+	if jobs, _ := queue.List(); len(jobs) != 1 || jobs[0].Queue != "mail" {
+		t.Errorf("Finished jobs should get removed, got %v", jobs)
+	}
+
+	// Waiting workers
+	ret := make(chan *service.Job)
+	go func() {
+		job, err := queue.Wait([]string{"thumbnail"}, time.Minute)
+		if err != nil {
+			t.Errorf("Wait returned error: %v", err)
+		}
+		ret <- job
+	}()
+	thumbnail, err := queue.Add(&service.NewJob{Queue: "thumbnail"},
+		time.Now().UTC())
+	if err != nil {
+		t.Fatalf("Could not add job: %v", err)
+	}
+	select {
+	case job := <-ret:
+		if job == nil || job.Id != thumbnail {
+			t.Errorf("Wait returned %v, should be %v", job, thumbnail)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Wait did not return the added job")
+	}
+}
@@ -0,0 +1,73 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"sync"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// maxLogEntries is the number of log entries kept for GetLog.
+const maxLogEntries = 1000
+
+// logBuffer keeps the latest lines written to it.
+type logBuffer struct {
+	mutex   sync.Mutex
+	entries []*service.LogEntry
+	// seq is the sequence number of the last entry.
+	seq int
+}
+
+// Write adds each line of p as an entry.
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		b.seq++
+		b.entries = append(b.entries, &service.LogEntry{Seq: b.seq,
+			Line: string(line)})
+	}
+	if len(b.entries) > maxLogEntries {
+		b.entries = b.entries[len(b.entries)-maxLogEntries:]
+	}
+	return len(p), nil
+}
+
+// since returns the kept entries after the one with the given
+// sequence number.
+func (b *logBuffer) since(seq int) []*service.LogEntry {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	entries := make([]*service.LogEntry, 0)
+	for _, entry := range b.entries {
+		if entry.Seq > seq {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func (i *MonstiService) GetLog(after int, reply *[]*service.LogEntry) error {
+	if i.logs == nil {
+		*reply = make([]*service.LogEntry, 0)
+		return nil
+	}
+	*reply = i.logs.since(after)
+	return nil
+}
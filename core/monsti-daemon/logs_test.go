@@ -0,0 +1,48 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestLogBuffer(t *testing.T) {
+	var logs logBuffer
+	for i := 0; i < maxLogEntries; i++ {
+		fmt.Fprintf(&logs, "line %v\n", i)
+	}
+	logs.Write([]byte("first\nsecond\n"))
+	if entries := logs.since(-1); len(entries) != maxLogEntries ||
+		entries[0].Seq != 3 || entries[0].Line != "line 2" {
+		t.Errorf("since(-1) returned %v entries starting with %v, should "+
+			"keep the latest %v", len(entries), entries[0], maxLogEntries)
+	}
+	lines := make([]string, 0)
+	for _, entry := range logs.since(maxLogEntries) {
+		lines = append(lines, entry.Line)
+	}
+	if expected := []string{"first", "second"}; !reflect.DeepEqual(lines,
+		expected) {
+		t.Errorf("since(%v) returned %v, should be %v", maxLogEntries, lines,
+			expected)
+	}
+	if entries := logs.since(logs.seq); len(entries) != 0 {
+		t.Errorf("since(%v) returned %v, should be empty", logs.seq, entries)
+	}
+}
@@ -0,0 +1,96 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// mailContentHeaders are the header fields describing the content of
+// a message. They get moved to the first part if files are attached.
+var mailContentHeaders = []string{"Mime-Version", "Content-Type",
+	"Content-Transfer-Encoding", "Content-Disposition"}
+
+// attachFiles returns the message as multipart/mixed message with the
+// original body as first part followed by the attachments. The
+// returned message uses CRLF line endings.
+func attachFiles(message []byte, attachments []service.MailAttachment) (
+	[]byte, error) {
+	fields, body := splitMessage(crlfMessage(message))
+	var header bytes.Buffer
+	textHeader := make(textproto.MIMEHeader)
+	for _, field := range fields {
+		isContent := false
+		for _, name := range mailContentHeaders {
+			isContent = isContent ||
+				strings.EqualFold(strings.TrimSpace(field.Name), name)
+		}
+		if !isContent {
+			header.WriteString(field.Name + ":" + field.Value + "\r\n")
+		} else if !strings.EqualFold(strings.TrimSpace(field.Name),
+			"Mime-Version") {
+			textHeader.Set(strings.TrimSpace(field.Name), strings.TrimSpace(
+				strings.Replace(field.Value, "\r\n", "", -1)))
+		}
+	}
+	if textHeader.Get("Content-Type") == "" {
+		textHeader.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	var parts bytes.Buffer
+	writer := multipart.NewWriter(&parts)
+	part, err := writer.CreatePart(textHeader)
+	if err != nil {
+		return nil, err
+	}
+	part.Write(body)
+	for _, attachment := range attachments {
+		fileType := attachment.Type
+		if fileType == "" {
+			fileType = "application/octet-stream"
+		}
+		params := map[string]string{"filename": attachment.Name}
+		fileHeader := make(textproto.MIMEHeader)
+		fileHeader.Set("Content-Type", fileType)
+		fileHeader.Set("Content-Disposition",
+			mime.FormatMediaType("attachment", params))
+		fileHeader.Set("Content-Transfer-Encoding", "base64")
+		if part, err = writer.CreatePart(fileHeader); err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(attachment.Content)
+		for len(encoded) > 76 {
+			part.Write([]byte(encoded[:76] + "\r\n"))
+			encoded = encoded[76:]
+		}
+		part.Write([]byte(encoded + "\r\n"))
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	header.WriteString("Mime-Version: 1.0\r\n")
+	header.WriteString("Content-Type: " + mime.FormatMediaType(
+		"multipart/mixed", map[string]string{"boundary": writer.Boundary()}) +
+		"\r\n\r\n")
+	return append(header.Bytes(), parts.Bytes()...), nil
+}
@@ -0,0 +1,86 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestAttachFiles(t *testing.T) {
+	message := []byte("From: site@example.com\nSubject: Application\n" +
+		"Mime-Version: 1.0\nContent-Type: text/plain;\n charset=utf-8\n" +
+		"Content-Transfer-Encoding: quoted-printable\n\nHello=21\n")
+	content := bytes.Repeat([]byte{0, 1, 2, 3}, 100)
+	attached, err := attachFiles(message, []service.MailAttachment{
+		{Name: "cv.pdf", Type: "application/pdf", Content: content}})
+	if err != nil {
+		t.Fatalf("attachFiles returned error: %v", err)
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(attached))
+	if err != nil {
+		t.Fatalf("Could not parse message: %v", err)
+	}
+	if subject := parsed.Header.Get("Subject"); subject != "Application" {
+		t.Errorf("Subject is %q, should be %q", subject, "Application")
+	}
+	mediaType, params, err := mime.ParseMediaType(
+		parsed.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Content-Type is %q, should be multipart/mixed",
+			parsed.Header.Get("Content-Type"))
+	}
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	part, err := reader.NextPart()
+	if err != nil {
+		t.Fatalf("Could not read text part: %v", err)
+	}
+	// The reader decodes quoted-printable parts.
+	text, _ := ioutil.ReadAll(part)
+	if part.Header.Get("Content-Type") != "text/plain; charset=utf-8" ||
+		string(text) != "Hello!\r\n" {
+		t.Errorf("Text part is %v %q", part.Header, text)
+	}
+	if part, err = reader.NextPart(); err != nil {
+		t.Fatalf("Could not read attachment: %v", err)
+	}
+	if part.FileName() != "cv.pdf" ||
+		part.Header.Get("Content-Type") != "application/pdf" {
+		t.Errorf("Attachment header is %v", part.Header)
+	}
+	encoded, _ := ioutil.ReadAll(part)
+	decoded, err := base64.StdEncoding.DecodeString(
+		string(bytes.Replace(encoded, []byte("\r\n"), nil, -1)))
+	if err != nil || !bytes.Equal(decoded, content) {
+		t.Errorf("Attachment content is %q, should be %q", decoded, content)
+	}
+	for _, line := range bytes.Split(encoded, []byte("\r\n")) {
+		if len(line) > 76 {
+			t.Errorf("Attachment line is longer than 76 characters: %q", line)
+		}
+	}
+	if _, err = reader.NextPart(); err == nil {
+		t.Errorf("Message should have two parts")
+	}
+}
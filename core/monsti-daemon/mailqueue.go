@@ -0,0 +1,521 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chrneumann/mimemail"
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// mailQueueSettings configures the outgoing mail queue.
+type mailQueueSettings struct {
+	// Directory holds the queued mails. Defaults to .mail-queue in the
+	// data directory.
+	Directory string
+	// Attempts is the number of delivery attempts before a mail fails.
+	// Defaults to 10.
+	Attempts int
+	// Backoff is the delay after the first failed attempt, e.g. "1m".
+	// It doubles with each further attempt up to 24 hours. Defaults to
+	// one minute.
+	Backoff string
+	// Keep is the time sent mails are kept to receive bounces, e.g.
+	// "72h". Defaults to one week.
+	Keep string
+	// ReturnPath is the envelope sender of the mails, e.g.
+	// "bounces+{id}@example.com". {id} gets replaced by the mail's queue
+	// id. Defaults to the sender of the mail. Sites may configure their
+	// own return path.
+	ReturnPath string
+}
+
+const (
+	defaultMailAttempts = 10
+	defaultMailBackoff  = time.Minute
+	maxMailBackoff      = 24 * time.Hour
+	defaultMailKeep     = 7 * 24 * time.Hour
+	// mailQueuePoll is the interval between scans of the queue
+	// directory, which may get mails added by other processes.
+	mailQueuePoll = 30 * time.Second
+)
+
+// mailQueue delivers mails with retries. The queue is stored in a
+// directory with a JSON file per mail. The contents of attachments are
+// stored beside in a directory per mail, see attachmentPath.
+type mailQueue struct {
+	Dir      string
+	Attempts int
+	Backoff  time.Duration
+	Keep     time.Duration
+	// Deliver sends the queued mail.
+	Deliver func(mail *service.QueuedMail) error
+	Log     *log.Logger
+	mutex   sync.Mutex
+	wake    chan struct{}
+}
+
+// newMailQueue returns the mail queue configured by the settings.
+func newMailQueue(settings *settings, deliver func(*service.QueuedMail) error,
+	logger *log.Logger) (*mailQueue, error) {
+	config := settings.Mail.Queue
+	queue := &mailQueue{
+		Dir:      config.Directory,
+		Attempts: config.Attempts,
+		Backoff:  defaultMailBackoff,
+		Keep:     defaultMailKeep,
+		Deliver:  deliver,
+		Log:      logger,
+		wake:     make(chan struct{}, 1)}
+	if queue.Dir == "" {
+		queue.Dir = filepath.Join(settings.Monsti.Directories.Data, ".mail-queue")
+	}
+	if queue.Attempts <= 0 {
+		queue.Attempts = defaultMailAttempts
+	}
+	var err error
+	if config.Backoff != "" {
+		if queue.Backoff, err = time.ParseDuration(config.Backoff); err != nil {
+			return nil, fmt.Errorf("Invalid mail queue backoff: %v", err)
+		}
+	}
+	if config.Keep != "" {
+		if queue.Keep, err = time.ParseDuration(config.Keep); err != nil {
+			return nil, fmt.Errorf("Invalid mail queue keep time: %v", err)
+		}
+	}
+	if err := os.MkdirAll(queue.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("Could not create mail queue directory: %v", err)
+	}
+	return queue, nil
+}
+
+// mailIdRegexp matches the ids of queued mails, i.e. the queue time
+// in nanoseconds and a random hex string.
+var mailIdRegexp = regexp.MustCompile(`^[0-9]+-[0-9a-f]{8}$`)
+
+// validMailId returns true iff id may be the id of a queued mail, i.e.
+// if it can't point outside of the queue directory.
+func validMailId(id string) bool {
+	return mailIdRegexp.MatchString(id)
+}
+
+// path returns the path to the file of the queued mail. The id must
+// be valid, see validMailId.
+func (q *mailQueue) path(id string) string {
+	return filepath.Join(q.Dir, id+".json")
+}
+
+// attachmentPath returns the path to the content of the queued mail's
+// attachment of the given index. The id must be valid.
+func (q *mailQueue) attachmentPath(id string, index int) string {
+	return filepath.Join(q.Dir, id+".attachments", strconv.Itoa(index))
+}
+
+// readAttachments returns the attachments of the queued mail including
+// their contents.
+func (q *mailQueue) readAttachments(mail *service.QueuedMail) (
+	[]service.MailAttachment, error) {
+	attachments := make([]service.MailAttachment, len(mail.Attachments))
+	for i, attachment := range mail.Attachments {
+		if attachment.Content == nil {
+			content, err := ioutil.ReadFile(q.attachmentPath(mail.Id, i))
+			if err != nil {
+				return nil, fmt.Errorf("Could not read attachment: %v", err)
+			}
+			attachment.Content = content
+		}
+		attachments[i] = attachment
+	}
+	return attachments, nil
+}
+
+// read returns the queued mail with the given id or nil if there is
+// no such mail. The contents of the mail's attachments are not read,
+// see readAttachments.
+func (q *mailQueue) read(id string) (*service.QueuedMail, error) {
+	if !validMailId(id) {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(q.path(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Could not read queued mail: %v", err)
+	}
+	mail := new(service.QueuedMail)
+	if err := json.Unmarshal(content, mail); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal queued mail %q: %v", id, err)
+	}
+	return mail, nil
+}
+
+// write stores the queued mail. Given contents of attachments get
+// written to their own files.
+func (q *mailQueue) write(mail *service.QueuedMail) error {
+	if !validMailId(mail.Id) {
+		return fmt.Errorf("Invalid queued mail id %q", mail.Id)
+	}
+	stored := *mail
+	stored.Attachments = make([]service.MailAttachment, len(mail.Attachments))
+	for i, attachment := range mail.Attachments {
+		if attachment.Content != nil {
+			path := q.attachmentPath(mail.Id, i)
+			if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				return fmt.Errorf("Could not create attachment directory: %v", err)
+			}
+			if err := ioutil.WriteFile(path, attachment.Content, 0600); err != nil {
+				return fmt.Errorf("Could not write attachment: %v", err)
+			}
+			attachment.Content = nil
+		}
+		stored.Attachments[i] = attachment
+	}
+	content, err := json.Marshal(&stored)
+	if err != nil {
+		return fmt.Errorf("Could not marshal queued mail: %v", err)
+	}
+	tmp := q.path(mail.Id) + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return fmt.Errorf("Could not write queued mail: %v", err)
+	}
+	if err := os.Rename(tmp, q.path(mail.Id)); err != nil {
+		return fmt.Errorf("Could not write queued mail: %v", err)
+	}
+	return nil
+}
+
+// Add queues the mail of the given site for immediate delivery. The
+// site may be empty for mails not sent by a site.
+func (q *mailQueue) Add(mail *mimemail.Mail, site string,
+	attachments []service.MailAttachment) (string, error) {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("Could not generate mail id: %v", err)
+	}
+	now := time.Now().UTC()
+	queued := &service.QueuedMail{
+		Id:          fmt.Sprintf("%d-%s", now.UnixNano(), hex.EncodeToString(id)),
+		Site:        site,
+		Mail:        *mail,
+		Attachments: attachments,
+		Status:      service.MailQueued,
+		Queued:      now,
+		Next:        now}
+	q.mutex.Lock()
+	err := q.write(queued)
+	q.mutex.Unlock()
+	if err != nil {
+		return "", err
+	}
+	q.Wake()
+	return queued.Id, nil
+}
+
+// Wake makes the queue process due mails now.
+func (q *mailQueue) Wake() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+type queuedMailsByTime []*service.QueuedMail
+
+func (s queuedMailsByTime) Len() int      { return len(s) }
+func (s queuedMailsByTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s queuedMailsByTime) Less(i, j int) bool {
+	return s[i].Queued.Before(s[j].Queued) ||
+		(s[i].Queued.Equal(s[j].Queued) && s[i].Id < s[j].Id)
+}
+
+// List returns the queued mails, oldest first.
+func (q *mailQueue) List() ([]*service.QueuedMail, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.list()
+}
+
+func (q *mailQueue) list() ([]*service.QueuedMail, error) {
+	files, err := ioutil.ReadDir(q.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read mail queue: %v", err)
+	}
+	mails := make([]*service.QueuedMail, 0, len(files))
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		id := strings.TrimSuffix(file.Name(), ".json")
+		mail, err := q.read(id)
+		if err != nil {
+			// Don't let a broken file stop the delivery of other mails.
+			q.Log.Printf("Moving broken queued mail %v aside: %v", id, err)
+			if err := os.Rename(q.path(id), q.path(id)+".broken"); err != nil {
+				q.Log.Printf("Could not move broken queued mail: %v", err)
+			}
+			continue
+		}
+		if mail != nil {
+			mails = append(mails, mail)
+		}
+	}
+	sort.Sort(queuedMailsByTime(mails))
+	return mails, nil
+}
+
+// update calls fn with the queued mail with the given id and writes
+// the changed mail. It fails if there is no such mail or if site is
+// not empty and the mail belongs to another site.
+func (q *mailQueue) update(site, id string,
+	fn func(mail *service.QueuedMail)) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	mail, err := q.read(id)
+	if err != nil {
+		return err
+	}
+	if mail == nil || (site != "" && mail.Site != site) {
+		return fmt.Errorf("Unknown queued mail %q", id)
+	}
+	fn(mail)
+	return q.write(mail)
+}
+
+// Retry queues a failed or bounced mail of the site for immediate
+// delivery. An empty site allows mails of any site.
+func (q *mailQueue) Retry(site, id string) error {
+	err := q.update(site, id, func(mail *service.QueuedMail) {
+		mail.Status = service.MailQueued
+		mail.Attempts = 0
+		mail.Next = time.Now().UTC()
+	})
+	if err == nil {
+		q.Wake()
+	}
+	return err
+}
+
+// Bounce marks the mail as bounced for the given reason.
+func (q *mailQueue) Bounce(id, reason string) error {
+	return q.update("", id, func(mail *service.QueuedMail) {
+		mail.Status = service.MailBounced
+		mail.Error = reason
+	})
+}
+
+// Remove removes the mail of the site from the queue. An empty site
+// allows mails of any site.
+func (q *mailQueue) Remove(site, id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	mail, err := q.read(id)
+	if err != nil {
+		return err
+	}
+	if mail == nil || (site != "" && mail.Site != site) {
+		return fmt.Errorf("Unknown queued mail %q", id)
+	}
+	return q.remove(id)
+}
+
+// remove removes the mail's file. The queue must be locked.
+func (q *mailQueue) remove(id string) error {
+	if !validMailId(id) {
+		return fmt.Errorf("Invalid queued mail id %q", id)
+	}
+	if err := os.Remove(q.path(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Could not remove queued mail: %v", err)
+	}
+	if err := os.RemoveAll(filepath.Join(q.Dir, id+".attachments")); err != nil {
+		return fmt.Errorf("Could not remove attachments: %v", err)
+	}
+	return nil
+}
+
+// backoff returns the delay after the given number of failed
+// attempts.
+func (q *mailQueue) backoff(attempts int) time.Duration {
+	delay := q.Backoff
+	for i := 1; i < attempts && delay < maxMailBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxMailBackoff {
+		delay = maxMailBackoff
+	}
+	return delay
+}
+
+// deliver attempts to deliver the mail and records the result.
+func (q *mailQueue) deliver(mail *service.QueuedMail, now time.Time) error {
+	sending := *mail
+	attachments, sendErr := q.readAttachments(mail)
+	if sendErr == nil {
+		sending.Attachments = attachments
+		sendErr = q.Deliver(&sending)
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if current, err := q.read(mail.Id); err != nil || current == nil ||
+		current.Status != service.MailQueued {
+		// The mail has been removed or changed while being delivered.
+		return err
+	}
+	mail.Attempts++
+	switch {
+	case sendErr == nil:
+		mail.Status = service.MailSent
+		mail.Sent = now
+		mail.Error = ""
+	case isPermanentMailError(sendErr) || mail.Attempts >= q.Attempts:
+		mail.Status = service.MailFailed
+		mail.Error = sendErr.Error()
+		q.Log.Printf("Could not deliver mail %v: %v", mail.Id, sendErr)
+	default:
+		mail.Next = now.Add(q.backoff(mail.Attempts))
+		mail.Error = sendErr.Error()
+	}
+	return q.write(mail)
+}
+
+// Process delivers the due mails and removes sent mails older than
+// the keep time. It returns the time of the next delivery attempt or
+// the zero time if no mails are queued.
+func (q *mailQueue) Process(now time.Time) (time.Time, error) {
+	mails, err := q.List()
+	if err != nil {
+		return time.Time{}, err
+	}
+	var next time.Time
+	for _, mail := range mails {
+		switch mail.Status {
+		case service.MailQueued:
+			if !mail.Next.After(now) {
+				if err := q.deliver(mail, now); err != nil {
+					return time.Time{}, err
+				}
+			}
+			if mail.Status == service.MailQueued &&
+				(next.IsZero() || mail.Next.Before(next)) {
+				next = mail.Next
+			}
+		case service.MailSent:
+			if mail.Sent.Add(q.Keep).Before(now) {
+				q.mutex.Lock()
+				err := q.remove(mail.Id)
+				q.mutex.Unlock()
+				if err != nil {
+					return time.Time{}, err
+				}
+			}
+		}
+	}
+	return next, nil
+}
+
+// Run processes the queue until the program exits.
+func (q *mailQueue) Run() {
+	for {
+		now := time.Now().UTC()
+		next, err := q.Process(now)
+		if err != nil {
+			q.Log.Printf("Could not process mail queue: %v", err)
+		}
+		delay := mailQueuePoll
+		if !next.IsZero() && next.Sub(now) < delay {
+			delay = next.Sub(now)
+		}
+		select {
+		case <-q.wake:
+		case <-time.After(delay):
+		}
+	}
+}
+
+// envelopeSender returns the envelope sender of the queued mail,
+// which is the return path of the mail's site or of the queue with
+// {id} replaced by the mail's id. Defaults to the sender of the mail.
+func envelopeSender(settings *settings, mail *service.QueuedMail) string {
+	returnPath := settings.Mail.Queue.ReturnPath
+	if site, ok := settings.Monsti.Sites[mail.Site]; ok &&
+		site.ReturnPath != "" {
+		returnPath = site.ReturnPath
+	}
+	if returnPath == "" {
+		return mail.Mail.Sender()
+	}
+	return strings.Replace(returnPath, "{id}", mail.Id, -1)
+}
+
+// countMails returns the number of queued, sent and failed or bounced
+// mails.
+func countMails(mails []*service.QueuedMail) (queued, sent, failed int) {
+	for _, mail := range mails {
+		switch mail.Status {
+		case service.MailQueued:
+			queued++
+		case service.MailSent:
+			sent++
+		default:
+			failed++
+		}
+	}
+	return
+}
+
+func (m *MonstiService) GetMailQueue(args int,
+	reply *[]*service.QueuedMail) error {
+	mails, err := m.mails.List()
+	*reply = mails
+	return err
+}
+
+type ReportMailBounceArgs struct {
+	Id, Reason string
+}
+
+func (m *MonstiService) ReportMailBounce(args *ReportMailBounceArgs,
+	reply *int) error {
+	return m.mails.Bounce(args.Id, args.Reason)
+}
+
+type QueuedMailArgs struct {
+	Site, Id string
+}
+
+func (m *MonstiService) RetryMail(args *QueuedMailArgs, reply *int) error {
+	return m.mails.Retry(args.Site, args.Id)
+}
+
+func (m *MonstiService) RemoveMail(args *QueuedMailArgs, reply *int) error {
+	return m.mails.Remove(args.Site, args.Id)
+}
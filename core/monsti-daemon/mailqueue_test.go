@@ -0,0 +1,264 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrneumann/mimemail"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestMailQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-mail-queue")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	replies := map[string]error{
+		"ok":        nil,
+		"temporary": &textproto.Error{Code: 451, Msg: "Try again later"},
+		"permanent": &textproto.Error{Code: 550, Msg: "No such user"},
+		"offline":   errors.New("connection refused"),
+	}
+	sites := make(map[string]string)
+	queue := &mailQueue{Dir: dir, Attempts: 2, Backoff: time.Minute,
+		Keep: time.Hour, Log: log.New(ioutil.Discard, "", 0),
+		wake: make(chan struct{}, 1),
+		Deliver: func(mail *service.QueuedMail) error {
+			sites[mail.Mail.Subject] = mail.Site
+			return replies[mail.Mail.Subject]
+		}}
+	ids := make(map[string]string)
+	for _, subject := range []string{"ok", "temporary", "permanent",
+		"offline"} {
+		id, err := queue.Add(&mimemail.Mail{Subject: subject}, "example", nil)
+		if err != nil {
+			t.Fatalf("Could not add mail: %v", err)
+		}
+		ids[subject] = id
+	}
+	now := time.Now().UTC()
+	next, err := queue.Process(now)
+	if err != nil {
+		t.Fatalf("Could not process queue: %v", err)
+	}
+	if !next.Equal(now.Add(time.Minute)) {
+		t.Errorf("Next attempt is at %v, should be %v", next,
+			now.Add(time.Minute))
+	}
+	if sites["ok"] != "example" {
+		t.Errorf("Site of delivered mail is %q, should be %q", sites["ok"],
+			"example")
+	}
+	check := func(step string, expected map[string]string) {
+		mails, err := queue.List()
+		if err != nil {
+			t.Fatalf("Could not list queue: %v", err)
+		}
+		statuses := make(map[string]string)
+		for _, mail := range mails {
+			statuses[mail.Mail.Subject] = mail.Status
+		}
+		if len(statuses) != len(expected) {
+			t.Errorf("%v: Queue is %v, should be %v", step, statuses, expected)
+		}
+		for subject, status := range expected {
+			if statuses[subject] != status {
+				t.Errorf("%v: Status of %q is %q, should be %q", step, subject,
+					statuses[subject], status)
+			}
+		}
+	}
+	check("First attempt", map[string]string{
+		"ok":        service.MailSent,
+		"temporary": service.MailQueued,
+		"permanent": service.MailFailed,
+		"offline":   service.MailQueued})
+
+	replies["temporary"] = nil
+	if _, err := queue.Process(now.Add(30 * time.Second)); err != nil {
+		t.Fatalf("Could not process queue: %v", err)
+	}
+	check("Before next attempt", map[string]string{
+		"ok":        service.MailSent,
+		"temporary": service.MailQueued,
+		"permanent": service.MailFailed,
+		"offline":   service.MailQueued})
+
+	next, err = queue.Process(now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Could not process queue: %v", err)
+	}
+	if !next.IsZero() {
+		t.Errorf("Next attempt is at %v, should be none", next)
+	}
+	check("Second attempt", map[string]string{
+		"ok":        service.MailSent,
+		"temporary": service.MailSent,
+		"permanent": service.MailFailed,
+		"offline":   service.MailFailed})
+
+	if err := queue.Bounce(ids["ok"], "Mailbox full"); err != nil {
+		t.Fatalf("Could not bounce mail: %v", err)
+	}
+	if err := queue.Bounce("unknown", "Mailbox full"); err == nil {
+		t.Errorf("Bounce should fail for unknown mails")
+	}
+	replies["offline"] = nil
+	if err := queue.Retry("other", ids["offline"]); err == nil {
+		t.Errorf("Retry should fail for mails of other sites")
+	}
+	if err := queue.Retry("example", ids["offline"]); err != nil {
+		t.Fatalf("Could not retry mail: %v", err)
+	}
+	if err := queue.Remove("other", ids["permanent"]); err == nil {
+		t.Errorf("Remove should fail for mails of other sites")
+	}
+	if err := queue.Remove("", "../../users"); err == nil {
+		t.Errorf("Remove should fail for invalid ids")
+	}
+	if err := queue.write(&service.QueuedMail{Id: "../../users"}); err == nil {
+		t.Errorf("write should fail for invalid ids")
+	}
+	if err := queue.Remove("example", ids["permanent"]); err != nil {
+		t.Fatalf("Could not remove mail: %v", err)
+	}
+	broken := filepath.Join(dir, "1-0badf00d.json")
+	if err := ioutil.WriteFile(broken, []byte("{"), 0600); err != nil {
+		t.Fatalf("Could not write broken mail: %v", err)
+	}
+	if _, err := queue.Process(now.Add(time.Minute)); err != nil {
+		t.Fatalf("Could not process queue: %v", err)
+	}
+	check("Retry", map[string]string{
+		"ok":        service.MailBounced,
+		"temporary": service.MailSent,
+		"offline":   service.MailSent})
+	if _, err := os.Stat(broken + ".broken"); err != nil {
+		t.Errorf("Broken mail should have been moved aside: %v", err)
+	}
+
+	if _, err := queue.Process(now.Add(2 * time.Hour)); err != nil {
+		t.Fatalf("Could not process queue: %v", err)
+	}
+	check("Expired", map[string]string{"ok": service.MailBounced})
+}
+
+func TestMailQueueAttachments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-mail-queue")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	var delivered []service.MailAttachment
+	queue := &mailQueue{Dir: dir, Attempts: 2, Backoff: time.Minute,
+		Log: log.New(ioutil.Discard, "", 0), wake: make(chan struct{}, 1),
+		Deliver: func(mail *service.QueuedMail) error {
+			delivered = mail.Attachments
+			return nil
+		}}
+	attachments := []service.MailAttachment{
+		{Name: "invoice.pdf", Type: "application/pdf", Content: []byte("%PDF")}}
+	id, err := queue.Add(&mimemail.Mail{Subject: "Invoice"}, "example",
+		attachments)
+	if err != nil {
+		t.Fatalf("Could not add mail: %v", err)
+	}
+	entry, err := ioutil.ReadFile(queue.path(id))
+	if err != nil {
+		t.Fatalf("Could not read queued mail: %v", err)
+	}
+	if strings.Contains(string(entry), "JVBERg") {
+		t.Errorf("Queued mail should not contain the attachment: %s", entry)
+	}
+	content, err := ioutil.ReadFile(queue.attachmentPath(id, 0))
+	if err != nil || string(content) != "%PDF" {
+		t.Errorf("Attachment file contains %q (%v), should be %q", content, err,
+			"%PDF")
+	}
+	if _, err := queue.Process(time.Now().UTC()); err != nil {
+		t.Fatalf("Could not process queue: %v", err)
+	}
+	if len(delivered) != 1 || delivered[0].Name != "invoice.pdf" ||
+		string(delivered[0].Content) != "%PDF" {
+		t.Errorf("Delivered attachments are %v, should be %v", delivered,
+			attachments)
+	}
+	if _, err := os.Stat(queue.attachmentPath(id, 0)); err != nil {
+		t.Errorf("Attachment of sent mail should be kept: %v", err)
+	}
+	if err := queue.Remove("example", id); err != nil {
+		t.Fatalf("Could not remove mail: %v", err)
+	}
+	if _, err := os.Stat(filepath.Dir(queue.attachmentPath(id, 0))); !os.IsNotExist(err) {
+		t.Errorf("Attachments of removed mail should be removed: %v", err)
+	}
+}
+
+func TestEnvelopeSender(t *testing.T) {
+	settings := new(settings)
+	settings.Monsti.Sites = map[string]util.SiteSettings{
+		"example": {ReturnPath: "bounces+{id}@example.com"},
+		"other":   {}}
+	mail := &service.QueuedMail{Id: "42",
+		Mail: mimemail.Mail{From: mimemail.Address{Email: "foo@example.com"}}}
+	tests := []struct {
+		Site, Queue, Sender string
+	}{
+		{"example", "", "bounces+42@example.com"},
+		{"example", "queue@example.com", "bounces+42@example.com"},
+		{"other", "queue-{id}@example.com", "queue-42@example.com"},
+		{"", "", mail.Mail.Sender()},
+	}
+	for i, test := range tests {
+		mail.Site = test.Site
+		settings.Mail.Queue.ReturnPath = test.Queue
+		if sender := envelopeSender(settings, mail); sender != test.Sender {
+			t.Errorf("Test %v: envelopeSender(...) = %q, should be %q", i, sender,
+				test.Sender)
+		}
+	}
+}
+
+func TestMailQueueBackoff(t *testing.T) {
+	queue := &mailQueue{Backoff: time.Minute}
+	tests := []struct {
+		Attempts int
+		Delay    time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{20, maxMailBackoff},
+	}
+	for _, test := range tests {
+		if delay := queue.backoff(test.Attempts); delay != test.Delay {
+			t.Errorf("backoff(%v) = %v, should be %v", test.Attempts, delay,
+				test.Delay)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+
+	"github.com/chrneumann/mimemail"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// passwordTokenMail returns the mail sending the user a link to
+// change the password.
+func passwordTokenMail(site util.SiteSettings, G func(string) string,
+	user *service.User, link string) *mimemail.Mail {
+	mail := mimemail.Mail{
+		From:    mimemail.Address{site.EmailName, site.EmailAddress},
+		Subject: G("Password request"),
+		Body: []byte(fmt.Sprintf(`Hello,
+
+someone, possibly you, requested a new password for your account %v at
+"%v".
+
+To change your password, visit the following link within 24 hours.
+If you did not request a new password, you may ignore this email.
+%v
+
+This is an automatically generated email. Please don't reply to it.
+`, user.Login, site.Title, link))}
+	mail.To = []mimemail.Address{mimemail.Address{user.Login, user.Email}}
+	return &mail
+}
+
+// contactFormMail returns the mail delivering a contact form
+// submission to the site owner.
+//
+// The mail is sent from the site's address to pass sender
+// verification, replies go to the visitor.
+func contactFormMail(site util.SiteSettings, data contactFormData) *mimemail.Mail {
+	visitor := netmail.Address{Name: data.Name, Address: data.Email}
+	mail := mimemail.Mail{
+		From:    mimemail.Address{site.EmailName, site.EmailAddress},
+		Subject: data.Subject,
+		Body:    []byte(data.Message),
+		Headers: map[string][]string{"Reply-To": {visitor.String()}}}
+	owner := mimemail.Address{site.Owner.Name, site.Owner.Email}
+	mail.To = []mimemail.Address{owner}
+	return &mail
+}
+
+// mailTemplate is a mail sent by Monsti which may be previewed.
+type mailTemplate struct {
+	Id string
+	// Name is the untranslated name of the mail.
+	Name string
+	// Sample returns the mail filled with sample data.
+	Sample func(c *reqContext, h *nodeHandler) *mimemail.Mail
+}
+
+// mailTemplates are the mails which may be previewed.
+var mailTemplates = []mailTemplate{
+	{"password-token", "Password request",
+		func(c *reqContext, h *nodeHandler) *mimemail.Mail {
+			G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+			site := h.Settings.Monsti.Sites[c.Site.Name]
+			return passwordTokenMail(site, G, c.UserSession.User,
+				site.BaseURL+"/@@change-password?token=sample")
+		}},
+	{"invitation", "Invitation",
+		func(c *reqContext, h *nodeHandler) *mimemail.Mail {
+			G, _, _, _ := gettext.DefaultLocales.Use("", c.Site.Locale)
+			site := h.Settings.Monsti.Sites[c.Site.Name]
+			return invitationMail(site, G, &service.User{Login: "jane",
+				Name: "Jane Doe", Email: "jane@example.com"},
+				site.BaseURL+"/@@change-password?token=sample")
+		}},
+	{"quarantine", "Quarantined file reviewed",
+		func(c *reqContext, h *nodeHandler) *mimemail.Mail {
+			G, _, _, _ := gettext.DefaultLocales.Use("", c.Site.Locale)
+			return quarantineMail(h.Settings.Monsti.Sites[c.Site.Name], G,
+				c.UserSession.User, &quarantinedFile{Name: "sample.pdf",
+					Reason: "Sample.Virus"}, true)
+		}},
+	{"comment", "New comment",
+		func(c *reqContext, h *nodeHandler) *mimemail.Mail {
+			G, _, _, _ := gettext.DefaultLocales.Use("", c.Site.Locale)
+			return commentMail(h.Settings.Monsti.Sites[c.Site.Name], G, c.Node,
+				&comment{Name: "Jane Doe", Email: "jane@example.com",
+					Text: "This is a sample comment.", Status: commentPending})
+		}},
+	{"contact-form", "Contact form submission",
+		func(c *reqContext, h *nodeHandler) *mimemail.Mail {
+			return contactFormMail(h.Settings.Monsti.Sites[c.Site.Name],
+				contactFormData{
+					Name:    "Jane Doe",
+					Email:   "jane@example.com",
+					Subject: "Sample subject",
+					Message: "This is a sample message."})
+		}},
+	{"form-wizard", "Multi-step form submission",
+		func(c *reqContext, h *nodeHandler) *mimemail.Mail {
+			locales := []string{c.Site.Locale}
+			fields := []*service.NodeField{
+				{Id: "sample.Name", Type: "Text",
+					Name: util.GenLanguageMap("Name", locales)},
+				{Id: "sample.Message", Type: "Text",
+					Name: util.GenLanguageMap("Message", locales)},
+			}
+			values := service.Node{Type: &service.NodeType{Fields: fields}}
+			values.InitFields(nil, "")
+			*(values.GetField("sample.Name").(*service.TextField)) = "Jane Doe"
+			*(values.GetField("sample.Message").(*service.TextField)) =
+				"This is a sample message."
+			return formValuesMail(c, h, &values, fields)
+		}},
+	{"newsletter-confirm", "Newsletter subscription",
+		func(c *reqContext, h *nodeHandler) *mimemail.Mail {
+			G, _, _, _ := gettext.DefaultLocales.Use("", c.Site.Locale)
+			site := h.Settings.Monsti.Sites[c.Site.Name]
+			return newsletterConfirmMail(site, G, "jane@example.com",
+				site.BaseURL+"/@@newsletter?confirm=sample")
+		}},
+	{"newsletter", "Newsletter",
+		func(c *reqContext, h *nodeHandler) *mimemail.Mail {
+			G, _, _, _ := gettext.DefaultLocales.Use("", c.Site.Locale)
+			site := h.Settings.Monsti.Sites[c.Site.Name]
+			return newsletterMail(site, G, &newsletterSubscriber{
+				Email: "jane@example.com", Token: "sample"}, "Sample newsletter",
+				"Sample newsletter\n=================\n\nThis is a sample newsletter.\n",
+				site.BaseURL+"/sample/")
+		}},
+}
+
+// getMailTemplate returns the mail template with the given id or nil
+// if there is no such template.
+func getMailTemplate(id string) *mailTemplate {
+	for i := range mailTemplates {
+		if mailTemplates[i].Id == id {
+			return &mailTemplates[i]
+		}
+	}
+	return nil
+}
+
+// Mails shows previews of the mails sent by Monsti and sends test
+// mails to the logged in user.
+func (h *nodeHandler) Mails(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if err := c.Req.ParseForm(); err != nil {
+		return err
+	}
+	if c.Req.Method == "POST" && c.Req.Form.Get("queued") != "" {
+		id := c.Req.Form.Get("queued")
+		var err error
+		switch c.Req.Form.Get("queue-action") {
+		case "retry":
+			err = c.Serv.Monsti().RetryMail(c.Site.Name, id)
+		case "remove":
+			err = c.Serv.Monsti().RemoveMail(c.Site.Name, id)
+		default:
+			return fmt.Errorf("Unknown queue action: %q",
+				c.Req.Form.Get("queue-action"))
+		}
+		if err != nil {
+			return fmt.Errorf("Could not change queued mail: %v", err)
+		}
+		http.Redirect(c.Res, c.Req, "@@mails", http.StatusSeeOther)
+		return nil
+	}
+	queue, err := c.Serv.Monsti().GetMailQueue()
+	if err != nil {
+		return fmt.Errorf("Could not get mail queue: %v", err)
+	}
+	unsent := make([]*service.QueuedMail, 0)
+	var sentCount int
+	for _, mail := range queue {
+		switch {
+		case mail.Site != c.Site.Name:
+		case mail.Status == service.MailSent:
+			sentCount++
+		default:
+			unsent = append(unsent, mail)
+		}
+	}
+	context := template.Context{"Templates": mailTemplates, "Queue": unsent,
+		"SentCount": sentCount}
+	tmpl := getMailTemplate(c.Req.Form.Get("template"))
+	if tmpl != nil {
+		mail := tmpl.Sample(c, h)
+		switch c.Req.Method {
+		case "GET":
+			_, sent := c.Req.Form["sent"]
+			context["Sent"] = sent
+		case "POST":
+			user := c.UserSession.User
+			mail.To = []mimemail.Address{{user.Name, user.Email}}
+			mail.Cc, mail.Bcc = nil, nil
+			if err := c.Serv.Monsti().SendSiteMail(c.Site.Name, mail); err != nil {
+				return fmt.Errorf("Could not send test mail: %v", err)
+			}
+			http.Redirect(c.Res, c.Req, "@@mails?"+url.Values{
+				"template": {tmpl.Id}, "sent": {""}}.Encode(), http.StatusSeeOther)
+			return nil
+		default:
+			return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+		}
+		context["Template"] = tmpl
+		context["Mail"] = mail
+		context["Body"] = string(mail.Body)
+	}
+	body, err := h.Renderer.Render("actions/mails", context,
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render mail preview: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("Mails"),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
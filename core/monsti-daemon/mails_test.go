@@ -0,0 +1,68 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestMailTemplates(t *testing.T) {
+	site := util.SiteSettings{Name: "example", Title: "Example",
+		BaseURL: "http://example.com", EmailAddress: "site@example.com"}
+	site.Owner.Email = "owner@example.com"
+	h := &nodeHandler{Settings: &settings{}}
+	h.Settings.Monsti.Sites = map[string]util.SiteSettings{"example": site}
+	c := &reqContext{
+		Site: &site,
+		Node: &service.Node{Path: "/contact"},
+		UserSession: &service.UserSession{
+			User: &service.User{Login: "admin", Email: "admin@example.com"}},
+	}
+	ids := make(map[string]bool)
+	for _, tmpl := range mailTemplates {
+		if ids[tmpl.Id] {
+			t.Errorf("Duplicate mail template %q", tmpl.Id)
+		}
+		ids[tmpl.Id] = true
+		mail := tmpl.Sample(c, h)
+		if mail == nil || len(mail.To) == 0 || len(mail.Body) == 0 {
+			t.Errorf("Sample of %q is incomplete: %v", tmpl.Id, mail)
+		}
+		if getMailTemplate(tmpl.Id) == nil {
+			t.Errorf("getMailTemplate(%q) returned nil", tmpl.Id)
+		}
+	}
+	mail := getMailTemplate("password-token").Sample(c, h)
+	if !strings.Contains(string(mail.Body),
+		"http://example.com/@@change-password?token=sample") {
+		t.Errorf("Password token mail misses the link:\n%s", mail.Body)
+	}
+	if getMailTemplate("unknown") != nil {
+		t.Errorf(`getMailTemplate("unknown") should be nil`)
+	}
+	mail = getMailTemplate("contact-form").Sample(c, h)
+	replyTo := mail.Headers["Reply-To"]
+	if mail.From.Email != "site@example.com" || len(replyTo) != 1 ||
+		replyTo[0] != `"Jane Doe" <jane@example.com>` {
+		t.Errorf("Contact form mail is from %v, reply to %v, should be from "+
+			"the site and reply to the visitor", mail.From, replyTo)
+	}
+}
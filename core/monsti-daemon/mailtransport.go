@@ -0,0 +1,412 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// mailTransport delivers mails.
+type mailTransport interface {
+	// Send delivers the message to the recipients using the given
+	// envelope sender. Permanent failures are reported as
+	// permanentMailError or *textproto.Error with a 5xx code.
+	Send(from string, to []string, message []byte) error
+}
+
+// permanentMailError is a delivery failure which should not be
+// retried.
+type permanentMailError struct {
+	error
+}
+
+// isPermanentMailError returns true if the mail can't be delivered by
+// retrying, e.g. if the mail server rejected it with a 5xx reply.
+func isPermanentMailError(err error) bool {
+	switch err := err.(type) {
+	case permanentMailError:
+		return true
+	case *textproto.Error:
+		return err.Code >= 500
+	}
+	return false
+}
+
+// errMissingSMTPHost is returned by newMailTransport if no SMTP host
+// has been configured.
+var errMissingSMTPHost = errors.New("Missing SMTP host")
+
+// smtpDialTimeout limits connecting to SMTP servers, smtpSendTimeout
+// the whole conversation to send a mail.
+const (
+	smtpDialTimeout = time.Minute
+	smtpSendTimeout = 5 * time.Minute
+)
+
+// newMailTransport returns the transport configured by the settings.
+func newMailTransport(config util.MailTransport) (mailTransport, error) {
+	switch config.Type {
+	case "", "smtp":
+		if config.Host == "" {
+			return nil, errMissingSMTPHost
+		}
+		switch config.Security {
+		case "", "starttls", "ssl":
+		default:
+			return nil, fmt.Errorf("Unknown SMTP security %q", config.Security)
+		}
+		switch config.Auth {
+		case "", "plain", "login", "cram-md5":
+		default:
+			return nil, fmt.Errorf("Unknown SMTP authentication %q", config.Auth)
+		}
+		return &smtpTransport{config}, nil
+	case "sendmail":
+		command := config.Command
+		if len(command) == 0 {
+			command = []string{"/usr/sbin/sendmail", "-i"}
+		}
+		return &sendmailTransport{command}, nil
+	case "mailgun":
+		if config.URL == "" {
+			return nil, fmt.Errorf("Missing Mailgun API URL")
+		}
+		return &mailgunTransport{config}, nil
+	case "ses":
+		if config.Region == "" && config.URL == "" {
+			return nil, fmt.Errorf("Missing SES region")
+		}
+		return &sesTransport{config, time.Now}, nil
+	}
+	return nil, fmt.Errorf("Unknown mail transport %q", config.Type)
+}
+
+// mailTransport returns the transport of the given site's mails.
+func (s *settings) mailTransport(site string) (mailTransport, error) {
+	if siteSettings, ok := s.Monsti.Sites[site]; ok &&
+		siteSettings.MailTransport != nil {
+		return newMailTransport(*siteSettings.MailTransport)
+	}
+	config := s.Mail.Transport
+	if config.Type == "" && config.Host == "" {
+		config.Host = s.Mail.Host
+		config.Username = s.Mail.Username
+		config.Password = s.Mail.Password
+	}
+	return newMailTransport(config)
+}
+
+// smtpTransport sends mails to an SMTP server.
+type smtpTransport struct {
+	Config util.MailTransport
+}
+
+// loginAuth implements the LOGIN authentication mechanism.
+type loginAuth struct {
+	Username, Password string
+}
+
+func (a loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", nil, nil
+}
+
+func (a loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.Username), nil
+	case "password:":
+		return []byte(a.Password), nil
+	}
+	return nil, fmt.Errorf("Unexpected LOGIN challenge %q", fromServer)
+}
+
+// auth returns the configured authentication or nil if none is
+// configured.
+func (t *smtpTransport) auth(host string) smtp.Auth {
+	config := t.Config
+	if config.Username == "" {
+		return nil
+	}
+	switch config.Auth {
+	case "login":
+		return loginAuth{config.Username, config.Password}
+	case "cram-md5":
+		return smtp.CRAMMD5Auth(config.Username, config.Password)
+	}
+	return smtp.PlainAuth("", config.Username, config.Password, host)
+}
+
+func (t *smtpTransport) Send(from string, to []string, message []byte) error {
+	host, _, err := net.SplitHostPort(t.Config.Host)
+	if err != nil {
+		return fmt.Errorf("Invalid SMTP host %q: %v", t.Config.Host, err)
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+	dialer := &net.Dialer{Timeout: smtpDialTimeout}
+	var conn net.Conn
+	if t.Config.Security == "ssl" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", t.Config.Host, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", t.Config.Host)
+	}
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(smtpSendTimeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if t.Config.Security != "ssl" {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		} else if t.Config.Security == "starttls" {
+			return fmt.Errorf("SMTP server does not support STARTTLS")
+		}
+	}
+	if auth := t.auth(host); auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// sendmailTransport pipes mails to a local sendmail command.
+type sendmailTransport struct {
+	Command []string
+}
+
+// Exit codes of sendmail (see sysexits.h) for permanent failures.
+var sendmailPermanentCodes = map[int]bool{
+	65: true, // EX_DATAERR
+	67: true, // EX_NOUSER
+	68: true, // EX_NOHOST
+}
+
+func (t *sendmailTransport) Send(from string, to []string, message []byte) error {
+	args := append(append(t.Command[1:len(t.Command):len(t.Command)],
+		"-f", from, "--"), to...)
+	cmd := exec.Command(t.Command[0], args...)
+	cmd.Stdin = bytes.NewReader(message)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	permanent := false
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		status, ok := exitErr.Sys().(syscall.WaitStatus)
+		permanent = ok && sendmailPermanentCodes[status.ExitStatus()]
+	}
+	if output.Len() > 0 {
+		err = fmt.Errorf("%v: %v", err, strings.TrimSpace(output.String()))
+	}
+	if permanent {
+		return permanentMailError{err}
+	}
+	return err
+}
+
+// httpMailError returns the error for the response of a mail API. Client
+// errors except 429 Too Many Requests are permanent.
+func httpMailError(res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	err := fmt.Errorf("Mail API answered %v: %v", res.Status,
+		strings.TrimSpace(string(body)))
+	if res.StatusCode >= 400 && res.StatusCode < 500 &&
+		res.StatusCode != http.StatusTooManyRequests {
+		return permanentMailError{err}
+	}
+	return err
+}
+
+// mailAPIClient sends requests to mail APIs.
+var mailAPIClient = &http.Client{Timeout: time.Minute}
+
+// mailgunTransport sends mails using Mailgun's MIME message API.
+type mailgunTransport struct {
+	Config util.MailTransport
+}
+
+func (t *mailgunTransport) Send(from string, to []string, message []byte) error {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, recipient := range to {
+		writer.WriteField("to", recipient)
+	}
+	file, err := writer.CreateFormFile("message", "message.eml")
+	if err != nil {
+		return err
+	}
+	file.Write(message)
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", t.Config.URL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	username := t.Config.Username
+	if username == "" {
+		username = "api"
+	}
+	req.SetBasicAuth(username, t.Config.Password)
+	res, err := mailAPIClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return httpMailError(res)
+}
+
+// sesTransport sends raw mails using the v2 API of Amazon SES or
+// compatible services.
+type sesTransport struct {
+	Config util.MailTransport
+	// now returns the current time used to sign requests.
+	now func() time.Time
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of the data.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signAWSRequest signs the request with the given body using AWS
+// Signature Version 4.
+func signAWSRequest(req *http.Request, body []byte, region, service,
+	accessKey, secretKey string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	timestamp := now.Format("20060102T150405Z")
+	bodyHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", timestamp)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(bodyHash[:]))
+	signedHeaders := "content-type;host;x-amz-content-sha256;x-amz-date"
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{req.Method, path,
+		req.URL.RawQuery,
+		"content-type:" + req.Header.Get("Content-Type"),
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + hex.EncodeToString(bodyHash[:]),
+		"x-amz-date:" + timestamp, "",
+		signedHeaders, hex.EncodeToString(bodyHash[:])}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + timestamp + "\n" + scope + "\n" +
+		hex.EncodeToString(requestHash[:])
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+
+		"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func (t *sesTransport) Send(from string, to []string, message []byte) error {
+	url := t.Config.URL
+	if url == "" {
+		url = "https://email." + t.Config.Region +
+			".amazonaws.com/v2/email/outbound-emails"
+	}
+	var request struct {
+		FromEmailAddress string
+		Destination      struct{ ToAddresses []string }
+		Content          struct{ Raw struct{ Data string } }
+	}
+	request.FromEmailAddress = from
+	request.Destination.ToAddresses = to
+	request.Content.Raw.Data = base64.StdEncoding.EncodeToString(message)
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signAWSRequest(req, body, t.Config.Region, "ses", t.Config.Username,
+		t.Config.Password, t.now())
+	res, err := mailAPIClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return httpMailError(res)
+}
@@ -0,0 +1,341 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestSettingsMailTransport(t *testing.T) {
+	settings := new(settings)
+	settings.Mail.Host = "legacy:25"
+	settings.Mail.Username = "user"
+	siteTransport := &util.MailTransport{Type: "sendmail"}
+	settings.Monsti.Sites = map[string]util.SiteSettings{
+		"example": {MailTransport: siteTransport},
+		"other":   {}}
+	transport, err := settings.mailTransport("example")
+	if err != nil {
+		t.Fatalf("mailTransport returned error: %v", err)
+	}
+	if _, ok := transport.(*sendmailTransport); !ok {
+		t.Errorf("Transport of example is %T, should be sendmail", transport)
+	}
+	transport, err = settings.mailTransport("other")
+	if err != nil {
+		t.Fatalf("mailTransport returned error: %v", err)
+	}
+	if smtp, ok := transport.(*smtpTransport); !ok ||
+		smtp.Config.Host != "legacy:25" || smtp.Config.Username != "user" {
+		t.Errorf("Transport of other is %v, should use legacy settings",
+			transport)
+	}
+	settings.Mail.Transport.Type = "mailgun"
+	settings.Mail.Transport.URL = "http://example.com/messages.mime"
+	if transport, _ := settings.mailTransport(""); transport == nil {
+		t.Errorf("Missing mailgun transport")
+	} else if _, ok := transport.(*mailgunTransport); !ok {
+		t.Errorf("Transport is %T, should be mailgun", transport)
+	}
+	for i, config := range []util.MailTransport{
+		{}, {Type: "unknown"}, {Host: "foo:25", Auth: "unknown"},
+		{Host: "foo:25", Security: "unknown"}, {Type: "mailgun"},
+		{Type: "ses"}} {
+		if _, err := newMailTransport(config); err == nil {
+			t.Errorf("Test %v: newMailTransport(%v) should fail", i, config)
+		}
+	}
+}
+
+// testSMTPServer accepts a single SMTP session requiring LOGIN
+// authentication. Recipients starting with "unknown" are rejected.
+type testSMTPServer struct {
+	Listener           net.Listener
+	Username, Password string
+	From               string
+	To                 []string
+	Data               string
+	done               chan struct{}
+}
+
+func newTestSMTPServer(t *testing.T) *testSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	server := &testSMTPServer{Listener: listener, done: make(chan struct{})}
+	go server.serve()
+	return server
+}
+
+func (s *testSMTPServer) serve() {
+	defer close(s.done)
+	conn, err := s.Listener.Accept()
+	if err != nil {
+		return
+	}
+	tp := textproto.NewConn(conn)
+	defer tp.Close()
+	decode := func() string {
+		line, _ := tp.ReadLine()
+		value, _ := base64.StdEncoding.DecodeString(line)
+		return string(value)
+	}
+	tp.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(command, "EHLO"):
+			tp.PrintfLine("250-localhost")
+			tp.PrintfLine("250 AUTH LOGIN")
+		case command == "AUTH LOGIN":
+			tp.PrintfLine("334 VXNlcm5hbWU6")
+			s.Username = decode()
+			tp.PrintfLine("334 UGFzc3dvcmQ6")
+			s.Password = decode()
+			tp.PrintfLine("235 Authenticated")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			s.From = strings.Trim(line[len("MAIL FROM:"):], "<>")
+			tp.PrintfLine("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			to := strings.Trim(line[len("RCPT TO:"):], "<>")
+			if strings.HasPrefix(to, "unknown") {
+				tp.PrintfLine("550 No such user")
+				continue
+			}
+			s.To = append(s.To, to)
+			tp.PrintfLine("250 OK")
+		case command == "DATA":
+			tp.PrintfLine("354 Go ahead")
+			data, _ := tp.ReadDotBytes()
+			s.Data = string(data)
+			tp.PrintfLine("250 Queued")
+		case command == "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Unknown command")
+		}
+	}
+}
+
+func TestSMTPTransport(t *testing.T) {
+	server := newTestSMTPServer(t)
+	defer server.Listener.Close()
+	transport, err := newMailTransport(util.MailTransport{
+		Host: server.Listener.Addr().String(), Username: "user",
+		Password: "secret", Auth: "login"})
+	if err != nil {
+		t.Fatalf("newMailTransport returned error: %v", err)
+	}
+	err = transport.Send("bounces@example.com",
+		[]string{"foo@example.com", "bar@example.com"},
+		[]byte("Subject: Hello\r\n\r\nHello World!\r\n"))
+	if err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+	<-server.done
+	if server.Username != "user" || server.Password != "secret" {
+		t.Errorf("Authenticated as %q, %q, should be %q, %q", server.Username,
+			server.Password, "user", "secret")
+	}
+	if server.From != "bounces@example.com" ||
+		!reflect.DeepEqual(server.To,
+			[]string{"foo@example.com", "bar@example.com"}) {
+		t.Errorf("Envelope is %v, %v", server.From, server.To)
+	}
+	if server.Data != "Subject: Hello\nHello World!\n" &&
+		server.Data != "Subject: Hello\n\nHello World!\n" {
+		t.Errorf("Sent data is %q", server.Data)
+	}
+
+	server = newTestSMTPServer(t)
+	defer server.Listener.Close()
+	transport, _ = newMailTransport(util.MailTransport{
+		Host: server.Listener.Addr().String()})
+	err = transport.Send("bounces@example.com", []string{"unknown@example.com"},
+		[]byte("Subject: Hello\r\n\r\nHello World!\r\n"))
+	if !isPermanentMailError(err) {
+		t.Errorf("Rejected recipient should fail permanently, got %v", err)
+	}
+
+	server = newTestSMTPServer(t)
+	defer server.Listener.Close()
+	transport, _ = newMailTransport(util.MailTransport{
+		Host: server.Listener.Addr().String(), Security: "starttls"})
+	err = transport.Send("bounces@example.com", []string{"foo@example.com"},
+		[]byte("Subject: Hello\r\n\r\nHello World!\r\n"))
+	if err == nil || isPermanentMailError(err) {
+		t.Errorf("Missing STARTTLS should fail temporarily, got %v", err)
+	}
+}
+
+func TestSendmailTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-TestSendmailTransport")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "sendmail")
+	if err := ioutil.WriteFile(script, []byte(`#!/bin/sh
+dir=$(dirname "$0")
+echo "$@" > "$dir/args"
+cat > "$dir/message"
+case "$5" in
+  unknown*) echo "No such user" >&2; exit 67;;
+  later*) exit 75;;
+esac
+`), 0700); err != nil {
+		t.Fatalf("Could not write script: %v", err)
+	}
+	transport, err := newMailTransport(util.MailTransport{Type: "sendmail",
+		Command: []string{script, "-i"}})
+	if err != nil {
+		t.Fatalf("newMailTransport returned error: %v", err)
+	}
+	message := "Subject: Hello\r\n\r\nHello World!\r\n"
+	if err := transport.Send("bounces@example.com",
+		[]string{"foo@example.com", "bar@example.com"},
+		[]byte(message)); err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+	expected := "-i -f bounces@example.com -- foo@example.com bar@example.com\n"
+	if string(args) != expected {
+		t.Errorf("sendmail got arguments %q, should be %q", args, expected)
+	}
+	sent, _ := ioutil.ReadFile(filepath.Join(dir, "message"))
+	if string(sent) != message {
+		t.Errorf("sendmail got message %q, should be %q", sent, message)
+	}
+	err = transport.Send("bounces@example.com", []string{"unknown@example.com"},
+		[]byte(message))
+	if !isPermanentMailError(err) || !strings.Contains(err.Error(),
+		"No such user") {
+		t.Errorf("Unknown user should fail permanently, got %v", err)
+	}
+	err = transport.Send("bounces@example.com", []string{"later@example.com"},
+		[]byte(message))
+	if err == nil || isPermanentMailError(err) {
+		t.Errorf("Temporary failure should not be permanent, got %v", err)
+	}
+}
+
+func TestMailgunTransport(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if user, password, _ := r.BasicAuth(); user != "api" ||
+				password != "key" {
+				t.Errorf("Authenticated as %q, %q, should be api, key", user,
+					password)
+			}
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				t.Fatalf("Could not parse form: %v", err)
+			}
+			if to := r.MultipartForm.Value["to"]; !reflect.DeepEqual(to,
+				[]string{"foo@example.com", "bar@example.com"}) {
+				t.Errorf("Recipients are %v", to)
+			}
+			file, _, err := r.FormFile("message")
+			if err != nil {
+				t.Fatalf("Missing message: %v", err)
+			}
+			if message, _ := ioutil.ReadAll(file); string(message) != "Hello" {
+				t.Errorf("Message is %q, should be %q", message, "Hello")
+			}
+			w.WriteHeader(status)
+		}))
+	defer server.Close()
+	transport, err := newMailTransport(util.MailTransport{Type: "mailgun",
+		URL: server.URL, Password: "key"})
+	if err != nil {
+		t.Fatalf("newMailTransport returned error: %v", err)
+	}
+	to := []string{"foo@example.com", "bar@example.com"}
+	if err := transport.Send("bounces@example.com", to,
+		[]byte("Hello")); err != nil {
+		t.Errorf("Send returned error: %v", err)
+	}
+	status = http.StatusBadRequest
+	err = transport.Send("bounces@example.com", to, []byte("Hello"))
+	if !isPermanentMailError(err) {
+		t.Errorf("Bad request should fail permanently, got %v", err)
+	}
+	status = http.StatusServiceUnavailable
+	err = transport.Send("bounces@example.com", to, []byte("Hello"))
+	if err == nil || isPermanentMailError(err) {
+		t.Errorf("Unavailable service should fail temporarily, got %v", err)
+	}
+}
+
+func TestSESTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			auth := r.Header.Get("Authorization")
+			prefix := "AWS4-HMAC-SHA256 Credential=KEYID/20140513/eu-west-1/ses/" +
+				"aws4_request, SignedHeaders=content-type;host;" +
+				"x-amz-content-sha256;x-amz-date, Signature="
+			if !strings.HasPrefix(auth, prefix) ||
+				len(auth) != len(prefix)+64 {
+				t.Errorf("Authorization is %q", auth)
+			}
+			if date := r.Header.Get("X-Amz-Date"); date != "20140513T165320Z" {
+				t.Errorf("X-Amz-Date is %q", date)
+			}
+			var request struct {
+				FromEmailAddress string
+				Destination      struct{ ToAddresses []string }
+				Content          struct{ Raw struct{ Data []byte } }
+			}
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				t.Fatalf("Could not decode request: %v", err)
+			}
+			if request.FromEmailAddress != "bounces@example.com" ||
+				!reflect.DeepEqual(request.Destination.ToAddresses,
+					[]string{"foo@example.com"}) ||
+				string(request.Content.Raw.Data) != "Hello" {
+				t.Errorf("Request is %+v", request)
+			}
+		}))
+	defer server.Close()
+	transport := &sesTransport{util.MailTransport{Type: "ses", URL: server.URL,
+		Region: "eu-west-1", Username: "KEYID", Password: "SECRET"},
+		func() time.Time { return time.Unix(1400000000, 0) }}
+	if err := transport.Send("bounces@example.com",
+		[]string{"foo@example.com"}, []byte("Hello")); err != nil {
+		t.Errorf("Send returned error: %v", err)
+	}
+}
@@ -0,0 +1,271 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	mtemplate "pkg.monsti.org/monsti/api/util/template"
+)
+
+// isMediaNode returns true iff the node belongs to the media library,
+// i.e. if it's an image or file node.
+func isMediaNode(node *service.Node) bool {
+	return node.Type != nil &&
+		(node.Type.Id == "core.Image" || node.Type.Id == "core.File")
+}
+
+// linkedPaths returns the paths of the site's nodes linked by the
+// given HTML code of the node at the given path, without image sizes.
+// Absolute links are ignored.
+func linkedPaths(nodePath, code string) []string {
+	paths := linkTargets(nodePath, code, "")
+	for i, target := range paths {
+		paths[i], _ = splitImageSize(target)
+	}
+	return paths
+}
+
+// mediaReferences returns the paths of the nodes referenced by the
+// given node, i.e. its embeds, MultiRef fields and links in HTML and
+// Markdown fields.
+func mediaReferences(node *service.Node) ([]string, error) {
+	refs, err := nodeReferences(node)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		paths = append(paths, path.Clean(ref.Target))
+	}
+	fields := node.AllFields()
+	for _, field := range fields {
+		value := node.GetField(field.Id)
+		if value == nil {
+			continue
+		}
+		if code, ok := value.RenderHTML().(template.HTML); ok {
+			paths = append(paths, linkedPaths(node.Path, string(code))...)
+		}
+	}
+	return paths, nil
+}
+
+// matchMediaQuery returns true iff the item matches the query.
+func matchMediaQuery(item *service.MediaItem, query *service.MediaQuery) bool {
+	if query.Type != "" && item.Type != query.Type {
+		return false
+	}
+	for _, tag := range query.Tags {
+		found := false
+		for _, itemTag := range item.Tags {
+			found = found || strings.EqualFold(tag, itemTag)
+		}
+		if !found {
+			return false
+		}
+	}
+	text := strings.ToLower(strings.TrimSpace(query.Text))
+	return text == "" ||
+		strings.Contains(strings.ToLower(item.Path), text) ||
+		strings.Contains(strings.ToLower(item.Title), text) ||
+		strings.Contains(strings.ToLower(item.AltText), text)
+}
+
+// queryMedia returns the site's media items matching the query,
+// ordered by path.
+func queryMedia(query *service.MediaQuery, getNodeFn getNodeFunc,
+	getChildrenFn getChildrenFunc) ([]*service.MediaItem, error) {
+	items := make([]*service.MediaItem, 0)
+	usedBy := make(map[string][]string)
+	err := walkNodes("/", getNodeFn, getChildrenFn,
+		func(node *service.Node) error {
+			nodePath := path.Clean(node.Path)
+			if isMediaNode(node) {
+				items = append(items, &service.MediaItem{
+					Path:    nodePath,
+					Title:   getNodeTitle(node),
+					Type:    node.Type.Id,
+					Tags:    node.Tags,
+					AltText: node.AltText,
+				})
+			}
+			refs, err := mediaReferences(node)
+			if err != nil {
+				return err
+			}
+			seen := make(map[string]bool)
+			for _, ref := range refs {
+				if !seen[ref] && ref != nodePath {
+					usedBy[ref] = append(usedBy[ref], nodePath)
+				}
+				seen[ref] = true
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*service.MediaItem, 0, len(items))
+	for _, item := range items {
+		if !matchMediaQuery(item, query) {
+			continue
+		}
+		item.UsedBy = usedBy[item.Path]
+		sort.Strings(item.UsedBy)
+		ret = append(ret, item)
+	}
+	sort.Sort(mediaItemsByPath(ret))
+	return ret, nil
+}
+
+type mediaItemsByPath []*service.MediaItem
+
+func (s mediaItemsByPath) Len() int           { return len(s) }
+func (s mediaItemsByPath) Less(i, j int) bool { return s[i].Path < s[j].Path }
+func (s mediaItemsByPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// splitTags returns the comma separated tags, ignoring empty ones.
+func splitTags(value string) []string {
+	tags := make([]string, 0)
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Media shows the site's media library and updates the tags and
+// alternative texts of its items.
+//
+// Items are filtered by the form values "q" (text), "tag" (comma
+// separated tags) and "type" (node type). If the form value "format"
+// is "json", the items are returned as JSON, e.g. for the media
+// dialog of MultiRef fields. If it is "markup", the responsive image
+// markup of the image node given by the form value "node" is
+// returned, using the form value "sizes" as sizes attribute. The
+// editor of HTML fields inserts this markup.
+func (h *nodeHandler) Media(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if err := c.Req.ParseForm(); err != nil {
+		return err
+	}
+	switch c.Req.Method {
+	case "GET":
+		if c.Req.Form.Get("format") == "markup" {
+			return h.mediaMarkup(c)
+		}
+	case "POST":
+		node, err := c.Serv.Monsti().GetNode(c.Site.Name,
+			c.Req.Form.Get("node"))
+		if err != nil {
+			return fmt.Errorf("Could not get node: %v", err)
+		}
+		if node == nil || !isMediaNode(node) {
+			http.Error(c.Res, "Invalid node.", http.StatusBadRequest)
+			return nil
+		}
+		node.Tags = splitTags(c.Req.Form.Get("tags"))
+		node.AltText = strings.TrimSpace(c.Req.Form.Get("alttext"))
+		if err := c.Serv.Monsti().WriteNode(c.Site.Name, node.Path,
+			node); err != nil {
+			return fmt.Errorf("Could not update node: %v", err)
+		}
+		if err := recordNodeEvents(c, node.Path, &service.NodeEvent{
+			Type:        service.NodeChangedEvent,
+			Description: "Media library"}); err != nil {
+			return err
+		}
+		http.Redirect(c.Res, c.Req, "/@@media?"+c.Req.URL.RawQuery,
+			http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	query := &service.MediaQuery{
+		Text: c.Req.Form.Get("q"),
+		Tags: splitTags(c.Req.Form.Get("tag")),
+		Type: c.Req.Form.Get("type"),
+	}
+	items, err := queryMedia(query,
+		func(nodePath string) (*service.Node, error) {
+			return c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
+		},
+		func(nodePath string) ([]*service.Node, error) {
+			return c.Serv.Monsti().GetChildren(c.Site.Name, nodePath)
+		})
+	if err != nil {
+		return fmt.Errorf("Could not query media: %v", err)
+	}
+	if c.Req.Form.Get("format") == "json" {
+		content, err := json.Marshal(items)
+		if err != nil {
+			return fmt.Errorf("Could not marshal media items: %v", err)
+		}
+		c.Res.Header().Set("Content-Type", "application/json")
+		c.Res.Write(content)
+		return nil
+	}
+	body, err := h.Renderer.Render("actions/media", mtemplate.Context{
+		"Items": items,
+		"Query": c.Req.Form,
+	}, c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render media library: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("Media library"),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
+
+// mediaMarkup writes the responsive image markup of the image node
+// requested by the editor of HTML fields.
+func (h *nodeHandler) mediaMarkup(c *reqContext) error {
+	node, err := c.Serv.Monsti().GetNode(c.Site.Name, c.Req.Form.Get("node"))
+	if err != nil {
+		return fmt.Errorf("Could not get node: %v", err)
+	}
+	if node == nil || node.Type == nil || node.Type.Id != "core.Image" {
+		http.Error(c.Res, "Invalid node.", http.StatusBadRequest)
+		return nil
+	}
+	sizesAttr := strings.TrimSpace(c.Req.Form.Get("sizes"))
+	if sizesAttr == "" {
+		sizesAttr = "100vw"
+	}
+	markup, err := responsiveImage(c, node, sizesAttr)
+	if err != nil {
+		return fmt.Errorf("Could not render image markup: %v", err)
+	}
+	c.Res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(c.Res, markup)
+	return nil
+}
@@ -0,0 +1,109 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"path"
+	"reflect"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestLinkedPaths(t *testing.T) {
+	code := `<p><img src="../images/foo.jpeg/_sizes/thumbnail"> <a
+    href='/files/report.pdf?download=1'>Report</a>
+    <a href="http://example.com/foo">Elsewhere</a></p>`
+	ret := linkedPaths("/news/item/", code)
+	expected := []string{"/news/images/foo.jpeg", "/files/report.pdf"}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Errorf("linkedPaths(...) = %v, should be %v", ret, expected)
+	}
+}
+
+func TestQueryMedia(t *testing.T) {
+	docType := &service.NodeType{Id: "core.Document",
+		Fields: []*service.NodeField{{Id: "core.Body", Type: "HTMLArea"}}}
+	refType := &service.NodeType{Id: "foo.Gallery",
+		Fields: []*service.NodeField{{Id: "foo.Images", Type: "MultiRef"}}}
+	imageType := &service.NodeType{Id: "core.Image"}
+	fileType := &service.NodeType{Id: "core.File"}
+	body := service.HTMLField(`<img src="/media/cat.jpeg">`)
+	nodes := map[string]*service.Node{
+		"/": {Path: "/", Type: docType,
+			Fields: map[string]service.Field{"core.Body": &body}},
+		"/media": {Path: "/media", Type: docType,
+			Fields: map[string]service.Field{"core.Body": new(service.HTMLField)}},
+		"/media/cat.jpeg": {Path: "/media/cat.jpeg", Type: imageType,
+			Tags: []string{"Animals", "cats"}, AltText: "A sleeping cat"},
+		"/media/dog.jpeg": {Path: "/media/dog.jpeg", Type: imageType,
+			Tags: []string{"animals"}},
+		"/media/report.pdf": {Path: "/media/report.pdf", Type: fileType},
+		"/gallery": {Path: "/gallery", Type: refType,
+			Fields: map[string]service.Field{"foo.Images": &service.MultiRefField{
+				Paths: []string{"/media/cat.jpeg", "/media/dog.jpeg"}}}},
+	}
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		return nodes[nodePath], nil
+	}
+	getChildrenFn := func(nodePath string) ([]*service.Node, error) {
+		children := make([]*service.Node, 0)
+		for childPath, child := range nodes {
+			if childPath != "/" && path.Dir(childPath) == nodePath {
+				children = append(children, child)
+			}
+		}
+		return children, nil
+	}
+	tests := []struct {
+		Query service.MediaQuery
+		Paths []string
+	}{
+		{service.MediaQuery{},
+			[]string{"/media/cat.jpeg", "/media/dog.jpeg", "/media/report.pdf"}},
+		{service.MediaQuery{Type: "core.File"}, []string{"/media/report.pdf"}},
+		{service.MediaQuery{Tags: []string{"animals"}},
+			[]string{"/media/cat.jpeg", "/media/dog.jpeg"}},
+		{service.MediaQuery{Tags: []string{"animals", "cats"}},
+			[]string{"/media/cat.jpeg"}},
+		{service.MediaQuery{Text: "SLEEPING"}, []string{"/media/cat.jpeg"}},
+		{service.MediaQuery{Text: "bird"}, []string{}},
+	}
+	for i, test := range tests {
+		items, err := queryMedia(&test.Query, getNodeFn, getChildrenFn)
+		if err != nil {
+			t.Fatalf("Test %v: queryMedia returned error: %v", i, err)
+		}
+		paths := make([]string, 0)
+		for _, item := range items {
+			paths = append(paths, item.Path)
+		}
+		if !reflect.DeepEqual(paths, test.Paths) {
+			t.Errorf("Test %v: queryMedia(...) returned %v, should be %v", i,
+				paths, test.Paths)
+		}
+	}
+	items, err := queryMedia(&service.MediaQuery{Text: "cat"}, getNodeFn,
+		getChildrenFn)
+	if err != nil {
+		t.Fatalf("queryMedia returned error: %v", err)
+	}
+	if expected := []string{"/", "/gallery"}; len(items) != 1 ||
+		!reflect.DeepEqual(items[0].UsedBy, expected) {
+		t.Errorf("queryMedia(...)[0].UsedBy should be %v", expected)
+	}
+}
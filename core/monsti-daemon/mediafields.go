@@ -0,0 +1,246 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2013 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// fieldFilesDir is the pseudo directory below nodes to access the
+// files of their video and audio fields, e.g.
+// "/foo/_files/example.Video".
+const fieldFilesDir = "/_files/"
+
+// splitFieldFile splits and returns the node path and field file of
+// the given path. The field file is either the field id or the field
+// id followed by "/poster" for the poster frame of videos.
+//
+// Returns the unchanged path and an empty field file if the path does
+// not point to a field file.
+func splitFieldFile(nodePath string) (string, string) {
+	i := strings.LastIndex(nodePath, fieldFilesDir)
+	if i <= 0 {
+		return nodePath, ""
+	}
+	file := nodePath[i+len(fieldFilesDir):]
+	field := strings.TrimSuffix(file, "/poster")
+	if field == "" || strings.Contains(field, "/") {
+		return nodePath, ""
+	}
+	return nodePath[:i], file
+}
+
+// mediaMIMEType returns the MIME type of the given video or audio
+// file. Returns an empty string if the content does not match the
+// given kind ("video" or "audio").
+func mediaMIMEType(kind string, content []byte) string {
+	mimeType := http.DetectContentType(content)
+	if i := strings.Index(mimeType, ";"); i >= 0 {
+		mimeType = mimeType[:i]
+	}
+	// Containers used for both video and audio.
+	switch mimeType {
+	case "application/ogg":
+		mimeType = kind + "/ogg"
+	case "video/mp4", "video/webm":
+		mimeType = kind + mimeType[len("video"):]
+	}
+	if !strings.HasPrefix(mimeType, kind+"/") {
+		return ""
+	}
+	return mimeType
+}
+
+// mp4Box returns the content of the first box of the given type
+// inside data.
+func mp4Box(data []byte, boxType string) ([]byte, bool) {
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data))
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, false
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return nil, false
+		}
+		if string(data[4:8]) == boxType {
+			return data[header:size], true
+		}
+		data = data[size:]
+	}
+	return nil, false
+}
+
+// mp4Duration returns the duration given by the movie header of the
+// MP4 file.
+func mp4Duration(content []byte) (time.Duration, bool) {
+	moov, ok := mp4Box(content, "moov")
+	if !ok {
+		return 0, false
+	}
+	mvhd, ok := mp4Box(moov, "mvhd")
+	if !ok || len(mvhd) < 20 {
+		return 0, false
+	}
+	var timescale, duration uint64
+	if mvhd[0] == 1 {
+		if len(mvhd) < 32 {
+			return 0, false
+		}
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[20:]))
+		duration = binary.BigEndian.Uint64(mvhd[24:])
+	} else {
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[12:]))
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:]))
+	}
+	if timescale == 0 {
+		return 0, false
+	}
+	return time.Duration(duration * uint64(time.Second) / timescale), true
+}
+
+// wavDuration returns the duration of the WAV file computed from its
+// byte rate and the size of its data chunk.
+func wavDuration(content []byte) (time.Duration, bool) {
+	if len(content) < 12 || string(content[:4]) != "RIFF" ||
+		string(content[8:12]) != "WAVE" {
+		return 0, false
+	}
+	var byteRate uint64
+	data := content[12:]
+	for len(data) >= 8 {
+		id := string(data[:4])
+		size := uint64(binary.LittleEndian.Uint32(data[4:]))
+		switch id {
+		case "fmt ":
+			if size < 12 || uint64(len(data)) < 8+size {
+				return 0, false
+			}
+			byteRate = uint64(binary.LittleEndian.Uint32(data[16:]))
+		case "data":
+			if byteRate == 0 {
+				return 0, false
+			}
+			return time.Duration(size * uint64(time.Second) / byteRate), true
+		}
+		size += size % 2
+		if uint64(len(data)) < 8+size {
+			return 0, false
+		}
+		data = data[8+size:]
+	}
+	return 0, false
+}
+
+// mediaDuration returns the duration of the given video or audio file.
+// Supports MP4 and WAV files.
+func mediaDuration(mimeType string, content []byte) (time.Duration, bool) {
+	switch mimeType {
+	case "video/mp4", "audio/mp4":
+		return mp4Duration(content)
+	case "audio/wave":
+		return wavDuration(content)
+	}
+	return 0, false
+}
+
+// generatePoster runs the poster hooks to generate a poster frame of
+// the given video. Hook commands get the path to the video as
+// MONSTI_INPUT and write the poster to the path given by MONSTI_OUTPUT.
+//
+// Returns nil if no poster could be generated.
+func generatePoster(c *reqContext, h *nodeHandler, nodePath, field string,
+	video []byte) ([]byte, error) {
+	if len(h.Settings.Hooks.Poster) == 0 {
+		return nil, nil
+	}
+	dir, err := ioutil.TempDir("", "monsti-poster")
+	if err != nil {
+		return nil, fmt.Errorf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "input")
+	output := filepath.Join(dir, "output")
+	if err := ioutil.WriteFile(input, video, 0600); err != nil {
+		return nil, fmt.Errorf("Could not write video: %v", err)
+	}
+	err = h.runHooks(c, h.Settings.Hooks.Poster, util.HookEnv{
+		Operation: "poster",
+		Stage:     "post",
+		Values: map[string]string{
+			"site":   c.Site.Name,
+			"node":   nodePath,
+			"field":  field,
+			"input":  input,
+			"output": output}})
+	if err != nil {
+		return nil, err
+	}
+	poster, err := ioutil.ReadFile(output)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Could not read poster: %v", err)
+	}
+	if len(poster) == 0 {
+		return nil, nil
+	}
+	return poster, nil
+}
+
+// serveFieldFile writes the file or poster of the media field given
+// by the request path.
+func (h *nodeHandler) serveFieldFile(c *reqContext) error {
+	id := strings.TrimSuffix(c.FieldFile, "/poster")
+	poster := id != c.FieldFile
+	field, ok := c.Node.GetField(id).(*service.MediaField)
+	if !ok || field.MIMEType == "" || (poster && !field.Poster) {
+		h.serveErrorPage(c, http.StatusNotFound)
+		return nil
+	}
+	name, mimeType := "__file_"+id, field.MIMEType
+	if poster {
+		name, mimeType = "__poster_"+id, ""
+	}
+	content, err := c.Serv.Monsti().GetNodeData(c.Site.Name, c.Node.Path, name)
+	if err != nil {
+		return fmt.Errorf("Could not read field file: %v", err)
+	}
+	if mimeType != "" {
+		c.Res.Header().Set("Content-Type", mimeType)
+	}
+	serveNodeFile(c, "", content)
+	return nil
+}
@@ -0,0 +1,129 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestSplitFieldFile(t *testing.T) {
+	tests := []struct {
+		Path, NodePath, File string
+	}{
+		{"/foo/_files/example.Video", "/foo", "example.Video"},
+		{"/foo/_files/example.Video/poster", "/foo", "example.Video/poster"},
+		{"/foo/_files/", "/foo/_files/", ""},
+		{"/foo/_files/a/b", "/foo/_files/a/b", ""},
+		{"/_files/example.Video", "/_files/example.Video", ""},
+		{"/foo/bar", "/foo/bar", ""},
+	}
+	for i, test := range tests {
+		nodePath, file := splitFieldFile(test.Path)
+		if nodePath != test.NodePath || file != test.File {
+			t.Errorf("Test %v: splitFieldFile(%q) = %q, %q, should be %q, %q",
+				i, test.Path, nodePath, file, test.NodePath, test.File)
+		}
+	}
+}
+
+// mp4File returns a minimal MP4 file with the given movie header
+// version, time scale and duration.
+func mp4File(version byte, timescale uint32, duration uint64) []byte {
+	var mvhd bytes.Buffer
+	mvhd.Write([]byte{version, 0, 0, 0})
+	if version == 1 {
+		binary.Write(&mvhd, binary.BigEndian, [2]uint64{})
+		binary.Write(&mvhd, binary.BigEndian, timescale)
+		binary.Write(&mvhd, binary.BigEndian, duration)
+	} else {
+		binary.Write(&mvhd, binary.BigEndian, [2]uint32{})
+		binary.Write(&mvhd, binary.BigEndian, timescale)
+		binary.Write(&mvhd, binary.BigEndian, uint32(duration))
+	}
+	box := func(boxType string, content []byte) []byte {
+		var ret bytes.Buffer
+		binary.Write(&ret, binary.BigEndian, uint32(8+len(content)))
+		ret.WriteString(boxType)
+		ret.Write(content)
+		return ret.Bytes()
+	}
+	ftyp := box("ftyp", []byte("isom\x00\x00\x02\x00isommp41"))
+	return append(ftyp, box("moov", box("mvhd", mvhd.Bytes()))...)
+}
+
+// wavFile returns a WAV file of the given byte rate and data size.
+func wavFile(byteRate uint32, size int) []byte {
+	var ret bytes.Buffer
+	ret.WriteString("RIFF")
+	binary.Write(&ret, binary.LittleEndian, uint32(36+size))
+	ret.WriteString("WAVEfmt ")
+	for _, value := range []interface{}{uint32(16), uint16(1), uint16(1),
+		byteRate / 2, byteRate, uint16(2), uint16(16)} {
+		binary.Write(&ret, binary.LittleEndian, value)
+	}
+	ret.WriteString("data")
+	binary.Write(&ret, binary.LittleEndian, uint32(size))
+	ret.Write(make([]byte, size))
+	return ret.Bytes()
+}
+
+func TestMediaMIMEType(t *testing.T) {
+	tests := []struct {
+		Kind     string
+		Content  []byte
+		MIMEType string
+	}{
+		{"video", mp4File(0, 1000, 1000), "video/mp4"},
+		{"audio", mp4File(0, 1000, 1000), "audio/mp4"},
+		{"audio", wavFile(8000, 8), "audio/wave"},
+		{"video", wavFile(8000, 8), ""},
+		{"audio", []byte("ID3\x03\x00\x00\x00\x00\x00\x00"), "audio/mpeg"},
+		{"video", []byte("<html><body>Foo</body></html>"), ""},
+	}
+	for i, test := range tests {
+		if ret := mediaMIMEType(test.Kind, test.Content); ret != test.MIMEType {
+			t.Errorf("Test %v: mediaMIMEType(%q, ...) = %q, should be %q", i,
+				test.Kind, ret, test.MIMEType)
+		}
+	}
+}
+
+func TestMediaDuration(t *testing.T) {
+	tests := []struct {
+		MIMEType string
+		Content  []byte
+		Duration time.Duration
+		OK       bool
+	}{
+		{"video/mp4", mp4File(0, 600, 90000), 150 * time.Second, true},
+		{"video/mp4", mp4File(1, 1000, 2500), 2500 * time.Millisecond, true},
+		{"video/mp4", mp4File(0, 0, 100), 0, false},
+		{"video/mp4", []byte("foo"), 0, false},
+		{"audio/wave", wavFile(16000, 8000), 500 * time.Millisecond, true},
+		{"audio/mpeg", []byte("ID3"), 0, false},
+	}
+	for i, test := range tests {
+		ret, ok := mediaDuration(test.MIMEType, test.Content)
+		if ret != test.Duration || ok != test.OK {
+			t.Errorf("Test %v: mediaDuration(%q, ...) = %v, %v, should be %v, %v",
+				i, test.MIMEType, ret, ok, test.Duration, test.OK)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// defaultMenus are the menus shown in the menu editor even if they
+// don't have any entries yet. The master template shows them in place
+// of the primary navigation and in the footer.
+var defaultMenus = []string{"main", "footer"}
+
+// menuNameRegexp matches valid names of menus.
+var menuNameRegexp = regexp.MustCompile(`^[-\w]{1,64}$`)
+
+// menusMutex serializes access to the menus of sites.
+var menusMutex sync.Mutex
+
+// menusPath returns the path to the menus inside the given site data
+// directory.
+func menusPath(dataDir string) string {
+	return filepath.Join(dataDir, "menus.json")
+}
+
+// readMenus returns the entries of the menus of the given site data
+// directory by name.
+func readMenus(dataDir string) (map[string][]*service.MenuEntry, error) {
+	menus := make(map[string][]*service.MenuEntry)
+	content, err := ioutil.ReadFile(menusPath(dataDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return menus, nil
+		}
+		return nil, fmt.Errorf("Could not read menus: %v", err)
+	}
+	if err := json.Unmarshal(content, &menus); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal menus: %v", err)
+	}
+	return menus, nil
+}
+
+// writeMenu replaces the entries of the named menu of the given site
+// data directory. Menus without entries get removed.
+func writeMenu(dataDir, name string, entries []*service.MenuEntry) error {
+	menusMutex.Lock()
+	defer menusMutex.Unlock()
+	menus, err := readMenus(dataDir)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		delete(menus, name)
+	} else {
+		menus[name] = entries
+	}
+	content, err := json.Marshal(menus)
+	if err != nil {
+		return fmt.Errorf("Could not marshal menus: %v", err)
+	}
+	if err := ioutil.WriteFile(menusPath(dataDir), content, 0600); err != nil {
+		return fmt.Errorf("Could not write menus: %v", err)
+	}
+	return nil
+}
+
+type GetMenuArgs struct{ Site, Name string }
+
+func (i *MonstiService) GetMenu(args *GetMenuArgs, reply *service.Menu) error {
+	menusMutex.Lock()
+	defer menusMutex.Unlock()
+	menus, err := readMenus(i.Settings.Monsti.GetSiteDataPath(args.Site))
+	if err != nil {
+		return err
+	}
+	*reply = service.Menu{Name: args.Name, Entries: menus[args.Name]}
+	return nil
+}
+
+// getMenuNav returns the navigation of the menu entries.
+//
+// Entries linking to missing nodes are skipped, as are entries linking
+// to unpublished nodes if public is true. Titles of nodes are shown in
+// the given locale. active is the path of the currently shown node.
+func getMenuNav(entries []*service.MenuEntry, active, locale string,
+	public bool, getNodeFn getNodeFunc) (navigation, error) {
+	nav := make(navigation, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Node == "" {
+			nav = append(nav, navLink{Name: entry.Title, Target: entry.URL})
+			continue
+		}
+		node, err := getNodeFn(path.Clean(entry.Node))
+		if err != nil {
+			return nil, fmt.Errorf("Could not get menu node: %v", err)
+		}
+		if node == nil || (public && !isPublished(node, time.Now())) {
+			continue
+		}
+		link := navLink{Name: entry.Title, Target: dirPath(node.Path)}
+		if link.Name == "" {
+			translated, err := translateNode(node, locale)
+			if err != nil {
+				return nil, fmt.Errorf("Could not translate menu node: %v", err)
+			}
+			link.Name = getNodeTitle(translated)
+		}
+		// Every node is below the root, so the root's entry is only
+		// active on the root itself.
+		if dirPath(active) == link.Target {
+			link.Active = true
+		} else if link.Target != "/" &&
+			strings.HasPrefix(dirPath(active), link.Target) {
+			link.ActiveBelow = true
+		}
+		nav = append(nav, link)
+	}
+	return nav, nil
+}
+
+// parseMenuEntries returns the menu entries given by the form values
+// Title, Node and URL, which hold the values of the entries in order.
+// Empty entries are skipped.
+//
+// The second return value holds translated messages about invalid
+// entries.
+func parseMenuEntries(form url.Values, G func(string) string,
+	getNodeFn getNodeFunc) ([]*service.MenuEntry, []string, error) {
+	entries := make([]*service.MenuEntry, 0)
+	var problems []string
+	for i := range form["Title"] {
+		value := func(key string) string {
+			if i < len(form[key]) {
+				return strings.TrimSpace(form[key][i])
+			}
+			return ""
+		}
+		entry := &service.MenuEntry{Title: value("Title"), Node: value("Node"),
+			URL: value("URL")}
+		switch {
+		case entry.Title == "" && entry.Node == "" && entry.URL == "":
+			continue
+		case entry.Node != "":
+			entry.URL = ""
+			node, err := getNodeFn(path.Clean("/" + entry.Node))
+			if err != nil {
+				return nil, nil, fmt.Errorf("Could not get menu node: %v", err)
+			}
+			if node == nil {
+				problems = append(problems, fmt.Sprintf(
+					G("The node %q does not exist."), entry.Node))
+				continue
+			}
+			entry.Node = node.Path
+		case entry.URL == "" || entry.Title == "":
+			problems = append(problems,
+				G("Entries linking to URLs need a title and an URL."))
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, problems, nil
+}
+
+// Menus shows and saves the entries of the menu given by the form
+// value "menu", defaulting to the main menu.
+func (h *nodeHandler) Menus(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if err := c.Req.ParseForm(); err != nil {
+		return err
+	}
+	dataDir := h.Settings.Monsti.GetSiteDataPath(c.Site.Name)
+	name := c.Req.Form.Get("menu")
+	if name == "" {
+		name = defaultMenus[0]
+	}
+	if !menuNameRegexp.MatchString(name) {
+		return fmt.Errorf("Invalid menu name: %q", name)
+	}
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		return c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
+	}
+	context := template.Context{"Menu": name}
+	var entries []*service.MenuEntry
+	switch c.Req.Method {
+	case "GET":
+		_, saved := c.Req.Form["saved"]
+		context["Saved"] = saved
+		menu, err := c.Serv.Monsti().GetMenu(c.Site.Name, name)
+		if err != nil {
+			return fmt.Errorf("Could not get menu: %v", err)
+		}
+		entries = menu.Entries
+	case "POST":
+		var problems []string
+		var err error
+		entries, problems, err = parseMenuEntries(c.Req.Form, G, getNodeFn)
+		if err != nil {
+			return err
+		}
+		if len(problems) == 0 {
+			if err := writeMenu(dataDir, name, entries); err != nil {
+				return err
+			}
+			http.Redirect(c.Res, c.Req, "@@menus?"+url.Values{
+				"menu": {name}, "saved": {""}}.Encode(), http.StatusSeeOther)
+			return nil
+		}
+		context["Problems"] = problems
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	menusMutex.Lock()
+	menus, err := readMenus(dataDir)
+	menusMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	names := append([]string{}, defaultMenus...)
+	for menu := range menus {
+		if !stringInSlice(menu, names) {
+			names = append(names, menu)
+		}
+	}
+	sort.Strings(names[len(defaultMenus):])
+	if !stringInSlice(name, names) {
+		names = append(names, name)
+	}
+	context["Menus"] = names
+	// An empty entry allows to add entries without JavaScript.
+	context["Entries"] = append(entries, &service.MenuEntry{})
+	body, err := h.Renderer.Render("actions/menus", context,
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render menu editor: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("Menus"),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
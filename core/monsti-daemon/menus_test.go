@@ -0,0 +1,141 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestGetMenuNav(t *testing.T) {
+	newNode := func(nodePath, title string, public bool) *service.Node {
+		titleField := service.TextField(title)
+		return &service.Node{Path: nodePath, Public: public,
+			Fields: map[string]service.Field{"core.Title": &titleField}}
+	}
+	nodes := map[string]*service.Node{
+		"/":            newNode("/", "Home", true),
+		"/about":       newNode("/about", "About", true),
+		"/about/team":  newNode("/about/team", "Team", true),
+		"/draft":       newNode("/draft", "Draft", false),
+		"/contact":     newNode("/contact", "Contact", true),
+		"/blog/recent": newNode("/blog/recent", "Recent", true),
+	}
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		return nodes[nodePath], nil
+	}
+	entries := []*service.MenuEntry{
+		{Node: "/"},
+		{Node: "/contact/"},
+		{Node: "/about", Title: "Who we are"},
+		{Title: "Example", URL: "https://example.com/"},
+		{Node: "/draft"},
+		{Node: "/missing"},
+		{Node: "/blog/recent"},
+	}
+	tests := []struct {
+		Active string
+		Public bool
+		Nav    string
+	}{
+		{"/about/team", true, "Home|/| Contact|/contact/| Who we are|/about/|b " +
+			"Example|https://example.com/| Recent|/blog/recent/|"},
+		{"/contact", false, "Home|/| Contact|/contact/|a Who we are|/about/| " +
+			"Example|https://example.com/| Draft|/draft/| Recent|/blog/recent/|"},
+		{"/", true, "Home|/|a Contact|/contact/| Who we are|/about/| " +
+			"Example|https://example.com/| Recent|/blog/recent/|"},
+	}
+	for _, test := range tests {
+		nav, err := getMenuNav(entries, test.Active, "", test.Public, getNodeFn)
+		if err != nil {
+			t.Fatalf("getMenuNav returned error: %v", err)
+		}
+		var links []string
+		for _, link := range nav {
+			state := ""
+			if link.Active {
+				state = "a"
+			} else if link.ActiveBelow {
+				state = "b"
+			}
+			links = append(links, link.Name+"|"+link.Target+"|"+state)
+		}
+		if fmt.Sprint(links) != "["+test.Nav+"]" {
+			t.Errorf("getMenuNav(_, %q, _, %v, _) = %v, should be [%v]",
+				test.Active, test.Public, links, test.Nav)
+		}
+	}
+}
+
+func TestParseMenuEntries(t *testing.T) {
+	G := func(in string) string { return in }
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		if nodePath == "/about" {
+			return &service.Node{Path: nodePath}, nil
+		}
+		return nil, nil
+	}
+	form := url.Values{
+		"Title": {"", "Example", "", "", "No URL"},
+		"Node":  {"about/", "", "", "/missing", ""},
+		"URL":   {"https://ignored.com", "https://example.com/", "", "", ""},
+	}
+	entries, problems, err := parseMenuEntries(form, G, getNodeFn)
+	if err != nil {
+		t.Fatalf("parseMenuEntries returned error: %v", err)
+	}
+	if len(entries) != 2 || *entries[0] != (service.MenuEntry{Node: "/about"}) ||
+		*entries[1] != (service.MenuEntry{Title: "Example",
+			URL: "https://example.com/"}) {
+		t.Errorf("parseMenuEntries returned entries %v", entries)
+	}
+	if len(problems) != 2 {
+		t.Errorf("parseMenuEntries returned problems %v, should be two",
+			problems)
+	}
+}
+
+func TestWriteMenu(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "monsti-menus")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dataDir)
+	entries := []*service.MenuEntry{{Node: "/about"}}
+	if err := writeMenu(dataDir, "main", entries); err != nil {
+		t.Fatalf("writeMenu returned error: %v", err)
+	}
+	if err := writeMenu(dataDir, "footer", entries); err != nil {
+		t.Fatalf("writeMenu returned error: %v", err)
+	}
+	if err := writeMenu(dataDir, "footer", nil); err != nil {
+		t.Fatalf("writeMenu returned error: %v", err)
+	}
+	menus, err := readMenus(dataDir)
+	if err != nil {
+		t.Fatalf("readMenus returned error: %v", err)
+	}
+	if len(menus) != 1 || len(menus["main"]) != 1 ||
+		menus["main"][0].Node != "/about" {
+		t.Errorf("readMenus returned %v, should only have the main menu", menus)
+	}
+}
@@ -0,0 +1,267 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// checkMigrations checks that the versions of the node type's
+// migrations start at 1 and increase.
+func checkMigrations(nodeType *service.NodeType) error {
+	version := 0
+	for _, migration := range nodeType.Migrations {
+		if migration.Version <= version {
+			return fmt.Errorf("Migration %q of node type %v must have a version "+
+				"above %v", migration.Description, nodeType.Id, version)
+		}
+		version = migration.Version
+	}
+	return nil
+}
+
+// convertFunc converts the fields of a node for the migration.
+type convertFunc func(migration *service.Migration,
+	fields map[string][]byte) (map[string][]byte, error)
+
+// nodeHeader holds the node.json entries identifying the node's
+// schema.
+type nodeHeader struct {
+	Type          string
+	SchemaVersion int
+}
+
+// migrateNodeData applies the migrations of the node type above the
+// node's schema version to the node.json data.
+//
+// Returns the migrated data and the applied migrations.
+func migrateNodeData(data []byte, nodeType *service.NodeType,
+	convert convertFunc) ([]byte, []*service.Migration, error) {
+	var header nodeHeader
+	var node map[string]*json.RawMessage
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, nil, fmt.Errorf("Could not unmarshal node: %v", err)
+	}
+	if err := json.Unmarshal(data, &node); err != nil {
+		return nil, nil, fmt.Errorf("Could not unmarshal node: %v", err)
+	}
+	var nested map[string]map[string]*json.RawMessage
+	if node["Fields"] != nil {
+		if err := json.Unmarshal(*node["Fields"], &nested); err != nil {
+			return nil, nil, fmt.Errorf("Could not unmarshal fields: %v", err)
+		}
+	}
+	fields := make(map[string][]byte)
+	for namespace, values := range nested {
+		for name, value := range values {
+			if value != nil {
+				fields[namespace+"."+name] = []byte(*value)
+			}
+		}
+	}
+	applied := make([]*service.Migration, 0)
+	for _, migration := range nodeType.Migrations {
+		if migration.Version <= header.SchemaVersion {
+			continue
+		}
+		renamed := make(map[string][]byte)
+		for from, to := range migration.RenameFields {
+			if value, ok := fields[from]; ok {
+				renamed[to] = value
+				delete(fields, from)
+			}
+		}
+		for id, value := range renamed {
+			fields[id] = value
+		}
+		for _, id := range migration.RemoveFields {
+			delete(fields, id)
+		}
+		if migration.Convert != "" {
+			var err error
+			fields, err = convert(migration, fields)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Could not convert node (%v): %v",
+					migration.Description, err)
+			}
+		}
+		applied = append(applied, migration)
+	}
+	if len(applied) == 0 {
+		return data, applied, nil
+	}
+	nested = make(map[string]map[string]*json.RawMessage)
+	for id, value := range fields {
+		parts := strings.SplitN(id, ".", 2)
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("Invalid field id %q", id)
+		}
+		if nested[parts[0]] == nil {
+			nested[parts[0]] = make(map[string]*json.RawMessage)
+		}
+		msg := json.RawMessage(value)
+		nested[parts[0]][parts[1]] = &msg
+	}
+	for key, value := range map[string]interface{}{
+		"Fields":        nested,
+		"SchemaVersion": applied[len(applied)-1].Version,
+	} {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not marshal node: %v", err)
+		}
+		msg := json.RawMessage(encoded)
+		node[key] = &msg
+	}
+	migrated, err := json.MarshalIndent(node, "", "  ")
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not marshal node: %v", err)
+	}
+	return migrated, applied, nil
+}
+
+// PendingMigrations returns the site's nodes whose schema version is
+// below the one of their node type.
+func (i *MonstiService) PendingMigrations(site string,
+	reply *[]*service.PendingMigration) error {
+	nodesMutex.RLock()
+	defer nodesMutex.RUnlock()
+	root := i.Settings.Monsti.GetSiteNodesPath(site)
+	pending := make([]*service.PendingMigration, 0)
+	err := filepath.Walk(root, func(file string, info os.FileInfo,
+		err error) error {
+		if err != nil || info.IsDir() || info.Name() != "node.json" {
+			return err
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var header nodeHeader
+		if err := json.Unmarshal(content, &header); err != nil {
+			return fmt.Errorf("Could not unmarshal %v: %v", file, err)
+		}
+		i.mutex.RLock()
+		nodeType := i.Settings.Config.NodeTypes[header.Type]
+		i.mutex.RUnlock()
+		if nodeType == nil || header.SchemaVersion >= nodeType.SchemaVersion() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, filepath.Dir(file))
+		if err != nil {
+			return err
+		}
+		pending = append(pending, &service.PendingMigration{
+			Path:     path.Clean("/" + filepath.ToSlash(rel)),
+			NodeType: header.Type,
+			Version:  header.SchemaVersion,
+			Target:   nodeType.SchemaVersion()})
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Could not find nodes to migrate: %v", err)
+	}
+	*reply = pending
+	return nil
+}
+
+type MigrateNodeArgs struct {
+	Site, Path string
+	DryRun     bool
+}
+
+// MigrateNode migrates the given node. Conversions are done by the
+// modules handling the monsti.MigrateNode signal.
+func (i *MonstiService) MigrateNode(args *MigrateNodeArgs,
+	reply *service.MigrationResult) error {
+	nodePath := path.Clean("/" + args.Path)
+	if err := i.checkNotMounted(args.Site, nodePath); err != nil {
+		return err
+	}
+	file := filepath.Join(i.Settings.Monsti.GetSiteNodesPath(args.Site),
+		nodePath[1:], "node.json")
+	nodesMutex.RLock()
+	data, err := ioutil.ReadFile(file)
+	nodesMutex.RUnlock()
+	if err != nil {
+		return fmt.Errorf("Could not read node: %v", err)
+	}
+	var header nodeHeader
+	if err := json.Unmarshal(data, &header); err != nil {
+		return fmt.Errorf("Could not unmarshal node: %v", err)
+	}
+	i.mutex.RLock()
+	nodeType := i.Settings.Config.NodeTypes[header.Type]
+	i.mutex.RUnlock()
+	if nodeType == nil {
+		return fmt.Errorf("Unknown node type %q", header.Type)
+	}
+	// Conversions may access nodes, so nodesMutex must not be held.
+	migrated, applied, err := migrateNodeData(data, nodeType,
+		func(migration *service.Migration, fields map[string][]byte) (
+			map[string][]byte, error) {
+			session, err := i.Handler.Sessions.New()
+			if err != nil {
+				return nil, fmt.Errorf("Could not get session: %v", err)
+			}
+			defer i.Handler.Sessions.Free(session)
+			var ret []service.MigrateNodeRet
+			if err := session.Monsti().EmitSignal("monsti.MigrateNode",
+				service.MigrateNodeArgs{Site: args.Site, Node: nodePath,
+					NodeType: nodeType.Id, Convert: migration.Convert,
+					Version: migration.Version, Fields: fields}, &ret); err != nil {
+				return nil, err
+			}
+			for _, r := range ret {
+				if r.Handled {
+					return r.Fields, nil
+				}
+			}
+			return nil, fmt.Errorf("No module handles conversion %q",
+				migration.Convert)
+		})
+	if err != nil {
+		return err
+	}
+	reply.From, reply.To = header.SchemaVersion, header.SchemaVersion
+	reply.Data = migrated
+	reply.Applied = make([]string, 0, len(applied))
+	for _, migration := range applied {
+		reply.To = migration.Version
+		reply.Applied = append(reply.Applied, migration.Description)
+	}
+	if args.DryRun || len(applied) == 0 {
+		return nil
+	}
+	nodesMutex.RLock()
+	current, err := ioutil.ReadFile(file)
+	nodesMutex.RUnlock()
+	if err != nil || !bytes.Equal(current, data) {
+		return fmt.Errorf("Node %v changed during its migration", nodePath)
+	}
+	return i.WriteNodeData(&WriteNodeDataArgs{Site: args.Site, Path: nodePath,
+		File: "node.json", Content: migrated}, new(int))
+}
@@ -0,0 +1,117 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestCheckMigrations(t *testing.T) {
+	tests := []struct {
+		Versions []int
+		Valid    bool
+	}{
+		{nil, true},
+		{[]int{1}, true},
+		{[]int{1, 2, 5}, true},
+		{[]int{0}, false},
+		{[]int{2, 2}, false},
+		{[]int{3, 1}, false},
+	}
+	for _, test := range tests {
+		var nodeType service.NodeType
+		for _, version := range test.Versions {
+			nodeType.Migrations = append(nodeType.Migrations,
+				&service.Migration{Version: version})
+		}
+		if err := checkMigrations(&nodeType); (err == nil) != test.Valid {
+			t.Errorf("checkMigrations(%v) returned %v", test.Versions, err)
+		}
+	}
+}
+
+func TestMigrateNodeData(t *testing.T) {
+	nodeType := &service.NodeType{Id: "foo.Bar", Migrations: []*service.Migration{
+		{Version: 1, Description: "One",
+			RenameFields: map[string]string{"foo.A": "foo.B", "foo.B": "foo.C"}},
+		{Version: 2, Description: "Two", RemoveFields: []string{"foo.Old"}},
+		{Version: 3, Description: "Three", Convert: "foo.Count"},
+	}}
+	convert := func(migration *service.Migration, fields map[string][]byte) (
+		map[string][]byte, error) {
+		if migration.Convert != "foo.Count" {
+			return nil, fmt.Errorf("Unknown conversion %q", migration.Convert)
+		}
+		fields["foo.Count"] = []byte(fmt.Sprintf("%d", len(fields)))
+		return fields, nil
+	}
+	tests := []struct {
+		Data    string
+		Applied []string
+		Fields  map[string]map[string]interface{}
+	}{
+		{`{"Type":"foo.Bar","Public":true,"Fields":{"foo":{"A":"a","B":"b",
+			"Old":"x"},"bar":{"Keep":"k"}}}`,
+			[]string{"One", "Two", "Three"},
+			map[string]map[string]interface{}{
+				"foo": {"B": "a", "C": "b", "Count": 3.0},
+				"bar": {"Keep": "k"}}},
+		{`{"Type":"foo.Bar","Public":true,"SchemaVersion":2,
+			"Fields":{"foo":{"A":"a"}}}`,
+			[]string{"Three"},
+			map[string]map[string]interface{}{
+				"foo": {"A": "a", "Count": 1.0}}},
+	}
+	for i, test := range tests {
+		ret, applied, err := migrateNodeData([]byte(test.Data), nodeType, convert)
+		if err != nil {
+			t.Errorf("%v: migrateNodeData returned error: %v", i, err)
+			continue
+		}
+		var descriptions []string
+		for _, migration := range applied {
+			descriptions = append(descriptions, migration.Description)
+		}
+		if !reflect.DeepEqual(descriptions, test.Applied) {
+			t.Errorf("%v: Applied %v, should be %v", i, descriptions, test.Applied)
+		}
+		var node struct {
+			Public        bool
+			SchemaVersion int
+			Fields        map[string]map[string]interface{}
+		}
+		if err := json.Unmarshal(ret, &node); err != nil {
+			t.Errorf("%v: Could not unmarshal migrated node: %v", i, err)
+			continue
+		}
+		if !node.Public || node.SchemaVersion != 3 ||
+			!reflect.DeepEqual(node.Fields, test.Fields) {
+			t.Errorf("%v: Migrated node is %s", i, ret)
+		}
+	}
+	data := []byte(`{"Type":"foo.Bar","SchemaVersion":3}`)
+	ret, applied, err := migrateNodeData(data, nodeType, convert)
+	if err != nil || len(applied) != 0 || string(ret) != string(data) {
+		t.Errorf("Migrated nodes should not change, got %s, %v, %v", ret,
+			applied, err)
+	}
+}
@@ -0,0 +1,150 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// checkMounts checks the mounts of the given sites.
+func checkMounts(sites map[string]util.SiteSettings) error {
+	for name, site := range sites {
+		for _, mount := range site.Mounts {
+			if !strings.HasPrefix(mount.Path, "/") || path.Clean(mount.Path) == "/" {
+				return fmt.Errorf("site %v: invalid mount point %q", name, mount.Path)
+			}
+			if !strings.HasPrefix(mount.Source, "/") {
+				return fmt.Errorf("site %v: invalid mount source %q", name,
+					mount.Source)
+			}
+			if _, ok := sites[mount.Site]; !ok || mount.Site == name {
+				return fmt.Errorf("site %v: invalid mounted site %q", name,
+					mount.Site)
+			}
+		}
+	}
+	return nil
+}
+
+// findMount returns the mount of the site containing the given node
+// and the node's path within the mounted site. Returns nil if the
+// node is not mounted.
+func findMount(site util.SiteSettings, nodePath string) (*util.Mount,
+	string) {
+	clean := path.Clean("/" + nodePath)
+	var found *util.Mount
+	for i := range site.Mounts {
+		mount := &site.Mounts[i]
+		point := path.Clean(mount.Path)
+		if (clean == point || strings.HasPrefix(clean, point+"/")) &&
+			(found == nil || len(point) > len(path.Clean(found.Path))) {
+			found = mount
+		}
+	}
+	if found == nil {
+		return nil, nodePath
+	}
+	rel := strings.TrimPrefix(clean, path.Clean(found.Path))
+	return found, path.Join(path.Clean(found.Source), rel)
+}
+
+// nodeRoot returns the nodes directory holding the given node of the
+// site and the node's path within it.
+func (i *MonstiService) nodeRoot(site, nodePath string) (string, string,
+	*util.Mount) {
+	mount, sourcePath := findMount(i.Settings.Monsti.Sites[site], nodePath)
+	if mount != nil {
+		return i.Settings.Monsti.GetSiteNodesPath(mount.Site), sourcePath, mount
+	}
+	return i.Settings.Monsti.GetSiteNodesPath(site), sourcePath, nil
+}
+
+// checkNotMounted returns an error if the given node of the site lies
+// within a mount, as mounts are read-only.
+func (i *MonstiService) checkNotMounted(site, nodePath string) error {
+	if mount, _ := findMount(i.Settings.Monsti.Sites[site],
+		nodePath); mount != nil {
+		return fmt.Errorf("Node %v is mounted read-only from site %v", nodePath,
+			mount.Site)
+	}
+	return nil
+}
+
+// rebaseNode replaces the prefix from of the path attribute of the
+// given node as returned by getNode with the prefix to.
+func rebaseNode(node []byte, from, to string) []byte {
+	prefix := []byte(`{"Path":`)
+	if !bytes.HasPrefix(node, prefix) {
+		return node
+	}
+	quoted, err := strconv.QuotedPrefix(string(node[len(prefix):]))
+	if err != nil {
+		return node
+	}
+	nodePath, err := strconv.Unquote(quoted)
+	if err != nil || !(nodePath == from || strings.HasPrefix(nodePath,
+		strings.TrimSuffix(from, "/")+"/")) {
+		return node
+	}
+	nodePath = path.Join(to, strings.TrimPrefix(nodePath, from))
+	return append([]byte(fmt.Sprintf(`{"Path":%q`, nodePath)),
+		node[len(prefix)+len(quoted):]...)
+}
+
+// mountPoints returns the mounts of the site whose mount points are
+// children of the given node.
+func mountPoints(site util.SiteSettings, nodePath string) []util.Mount {
+	nodePath = path.Clean("/" + nodePath)
+	var mounts []util.Mount
+	for _, mount := range site.Mounts {
+		if path.Dir(path.Clean(mount.Path)) == nodePath {
+			mounts = append(mounts, mount)
+		}
+	}
+	return mounts
+}
+
+// mountedPaths returns the paths of the given changed nodes of the
+// source site as seen by the other sites mounting them, by site name.
+func mountedPaths(sites map[string]util.SiteSettings, source string,
+	nodePaths []string) map[string][]string {
+	paths := make(map[string][]string)
+	for name, site := range sites {
+		for _, mount := range site.Mounts {
+			if mount.Site != source {
+				continue
+			}
+			root := path.Clean(mount.Source)
+			for _, nodePath := range nodePaths {
+				nodePath = path.Clean("/" + nodePath)
+				if nodePath != root && !strings.HasPrefix(nodePath,
+					strings.TrimSuffix(root, "/")+"/") {
+					continue
+				}
+				paths[name] = append(paths[name], path.Join(path.Clean(mount.Path),
+					strings.TrimPrefix(nodePath, root)))
+			}
+		}
+	}
+	return paths
+}
@@ -0,0 +1,141 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestMountedPaths(t *testing.T) {
+	sites := map[string]util.SiteSettings{
+		"brand": {},
+		"a": {Mounts: []util.Mount{{Path: "/legal", Site: "brand",
+			Source: "/shared/legal"}}},
+		"b": {Mounts: []util.Mount{{Path: "/media", Site: "brand",
+			Source: "/"}}},
+	}
+	ret := mountedPaths(sites, "brand", []string{"/shared/legal/imprint",
+		"/shared/legalese"})
+	expected := map[string][]string{
+		"a": {"/legal/imprint"},
+		"b": {"/media/shared/legal/imprint", "/media/shared/legalese"},
+	}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Errorf("mountedPaths() = %v, should be %v", ret, expected)
+	}
+	if err := checkMounts(sites); err != nil {
+		t.Errorf("checkMounts() returned error: %v", err)
+	}
+	sites["c"] = util.SiteSettings{Mounts: []util.Mount{{Path: "/",
+		Site: "brand", Source: "/"}}}
+	if err := checkMounts(sites); err == nil {
+		t.Errorf("checkMounts() should fail for mounts at the root")
+	}
+}
+
+func TestMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-mounts")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := MonstiService{Settings: new(settings),
+		Logger: log.New(ioutil.Discard, "", 0)}
+	m.Settings.Monsti.Directories.Data = dir
+	m.Settings.Monsti.Directories.Config = dir
+	m.Settings.Monsti.Sites = map[string]util.SiteSettings{
+		"brand": {},
+		"example": {Mounts: []util.Mount{{Path: "/about/legal", Site: "brand",
+			Source: "/legal"}}},
+	}
+	for site, nodes := range map[string][]string{
+		"brand":   {"legal", "legal/imprint"},
+		"example": {"about", "about/team"},
+	} {
+		root := m.Settings.Monsti.GetSiteNodesPath(site)
+		for _, node := range nodes {
+			if err := os.MkdirAll(filepath.Join(root, node), 0700); err != nil {
+				t.Fatalf("Could not create node: %v", err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(root, node, "node.json"),
+				[]byte(`{"Type":"core.Document"}`), 0600); err != nil {
+				t.Fatalf("Could not write node: %v", err)
+			}
+		}
+	}
+
+	var node []byte
+	if err := m.GetNode(&GetNodeDataArgs{Site: "example",
+		Path: "/about/legal/imprint"}, &node); err != nil ||
+		string(node) != `{"Path":"/about/legal/imprint","Type":"core.Document"}` {
+		t.Errorf("GetNode() = %s, %v", node, err)
+	}
+	childPaths := func(nodePath string) []string {
+		var children [][]byte
+		if err := m.GetChildren(GetChildrenArgs{"example", nodePath},
+			&children); err != nil {
+			t.Fatalf("GetChildren(%q) returned error: %v", nodePath, err)
+		}
+		var paths []string
+		for _, child := range children {
+			paths = append(paths, strings.SplitN(string(child), `"`, 5)[3])
+		}
+		sort.Strings(paths)
+		return paths
+	}
+	if ret := childPaths("/about"); !reflect.DeepEqual(ret,
+		[]string{"/about/legal", "/about/team"}) {
+		t.Errorf("GetChildren(/about) = %v", ret)
+	}
+	if ret := childPaths("/about/legal"); !reflect.DeepEqual(ret,
+		[]string{"/about/legal/imprint"}) {
+		t.Errorf("GetChildren(/about/legal) = %v", ret)
+	}
+	if err := m.GetNodeData(&GetNodeDataArgs{"example", "/about/legal/imprint",
+		"node.json"}, &node); err != nil || len(node) == 0 {
+		t.Errorf("GetNodeData() = %s, %v", node, err)
+	}
+
+	if err := m.WriteNodeData(&WriteNodeDataArgs{Site: "example",
+		Path: "/about/legal/imprint", File: "node.json",
+		Content: []byte("{}")}, new(int)); err == nil ||
+		!strings.Contains(err.Error(), "read-only") {
+		t.Errorf("WriteNodeData() should fail for mounted nodes: %v", err)
+	}
+	if err := m.RemoveNode(&RemoveNodeArgs{"example", "/about/legal"},
+		new(int)); err == nil {
+		t.Errorf("RemoveNode() should fail for mounted nodes")
+	}
+	if err := m.CopyNode(&CopyNodeArgs{"example", "/about/legal/imprint",
+		"/imprint"}, new(int)); err != nil {
+		t.Errorf("CopyNode() returned error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(
+		m.Settings.Monsti.GetSiteNodesPath("example"),
+		"imprint/node.json")); err != nil {
+		t.Errorf("Mounted node should have been copied: %v", err)
+	}
+}
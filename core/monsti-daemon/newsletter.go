@@ -0,0 +1,611 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/chrneumann/htmlwidgets"
+	"github.com/chrneumann/mimemail"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// newsletterConfirmTimeout is the time after which unconfirmed
+// subscriptions get dropped.
+const newsletterConfirmTimeout = 7 * 24 * time.Hour
+
+// newsletterConfirmInterval is the minimal time between two
+// confirmation mails to the same address.
+const newsletterConfirmInterval = time.Hour
+
+// newsletterSubscriber is a subscriber of a site's newsletter.
+type newsletterSubscriber struct {
+	Email string
+	// Token identifies the subscriber in confirmation and unsubscribe
+	// links.
+	Token string
+	// Subscribed is the time of the subscription request.
+	Subscribed time.Time
+	// Confirmed is the time the subscription has been confirmed. It is
+	// zero for unconfirmed subscriptions.
+	Confirmed time.Time
+}
+
+// newsletterData holds the subscribers and sent issues of a site.
+type newsletterData struct {
+	Subscribers []*newsletterSubscriber
+	// Sent maps the paths of sent issues to the time they were sent.
+	Sent map[string]time.Time
+	// Partial maps the paths of issues whose sending failed to the
+	// tokens of the subscribers who already got them.
+	Partial map[string][]string `json:",omitempty"`
+}
+
+// newsletterMutex serializes updates of the newsletter data.
+var newsletterMutex sync.Mutex
+
+// newsletterPath returns the path to the newsletter data inside the
+// given site data directory.
+func newsletterPath(dataDir string) string {
+	return filepath.Join(dataDir, "newsletter.json")
+}
+
+// readNewsletter reads the newsletter data of the given site data
+// directory.
+func readNewsletter(dataDir string) (*newsletterData, error) {
+	data := &newsletterData{Sent: make(map[string]time.Time)}
+	content, err := ioutil.ReadFile(newsletterPath(dataDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return data, nil
+		}
+		return nil, fmt.Errorf("Could not read newsletter data: %v", err)
+	}
+	if err := json.Unmarshal(content, data); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal newsletter data: %v", err)
+	}
+	if data.Sent == nil {
+		data.Sent = make(map[string]time.Time)
+	}
+	return data, nil
+}
+
+// updateNewsletter calls fn with the newsletter data of the given site
+// data directory and writes the data back unless fn fails.
+func updateNewsletter(dataDir string, fn func(*newsletterData) error) error {
+	newsletterMutex.Lock()
+	defer newsletterMutex.Unlock()
+	data, err := readNewsletter(dataDir)
+	if err != nil {
+		return err
+	}
+	if err := fn(data); err != nil {
+		return err
+	}
+	content, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("Could not marshal newsletter data: %v", err)
+	}
+	if err := ioutil.WriteFile(newsletterPath(dataDir), content,
+		0600); err != nil {
+		return fmt.Errorf("Could not write newsletter data: %v", err)
+	}
+	return nil
+}
+
+// find returns the index of the subscriber matched by fn or -1.
+func (d *newsletterData) find(fn func(*newsletterSubscriber) bool) int {
+	for i, subscriber := range d.Subscribers {
+		if fn(subscriber) {
+			return i
+		}
+	}
+	return -1
+}
+
+// confirmed returns the confirmed subscribers.
+func (d *newsletterData) confirmed() []*newsletterSubscriber {
+	ret := make([]*newsletterSubscriber, 0, len(d.Subscribers))
+	for _, subscriber := range d.Subscribers {
+		if !subscriber.Confirmed.IsZero() {
+			ret = append(ret, subscriber)
+		}
+	}
+	return ret
+}
+
+// subscribe adds the address to the subscribers of the given site data
+// directory and returns the subscriber and whether a confirmation mail
+// should be sent. Expired unconfirmed subscriptions get dropped.
+//
+// Subscribing an unconfirmed address again renews the request, but at
+// most once per newsletterConfirmInterval. The returned subscriber is
+// already confirmed if the address has been subscribed before.
+func subscribe(dataDir, email string, now time.Time) (
+	*newsletterSubscriber, bool, error) {
+	var ret *newsletterSubscriber
+	confirm := false
+	err := updateNewsletter(dataDir, func(data *newsletterData) error {
+		subscribers := data.Subscribers[:0]
+		for _, subscriber := range data.Subscribers {
+			if !subscriber.Confirmed.IsZero() ||
+				now.Sub(subscriber.Subscribed) < newsletterConfirmTimeout {
+				subscribers = append(subscribers, subscriber)
+			}
+		}
+		data.Subscribers = subscribers
+		i := data.find(func(s *newsletterSubscriber) bool {
+			return strings.EqualFold(s.Email, email)
+		})
+		if i >= 0 {
+			ret = data.Subscribers[i]
+			if ret.Confirmed.IsZero() &&
+				now.Sub(ret.Subscribed) >= newsletterConfirmInterval {
+				ret.Subscribed = now
+				confirm = true
+			}
+			return nil
+		}
+		token := make([]byte, 16)
+		if _, err := rand.Read(token); err != nil {
+			return fmt.Errorf("Could not generate token: %v", err)
+		}
+		ret = &newsletterSubscriber{Email: email,
+			Token: hex.EncodeToString(token), Subscribed: now}
+		data.Subscribers = append(data.Subscribers, ret)
+		confirm = true
+		return nil
+	})
+	return ret, confirm, err
+}
+
+// confirmSubscription confirms the subscription with the given token.
+// It returns false if there is no such subscription.
+func confirmSubscription(dataDir, token string, now time.Time) (bool, error) {
+	found := false
+	err := updateNewsletter(dataDir, func(data *newsletterData) error {
+		i := data.find(func(s *newsletterSubscriber) bool {
+			return token != "" && s.Token == token
+		})
+		if i < 0 {
+			return nil
+		}
+		found = true
+		if data.Subscribers[i].Confirmed.IsZero() {
+			data.Subscribers[i].Confirmed = now
+		}
+		return nil
+	})
+	return found, err
+}
+
+// unsubscribe removes the subscriber matched by fn. It returns false
+// if there is no such subscriber.
+func unsubscribe(dataDir string, fn func(*newsletterSubscriber) bool) (
+	bool, error) {
+	found := false
+	err := updateNewsletter(dataDir, func(data *newsletterData) error {
+		i := data.find(fn)
+		if i < 0 {
+			return nil
+		}
+		found = true
+		data.Subscribers = append(data.Subscribers[:i], data.Subscribers[i+1:]...)
+		return nil
+	})
+	return found, err
+}
+
+// subscriberCSVHeader is the header row of exported subscribers.
+var subscriberCSVHeader = []string{"Email", "Subscribed", "Confirmed"}
+
+// exportSubscribers writes the subscribers as CSV. Times are formatted
+// according to RFC 3339, the confirmation time is empty for
+// unconfirmed subscribers.
+func exportSubscribers(subscribers []*newsletterSubscriber,
+	w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write(subscriberCSVHeader)
+	for _, subscriber := range subscribers {
+		var confirmed string
+		if !subscriber.Confirmed.IsZero() {
+			confirmed = subscriber.Confirmed.UTC().Format(time.RFC3339)
+		}
+		writer.Write([]string{subscriber.Email,
+			subscriber.Subscribed.UTC().Format(time.RFC3339), confirmed})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+var (
+	newsletterBreakRegexp     = regexp.MustCompile(`(?i)<br\s*/?>`)
+	newsletterParagraphRegexp = regexp.MustCompile(
+		`(?i)</(p|div|h[1-6]|li|tr|blockquote|pre|ul|ol|table)>`)
+	newsletterBlankRegexp = regexp.MustCompile(`\n{3,}`)
+)
+
+// newsletterText returns the plain text of the newsletter issue, i.e.
+// the underlined title followed by the body without markup.
+func newsletterText(node *service.Node) string {
+	var title, body string
+	if field := node.GetField("core.Title"); field != nil {
+		title = field.String()
+	}
+	if field := node.GetField("core.Body"); field != nil {
+		body = field.String()
+	}
+	body = newsletterBreakRegexp.ReplaceAllString(body, "\n")
+	body = newsletterParagraphRegexp.ReplaceAllString(body, "\n\n")
+	body = html.UnescapeString(tagRegexp.ReplaceAllString(body, ""))
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+	body = newsletterBlankRegexp.ReplaceAllString(
+		strings.TrimSpace(strings.Join(lines, "\n")), "\n\n")
+	return fmt.Sprintf("%v\n%v\n\n%v\n", title,
+		strings.Repeat("=", utf8.RuneCountInString(title)), body)
+}
+
+// newsletterConfirmMail returns the mail asking to confirm a
+// subscription by visiting the link.
+func newsletterConfirmMail(site util.SiteSettings, G func(string) string,
+	email, link string) *mimemail.Mail {
+	mail := mimemail.Mail{
+		From:    mimemail.Address{Name: site.EmailName, Email: site.EmailAddress},
+		Subject: fmt.Sprintf(G("Confirm your subscription to %v"), site.Title),
+		Body: []byte(fmt.Sprintf(G(`Hello,
+
+someone, possibly you, subscribed %v to the newsletter of "%v".
+
+To confirm your subscription, visit the following link within 7 days.
+If you did not subscribe, you may ignore this email.
+%v
+
+This is an automatically generated email. Please don't reply to it.
+`), email, site.Title, link))}
+	mail.To = []mimemail.Address{{Email: email}}
+	return &mail
+}
+
+// newsletterMail returns the mail delivering the issue with the given
+// text and online link to the subscriber.
+//
+// Subscribers may unsubscribe by visiting the link in the mail or
+// using their mail client (RFC 8058).
+func newsletterMail(site util.SiteSettings, G func(string) string,
+	subscriber *newsletterSubscriber, subject, text, link string) *mimemail.Mail {
+	unsubscribe := site.BaseURL + "/@@newsletter?" + url.Values{
+		"unsubscribe": {subscriber.Token}}.Encode()
+	mail := mimemail.Mail{
+		From:    mimemail.Address{Name: site.EmailName, Email: site.EmailAddress},
+		Subject: subject,
+		Body: []byte(fmt.Sprintf("%v\n-- \n%v\n%v\n", text,
+			fmt.Sprintf(G("Read online: %v"), link),
+			fmt.Sprintf(G("Unsubscribe: %v"), unsubscribe))),
+		Headers: map[string][]string{
+			"List-Unsubscribe":      {"<" + unsubscribe + ">"},
+			"List-Unsubscribe-Post": {"List-Unsubscribe=One-Click"}}}
+	mail.To = []mimemail.Address{{Email: subscriber.Email}}
+	return &mail
+}
+
+// errNewsletterSent is returned by sendNewsletter if the issue has
+// already been sent.
+var errNewsletterSent = errors.New("Newsletter has already been sent")
+
+// sendNewsletter sends the issue to all confirmed subscribers of the
+// site using sendFn. It returns the number of sent mails.
+//
+// Each issue is only sent once. If sending fails, the subscribers who
+// already got the issue are recorded and skipped when sending again.
+func sendNewsletter(site util.SiteSettings, dataDir string, G func(string) string,
+	node *service.Node, now time.Time,
+	sendFn func(*mimemail.Mail) error) (int, error) {
+	var subject string
+	if field := node.GetField("core.Title"); field != nil {
+		subject = field.String()
+	}
+	text := newsletterText(node)
+	link := site.BaseURL + node.Path + "/"
+	count := 0
+	var sendErr error
+	err := updateNewsletter(dataDir, func(data *newsletterData) error {
+		if _, sent := data.Sent[node.Path]; sent {
+			return errNewsletterSent
+		}
+		received := make(map[string]bool)
+		for _, token := range data.Partial[node.Path] {
+			received[token] = true
+		}
+		for _, subscriber := range data.confirmed() {
+			if received[subscriber.Token] {
+				continue
+			}
+			if err := sendFn(newsletterMail(site, G, subscriber, subject, text,
+				link)); err != nil {
+				sendErr = fmt.Errorf("Could not send newsletter to %v: %v",
+					subscriber.Email, err)
+				break
+			}
+			if data.Partial == nil {
+				data.Partial = make(map[string][]string)
+			}
+			data.Partial[node.Path] = append(data.Partial[node.Path],
+				subscriber.Token)
+			count++
+		}
+		if sendErr == nil {
+			delete(data.Partial, node.Path)
+			data.Sent[node.Path] = now
+		}
+		return nil
+	})
+	if err == nil {
+		err = sendErr
+	}
+	return count, err
+}
+
+type newsletterFormData struct {
+	Email string
+}
+
+// newsletterForm returns the subscription form.
+func newsletterForm(data *newsletterFormData,
+	G func(string) string) *htmlwidgets.Form {
+	form := htmlwidgets.NewForm(data)
+	form.AddWidget(&htmlwidgets.TextWidget{
+		Regexp:          `^[^@\s]+@[^@\s]+$`,
+		ValidationError: G("Please enter a valid email address.")},
+		"Email", G("Email"), "")
+	form.Action = "/@@newsletter"
+	return form
+}
+
+// renderNewsletter adds the subscription form to the context of
+// newsletter issues.
+func renderNewsletter(c *reqContext, context template.Context) {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	context["Form"] = newsletterForm(new(newsletterFormData), G).RenderData()
+}
+
+// Newsletter handles subscriptions to the site's newsletter, i.e.
+// subscribing (form value "Email"), confirming (form value "confirm")
+// and unsubscribing (form value "unsubscribe" posted by the visitor
+// or the mail client).
+func (h *nodeHandler) Newsletter(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if err := c.Req.ParseForm(); err != nil {
+		return fmt.Errorf("Could not parse form: %v", err)
+	}
+	dataDir := h.Settings.Monsti.GetSiteDataPath(c.Site.Name)
+	data := newsletterFormData{}
+	form := newsletterForm(&data, G)
+	context := template.Context{}
+	token := c.Req.Form.Get("unsubscribe")
+	switch {
+	case c.Req.Form.Get("confirm") != "":
+		found, err := confirmSubscription(dataDir, c.Req.Form.Get("confirm"),
+			time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("Could not confirm subscription: %v", err)
+		}
+		context["Confirmed"] = found
+		context["Invalid"] = !found
+	case token != "":
+		context["Token"] = token
+		if c.Req.Method != "POST" {
+			break
+		}
+		found, err := unsubscribe(dataDir, func(s *newsletterSubscriber) bool {
+			return s.Token == token
+		})
+		if err != nil {
+			return fmt.Errorf("Could not unsubscribe: %v", err)
+		}
+		context["Unsubscribed"] = found
+		context["Invalid"] = !found
+	case c.Req.Method == "GET":
+		_, subscribed := c.Req.Form["subscribed"]
+		context["Subscribed"] = subscribed
+	case c.Req.Method == "POST":
+		if !form.Fill(c.Req.Form) {
+			break
+		}
+		subscriber, confirm, err := subscribe(dataDir, data.Email,
+			time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("Could not subscribe: %v", err)
+		}
+		// Don't reveal whether the address is subscribed already.
+		if confirm {
+			mailG, _, _, _ := gettext.DefaultLocales.Use("", c.Site.Locale)
+			site := h.Settings.Monsti.Sites[c.Site.Name]
+			mail := newsletterConfirmMail(site, mailG, subscriber.Email,
+				site.BaseURL+"/@@newsletter?"+url.Values{
+					"confirm": {subscriber.Token}}.Encode())
+			if err := c.Serv.Monsti().SendSiteMail(c.Site.Name, mail); err != nil {
+				return fmt.Errorf("Could not send mail: %v", err)
+			}
+		}
+		http.Redirect(c.Res, c.Req, "/@@newsletter?subscribed",
+			http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	context["Form"] = form.RenderData()
+	body, err := h.Renderer.Render("actions/newsletter", context,
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render newsletter form: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("Newsletter")}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
+
+// Subscribers lists the newsletter subscribers of the site and
+// handles their removal and export.
+func (h *nodeHandler) Subscribers(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if err := c.Req.ParseForm(); err != nil {
+		return fmt.Errorf("Could not parse form: %v", err)
+	}
+	dataDir := h.Settings.Monsti.GetSiteDataPath(c.Site.Name)
+	switch c.Req.Method {
+	case "GET":
+	case "POST":
+		email := c.Req.Form.Get("remove")
+		if _, err := unsubscribe(dataDir, func(s *newsletterSubscriber) bool {
+			return s.Email == email
+		}); err != nil {
+			return fmt.Errorf("Could not remove subscriber: %v", err)
+		}
+		http.Redirect(c.Res, c.Req, "@@subscribers", http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	data, err := readNewsletter(dataDir)
+	if err != nil {
+		return err
+	}
+	if c.Req.Form.Get("export") == "csv" {
+		c.Res.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		c.Res.Header().Set("Content-Disposition",
+			"attachment; filename=subscribers.csv")
+		return exportSubscribers(data.Subscribers, c.Res)
+	}
+	body, err := h.Renderer.Render("actions/subscribers", template.Context{
+		"Subscribers": data.Subscribers,
+		"Confirmed":   len(data.confirmed())}, c.UserSession.Locale,
+		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render subscribers: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("Newsletter subscribers"),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
+
+// SendNewsletter publishes the newsletter issue and sends it to all
+// confirmed subscribers.
+func (h *nodeHandler) SendNewsletter(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if c.Node.Type == nil || c.Node.Type.Id != "core.Newsletter" {
+		return fmt.Errorf("Node %q is not a newsletter", c.Node.Path)
+	}
+	if err := c.Req.ParseForm(); err != nil {
+		return fmt.Errorf("Could not parse form: %v", err)
+	}
+	dataDir := h.Settings.Monsti.GetSiteDataPath(c.Site.Name)
+	context := template.Context{}
+	switch c.Req.Method {
+	case "GET":
+		context["Count"] = c.Req.Form.Get("count")
+	case "POST":
+		node := *c.Node
+		now := time.Now().UTC()
+		if !node.Public || node.PublishTime.After(now) {
+			node.Public = true
+			node.PublishTime = now
+			msg, err := writeNodeWithHooks(c, h, &node, nil,
+				&service.NodeEvent{Type: service.NodeChangedEvent})
+			if err != nil {
+				return err
+			}
+			if msg != "" {
+				context["Error"] = msg
+				break
+			}
+		}
+		mailG, _, _, _ := gettext.DefaultLocales.Use("", c.Site.Locale)
+		count, err := sendNewsletter(h.Settings.Monsti.Sites[c.Site.Name],
+			dataDir, mailG, &node, now, func(mail *mimemail.Mail) error {
+				return c.Serv.Monsti().SendSiteMail(c.Site.Name, mail)
+			})
+		if err == errNewsletterSent {
+			break
+		}
+		if err != nil {
+			h.Log.Printf("Could not send newsletter %v of site %v: %v",
+				node.Path, c.Site.Name, err)
+			context["Error"] = fmt.Sprintf(G(
+				"The newsletter has been sent to %v subscribers, but sending failed: %v. Send again to reach the remaining subscribers."),
+				count, err)
+			break
+		}
+		http.Redirect(c.Res, c.Req, "@@send-newsletter?count="+fmt.Sprint(count),
+			http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	data, err := readNewsletter(dataDir)
+	if err != nil {
+		return err
+	}
+	if sent, ok := data.Sent[c.Node.Path]; ok {
+		context["Sent"] = sent
+	}
+	context["Subscribers"] = len(data.confirmed())
+	body, err := h.Renderer.Render("actions/send-newsletter", context,
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render newsletter form: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   fmt.Sprintf(G("Send \"%v\""), c.Node.Path),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
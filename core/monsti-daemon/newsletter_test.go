@@ -0,0 +1,253 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrneumann/mimemail"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestNewsletterSubscriptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-TestNewsletterSubscriptions")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Date(2014, 3, 7, 14, 5, 0, 0, time.UTC)
+	foo, confirm, err := subscribe(dir, "foo@example.com", now)
+	if err != nil {
+		t.Fatalf("subscribe returned error: %v", err)
+	}
+	if foo.Token == "" || !foo.Confirmed.IsZero() || !confirm {
+		t.Errorf("New subscriber is %+v, should be unconfirmed with token", foo)
+	}
+	again, confirm, err := subscribe(dir, "foo@example.com",
+		now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("subscribe returned error: %v", err)
+	}
+	if confirm || !again.Subscribed.Equal(now) {
+		t.Errorf("Subscribing again within %v should not renew %+v",
+			newsletterConfirmInterval, again)
+	}
+	again, confirm, err = subscribe(dir, "FOO@example.com", now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("subscribe returned error: %v", err)
+	}
+	if again.Token != foo.Token || !again.Subscribed.Equal(now.Add(time.Hour)) ||
+		!confirm {
+		t.Errorf("Subscribing again returned %+v, should renew %+v", again, foo)
+	}
+	if found, err := confirmSubscription(dir, "unknown", now); found ||
+		err != nil {
+		t.Errorf("confirmSubscription(unknown) = %v, %v, should be false, nil",
+			found, err)
+	}
+	if found, err := confirmSubscription(dir, foo.Token, now); !found ||
+		err != nil {
+		t.Errorf("confirmSubscription(foo) = %v, %v, should be true, nil",
+			found, err)
+	}
+	if _, _, err := subscribe(dir, "bar@example.com", now); err != nil {
+		t.Fatalf("subscribe returned error: %v", err)
+	}
+	// Adding baz drops bar's expired request.
+	if _, _, err := subscribe(dir, "baz@example.com",
+		now.Add(newsletterConfirmTimeout)); err != nil {
+		t.Fatalf("subscribe returned error: %v", err)
+	}
+	data, err := readNewsletter(dir)
+	if err != nil {
+		t.Fatalf("readNewsletter returned error: %v", err)
+	}
+	var emails []string
+	for _, subscriber := range data.Subscribers {
+		emails = append(emails, subscriber.Email)
+	}
+	if strings.Join(emails, " ") != "foo@example.com baz@example.com" {
+		t.Errorf("Subscribers are %v, should be foo and baz", emails)
+	}
+	if confirmed := data.confirmed(); len(confirmed) != 1 ||
+		confirmed[0].Email != "foo@example.com" {
+		t.Errorf("Confirmed subscribers are %v, should be foo", confirmed)
+	}
+
+	var out bytes.Buffer
+	if err := exportSubscribers(data.Subscribers, &out); err != nil {
+		t.Fatalf("exportSubscribers returned error: %v", err)
+	}
+	expected := `Email,Subscribed,Confirmed
+foo@example.com,2014-03-07T15:05:00Z,2014-03-07T14:05:00Z
+baz@example.com,2014-03-14T14:05:00Z,
+`
+	if out.String() != expected {
+		t.Errorf("exportSubscribers wrote\n%v\nshould be\n%v", out.String(),
+			expected)
+	}
+
+	found, err := unsubscribe(dir, func(s *newsletterSubscriber) bool {
+		return s.Token == foo.Token
+	})
+	if !found || err != nil {
+		t.Errorf("unsubscribe(foo) = %v, %v, should be true, nil", found, err)
+	}
+	if data, _ := readNewsletter(dir); len(data.Subscribers) != 1 {
+		t.Errorf("Subscribers are %v, should be baz", data.Subscribers)
+	}
+}
+
+func TestNewsletterText(t *testing.T) {
+	node := service.Node{Fields: map[string]service.Field{}}
+	title := service.TextField("Spring news")
+	body := service.HTMLField(`<h2>Hello &amp; welcome!</h2>
+<p>First   <strong>paragraph</strong><br/>with a break.</p>
+
+<ul><li>One</li><li>Two</li></ul>`)
+	node.Fields["core.Title"] = &title
+	node.Fields["core.Body"] = &body
+	expected := `Spring news
+===========
+
+Hello & welcome!
+
+First paragraph
+with a break.
+
+One
+
+Two
+`
+	if text := newsletterText(&node); text != expected {
+		t.Errorf("newsletterText() = %q, should be %q", text, expected)
+	}
+}
+
+func TestSendNewsletter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-TestSendNewsletter")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now().UTC()
+	for _, email := range []string{"foo@example.com", "bar@example.com"} {
+		subscriber, _, err := subscribe(dir, email, now)
+		if err != nil {
+			t.Fatalf("subscribe returned error: %v", err)
+		}
+		if email == "foo@example.com" {
+			confirmSubscription(dir, subscriber.Token, now)
+		}
+	}
+	site := util.SiteSettings{BaseURL: "http://example.com",
+		EmailAddress: "news@example.com"}
+	title := service.TextField("Spring news")
+	node := service.Node{Path: "/news/spring",
+		Fields: map[string]service.Field{"core.Title": &title}}
+	G := func(in string) string { return in }
+	var sent []*mimemail.Mail
+	send := func(mail *mimemail.Mail) error {
+		sent = append(sent, mail)
+		return nil
+	}
+	count, err := sendNewsletter(site, dir, G, &node, now, send)
+	if err != nil || count != 1 {
+		t.Fatalf("sendNewsletter() = %v, %v, should be 1, nil", count, err)
+	}
+	if len(sent) != 1 || sent[0].To[0].Email != "foo@example.com" ||
+		sent[0].Subject != "Spring news" {
+		t.Fatalf("Sent mails are %v, should be one mail to foo", sent)
+	}
+	data, _ := readNewsletter(dir)
+	unsubscribe := "http://example.com/@@newsletter?unsubscribe=" +
+		data.Subscribers[0].Token
+	if header := sent[0].Headers["List-Unsubscribe"]; len(header) != 1 ||
+		header[0] != "<"+unsubscribe+">" {
+		t.Errorf("List-Unsubscribe is %v, should be <%v>", header, unsubscribe)
+	}
+	if body := string(sent[0].Body); !strings.Contains(body,
+		"http://example.com/news/spring/") ||
+		!strings.Contains(body, unsubscribe) {
+		t.Errorf("Body should contain online and unsubscribe links:\n%v", body)
+	}
+	if _, err := sendNewsletter(site, dir, G, &node, now,
+		send); err != errNewsletterSent {
+		t.Errorf("Sending again returned %v, should be %v", err,
+			errNewsletterSent)
+	}
+	if len(sent) != 1 {
+		t.Errorf("Newsletter has been sent again")
+	}
+}
+
+func TestSendNewsletterPartially(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-TestSendNewsletterPartially")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now().UTC()
+	for _, email := range []string{"foo@example.com", "bar@example.com",
+		"baz@example.com"} {
+		subscriber, _, err := subscribe(dir, email, now)
+		if err != nil {
+			t.Fatalf("subscribe returned error: %v", err)
+		}
+		confirmSubscription(dir, subscriber.Token, now)
+	}
+	title := service.TextField("Spring news")
+	node := service.Node{Path: "/news/spring",
+		Fields: map[string]service.Field{"core.Title": &title}}
+	G := func(in string) string { return in }
+	received := make(map[string]int)
+	failing := "bar@example.com"
+	send := func(mail *mimemail.Mail) error {
+		if mail.To[0].Email == failing {
+			return errors.New("queue full")
+		}
+		received[mail.To[0].Email]++
+		return nil
+	}
+	count, err := sendNewsletter(util.SiteSettings{}, dir, G, &node, now, send)
+	if err == nil || count != 1 {
+		t.Fatalf("sendNewsletter() = %v, %v, should fail after 1 mail", count,
+			err)
+	}
+	failing = ""
+	count, err = sendNewsletter(util.SiteSettings{}, dir, G, &node, now, send)
+	if err != nil || count != 2 {
+		t.Fatalf("Sending again returned %v, %v, should be 2, nil", count, err)
+	}
+	for _, email := range []string{"foo@example.com", "bar@example.com",
+		"baz@example.com"} {
+		if received[email] != 1 {
+			t.Errorf("%v got %v mails, should be 1", email, received[email])
+		}
+	}
+	if data, _ := readNewsletter(dir); len(data.Partial) != 0 ||
+		data.Sent[node.Path].IsZero() {
+		t.Errorf("Issue should be recorded as sent: %+v", data)
+	}
+}
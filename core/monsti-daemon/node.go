@@ -18,10 +18,10 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"html/template"
-	"image/jpeg"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path"
@@ -30,7 +30,6 @@ import (
 	"time"
 
 	"github.com/chrneumann/htmlwidgets"
-	"github.com/nfnt/resize"
 	"pkg.monsti.org/gettext"
 	"pkg.monsti.org/monsti/api/service"
 	"pkg.monsti.org/monsti/api/util"
@@ -41,6 +40,7 @@ import (
 type navLink struct {
 	Name, Target               string
 	Active, ActiveBelow, Child bool
+	Pinned                     bool
 	Order                      int
 }
 
@@ -54,6 +54,9 @@ func (n navigation) Len() int {
 // Less returns whether the element with index i should sort
 // before the element with index j.
 func (n navigation) Less(i, j int) bool {
+	if n[i].Pinned != n[j].Pinned {
+		return n[i].Pinned
+	}
 	return n[i].Order < n[j].Order || (n[i].Order == n[j].Order &&
 		n[i].Name < n[j].Name)
 }
@@ -97,7 +100,7 @@ func getNav(nodePath, active string, public bool,
 		childrenNavLinks = append(childrenNavLinks, navLink{
 			Name:   getNodeTitle(child),
 			Target: path.Join(nodePath, child.Name()),
-			Child:  true, Order: child.Order})
+			Child:  true, Pinned: child.Pinned, Order: child.Order})
 	}
 	if len(childrenNavLinks) == 0 {
 		if nodePath == "/" || path.Dir(nodePath) == "/" {
@@ -115,7 +118,7 @@ func getNav(nodePath, active string, public bool,
 		}
 		siblingsNavLinks = append(siblingsNavLinks, navLink{
 			Name:   getNodeTitle(node),
-			Target: nodePath, Order: node.Order})
+			Target: nodePath, Pinned: node.Pinned, Order: node.Order})
 	} else if nodePath != "/" {
 		parent := path.Dir(nodePath)
 		siblings, err := getChildrenFn(parent)
@@ -128,7 +131,8 @@ func getNav(nodePath, active string, public bool,
 			}
 			siblingsNavLinks = append(siblingsNavLinks, navLink{
 				Name:   getNodeTitle(sibling),
-				Target: path.Join(nodePath, "..", sibling.Name()), Order: sibling.Order})
+				Target: path.Join(nodePath, "..", sibling.Name()),
+				Pinned: sibling.Pinned, Order: sibling.Order})
 		}
 	}
 	sort.Sort(&siblingsNavLinks)
@@ -238,8 +242,18 @@ func (h *nodeHandler) Remove(c *reqContext) error {
 	default:
 		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
 	}
+	refs, err := getReferencesTo(c.Node.Path,
+		func(nodePath string) (*service.Node, error) {
+			return c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
+		},
+		func(nodePath string) ([]*service.Node, error) {
+			return c.Serv.Monsti().GetChildren(c.Site.Name, nodePath)
+		})
+	if err != nil {
+		return fmt.Errorf("Could not get references to node: %v", err)
+	}
 	body, err := h.Renderer.Render("actions/removeform", mtemplate.Context{
-		"Form": form.RenderData(), "Node": c.Node},
+		"Form": form.RenderData(), "Node": c.Node, "References": refs},
 		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
 	if err != nil {
 		panic("Can't render node remove formular: " + err.Error())
@@ -251,10 +265,17 @@ func (h *nodeHandler) Remove(c *reqContext) error {
 	return nil
 }
 
-type imageSize struct{ Width, Height uint }
-
-func (s imageSize) String() string {
-	return fmt.Sprintf("%vx%v", s.Width, s.Height)
+// serveNodeFile writes the given file content of the requested node.
+//
+// Range and conditional requests are answered using the node's change
+// time and an ETag derived from the content. The content type is
+// detected by the file name's extension or the content if not set
+// before.
+func serveNodeFile(c *reqContext, name string, content []byte) {
+	sum := sha1.Sum(content)
+	c.Res.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	http.ServeContent(c.Res, c.Req, name, c.Node.Changed,
+		bytes.NewReader(content))
 }
 
 // ViewNode handles node views.
@@ -265,55 +286,62 @@ func (h *nodeHandler) View(c *reqContext) error {
 		return err
 	}
 
+	if err := setCacheHeaders(c); err != nil {
+		return err
+	}
+
+	if c.FieldFile != "" {
+		return h.serveFieldFile(c)
+	}
+
 	// Redirect if trailing slash is missing and if this is not a file
 	// node (in which case we write out the file's content).
 	if c.Node.Path[len(c.Node.Path)-1] != '/' {
-		if c.Node.Type.Id == "core.Image" || c.Node.Type.Id == "core.File" {
-			c.Res.Header().Add("Last-Modified", c.Node.Changed.Format(time.RFC1123))
-		}
 		if c.Node.Type.Id == "core.Image" {
-			sizeName := c.Req.FormValue("size")
-			var size imageSize
+			sizeName := c.ImageSize
+			if sizeName == "" {
+				sizeName = c.Req.FormValue("size")
+			}
+			settings, err := getImageSettings(c)
+			if err != nil {
+				return err
+			}
+			if len(settings.Formats) > 0 {
+				c.Res.Header().Add("Vary", "Accept")
+			}
+			format := acceptedImageFormat(c, settings.Formats)
 			var body []byte
-			var err error
-			if sizeName != "" {
-				err = c.Serv.Monsti().GetSiteConfig(c.Site.Name,
-					"core.image.sizes."+sizeName, &size)
-				if err != nil || size.Width == 0 {
+			if size, ok := settings.Sizes[sizeName]; ok {
+				if format != "" {
+					body, err = getSizedImage(c, c.Node.Path, size, format)
 					if err != nil {
-						h.Log.Printf("Could not get size config: %v", err)
+						h.Log.Printf("Could not get %v derivative of %q: %v", format,
+							c.Node.Path, err)
+						body = nil
 					} else {
-						h.Log.Printf("Could not find size %q for site %q: %v", sizeName,
-							c.Site.Name, err)
+						c.Res.Header().Set("Content-Type", imageFormats[format].MIMEType)
 					}
-				} else {
-					sizePath := "__image_" + size.String()
-					body, err = c.Serv.Monsti().GetNodeData(c.Site.Name, c.Node.Path,
-						sizePath)
-					if err != nil || body == nil {
-						body, err = c.Serv.Monsti().GetNodeData(c.Site.Name, c.Node.Path,
-							"__file_core.File")
-						if err != nil {
-							return fmt.Errorf("Could not get image data: %v", err)
-						}
-						image, err := jpeg.Decode(bytes.NewBuffer(body))
-						if err != nil {
-							return fmt.Errorf("Could not decode image data: %v", err)
-						}
-						image = resize.Thumbnail(size.Width, size.Height, image,
-							resize.Lanczos3)
-						var out bytes.Buffer
-						err = jpeg.Encode(&out, image, nil)
-						body = out.Bytes()
-						if err != nil {
-							return fmt.Errorf("Could not encode resized image: %v", err)
-						}
-						if err := c.Serv.Monsti().WriteNodeData(c.Site.Name, c.Node.Path,
-							sizePath, body); err != nil {
-							return fmt.Errorf("Could not write resized image data: %v", err)
-						}
+				}
+				if body == nil {
+					body, err = getSizedImage(c, c.Node.Path, size, "")
+					if err != nil {
+						return err
 					}
 				}
+			} else if sizeName != "" {
+				h.Log.Printf("Could not find size %q for site %q", sizeName,
+					c.Site.Name)
+			} else if format != "" {
+				body, err = c.Serv.Monsti().GetNodeData(c.Site.Name, c.Node.Path,
+					"__image_"+format)
+				if err != nil {
+					return fmt.Errorf("Could not read image derivative: %v", err)
+				}
+				if len(body) > 0 {
+					c.Res.Header().Set("Content-Type", imageFormats[format].MIMEType)
+				} else {
+					body = nil
+				}
 			}
 			if body == nil {
 				body, err = c.Serv.Monsti().GetNodeData(c.Site.Name, c.Node.Path,
@@ -322,16 +350,23 @@ func (h *nodeHandler) View(c *reqContext) error {
 					return fmt.Errorf("Could not read image: %v", err)
 				}
 			}
-			c.Res.Write(body)
+			serveNodeFile(c, path.Base(c.Node.Path), body)
 		} else if c.Node.Type.Id == "core.File" {
 			content, err := c.Serv.Monsti().GetNodeData(c.Site.Name, c.Node.Path,
 				"__file_core.File")
 			if err != nil {
 				return fmt.Errorf("Could not read file: %v", err)
 			}
-			c.Res.Write(content)
+			serveNodeFile(c, path.Base(c.Node.Path), content)
 		} else {
-			newPath, err := url.Parse(c.Node.Path + "/")
+			nodePath, err := localizedNodePath(c.PathLocale, c.PathLocale != "",
+				c.Node.Path, func(nodePath string) (*service.Node, error) {
+					return c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
+				})
+			if err != nil {
+				return fmt.Errorf("Could not get localized path: %v", err)
+			}
+			newPath, err := url.Parse(nodePath + "/")
 			if err != nil {
 				serveError("Could not parse request URL: %v", err)
 			}
@@ -341,17 +376,39 @@ func (h *nodeHandler) View(c *reqContext) error {
 		return nil
 	}
 
+	changed, err := handleExperiments(c)
+	if err != nil {
+		return fmt.Errorf("Could not handle experiments: %v", err)
+	}
+	if changed {
+		if err := c.Session.Save(c.Req, c.Res); err != nil {
+			return fmt.Errorf("Could not save user session: %v", err)
+		}
+	}
+	c.Node, err = translateNode(c.Node, c.Locale)
+	if err != nil {
+		return fmt.Errorf("Could not translate node: %v", err)
+	}
+
 	rendered, err := h.RenderNode(c, nil)
 	if err != nil {
 		return fmt.Errorf("Could not render node: %v", err)
 	}
+	comments, err := renderComments(c, h)
+	if err != nil {
+		return fmt.Errorf("Could not render comments: %v", err)
+	}
+	rendered = append(rendered, comments...)
 
-	env := masterTmplEnv{Node: c.Node, Session: c.UserSession}
+	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
+		Meta: getPageMeta(c.Node, getNodeTitle(c.Node), c.Site.BaseURL)}
 	var content []byte
 	content = []byte(renderInMaster(h.Renderer, rendered, env, h.Settings,
 		*c.Site, c.UserSession.Locale, c.Serv))
 
-	c.Res.Write(content)
+	sum := sha1.Sum(content)
+	c.Res.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	http.ServeContent(c.Res, c.Req, "", time.Time{}, bytes.NewReader(content))
 	return nil
 }
 
@@ -363,22 +420,43 @@ func (h *nodeHandler) RenderNode(c *reqContext, embedNode *service.EmbedNode) (
 	[]byte, error) {
 	reqNode := c.Node
 	if embedNode != nil {
-		embedURL, err := url.Parse(embedNode.URI)
+		target, err := embedPath(reqNode.Path, embedNode)
 		if err != nil {
-			return nil, fmt.Errorf("Could not parse embed URI: %v", err)
+			return nil, err
 		}
-		embedPath := path.Join(reqNode.Path, embedURL.Path)
-		reqNode, err = c.Serv.Monsti().GetNode(c.Site.Name, embedPath)
-		if err != nil || reqNode == nil {
+		reqNode, err = c.Serv.Monsti().GetNode(c.Site.Name, target)
+		if err != nil {
 			return nil, fmt.Errorf("Could not find node to embed: %v", err)
 		}
+		if reqNode == nil {
+			return nil, errMissingEmbed
+		}
+		reqNode, err = translateNode(reqNode, c.Locale)
+		if err != nil {
+			return nil, fmt.Errorf("Could not translate embedded node: %v", err)
+		}
+	}
+	if err := computeRequestFields(c, reqNode, true); err != nil {
+		return nil, err
+	}
+	// Shortcodes of embedded nodes are kept, e.g. to not embed forms
+	// recursively.
+	if embedNode == nil {
+		var err error
+		if reqNode, err = h.expandNodeShortcodes(c, reqNode); err != nil {
+			return nil, err
+		}
 	}
 	context := make(mtemplate.Context)
 	context["Embed"] = make(map[string]template.HTML)
 	// Embed nodes
-	embedNodes := append(reqNode.Type.Embed, reqNode.Embed...)
+	embedNodes := append(append([]service.EmbedNode(nil),
+		reqNode.Type.Embed...), reqNode.Embed...)
 	for _, embed := range embedNodes {
 		rendered, err := h.RenderNode(c, &embed)
+		if err == errMissingEmbed {
+			rendered, err = h.renderBrokenReference(c, &embed)
+		}
 		if err != nil {
 			return nil, fmt.Errorf("Could not render embed node: %v", err)
 		}
@@ -388,9 +466,27 @@ func (h *nodeHandler) RenderNode(c *reqContext, embedNode *service.EmbedNode) (
 	context["Node"] = reqNode
 	switch reqNode.Type.Id {
 	case "core.ContactForm":
-		if err := renderContactForm(c, context, c.Req.Form, h); err != nil {
+		if embedNode == nil && len(reqNode.FormSteps) > 0 {
+			if err := renderFormWizard(c, context, c.Req.Form, h); err != nil {
+				return nil, fmt.Errorf("Could not render form wizard: %v", err)
+			}
+		} else if err := renderContactForm(c, context, c.Req.Form, h); err != nil {
 			return nil, fmt.Errorf("Could not render contact form: %v", err)
 		}
+	case "core.Form":
+		if embedNode == nil && len(reqNode.FormSteps) > 0 {
+			if err := renderFormWizard(c, context, c.Req.Form, h); err != nil {
+				return nil, fmt.Errorf("Could not render form wizard: %v", err)
+			}
+		} else if err := renderForm(c, context, c.Req.Form, h); err != nil {
+			return nil, fmt.Errorf("Could not render form: %v", err)
+		}
+	case "core.Newsletter":
+		renderNewsletter(c, context)
+	case "core.Gallery":
+		if err := renderGallery(c, context, reqNode); err != nil {
+			return nil, fmt.Errorf("Could not render gallery: %v", err)
+		}
 	}
 	context["Embedded"] = embedNode != nil
 
@@ -406,25 +502,87 @@ func (h *nodeHandler) RenderNode(c *reqContext, embedNode *service.EmbedNode) (
 		}
 	}
 
-	template := strings.Replace(reqNode.Type.Id, ".", "/", 1) + "-view"
-	if overwrite, ok := reqNode.TemplateOverwrites[template]; ok {
-		template = overwrite.Template
+	view := "view"
+	if len(reqNode.View) > 0 {
+		view = reqNode.View
 	}
+	if embedNode != nil && len(embedNode.View) > 0 {
+		view = embedNode.View
+	}
+	siteTemplates := h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name)
+	template := findViewTemplate(reqNode, view, func(name string) bool {
+		return h.Renderer.Exists(name, siteTemplates)
+	})
 
 	context["Site"] = c.Site
-	rendered, err := h.Renderer.Render(template, context,
-		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	context["View"] = view
+	renderer := h.Renderer
+	renderer.Funcs = imageFuncs(c)
+	for name, fn := range assetFuncs(h.Settings, c.Site.Name, c.Serv) {
+		renderer.Funcs[name] = fn
+	}
+	renderer.SandboxFuncs = []string{"asset", "responsiveImage"}
+	rendered, err := renderer.Render(template, context,
+		c.UserSession.Locale, siteTemplates)
 	if err != nil {
 		return nil, fmt.Errorf("Could not render template: %v", err)
 	}
 	return []byte(rendered), nil
 }
 
+// viewTemplates returns the templates of the given view of a node
+// type in order of preference.
+//
+// Falls back to the templates of the default view.
+func viewTemplates(nodeType *service.NodeType, view string) []string {
+	templates := make([]string, 0)
+	for _, id := range []string{view, "view"} {
+		declared := false
+		for _, typeView := range nodeType.Views {
+			if typeView.Id == id && len(typeView.Templates) > 0 {
+				templates = append(templates, typeView.Templates...)
+				declared = true
+			}
+		}
+		if !declared {
+			templates = append(templates,
+				strings.Replace(nodeType.Id, ".", "/", 1)+"-"+id)
+		}
+		if view == "view" {
+			break
+		}
+	}
+	return templates
+}
+
+// findViewTemplate returns the template to render the given view of
+// the node.
+//
+// The node's template overwrites are applied to each template. The
+// first existing template is returned, or the first template if none
+// exists.
+func findViewTemplate(node *service.Node, view string,
+	exists func(name string) bool) string {
+	templates := viewTemplates(node.Type, view)
+	for i, template := range templates {
+		if overwrite, ok := node.TemplateOverwrites[template]; ok {
+			templates[i] = overwrite.Template
+		}
+	}
+	for _, template := range templates {
+		if exists(template) {
+			return template
+		}
+	}
+	return templates[0]
+}
+
 type editFormData struct {
 	NodeType string
 	Name     string
 	Node     service.Node
 	Fields   util.NestedMap
+	SEO      service.SEOMetadata
 }
 
 // EditNode handles node edits.
@@ -450,6 +608,26 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 		// TODO Check if node type may be added to this node
 	}
 
+	var locales []string
+	if c.Action == service.EditAction && !newNode {
+		var err error
+		locales, err = getContentLocales(c)
+		if err != nil {
+			return err
+		}
+		if locale := c.Req.FormValue("locale"); locale != "" {
+			for _, contentLocale := range locales[1:] {
+				if locale == contentLocale {
+					return h.editTranslation(c, locale, locales)
+				}
+			}
+			return fmt.Errorf("Unknown content locale %q", locale)
+		}
+		if len(locales) < 2 {
+			locales = nil
+		}
+	}
+
 	env := masterTmplEnv{Node: c.Node, Session: c.UserSession}
 
 	if c.Action == service.EditAction {
@@ -481,6 +659,8 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 	if !nodeType.Hide {
 		form.AddWidget(new(htmlwidgets.BoolWidget), "Node.Hide", G("Hide"), G("Don't show node in navigation."))
 	}
+	form.AddWidget(new(htmlwidgets.BoolWidget), "Node.Pinned", G("Pinned"),
+		G("List the node before other nodes, e.g. for announcements."))
 	form.AddWidget(new(htmlwidgets.IntegerWidget), "Node.Order", G("Order"), G("Order in navigation or listings (lower numbered entries appear first)."))
 	form.AddWidget(new(htmlwidgets.BoolWidget), "Node.Public", G("Public"), G("Is the node accessible by every visitor?"))
 	var timezone string
@@ -503,7 +683,11 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 	}
 	if !newNode {
 		formData.Name = c.Node.Name()
+		if c.Node.SEO != nil {
+			formData.SEO = *c.Node.SEO
+		}
 	}
+	seoFields := addSEOWidgets(form, G)
 
 	fileFields := make([]string, 0)
 	nodeFields := nodeType.Fields
@@ -511,19 +695,66 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 		nodeFields = append(nodeFields, c.Node.LocalFields...)
 	}
 	for _, field := range nodeFields {
+		if field.Compute != "" {
+			continue
+		}
 		formData.Node.GetField(field.Id).ToFormField(form, formData.Fields,
 			field, c.UserSession.Locale)
-		if field.Type == "File" {
+		if field.Type == "File" || field.Type == "Video" ||
+			field.Type == "Audio" {
 			fileFields = append(fileFields, field.Id)
 		}
 	}
 
+	dataDir := h.Settings.Monsti.GetSiteDataPath(c.Site.Name)
+	login := c.UserSession.User.Login
+	draftType := ""
+	if newNode {
+		draftType = nodeType.Id
+	}
+	savedDraft, err := getDraft(dataDir, login, c.Node.Path, draftType)
+	if err != nil {
+		return err
+	}
+	restored := false
+
 	switch c.Req.Method {
 	case "GET":
 	case "POST":
-		if len(c.Req.FormValue("New")) == 0 && form.Fill(c.Req.Form) {
+		if len(c.Req.FormValue("Autosave")) > 0 {
+			if err := saveDraft(dataDir, &draft{
+				User:     login,
+				Path:     c.Node.Path,
+				NodeType: draftType,
+				Values:   draftFormValues(c.Req.PostForm),
+				Saved:    time.Now().UTC()}); err != nil {
+				return err
+			}
+			c.Res.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+		switch c.Req.FormValue("Draft") {
+		case "restore":
+			if savedDraft != nil {
+				form.Fill(savedDraft.Values)
+				restored = true
+			}
+		case "discard":
+			if err := removeDraft(dataDir, login, c.Node.Path,
+				draftType); err != nil {
+				return err
+			}
+			savedDraft = nil
+		}
+		if len(c.Req.FormValue("New")) == 0 &&
+			len(c.Req.FormValue("Draft")) == 0 && form.Fill(c.Req.Form) {
 			node := formData.Node
 			node.Type = nodeType
+			node.SEO = nil
+			if formData.SEO != (service.SEOMetadata{}) {
+				seo := formData.SEO
+				node.SEO = &seo
+			}
 			pathPrefix := node.GetPathPrefix()
 			oldPath := c.Node.Path
 			parentPath := c.Node.GetParentPath()
@@ -532,6 +763,9 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 			}
 			node.Path = path.Join(parentPath, pathPrefix, formData.Name)
 			renamed := !newNode && c.Node.Name() != "" && oldPath != node.Path
+			if len(c.Req.FormValue("Preview")) > 0 {
+				return h.previewNode(c, &node, nodeFields, formData.Fields)
+			}
 			writeNode := true
 			if newNode || renamed {
 				existing, err := c.Serv.Monsti().GetNode(c.Site.Name, node.Path)
@@ -546,6 +780,85 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 					return fmt.Errorf("Could not init node fields: %v", err)
 				}
 			}
+			posters := make(map[string][]byte)
+			if writeNode {
+				for _, name := range fileFields {
+					file, err := formFile(c, h, name)
+					if err != nil {
+						return err
+					}
+					media, isMedia := node.GetField(name).(*service.MediaField)
+					if isMedia && file == nil && renamed {
+						// Fields have been reset by InitFields.
+						if old, ok := c.Node.GetField(name).(*service.MediaField); ok {
+							media.MIMEType, media.Duration, media.Poster =
+								old.MIMEType, old.Duration, old.Poster
+						}
+					}
+					if file == nil {
+						continue
+					}
+					// Screen the upload before processing it further.
+					reason, err := screenUpload(c, h, quarantinedFile{
+						Name: file.Name, Node: node.Path, Field: name}, file.Content)
+					if err != nil {
+						return fmt.Errorf("Could not scan upload: %v", err)
+					}
+					if reason != "" {
+						form.AddError("Fields."+name, fmt.Sprintf(
+							G("The file has been quarantined for review: %v"), reason))
+						writeNode = false
+						continue
+					}
+					if isMedia {
+						mimeType := mediaMIMEType(media.Kind(), file.Content)
+						if mimeType == "" {
+							msg := G("Please choose an audio file.")
+							if media.Kind() == "video" {
+								msg = G("Please choose a video file.")
+							}
+							form.AddError("Fields."+name, msg)
+							writeNode = false
+							continue
+						}
+						media.MIMEType = mimeType
+						media.Duration, _ = mediaDuration(mimeType, file.Content)
+						media.Poster = false
+						if media.Kind() == "video" {
+							poster, err := generatePoster(c, h, node.Path, name,
+								file.Content)
+							if err != nil {
+								form.AddError("Fields."+name, fmt.Sprintf(
+									G("The poster frame could not be generated: %v"), err))
+								writeNode = false
+								continue
+							}
+							media.Poster = poster != nil
+							posters[name] = poster
+						}
+					}
+				}
+			}
+			for _, field := range nodeFields {
+				validator, ok := node.GetField(field.Id).(service.FormFieldValidator)
+				if !ok || field.Compute != "" {
+					continue
+				}
+				if msg := validator.ValidateFormField(formData.Fields, field,
+					c.UserSession.Locale); msg != "" {
+					form.AddError("Fields."+field.Id, msg)
+					writeNode = false
+				}
+			}
+			if writeNode && node.Public {
+				err := h.runHooks(c, h.Settings.Hooks.Publish.Pre,
+					publishHookEnv(c, "pre", node.Path))
+				if err != nil {
+					form.AddError("", fmt.Sprintf(G("The node could not be published: %v"),
+						err))
+					writeNode = false
+				}
+			}
 			if writeNode {
 				if renamed {
 					err := c.Serv.Monsti().RenameNode(c.Site.Name, c.Node.Path, node.Path)
@@ -554,37 +867,108 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 					}
 				}
 				for _, field := range nodeFields {
-					node.GetField(field.Id).FromFormField(formData.Fields, field)
+					if field.Compute == "" {
+						node.GetField(field.Id).FromFormField(formData.Fields, field)
+					}
+				}
+				allowlist, err := getHTMLAllowlist(c.Serv, c.Site.Name)
+				if err != nil {
+					return err
 				}
-				err := c.Serv.Monsti().WriteNode(c.Site.Name, node.Path, &node)
+				sanitizeHTMLFields(&node, allowlist)
+				if err := computeRequestFields(c, &node, false); err != nil {
+					return err
+				}
+				err = c.Serv.Monsti().WriteNode(c.Site.Name, node.Path, &node)
 				if err != nil {
 					return fmt.Errorf("Could not update node: ", err)
 				}
+				events := []*service.NodeEvent{{Type: service.NodeChangedEvent}}
+				oldNode := c.Node
+				if newNode {
+					events[0].Type = service.NodeCreatedEvent
+					oldNode = nil
+				} else if renamed {
+					events = append([]*service.NodeEvent{{
+						Type: service.NodeRenamedEvent,
+						From: oldPath, To: node.Path}}, events...)
+				}
+				refEvents, err := referenceEvents(oldNode, &node)
+				if err != nil {
+					return fmt.Errorf("Could not compare references: %v", err)
+				}
+				if err := recordNodeEvents(c, node.Path,
+					append(events, refEvents...)...); err != nil {
+					return err
+				}
 
-				if len(fileFields) > 0 && c.Req.MultipartForm != nil {
-					for _, name := range fileFields {
-						file, _, err := c.Req.FormFile("Fields." + name)
-						if err == nil {
-							content, err := ioutil.ReadAll(file)
-							if err != nil {
-								return fmt.Errorf("Could not read multipart file: %v", err)
-							}
-							if err = c.Serv.Monsti().WriteNodeData(c.Site.Name, node.Path,
-								"__file_"+name, content); err != nil {
-								return fmt.Errorf("Could not save file: %v", err)
-							}
+				for _, name := range fileFields {
+					file, err := formFile(c, h, name)
+					if err != nil {
+						return err
+					}
+					if file == nil {
+						continue
+					}
+					if node.Type.Id == "core.Image" && name == "core.File" {
+						err = writeImageUpload(c, h, node.Path, file.Content)
+					} else if err = c.Serv.Monsti().WriteNodeData(c.Site.Name,
+						node.Path, "__file_"+name, file.Content); err != nil {
+						err = fmt.Errorf("Could not save file: %v", err)
+					}
+					if err != nil {
+						return err
+					}
+					if poster, ok := posters[name]; ok {
+						if err := c.Serv.Monsti().WriteNodeData(c.Site.Name, node.Path,
+							"__poster_"+name, poster); err != nil {
+							return fmt.Errorf("Could not save poster: %v", err)
+						}
+					}
+					if file.Upload != "" {
+						if err := removeUpload(dataDir, file.Upload); err != nil {
+							return err
+						}
+					}
+				}
+				if err := removeDraft(dataDir, login, c.Node.Path,
+					draftType); err != nil {
+					return err
+				}
+				target := node.Path + "/"
+				if node.Public {
+					// Show the failure on the edit page of the saved node.
+					failure := h.runPostHooks(c, h.Settings.Hooks.Publish.Post,
+						publishHookEnv(c, "post", node.Path))
+					if failure != "" {
+						c.Session.Values["hook-failure"] = failure
+						if err := c.Session.Save(c.Req, c.Res); err != nil {
+							return fmt.Errorf("Could not save user session: %v", err)
 						}
+						target = path.Join(node.Path, "@@edit")
 					}
 				}
-				http.Redirect(c.Res, c.Req, node.Path+"/", http.StatusSeeOther)
+				http.Redirect(c.Res, c.Req, target, http.StatusSeeOther)
 				return nil
 			}
 		}
 	default:
 		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
 	}
-	rendered, err := h.Renderer.Render("edit",
-		mtemplate.Context{"Form": form.RenderData()},
+	context := mtemplate.Context{"Form": form.RenderData(),
+		"Locale": c.Site.Locale, "Locales": locales,
+		"SEOFields": seoFields, "ShowSEO": formData.SEO != service.SEOMetadata{},
+		"Preview": true, "Autosave": true, "NodeType": draftType, "Draft": savedDraft,
+		"DraftRestored": restored,
+		"GalleryUpload": !newNode && c.Node.Type.Id == "core.Gallery"}
+	if savedDraft != nil {
+		context["DraftAge"] = draftAge(savedDraft.Saved, time.Now(), G)
+	}
+	if failure, ok := c.Session.Values["hook-failure"].(string); ok {
+		delete(c.Session.Values, "hook-failure")
+		context["HookFailure"] = failure
+	}
+	rendered, err := h.Renderer.Render("edit", context,
 		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
 
 	if err != nil {
@@ -602,6 +986,20 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 	return nil
 }
 
+// MarkdownPreview renders the posted Markdown source (form value
+// "Source") for the preview of Markdown fields.
+func (h *nodeHandler) MarkdownPreview(c *reqContext) error {
+	if c.Req.Method != "POST" {
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	if err := c.Req.ParseForm(); err != nil {
+		return fmt.Errorf("Could not parse form: %v", err)
+	}
+	c.Res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(c.Res, service.RenderMarkdown(c.Req.PostForm.Get("Source")))
+	return nil
+}
+
 /*
 	err = c.Session.Save(c.Req, c.Res)
 	if err != nil {
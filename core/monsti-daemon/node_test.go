@@ -17,9 +17,12 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"path"
 	"reflect"
 	"testing"
+	"time"
 
 	"pkg.monsti.org/monsti/api/service"
 )
@@ -30,7 +33,7 @@ func TestGetNav(t *testing.T) {
 		Children []string
 	}{
 		"/": {
-			Children: []string{"foo", "bar", "hideme", "cruz"}},
+			Children: []string{"foo", "bar", "hideme", "cruz", "news"}},
 		"/foo": {
 			Children: []string{"child1", "child2"}},
 		"/foo/child1": {
@@ -49,6 +52,9 @@ func TestGetNav(t *testing.T) {
 			Node:     service.Node{Order: -2},
 			Children: []string{"child1"}},
 		"/cruz/child1": {
+			Children: []string{}},
+		"/news": {
+			Node:     service.Node{Pinned: true, Order: 5},
 			Children: []string{}}}
 	getNodeFn := func(nodePath string) (*service.Node, error) {
 		if val, ok := nodes[nodePath]; ok {
@@ -76,11 +82,13 @@ func TestGetNav(t *testing.T) {
 	}{
 		{"/", "/", true, navigation{
 			{Target: "/", Child: false, Active: true},
+			{Target: "/news", Child: true, Pinned: true, Order: 5},
 			{Target: "/cruz", Child: true, Order: -2},
 			{Target: "/foo", Child: true},
 			{Target: "/bar", Child: true, Order: 2}}},
 		{"/", "/foo/child2/child1", true, navigation{
 			{Target: "/", Child: false, Active: false, ActiveBelow: true},
+			{Target: "/news", Child: true, Pinned: true, Order: 5},
 			{Target: "/cruz", Child: true, Order: -2},
 			{Target: "/foo", Child: true, ActiveBelow: true},
 			{Target: "/bar", Child: true, Order: 2}}},
@@ -133,3 +141,91 @@ func TestNavigationMakeAbsolute(t *testing.T) {
 			nav, expected)
 	}
 }
+
+func TestFindViewTemplate(t *testing.T) {
+	nodeType := &service.NodeType{
+		Id: "foo.Event",
+		Views: []service.NodeTypeView{
+			{Id: "teaser", Templates: []string{"foo/event-teaser", "blocks/teaser"}},
+			{Id: "card"},
+		}}
+	existing := map[string]bool{
+		"foo/Event-view":   true,
+		"foo/Event-card":   true,
+		"blocks/teaser":    true,
+		"site/event-full":  true,
+		"site/event-other": false,
+	}
+	exists := func(name string) bool { return existing[name] }
+	tests := []struct {
+		View       string
+		Overwrites map[string]service.TemplateOverwrite
+		Template   string
+	}{
+		{"view", nil, "foo/Event-view"},
+		{"teaser", nil, "blocks/teaser"},
+		{"card", nil, "foo/Event-card"},
+		{"full", nil, "foo/Event-view"},
+		{"full", map[string]service.TemplateOverwrite{
+			"foo/Event-full": {Template: "site/event-full"}}, "site/event-full"},
+		{"view", map[string]service.TemplateOverwrite{
+			"foo/Event-view": {Template: "site/event-other"}}, "site/event-other"},
+	}
+	for i, test := range tests {
+		node := service.Node{Type: nodeType, TemplateOverwrites: test.Overwrites}
+		ret := findViewTemplate(&node, test.View, exists)
+		if ret != test.Template {
+			t.Errorf("%v: findViewTemplate(_, %q, _) = %q, should be %q", i,
+				test.View, ret, test.Template)
+		}
+	}
+}
+
+func TestServeNodeFile(t *testing.T) {
+	changed := time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)
+	content := []byte("%PDF-1.4 Some document")
+	serve := func(header http.Header) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/foo.pdf", nil)
+		for key := range header {
+			req.Header.Set(key, header.Get(key))
+		}
+		res := httptest.NewRecorder()
+		serveNodeFile(&reqContext{Req: req, Res: res,
+			Node: &service.Node{Path: "/foo.pdf", Changed: changed}},
+			"foo.pdf", content)
+		return res
+	}
+	res := serve(nil)
+	if res.Code != http.StatusOK || res.Body.String() != string(content) {
+		t.Fatalf("Got %v %q, should be 200 with content", res.Code, res.Body)
+	}
+	if ret := res.Header().Get("Content-Type"); ret != "application/pdf" {
+		t.Errorf("Content-Type is %q, should be application/pdf", ret)
+	}
+	etag := res.Header().Get("ETag")
+	if etag == "" || res.Header().Get("Last-Modified") == "" ||
+		res.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("Missing caching headers: %v", res.Header())
+	}
+	tests := []struct {
+		Header http.Header
+		Code   int
+		Body   string
+	}{
+		{http.Header{"Range": {"bytes=0-3"}}, http.StatusPartialContent, "%PDF"},
+		{http.Header{"If-None-Match": {etag}}, http.StatusNotModified, ""},
+		{http.Header{"If-None-Match": {`"foo"`}}, http.StatusOK, string(content)},
+		{http.Header{"If-Modified-Since": {changed.Format(http.TimeFormat)}},
+			http.StatusNotModified, ""},
+		{http.Header{"If-Modified-Since": {
+			changed.Add(-time.Hour).Format(http.TimeFormat)}},
+			http.StatusOK, string(content)},
+	}
+	for i, test := range tests {
+		res := serve(test.Header)
+		if res.Code != test.Code || res.Body.String() != test.Body {
+			t.Errorf("Test %v: Got %v %q, should be %v %q", i, res.Code,
+				res.Body, test.Code, test.Body)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// nodeChecker checks the node tree of a site, see
+// MonstiClient.CheckNodes.
+type nodeChecker struct {
+	// Root is the nodes directory of the site.
+	Root string
+	// LostFound is the directory orphaned files get moved to.
+	LostFound string
+	// Fix enables the repair of found problems.
+	Fix bool
+	// NodeType returns the node type with the given id or nil if there
+	// is no such node type.
+	NodeType func(id string) *service.NodeType
+	// Exists returns true iff the node with the given path exists.
+	Exists func(nodePath string) bool
+	// Issues are the found problems.
+	Issues []*service.NodeIssue
+	// Changed are the paths of the nodes changed by repairs.
+	Changed []string
+}
+
+// check checks the whole node tree.
+func (c *nodeChecker) check() error {
+	return c.checkDir("/")
+}
+
+// checkDir checks the node at the given path, its files and the nodes
+// below.
+func (c *nodeChecker) checkDir(nodePath string) error {
+	dir := filepath.Join(c.Root, nodePath[1:])
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	isNode, archived := false, false
+	for _, file := range files {
+		switch file.Name() {
+		case "node.json":
+			isNode = true
+		case archiveFile:
+			archived = true
+		}
+	}
+	if isNode {
+		if err := c.checkNode(nodePath); err != nil {
+			return err
+		}
+	}
+	for _, file := range files {
+		name := file.Name()
+		switch {
+		case file.IsDir():
+			if err := c.checkDir(path.Join(nodePath, name)); err != nil {
+				return err
+			}
+		case !file.Mode().IsRegular():
+		case strings.HasPrefix(name, ".archive"):
+			// Left over by an interrupted archiveNode.
+			if err := c.orphan(nodePath, name, "Incomplete archive"); err != nil {
+				return err
+			}
+		case !isNode && !archived:
+			if err := c.orphan(nodePath, name, "File without node"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// orphan adds an issue for the given orphaned file and moves it to the
+// lost+found directory if fixing.
+func (c *nodeChecker) orphan(nodePath, name, detail string) error {
+	issue := &service.NodeIssue{Path: path.Join(nodePath, name),
+		Check: service.IssueOrphanedData, Detail: detail}
+	c.Issues = append(c.Issues, issue)
+	if !c.Fix {
+		return nil
+	}
+	target := filepath.Join(c.LostFound, nodePath[1:], name)
+	if _, err := os.Stat(target); err == nil {
+		issue.Detail += fmt.Sprintf(", not moved as %v exists", target)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return fmt.Errorf("Could not create lost+found directory: %v", err)
+	}
+	if err := os.Rename(filepath.Join(c.Root, nodePath[1:], name),
+		target); err != nil {
+		return fmt.Errorf("Could not move orphaned file: %v", err)
+	}
+	issue.Fixed = true
+	c.Changed = append(c.Changed, nodePath)
+	return nil
+}
+
+// checkNode checks the node.json of the given node.
+func (c *nodeChecker) checkNode(nodePath string) error {
+	file := filepath.Join(c.Root, nodePath[1:], "node.json")
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	malformed := func(detail string) {
+		c.Issues = append(c.Issues, &service.NodeIssue{Path: nodePath,
+			Check: service.IssueMalformedNode, Detail: detail})
+	}
+	var node map[string]*json.RawMessage
+	var header struct {
+		Type, Path  string
+		Embed       []service.EmbedNode
+		LocalFields []*service.NodeField
+		Fields      map[string]map[string]*json.RawMessage
+	}
+	if err := json.Unmarshal(content, &node); err != nil {
+		malformed(err.Error())
+		return nil
+	}
+	if err := json.Unmarshal(content, &header); err != nil {
+		malformed(err.Error())
+		return nil
+	}
+	if header.Type == "" {
+		malformed("Missing node type")
+		return nil
+	}
+	// Repairs of fixable issues get written at once.
+	fixable := make([]*service.NodeIssue, 0)
+	issue := func(check, detail string, fix bool) {
+		issue := &service.NodeIssue{Path: nodePath, Check: check,
+			Detail: detail}
+		c.Issues = append(c.Issues, issue)
+		if fix {
+			fixable = append(fixable, issue)
+		}
+	}
+	if _, ok := node["Path"]; ok && header.Path != nodePath {
+		issue(service.IssuePathMismatch,
+			fmt.Sprintf("Stored path %q", header.Path), true)
+		delete(node, "Path")
+	}
+	embeds := header.Embed
+	fields := header.LocalFields
+	if nodeType := c.NodeType(header.Type); nodeType != nil {
+		embeds = append(append([]service.EmbedNode(nil), nodeType.Embed...),
+			embeds...)
+		fields = append(append([]*service.NodeField(nil), nodeType.Fields...),
+			fields...)
+	} else {
+		issue(service.IssueUnknownType,
+			fmt.Sprintf("Unknown node type %q", header.Type), false)
+	}
+	for i := range embeds {
+		target, err := embedPath(nodePath, &embeds[i])
+		if err == nil && c.Exists(target) {
+			continue
+		}
+		detail := fmt.Sprintf("Embed %q references missing node %v",
+			embeds[i].Id, target)
+		if err != nil {
+			detail = fmt.Sprintf("Embed %q: %v", embeds[i].Id, err)
+		}
+		// Missing embeds can't be repaired without changing the node's
+		// layout.
+		issue(service.IssueDanglingRef, detail, false)
+	}
+	for _, field := range fields {
+		parts := strings.SplitN(field.Id, ".", 2)
+		if field.Type != "MultiRef" || len(parts) != 2 ||
+			header.Fields[parts[0]][parts[1]] == nil {
+			continue
+		}
+		var paths []string
+		if err := json.Unmarshal(*header.Fields[parts[0]][parts[1]],
+			&paths); err != nil {
+			malformed(fmt.Sprintf("Field %v: %v", field.Id, err))
+			return nil
+		}
+		kept := make([]string, 0, len(paths))
+		for _, target := range paths {
+			if c.Exists(target) {
+				kept = append(kept, target)
+				continue
+			}
+			issue(service.IssueDanglingRef,
+				fmt.Sprintf("Field %v references missing node %v", field.Id,
+					target), true)
+		}
+		if len(kept) < len(paths) {
+			encoded, err := json.Marshal(kept)
+			if err != nil {
+				return err
+			}
+			msg := json.RawMessage(encoded)
+			header.Fields[parts[0]][parts[1]] = &msg
+		}
+	}
+	if !c.Fix || len(fixable) == 0 {
+		return nil
+	}
+	if header.Fields != nil {
+		encoded, err := json.Marshal(header.Fields)
+		if err != nil {
+			return err
+		}
+		msg := json.RawMessage(encoded)
+		node["Fields"] = &msg
+	}
+	repaired, err := json.MarshalIndent(node, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not marshal node: %v", err)
+	}
+	if err := ioutil.WriteFile(file, repaired, 0600); err != nil {
+		return fmt.Errorf("Could not write node: %v", err)
+	}
+	for _, issue := range fixable {
+		issue.Fixed = true
+	}
+	c.Changed = append(c.Changed, nodePath)
+	return nil
+}
+
+type CheckNodesArgs struct {
+	Site string
+	Fix  bool
+}
+
+// CheckNodes checks the node tree of the site and repairs found
+// problems if requested.
+func (i *MonstiService) CheckNodes(args *CheckNodesArgs,
+	reply *[]*service.NodeIssue) error {
+	if args.Fix {
+		nodesMutex.Lock()
+		defer nodesMutex.Unlock()
+	} else {
+		nodesMutex.RLock()
+		defer nodesMutex.RUnlock()
+	}
+	checker := nodeChecker{
+		Root: i.Settings.Monsti.GetSiteNodesPath(args.Site),
+		LostFound: filepath.Join(i.Settings.Monsti.GetSiteDataPath(args.Site),
+			"lost+found"),
+		Fix: args.Fix,
+		NodeType: func(id string) *service.NodeType {
+			i.mutex.RLock()
+			defer i.mutex.RUnlock()
+			return i.Settings.Config.NodeTypes[id]
+		},
+		Exists: func(nodePath string) bool {
+			root, sourcePath, _ := i.nodeRoot(args.Site, nodePath)
+			node, err := getNode(root, sourcePath)
+			return err == nil && node != nil
+		},
+		Issues: make([]*service.NodeIssue, 0),
+	}
+	if err := checker.check(); err != nil {
+		return fmt.Errorf("Could not check nodes: %v", err)
+	}
+	if len(checker.Changed) > 0 {
+		i.purgeNodes(args.Site, checker.Changed...)
+		if err := i.recordChanges(args.Site, false,
+			checker.Changed...); err != nil {
+			return err
+		}
+	}
+	*reply = checker.Issues
+	return nil
+}
+
+// checkSites checks the node trees of all sites and logs the number
+// of found problems.
+func (i *MonstiService) checkSites() {
+	for site := range i.Settings.Monsti.Sites {
+		var issues []*service.NodeIssue
+		if err := i.CheckNodes(&CheckNodesArgs{Site: site},
+			&issues); err != nil {
+			i.Logger.Printf("(%v) %v", site, err)
+			continue
+		}
+		if len(issues) > 0 {
+			i.Logger.Printf("(%v) Found %v problems in the node tree, run "+
+				"monsti check for details", site, len(issues))
+		}
+	}
+}
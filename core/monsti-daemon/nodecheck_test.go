@@ -0,0 +1,121 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestNodeChecker(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/nodes/node.json": `{"Type":"core.Document"}`,
+		"/nodes/a/node.json": `{"Type":"foo.Related",
+"Fields":{"foo":{"Refs":["/b","/missing","/a"]}}}`,
+		"/nodes/b/node.json":           `{"Path":"/old","Type":"core.Document"}`,
+		"/nodes/c/node.json":           `{"Type":"foo.Unknown"}`,
+		"/nodes/d/node.json":           `{"Type":`,
+		"/nodes/e/node.json":           `{"Type":"core.Document","Embed":[{"Id":"x","URI":"missing"}]}`,
+		"/nodes/gone/__file_core.File": "content",
+		"/nodes/old/archive.zip":       "",
+		"/nodes/.archive123":           "",
+	}, "TestNodeChecker")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	nodeTypes := map[string]*service.NodeType{
+		"core.Document": {Id: "core.Document"},
+		"foo.Related": {Id: "foo.Related", Fields: []*service.NodeField{
+			{Id: "foo.Refs", Type: "MultiRef"}}},
+	}
+	check := func(fix bool) []service.NodeIssue {
+		checker := nodeChecker{
+			Root:      filepath.Join(root, "nodes"),
+			LostFound: filepath.Join(root, "lost+found"),
+			Fix:       fix,
+			NodeType: func(id string) *service.NodeType {
+				return nodeTypes[id]
+			},
+			Exists: func(nodePath string) bool {
+				_, err := os.Stat(filepath.Join(root, "nodes", nodePath[1:],
+					"node.json"))
+				return err == nil
+			},
+		}
+		if err := checker.check(); err != nil {
+			t.Fatalf("check() returned error: %v", err)
+		}
+		issues := make([]service.NodeIssue, 0)
+		for _, issue := range checker.Issues {
+			issue.Detail = ""
+			issues = append(issues, *issue)
+		}
+		return issues
+	}
+	expected := []service.NodeIssue{
+		{Path: "/.archive123", Check: service.IssueOrphanedData},
+		{Path: "/a", Check: service.IssueDanglingRef},
+		{Path: "/b", Check: service.IssuePathMismatch},
+		{Path: "/c", Check: service.IssueUnknownType},
+		{Path: "/d", Check: service.IssueMalformedNode},
+		{Path: "/e", Check: service.IssueDanglingRef},
+		{Path: "/gone/__file_core.File", Check: service.IssueOrphanedData},
+	}
+	if issues := check(false); !reflect.DeepEqual(issues, expected) {
+		t.Errorf("check(false) found\n%v, should be\n%v", issues, expected)
+	}
+	for i := range expected {
+		expected[i].Fixed = expected[i].Check != service.IssueUnknownType &&
+			expected[i].Check != service.IssueMalformedNode &&
+			expected[i].Path != "/e"
+	}
+	if issues := check(true); !reflect.DeepEqual(issues, expected) {
+		t.Errorf("check(true) found\n%v, should be\n%v", issues, expected)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(root, "lost+found", "gone",
+		"__file_core.File"))
+	if err != nil || string(content) != "content" {
+		t.Errorf("Orphaned file should have been moved: %q, %v", content, err)
+	}
+	content, err = ioutil.ReadFile(filepath.Join(root, "nodes", "a",
+		"node.json"))
+	if err != nil {
+		t.Fatalf("Could not read repaired node: %v", err)
+	}
+	var node struct {
+		Fields map[string]map[string][]string
+	}
+	if err := json.Unmarshal(content, &node); err != nil ||
+		!reflect.DeepEqual(node.Fields["foo"]["Refs"], []string{"/b", "/a"}) {
+		t.Errorf("Dangling reference should have been removed: %s, %v",
+			content, err)
+	}
+	expected = []service.NodeIssue{expected[3], expected[4], expected[5]}
+	expected[2].Fixed = false
+	if issues := check(false); !reflect.DeepEqual(issues, expected) {
+		t.Errorf("check(false) after fixing found\n%v, should be\n%v", issues,
+			expected)
+	}
+}
@@ -22,16 +22,16 @@ import (
 	"net/http"
 	"net/url"
 
-	"path"
 	"github.com/chrneumann/htmlwidgets"
-	"github.com/chrneumann/mimemail"
 	"pkg.monsti.org/gettext"
 	"pkg.monsti.org/monsti/api/util"
 	"pkg.monsti.org/monsti/api/util/template"
 )
 import "pkg.monsti.org/monsti/api/service"
 
-var availableLocales = []string{"en", "de"}
+// availableLocales are the languages of the user interface. They are
+// set on startup from the Monsti settings.
+var availableLocales = []string{"en"}
 
 func initNodeTypes(settings *settings, session *service.Session, logger *log.Logger) error {
 	G := func(in string) string { return in }
@@ -50,16 +50,18 @@ func initNodeTypes(settings *settings, session *service.Session, logger *log.Log
 		Name:      util.GenLanguageMap(G("Document"), availableLocales),
 		Fields: []*service.NodeField{
 			{
-				Id:       "core.Title",
-				Required: true,
-				Name:     util.GenLanguageMap(G("Title"), availableLocales),
-				Type:     "Text",
+				Id:           "core.Title",
+				Required:     true,
+				Name:         util.GenLanguageMap(G("Title"), availableLocales),
+				Type:         "Text",
+				Translatable: true,
 			},
 			{
-				Id:       "core.Body",
-				Required: true,
-				Name:     util.GenLanguageMap(G("Body"), availableLocales),
-				Type:     "HTMLArea",
+				Id:           "core.Body",
+				Required:     true,
+				Name:         util.GenLanguageMap(G("Body"), availableLocales),
+				Type:         "HTMLArea",
+				Translatable: true,
 			},
 		},
 	}
@@ -99,18 +101,114 @@ func initNodeTypes(settings *settings, session *service.Session, logger *log.Log
 		return fmt.Errorf("Could not register image node type: %v", err)
 	}
 
-	contactFormType := service.NodeType{
-		Id:        "core.ContactForm",
+	galleryType := service.NodeType{
+		Id:        "core.Gallery",
+		AddableTo: []string{"."},
+		Name:      util.GenLanguageMap(G("Gallery"), availableLocales),
+		Fields: []*service.NodeField{
+			{Id: "core.Title"},
+			{Id: "core.Body"},
+		},
+	}
+	if err := session.Monsti().RegisterNodeType(&galleryType); err != nil {
+		return fmt.Errorf("Could not register gallery node type: %v", err)
+	}
+
+	option := func(value, label string) *service.FieldOption {
+		return &service.FieldOption{Value: value,
+			Label: util.GenLanguageMap(label, availableLocales)}
+	}
+	formType := service.NodeType{
+		Id:        "core.Form",
 		AddableTo: []string{"."},
-		Name:      util.GenLanguageMap(G("Contact form"), availableLocales),
+		Name:      util.GenLanguageMap(G("Form"), availableLocales),
 		Fields: []*service.NodeField{
 			{Id: "core.Title"},
 			{Id: "core.Body"},
+			{
+				Id:   "core.FormFields",
+				Name: util.GenLanguageMap(G("Form fields"), availableLocales),
+				Type: "List",
+				Fields: []*service.NodeField{
+					{Id: "Label", Type: "Text",
+						Name: util.GenLanguageMap(G("Label"), availableLocales)},
+					{Id: "Type", Type: "Select",
+						Name: util.GenLanguageMap(G("Type"), availableLocales),
+						Options: []*service.FieldOption{
+							option("text", G("Text")),
+							option("textarea", G("Text area")),
+							option("select", G("Selection")),
+							option("checkbox", G("Checkbox")),
+							option("file", G("File upload"))}},
+					{Id: "Required", Type: "Select",
+						Name: util.GenLanguageMap(G("Required"), availableLocales),
+						Options: []*service.FieldOption{
+							option("", G("Optional")),
+							option("required", G("Required"))}},
+					{Id: "Options", Type: "Text",
+						Name: util.GenLanguageMap(G("Options (comma separated)"),
+							availableLocales)},
+					{Id: "MaxSize", Type: "Text",
+						Name: util.GenLanguageMap(G("Max. file size (MiB)"),
+							availableLocales)},
+				},
+			},
+			{
+				Id:       "core.FormSubmit",
+				Required: true,
+				Name:     util.GenLanguageMap(G("Submissions"), availableLocales),
+				Type:     "Select",
+				Options: []*service.FieldOption{
+					option("mail", G("Send by mail")),
+					option("store", G("Store")),
+					option("mail-store", G("Send by mail and store"))},
+			},
+		},
+	}
+	if err := session.Monsti().RegisterNodeType(&formType); err != nil {
+		return fmt.Errorf("Could not register form node type: %v", err)
+	}
+
+	// Deprecated: Use core.Form instead. Existing contact forms keep
+	// working, but new ones can't be added.
+	contactFormType := service.NodeType{
+		Id:   "core.ContactForm",
+		Name: util.GenLanguageMap(G("Contact form"), availableLocales),
+		Fields: []*service.NodeField{
+			{Id: "core.Title"},
+			{Id: "core.Body"},
+			{Id: "core.FormSubmit"},
 		},
 	}
 	if err := session.Monsti().RegisterNodeType(&contactFormType); err != nil {
 		return fmt.Errorf("Could not register contactform node type: %v", err)
 	}
+
+	submissionType := service.NodeType{
+		Id:   "core.FormSubmission",
+		Hide: true,
+		Name: util.GenLanguageMap(G("Form submission"), availableLocales),
+		Fields: []*service.NodeField{
+			{Id: "core.Title"},
+		},
+	}
+	if err := session.Monsti().RegisterNodeType(&submissionType); err != nil {
+		return fmt.Errorf("Could not register form submission node type: %v",
+			err)
+	}
+
+	newsletterType := service.NodeType{
+		Id:        "core.Newsletter",
+		AddableTo: []string{"."},
+		Name:      util.GenLanguageMap(G("Newsletter"), availableLocales),
+		Fields: []*service.NodeField{
+			{Id: "core.Title"},
+			{Id: "core.Body"},
+		},
+	}
+	if err := session.Monsti().RegisterNodeType(&newsletterType); err != nil {
+		return fmt.Errorf("Could not register newsletter node type: %v", err)
+	}
 	return nil
 }
 
@@ -118,11 +216,22 @@ type contactFormData struct {
 	Name, Email, Subject, Message string
 }
 
+// submission returns the contact form data as submission of the
+// default form fields.
+func (d contactFormData) submission() *formSubmission {
+	return &formSubmission{Values: map[string]string{
+		"name":    d.Name,
+		"email":   d.Email,
+		"subject": d.Subject,
+		"message": d.Message}}
+}
+
 func renderContactForm(c *reqContext, context template.Context,
 	formValues url.Values, h *nodeHandler) error {
 	G, _, _, _ := gettext.DefaultLocales.Use("", c.Site.Locale)
 	data := contactFormData{}
 	form := htmlwidgets.NewForm(&data)
+	form.Action = c.FormAction
 	form.AddWidget(&htmlwidgets.TextWidget{MinLength: 1,
 		ValidationError: G("Required.")}, "Name", G("Name"), "")
 	form.AddWidget(&htmlwidgets.TextWidget{MinLength: 1,
@@ -137,20 +246,18 @@ func renderContactForm(c *reqContext, context template.Context,
 		if _, submitted := formValues["submitted"]; submitted {
 			context["Submitted"] = 1
 		}
+		if _, failed := formValues["payment-failed"]; failed {
+			context["PaymentFailed"] = 1
+		}
 	case "POST":
 		if form.Fill(formValues) {
-			mail := mimemail.Mail{
-				From:    mimemail.Address{data.Name, data.Email},
-				Subject: data.Subject,
-				Body:    []byte(data.Message)}
-			site := h.Settings.Monsti.Sites[c.Site.Name]
-			owner := mimemail.Address{site.Owner.Name, site.Owner.Email}
-			mail.To = []mimemail.Address{owner}
-			err := c.Serv.Monsti().SendMail(&mail)
+			mail := contactFormMail(h.Settings.Monsti.Sites[c.Site.Name], data)
+			target, err := submitFormValues(c, h, defaultFormFields(G),
+				data.submission(), mail)
 			if err != nil {
-				return fmt.Errorf("Could not send mail: %v", err)
+				return fmt.Errorf("Could not submit form: %v", err)
 			}
-			http.Redirect(c.Res, c.Req, path.Dir(c.Node.Path)+"/?submitted", http.StatusSeeOther)
+			http.Redirect(c.Res, c.Req, target, http.StatusSeeOther)
 			return nil
 		}
 	default:
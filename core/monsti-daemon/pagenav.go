@@ -0,0 +1,181 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// pageNav is the navigation of a node within the node tree, see
+// getPageNav.
+type pageNav struct {
+	// Breadcrumbs lead from the root node to the node, which is the
+	// last and active link.
+	Breadcrumbs navigation
+	// Previous and Next are the node's adjacent siblings, if any.
+	Previous, Next *navLink
+	// Section is the top level node containing the node, e.g. "/about/"
+	// for "/about/team/". It's nil for the root node.
+	Section *navLink
+}
+
+// SectionName returns the name of the node's section, e.g. "about"
+// for "/about/team/", or an empty string for the root node.
+func (n *pageNav) SectionName() string {
+	if n.Section == nil {
+		return ""
+	}
+	return strings.Trim(n.Section.Target, "/")
+}
+
+// nodeSortKey returns the value of the node's field to sort by. The
+// special field "PublishTime" refers to the node's publish time.
+func nodeSortKey(node *service.Node, field string) (time.Time, string) {
+	if field == "PublishTime" {
+		return node.PublishTime, ""
+	}
+	switch value := node.GetField(field).(type) {
+	case nil:
+		return time.Time{}, ""
+	case *service.DateTimeField:
+		return value.Time, ""
+	case *service.DateField:
+		return value.Time, ""
+	default:
+		return time.Time{}, strings.ToLower(value.String())
+	}
+}
+
+// siblingOrder returns the function ordering sibling nodes by the given
+// field, descending if the field is prefixed with "-" (e.g.
+// "-PublishTime"). Without field, siblings are ordered like in the
+// navigation.
+func siblingOrder(order string) func(left, right *service.Node) bool {
+	desc := strings.HasPrefix(order, "-")
+	field := strings.TrimPrefix(order, "-")
+	return func(left, right *service.Node) bool {
+		if field != "" {
+			leftTime, leftText := nodeSortKey(left, field)
+			rightTime, rightText := nodeSortKey(right, field)
+			if !leftTime.Equal(rightTime) {
+				return leftTime.Before(rightTime) != desc
+			}
+			if leftText != rightText {
+				return (leftText < rightText) != desc
+			}
+		}
+		return left.ListedBefore(right)
+	}
+}
+
+// getPageNav returns the breadcrumbs, adjacent siblings and section of
+// the given node. Siblings are ordered by the given field, see
+// siblingOrder. Titles are shown in the given locale.
+//
+// Hidden nodes are skipped, as are unpublished nodes if public is
+// true.
+func getPageNav(node *service.Node, order, locale string, public bool,
+	now time.Time, getNodeFn getNodeFunc, getChildrenFn getChildrenFunc) (
+	*pageNav, error) {
+	visible := func(node *service.Node) bool {
+		return !node.Hide && (node.Type == nil || !node.Type.Hide) &&
+			(!public || isPublished(node, now))
+	}
+	link := func(node *service.Node) (*navLink, error) {
+		translated, err := translateNode(node, locale)
+		if err != nil {
+			return nil, fmt.Errorf("Could not translate node %q: %v", node.Path,
+				err)
+		}
+		return &navLink{Name: getNodeTitle(translated),
+			Target: dirPath(node.Path)}, nil
+	}
+	nav := new(pageNav)
+	var ancestors []string
+	if node.Path != "/" {
+		for dir := path.Dir(node.Path); ; dir = path.Dir(dir) {
+			ancestors = append([]string{dir}, ancestors...)
+			if dir == "/" {
+				break
+			}
+		}
+	}
+	for _, ancestorPath := range ancestors {
+		ancestor, err := getNodeFn(ancestorPath)
+		if err != nil {
+			return nil, fmt.Errorf("Could not get ancestor: %v", err)
+		}
+		if ancestor == nil {
+			continue
+		}
+		crumb, err := link(ancestor)
+		if err != nil {
+			return nil, err
+		}
+		crumb.ActiveBelow = true
+		nav.Breadcrumbs = append(nav.Breadcrumbs, *crumb)
+	}
+	crumb, err := link(node)
+	if err != nil {
+		return nil, err
+	}
+	crumb.Active = true
+	nav.Breadcrumbs = append(nav.Breadcrumbs, *crumb)
+	if node.Path == "/" {
+		return nav, nil
+	}
+	for i := range nav.Breadcrumbs {
+		if strings.Count(nav.Breadcrumbs[i].Target, "/") == 2 {
+			nav.Section = &nav.Breadcrumbs[i]
+			break
+		}
+	}
+	siblings, err := getChildrenFn(path.Dir(node.Path))
+	if err != nil {
+		return nil, fmt.Errorf("Could not get siblings: %v", err)
+	}
+	shown := make([]*service.Node, 0, len(siblings))
+	for _, sibling := range siblings {
+		if sibling.Path == node.Path || visible(sibling) {
+			shown = append(shown, sibling)
+		}
+	}
+	sort.Sort(&nodeSort{shown, siblingOrder(order)})
+	for i, sibling := range shown {
+		if sibling.Path != node.Path {
+			continue
+		}
+		if i > 0 {
+			if nav.Previous, err = link(shown[i-1]); err != nil {
+				return nil, err
+			}
+		}
+		if i < len(shown)-1 {
+			if nav.Next, err = link(shown[i+1]); err != nil {
+				return nil, err
+			}
+		}
+		break
+	}
+	return nav, nil
+}
@@ -0,0 +1,117 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestGetPageNav(t *testing.T) {
+	docType := &service.NodeType{Id: "core.Document"}
+	hiddenType := &service.NodeType{Id: "core.File", Hide: true}
+	now := time.Date(2015, 3, 1, 0, 0, 0, 0, time.UTC)
+	newNode := func(nodePath, title string, order int, public bool,
+		nodeType *service.NodeType, published time.Time) *service.Node {
+		titleField := service.TextField(title)
+		return &service.Node{Path: nodePath, Type: nodeType, Public: public,
+			Order: order, PublishTime: published,
+			Fields: map[string]service.Field{"core.Title": &titleField}}
+	}
+	nodes := map[string]*service.Node{
+		"/": newNode("/", "Home", 0, true, docType, now),
+		"/about": newNode("/about", "About", 0, true, docType,
+			now.AddDate(0, 0, -1)),
+		"/about/team": newNode("/about/team", "Team", 2, true, docType,
+			now.AddDate(0, 0, -3)),
+		"/about/history": newNode("/about/history", "History", 1, true, docType,
+			now.AddDate(0, 0, -1)),
+		"/about/draft": newNode("/about/draft", "Draft", 3, false, docType,
+			now.AddDate(0, 0, -2)),
+		"/about/file": newNode("/about/file", "File", 4, true, hiddenType,
+			now.AddDate(0, 0, -2)),
+		"/about/jobs": newNode("/about/jobs", "Jobs", 5, true, docType,
+			now.AddDate(0, 0, -4)),
+	}
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		return nodes[nodePath], nil
+	}
+	getChildrenFn := func(nodePath string) ([]*service.Node, error) {
+		children := make([]*service.Node, 0)
+		for childPath, child := range nodes {
+			if childPath != "/" && path.Dir(childPath) == nodePath {
+				children = append(children, child)
+			}
+		}
+		return children, nil
+	}
+	linkName := func(link *navLink) string {
+		if link == nil {
+			return "-"
+		}
+		return link.Name
+	}
+	tests := []struct {
+		Path, Order                 string
+		Public                      bool
+		Crumbs, Prev, Next, Section string
+	}{
+		{"/", "", true, "[Home]", "-", "-", ""},
+		{"/about", "", true, "[Home About]", "-", "-", "about"},
+		{"/about/team", "", true, "[Home About Team]", "History", "Jobs",
+			"about"},
+		{"/about/team", "", false, "[Home About Team]", "History", "Draft",
+			"about"},
+		{"/about/team", "core.Title", true, "[Home About Team]", "Jobs", "-",
+			"about"},
+		{"/about/team", "-PublishTime", false, "[Home About Team]", "Draft",
+			"Jobs", "about"},
+	}
+	for _, test := range tests {
+		nav, err := getPageNav(nodes[test.Path], test.Order, "", test.Public,
+			now, getNodeFn, getChildrenFn)
+		if err != nil {
+			t.Fatalf("getPageNav(%q, ...) returned error: %v", test.Path, err)
+		}
+		var crumbs []string
+		for _, crumb := range nav.Breadcrumbs {
+			crumbs = append(crumbs, crumb.Name)
+		}
+		if fmt.Sprint(crumbs) != test.Crumbs {
+			t.Errorf("getPageNav(%q, %q, ...) breadcrumbs are %v, should be %v",
+				test.Path, test.Order, crumbs, test.Crumbs)
+		}
+		if !nav.Breadcrumbs[len(nav.Breadcrumbs)-1].Active {
+			t.Errorf("getPageNav(%q, ...) should activate the last breadcrumb",
+				test.Path)
+		}
+		if prev, next := linkName(nav.Previous), linkName(nav.Next); prev !=
+			test.Prev || next != test.Next {
+			t.Errorf("getPageNav(%q, %q, _, %v, ...) siblings are %v and %v, "+
+				"should be %v and %v", test.Path, test.Order, test.Public, prev, next,
+				test.Prev, test.Next)
+		}
+		if section := nav.SectionName(); section != test.Section {
+			t.Errorf("getPageNav(%q, ...) section is %q, should be %q", test.Path,
+				section, test.Section)
+		}
+	}
+}
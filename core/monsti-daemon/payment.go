@@ -0,0 +1,186 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/chrneumann/mimemail"
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// pendingSubmission is a form submission waiting for its payment.
+type pendingSubmission struct {
+	// NodePath is the path of the form node.
+	NodePath    string
+	Mail        mimemail.Mail
+	Attachments []service.MailAttachment `json:",omitempty"`
+}
+
+// pendingSubmissionPath returns the path to the pending submission
+// with the given token inside the given site data directory.
+func pendingSubmissionPath(dataDir, token string) string {
+	return filepath.Join(dataDir, "payments", token+".json")
+}
+
+// getPendingSubmission reads the pending submission with the given token.
+//
+// If there is no such submission or the token is invalid, it returns
+// nil, nil.
+func getPendingSubmission(dataDir, token string) (*pendingSubmission, error) {
+	if !validFormStateToken(token) {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(pendingSubmissionPath(dataDir, token))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Could not read pending submission: %v", err)
+	}
+	submission := new(pendingSubmission)
+	if err = json.Unmarshal(content, submission); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal pending submission: %v", err)
+	}
+	return submission, nil
+}
+
+// writePendingSubmission writes the pending submission with the given token.
+func writePendingSubmission(dataDir, token string,
+	submission *pendingSubmission) error {
+	path := pendingSubmissionPath(dataDir, token)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("Could not create payments directory: %v", err)
+	}
+	content, err := json.Marshal(submission)
+	if err != nil {
+		return fmt.Errorf("Could not marshal pending submission: %v", err)
+	}
+	if err = ioutil.WriteFile(path, content, 0600); err != nil {
+		return fmt.Errorf("Could not write pending submission: %v", err)
+	}
+	return nil
+}
+
+// submitFormMail delivers the mail of a validated form submission with
+// the given attachments, if any.
+//
+// If the form node requires a payment, the submission will be kept
+// until a payment module confirms the payment.
+//
+// Returns the URL the user should be redirected to.
+func submitFormMail(c *reqContext, h *nodeHandler, mail *mimemail.Mail,
+	attachments []service.MailAttachment) (string, error) {
+	nodePath := dirPath(c.Node.Path)
+	payment := c.Node.Payment
+	if payment == nil {
+		if err := c.Serv.Monsti().SendSiteMailWithAttachments(c.Site.Name, mail,
+			attachments); err != nil {
+			return "", fmt.Errorf("Could not send mail: %v", err)
+		}
+		return nodePath + "?submitted", nil
+	}
+	token, err := newFormStateToken()
+	if err != nil {
+		return "", fmt.Errorf("Could not generate payment token: %v", err)
+	}
+	dataDir := h.Settings.Monsti.GetSiteDataPath(c.Site.Name)
+	err = writePendingSubmission(dataDir, token,
+		&pendingSubmission{NodePath: c.Node.Path, Mail: *mail,
+			Attachments: attachments})
+	if err != nil {
+		return "", err
+	}
+	args := service.RequestPaymentArgs{
+		Request:     c.Id,
+		Token:       token,
+		Amount:      payment.Amount,
+		Currency:    payment.Currency,
+		Description: payment.Description,
+		CallbackURL: c.Site.BaseURL + path.Join(nodePath, "@@payment-callback") +
+			"?" + url.Values{"token": {token}}.Encode(),
+	}
+	var ret []service.RequestPaymentRet
+	if err := c.Serv.Monsti().EmitSignal("monsti.RequestPayment", args,
+		&ret); err != nil {
+		return "", fmt.Errorf("Could not emit signal: %v", err)
+	}
+	for _, target := range ret {
+		if len(target.RedirectURL) > 0 {
+			return target.RedirectURL, nil
+		}
+	}
+	return "", fmt.Errorf("No payment module handled the payment for %q",
+		c.Node.Path)
+}
+
+// PaymentCallback handles users returning from the payment provider.
+//
+// Payment modules get asked to confirm the payment. If confirmed, the
+// pending submission will be delivered.
+func (h *nodeHandler) PaymentCallback(c *reqContext) error {
+	if err := c.Req.ParseForm(); err != nil {
+		return err
+	}
+	nodePath := dirPath(c.Node.Path)
+	dataDir := h.Settings.Monsti.GetSiteDataPath(c.Site.Name)
+	token := c.Req.Form.Get("token")
+	if !validFormStateToken(token) {
+		http.Error(c.Res, "Unknown payment", http.StatusNotFound)
+		return nil
+	}
+	submission, err := getPendingSubmission(dataDir, token)
+	if err != nil {
+		return fmt.Errorf("Could not get pending submission: %v", err)
+	}
+	if submission == nil ||
+		dirPath(submission.NodePath) != nodePath {
+		http.Error(c.Res, "Unknown payment", http.StatusNotFound)
+		return nil
+	}
+	var ret []service.ConfirmPaymentRet
+	if err := c.Serv.Monsti().EmitSignal("monsti.ConfirmPayment",
+		service.ConfirmPaymentArgs{Request: c.Id, Token: token}, &ret); err != nil {
+		return fmt.Errorf("Could not emit signal: %v", err)
+	}
+	confirmed := false
+	for _, r := range ret {
+		confirmed = confirmed || r.Confirmed
+	}
+	if !confirmed {
+		http.Redirect(c.Res, c.Req, nodePath+"?payment-failed",
+			http.StatusSeeOther)
+		return nil
+	}
+	if err := c.Serv.Monsti().SendSiteMailWithAttachments(c.Site.Name,
+		&submission.Mail, submission.Attachments); err != nil {
+		return fmt.Errorf("Could not send mail: %v", err)
+	}
+	err = os.Remove(pendingSubmissionPath(dataDir, token))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Could not remove pending submission: %v", err)
+	}
+	http.Redirect(c.Res, c.Req, nodePath+"?submitted", http.StatusSeeOther)
+	return nil
+}
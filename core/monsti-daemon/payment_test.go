@@ -0,0 +1,83 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/chrneumann/mimemail"
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestPendingSubmission(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{},
+		"TestPendingSubmission")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	ret, err := getPendingSubmission(root, "unknown")
+	if ret != nil || err != nil {
+		t.Errorf(`getPendingSubmission(_, "unknown") = %v, %v, should be nil, nil`,
+			ret, err)
+	}
+	submission := pendingSubmission{
+		NodePath: "/contact/",
+		Mail:     mimemail.Mail{Subject: "Contact", Body: []byte("Hello")}}
+	token, err := newFormStateToken()
+	if err != nil {
+		t.Fatalf("Could not generate token: %v", err)
+	}
+	if err := writePendingSubmission(root, token, &submission); err != nil {
+		t.Fatalf("Could not write pending submission: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "secret.json"),
+		[]byte(`{"NodePath":"/contact/"}`), 0600); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	ret, err = getPendingSubmission(root, "../secret")
+	if ret != nil || err != nil {
+		t.Errorf(`getPendingSubmission(_, "../secret") = %v, %v, should be nil, nil`,
+			ret, err)
+	}
+	ret, err = getPendingSubmission(root, token)
+	if err != nil || ret == nil {
+		t.Fatalf("Could not read pending submission: %v", err)
+	}
+	if ret.NodePath != submission.NodePath ||
+		ret.Mail.Subject != submission.Mail.Subject ||
+		string(ret.Mail.Body) != string(submission.Mail.Body) {
+		t.Errorf("Read pending submission is %v, should be %v", ret, submission)
+	}
+}
+
+func TestDirPath(t *testing.T) {
+	tests := []struct{ Path, Expected string }{
+		{"/", "/"},
+		{"", "/"},
+		{"/foo", "/foo/"},
+		{"/foo/", "/foo/"},
+		{"/foo/bar//", "/foo/bar/"}}
+	for _, test := range tests {
+		if ret := dirPath(test.Path); ret != test.Expected {
+			t.Errorf("dirPath(%q) = %q, should be %q", test.Path, ret,
+				test.Expected)
+		}
+	}
+}
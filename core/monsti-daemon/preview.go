@@ -0,0 +1,70 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// previewNode renders the node with the submitted but unsaved field
+// values in the site's master template.
+//
+// The node is rendered as requested by a GET request without form
+// values, so forms of the node don't get submitted. Uploaded files
+// are not previewed.
+func (h *nodeHandler) previewNode(c *reqContext, node *service.Node,
+	fields []*service.NodeField, data util.NestedMap) error {
+	for _, field := range fields {
+		if field.Compute == "" {
+			node.GetField(field.Id).FromFormField(data, field)
+		}
+	}
+	allowlist, err := getHTMLAllowlist(c.Serv, c.Site.Name)
+	if err != nil {
+		return err
+	}
+	sanitizeHTMLFields(node, allowlist)
+	req := *c.Req
+	req.Method = "GET"
+	req.Form, req.PostForm, req.MultipartForm = url.Values{}, url.Values{}, nil
+	preview := *c
+	preview.Req = &req
+	preview.Node = node
+	preview.Action = service.ViewAction
+	rendered, err := h.RenderNode(&preview, nil)
+	if err != nil {
+		return fmt.Errorf("Could not render node preview: %v", err)
+	}
+	notice, err := h.Renderer.Render("blocks/preview-notice",
+		template.Context{"Node": node}, c.UserSession.Locale,
+		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Could not render preview notice: %v", err)
+	}
+	env := masterTmplEnv{Node: node, Session: c.UserSession,
+		Meta: getPageMeta(node, getNodeTitle(node), c.Site.BaseURL)}
+	c.Res.Header().Set("Cache-Control", "no-store")
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer,
+		append([]byte(notice), rendered...), env, h.Settings, *c.Site,
+		c.UserSession.Locale, c.Serv))
+	return nil
+}
@@ -0,0 +1,354 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chrneumann/mimemail"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// quarantinedFile is an uploaded file flagged by a scanner.
+type quarantinedFile struct {
+	Id   string
+	Time time.Time
+	// Login of the uploading user.
+	Login string
+	// Name is the name of the uploaded file.
+	Name     string
+	Size     int64
+	MIMEType string
+	// Reason is the reason given by the scanner.
+	Reason string
+	// Node and Field are the node path and the id of the file field
+	// the file has been uploaded to. Node is empty for files uploaded
+	// to the user's file area.
+	Node, Field string
+}
+
+// quarantinePath returns the path to the quarantine inside the given
+// site data directory.
+func quarantinePath(dataDir string) string {
+	return filepath.Join(dataDir, "quarantine")
+}
+
+// validQuarantineId returns true iff the id may be the id of a
+// quarantined file.
+func validQuarantineId(id string) bool {
+	_, err := strconv.ParseUint(id, 10, 64)
+	return err == nil
+}
+
+// addQuarantinedFile writes the file into the given quarantine and
+// sets its id, size and MIME type.
+func addQuarantinedFile(dir string, file *quarantinedFile,
+	content []byte) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Could not create quarantine directory: %v", err)
+	}
+	file.Id = strconv.FormatInt(file.Time.UnixNano(), 10)
+	file.Size = int64(len(content))
+	file.MIMEType = http.DetectContentType(content)
+	meta, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not marshal quarantined file: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, file.Id+".data"), content, 0600)
+	if err != nil {
+		return fmt.Errorf("Could not write quarantined file: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, file.Id+".json"), meta, 0600)
+	if err != nil {
+		return fmt.Errorf("Could not write quarantined file: %v", err)
+	}
+	return nil
+}
+
+// readQuarantinedFile reads the quarantined file with the given id.
+func readQuarantinedFile(dir, id string) (*quarantinedFile, error) {
+	if !validQuarantineId(id) {
+		return nil, fmt.Errorf("Invalid quarantine id %q", id)
+	}
+	meta, err := ioutil.ReadFile(filepath.Join(dir, id+".json"))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read quarantined file: %v", err)
+	}
+	file := new(quarantinedFile)
+	if err := json.Unmarshal(meta, file); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal quarantined file: %v", err)
+	}
+	return file, nil
+}
+
+// readQuarantinedContent returns the content of the quarantined file
+// with the given id.
+func readQuarantinedContent(dir, id string) ([]byte, error) {
+	if !validQuarantineId(id) {
+		return nil, fmt.Errorf("Invalid quarantine id %q", id)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, id+".data"))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read quarantined file: %v", err)
+	}
+	return content, nil
+}
+
+// removeQuarantinedFile removes the quarantined file with the given
+// id.
+func removeQuarantinedFile(dir, id string) error {
+	if !validQuarantineId(id) {
+		return fmt.Errorf("Invalid quarantine id %q", id)
+	}
+	for _, ext := range []string{".data", ".json"} {
+		err := os.Remove(filepath.Join(dir, id+ext))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Could not remove quarantined file: %v", err)
+		}
+	}
+	return nil
+}
+
+// listQuarantinedFiles returns the files in the given quarantine
+// ordered by time.
+func listQuarantinedFiles(dir string) ([]*quarantinedFile, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Could not read quarantine: %v", err)
+	}
+	files := make([]*quarantinedFile, 0, len(infos))
+	for _, info := range infos {
+		id := strings.TrimSuffix(info.Name(), ".json")
+		if id == info.Name() || !validQuarantineId(id) {
+			continue
+		}
+		file, err := readQuarantinedFile(dir, id)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	sort.Sort(quarantinedFilesByTime(files))
+	return files, nil
+}
+
+type quarantinedFilesByTime []*quarantinedFile
+
+func (s quarantinedFilesByTime) Len() int           { return len(s) }
+func (s quarantinedFilesByTime) Less(i, j int) bool { return s[i].Time.Before(s[j].Time) }
+func (s quarantinedFilesByTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// scanUpload lets modules scan the uploaded file. The login is empty
+// for files uploaded by visitors.
+//
+// Returns the reason if a module flagged the file.
+func scanUpload(c *reqContext, name string, content []byte) (string, error) {
+	var login string
+	if c.UserSession.User != nil {
+		login = c.UserSession.User.Login
+	}
+	var ret []service.ScanUploadRet
+	err := c.Serv.Monsti().EmitSignal("monsti.ScanUpload",
+		service.ScanUploadArgs{Site: c.Site.Name, Login: login, Name: name,
+			Content: content}, &ret)
+	if err != nil {
+		return "", fmt.Errorf("Could not emit signal: %v", err)
+	}
+	for _, result := range ret {
+		if result.Flagged {
+			return result.Reason, nil
+		}
+	}
+	return "", nil
+}
+
+// screenUpload lets modules scan the uploaded file. Flagged files get
+// quarantined.
+//
+// Returns the reason if the file has been quarantined.
+func screenUpload(c *reqContext, h *nodeHandler, file quarantinedFile,
+	content []byte) (string, error) {
+	reason, err := scanUpload(c, file.Name, content)
+	if err != nil || reason == "" {
+		return "", err
+	}
+	file.Time = time.Now().UTC()
+	file.Login = c.UserSession.User.Login
+	file.Reason = reason
+	dir := quarantinePath(h.Settings.Monsti.GetSiteDataPath(c.Site.Name))
+	if err := addQuarantinedFile(dir, &file, content); err != nil {
+		return "", err
+	}
+	return reason, nil
+}
+
+// quarantineMail returns the mail informing the uploader about the
+// review of the quarantined file.
+func quarantineMail(site util.SiteSettings, G func(string) string,
+	user *service.User, file *quarantinedFile, released bool) *mimemail.Mail {
+	decision := G("has been deleted")
+	if released {
+		decision = G("has been released")
+	}
+	mail := mimemail.Mail{
+		From:    mimemail.Address{Name: site.EmailName, Email: site.EmailAddress},
+		Subject: G("Quarantined file reviewed"),
+		Body: []byte(fmt.Sprintf(`Hello,
+
+the file %q you uploaded to "%v" has been quarantined because of the
+following reason:
+
+%v
+
+After review, the file %v.
+
+This is an automatically generated email. Please don't reply to it.
+`, file.Name, site.Title, file.Reason, decision))}
+	mail.To = []mimemail.Address{{Name: user.Name, Email: user.Email}}
+	return &mail
+}
+
+// releaseQuarantinedFile writes the quarantined file to its
+// destination.
+//
+// Returns a translated message if the file can't be released.
+func releaseQuarantinedFile(c *reqContext, h *nodeHandler,
+	file *quarantinedFile, content []byte) (string, error) {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if file.Node == "" {
+		dir := userFilesPath(h.Settings.Monsti.GetSiteDataPath(c.Site.Name),
+			file.Login)
+		switch err := addUserFile(dir, file.Name, content,
+			c.Site.UserFileQuota); {
+		case err == errQuotaExceeded:
+			return G("The file exceeds the uploader's quota."), nil
+		case err != nil:
+			return "", err
+		}
+		return "", nil
+	}
+	node, err := c.Serv.Monsti().GetNode(c.Site.Name, file.Node)
+	if err != nil {
+		return "", fmt.Errorf("Could not get node: %v", err)
+	}
+	if node == nil {
+		return G("The node of the file does not exist."), nil
+	}
+	if node.Type.Id == "core.Image" && file.Field == "core.File" {
+		return "", writeImageUpload(c, h, node.Path, content)
+	}
+	if err := c.Serv.Monsti().WriteNodeData(c.Site.Name, node.Path,
+		"__file_"+file.Field, content); err != nil {
+		return "", fmt.Errorf("Could not save file: %v", err)
+	}
+	return "", nil
+}
+
+// Quarantine shows the queue of quarantined files and handles their
+// release or deletion.
+func (h *nodeHandler) Quarantine(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if err := c.Req.ParseForm(); err != nil {
+		return err
+	}
+	dataDir := h.Settings.Monsti.GetSiteDataPath(c.Site.Name)
+	dir := quarantinePath(dataDir)
+	context := template.Context{}
+	switch c.Req.Method {
+	case "GET":
+		context["Done"] = c.Req.Form.Get("done")
+	case "POST":
+		id := c.Req.Form.Get("Id")
+		file, err := readQuarantinedFile(dir, id)
+		if err != nil {
+			return err
+		}
+		released := len(c.Req.Form.Get("Release")) > 0
+		if released {
+			content, err := readQuarantinedContent(dir, id)
+			if err != nil {
+				return err
+			}
+			msg, err := releaseQuarantinedFile(c, h, file, content)
+			if err != nil {
+				return fmt.Errorf("Could not release file: %v", err)
+			}
+			if msg != "" {
+				context["Error"] = msg
+				break
+			}
+		}
+		if err := removeQuarantinedFile(dir, id); err != nil {
+			return err
+		}
+		uploader, err := getUser(file.Login, dataDir)
+		if err != nil {
+			return fmt.Errorf("Could not get uploader: %v", err)
+		}
+		if uploader != nil && uploader.Email != "" {
+			siteG, _, _, _ := gettext.DefaultLocales.Use("", c.Site.Locale)
+			mail := quarantineMail(h.Settings.Monsti.Sites[c.Site.Name], siteG,
+				uploader, file, released)
+			if err := c.Serv.Monsti().SendSiteMail(c.Site.Name, mail); err != nil {
+				return fmt.Errorf("Could not send notification: %v", err)
+			}
+		}
+		done := "deleted"
+		if released {
+			done = "released"
+		}
+		http.Redirect(c.Res, c.Req, "@@quarantine?"+url.Values{
+			"done": {done}}.Encode(), http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	files, err := listQuarantinedFiles(dir)
+	if err != nil {
+		return err
+	}
+	context["Files"] = files
+	body, err := h.Renderer.Render("actions/quarantine", context,
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render quarantine: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("Quarantine"),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
@@ -0,0 +1,108 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestQuarantine(t *testing.T) {
+	root, err := ioutil.TempDir("", "monsti-test")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	dir := quarantinePath(root)
+	files, err := listQuarantinedFiles(dir)
+	if err != nil || len(files) != 0 {
+		t.Fatalf("listQuarantinedFiles of missing quarantine = %v, %v", files, err)
+	}
+	now := time.Date(2014, 12, 20, 12, 0, 0, 0, time.UTC)
+	later := &quarantinedFile{Time: now.Add(time.Minute), Name: "b.txt",
+		Login: "jane", Reason: "Eicar-Test-Signature"}
+	earlier := &quarantinedFile{Time: now, Name: "a.pdf", Login: "joe",
+		Node: "/foo", Field: "core.File", Reason: "Suspicious"}
+	for _, file := range []*quarantinedFile{later, earlier} {
+		if err := addQuarantinedFile(dir, file,
+			[]byte("Hello "+file.Name)); err != nil {
+			t.Fatalf("addQuarantinedFile returned error: %v", err)
+		}
+	}
+	if earlier.Size != 11 || !strings.HasPrefix(earlier.MIMEType, "text/plain") {
+		t.Errorf("addQuarantinedFile set size %v and type %q, should be 11, text/plain",
+			earlier.Size, earlier.MIMEType)
+	}
+	files, err = listQuarantinedFiles(dir)
+	if err != nil {
+		t.Fatalf("listQuarantinedFiles returned error: %v", err)
+	}
+	if len(files) != 2 || *files[0] != *earlier || *files[1] != *later {
+		t.Errorf("listQuarantinedFiles(...) = %v, should be [%v %v]", files,
+			earlier, later)
+	}
+	content, err := readQuarantinedContent(dir, later.Id)
+	if err != nil || !bytes.Equal(content, []byte("Hello b.txt")) {
+		t.Errorf("readQuarantinedContent(...) = %q, %v", content, err)
+	}
+	if _, err := readQuarantinedFile(dir, "../users"); err == nil {
+		t.Errorf("readQuarantinedFile should fail for invalid ids")
+	}
+	if err := removeQuarantinedFile(dir, later.Id); err != nil {
+		t.Fatalf("removeQuarantinedFile returned error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, later.Id+".data")); !os.IsNotExist(err) {
+		t.Errorf("removeQuarantinedFile should remove the file's content")
+	}
+	files, err = listQuarantinedFiles(dir)
+	if err != nil || len(files) != 1 || files[0].Id != earlier.Id {
+		t.Errorf("listQuarantinedFiles after removal = %v, %v", files, err)
+	}
+}
+
+func TestQuarantineMail(t *testing.T) {
+	site := util.SiteSettings{Title: "Example", EmailName: "Monsti",
+		EmailAddress: "monsti@example.com"}
+	G := func(in string) string { return in }
+	user := &service.User{Login: "jane", Name: "Jane Doe",
+		Email: "jane@example.com"}
+	file := &quarantinedFile{Name: "a.pdf", Reason: "Eicar-Test-Signature"}
+	for _, released := range []bool{true, false} {
+		mail := quarantineMail(site, G, user, file, released)
+		decision := "has been deleted"
+		if released {
+			decision = "has been released"
+		}
+		body := string(mail.Body)
+		if !strings.Contains(body, `"a.pdf"`) ||
+			!strings.Contains(body, "Eicar-Test-Signature") ||
+			!strings.Contains(body, decision) {
+			t.Errorf("quarantineMail(..., %v) has body %q", released, body)
+		}
+		if len(mail.To) != 1 || mail.To[0].Email != "jane@example.com" {
+			t.Errorf("quarantineMail(...) has recipients %v", mail.To)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// rateLimit limits the requests of each client to matching paths.
+type rateLimit struct {
+	Prefix, Action, Method string
+	Requests               int
+	Period, Ban            time.Duration
+}
+
+// matches returns true iff the limit applies to requests with the
+// given method, node path and action.
+func (l *rateLimit) matches(method, nodePath, action string) bool {
+	if l.Method != "" && !strings.EqualFold(l.Method, method) {
+		return false
+	}
+	if l.Action != "" && l.Action != action {
+		return false
+	}
+	return l.Prefix == "/" || nodePath == l.Prefix ||
+		strings.HasPrefix(nodePath, l.Prefix+"/")
+}
+
+// parseRateLimit parses the rate limit of a site's settings.
+func parseRateLimit(limit util.RateLimit) (*rateLimit, error) {
+	ret := rateLimit{Prefix: limit.Prefix, Action: limit.Action,
+		Method: limit.Method, Requests: limit.Requests}
+	if ret.Prefix == "" {
+		ret.Prefix = "/"
+	}
+	if !strings.HasPrefix(ret.Prefix, "/") ||
+		path.Clean(ret.Prefix) != ret.Prefix {
+		return nil, fmt.Errorf("Invalid prefix %q", limit.Prefix)
+	}
+	if ret.Requests < 1 {
+		return nil, fmt.Errorf("Invalid number of requests: %v", limit.Requests)
+	}
+	var err error
+	if ret.Period, err = time.ParseDuration(limit.Period); err != nil ||
+		ret.Period <= 0 {
+		return nil, fmt.Errorf("Invalid period %q", limit.Period)
+	}
+	if limit.Ban != "" {
+		if ret.Ban, err = time.ParseDuration(limit.Ban); err != nil ||
+			ret.Ban <= 0 {
+			return nil, fmt.Errorf("Invalid ban %q", limit.Ban)
+		}
+	}
+	return &ret, nil
+}
+
+// rateKey identifies the requests of a client to a site counted by a
+// limit.
+type rateKey struct {
+	Site  string
+	Limit int
+	IP    string
+}
+
+// banKey identifies a banned client of a site.
+type banKey struct {
+	Site, IP string
+}
+
+// rateSweepInterval is the interval to forget refilled buckets and
+// expired bans.
+const rateSweepInterval = time.Minute
+
+// rateLimiter enforces the rate limits of the sites.
+type rateLimiter struct {
+	// Limits maps site names to their rate limits.
+	Limits map[string][]*rateLimit
+	mutex  sync.Mutex
+	// buckets hold the time at which the requests of each client would
+	// be back to zero if they had been evenly spaced, i.e. one every
+	// Period/Requests.
+	buckets map[rateKey]time.Time
+	bans    map[banKey]time.Time
+	swept   time.Time
+}
+
+// defaultCommentsLimit limits the comments posted by each client to
+// sites without a rate limit for the comments action.
+var defaultCommentsLimit = rateLimit{Prefix: "/", Action: "comments",
+	Method: "POST", Requests: 5, Period: 10 * time.Minute}
+
+// newRateLimiter returns the rate limiter of the given sites or nil if
+// there are no rate limits.
+func newRateLimiter(sites map[string]util.SiteSettings) (*rateLimiter, error) {
+	limits := make(map[string][]*rateLimit)
+	for name, site := range sites {
+		comments := false
+		for i, limit := range site.RateLimits {
+			parsed, err := parseRateLimit(limit)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid rate limit %v of site %v: %v",
+					i+1, name, err)
+			}
+			limits[name] = append(limits[name], parsed)
+			comments = comments || parsed.Action == defaultCommentsLimit.Action
+		}
+		if !comments {
+			limit := defaultCommentsLimit
+			limits[name] = append(limits[name], &limit)
+		}
+	}
+	if len(limits) == 0 {
+		return nil, nil
+	}
+	return &rateLimiter{Limits: limits,
+		buckets: make(map[rateKey]time.Time),
+		bans:    make(map[banKey]time.Time)}, nil
+}
+
+// allow counts the request of the client to the site and returns
+// zero if it's allowed. Otherwise, it returns the duration after which
+// the client may try again and whether the request got the client
+// banned.
+func (r *rateLimiter) allow(site, ip, method, path string,
+	now time.Time) (time.Duration, bool) {
+	if r == nil || len(r.Limits[site]) == 0 {
+		return 0, false
+	}
+	nodePath, action := splitAction(path)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if now.Sub(r.swept) >= rateSweepInterval {
+		r.sweep(now)
+	}
+	if until, ok := r.bans[banKey{site, ip}]; ok && now.Before(until) {
+		return until.Sub(now), false
+	}
+	var retry, ban time.Duration
+	for i, limit := range r.Limits[site] {
+		if !limit.matches(method, nodePath, action) {
+			continue
+		}
+		key := rateKey{site, i, ip}
+		next := r.buckets[key]
+		if next.Before(now) {
+			next = now
+		}
+		next = next.Add(limit.Period / time.Duration(limit.Requests))
+		wait := next.Sub(now) - limit.Period
+		if wait <= 0 {
+			r.buckets[key] = next
+			continue
+		}
+		if wait > retry {
+			retry = wait
+		}
+		if limit.Ban > ban {
+			ban = limit.Ban
+		}
+	}
+	if ban > 0 {
+		if ban < retry {
+			ban = retry
+		}
+		r.bans[banKey{site, ip}] = now.Add(ban)
+		return ban, true
+	}
+	return retry, false
+}
+
+// sweep forgets refilled buckets and expired bans.
+func (r *rateLimiter) sweep(now time.Time) {
+	for key, next := range r.buckets {
+		if !next.After(now) {
+			delete(r.buckets, key)
+		}
+	}
+	for key, until := range r.bans {
+		if !now.Before(until) {
+			delete(r.bans, key)
+		}
+	}
+	r.swept = now
+}
@@ -0,0 +1,143 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestNewRateLimiter(t *testing.T) {
+	limiter, err := newRateLimiter(nil)
+	if err != nil || limiter != nil {
+		t.Errorf("newRateLimiter without sites = %v, %v, should be nil, nil",
+			limiter, err)
+	}
+	limiter, err = newRateLimiter(map[string]util.SiteSettings{"foo": {}})
+	if err != nil || len(limiter.Limits["foo"]) != 1 ||
+		*limiter.Limits["foo"][0] != defaultCommentsLimit {
+		t.Errorf("newRateLimiter without limits = %v, %v, should limit comments",
+			limiter, err)
+	}
+	limiter, err = newRateLimiter(map[string]util.SiteSettings{
+		"foo": {RateLimits: []util.RateLimit{
+			{Action: "comments", Requests: 50, Period: "1m"}}}})
+	if err != nil || len(limiter.Limits["foo"]) != 1 ||
+		limiter.Limits["foo"][0].Requests != 50 {
+		t.Errorf("newRateLimiter should not add the default comments limit")
+	}
+	for i, limit := range []util.RateLimit{
+		{Requests: 10},
+		{Requests: 0, Period: "1m"},
+		{Requests: 10, Period: "-1m"},
+		{Requests: 10, Period: "1m", Ban: "foo"},
+		{Prefix: "contact", Requests: 10, Period: "1m"},
+		{Prefix: "/contact/", Requests: 10, Period: "1m"},
+	} {
+		_, err := newRateLimiter(map[string]util.SiteSettings{
+			"foo": {RateLimits: []util.RateLimit{limit}}})
+		if err == nil {
+			t.Errorf("%v: newRateLimiter(%v) should fail", i, limit)
+		}
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter, err := newRateLimiter(map[string]util.SiteSettings{
+		"foo": {RateLimits: []util.RateLimit{
+			{Prefix: "/contact", Method: "POST", Requests: 2, Period: "1m"},
+			{Action: "search", Requests: 1, Period: "10s", Ban: "1h"},
+		}}})
+	if err != nil {
+		t.Fatalf("newRateLimiter returned error: %v", err)
+	}
+	start := time.Now()
+	tests := []struct {
+		Site, IP, Method, Path string
+		After                  time.Duration
+		Retry                  time.Duration
+		Banned                 bool
+	}{
+		{"foo", "1.2.3.4", "POST", "/contact", 0, 0, false},
+		{"foo", "1.2.3.4", "POST", "/contact/@@edit", 0, 0, false},
+		{"foo", "1.2.3.4", "POST", "/contact", 0, 30 * time.Second, false},
+		{"foo", "1.2.3.4", "GET", "/contact", 0, 0, false},
+		{"foo", "1.2.3.4", "POST", "/contacts", 0, 0, false},
+		{"foo", "5.6.7.8", "POST", "/contact", 0, 0, false},
+		{"bar", "1.2.3.4", "POST", "/contact", 0, 0, false},
+		{"foo", "1.2.3.4", "POST", "/contact", 20 * time.Second,
+			10 * time.Second, false},
+		{"foo", "1.2.3.4", "POST", "/contact", 30 * time.Second, 0, false},
+		{"foo", "1.2.3.4", "GET", "/@@search", 0, 0, false},
+		{"foo", "1.2.3.4", "GET", "/blog/@@search", 0, time.Hour, true},
+		{"foo", "1.2.3.4", "GET", "/", 0, time.Hour, false},
+		{"foo", "1.2.3.4", "GET", "/", time.Hour, 0, false},
+		{"foo", "1.2.3.4", "GET", "/@@search", time.Hour, 0, false},
+	}
+	now := start
+	for i, test := range tests {
+		now = now.Add(test.After)
+		retry, banned := limiter.allow(test.Site, test.IP, test.Method,
+			test.Path, now)
+		if retry != test.Retry || banned != test.Banned {
+			t.Errorf("%v: allow(%q, %q, %q, %q) = %v, %v, should be %v, %v", i,
+				test.Site, test.IP, test.Method, test.Path, retry, banned,
+				test.Retry, test.Banned)
+		}
+	}
+	limiter.sweep(now.Add(time.Minute))
+	if len(limiter.buckets) != 0 || len(limiter.bans) != 0 {
+		t.Errorf("sweep left %v buckets and %v bans, should be none",
+			len(limiter.buckets), len(limiter.bans))
+	}
+}
+
+func TestServeHTTPRateLimit(t *testing.T) {
+	sites := map[string]util.SiteSettings{"foo": {Hosts: []string{"foo.com"},
+		RateLimits: []util.RateLimit{{Requests: 1, Period: "10s", Ban: "2m"}}}}
+	hosts, _, err := newHostTables(sites)
+	if err != nil {
+		t.Fatalf("newHostTables returned error: %v", err)
+	}
+	var logs bytes.Buffer
+	h := &nodeHandler{Hosts: hosts, Log: log.New(&logs, "", 0)}
+	if h.RateLimits, err = newRateLimiter(sites); err != nil {
+		t.Fatalf("newRateLimiter returned error: %v", err)
+	}
+	h.RateLimits.allow("foo", "1.2.3.4", "GET", "/", time.Now())
+	req, _ := http.NewRequest("GET", "http://foo.com/", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Status is %v, should be %v", rec.Code,
+			http.StatusTooManyRequests)
+	}
+	if retry := rec.Header().Get("Retry-After"); retry != "120" {
+		t.Errorf("Retry-After is %q, should be %q", retry, "120")
+	}
+	if !strings.Contains(logs.String(), "Banned 1.2.3.4 from site foo") {
+		t.Errorf("Ban has not been logged: %q", logs.String())
+	}
+}
@@ -0,0 +1,546 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/chrneumann/htmlwidgets"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// Kinds of redirects.
+const (
+	// redirectPath redirects the path and the paths below it, e.g.
+	// "/old/foo" to "/new/foo" for a redirect from "/old" to "/new".
+	redirectPath = ""
+	// redirectWildcard redirects paths matching a pattern where "*"
+	// matches any text. The target may refer to the matched texts
+	// using $1, $2 and so on.
+	redirectWildcard = "wildcard"
+	// redirectRegexp redirects paths matching a regular expression. The
+	// target may refer to submatches using $1, $2 and so on.
+	redirectRegexp = "regexp"
+)
+
+// maxNotFoundPaths is the number of missing paths whose hits are
+// counted. Paths longer than maxNotFoundPathLength bytes get
+// truncated.
+const (
+	maxNotFoundPaths      = 500
+	maxNotFoundPathLength = 256
+)
+
+// notFoundFlushInterval is the interval in which counted 404 hits are
+// written to the site data directories.
+const notFoundFlushInterval = time.Minute
+
+// redirect redirects requests to missing nodes.
+type redirect struct {
+	Id string
+	// From is the path or pattern of requested paths, To the target
+	// path or URL.
+	From, To string
+	// Kind is either redirectPath, redirectWildcard or redirectRegexp.
+	Kind string `json:",omitempty"`
+	// Auto is true for redirects recorded when renaming nodes.
+	Auto    bool `json:",omitempty"`
+	Created time.Time
+}
+
+// notFoundPath counts the requests to a missing path.
+type notFoundPath struct {
+	Path  string
+	Hits  int
+	Last  time.Time
+	First time.Time
+}
+
+// redirectsMutex serializes updates of redirects and 404 hits.
+var redirectsMutex sync.Mutex
+
+// pendingNotFound holds the 404 hits not yet written, by site data
+// directory and path. Guarded by redirectsMutex.
+var pendingNotFound = make(map[string]map[string]*notFoundPath)
+
+// redirectsPath returns the path to the redirects inside the given site
+// data directory.
+func redirectsPath(dataDir string) string {
+	return filepath.Join(dataDir, "redirects.json")
+}
+
+// notFoundPathsPath returns the path to the 404 hits inside the given
+// site data directory.
+func notFoundPathsPath(dataDir string) string {
+	return filepath.Join(dataDir, "not-found.json")
+}
+
+// readJSONFile unmarshals the given file into out. Missing files leave
+// out unchanged.
+func readJSONFile(path string, out interface{}) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(content, out)
+}
+
+// writeJSONFile writes the JSON encoding of value to the given file.
+func writeJSONFile(path string, value interface{}) error {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, content, 0600)
+}
+
+// readRedirects returns the redirects of the given site data directory.
+func readRedirects(dataDir string) ([]*redirect, error) {
+	redirects := make([]*redirect, 0)
+	if err := readJSONFile(redirectsPath(dataDir), &redirects); err != nil {
+		return nil, fmt.Errorf("Could not read redirects: %v", err)
+	}
+	return redirects, nil
+}
+
+// writeRedirects writes the redirects of the given site data directory.
+func writeRedirects(dataDir string, redirects []*redirect) error {
+	if err := writeJSONFile(redirectsPath(dataDir), redirects); err != nil {
+		return fmt.Errorf("Could not write redirects: %v", err)
+	}
+	return nil
+}
+
+// pattern returns the regular expression matching the paths of
+// wildcard and regexp redirects.
+func (r *redirect) pattern() (*regexp.Regexp, error) {
+	expr := r.From
+	if r.Kind == redirectWildcard {
+		parts := strings.Split(r.From, "*")
+		for i := range parts {
+			parts[i] = regexp.QuoteMeta(parts[i])
+		}
+		expr = strings.Join(parts, "(.*)")
+	}
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// target returns the target of the redirect for the requested path or
+// an empty string if the redirect does not match.
+func (r *redirect) target(reqPath string) (string, error) {
+	switch r.Kind {
+	case redirectPath:
+		from := strings.TrimSuffix(r.From, "/")
+		switch {
+		case reqPath == from || reqPath == from+"/":
+			return r.To, nil
+		case strings.HasPrefix(reqPath, from+"/"):
+			return strings.TrimSuffix(r.To, "/") + reqPath[len(from):], nil
+		}
+		return "", nil
+	case redirectWildcard, redirectRegexp:
+		pattern, err := r.pattern()
+		if err != nil {
+			return "", err
+		}
+		match := pattern.FindStringSubmatchIndex(reqPath)
+		if match == nil {
+			return "", nil
+		}
+		return string(pattern.ExpandString(nil, r.To, reqPath, match)), nil
+	}
+	return "", fmt.Errorf("Unknown kind of redirect: %q", r.Kind)
+}
+
+// findRedirect returns the target of the first redirect matching the
+// requested path or an empty string if there is none. Invalid redirects
+// are skipped.
+func findRedirect(redirects []*redirect, reqPath string) string {
+	for _, redirect := range redirects {
+		if target, err := redirect.target(reqPath); err == nil && target != "" {
+			return target
+		}
+	}
+	return ""
+}
+
+// validRedirect checks the given redirect.
+//
+// Returns a translated message if the redirect is invalid.
+func validRedirect(r *redirect, G func(string) string) string {
+	if r.From == "" || r.To == "" {
+		return G("Please enter the source and the target.")
+	}
+	if r.Kind != redirectRegexp && !strings.HasPrefix(r.From, "/") {
+		return G("The source must start with a slash.")
+	}
+	if !strings.HasPrefix(r.To, "/") && !strings.HasPrefix(r.To, "http://") &&
+		!strings.HasPrefix(r.To, "https://") {
+		return G("The target must be a path or an URL.")
+	}
+	if r.Kind != redirectPath {
+		if _, err := r.pattern(); err != nil {
+			return G("The source is not a valid pattern.")
+		}
+	}
+	return ""
+}
+
+// addRedirect appends the redirect to the redirects of the given site
+// directory and sets its id and creation time.
+func addRedirect(dataDir string, r *redirect, now time.Time) error {
+	redirectsMutex.Lock()
+	defer redirectsMutex.Unlock()
+	redirects, err := readRedirects(dataDir)
+	if err != nil {
+		return err
+	}
+	r.Created = now
+	r.Id = strconv.FormatInt(now.UnixNano(), 10)
+	return writeRedirects(dataDir, append(redirects, r))
+}
+
+// removeRedirect removes the redirect with the given id from the
+// redirects of the given site data directory.
+func removeRedirect(dataDir, id string) error {
+	redirectsMutex.Lock()
+	defer redirectsMutex.Unlock()
+	redirects, err := readRedirects(dataDir)
+	if err != nil {
+		return err
+	}
+	kept := make([]*redirect, 0, len(redirects))
+	for _, redirect := range redirects {
+		if redirect.Id != id {
+			kept = append(kept, redirect)
+		}
+	}
+	return writeRedirects(dataDir, kept)
+}
+
+// recordRename adds a redirect from the source to the target path of a
+// renamed node. Redirects to the source get updated to point to the
+// target to avoid chains of redirects.
+func recordRename(dataDir, source, target string, now time.Time) error {
+	redirectsMutex.Lock()
+	defer redirectsMutex.Unlock()
+	redirects, err := readRedirects(dataDir)
+	if err != nil {
+		return err
+	}
+	rename := &redirect{From: source, To: target, Kind: redirectPath}
+	kept := make([]*redirect, 0, len(redirects)+1)
+	for _, redirect := range redirects {
+		if redirect.Kind == redirectPath && redirect.From == source {
+			continue
+		}
+		if moved, _ := rename.target(redirect.To); moved != "" {
+			redirect.To = moved
+		}
+		if redirect.Kind == redirectPath &&
+			strings.TrimSuffix(redirect.From, "/") ==
+				strings.TrimSuffix(redirect.To, "/") {
+			continue
+		}
+		kept = append(kept, redirect)
+	}
+	rename.Auto = true
+	rename.Created = now
+	rename.Id = strconv.FormatInt(now.UnixNano(), 10)
+	return writeRedirects(dataDir, append(kept, rename))
+}
+
+// readNotFoundPaths returns the 404 hits of the given site data
+// directory, most hits first.
+func readNotFoundPaths(dataDir string) ([]*notFoundPath, error) {
+	paths := make([]*notFoundPath, 0)
+	if err := readJSONFile(notFoundPathsPath(dataDir), &paths); err != nil {
+		return nil, fmt.Errorf("Could not read 404 hits: %v", err)
+	}
+	sort.Sort(notFoundPathsByHits(paths))
+	return paths, nil
+}
+
+type notFoundPathsByHits []*notFoundPath
+
+func (s notFoundPathsByHits) Len() int      { return len(s) }
+func (s notFoundPathsByHits) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s notFoundPathsByHits) Less(i, j int) bool {
+	return s[i].Hits > s[j].Hits ||
+		(s[i].Hits == s[j].Hits && s[i].Last.After(s[j].Last))
+}
+
+// truncateNotFoundPath shortens the path to maxNotFoundPathLength
+// bytes without splitting characters.
+func truncateNotFoundPath(reqPath string) string {
+	if len(reqPath) <= maxNotFoundPathLength {
+		return reqPath
+	}
+	reqPath = reqPath[:maxNotFoundPathLength]
+	for len(reqPath) > 0 && !utf8.ValidString(reqPath) {
+		reqPath = reqPath[:len(reqPath)-1]
+	}
+	return reqPath
+}
+
+// recordNotFound counts a request to the missing path. The hits are
+// kept in memory until written by flushNotFound. Hits of new paths are
+// dropped if maxNotFoundPaths paths are pending.
+func recordNotFound(dataDir, reqPath string, now time.Time) {
+	reqPath = truncateNotFoundPath(reqPath)
+	redirectsMutex.Lock()
+	defer redirectsMutex.Unlock()
+	pending := pendingNotFound[dataDir]
+	if pending == nil {
+		pending = make(map[string]*notFoundPath)
+		pendingNotFound[dataDir] = pending
+	}
+	if entry, ok := pending[reqPath]; ok {
+		entry.Hits++
+		entry.Last = now
+		return
+	}
+	if len(pending) < maxNotFoundPaths {
+		pending[reqPath] = &notFoundPath{reqPath, 1, now, now}
+	}
+}
+
+// flushNotFound writes the pending 404 hits of the given site data
+// directory. Only the maxNotFoundPaths most recently requested paths
+// are kept.
+func flushNotFound(dataDir string) error {
+	redirectsMutex.Lock()
+	defer redirectsMutex.Unlock()
+	return flushNotFoundLocked(dataDir)
+}
+
+// flushNotFoundLocked is flushNotFound for callers holding
+// redirectsMutex.
+func flushNotFoundLocked(dataDir string) error {
+	pending := pendingNotFound[dataDir]
+	if len(pending) == 0 {
+		return nil
+	}
+	paths, err := readNotFoundPaths(dataDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range paths {
+		if hits, ok := pending[entry.Path]; ok {
+			entry.Hits += hits.Hits
+			entry.Last = hits.Last
+			delete(pending, entry.Path)
+		}
+	}
+	for _, hits := range pending {
+		paths = append(paths, hits)
+	}
+	if len(paths) > maxNotFoundPaths {
+		sort.Sort(notFoundPathsByLast(paths))
+		paths = paths[:maxNotFoundPaths]
+	}
+	if err := writeJSONFile(notFoundPathsPath(dataDir), paths); err != nil {
+		return fmt.Errorf("Could not write 404 hits: %v", err)
+	}
+	delete(pendingNotFound, dataDir)
+	return nil
+}
+
+// notFoundPathsByLast sorts 404 hits by their last request, most
+// recent first.
+type notFoundPathsByLast []*notFoundPath
+
+func (s notFoundPathsByLast) Len() int           { return len(s) }
+func (s notFoundPathsByLast) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s notFoundPathsByLast) Less(i, j int) bool { return s[i].Last.After(s[j].Last) }
+
+// scheduleNotFoundFlush periodically writes the pending 404 hits of
+// all sites.
+func scheduleNotFoundFlush(settings *settings, logger *log.Logger) {
+	for {
+		time.Sleep(notFoundFlushInterval)
+		for site := range settings.Monsti.Sites {
+			if err := flushNotFound(
+				settings.Monsti.GetSiteDataPath(site)); err != nil {
+				logger.Printf("Could not write 404 hits of site %q: %v", site, err)
+			}
+		}
+	}
+}
+
+// clearNotFound removes the hits of the given path or all hits if the
+// path is empty.
+func clearNotFound(dataDir, reqPath string) error {
+	redirectsMutex.Lock()
+	defer redirectsMutex.Unlock()
+	if err := flushNotFoundLocked(dataDir); err != nil {
+		return err
+	}
+	paths, err := readNotFoundPaths(dataDir)
+	if err != nil {
+		return err
+	}
+	kept := make([]*notFoundPath, 0, len(paths))
+	for _, entry := range paths {
+		if reqPath != "" && entry.Path != reqPath {
+			kept = append(kept, entry)
+		}
+	}
+	if err := writeJSONFile(notFoundPathsPath(dataDir), kept); err != nil {
+		return fmt.Errorf("Could not write 404 hits: %v", err)
+	}
+	return nil
+}
+
+// redirectMissing redirects the request to a missing node if there is
+// a matching redirect. Otherwise, the request gets counted as 404 hit.
+//
+// Returns true if the request has been redirected.
+func (h *nodeHandler) redirectMissing(c *reqContext) bool {
+	dataDir := h.Settings.Monsti.GetSiteDataPath(c.Site.Name)
+	redirects, err := readRedirects(dataDir)
+	if err != nil {
+		h.Log.Printf("Could not get redirects of %v: %v", c.Site.Name, err)
+		return false
+	}
+	if target := findRedirect(redirects, c.Req.URL.Path); target != "" {
+		if c.Req.URL.RawQuery != "" && !strings.Contains(target, "?") {
+			target += "?" + c.Req.URL.RawQuery
+		}
+		http.Redirect(c.Res, c.Req, target, http.StatusMovedPermanently)
+		return true
+	}
+	recordNotFound(dataDir, c.Req.URL.Path, time.Now().UTC())
+	return false
+}
+
+type redirectFormData struct {
+	From, To, Kind string
+}
+
+// Redirects shows the redirects and 404 hits of the site and handles
+// adding and removing redirects.
+func (h *nodeHandler) Redirects(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if err := c.Req.ParseForm(); err != nil {
+		return err
+	}
+	dataDir := h.Settings.Monsti.GetSiteDataPath(c.Site.Name)
+	data := redirectFormData{From: c.Req.Form.Get("from")}
+	form := htmlwidgets.NewForm(&data)
+	form.AddWidget(new(htmlwidgets.TextWidget), "From", G("Source"),
+		G("Path, pattern or regular expression of requested paths."))
+	form.AddWidget(new(htmlwidgets.TextWidget), "To", G("Target"),
+		G("Path or URL. Patterns and regular expressions may refer to matches using $1, $2 and so on."))
+	form.AddWidget(&htmlwidgets.SelectWidget{Options: []htmlwidgets.SelectOption{
+		{Value: redirectPath, Description: G("Path and the paths below it")},
+		{Value: redirectWildcard,
+			Description: G("Pattern (* matches any text)")},
+		{Value: redirectRegexp, Description: G("Regular expression")}}},
+		"Kind", G("Kind"), "")
+	form.Action = "@@redirects"
+	context := template.Context{}
+	switch c.Req.Method {
+	case "GET":
+		context["Done"] = c.Req.Form.Get("done")
+	case "POST":
+		done := ""
+		switch {
+		case c.Req.Form.Get("Remove") != "":
+			if err := removeRedirect(dataDir, c.Req.Form.Get("Remove")); err != nil {
+				return err
+			}
+			done = "removed"
+		case c.Req.Form.Get("ClearNotFound") != "":
+			if err := clearNotFound(dataDir,
+				c.Req.Form.Get("Path")); err != nil {
+				return err
+			}
+			done = "cleared"
+		default:
+			if !form.Fill(c.Req.Form) {
+				break
+			}
+			redirect := &redirect{From: strings.TrimSpace(data.From),
+				To: strings.TrimSpace(data.To), Kind: data.Kind}
+			if msg := validRedirect(redirect, G); msg != "" {
+				form.AddError("From", msg)
+				break
+			}
+			if err := addRedirect(dataDir, redirect, time.Now().UTC()); err != nil {
+				return err
+			}
+			if err := clearNotFound(dataDir, redirect.From); err != nil {
+				return err
+			}
+			done = "added"
+		}
+		if done == "" {
+			break
+		}
+		http.Redirect(c.Res, c.Req, "@@redirects?"+url.Values{
+			"done": {done}}.Encode(), http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	redirects, err := readRedirects(dataDir)
+	if err != nil {
+		return err
+	}
+	if err := flushNotFound(dataDir); err != nil {
+		return err
+	}
+	notFound, err := readNotFoundPaths(dataDir)
+	if err != nil {
+		return err
+	}
+	context["Redirects"] = redirects
+	context["NotFound"] = notFound
+	context["Form"] = form.RenderData()
+	body, err := h.Renderer.Render("actions/redirects", context,
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render redirects: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("Redirects"),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
@@ -0,0 +1,176 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestFindRedirect(t *testing.T) {
+	redirects := []*redirect{
+		{From: "/old", To: "/new"},
+		{From: "/blog/*/comments", To: "/posts/$1", Kind: redirectWildcard},
+		{From: `/(\d+)\.html`, To: "/archive/$1/", Kind: redirectRegexp},
+		{From: "/invalid(", To: "/foo", Kind: redirectRegexp},
+		{From: "/away/", To: "https://example.com/"},
+	}
+	tests := []struct {
+		Path, Target string
+	}{
+		{"/old", "/new"},
+		{"/old/", "/new"},
+		{"/old/foo/bar", "/new/foo/bar"},
+		{"/older", ""},
+		{"/blog/2015/comments", "/posts/2015"},
+		{"/blog/2015/comments/", ""},
+		{"/42.html", "/archive/42/"},
+		{"/foo/42.html", ""},
+		{"/away/foo", "https://example.com/foo"},
+		{"/invalid(", ""},
+		{"/", ""},
+	}
+	for _, test := range tests {
+		if target := findRedirect(redirects, test.Path); target != test.Target {
+			t.Errorf("findRedirect(_, %q) = %q, should be %q", test.Path, target,
+				test.Target)
+		}
+	}
+}
+
+func TestValidRedirect(t *testing.T) {
+	G := func(in string) string { return in }
+	tests := []struct {
+		Redirect redirect
+		Valid    bool
+	}{
+		{redirect{From: "/foo", To: "/bar"}, true},
+		{redirect{From: "/foo", To: "https://example.com/"}, true},
+		{redirect{From: "foo", To: "/bar"}, false},
+		{redirect{From: "/foo", To: "bar"}, false},
+		{redirect{From: "", To: "/bar"}, false},
+		{redirect{From: "/foo/*", To: "/bar/$1", Kind: redirectWildcard}, true},
+		{redirect{From: ".*\\.php", To: "/", Kind: redirectRegexp}, true},
+		{redirect{From: "/foo(", To: "/", Kind: redirectRegexp}, false},
+	}
+	for i, test := range tests {
+		if valid := validRedirect(&test.Redirect, G) == ""; valid != test.Valid {
+			t.Errorf("%v: validRedirect(%v) valid = %v, should be %v", i,
+				test.Redirect, valid, test.Valid)
+		}
+	}
+}
+
+func TestRecordRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-redirects")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := addRedirect(dir, &redirect{From: "/manual", To: "/a/foo"},
+		now); err != nil {
+		t.Fatalf("addRedirect returned error: %v", err)
+	}
+	renames := [][2]string{{"/a", "/b"}, {"/b", "/c"}, {"/c", "/b"}}
+	for i, rename := range renames {
+		if err := recordRename(dir, rename[0], rename[1],
+			now.Add(time.Duration(i+1)*time.Second)); err != nil {
+			t.Fatalf("recordRename returned error: %v", err)
+		}
+	}
+	redirects, err := readRedirects(dir)
+	if err != nil {
+		t.Fatalf("readRedirects returned error: %v", err)
+	}
+	expected := map[string]string{"/manual": "/b/foo", "/a": "/b", "/c": "/b"}
+	if len(redirects) != len(expected) {
+		t.Errorf("Got %v redirects, should be %v", len(redirects), len(expected))
+	}
+	for _, redirect := range redirects {
+		if expected[redirect.From] != redirect.To {
+			t.Errorf("Redirect from %q goes to %q, should be %q", redirect.From,
+				redirect.To, expected[redirect.From])
+		}
+		if redirect.Auto != (redirect.From != "/manual") {
+			t.Errorf("Redirect from %q has Auto = %v", redirect.From, redirect.Auto)
+		}
+	}
+}
+
+func TestRecordNotFound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-redirects")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, path := range []string{"/foo", "/bar", "/foo", "/baz", "/bar", "/foo"} {
+		recordNotFound(dir, path, now.Add(time.Duration(i)*time.Second))
+	}
+	if paths, _ := readNotFoundPaths(dir); len(paths) != 0 {
+		t.Errorf("Got %v paths before flushing, should be 0", len(paths))
+	}
+	if err := flushNotFound(dir); err != nil {
+		t.Fatalf("flushNotFound returned error: %v", err)
+	}
+	recordNotFound(dir, "/foo", now.Add(time.Minute))
+	if err := flushNotFound(dir); err != nil {
+		t.Fatalf("flushNotFound returned error: %v", err)
+	}
+	paths, err := readNotFoundPaths(dir)
+	if err != nil {
+		t.Fatalf("readNotFoundPaths returned error: %v", err)
+	}
+	expected := []struct {
+		Path string
+		Hits int
+	}{{"/foo", 4}, {"/bar", 2}, {"/baz", 1}}
+	if len(paths) != len(expected) {
+		t.Fatalf("Got %v paths, should be %v", len(paths), len(expected))
+	}
+	for i, entry := range expected {
+		if paths[i].Path != entry.Path || paths[i].Hits != entry.Hits {
+			t.Errorf("%v: Got %v with %v hits, should be %v with %v hits", i,
+				paths[i].Path, paths[i].Hits, entry.Path, entry.Hits)
+		}
+	}
+	recordNotFound(dir, "/"+strings.Repeat("ü", maxNotFoundPathLength), now)
+	if err := clearNotFound(dir, "/bar"); err != nil {
+		t.Fatalf("clearNotFound returned error: %v", err)
+	}
+	if paths, _ = readNotFoundPaths(dir); len(paths) != 3 {
+		t.Fatalf("clearNotFound(_, \"/bar\") left %v paths, should be 3",
+			len(paths))
+	}
+	for _, entry := range paths {
+		if len(entry.Path) > maxNotFoundPathLength ||
+			!utf8.ValidString(entry.Path) {
+			t.Errorf("Path %q has not been truncated properly", entry.Path)
+		}
+	}
+	if err := clearNotFound(dir, ""); err != nil {
+		t.Fatalf("clearNotFound returned error: %v", err)
+	}
+	if paths, _ = readNotFoundPaths(dir); len(paths) != 0 {
+		t.Errorf("clearNotFound(_, \"\") left %v paths, should be 0", len(paths))
+	}
+}
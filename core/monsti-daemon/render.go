@@ -21,6 +21,7 @@ import (
 	htmlT "html/template"
 	"path"
 	"strings"
+	"time"
 
 	"pkg.monsti.org/monsti/api/service"
 	"pkg.monsti.org/monsti/api/util"
@@ -40,6 +41,9 @@ type masterTmplEnv struct {
 	Session            *service.UserSession
 	Title, Description string
 	Flags              masterTmplFlags
+	// Meta is the metadata of node views for search engines and
+	// social media.
+	Meta *pageMeta
 }
 
 // splitFirstDir returns the first directory in the given path.
@@ -54,13 +58,32 @@ func splitFirstDir(path string) string {
 func renderInMaster(r template.Renderer, content []byte, env masterTmplEnv,
 	settings *settings, site util.SiteSettings, locale string,
 	s *service.Session) string {
+	ui, err := getAdminUI(s, site.Name, env.Session.User)
+	if err != nil {
+		panic(fmt.Sprint("Could not get admin UI: ", err))
+	}
+	funcs := make(htmlT.FuncMap)
+	for _, fns := range []htmlT.FuncMap{r.Funcs,
+		assetFuncs(settings, site.Name, s)} {
+		for name, fn := range fns {
+			funcs[name] = fn
+		}
+	}
+	r.Funcs = funcs
+	r.SandboxFuncs = append(r.SandboxFuncs, "asset")
 	if env.Flags&EDIT_VIEW != 0 {
+		editor, err := getEditorConfig(s, site.Name)
+		if err != nil {
+			panic(fmt.Sprint("Could not get editor configuration: ", err))
+		}
 		ret, err := r.Render("admin/master", template.Context{
-			"Site": site,
+			"AdminUI": ui,
+			"Site":    site,
 			"Page": template.Context{
 				"Title":    env.Title,
 				"Node":     env.Node,
 				"EditView": env.Flags&EDIT_VIEW != 0,
+				"Editor":   editor,
 				"Content":  htmlT.HTML(content),
 			},
 			"Session": env.Session}, locale,
@@ -78,6 +101,30 @@ func renderInMaster(r template.Renderer, content []byte, env masterTmplEnv,
 	getChildrenFn := func(path string) ([]*service.Node, error) {
 		return s.Monsti().GetChildren(site.Name, path)
 	}
+	// menu returns the navigation of the named menu.
+	funcs["menu"] = func(name string) (navigation, error) {
+		menu, err := s.Monsti().GetMenu(site.Name, name)
+		if err != nil {
+			return nil, err
+		}
+		return getMenuNav(menu.Entries, env.Node.Path, locale,
+			env.Session.User == nil, getNodeFn)
+	}
+	r.SandboxFuncs = append(r.SandboxFuncs, "menu")
+	imageFn := func(node *service.Node) (htmlT.HTML, error) {
+		return responsiveImage(&reqContext{Site: &site, Serv: s}, node,
+			blockImageSizes)
+	}
+	// blocks returns the blocks of the named region shown on the node.
+	funcs["blocks"] = func(region string) ([]blockView, error) {
+		blocks, err := s.Monsti().GetBlocks(site.Name)
+		if err != nil {
+			return nil, err
+		}
+		return regionBlocks(blocks, region, env.Node.Path, locale,
+			env.Session.User == nil, getNodeFn, getChildrenFn, imageFn)
+	}
+	r.SandboxFuncs = append(r.SandboxFuncs, "blocks")
 	prinav, err := getNav("/", path.Join("/", firstDir), env.Session.User == nil,
 		getNodeFn, getChildrenFn)
 	if err != nil {
@@ -94,15 +141,67 @@ func renderInMaster(r template.Renderer, content []byte, env masterTmplEnv,
 		secnav.MakeAbsolute(env.Node.Path)
 	}
 
-	title := getNodeTitle(env.Node)
+	code, err := getCustomCode(s, site.Name)
+	if err != nil {
+		panic(fmt.Sprint("Could not get custom code: ", err))
+	}
+
+	alternates, err := getAlternates(env.Node, site.Locale, site.BaseURL,
+		getNodeFn, time.Now())
+	if err != nil {
+		panic(fmt.Sprint("Could not get alternates: ", err))
+	}
+	if alternates == nil {
+		locales, err := contentLocales(s, site)
+		if err != nil {
+			panic(err.Error())
+		}
+		prefixAll, err := getPrefixLocales(s, site.Name)
+		if err != nil {
+			panic(err.Error())
+		}
+		alternates, err = fieldAlternates(env.Node, locales, prefixAll,
+			site.BaseURL, getNodeFn)
+		if err != nil {
+			panic(fmt.Sprint("Could not get alternates: ", err))
+		}
+	}
+
+	var siblingOrder string
+	if err := s.Monsti().GetSiteConfig(site.Name,
+		"core.navigation.siblingorder", &siblingOrder); err != nil {
+		panic(fmt.Sprint("Could not get sibling order: ", err))
+	}
+	pageNav, err := getPageNav(env.Node, siblingOrder, locale,
+		env.Session.User == nil, time.Now(), getNodeFn, getChildrenFn)
+	if err != nil {
+		panic(fmt.Sprint("Could not get page navigation: ", err))
+	}
+
+	search, err := getSearchWidget(s, site.Name,
+		settings.Monsti.GetSiteDataPath(site.Name))
+	if err != nil {
+		panic(fmt.Sprint("Could not get search widget: ", err))
+	}
+
+	title := env.Title
+	if title == "" {
+		title = getNodeTitle(env.Node)
+	}
 	ret, err := r.Render("master", template.Context{
-		"Site": site,
+		"AdminUI":    ui,
+		"CustomCode": code.templateData(),
+		"Search":     search,
+		"Site":       site,
 		"Page": template.Context{
 			"Node":             env.Node,
+			"Alternates":       alternates,
 			"PrimaryNav":       prinav,
 			"SecondaryNav":     secnav,
+			"Nav":              pageNav,
 			"EditView":         env.Flags&EDIT_VIEW != 0,
 			"Title":            title,
+			"Meta":             env.Meta,
 			"Content":          htmlT.HTML(content),
 			"ShowSecondaryNav": len(secnav) > 0},
 		"Session": env.Session}, locale,
@@ -0,0 +1,189 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"image"
+	"sort"
+	"strings"
+
+	"pkg.monsti.org/monsti/api/service"
+	mtemplate "pkg.monsti.org/monsti/api/util/template"
+)
+
+// fitImageSize returns the dimension of an image of the given
+// dimension scaled to fit into the given size as done when
+// generating image sizes. Images never get scaled up.
+func fitImageSize(width, height uint, size imageSize) (uint, uint) {
+	if size.Width >= width && size.Height >= height {
+		return width, height
+	}
+	if width > size.Width {
+		height = height * size.Width / width
+		if height < 1 {
+			height = 1
+		}
+		width = size.Width
+	}
+	if height > size.Height {
+		width = width * size.Height / height
+		if width < 1 {
+			width = 1
+		}
+		height = size.Height
+	}
+	return width, height
+}
+
+// responsiveImageTag returns an img element showing the image node at
+// the given path with a srcset offering the given sizes of the image.
+//
+// width and height are the dimension of the original image. sizesAttr
+// is the value of the sizes attribute, e.g. "(max-width: 40em) 100vw,
+// 50vw".
+func responsiveImageTag(nodePath, alt string, width, height uint,
+	sizes map[string]imageSize, sizesAttr string) template.HTML {
+	names := make([]string, 0, len(sizes))
+	for name := range sizes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// Sizes resulting in the same width are offered only once.
+	candidates := make(map[uint]string)
+	for _, name := range names {
+		size := sizes[name]
+		if size.Width == 0 || size.Height == 0 {
+			continue
+		}
+		w, _ := fitImageSize(width, height, size)
+		if _, ok := candidates[w]; !ok && w < width {
+			candidates[w] = mtemplate.ImageURL(nodePath, name)
+		}
+	}
+	original := mtemplate.ImageURL(nodePath, "")
+	candidates[width] = original
+	widths := make([]int, 0, len(candidates))
+	for w := range candidates {
+		widths = append(widths, int(w))
+	}
+	sort.Ints(widths)
+	srcset := make([]string, 0, len(widths))
+	for _, w := range widths {
+		srcset = append(srcset, fmt.Sprintf("%v %vw", candidates[uint(w)], w))
+	}
+	return template.HTML(fmt.Sprintf(
+		`<img src="%v" srcset="%v" sizes="%v" width="%v" height="%v" alt="%v">`,
+		html.EscapeString(original), html.EscapeString(strings.Join(srcset, ", ")),
+		html.EscapeString(sizesAttr), width, height, html.EscapeString(alt)))
+}
+
+// imageDimensionFile is the node data file caching the dimension of
+// an image node's original image.
+const imageDimensionFile = "__image_dimension"
+
+// getImageDimension returns the dimension of the image node's original
+// image.
+func getImageDimension(c *reqContext, nodePath string) (uint, uint, error) {
+	var width, height uint
+	cached, err := c.Serv.Monsti().GetNodeData(c.Site.Name, nodePath,
+		imageDimensionFile)
+	if err == nil && len(cached) > 0 {
+		if _, err := fmt.Sscanf(string(cached), "%dx%d", &width,
+			&height); err == nil {
+			return width, height, nil
+		}
+	}
+	data, err := c.Serv.Monsti().GetNodeData(c.Site.Name, nodePath,
+		"__file_core.File")
+	if err != nil {
+		return 0, 0, fmt.Errorf("Could not get image data: %v", err)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, fmt.Errorf("Could not decode image: %v", err)
+	}
+	width, height = uint(config.Width), uint(config.Height)
+	// The dimension is only cached, so failing to write it (e.g. for
+	// archived nodes) does not matter.
+	c.Serv.Monsti().WriteNodeData(c.Site.Name, nodePath, imageDimensionFile,
+		[]byte(imageSize{width, height}.String()))
+	return width, height, nil
+}
+
+// responsiveImage returns an img element with srcset for the given
+// image node. The alternative text defaults to the node's title.
+func responsiveImage(c *reqContext, node *service.Node, sizesAttr string) (
+	template.HTML, error) {
+	if node.Type == nil || node.Type.Id != "core.Image" {
+		return "", fmt.Errorf("Node %q is not an image", node.Path)
+	}
+	settings, err := getImageSettings(c)
+	if err != nil {
+		return "", err
+	}
+	width, height, err := getImageDimension(c, node.Path)
+	if err != nil {
+		return "", err
+	}
+	alt := node.AltText
+	if title := node.Fields["core.Title"]; alt == "" && title != nil {
+		alt = title.String()
+	}
+	return responsiveImageTag(node.Path, alt, width, height, settings.Sizes,
+		sizesAttr), nil
+}
+
+// imageFuncs returns the template functions to render images of the
+// request's site.
+func imageFuncs(c *reqContext) template.FuncMap {
+	return template.FuncMap{
+		// responsiveImage renders an img element with srcset for the given
+		// image node or path of an image node, e.g. a path of a MultiRef
+		// field. The optional second argument is the sizes attribute,
+		// defaulting to "100vw".
+		"responsiveImage": func(img interface{}, sizesAttr ...string) (
+			template.HTML, error) {
+			var node *service.Node
+			switch img := img.(type) {
+			case *service.Node:
+				node = img
+			case service.Node:
+				node = &img
+			case string:
+				var err error
+				node, err = c.Serv.Monsti().GetNode(c.Site.Name, img)
+				if err != nil {
+					return "", fmt.Errorf("Could not get image node: %v", err)
+				}
+				if node == nil {
+					return "", fmt.Errorf("Image node %q not found", img)
+				}
+			default:
+				return "", fmt.Errorf("Can't render image of type %T", img)
+			}
+			attr := "100vw"
+			if len(sizesAttr) > 0 {
+				attr = sizesAttr[0]
+			}
+			return responsiveImage(c, node, attr)
+		},
+	}
+}
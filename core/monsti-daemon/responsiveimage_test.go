@@ -0,0 +1,58 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import "testing"
+
+func TestFitImageSize(t *testing.T) {
+	tests := []struct {
+		Width, Height uint
+		Size          imageSize
+		OutW, OutH    uint
+	}{
+		{100, 50, imageSize{200, 200}, 100, 50},
+		{400, 200, imageSize{100, 100}, 100, 50},
+		{200, 400, imageSize{100, 100}, 50, 100},
+		{400, 200, imageSize{300, 50}, 100, 50},
+	}
+	for i, test := range tests {
+		w, h := fitImageSize(test.Width, test.Height, test.Size)
+		if w != test.OutW || h != test.OutH {
+			t.Errorf("Test %v: fitImageSize(%v, %v, %v) = %v, %v, should be %v, %v",
+				i, test.Width, test.Height, test.Size, w, h, test.OutW, test.OutH)
+		}
+	}
+}
+
+func TestResponsiveImageTag(t *testing.T) {
+	sizes := map[string]imageSize{
+		"thumbnail": {150, 150},
+		"medium":    {480, 480},
+		"large":     {1024, 1024},
+		"wide":      {480, 1024},
+		"broken":    {200, 0},
+	}
+	ret := responsiveImageTag("/foo/image.jpeg/", `A "nice" image`, 800, 400,
+		sizes, "50vw")
+	expected := `<img src="/foo/image.jpeg" srcset="` +
+		`/foo/image.jpeg/_sizes/thumbnail 150w, ` +
+		`/foo/image.jpeg/_sizes/medium 480w, /foo/image.jpeg 800w" ` +
+		`sizes="50vw" width="800" height="400" alt="A &#34;nice&#34; image">`
+	if string(ret) != expected {
+		t.Errorf("responsiveImageTag(...) = %v, should be %v", ret, expected)
+	}
+}
@@ -0,0 +1,168 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// routeTable holds the routes registered by modules.
+type routeTable struct {
+	mutex  sync.RWMutex
+	routes []*service.Route
+	// proxies maps the paths of the modules' sockets to the proxies
+	// forwarding requests to them.
+	proxies map[string]*httputil.ReverseProxy
+}
+
+// matchesRoute returns true iff the route matches the path.
+func matchesRoute(route *service.Route, site, nodePath string) bool {
+	if route.Site != "" && route.Site != site {
+		return false
+	}
+	return nodePath == route.Prefix ||
+		strings.HasPrefix(nodePath, strings.TrimSuffix(route.Prefix, "/")+"/")
+}
+
+// add adds the route. A module may register its routes again, e.g.
+// after a restart.
+func (t *routeTable) add(route *service.Route) error {
+	if !strings.HasPrefix(route.Prefix, "/") || route.Prefix == "/" ||
+		path.Clean(route.Prefix) != route.Prefix ||
+		strings.Contains(route.Prefix, "@@") {
+		return fmt.Errorf("Invalid prefix of route: %q", route.Prefix)
+	}
+	if route.Service == "" {
+		return fmt.Errorf("Missing service of route %q", route.Prefix)
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i, other := range t.routes {
+		if other.Prefix == route.Prefix && other.Site == route.Site {
+			if other.Service != route.Service {
+				return fmt.Errorf("Route %q does already exist", route.Prefix)
+			}
+			t.routes[i] = route
+			return nil
+		}
+	}
+	t.routes = append(t.routes, route)
+	return nil
+}
+
+// lookup returns the route with the longest prefix matching the
+// request of the given site and path, or nil if there is none. Routes
+// of the site take precedence over routes of all sites with the same
+// prefix.
+func (t *routeTable) lookup(site, nodePath string) *service.Route {
+	if t == nil {
+		return nil
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	var ret *service.Route
+	for _, route := range t.routes {
+		if !matchesRoute(route, site, nodePath) {
+			continue
+		}
+		if ret == nil || len(route.Prefix) > len(ret.Prefix) ||
+			(route.Prefix == ret.Prefix && route.Site != "") {
+			ret = route
+		}
+	}
+	return ret
+}
+
+// proxy returns the proxy forwarding requests to the module serving
+// the route.
+func (t *routeTable) proxy(route *service.Route,
+	h *nodeHandler) *httputil.ReverseProxy {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if proxy, ok := t.proxies[route.Service]; ok {
+		return proxy
+	}
+	socket := route.Service
+	proxy := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = "module"
+		},
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		},
+		FlushInterval: 100 * time.Millisecond,
+		ErrorLog:      h.Log,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			h.Log.Printf("[%v] Could not proxy request to %v: %v",
+				r.Header.Get(requestIDHeader), socket, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	if t.proxies == nil {
+		t.proxies = make(map[string]*httputil.ReverseProxy)
+	}
+	t.proxies[route.Service] = proxy
+	return proxy
+}
+
+// serveRoute proxies the request to the module serving the route.
+// Upgraded connections like WebSockets are passed through.
+func (h *nodeHandler) serveRoute(c *reqContext, route *service.Route) {
+	r := *c.Req
+	r.Header = make(http.Header)
+	for name, values := range c.Req.Header {
+		if !strings.HasPrefix(name, "X-Monsti-") {
+			r.Header[name] = values
+		}
+	}
+	r.Header.Set(service.RouteRequestHeader, strconv.FormatUint(
+		uint64(c.Id), 10))
+	if c.Site != nil {
+		r.Header.Set(service.RouteSiteHeader, c.Site.Name)
+	}
+	if c.UserSession != nil && c.UserSession.User != nil {
+		r.Header.Set(service.RouteUserHeader, c.UserSession.User.Login)
+	}
+	r.Header.Set(requestIDHeader, c.RequestID)
+	r.Header.Set("X-Forwarded-Host", c.Req.Host)
+	proto := "http"
+	if isSecureRequest(c.Req, h.TrustedProxies) {
+		proto = "https"
+	}
+	r.Header.Set("X-Forwarded-Proto", proto)
+	// The module gets the client's address from GetRouteRequest. A nil
+	// value keeps the proxy from adding the header.
+	r.Header["X-Forwarded-For"] = nil
+	h.Routes.proxy(route, h).ServeHTTP(c.Res, &r)
+}
+
+func (m *MonstiService) RegisterRoute(route *service.Route, reply *int) error {
+	return m.routes.add(route)
+}
@@ -0,0 +1,236 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestRouteTable(t *testing.T) {
+	var table routeTable
+	for _, route := range []*service.Route{
+		{Prefix: "/shop", Service: "a"},
+		{Prefix: "/shop/cart", Service: "a"},
+		{Prefix: "/shop", Site: "example", Service: "b"},
+		{Prefix: "/shop", Service: "a"},
+	} {
+		if err := table.add(route); err != nil {
+			t.Fatalf("add(%v) returned error: %v", route.Prefix, err)
+		}
+	}
+	for _, route := range []*service.Route{
+		{Prefix: "/shop", Service: "c"},
+		{Prefix: "/", Service: "c"},
+		{Prefix: "shop", Service: "c"},
+		{Prefix: "/shop/../foo", Service: "c"},
+		{Prefix: "/@@edit", Service: "c"},
+		{Prefix: "/foo"},
+	} {
+		if err := table.add(route); err == nil {
+			t.Errorf("add(%q, %q) should fail", route.Prefix, route.Service)
+		}
+	}
+	tests := []struct {
+		Site, Path, Route string
+	}{
+		{"other", "/shop", "/shop a"},
+		{"other", "/shop/", "/shop a"},
+		{"other", "/shop/item", "/shop a"},
+		{"other", "/shop/cart/add", "/shop/cart a"},
+		{"example", "/shop/item", "/shop b"},
+		{"example", "/shop/cart", "/shop/cart a"},
+		{"other", "/shopping", "<nil>"},
+		{"other", "/", "<nil>"},
+	}
+	for _, test := range tests {
+		ret := "<nil>"
+		if route := table.lookup(test.Site, test.Path); route != nil {
+			ret = route.Prefix + " " + route.Service
+		}
+		if ret != test.Route {
+			t.Errorf("lookup(%q, %q) returned %v, should be %v", test.Site,
+				test.Path, ret, test.Route)
+		}
+	}
+	if (*routeTable)(nil).lookup("example", "/shop") != nil {
+		t.Errorf("lookup of nil table should return nil")
+	}
+}
+
+func TestServeRoute(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-routes")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "module")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("X-Module", "shop")
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, "%v %v %v %v %v %v %q %s", r.Method, r.Host,
+				r.URL.RequestURI(), r.Header.Get(service.RouteRequestHeader),
+				r.Header.Get(requestIDHeader), r.Header.Get("X-Forwarded-Proto"),
+				r.Header.Get("X-Forwarded-For"), body)
+		}))
+
+	h := &nodeHandler{Routes: new(routeTable),
+		Log: log.New(ioutil.Discard, "", 0)}
+	route := &service.Route{Prefix: "/shop", Service: socket}
+	req := httptest.NewRequest("POST", "http://example.com/shop/cart?item=1",
+		strings.NewReader("quantity=2"))
+	req.Header.Set("X-Forwarded-For", "6.6.6.6")
+	res := httptest.NewRecorder()
+	h.serveRoute(&reqContext{Id: 7, Req: req, Res: res, RequestID: "foo"},
+		route)
+	expected := `POST example.com /shop/cart?item=1 7 foo http "" quantity=2`
+	if res.Code != http.StatusCreated || res.Header().Get("X-Module") != "shop" ||
+		res.Body.String() != expected {
+		t.Errorf("Proxied response is %v %v %q, should be %v %q", res.Code,
+			res.Header(), res.Body.String(), http.StatusCreated, expected)
+	}
+
+	route.Service = filepath.Join(dir, "missing")
+	res = httptest.NewRecorder()
+	h.serveRoute(&reqContext{Req: httptest.NewRequest("GET",
+		"http://example.com/shop", nil), Res: res}, route)
+	if res.Code != http.StatusBadGateway {
+		t.Errorf("Status of unavailable module is %v, should be %v", res.Code,
+			http.StatusBadGateway)
+	}
+}
+
+func TestServeRouteStreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-routes")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "module")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer listener.Close()
+	next := make(chan struct{})
+	go http.Serve(listener, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Upgrade") != "echo" {
+				w.Header().Set("Content-Type", "text/event-stream")
+				fmt.Fprintf(w, "data: %v\n\n", r.Header.Get(service.RouteSiteHeader))
+				w.(http.Flusher).Flush()
+				<-next
+				fmt.Fprint(w, "data: bye\n\n")
+				return
+			}
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("Could not hijack: %v", err)
+				return
+			}
+			defer conn.Close()
+			fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+				"Connection: Upgrade\r\nUpgrade: echo\r\n\r\n%v\n",
+				r.Header.Get(service.RouteUserHeader))
+			rw.Flush()
+			line, _ := rw.ReadString('\n')
+			fmt.Fprint(rw, line)
+			rw.Flush()
+		}))
+
+	h := &nodeHandler{Routes: new(routeTable),
+		Log: log.New(ioutil.Discard, "", 0)}
+	route := &service.Route{Prefix: "/live", Service: socket}
+	statuses := make(chan int, 2)
+	front := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			writer := &accessLogWriter{ResponseWriter: w}
+			c := &reqContext{Req: r, Res: writer,
+				Site:        &util.SiteSettings{Name: "example"},
+				UserSession: &service.UserSession{User: &service.User{Login: "jane"}}}
+			h.serveRoute(c, route)
+			statuses <- writer.status
+		}))
+	defer front.Close()
+
+	// Server-sent events
+	res, err := http.Get(front.URL + "/live/events")
+	if err != nil {
+		t.Fatalf("Could not get events: %v", err)
+	}
+	events := bufio.NewReader(res.Body)
+	if line, _ := events.ReadString('\n'); line != "data: example\n" {
+		t.Errorf("First event is %q, should be %q", line, "data: example\n")
+	}
+	close(next)
+	rest, _ := ioutil.ReadAll(events)
+	res.Body.Close()
+	if string(rest) != "\ndata: bye\n\n" {
+		t.Errorf("Rest of events is %q", rest)
+	}
+	<-statuses
+
+	// Upgraded connections
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /live/chat HTTP/1.1\r\nHost: example.com\r\n"+
+		"Connection: Upgrade\r\nUpgrade: echo\r\nX-Monsti-User: mallory\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	res, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Could not read response: %v", err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Status is %v, should be %v", res.StatusCode,
+			http.StatusSwitchingProtocols)
+	}
+	if line, _ := reader.ReadString('\n'); line != "jane\n" {
+		t.Errorf("User of upgraded connection is %q, should be %q", line,
+			"jane\n")
+	}
+	fmt.Fprint(conn, "ping\n")
+	if line, err := reader.ReadString('\n'); line != "ping\n" {
+		t.Errorf("Echo is %q (%v), should be %q", line, err, "ping\n")
+	}
+	conn.Close()
+	if status := <-statuses; status != http.StatusSwitchingProtocols {
+		t.Errorf("Logged status is %v, should be %v", status,
+			http.StatusSwitchingProtocols)
+	}
+}
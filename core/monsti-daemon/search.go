@@ -0,0 +1,431 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// searchResult is a node matching a search query.
+type searchResult struct {
+	Path, Title string
+	// Snippet is an excerpt of the node's text around the first match.
+	Snippet string
+	// score ranks the results. Matches in the title count more.
+	score int
+}
+
+type searchResultsByScore []searchResult
+
+func (s searchResultsByScore) Len() int      { return len(s) }
+func (s searchResultsByScore) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s searchResultsByScore) Less(i, j int) bool {
+	return s[i].score > s[j].score ||
+		(s[i].score == s[j].score && s[i].Path < s[j].Path)
+}
+
+var tagRegexp = regexp.MustCompile(`<[^>]*>`)
+
+// nodeText returns the text of the node's fields except its title.
+func nodeText(node *service.Node) string {
+	fields := node.AllFields()
+	texts := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if field.Id == "core.Title" || field.Type == "File" ||
+			field.Type == "Video" || field.Type == "Audio" {
+			continue
+		}
+		value := node.GetField(field.Id)
+		if value == nil {
+			continue
+		}
+		text := html.UnescapeString(tagRegexp.ReplaceAllString(value.String(), " "))
+		if text = strings.Join(strings.Fields(text), " "); text != "" {
+			texts = append(texts, text)
+		}
+	}
+	return strings.Join(texts, " ")
+}
+
+// searchSnippet returns an excerpt of the text around the first
+// occurence of the term.
+func searchSnippet(text, term string) string {
+	const context = 80
+	runes := []rune(text)
+	lower := []rune(strings.ToLower(text))
+	i := strings.Index(string(lower), term)
+	if i < 0 || len(lower) != len(runes) {
+		i = 0
+	}
+	start := len([]rune(string(lower)[:i])) - context
+	if start > len(runes)-2*context {
+		start = len(runes) - 2*context
+	}
+	prefix, suffix := "… ", " …"
+	if start <= 0 {
+		start, prefix = 0, ""
+	}
+	end := start + 2*context
+	if end >= len(runes) {
+		end, suffix = len(runes), ""
+	}
+	return prefix + string(runes[start:end]) + suffix
+}
+
+// matchNode returns the search result for the node if it contains
+// all the given lower case terms.
+func matchNode(node *service.Node, terms []string) (searchResult, bool) {
+	var lowerTitle string
+	if title := node.Fields["core.Title"]; title != nil {
+		lowerTitle = strings.ToLower(title.String())
+	}
+	text := nodeText(node)
+	lowerText := strings.ToLower(text)
+	result := searchResult{Path: node.Path, Title: getNodeTitle(node)}
+	for _, term := range terms {
+		inTitle := strings.Count(lowerTitle, term)
+		inText := strings.Count(lowerText, term)
+		if inTitle+inText == 0 {
+			return result, false
+		}
+		result.score += 10*inTitle + inText
+	}
+	if len(terms) > 0 {
+		result.Snippet = searchSnippet(text, terms[0])
+	}
+	return result, true
+}
+
+// searchTerms returns the lower case terms of the query.
+func searchTerms(query string) []string {
+	return strings.Fields(strings.ToLower(query))
+}
+
+// searchNodes returns the nodes containing all terms of the query,
+// best matches first. Nodes are searched in their translation into the
+// given locale, if any. If public is true, only published nodes are
+// searched.
+func searchNodes(query, locale string, public bool, now time.Time,
+	getNodeFn getNodeFunc, getChildrenFn getChildrenFunc) (
+	[]searchResult, error) {
+	return findNodes(searchTerms(query), true, locale, public, now, getNodeFn,
+		getChildrenFn)
+}
+
+// findNodes returns the nodes containing the given lower case terms,
+// best matches first. If all is false, nodes containing any of the
+// terms are returned. See searchNodes.
+func findNodes(terms []string, all bool, locale string, public bool,
+	now time.Time, getNodeFn getNodeFunc, getChildrenFn getChildrenFunc) (
+	[]searchResult, error) {
+	results := make([]searchResult, 0)
+	if len(terms) == 0 {
+		return results, nil
+	}
+	err := walkNodes("/", getNodeFn, getChildrenFn,
+		func(node *service.Node) error {
+			if (public && !isPublished(node, now)) ||
+				(node.Type != nil && node.Type.Hide) {
+				return nil
+			}
+			translated, err := translateNode(node, locale)
+			if err != nil {
+				return fmt.Errorf("Could not translate node %q: %v", node.Path, err)
+			}
+			if all {
+				if result, ok := matchNode(translated, terms); ok {
+					results = append(results, result)
+				}
+				return nil
+			}
+			var result searchResult
+			matched := false
+			for _, term := range terms {
+				if match, ok := matchNode(translated, []string{term}); ok {
+					if matched {
+						result.score += match.score
+					} else {
+						result, matched = match, true
+					}
+				}
+			}
+			if matched {
+				results = append(results, result)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(searchResultsByScore(results))
+	return results, nil
+}
+
+// maxRecentSearchQueries is the number of recent queries kept,
+// maxCountedSearchQueries the number of queries whose searches are
+// counted. Queries longer than maxSearchQueryLength bytes are not
+// recorded.
+const (
+	maxRecentSearchQueries  = 20
+	maxCountedSearchQueries = 1000
+	maxSearchQueryLength    = 100
+)
+
+// searchQueriesFlushInterval is the interval in which recorded queries
+// are written to the site data directories.
+const searchQueriesFlushInterval = time.Minute
+
+// searchQueries holds the queries searched on a site.
+type searchQueries struct {
+	// Recent holds the latest distinct queries, newest first.
+	Recent []string
+	// Counts maps queries to their number of searches.
+	Counts map[string]int
+}
+
+// searchQueriesMutex serializes updates of the query logs.
+var searchQueriesMutex sync.Mutex
+
+// pendingSearchQueries holds the queries not yet written by site data
+// directory. Guarded by searchQueriesMutex.
+var pendingSearchQueries = make(map[string]*searchQueries)
+
+// searchQueriesPath returns the path to the query log inside the
+// given site data directory.
+func searchQueriesPath(dataDir string) string {
+	return filepath.Join(dataDir, "search-queries.json")
+}
+
+// readSearchQueries reads the query log of the given site data
+// directory.
+func readSearchQueries(dataDir string) (*searchQueries, error) {
+	queries := &searchQueries{Counts: make(map[string]int)}
+	content, err := ioutil.ReadFile(searchQueriesPath(dataDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return queries, nil
+		}
+		return nil, fmt.Errorf("Could not read search queries: %v", err)
+	}
+	if err := json.Unmarshal(content, queries); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal search queries: %v", err)
+	}
+	return queries, nil
+}
+
+// recordSearchQuery adds the query to the query log of the given site
+// data directory. The query is kept in memory until written by
+// flushSearchQueries.
+func recordSearchQuery(dataDir, query string) {
+	query = strings.Join(searchTerms(query), " ")
+	if query == "" || len(query) > maxSearchQueryLength {
+		return
+	}
+	searchQueriesMutex.Lock()
+	defer searchQueriesMutex.Unlock()
+	pending := pendingSearchQueries[dataDir]
+	if pending == nil {
+		pending = &searchQueries{Counts: make(map[string]int)}
+		pendingSearchQueries[dataDir] = pending
+	}
+	if _, ok := pending.Counts[query]; ok ||
+		len(pending.Counts) < maxCountedSearchQueries {
+		pending.Counts[query]++
+	}
+	pending.add([]string{query})
+}
+
+// add prepends the given queries, newest first, to the recent ones.
+func (q *searchQueries) add(queries []string) {
+	recent := make([]string, 0, maxRecentSearchQueries)
+	seen := make(map[string]bool)
+	for _, entry := range append(queries, q.Recent...) {
+		if !seen[entry] && len(recent) < maxRecentSearchQueries {
+			seen[entry] = true
+			recent = append(recent, entry)
+		}
+	}
+	q.Recent = recent
+}
+
+// flushSearchQueries writes the pending queries of the given site data
+// directory. Only the maxCountedSearchQueries most searched queries are
+// kept.
+func flushSearchQueries(dataDir string) error {
+	searchQueriesMutex.Lock()
+	defer searchQueriesMutex.Unlock()
+	pending := pendingSearchQueries[dataDir]
+	if pending == nil {
+		return nil
+	}
+	queries, err := readSearchQueries(dataDir)
+	if err != nil {
+		return err
+	}
+	for query, count := range pending.Counts {
+		queries.Counts[query] += count
+	}
+	if len(queries.Counts) > maxCountedSearchQueries {
+		for _, query := range queries.Popular(
+			len(queries.Counts))[maxCountedSearchQueries:] {
+			delete(queries.Counts, query)
+		}
+	}
+	queries.add(pending.Recent)
+	content, err := json.Marshal(queries)
+	if err != nil {
+		return fmt.Errorf("Could not marshal search queries: %v", err)
+	}
+	if err := ioutil.WriteFile(searchQueriesPath(dataDir), content,
+		0600); err != nil {
+		return fmt.Errorf("Could not write search queries: %v", err)
+	}
+	delete(pendingSearchQueries, dataDir)
+	return nil
+}
+
+// scheduleSearchQueriesFlush periodically writes the pending queries
+// of all sites.
+func scheduleSearchQueriesFlush(settings *settings, logger *log.Logger) {
+	for {
+		time.Sleep(searchQueriesFlushInterval)
+		for site := range settings.Monsti.Sites {
+			if err := flushSearchQueries(
+				settings.Monsti.GetSiteDataPath(site)); err != nil {
+				logger.Printf("Could not write search queries of site %q: %v",
+					site, err)
+			}
+		}
+	}
+}
+
+// Latest returns up to n of the most recent queries.
+func (q *searchQueries) Latest(n int) []string {
+	if len(q.Recent) < n {
+		n = len(q.Recent)
+	}
+	return q.Recent[:n]
+}
+
+// Popular returns up to n of the most searched queries.
+func (q *searchQueries) Popular(n int) []string {
+	popular := make([]string, 0, len(q.Counts))
+	for query := range q.Counts {
+		popular = append(popular, query)
+	}
+	sort.Sort(queriesByCount{popular, q.Counts})
+	if len(popular) < n {
+		n = len(popular)
+	}
+	return popular[:n]
+}
+
+type queriesByCount struct {
+	Queries []string
+	Counts  map[string]int
+}
+
+func (s queriesByCount) Len() int      { return len(s.Queries) }
+func (s queriesByCount) Swap(i, j int) { s.Queries[i], s.Queries[j] = s.Queries[j], s.Queries[i] }
+func (s queriesByCount) Less(i, j int) bool {
+	left, right := s.Queries[i], s.Queries[j]
+	return s.Counts[left] > s.Counts[right] ||
+		(s.Counts[left] == s.Counts[right] && left < right)
+}
+
+// searchWidget is the data of the search widget of the master
+// template (blocks/search-widget).
+type searchWidget struct {
+	// Recent and Popular are the queries shown beneath the search box.
+	Recent, Popular []string
+}
+
+// getSearchWidget returns the search widget data of the site. The
+// number of shown queries is configured by core.search.queries and
+// defaults to none.
+func getSearchWidget(s *service.Session, site, dataDir string) (
+	*searchWidget, error) {
+	var count int
+	err := s.Monsti().GetSiteConfig(site, "core.search.queries", &count)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get search configuration: %v", err)
+	}
+	widget := new(searchWidget)
+	if count <= 0 {
+		return widget, nil
+	}
+	queries, err := readSearchQueries(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	widget.Recent = queries.Latest(count)
+	widget.Popular = queries.Popular(count)
+	return widget, nil
+}
+
+// Search searches the site's nodes for the query given by the form
+// value "q".
+func (h *nodeHandler) Search(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if err := c.Req.ParseForm(); err != nil {
+		return err
+	}
+	query := strings.TrimSpace(c.Req.Form.Get("q"))
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		return c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
+	}
+	getChildrenFn := func(nodePath string) ([]*service.Node, error) {
+		return c.Serv.Monsti().GetChildren(c.Site.Name, nodePath)
+	}
+	results, err := searchNodes(query, c.UserSession.Locale,
+		c.UserSession.User == nil, time.Now(), getNodeFn, getChildrenFn)
+	if err != nil {
+		return fmt.Errorf("Could not search nodes: %v", err)
+	}
+	if query != "" {
+		recordSearchQuery(h.Settings.Monsti.GetSiteDataPath(c.Site.Name), query)
+	}
+	body, err := h.Renderer.Render("actions/search", template.Context{
+		"Query":   query,
+		"Results": results}, c.UserSession.Locale,
+		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render search results: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("Search")}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
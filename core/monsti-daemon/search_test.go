@@ -0,0 +1,170 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestSearchNodes(t *testing.T) {
+	docType := &service.NodeType{Id: "core.Document",
+		Fields: []*service.NodeField{
+			{Id: "core.Title", Type: "Text"},
+			{Id: "core.Body", Type: "HTMLArea"}}}
+	hiddenType := &service.NodeType{Id: "core.File", Hide: true,
+		Fields: docType.Fields}
+	newNode := func(nodePath, title, body string, nodeType *service.NodeType,
+		public bool) *service.Node {
+		titleField := service.TextField(title)
+		bodyField := service.HTMLField(body)
+		return &service.Node{Path: nodePath, Type: nodeType, Public: public,
+			Fields: map[string]service.Field{
+				"core.Title": &titleField, "core.Body": &bodyField}}
+	}
+	nodes := map[string]*service.Node{
+		"/": newNode("/", "Home", "<p>Welcome to our <b>bakery</b>!</p>",
+			docType, true),
+		"/bread": newNode("/bread", "Bread", "<p>Fresh bread &amp; rolls.</p>",
+			docType, true),
+		"/cakes": newNode("/cakes", "Cakes", "<p>Bread is not a cake.</p>",
+			docType, true),
+		"/draft": newNode("/draft", "Bread draft", "", docType, false),
+		"/file":  newNode("/file", "Bread file", "", hiddenType, true),
+	}
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		return nodes[nodePath], nil
+	}
+	getChildrenFn := func(nodePath string) ([]*service.Node, error) {
+		children := make([]*service.Node, 0)
+		for _, child := range []string{"/bread", "/cakes", "/draft", "/file"} {
+			if path.Dir(child) == nodePath {
+				children = append(children, nodes[child])
+			}
+		}
+		return children, nil
+	}
+	now := time.Now()
+	tests := []struct {
+		Query  string
+		Public bool
+		Paths  []string
+	}{
+		{"", true, nil},
+		{"bread", true, []string{"/bread", "/cakes"}},
+		{"bread", false, []string{"/bread", "/draft", "/cakes"}},
+		{"BREAD Rolls", true, []string{"/bread"}},
+		{"bakery", true, []string{"/"}},
+		{"b>", true, nil},
+		{"untitled", true, nil},
+	}
+	for _, test := range tests {
+		results, err := searchNodes(test.Query, "", test.Public, now, getNodeFn,
+			getChildrenFn)
+		if err != nil {
+			t.Fatalf("searchNodes(%q, ...) returned error: %v", test.Query, err)
+		}
+		paths := make([]string, 0)
+		for _, result := range results {
+			paths = append(paths, result.Path)
+		}
+		if len(paths) != len(test.Paths) ||
+			(len(paths) > 0 && !reflect.DeepEqual(paths, test.Paths)) {
+			t.Errorf("searchNodes(%q, _, %v, ...) = %v, should be %v",
+				test.Query, test.Public, paths, test.Paths)
+		}
+	}
+	results, _ := searchNodes("rolls", "", true, now, getNodeFn, getChildrenFn)
+	if len(results) != 1 || results[0].Title != "Bread" ||
+		results[0].Snippet != "Fresh bread & rolls." {
+		t.Errorf(`searchNodes("rolls", ...) = %v, should find "Bread"`, results)
+	}
+	results, _ = findNodes([]string{"rolls", "cake"}, false, "", true, now,
+		getNodeFn, getChildrenFn)
+	if len(results) != 2 || results[0].Path != "/cakes" ||
+		results[1].Path != "/bread" {
+		t.Errorf(`findNodes({"rolls", "cake"}, false, ...) = %v, should find `+
+			`"/cakes" and "/bread"`, results)
+	}
+}
+
+func TestSearchSnippet(t *testing.T) {
+	text := "Lorem ipsum dolor sit amet, consectetur adipisici elit, sed " +
+		"eiusmod tempor incidunt ut labore et dolore magna aliqua. Ut enim ad " +
+		"minim veniam, quis nostrud exercitation ullamco laboris nisi ut " +
+		"aliquid ex ea commodi consequat."
+	tests := []struct {
+		Term, Snippet string
+	}{
+		{"lorem", text[:160] + " …"},
+		{"consequat", "… " + text[len(text)-160:]},
+		{"missing", text[:160] + " …"},
+	}
+	for _, test := range tests {
+		if snippet := searchSnippet(text, test.Term); snippet != test.Snippet {
+			t.Errorf("searchSnippet(_, %q) = %q, should be %q", test.Term, snippet,
+				test.Snippet)
+		}
+	}
+	if snippet := searchSnippet("Short text", "text"); snippet != "Short text" {
+		t.Errorf(`searchSnippet("Short text", _) = %q, should be "Short text"`,
+			snippet)
+	}
+}
+
+func TestSearchQueries(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "monsti-search")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dataDir)
+	for _, query := range []string{"bread", "Cake", "bread", "  Bread ",
+		"rolls", "cake", "", strings.Repeat("long ", 30)} {
+		recordSearchQuery(dataDir, query)
+	}
+	if err := flushSearchQueries(dataDir); err != nil {
+		t.Fatalf("flushSearchQueries returned error: %v", err)
+	}
+	for _, query := range []string{"rolls", "bread"} {
+		recordSearchQuery(dataDir, query)
+	}
+	if err := flushSearchQueries(dataDir); err != nil {
+		t.Fatalf("flushSearchQueries returned error: %v", err)
+	}
+	queries, err := readSearchQueries(dataDir)
+	if err != nil {
+		t.Fatalf("readSearchQueries returned error: %v", err)
+	}
+	if latest := queries.Latest(2); !reflect.DeepEqual(latest,
+		[]string{"bread", "rolls"}) {
+		t.Errorf("Latest(2) = %v, should be [bread rolls]", latest)
+	}
+	if popular := queries.Popular(5); !reflect.DeepEqual(popular,
+		[]string{"bread", "cake", "rolls"}) {
+		t.Errorf("Popular(5) = %v, should be [bread cake rolls]", popular)
+	}
+	if queries.Counts["bread"] != 4 || queries.Counts["rolls"] != 2 {
+		t.Errorf("Counts = %v, should have 4 bread and 2 rolls", queries.Counts)
+	}
+}
@@ -0,0 +1,221 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/chrneumann/htmlwidgets"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// maxDescriptionLength limits the length of descriptions derived from
+// the node's content.
+const maxDescriptionLength = 160
+
+// robotsTxtLimit is the maximum size in bytes of the robots.txt.
+const robotsTxtLimit = 64 << 10
+
+// pageMeta is the metadata of a node's page for search engines and
+// social media as emitted by the master template (blocks/headers).
+type pageMeta struct {
+	Description, Robots string
+	// Canonical and URL are the canonical and the absolute URL of the
+	// page. Both are empty if the site's base URL is unknown.
+	Canonical, URL string
+	// Title, Image and Type are used for Open Graph and Twitter cards.
+	// Image is an absolute URL.
+	Title, Image, Type string
+}
+
+// getPageMeta returns the metadata of the given node's page. The
+// node's SEO metadata overrides the defaults, i.e. the title of the
+// page, the node's teaser or the beginning of its text and the URL of
+// the node.
+func getPageMeta(node *service.Node, title, baseURL string) *pageMeta {
+	seo := node.SEO
+	if seo == nil {
+		seo = new(service.SEOMetadata)
+	}
+	meta := &pageMeta{
+		Description: seo.Description,
+		Robots:      seo.Robots,
+		Canonical:   seo.Canonical,
+		Title:       seo.Title,
+		Image:       seo.Image,
+		Type:        "website"}
+	if node.Type != nil && node.Type.Id == "core.BlogPost" {
+		meta.Type = "article"
+	}
+	if meta.Description == "" {
+		if field := node.GetField("core.Teaser"); field != nil {
+			meta.Description = strings.TrimSpace(field.String())
+		}
+	}
+	if meta.Description == "" {
+		meta.Description = truncateWords(nodeText(node), maxDescriptionLength)
+	}
+	if meta.Title == "" {
+		meta.Title = title
+	}
+	if baseURL != "" {
+		meta.URL = baseURL + dirPath(node.Path)
+		if meta.Canonical == "" {
+			meta.Canonical = meta.URL
+		}
+	}
+	if strings.HasPrefix(meta.Image, "/") {
+		meta.Image = baseURL + meta.Image
+	}
+	return meta
+}
+
+// addSEOWidgets adds the widgets of the node's SEO metadata to the
+// edit form. Returns the set of their ids, which the edit template
+// gets as SEOFields to show them in a separate section.
+func addSEOWidgets(form *htmlwidgets.Form,
+	G func(string) string) map[string]bool {
+	widgets := []struct {
+		Widget             htmlwidgets.Widget
+		Id, Label, Comment string
+	}{
+		{new(htmlwidgets.TextAreaWidget), "SEO.Description",
+			G("Description"),
+			G("Shown by search engines. Defaults to the beginning of the content.")},
+		{&htmlwidgets.TextWidget{
+			Regexp:          `^(https?://\S+)?$`,
+			ValidationError: G("Please enter an URL starting with http:// or https://.")},
+			"SEO.Canonical", G("Canonical URL"),
+			G("The URL of the original content, if the content has been copied.")},
+		{&htmlwidgets.TextWidget{
+			Regexp:          `^[\w\s,:-]*$`,
+			ValidationError: G("Please enter directives separated by commas.")},
+			"SEO.Robots", G("Robots"),
+			G("Directives for search engine crawlers, e.g. noindex, nofollow.")},
+		{new(htmlwidgets.TextWidget), "SEO.Title", G("Social media title"),
+			G("Title of Open Graph and Twitter cards. Defaults to the node's title.")},
+		{&htmlwidgets.TextWidget{
+			Regexp:          `^(/\S*|https?://\S+)?$`,
+			ValidationError: G("Please enter a path or an URL.")},
+			"SEO.Image", G("Social media image"),
+			G("Path or URL of the image of Open Graph and Twitter cards.")},
+	}
+	ids := make(map[string]bool, len(widgets))
+	for _, widget := range widgets {
+		form.AddWidget(widget.Widget, widget.Id, widget.Label,
+			widget.Comment).Base().Classes = []string{"seo-field"}
+		ids[widget.Id] = true
+	}
+	return ids
+}
+
+// defaultRobotsTxt returns the robots.txt of sites without configured
+// robots.txt. It allows crawling everything and announces the
+// sitemap.
+func defaultRobotsTxt(baseURL string) string {
+	return fmt.Sprintf("User-agent: *\nDisallow:\n\nSitemap: %v/@@sitemap\n",
+		baseURL)
+}
+
+// getRobotsTxt returns the robots.txt of the site as configured by
+// core.seo.robots.
+func getRobotsTxt(s *service.Session, site *util.SiteSettings) (string,
+	error) {
+	var robots string
+	if err := s.Monsti().GetSiteConfig(site.Name, "core.seo.robots",
+		&robots); err != nil {
+		return "", fmt.Errorf("Could not get robots.txt: %v", err)
+	}
+	if strings.TrimSpace(robots) == "" {
+		return defaultRobotsTxt(site.BaseURL), nil
+	}
+	return robots, nil
+}
+
+// RobotsTxt serves the site's robots.txt.
+func (h *nodeHandler) RobotsTxt(c *reqContext) error {
+	robots, err := getRobotsTxt(c.Serv, c.Site)
+	if err != nil {
+		return err
+	}
+	c.Res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(c.Res, robots)
+	return nil
+}
+
+type robotsFormData struct {
+	Robots string
+}
+
+// Robots handles the form to change the site's robots.txt.
+func (h *nodeHandler) Robots(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	var data robotsFormData
+	if err := c.Serv.Monsti().GetSiteConfig(c.Site.Name, "core.seo.robots",
+		&data.Robots); err != nil {
+		return fmt.Errorf("Could not get robots.txt: %v", err)
+	}
+	form := htmlwidgets.NewForm(&data)
+	form.AddWidget(new(htmlwidgets.TextAreaWidget), "Robots", G("robots.txt"),
+		G("Leave empty to allow crawling everything and to announce the sitemap."))
+
+	c.Req.ParseForm()
+	saved := false
+	switch c.Req.Method {
+	case "GET":
+		_, saved = c.Req.Form["saved"]
+	case "POST":
+		if !form.Fill(c.Req.Form) {
+			break
+		}
+		if len(data.Robots) > robotsTxtLimit {
+			form.AddError("Robots", G("Too long."))
+			break
+		}
+		if err := c.Serv.Monsti().SetSiteConfig(c.Site.Name, "core.seo.robots",
+			data.Robots); err != nil {
+			return fmt.Errorf("Could not set robots.txt: %v", err)
+		}
+		http.Redirect(c.Res, c.Req, "@@robots?saved", http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+
+	body, err := h.Renderer.Render("actions/robots",
+		template.Context{
+			"Saved":   saved,
+			"Default": defaultRobotsTxt(c.Site.BaseURL),
+			"Form":    form.RenderData()}, c.UserSession.Locale,
+		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render robots.txt form: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("robots.txt"),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
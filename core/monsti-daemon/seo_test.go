@@ -0,0 +1,98 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestGetPageMeta(t *testing.T) {
+	nodeType := &service.NodeType{Id: "core.BlogPost", Fields: []*service.NodeField{
+		{Id: "core.Title", Type: "Text"},
+		{Id: "core.Teaser", Type: "Text"},
+		{Id: "core.Body", Type: "HTMLArea"},
+	}}
+	node := &service.Node{Path: "/blog/2015/01/hello", Type: nodeType}
+	if err := node.InitFields(nil, ""); err != nil {
+		t.Fatalf("Could not init fields: %v", err)
+	}
+	*(node.GetField("core.Body").(*service.HTMLField)) =
+		"<p>Hello <b>World</b>!</p>"
+	meta := getPageMeta(node, "Hello", "http://example.com")
+	expected := pageMeta{
+		Description: "Hello World !",
+		Canonical:   "http://example.com/blog/2015/01/hello/",
+		URL:         "http://example.com/blog/2015/01/hello/",
+		Title:       "Hello",
+		Type:        "article"}
+	if *meta != expected {
+		t.Errorf("getPageMeta(...) = %v, should be %v", *meta, expected)
+	}
+
+	*(node.GetField("core.Teaser").(*service.TextField)) = "A greeting."
+	node.SEO = &service.SEOMetadata{
+		Robots:    "noindex",
+		Canonical: "http://example.org/hello",
+		Title:     "Hello!",
+		Image:     "/images/hello.png"}
+	meta = getPageMeta(node, "Hello", "http://example.com")
+	expected = pageMeta{
+		Description: "A greeting.",
+		Robots:      "noindex",
+		Canonical:   "http://example.org/hello",
+		URL:         "http://example.com/blog/2015/01/hello/",
+		Title:       "Hello!",
+		Image:       "http://example.com/images/hello.png",
+		Type:        "article"}
+	if *meta != expected {
+		t.Errorf("getPageMeta(...) = %v, should be %v", *meta, expected)
+	}
+
+	node.SEO.Description = "Overridden"
+	meta = getPageMeta(node, "Hello", "")
+	if meta.Description != "Overridden" || meta.URL != "" ||
+		meta.Image != "/images/hello.png" {
+		t.Errorf("getPageMeta(...) without base URL = %v", *meta)
+	}
+}
+
+func TestTruncateWords(t *testing.T) {
+	tests := []struct {
+		Text   string
+		Length int
+		Result string
+	}{
+		{"", 10, ""},
+		{"  Hello   World ", 20, "Hello World"},
+		{"Hello World", 8, "Hello …"},
+	}
+	for _, test := range tests {
+		if result := truncateWords(test.Text, test.Length); result != test.Result {
+			t.Errorf("truncateWords(%q, %v) = %q, should be %q", test.Text,
+				test.Length, result, test.Result)
+		}
+	}
+}
+
+func TestDefaultRobotsTxt(t *testing.T) {
+	expected := "User-agent: *\nDisallow:\n\nSitemap: http://example.com/@@sitemap\n"
+	if robots := defaultRobotsTxt("http://example.com"); robots != expected {
+		t.Errorf("defaultRobotsTxt(...) = %q, should be %q", robots, expected)
+	}
+}
@@ -18,10 +18,15 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"regexp"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -44,19 +49,59 @@ type reqContext struct {
 	UserSession *service.UserSession
 	Site        *util.SiteSettings
 	Serv        *service.Session
+	// Locale is the language the node's content is shown in.
+	Locale string
+	// PathLocale is the locale given by the request path, e.g. "de"
+	// for "/de/about".
+	PathLocale string
+	// ImageSize is the image size given by the request path, e.g.
+	// "thumbnail" for "/foo.jpeg/_sizes/thumbnail".
+	ImageSize string
+	// FieldFile is the file of a video or audio field given by the
+	// request path, e.g. "example.Video" for "/foo/_files/example.Video".
+	FieldFile string
+	// Feed is the format of the feed given by the request path, e.g.
+	// "rss" for "/blog/feed.xml" (see splitFeed).
+	Feed string
+	// FormAction is the URL forms of form nodes get submitted to, e.g.
+	// for forms shown by the form shortcode. Empty submits them to the
+	// requested URL.
+	FormAction string
+	// RequestID identifies the request in the log and the X-Request-Id
+	// response header.
+	RequestID string
+	// ClientIP is the address of the client, see clientIP.
+	ClientIP string
+	// ErrorMessage explains the status of the error page, if set.
+	ErrorMessage string
 }
 
 // nodeHandler is a net/http handler to process incoming HTTP requests.
 type nodeHandler struct {
 	Renderer template.Renderer
 	Settings *settings
-	// Hosts is a map from hosts to site names.
-	Hosts map[string]string
+	// Hosts maps host patterns to site names.
+	Hosts hostTable
 	// Log is the logger used by the node handler.
 	Log *log.Logger
 	// Info is a connection to an INFO service.
-	Monsti        *service.MonstiClient
-	Sessions      *service.SessionPool
+	Monsti   *service.MonstiClient
+	Sessions *service.SessionPool
+	// Replay is the capture being replayed, if any.
+	Replay *captureBundle
+	// Timeout limits the time to process a request. Zero disables the
+	// limit.
+	Timeout time.Duration
+	// TrustedProxies are the networks of proxies whose X-Forwarded-For
+	// and X-Forwarded-Proto headers are trusted.
+	TrustedProxies []*net.IPNet
+	// Routes are the routes served by modules.
+	Routes *routeTable
+	// RateLimits limits the requests of clients, if not nil.
+	RateLimits *rateLimiter
+	// AdminAccess maps site names to the restrictions of their admin
+	// areas.
+	AdminAccess   map[string]*adminAccess
 	requests      map[uint]*reqContext
 	lastRequestID uint
 	mutex         sync.RWMutex
@@ -69,19 +114,34 @@ func (n *nodeHandler) GetRequest(id uint) *service.Request {
 	if !ok {
 		return nil
 	}
-	return &service.Request{
-		Id:       id,
-		NodePath: req.Node.Path,
-		Site:     req.Site.Name,
-		Query:    req.Req.URL.Query(),
-		// TODO add method
-		Session:  req.UserSession,
-		Action:   req.Action,
-		FormData: req.Req.PostForm,
+	ret := &service.Request{
+		Id:        id,
+		Path:      req.Req.URL.Path,
+		Host:      req.Req.Host,
+		Query:     req.Req.URL.Query(),
+		Method:    service.GetRequest,
+		Header:    selectHeaders(req.Req.Header),
+		ClientIP:  req.ClientIP,
+		Secure:    isSecureRequest(req.Req, n.TrustedProxies),
+		RequestID: req.RequestID,
+		Session:   req.UserSession,
+		Locale:    req.Locale,
+		Action:    req.Action,
+		FormData:  req.Req.PostForm,
 		/*
 			Node:  req.Node,
 		*/
 	}
+	if req.Req.Method == "POST" {
+		ret.Method = service.PostRequest
+	}
+	if req.Node != nil {
+		ret.NodePath = req.Node.Path
+	}
+	if req.Site != nil {
+		ret.Site = req.Site.Name
+	}
+	return ret
 }
 
 // splitAction splits and returns the path and @@action of the given URL.
@@ -112,9 +172,93 @@ func serveError(args ...interface{}) {
 	panic(ServeError(fmt.Sprintf(args[0].(string), args[1:]...)))
 }
 
+// requestIDHeader is the header holding the id of a request.
+const requestIDHeader = "X-Request-Id"
+
+// requestIDRegexp matches request ids set by fronting proxies which
+// may be used as ids of the requests.
+var requestIDRegexp = regexp.MustCompile(`^[-\w.]{1,64}$`)
+
+// requestID returns the id of the request, i.e. the X-Request-Id set
+// by a fronting proxy or a new random id.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); requestIDRegexp.MatchString(id) {
+		return id
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Sprintf("Could not generate request id: %v", err))
+	}
+	return hex.EncodeToString(id)
+}
+
+// timeoutPage is shown if a request could not be processed in time.
+const timeoutPage = `<!DOCTYPE html>
+<html><head><title>Service unavailable</title></head>
+<body><h1>Service unavailable</h1>
+<p>The page took too long to load. Please try again later.</p></body></html>`
+
 // ServeHTTP handles incoming HTTP requests.
+//
+// The id of the request is returned in the X-Request-Id header.
+// Requests are cancelled with 503 Service Unavailable after the
+// handler's timeout, except requests to routes of modules.
 func (h *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	c := reqContext{Res: w, Req: r}
+	id := requestID(r)
+	w.Header().Set(requestIDHeader, id)
+	site, _ := h.Hosts.lookup(r.Host)
+	ip := clientIP(r, h.TrustedProxies)
+	if retry, banned := h.RateLimits.allow(site, ip, r.Method, r.URL.Path,
+		time.Now()); retry > 0 {
+		if banned {
+			h.Log.Printf("[%v] Banned %v from site %v for %v", id, ip, site,
+				retry)
+		}
+		w.Header().Set("Retry-After",
+			strconv.Itoa(int((retry+time.Second-1)/time.Second)))
+		http.Error(w, "Too many requests.", http.StatusTooManyRequests)
+		return
+	}
+	// Modules serving routes may stream responses, which the timeout
+	// handler would buffer.
+	if h.Timeout <= 0 || h.Routes.lookup(site, r.URL.Path) != nil ||
+		timeoutExempt(r) {
+		h.serve(w, r, id)
+		return
+	}
+	start := time.Now()
+	http.TimeoutHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			h.serve(w, r, id)
+			if elapsed := time.Since(start); elapsed > h.Timeout {
+				h.Log.Printf("[%v] Request to %v%v timed out after %v", id, r.Host,
+					r.URL.Path, elapsed)
+			}
+		}), h.Timeout, timeoutPage).ServeHTTP(w, r)
+}
+
+// timeoutExempt returns true if the request is not limited by the
+// request timeout as it transfers files: uploads, imports, multipart
+// form submissions and files served at paths without trailing slash.
+func timeoutExempt(r *http.Request) bool {
+	nodePath, action := splitAction(r.URL.Path)
+	switch action {
+	case "upload", "gallery-upload", "import", "files":
+		return true
+	case "":
+		if !strings.HasSuffix(nodePath, "/") {
+			return true
+		}
+	}
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/")
+}
+
+// serve processes the request with the given id. Panics get logged
+// and answered with the error page.
+func (h *nodeHandler) serve(w http.ResponseWriter, r *http.Request,
+	id string) {
+	c := reqContext{Res: w, Req: r, RequestID: id,
+		ClientIP: clientIP(r, h.TrustedProxies)}
 	h.mutex.Lock()
 	c.Id = h.lastRequestID
 	h.lastRequestID += 1
@@ -129,13 +273,21 @@ func (h *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.mutex.Unlock()
 		if err := recover(); err != nil {
 			var buf bytes.Buffer
-			fmt.Fprintf(&buf, "error: %v\n", err)
+			fmt.Fprintf(&buf, "[%v] error: %v\n", c.RequestID, err)
 			if _, ok := err.(ServeError); !ok {
 				buf.Write(debug.Stack())
 			}
 			h.Log.Println(buf.String())
-			http.Error(c.Res, "Application error.",
-				http.StatusInternalServerError)
+			// The request's session has already been freed.
+			if c.Serv != nil {
+				if serv, err := h.Sessions.New(); err != nil {
+					c.Serv = nil
+				} else {
+					c.Serv = serv
+					defer h.Sessions.Free(serv)
+				}
+			}
+			h.serveErrorPage(&c, http.StatusInternalServerError)
 		}
 	}()
 	var err error
@@ -144,8 +296,31 @@ func (h *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		serveError("Could not get session: %v", err)
 	}
 	defer h.Sessions.Free(c.Serv)
+	if service.DefaultTracer != nil {
+		span := service.StartSpan(r.Method+" "+r.URL.Path, service.ServerSpan,
+			service.ParseTraceparent(r.Header.Get("Traceparent")))
+		span.Attributes["http.host"] = r.Host
+		span.Attributes["request.id"] = c.RequestID
+		c.Serv.Monsti().SetTrace(&span.Context)
+		defer func() {
+			c.Serv.Monsti().SetTrace(nil)
+			span.Finish()
+		}()
+	}
 	var nodePath string
 	nodePath, action := splitAction(c.Req.URL.Path)
+	if action == "" && nodePath == "/robots.txt" {
+		nodePath, action = "/", "robots.txt"
+	}
+	if action == "" {
+		nodePath, c.ImageSize = splitImageSize(nodePath)
+		if c.ImageSize == "" {
+			nodePath, c.FieldFile = splitFieldFile(nodePath)
+		}
+		if nodePath, c.Feed = splitFeed(nodePath); c.Feed != "" {
+			action = "feed"
+		}
+	}
 	c.Action = map[string]service.Action{
 		"view":                   service.ViewAction,
 		"edit":                   service.EditAction,
@@ -155,14 +330,64 @@ func (h *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"remove":                 service.RemoveAction,
 		"request-password-token": service.RequestPasswordTokenAction,
 		"change-password":        service.ChangePasswordAction,
+		"payment-callback":       service.PaymentCallbackAction,
+		"settings":               service.SettingsAction,
+		"files":                  service.FilesAction,
+		"calendar":               service.CalendarAction,
+		"custom-code":            service.CustomCodeAction,
+		"broken-references":      service.BrokenReferencesAction,
+		"archive":                service.ArchiveAction,
+		"browse":                 service.BrowseAction,
+		"mails":                  service.MailsAction,
+		"history":                service.HistoryAction,
+		"sitemap":                service.SitemapAction,
+		"markdown-preview":       service.MarkdownPreviewAction,
+		"users":                  service.UsersAction,
+		"health":                 service.HealthAction,
+		"quarantine":             service.QuarantineAction,
+		"search":                 service.SearchAction,
+		"translations":           service.TranslationsAction,
+		"media":                  service.MediaAction,
+		"upload":                 service.UploadAction,
+		"dashboard":              service.DashboardAction,
+		"newsletter":             service.NewsletterAction,
+		"subscribers":            service.SubscribersAction,
+		"send-newsletter":        service.SendNewsletterAction,
+		"submissions":            service.SubmissionsAction,
+		"feed":                   service.FeedAction,
+		"comments":               service.CommentsAction,
+		"moderate-comments":      service.ModerateCommentsAction,
+		"robots.txt":             service.RobotsTxtAction,
+		"robots":                 service.RobotsAction,
+		"redirects":              service.RedirectsAction,
+		"menus":                  service.MenusAction,
+		"blocks":                 service.BlocksAction,
+		"children":               service.ChildrenAction,
+		"tree":                   service.TreeAction,
+		"gallery-upload":         service.GalleryUploadAction,
+		"import":                 service.ImportAction,
 	}[action]
-	site_name, ok := h.Hosts[c.Req.Host]
+	site_name, ok := h.Hosts.lookup(c.Req.Host)
 	if !ok {
 		serveError("No site found for host %v", c.Req.Host)
 	}
 	site := h.Settings.Monsti.Sites[site_name]
 	c.Site = &site
 	c.Site.Name = site_name
+	capt, err := startCapture(&c, h)
+	if err != nil {
+		serveError("Could not start capture: %v", err)
+	}
+	if capt != nil {
+		defer func() {
+			path, err := capt.finish(&c, h)
+			if err != nil {
+				h.Log.Printf("Could not finish capture: %v", err)
+				return
+			}
+			h.Log.Printf("Captured request to %v", path)
+		}()
+	}
 	c.Session, err = getSession(c.Req, *c.Site)
 	if err != nil {
 		serveError("Could not get session: %v", err)
@@ -173,23 +398,100 @@ func (h *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		serveError("Could not get client session: %v", err)
 	}
+	if h.Replay != nil {
+		c.UserSession.User = h.Replay.User
+	}
 	c.UserSession.Locale = c.Site.Locale
+	if !h.checkAdminAccess(&c) {
+		return
+	}
+	if route := h.Routes.lookup(c.Site.Name, c.Req.URL.Path); route != nil {
+		c.Locale = c.Site.Locale
+		h.serveRoute(&c, route)
+		return
+	}
+	locales, err := getContentLocales(&c)
+	if err != nil {
+		serveError("%v", err)
+	}
+	prefixAll, err := getPrefixLocales(c.Serv, c.Site.Name)
+	if err != nil {
+		serveError("%v", err)
+	}
 	c.Node, err = c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
 	if err != nil {
 		serveError("Error getting node: %v", err)
 	}
+	if c.Node == nil {
+		// The path may start with a locale, e.g. "/de/about" or
+		// "/de/ueber-uns" using the localized names of the nodes.
+		locale, stripped := splitLocale(nodePath,
+			prefixedLocales(locales, prefixAll))
+		if locale != "" {
+			c.PathLocale, nodePath = locale, stripped
+			c.Node, err = c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
+			if err != nil {
+				serveError("Error getting node: %v", err)
+			}
+		}
+		if locale != "" && c.Node == nil {
+			resolved, err := resolveLocalizedPath(locale, nodePath,
+				func(nodePath string) ([]*service.Node, error) {
+					return c.Serv.Monsti().GetChildren(c.Site.Name, nodePath)
+				})
+			if err != nil {
+				serveError("Could not resolve localized path: %v", err)
+			}
+			if resolved != "" {
+				nodePath = resolved
+				c.Node, err = c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
+				if err != nil {
+					serveError("Error getting node: %v", err)
+				}
+			}
+		}
+	}
 	if c.Node == nil ||
+		(c.ImageSize != "" && c.Node.Type.Id != "core.Image") ||
 		(c.UserSession.User == nil &&
 			(c.Node.Public == false || c.Node.PublishTime.After(time.Now()))) {
+		if c.Node == nil && h.redirectMissing(&c) {
+			return
+		}
 		h.Log.Printf("Node not found: %v @ %v", nodePath, c.Site.Name)
 		c.Node = &service.Node{Path: nodePath}
-		http.Error(c.Res, "Document not found", http.StatusNotFound)
+		h.serveErrorPage(&c, http.StatusNotFound)
+		return
+	}
+	c.Locale = pickLocale(c.Node, c.PathLocale, c.Req.Header.Get("Accept-Language"),
+		locales)
+	if len(locales) > 1 {
+		c.UserSession.Locale = c.Locale
+		c.Res.Header().Add("Vary", "Accept-Language")
+	}
+	target, err := localeRedirect(&c, locales, prefixAll,
+		func(nodePath string) (*service.Node, error) {
+			return c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
+		})
+	if err != nil {
+		serveError("Could not get localized path: %v", err)
+	}
+	if target != "" {
+		http.Redirect(c.Res, c.Req, target, http.StatusFound)
 		return
 	}
 	if !checkPermission(c.Action, c.UserSession) {
 		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
 		return
 	}
+	ui, err := getAdminUI(c.Serv, c.Site.Name, c.UserSession.User)
+	if err != nil {
+		serveError("%v", err)
+	}
+	if !ui.Shows(action) {
+		h.serveErrorPage(&c, http.StatusForbidden)
+		return
+	}
 	switch c.Action {
 	case service.LoginAction:
 		err = h.Login(&c)
@@ -205,6 +507,78 @@ func (h *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		err = h.RequestPasswordToken(&c)
 	case service.ChangePasswordAction:
 		err = h.ChangePassword(&c)
+	case service.PaymentCallbackAction:
+		err = h.PaymentCallback(&c)
+	case service.SettingsAction:
+		err = h.SiteSettings(&c)
+	case service.FilesAction:
+		err = h.Files(&c)
+	case service.CalendarAction:
+		err = h.Calendar(&c)
+	case service.CustomCodeAction:
+		err = h.CustomCode(&c)
+	case service.BrokenReferencesAction:
+		err = h.BrokenReferences(&c)
+	case service.ArchiveAction:
+		err = h.Archive(&c)
+	case service.BrowseAction:
+		err = h.Browse(&c)
+	case service.MailsAction:
+		err = h.Mails(&c)
+	case service.HistoryAction:
+		err = h.History(&c)
+	case service.SitemapAction:
+		err = h.Sitemap(&c)
+	case service.MarkdownPreviewAction:
+		err = h.MarkdownPreview(&c)
+	case service.UsersAction:
+		err = h.Users(&c)
+	case service.HealthAction:
+		err = h.Health(&c)
+	case service.QuarantineAction:
+		err = h.Quarantine(&c)
+	case service.SearchAction:
+		err = h.Search(&c)
+	case service.TranslationsAction:
+		err = h.Translations(&c)
+	case service.MediaAction:
+		err = h.Media(&c)
+	case service.UploadAction:
+		err = h.Upload(&c)
+	case service.DashboardAction:
+		err = h.Dashboard(&c)
+	case service.NewsletterAction:
+		err = h.Newsletter(&c)
+	case service.SubscribersAction:
+		err = h.Subscribers(&c)
+	case service.SendNewsletterAction:
+		err = h.SendNewsletter(&c)
+	case service.SubmissionsAction:
+		err = h.Submissions(&c)
+	case service.FeedAction:
+		err = h.Feed(&c)
+	case service.CommentsAction:
+		err = h.Comments(&c)
+	case service.ModerateCommentsAction:
+		err = h.ModerateComments(&c)
+	case service.RobotsTxtAction:
+		err = h.RobotsTxt(&c)
+	case service.RobotsAction:
+		err = h.Robots(&c)
+	case service.RedirectsAction:
+		err = h.Redirects(&c)
+	case service.MenusAction:
+		err = h.Menus(&c)
+	case service.BlocksAction:
+		err = h.Blocks(&c)
+	case service.ChildrenAction:
+		err = h.Children(&c)
+	case service.TreeAction:
+		err = h.Tree(&c)
+	case service.GalleryUploadAction:
+		err = h.GalleryUpload(&c)
+	case service.ImportAction:
+		err = h.Import(&c)
 	default:
 		err = h.View(&c)
 	}
@@ -17,8 +17,16 @@
 package main
 
 import (
+	"bytes"
+	"log"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+	"pkg.monsti.org/monsti/api/util/template"
 )
 
 func TestSplitAction(t *testing.T) {
@@ -44,6 +52,30 @@ func TestSplitAction(t *testing.T) {
 	}
 }
 
+func TestTimeoutExempt(t *testing.T) {
+	tests := []struct {
+		Method, Path, ContentType string
+		Exempt                    bool
+	}{
+		{"GET", "/", "", false},
+		{"GET", "/about/", "", false},
+		{"GET", "/about/@@edit", "", false},
+		{"GET", "/files/report.pdf", "", true},
+		{"GET", "/media/@@upload", "", true},
+		{"POST", "/@@import", "application/x-www-form-urlencoded", true},
+		{"POST", "/about/@@edit", "application/x-www-form-urlencoded", false},
+		{"POST", "/about/@@edit", "multipart/form-data; boundary=x", true},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.Method, test.Path, nil)
+		req.Header.Set("Content-Type", test.ContentType)
+		if exempt := timeoutExempt(req); exempt != test.Exempt {
+			t.Errorf("timeoutExempt(%v %v) = %v, should be %v", test.Method,
+				test.Path, exempt, test.Exempt)
+		}
+	}
+}
+
 type responseWriter struct {
 	Body []byte
 }
@@ -90,3 +122,80 @@ func TestProcessNodeResponse(t *testing.T) {
 }
 
 */
+
+func TestRequestID(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	first, second := requestID(req), requestID(req)
+	if len(first) != 16 || first == second {
+		t.Errorf("requestID returned %q and %q, should be random", first, second)
+	}
+	req.Header.Set("X-Request-Id", "proxy-1234")
+	if ret := requestID(req); ret != "proxy-1234" {
+		t.Errorf("requestID = %q, should be the proxy's id", ret)
+	}
+	req.Header.Set("X-Request-Id", "<script>")
+	if ret := requestID(req); ret == "<script>" {
+		t.Errorf("requestID should not accept invalid ids")
+	}
+}
+
+func TestServePanic(t *testing.T) {
+	var logged bytes.Buffer
+	h := &nodeHandler{
+		Renderer: template.Renderer{Root: "../../templates"},
+		Settings: new(settings),
+		Log:      log.New(&logged, "", 0)}
+	req, _ := http.NewRequest("GET", "/foo/", nil)
+	req.Header.Set("X-Request-Id", "test-id")
+	res := httptest.NewRecorder()
+	// Missing sessions make the handler panic.
+	h.ServeHTTP(res, req)
+	if res.Code != http.StatusInternalServerError {
+		t.Errorf("Status is %v, should be 500", res.Code)
+	}
+	if res.Header().Get("X-Request-Id") != "test-id" ||
+		!strings.Contains(res.Body.String(), "<code>test-id</code>") {
+		t.Errorf("Response should contain the request id, got %v %q",
+			res.Header(), res.Body)
+	}
+	if !strings.HasPrefix(logged.String(), "[test-id] error: ") ||
+		!strings.Contains(logged.String(), "goroutine") {
+		t.Errorf("Log should contain tagged stack trace, got %q", logged.String())
+	}
+}
+
+func TestGetRequest(t *testing.T) {
+	r := httptest.NewRequest("POST", "http://example.com/blog/feed.xml?a=1",
+		strings.NewReader("foo=bar"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Accept-Language", "de")
+	r.Header.Set("Cookie", "session=secret")
+	r.ParseForm()
+	h := nodeHandler{requests: map[uint]*reqContext{
+		3: {Req: r, Node: &service.Node{Path: "/blog"},
+			Site: &util.SiteSettings{Name: "example"}, Locale: "de",
+			RequestID: "foo", ClientIP: "1.2.3.4"},
+		4: {Req: r},
+	}}
+	req := h.GetRequest(3)
+	if req == nil {
+		t.Fatalf("GetRequest returned nil")
+	}
+	if req.Id != 3 || req.NodePath != "/blog" || req.Site != "example" ||
+		req.Path != "/blog/feed.xml" || req.Host != "example.com" ||
+		req.Query.Get("a") != "1" || req.Method != service.PostRequest ||
+		req.ClientIP != "1.2.3.4" || req.RequestID != "foo" ||
+		req.Locale != "de" || req.FormData.Get("foo") != "bar" {
+		t.Errorf("GetRequest returned %+v", req)
+	}
+	if req.Header.Get("Accept-Language") != "de" ||
+		req.Header.Get("Cookie") != "" {
+		t.Errorf("Header of request is %v", req.Header)
+	}
+	if req := h.GetRequest(4); req == nil || req.NodePath != "" {
+		t.Errorf("GetRequest of request without node returned %+v", req)
+	}
+	if req := h.GetRequest(5); req != nil {
+		t.Errorf("GetRequest of unknown request should return nil")
+	}
+}
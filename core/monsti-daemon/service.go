@@ -20,18 +20,21 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
-	"net/smtp"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/chrneumann/mimemail"
 	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
 )
 
 type subscription struct {
@@ -43,9 +46,10 @@ type emitRet struct {
 }
 
 type signal struct {
-	Name string
-	Args []byte
-	Ret  chan emitRet
+	Name  string
+	Args  []byte
+	Trace string
+	Ret   chan emitRet
 }
 
 type MonstiService struct {
@@ -59,6 +63,23 @@ type MonstiService struct {
 	subscriptions map[string][]string
 	subscriber    map[string]chan *signal
 	subscriberRet map[string]chan emitRet
+	// eventsMutex syncronizes access to node timelines.
+	eventsMutex sync.Mutex
+	// fieldTypes maps field types provided by modules to the paths of
+	// their services.
+	fieldTypes map[string]string
+	// status collects the state shown on the dashboard.
+	status systemStatus
+	// mails is the outgoing mail queue.
+	mails *mailQueue
+	// jobs is the job queue of modules.
+	jobs *jobQueue
+	// logs keeps the latest log entries for GetLog.
+	logs *logBuffer
+	// tasks keeps the state of the scheduled tasks.
+	tasks taskRuns
+	// routes are the routes registered by modules.
+	routes routeTable
 }
 
 type PublishServiceArgs struct {
@@ -73,6 +94,23 @@ func (i *MonstiService) PublishService(args PublishServiceArgs,
 		i.Services = make(map[string][]string)
 	}
 	switch args.Service {
+	case "FieldType":
+		types, err := service.GetFieldTypes(args.Path)
+		if err != nil {
+			return fmt.Errorf("Could not get field types: %v", err)
+		}
+		if i.fieldTypes == nil {
+			i.fieldTypes = make(map[string]string)
+		}
+		for _, fieldType := range types {
+			if _, ok := i.fieldTypes[fieldType]; ok ||
+				service.NewField(fieldType) != nil {
+				return fmt.Errorf("Field type %q does already exist", fieldType)
+			}
+		}
+		for _, fieldType := range types {
+			i.fieldTypes[fieldType] = args.Path
+		}
 	default:
 		return fmt.Errorf("Unknown service type %v", args.Service)
 	}
@@ -85,30 +123,92 @@ func (i *MonstiService) PublishService(args PublishServiceArgs,
 	return nil
 }
 
+// GetFieldTypeService returns the path to the service providing the
+// given field type or an empty string if there is no such service.
+func (i *MonstiService) GetFieldTypeService(fieldType string,
+	reply *string) error {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	*reply = i.fieldTypes[fieldType]
+	return nil
+}
+
+// GetAvailableLocales returns the languages of the user interface.
+func (i *MonstiService) GetAvailableLocales(_ int, reply *[]string) error {
+	*reply = i.Settings.Monsti.Locales
+	return nil
+}
+
 func (i *MonstiService) ModuleInitDone(args string, reply *int) error {
-	// TODO Implement me
+	i.status.moduleReady(args)
 	return nil
 }
 
 func (m *MonstiService) SendMail(mail mimemail.Mail, reply *int) error {
+	if _, err := m.mails.Add(&mail, "", nil); err != nil {
+		return fmt.Errorf("monsti: Could not queue email: %v", err)
+	}
+	return nil
+}
+
+type SendSiteMailArgs struct {
+	Site        string
+	Mail        *mimemail.Mail
+	Attachments []service.MailAttachment
+}
+
+func (m *MonstiService) SendSiteMail(args *SendSiteMailArgs, reply *int) error {
+	if _, err := m.mails.Add(args.Mail, args.Site,
+		args.Attachments); err != nil {
+		return fmt.Errorf("monsti: Could not queue email: %v", err)
+	}
+	return nil
+}
+
+// deliverMail sends the queued mail, signed if configured by its
+// site. Errors of the mail server are returned unchanged to tell
+// permanent from temporary failures.
+func (m *MonstiService) deliverMail(queued *service.QueuedMail) error {
+	mail := &queued.Mail
+	from := envelopeSender(m.Settings, queued)
+	message := mail.Message()
+	if len(queued.Attachments) > 0 {
+		var err error
+		if message, err = attachFiles(message, queued.Attachments); err != nil {
+			return fmt.Errorf("Could not attach files: %v", err)
+		}
+	}
+	signer, err := newDKIMSigner(m.Settings.Monsti.Sites[queued.Site])
+	if err != nil {
+		return fmt.Errorf("Invalid DKIM settings of site %q: %v", queued.Site, err)
+	}
+	if signer != nil {
+		if message, err = signer.Sign(message, time.Now()); err != nil {
+			return err
+		}
+	}
 	if !m.Settings.Mail.Debug {
-		auth := smtp.PlainAuth("", m.Settings.Mail.Username,
-			m.Settings.Mail.Password, strings.Split(m.Settings.Mail.Host, ":")[0])
-		if err := smtp.SendMail(m.Settings.Mail.Host, auth,
-			mail.Sender(), mail.Recipients(), mail.Message()); err != nil {
-			return fmt.Errorf("monsti: Could not send email: %v", err)
+		transport, err := m.Settings.mailTransport(queued.Site)
+		if err != nil {
+			return fmt.Errorf("Invalid mail transport of site %q: %v",
+				queued.Site, err)
 		}
+		return transport.Send(from, mail.Recipients(), message)
 	} else {
 		m.Logger.Printf(`SendMail debug:
+Envelope sender: %v
+Signed: %v
 From: %v
 To: %v
 Cc: %v
 Bcc: %v
 Subject: %v
+Attachments: %v
 -- Body Start --
 %v
 -- Body End --`,
-			mail.From, mail.To, mail.Cc, mail.Bcc, mail.Subject, string(mail.Body))
+			from, signer != nil, mail.From, mail.To, mail.Cc, mail.Bcc,
+			mail.Subject, len(queued.Attachments), string(mail.Body))
 	}
 	return nil
 }
@@ -132,6 +232,8 @@ func (m *MonstiService) ConnectSignal(args *ConnectSignalArgs, ret *int) error {
 type Receive struct {
 	Name string
 	Args []byte
+	// Trace is the traceparent of the emitting call, if traced.
+	Trace string
 }
 
 func (m *MonstiService) EmitSignal(args *Receive, ret *[][]byte) error {
@@ -148,9 +250,10 @@ func (m *MonstiService) EmitSignal(args *Receive, ret *[][]byte) error {
 					args.Name, id)
 			}
 		}()
-		m.subscriber[id] <- &signal{args.Name, args.Args, retChan}
+		m.subscriber[id] <- &signal{args.Name, args.Args, args.Trace, retChan}
 		emitRet := <-retChan
 		if len(emitRet.Error) > 0 {
+			m.status.signalFailed(args.Name, emitRet.Error)
 			return fmt.Errorf("Received error as signal response: %v", emitRet.Error)
 		}
 		(*ret)[i] = emitRet.Ret
@@ -160,14 +263,16 @@ func (m *MonstiService) EmitSignal(args *Receive, ret *[][]byte) error {
 }
 
 type WaitSignalRet struct {
-	Name string
-	Args []byte
+	Name  string
+	Args  []byte
+	Trace string
 }
 
 func (m *MonstiService) WaitSignal(subscriber string, ret *WaitSignalRet) error {
 	signal := <-m.subscriber[subscriber]
 	ret.Name = signal.Name
 	ret.Args = signal.Args
+	ret.Trace = signal.Trace
 	if m.subscriberRet == nil {
 		m.subscriberRet = make(map[string]chan emitRet)
 	}
@@ -193,7 +298,10 @@ func getNode(root, path string) (node []byte, err error) {
 	node_path := filepath.Join(root, path[1:], "node.json")
 	node, err = ioutil.ReadFile(node_path)
 	if os.IsNotExist(err) {
-		return nil, nil
+		node, err = readArchivedNodeFile(root, path, "node.json")
+		if node == nil {
+			return nil, err
+		}
 	}
 	if err != nil {
 		return
@@ -203,8 +311,50 @@ func getNode(root, path string) (node []byte, err error) {
 	return
 }
 
+// readArchivedNodeFile reads the file of the given node if the node
+// is archived. Returns nil, nil if there is no such file.
+func readArchivedNodeFile(root, nodePath, file string) ([]byte, error) {
+	archive, rel := findArchive(root, nodePath)
+	if len(archive) == 0 {
+		return nil, nil
+	}
+	if len(rel) > 0 {
+		file = rel + "/" + file
+	}
+	return readArchiveFile(archive, file)
+}
+
+// checkNotArchived returns an error if the given node lies within an
+// archive. If the archived node itself is allowed, only nodes below
+// the archived node are rejected.
+func checkNotArchived(root, nodePath string, allowArchived bool) error {
+	archive, rel := findArchive(root, nodePath)
+	if len(archive) > 0 && !(allowArchived && len(rel) == 0) {
+		return fmt.Errorf("Node %v is archived", nodePath)
+	}
+	return nil
+}
+
 // getChildren looks up child nodes of the given node.
 func getChildren(root, path string) (nodes [][]byte, err error) {
+	if archive, rel := findArchive(root, path); len(archive) > 0 {
+		dirs, err := listArchiveDir(archive, rel)
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range dirs {
+			childPath := filepath.Join(path, dir)
+			node, err := getNode(root, childPath)
+			if err != nil {
+				return nil, err
+			}
+			if node == nil {
+				node = []byte(fmt.Sprintf(`{"Path":%q,"Type":"core.Path"}`, childPath))
+			}
+			nodes = append(nodes, node)
+		}
+		return nodes, nil
+	}
 	files, err := ioutil.ReadDir(filepath.Join(root, path))
 	if err != nil {
 		return
@@ -231,18 +381,56 @@ type GetChildrenArgs struct {
 
 func (i *MonstiService) GetChildren(args GetChildrenArgs,
 	reply *[][]byte) error {
-	site := i.Settings.Monsti.GetSiteNodesPath(args.Site)
-	ret, err := getChildren(site, args.Path)
+	nodesMutex.RLock()
+	defer nodesMutex.RUnlock()
+	root, sourcePath, mount := i.nodeRoot(args.Site, args.Path)
+	ret, err := getChildren(root, sourcePath)
+	if err != nil {
+		return err
+	}
+	if mount != nil {
+		for idx := range ret {
+			ret[idx] = rebaseNode(ret[idx], sourcePath, path.Clean(args.Path))
+		}
+		*reply = ret
+		return nil
+	}
+	// Mount points hide local nodes at the same path.
+	for _, point := range mountPoints(i.Settings.Monsti.Sites[args.Site],
+		args.Path) {
+		node, err := getNode(i.Settings.Monsti.GetSiteNodesPath(point.Site),
+			path.Clean(point.Source))
+		if err != nil {
+			return err
+		}
+		if node == nil {
+			continue
+		}
+		node = rebaseNode(node, path.Clean(point.Source), path.Clean(point.Path))
+		local := []byte(fmt.Sprintf(`{"Path":%q,`, path.Clean(point.Path)))
+		for idx := range ret {
+			if bytes.HasPrefix(ret[idx], local) {
+				ret = append(ret[:idx], ret[idx+1:]...)
+				break
+			}
+		}
+		ret = append(ret, node)
+	}
 	*reply = ret
-	return err
+	return nil
 }
 
 type GetNodeArgs struct{ Site, Path string }
 
 func (i *MonstiService) GetNode(args *GetNodeDataArgs,
 	reply *[]byte) error {
-	site := i.Settings.Monsti.GetSiteNodesPath(args.Site)
-	ret, err := getNode(site, args.Path)
+	nodesMutex.RLock()
+	defer nodesMutex.RUnlock()
+	root, sourcePath, mount := i.nodeRoot(args.Site, args.Path)
+	ret, err := getNode(root, sourcePath)
+	if mount != nil && ret != nil {
+		ret = rebaseNode(ret, sourcePath, path.Clean(args.Path))
+	}
 	*reply = ret
 	return err
 }
@@ -251,17 +439,55 @@ type GetNodeDataArgs struct{ Site, Path, File string }
 
 func (i *MonstiService) GetNodeData(args *GetNodeDataArgs,
 	reply *[]byte) error {
-	site := i.Settings.Monsti.GetSiteNodesPath(args.Site)
-	path := filepath.Join(site, args.Path[1:], args.File)
+	nodesMutex.RLock()
+	defer nodesMutex.RUnlock()
+	site, nodePath, _ := i.nodeRoot(args.Site, args.Path)
+	path := filepath.Join(site, nodePath[1:], args.File)
 	ret, err := ioutil.ReadFile(path)
 	if os.IsNotExist(err) {
-		*reply = nil
-		return nil
+		*reply, err = readArchivedNodeFile(site, nodePath, args.File)
+		return err
 	}
 	*reply = ret
 	return err
 }
 
+type GetNodeFilesArgs struct {
+	Site, Path string
+}
+
+func (i *MonstiService) GetNodeFiles(args *GetNodeFilesArgs,
+	reply *[]string) error {
+	nodesMutex.RLock()
+	defer nodesMutex.RUnlock()
+	site, nodePath, _ := i.nodeRoot(args.Site, args.Path)
+	var files []string
+	if archive, rel := findArchive(site, nodePath); len(archive) > 0 {
+		var err error
+		if files, err = listArchiveFiles(archive, rel); err != nil {
+			return err
+		}
+	} else {
+		infos, err := ioutil.ReadDir(filepath.Join(site, nodePath[1:]))
+		if err != nil {
+			return fmt.Errorf("Could not read node directory: %v", err)
+		}
+		for _, info := range infos {
+			if info.Mode().IsRegular() {
+				files = append(files, info.Name())
+			}
+		}
+	}
+	*reply = make([]string, 0, len(files))
+	for _, file := range files {
+		// The timeline is not part of the node's content.
+		if file != "node.json" && file != nodeEventsFile {
+			*reply = append(*reply, file)
+		}
+	}
+	return nil
+}
+
 type WriteNodeDataArgs struct {
 	Site, Path, File string
 	Content          []byte
@@ -269,7 +495,15 @@ type WriteNodeDataArgs struct {
 
 func (i *MonstiService) WriteNodeData(args *WriteNodeDataArgs,
 	reply *int) error {
+	nodesMutex.RLock()
+	defer nodesMutex.RUnlock()
+	if err := i.checkNotMounted(args.Site, args.Path); err != nil {
+		return err
+	}
 	site := i.Settings.Monsti.GetSiteNodesPath(args.Site)
+	if err := checkNotArchived(site, args.Path, false); err != nil {
+		return err
+	}
 	path := filepath.Join(site, args.Path[1:], args.File)
 	err := os.MkdirAll(filepath.Dir(path), 0700)
 	if err != nil {
@@ -279,7 +513,10 @@ func (i *MonstiService) WriteNodeData(args *WriteNodeDataArgs,
 	if err != nil {
 		return fmt.Errorf("Could not write node data: %v", err)
 	}
-	return nil
+	if purgesCache(args.File) {
+		i.purgeNodes(args.Site, args.Path)
+	}
+	return i.recordChanges(args.Site, false, args.Path)
 }
 
 type RemoveNodeArgs struct {
@@ -287,12 +524,38 @@ type RemoveNodeArgs struct {
 }
 
 func (i *MonstiService) RemoveNode(args *RemoveNodeArgs, reply *int) error {
+	nodesMutex.RLock()
+	defer nodesMutex.RUnlock()
+	if err := i.checkNotMounted(args.Site, args.Node); err != nil {
+		return err
+	}
 	root := i.Settings.Monsti.GetSiteNodesPath(args.Site)
+	if err := checkNotArchived(root, args.Node, true); err != nil {
+		return err
+	}
 	nodePath := filepath.Join(root, args.Node[1:])
 	if err := os.RemoveAll(nodePath); err != nil {
 		return fmt.Errorf("Can't remove node: %v", err)
 	}
-	return nil
+	i.purgeNodes(args.Site, args.Node)
+	return i.recordChanges(args.Site, true, args.Node)
+}
+
+type ArchiveNodeArgs struct {
+	Site, Node string
+}
+
+func (i *MonstiService) ArchiveNode(args *ArchiveNodeArgs, reply *int) error {
+	nodesMutex.RLock()
+	defer nodesMutex.RUnlock()
+	if err := i.checkNotMounted(args.Site, args.Node); err != nil {
+		return err
+	}
+	root := i.Settings.Monsti.GetSiteNodesPath(args.Site)
+	if err := archiveNode(root, args.Node); err != nil {
+		return fmt.Errorf("Can't archive node: %v", err)
+	}
+	return i.recordChanges(args.Site, true, args.Node)
 }
 
 type RenameNodeArgs struct {
@@ -300,7 +563,20 @@ type RenameNodeArgs struct {
 }
 
 func (i *MonstiService) RenameNode(args *RenameNodeArgs, reply *int) error {
+	nodesMutex.RLock()
+	defer nodesMutex.RUnlock()
+	for _, nodePath := range []string{args.Source, args.Target} {
+		if err := i.checkNotMounted(args.Site, nodePath); err != nil {
+			return err
+		}
+	}
 	root := i.Settings.Monsti.GetSiteNodesPath(args.Site)
+	if err := checkNotArchived(root, args.Source, true); err != nil {
+		return err
+	}
+	if err := checkNotArchived(root, args.Target, false); err != nil {
+		return err
+	}
 	if err := os.MkdirAll(
 		filepath.Dir(filepath.Join(root, args.Target)), 0700); err != nil {
 		return fmt.Errorf("Can't create parent directory: %v", err)
@@ -310,23 +586,235 @@ func (i *MonstiService) RenameNode(args *RenameNodeArgs, reply *int) error {
 		filepath.Join(root, args.Target)); err != nil {
 		return fmt.Errorf("Can't move node: %v", err)
 	}
+	i.purgeNodes(args.Site, args.Source, args.Target)
+	if err := recordRename(i.Settings.Monsti.GetSiteDataPath(args.Site),
+		args.Source, args.Target, time.Now().UTC()); err != nil {
+		return err
+	}
+	return i.recordChanges(args.Site, true, args.Source, args.Target)
+}
+
+// isFormSubmissionDir returns true if the given node directory holds
+// a stored form submission.
+func isFormSubmissionDir(dir string) (bool, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, "node.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	var node struct{ Type string }
+	if err := json.Unmarshal(content, &node); err != nil {
+		return false, fmt.Errorf("Could not unmarshal node %v: %v", dir, err)
+	}
+	return node.Type == "core.FormSubmission", nil
+}
+
+// copyNodeDir copies the node directory source including its subtree
+// to target, leaving out the runtime data of the nodes, i.e. their
+// timelines, comments and stored form submissions.
+func copyNodeDir(source, target string) error {
+	return filepath.Walk(source, func(file string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(source, file)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(target, name)
+		if info.IsDir() {
+			if file != source {
+				submission, err := isFormSubmissionDir(file)
+				if err != nil {
+					return err
+				}
+				if submission {
+					return filepath.SkipDir
+				}
+			}
+			return os.Mkdir(dest, 0700)
+		}
+		if info.Name() == nodeEventsFile || info.Name() == commentsFile {
+			return nil
+		}
+		in, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
+
+type CopyNodeArgs struct {
+	Site, Source, Target string
+}
+
+func (i *MonstiService) CopyNode(args *CopyNodeArgs, reply *int) error {
+	nodesMutex.RLock()
+	defer nodesMutex.RUnlock()
+	root := i.Settings.Monsti.GetSiteNodesPath(args.Site)
+	source, target := path.Clean("/"+args.Source), path.Clean("/"+args.Target)
+	if target == "/" || target == source ||
+		strings.HasPrefix(target, source+"/") || source == "/" {
+		return fmt.Errorf("Can't copy node %v to %v", source, target)
+	}
+	if err := i.checkNotMounted(args.Site, target); err != nil {
+		return err
+	}
+	// Mounted nodes may be copied into the site.
+	sourceRoot, sourcePath, _ := i.nodeRoot(args.Site, source)
+	if err := checkNotArchived(sourceRoot, sourcePath, true); err != nil {
+		return err
+	}
+	if err := checkNotArchived(root, target, false); err != nil {
+		return err
+	}
+	dir := filepath.Join(root, target[1:])
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		return fmt.Errorf("Target node %v does already exist", target)
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return fmt.Errorf("Can't create parent directory: %v", err)
+	}
+	if err := copyNodeDir(filepath.Join(sourceRoot, sourcePath[1:]),
+		dir); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("Can't copy node: %v", err)
+	}
+	i.purgeNodes(args.Site, target)
+	return i.recordChanges(args.Site, true, target)
+}
+
+// nodeEventsFile is the node data file holding the node's timeline.
+const nodeEventsFile = "__events.json"
+
+// readNodeEvents reads the timeline of the given node.
+func readNodeEvents(root, nodePath string) ([]*service.NodeEvent, error) {
+	content, err := ioutil.ReadFile(
+		filepath.Join(root, nodePath[1:], nodeEventsFile))
+	if os.IsNotExist(err) {
+		content, err = readArchivedNodeFile(root, nodePath, nodeEventsFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read node events: %v", err)
+	}
+	events := make([]*service.NodeEvent, 0)
+	if len(content) == 0 {
+		return events, nil
+	}
+	if err := json.Unmarshal(content, &events); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal node events: %v", err)
+	}
+	return events, nil
+}
+
+// addNodeEvent appends the event to the timeline of the given node.
+func addNodeEvent(root, nodePath string, event *service.NodeEvent) error {
+	if err := checkNotArchived(root, nodePath, false); err != nil {
+		return err
+	}
+	events, err := readNodeEvents(root, nodePath)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(append(events, event))
+	if err != nil {
+		return fmt.Errorf("Could not marshal node events: %v", err)
+	}
+	path := filepath.Join(root, nodePath[1:], nodeEventsFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("Could not create node directory: %v", err)
+	}
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		return fmt.Errorf("Could not write node events: %v", err)
+	}
 	return nil
 }
 
+type AddNodeEventArgs struct {
+	Site, Path string
+	Event      *service.NodeEvent
+}
+
+func (i *MonstiService) AddNodeEvent(args *AddNodeEventArgs, reply *int) error {
+	nodesMutex.RLock()
+	defer nodesMutex.RUnlock()
+	root := i.Settings.Monsti.GetSiteNodesPath(args.Site)
+	i.eventsMutex.Lock()
+	defer i.eventsMutex.Unlock()
+	if err := addNodeEvent(root, args.Path, args.Event); err != nil {
+		return err
+	}
+	return i.recordChanges(args.Site, false, args.Path)
+}
+
+type GetNodeEventsArgs struct{ Site, Path string }
+
+func (i *MonstiService) GetNodeEvents(args *GetNodeEventsArgs,
+	reply *[]*service.NodeEvent) error {
+	root := i.Settings.Monsti.GetSiteNodesPath(args.Site)
+	i.eventsMutex.Lock()
+	defer i.eventsMutex.Unlock()
+	events, err := readNodeEvents(root, args.Path)
+	*reply = events
+	return err
+}
+
+type QueryMediaArgs struct {
+	Site  string
+	Query *service.MediaQuery
+}
+
+func (i *MonstiService) QueryMedia(args *QueryMediaArgs,
+	reply *[]*service.MediaItem) error {
+	session, err := i.Handler.Sessions.New()
+	if err != nil {
+		return fmt.Errorf("Could not get session: %v", err)
+	}
+	defer i.Handler.Sessions.Free(session)
+	query := args.Query
+	if query == nil {
+		query = new(service.MediaQuery)
+	}
+	items, err := queryMedia(query,
+		func(nodePath string) (*service.Node, error) {
+			return session.Monsti().GetNode(args.Site, nodePath)
+		},
+		func(nodePath string) ([]*service.Node, error) {
+			return session.Monsti().GetChildren(args.Site, nodePath)
+		})
+	*reply = items
+	return err
+}
+
 // getConfig returns the configuration value or section for the given name.
+// The file may be in any format supported by util.ParseConfig.
 // If the file does not exist, it returns a nil slice.
+//
+// References like ${NAME} are not resolved: the values may have been
+// set by editors using SetSiteConfig.
 func getConfig(path, name string) ([]byte, error) {
-	content, err := ioutil.ReadFile(path)
-	if err != nil {
+	if _, err := os.Stat(path); err != nil {
 		if os.IsNotExist(err) {
 			return nil, nil
 		}
 		return nil, fmt.Errorf("Could not read configuration: %v", err)
 	}
 	var target interface{}
-	err = json.Unmarshal(content, &target)
-	if err != nil {
-		return nil, fmt.Errorf("Could not parse configuration: %v", err)
+	if err := util.ParseRawConfig(path, &target); err != nil {
+		return nil, err
 	}
 	subs := strings.Split(name, ".")
 	for _, sub := range subs {
@@ -356,11 +844,22 @@ type GetSiteConfigArgs struct{ Site, Name string }
 
 func (i *MonstiService) GetSiteConfig(args *GetSiteConfigArgs,
 	reply *[]byte) error {
-	configPath := i.Settings.Monsti.GetSiteConfigPath(args.Site)
 	parts := strings.SplitN(args.Name, ".", 2)
 	module := parts[0]
 	name := parts[1]
-	config, err := getConfig(filepath.Join(configPath, module+".json"), name)
+	i.mutex.RLock()
+	schema, ok := i.Settings.Config.ConfigSchemas[module]
+	i.mutex.RUnlock()
+	if ok {
+		if err := checkConfigName(schema, args.Site, args.Name); err != nil {
+			return err
+		}
+	}
+	path, err := i.findSiteConfigFile(args.Site, module)
+	if err != nil {
+		return err
+	}
+	config, err := getConfig(path, name)
 	if err != nil {
 		reply = nil
 		return err
@@ -369,6 +868,168 @@ func (i *MonstiService) GetSiteConfig(args *GetSiteConfigArgs,
 	return nil
 }
 
+// siteConfig decodes the site's configuration value of the given name
+// into out, which is left untouched if the value is not set.
+func (i *MonstiService) siteConfig(site, name string, out interface{}) error {
+	var raw []byte
+	if err := i.GetSiteConfig(&GetSiteConfigArgs{site, name}, &raw); err != nil {
+		return fmt.Errorf("Could not get %v: %v", name, err)
+	}
+	config := struct{ Value interface{} }{out}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return fmt.Errorf("Could not decode %v: %v", name, err)
+	}
+	return nil
+}
+
+// setConfig sets the configuration value for the given name to the
+// given JSON encoded value. Missing sections will be created. The
+// file keeps its format.
+func setConfig(path, name string, value []byte) error {
+	config := make(map[string]interface{})
+	_, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Could not read configuration: %v", err)
+	}
+	if err == nil {
+		var target interface{}
+		if err = util.ParseRawConfig(path, &target); err != nil {
+			return err
+		}
+		if section, ok := target.(map[string]interface{}); ok {
+			config = section
+		}
+	}
+	var decoded interface{}
+	if err = json.Unmarshal(value, &decoded); err != nil {
+		return fmt.Errorf("Could not decode value: %v", err)
+	}
+	subs := strings.Split(name, ".")
+	section := config
+	for _, sub := range subs[:len(subs)-1] {
+		next, ok := section[sub].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			section[sub] = next
+		}
+		section = next
+	}
+	section[subs[len(subs)-1]] = decoded
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("Could not create configuration directory: %v", err)
+	}
+	return util.WriteConfig(path, config)
+}
+
+// findSiteConfigFile returns the path to the configuration file of
+// the given module and site. If there is none, it returns the path to
+// a JSON file to be created.
+func (i *MonstiService) findSiteConfigFile(site, module string) (string,
+	error) {
+	base := filepath.Join(i.Settings.Monsti.GetSiteConfigPath(site), module)
+	path, err := util.FindConfigFile(base)
+	if err != nil {
+		return "", err
+	}
+	if len(path) == 0 {
+		path = base + ".json"
+	}
+	return path, nil
+}
+
+type SetSiteConfigArgs struct {
+	Site, Name string
+	Value      []byte
+}
+
+func (i *MonstiService) SetSiteConfig(args *SetSiteConfigArgs,
+	reply *int) error {
+	parts := strings.SplitN(args.Name, ".", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("Invalid configuration name %q", args.Name)
+	}
+	module := parts[0]
+	name := parts[1]
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	schema, ok := i.Settings.Config.ConfigSchemas[module]
+	if !ok {
+		return fmt.Errorf("No configuration schema for module %q", module)
+	}
+	if err := validateConfigValue(schema, args.Name, args.Value); err != nil {
+		return err
+	}
+	path, err := i.findSiteConfigFile(args.Site, module)
+	if err != nil {
+		return err
+	}
+	return setConfig(path, name, args.Value)
+}
+
+func (m *MonstiService) RegisterConfigSchema(schema *service.ConfigSchema,
+	reply *int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.Settings.Config.ConfigSchemas[schema.Id]; ok {
+		return fmt.Errorf("Configuration schema for module %q does already exist",
+			schema.Id)
+	}
+	for _, option := range schema.Options {
+		if !strings.HasPrefix(option.Id, schema.Id+".") {
+			return fmt.Errorf("Option %q is not in the namespace of module %q",
+				option.Id, schema.Id)
+		}
+		if service.NewField(option.Type) == nil {
+			return fmt.Errorf("Unknown type %q of option %q", option.Type,
+				option.Id)
+		}
+	}
+	for _, section := range schema.Sections {
+		if !strings.HasPrefix(section, schema.Id+".") {
+			return fmt.Errorf("Section %q is not in the namespace of module %q",
+				section, schema.Id)
+		}
+	}
+	if m.Settings.Config.ConfigSchemas == nil {
+		m.Settings.Config.ConfigSchemas = make(map[string]*service.ConfigSchema)
+	}
+	m.Settings.Config.ConfigSchemas[schema.Id] = schema
+	for site := range m.Settings.Monsti.Sites {
+		path, err := m.findSiteConfigFile(site, schema.Id)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		var config interface{}
+		if err := util.ParseRawConfig(path, &config); err != nil {
+			m.Logger.Printf("Invalid configuration: %v", err)
+			continue
+		}
+		for _, err := range validateSiteConfig(schema, site, config) {
+			m.Logger.Printf("Invalid configuration in %v: %v", path, err)
+		}
+	}
+	return nil
+}
+
+func (i *MonstiService) GetConfigSchemas(_ int,
+	ret *[]*service.ConfigSchema) error {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	ids := make([]string, 0, len(i.Settings.Config.ConfigSchemas))
+	for id := range i.Settings.Config.ConfigSchemas {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	*ret = make([]*service.ConfigSchema, 0, len(ids))
+	for _, id := range ids {
+		*ret = append(*ret, i.Settings.Config.ConfigSchemas[id])
+	}
+	return nil
+}
+
 func findAddableNodeTypes(nodeType string,
 	nodeTypes map[string]*service.NodeType) []string {
 	types := make([]string, 0)
@@ -406,6 +1067,73 @@ func (i *MonstiService) GetNodeType(nodeTypeID string,
 	return fmt.Errorf("Unknown node type %q", nodeTypeID)
 }
 
+// mergeNodeType merges the node types the given type extends and
+// includes as mixins into the given type.
+//
+// Inherited fields come first. A field of the given type replaces an
+// inherited field with the same id.
+func mergeNodeType(nodeType *service.NodeType,
+	nodeTypes map[string]*service.NodeType) error {
+	if len(nodeType.Extends) == 0 && len(nodeType.Mixins) == 0 {
+		return nil
+	}
+	bases := make([]*service.NodeType, 0, len(nodeType.Mixins)+1)
+	for _, id := range append([]string{nodeType.Extends}, nodeType.Mixins...) {
+		if len(id) == 0 {
+			continue
+		}
+		base, ok := nodeTypes[id]
+		if !ok {
+			return fmt.Errorf("Unknown base node type %q", id)
+		}
+		bases = append(bases, base)
+	}
+	fields := make([]*service.NodeField, 0)
+	positions := make(map[string]int)
+	for _, base := range bases {
+		for _, field := range base.Fields {
+			if _, ok := positions[field.Id]; !ok {
+				positions[field.Id] = len(fields)
+				fields = append(fields, field)
+			}
+		}
+	}
+	for _, field := range nodeType.Fields {
+		if pos, ok := positions[field.Id]; ok {
+			fields[pos] = field
+		} else {
+			positions[field.Id] = len(fields)
+			fields = append(fields, field)
+		}
+	}
+	nodeType.Fields = fields
+	if len(nodeType.Extends) == 0 {
+		return nil
+	}
+	parent := bases[0]
+	for _, addableTo := range parent.AddableTo {
+		found := false
+		for _, existing := range nodeType.AddableTo {
+			if existing == addableTo {
+				found = true
+				break
+			}
+		}
+		if !found {
+			nodeType.AddableTo = append(nodeType.AddableTo, addableTo)
+		}
+	}
+	if nodeType.Name == nil {
+		nodeType.Name = make(map[string]string)
+	}
+	for lang, name := range parent.Name {
+		if _, ok := nodeType.Name[lang]; !ok {
+			nodeType.Name[lang] = name
+		}
+	}
+	return nil
+}
+
 func (m *MonstiService) RegisterNodeType(nodeType *service.NodeType,
 	reply *int) error {
 	m.mutex.Lock()
@@ -413,18 +1141,116 @@ func (m *MonstiService) RegisterNodeType(nodeType *service.NodeType,
 	if _, ok := m.Settings.Config.NodeTypes[nodeType.Id]; ok {
 		return fmt.Errorf("Node type with id %v does already exist", nodeType.Id)
 	}
+	if err := checkMigrations(nodeType); err != nil {
+		return err
+	}
+	if err := mergeNodeType(nodeType, m.Settings.Config.NodeTypes); err != nil {
+		return fmt.Errorf("Could not merge node type %v: %v", nodeType.Id, err)
+	}
 	if m.Settings.Config.NodeTypes == nil {
 		m.Settings.Config.NodeTypes = make(map[string]*service.NodeType)
 		m.Settings.Config.NodeFields = make(map[string]*service.NodeField)
 	}
 	m.Settings.Config.NodeTypes[nodeType.Id] = nodeType
+	m.registerNodeFields(nodeType, false)
+	return nil
+}
+
+// registerNodeFields registers the fields of the given node type.
+//
+// Known fields will be reused unless update is true and the field
+// specifies its type, in which case the known field gets replaced.
+func (m *MonstiService) registerNodeFields(nodeType *service.NodeType,
+	update bool) {
 	for i, field := range nodeType.Fields {
-		if existing, ok := m.Settings.Config.NodeFields[field.Id]; ok {
+		existing, ok := m.Settings.Config.NodeFields[field.Id]
+		if ok && !(update && len(field.Type) > 0) {
 			nodeType.Fields[i] = existing
 		} else {
 			m.Settings.Config.NodeFields[field.Id] = field
 		}
 	}
+}
+
+type UpdateNodeTypeArgs struct {
+	NodeType *service.NodeType
+}
+
+// UpdateNodeType replaces an already registered node type.
+//
+// The reply is set to the ids of the fields which are no longer part
+// of the node type.
+func (m *MonstiService) UpdateNodeType(args *UpdateNodeTypeArgs,
+	reply *[]string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	nodeType := args.NodeType
+	old, ok := m.Settings.Config.NodeTypes[nodeType.Id]
+	if !ok {
+		return fmt.Errorf("Unknown node type %q", nodeType.Id)
+	}
+	if err := checkMigrations(nodeType); err != nil {
+		return err
+	}
+	if err := mergeNodeType(nodeType, m.Settings.Config.NodeTypes); err != nil {
+		return fmt.Errorf("Could not merge node type %v: %v", nodeType.Id, err)
+	}
+	m.Settings.Config.NodeTypes[nodeType.Id] = nodeType
+	m.registerNodeFields(nodeType, true)
+	*reply = make([]string, 0)
+	for _, oldField := range old.Fields {
+		found := false
+		for _, field := range nodeType.Fields {
+			if field.Id == oldField.Id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			*reply = append(*reply, oldField.Id)
+		}
+	}
+	return nil
+}
+
+// unregisterNodeFields removes the fields of the given node type,
+// including those merged from its mixins, unless another registered
+// node type still uses them.
+func (m *MonstiService) unregisterNodeFields(nodeType *service.NodeType) {
+	used := make(map[string]bool)
+	for _, other := range m.Settings.Config.NodeTypes {
+		for _, field := range other.Fields {
+			used[field.Id] = true
+		}
+	}
+	for _, field := range nodeType.Fields {
+		if !used[field.Id] {
+			delete(m.Settings.Config.NodeFields, field.Id)
+		}
+	}
+}
+
+// UnregisterNodeType removes a registered node type and its fields
+// which are not used by other node types.
+func (m *MonstiService) UnregisterNodeType(id string, reply *int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	nodeType, ok := m.Settings.Config.NodeTypes[id]
+	if !ok {
+		return fmt.Errorf("Unknown node type %q", id)
+	}
+	for _, other := range m.Settings.Config.NodeTypes {
+		if other.Extends == id {
+			return fmt.Errorf("Node type %v is extended by %v", id, other.Id)
+		}
+		for _, mixin := range other.Mixins {
+			if mixin == id {
+				return fmt.Errorf("Node type %v is a mixin of %v", id, other.Id)
+			}
+		}
+	}
+	delete(m.Settings.Config.NodeTypes, id)
+	m.unregisterNodeFields(nodeType)
 	return nil
 }
 
@@ -18,6 +18,8 @@ package main
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"log"
 	"os"
 	"reflect"
 	"strings"
@@ -100,6 +102,17 @@ func TestGetChildren(t *testing.T) {
 func TestGetConfig(t *testing.T) {
 	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
 		"/foo.json": `{"foo":{"foobar":"foobarvalue"},"bar":"barvalue"}`,
+		"/foo.yaml": `
+foo:
+  foobar: foobarvalue
+bar: barvalue
+`,
+		"/foo.toml": `
+bar = "barvalue"
+
+[foo]
+foobar = "foobarvalue"
+`,
 	}, "TestGetSection")
 	if err != nil {
 		t.Fatalf("Could not create directory tree: ", err)
@@ -117,22 +130,36 @@ func TestGetConfig(t *testing.T) {
 		t.Errorf("getConfig for non existing config file should"+
 			"return nil,nil, got %v,%v", ret, err)
 	}
-	for _, test := range tests {
-		unmarshal := func(in []byte) (out interface{}) {
-			if err = json.Unmarshal(in, &out); err != nil {
-				t.Errorf("Could not unmarshal for %v: %v", test.Name, err)
+	for _, file := range []string{"foo.json", "foo.yaml", "foo.toml"} {
+		for _, test := range tests {
+			unmarshal := func(in []byte) (out interface{}) {
+				if err = json.Unmarshal(in, &out); err != nil {
+					t.Errorf("Could not unmarshal for %v: %v", test.Name, err)
+				}
+				return
+			}
+			ret, err := getConfig(filepath.Join(root, file), test.Name)
+			switch {
+			case err != nil:
+				t.Errorf("getConfig(%q, %q) returned error: %v", file, test.Name, err)
+			case !reflect.DeepEqual(unmarshal(ret), unmarshal([]byte(test.Value))):
+				t.Errorf("getConfig(%q, %q) = `%s`, _ should be `%s`", file,
+					test.Name, ret, test.Value)
 			}
-			return
-		}
-		ret, err := getConfig(filepath.Join(root, "foo.json"), test.Name)
-		switch {
-		case err != nil:
-			t.Errorf("getConfig(_, %q) returned error: %v", test.Name, err)
-		case !reflect.DeepEqual(unmarshal(ret), unmarshal([]byte(test.Value))):
-			t.Errorf("getConfig(_, %q) = `%s`, _ should be `%s`", test.Name, ret,
-				test.Value)
 		}
 	}
+	// Values set by editors must not reveal secrets of the daemon.
+	path := filepath.Join(root, "secret.json")
+	if err := ioutil.WriteFile(path,
+		[]byte(`{"foo":"${file:foo.json} ${HOME}"}`), 0600); err != nil {
+		t.Fatalf("Could not write configuration: %v", err)
+	}
+	ret, err = getConfig(path, "foo")
+	if expected := `{"Value":"${file:foo.json} ${HOME}"}`; err != nil ||
+		string(ret) != expected {
+		t.Errorf("getConfig(%q, %q) = `%s`, %v, should be `%s`, nil", path,
+			"foo", ret, err, expected)
+	}
 }
 
 func TestFindAddableNodeTypes(t *testing.T) {
@@ -178,3 +205,246 @@ func TestFindAddableNodeTypes(t *testing.T) {
 		}
 	}
 }
+
+func TestMergeNodeType(t *testing.T) {
+	nodeTypes := map[string]*service.NodeType{
+		"core.Document": &service.NodeType{
+			Id:        "core.Document",
+			AddableTo: []string{"."},
+			Name:      map[string]string{"en": "Document", "de": "Dokument"},
+			Fields: []*service.NodeField{
+				{Id: "core.Title", Type: "Text"},
+				{Id: "core.Body", Type: "HTMLArea"}}},
+		"foo.Dated": &service.NodeType{
+			Id: "foo.Dated",
+			Fields: []*service.NodeField{
+				{Id: "foo.Date", Type: "DateTime"},
+				{Id: "core.Title", Type: "Text"}}},
+	}
+	nodeType := service.NodeType{
+		Id:        "foo.Event",
+		Extends:   "core.Document",
+		Mixins:    []string{"foo.Dated"},
+		AddableTo: []string{"foo.Calendar"},
+		Name:      map[string]string{"en": "Event"},
+		Fields: []*service.NodeField{
+			{Id: "core.Body", Type: "Text"},
+			{Id: "foo.Location", Type: "Text"}}}
+	if err := mergeNodeType(&nodeType, nodeTypes); err != nil {
+		t.Fatalf("mergeNodeType returned error: %v", err)
+	}
+	fields := make([]string, 0)
+	for _, field := range nodeType.Fields {
+		fields = append(fields, field.Id+":"+field.Type)
+	}
+	expectedFields := []string{"core.Title:Text", "core.Body:Text",
+		"foo.Date:DateTime", "foo.Location:Text"}
+	if !reflect.DeepEqual(fields, expectedFields) {
+		t.Errorf("Merged fields are %v, should be %v", fields, expectedFields)
+	}
+	expectedAddableTo := []string{"foo.Calendar", "."}
+	if !reflect.DeepEqual(nodeType.AddableTo, expectedAddableTo) {
+		t.Errorf("Merged AddableTo is %v, should be %v", nodeType.AddableTo,
+			expectedAddableTo)
+	}
+	expectedName := map[string]string{"en": "Event", "de": "Dokument"}
+	if !reflect.DeepEqual(nodeType.Name, expectedName) {
+		t.Errorf("Merged Name is %v, should be %v", nodeType.Name, expectedName)
+	}
+
+	unknown := service.NodeType{Id: "foo.Bar", Extends: "foo.Unknown"}
+	if err := mergeNodeType(&unknown, nodeTypes); err == nil {
+		t.Errorf("mergeNodeType should fail for unknown base types")
+	}
+}
+
+func TestUpdateNodeType(t *testing.T) {
+	m := MonstiService{Settings: new(settings)}
+	fields := []*service.NodeField{
+		{Id: "foo.Title", Type: "Text"},
+		{Id: "foo.Date", Type: "DateTime"}}
+	err := m.RegisterNodeType(&service.NodeType{Id: "foo.Event",
+		Fields: fields}, new(int))
+	if err != nil {
+		t.Fatalf("Could not register node type: %v", err)
+	}
+	var removed []string
+	err = m.UpdateNodeType(&UpdateNodeTypeArgs{&service.NodeType{
+		Id: "foo.Event",
+		Fields: []*service.NodeField{
+			{Id: "foo.Title"},
+			{Id: "foo.Start", Type: "DateTime"}}}}, &removed)
+	if err != nil {
+		t.Fatalf("UpdateNodeType returned error: %v", err)
+	}
+	if !reflect.DeepEqual(removed, []string{"foo.Date"}) {
+		t.Errorf("Removed fields are %v, should be [foo.Date]", removed)
+	}
+	var nodeType service.NodeType
+	if err := m.GetNodeType("foo.Event", &nodeType); err != nil {
+		t.Fatalf("Could not get updated node type: %v", err)
+	}
+	if len(nodeType.Fields) != 2 || nodeType.Fields[0].Type != "Text" ||
+		nodeType.Fields[1].Id != "foo.Start" {
+		t.Errorf("Updated node type has wrong fields: %v", nodeType.Fields)
+	}
+	err = m.UpdateNodeType(&UpdateNodeTypeArgs{
+		&service.NodeType{Id: "foo.Unknown"}}, &removed)
+	if err == nil {
+		t.Errorf("UpdateNodeType should fail for unknown node types")
+	}
+
+	err = m.RegisterNodeType(&service.NodeType{Id: "foo.Party",
+		Extends: "foo.Event"}, new(int))
+	if err != nil {
+		t.Fatalf("Could not register node type: %v", err)
+	}
+	if err := m.UnregisterNodeType("foo.Event", new(int)); err == nil {
+		t.Errorf("UnregisterNodeType should fail for extended node types")
+	}
+	if err := m.UnregisterNodeType("foo.Party", new(int)); err != nil {
+		t.Errorf("UnregisterNodeType returned error: %v", err)
+	}
+	if err := m.GetNodeType("foo.Party", &nodeType); err == nil {
+		t.Errorf("Unregistered node type is still known")
+	}
+
+	err = m.RegisterNodeType(&service.NodeType{Id: "foo.Located",
+		Fields: []*service.NodeField{{Id: "foo.Location", Type: "Text"}}},
+		new(int))
+	if err != nil {
+		t.Fatalf("Could not register node type: %v", err)
+	}
+	talk := func(speakerType string) *service.NodeType {
+		return &service.NodeType{Id: "foo.Talk", Mixins: []string{"foo.Located"},
+			Fields: []*service.NodeField{{Id: "foo.Speaker", Type: speakerType}}}
+	}
+	if err := m.RegisterNodeType(talk("Text"), new(int)); err != nil {
+		t.Fatalf("Could not register node type: %v", err)
+	}
+	if err := m.UnregisterNodeType("foo.Located", new(int)); err == nil {
+		t.Errorf("UnregisterNodeType should fail for mixins of other node types")
+	}
+	if err := m.UnregisterNodeType("foo.Talk", new(int)); err != nil {
+		t.Errorf("UnregisterNodeType returned error: %v", err)
+	}
+	if _, ok := m.Settings.Config.NodeFields["foo.Speaker"]; ok {
+		t.Errorf("Field of unregistered node type is still known")
+	}
+	if _, ok := m.Settings.Config.NodeFields["foo.Location"]; !ok {
+		t.Errorf("Field of mixin has been removed")
+	}
+	if err := m.RegisterNodeType(talk("HTMLArea"), new(int)); err != nil {
+		t.Fatalf("Could not register node type again: %v", err)
+	}
+	if err := m.GetNodeType("foo.Talk", &nodeType); err != nil {
+		t.Fatalf("Could not get node type: %v", err)
+	}
+	if len(nodeType.Fields) != 2 || nodeType.Fields[1].Type != "HTMLArea" {
+		t.Errorf("Registered node type has stale fields: %v", nodeType.Fields)
+	}
+}
+
+func TestCopyNode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-copy")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := MonstiService{Settings: new(settings),
+		Logger: log.New(ioutil.Discard, "", 0)}
+	m.Settings.Monsti.Directories.Data = dir
+	root := m.Settings.Monsti.GetSiteNodesPath("example")
+	files := map[string]string{
+		"news/node.json":            `{"Type":"core.Path"}`,
+		"news/__events.json":        `[]`,
+		"news/post/node.json":       `{"Type":"core.Document"}`,
+		"news/post/__file_core.Foo": `foo`,
+		"news/post/comments.json":   `[]`,
+		"news/submission/node.json": `{"Type":"core.FormSubmission"}`,
+		"archive/node.json":         `{"Type":"core.Path"}`,
+	}
+	for file, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, file)),
+			0700); err != nil {
+			t.Fatalf("Could not create node: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, file), []byte(content),
+			0600); err != nil {
+			t.Fatalf("Could not write node: %v", err)
+		}
+	}
+	if err := m.CopyNode(&CopyNodeArgs{"example", "/news", "/archive/news"},
+		new(int)); err != nil {
+		t.Fatalf("CopyNode returned error: %v", err)
+	}
+	for file, content := range files {
+		if !strings.HasPrefix(file, "news/") {
+			continue
+		}
+		copied, err := ioutil.ReadFile(filepath.Join(root, "archive", file))
+		if strings.HasSuffix(file, nodeEventsFile) ||
+			strings.HasSuffix(file, commentsFile) ||
+			strings.HasPrefix(file, "news/submission/") {
+			if !os.IsNotExist(err) {
+				t.Errorf("Runtime data %v should not have been copied", file)
+			}
+		} else if err != nil || string(copied) != content {
+			t.Errorf("Copy of %v is %q (%v), should be %q", file, copied, err,
+				content)
+		}
+	}
+	for i, target := range []string{"/archive/news", "/news/post/news", "/"} {
+		if err := m.CopyNode(&CopyNodeArgs{"example", "/news", target},
+			new(int)); err == nil {
+			t.Errorf("Test %v: CopyNode to %v should fail", i, target)
+		}
+	}
+}
+
+func TestGetNodeFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-files")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := MonstiService{Settings: new(settings),
+		Logger: log.New(ioutil.Discard, "", 0)}
+	m.Settings.Monsti.Directories.Data = dir
+	root := m.Settings.Monsti.GetSiteNodesPath("example")
+	for file, content := range map[string]string{
+		"news/node.json":                 `{"Type":"core.Path"}`,
+		"news/__events.json":             `[]`,
+		"news/post/node.json":            `{"Type":"core.Image"}`,
+		"news/post/__file_core.File":     `foo`,
+		"news/post/__image_100x100.jpeg": `bar`,
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, file)),
+			0700); err != nil {
+			t.Fatalf("Could not create node: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, file), []byte(content),
+			0600); err != nil {
+			t.Fatalf("Could not write node: %v", err)
+		}
+	}
+	expected := []string{"__file_core.File", "__image_100x100.jpeg"}
+	for _, archived := range []bool{false, true} {
+		if archived {
+			if err := archiveNode(root, "/news"); err != nil {
+				t.Fatalf("Could not archive node: %v", err)
+			}
+		}
+		var files []string
+		if err := m.GetNodeFiles(&GetNodeFilesArgs{"example", "/news/post"},
+			&files); err != nil || !reflect.DeepEqual(files, expected) {
+			t.Errorf("GetNodeFiles (archived: %v) = %v, %v, should be %v",
+				archived, files, err, expected)
+		}
+		if err := m.GetNodeFiles(&GetNodeFilesArgs{"example", "/news"},
+			&files); err != nil || len(files) != 0 {
+			t.Errorf("GetNodeFiles (archived: %v) = %v, %v, should be empty",
+				archived, files, err)
+		}
+	}
+}
@@ -30,7 +30,6 @@ import (
 	"crypto/sha256"
 	"code.google.com/p/go.crypto/bcrypt"
 	"github.com/chrneumann/htmlwidgets"
-	"github.com/chrneumann/mimemail"
 	"github.com/gorilla/sessions"
 	"pkg.monsti.org/gettext"
 	"pkg.monsti.org/monsti/api/service"
@@ -125,22 +124,9 @@ func (h *nodeHandler) RequestPasswordToken(c *reqContext) error {
 				site := h.Settings.Monsti.Sites[c.Site.Name]
 				link := getRequestPasswordToken(c.Site.Name, data.User,
 					site.PasswordTokenKey)
-				mail := mimemail.Mail{
-					From:    mimemail.Address{site.EmailName, site.EmailAddress},
-					Subject: G("Password request"),
-					Body: []byte(fmt.Sprintf(`Hello,
-
-someone, possibly you, requested a new password for your account %v at
-"%v".
-
-To change your password, visit the following link within 24 hours.
-If you did not request a new password, you may ignore this email.
-%v
-
-This is an automatically generated email. Please don't reply to it.
-`, data.User, site.Title, site.BaseURL+"/@@change-password?token="+link))}
-				mail.To = []mimemail.Address{mimemail.Address{user.Login, user.Email}}
-				err := c.Serv.Monsti().SendMail(&mail)
+				mail := passwordTokenMail(site, G, user,
+					site.BaseURL+"/@@change-password?token="+link)
+				err := c.Serv.Monsti().SendSiteMail(c.Site.Name, mail)
 				if err != nil {
 					return fmt.Errorf("Could not send mail: %v", err)
 				}
@@ -373,14 +359,27 @@ func writeUser(user *service.User, dataDir string) error {
 
 // checkPermission checks if the session's user might perform the given action.
 func checkPermission(action service.Action, session *service.UserSession) bool {
-	auth := session.User != nil
+	return session.User != nil || !requiresLogin(action)
+}
+
+// requiresLogin returns true iff the action is only available to
+// authenticated users.
+func requiresLogin(action service.Action) bool {
 	switch action {
 	case service.RemoveAction, service.EditAction, service.AddAction,
-		service.LogoutAction:
-		if auth {
-			return true
-		}
-	default:
+		service.LogoutAction, service.SettingsAction, service.FilesAction,
+		service.CalendarAction, service.CustomCodeAction,
+		service.BrokenReferencesAction, service.ArchiveAction,
+		service.BrowseAction, service.MailsAction, service.HistoryAction,
+		service.MarkdownPreviewAction, service.UsersAction,
+		service.HealthAction, service.QuarantineAction,
+		service.TranslationsAction, service.MediaAction, service.UploadAction,
+		service.DashboardAction, service.SubscribersAction,
+		service.SendNewsletterAction, service.SubmissionsAction,
+		service.ModerateCommentsAction, service.RobotsAction,
+		service.RedirectsAction, service.MenusAction, service.ChildrenAction,
+		service.TreeAction, service.BlocksAction,
+		service.GalleryUploadAction, service.ImportAction:
 		return true
 	}
 	return false
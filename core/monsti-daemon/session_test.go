@@ -104,7 +104,7 @@ func WriteUser(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Error reading changed user: %v", err)
 	}
-	if *userChanged != user {
+	if !reflect.DeepEqual(*userChanged, user) {
 		t.Errorf("Users differ: %v\n %v", user, userChanged)
 	}
 }
@@ -0,0 +1,341 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	htmlT "html/template"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// builtinShortcodes are the shortcodes expanded by Monsti itself.
+var builtinShortcodes = []string{"children", "form", "gallery"}
+
+// shortcodeNameRegexp matches valid names of shortcodes.
+var shortcodeNameRegexp = regexp.MustCompile(`^[A-Za-z][\w-]*$`)
+
+// shortcodeRegexp matches shortcodes, e.g. [gallery path=/photos].
+// Shortcodes in double brackets like [[gallery]] are escaped. The
+// enclosing paragraph of a shortcode standing alone in a paragraph
+// gets matched, too.
+var shortcodeRegexp = regexp.MustCompile(
+	`(<p>\s*)?\[(\[?)([A-Za-z][\w-]*)((?:\s[^\[\]]*)?)\](\]?)(\s*</p>)?`)
+
+// shortcodeParamRegexp matches the arguments of shortcodes, which are
+// either positional or named and optionally quoted, e.g. /about,
+// type=core.Document or title="Our team".
+var shortcodeParamRegexp = regexp.MustCompile(
+	`(?:([\w-]+)=)?(?:"([^"]*)"|'([^']*)'|(\S+))`)
+
+// parseShortcode returns the signal arguments of the shortcode with
+// the given name and parameters as found in HTML.
+func parseShortcode(name, params string) *service.ShortcodeArgs {
+	args := &service.ShortcodeArgs{Name: name, Args: make([]string, 0),
+		Attrs: make(map[string]string)}
+	params = strings.Replace(html.UnescapeString(params), "\u00a0", " ", -1)
+	for _, match := range shortcodeParamRegexp.FindAllStringSubmatch(params, -1) {
+		value := match[2] + match[3] + match[4]
+		if match[1] == "" {
+			args.Args = append(args.Args, value)
+		} else {
+			args.Attrs[match[1]] = value
+		}
+	}
+	return args
+}
+
+// shortcodeExpander returns the HTML replacing a shortcode and true,
+// or false if it does not handle the shortcode.
+type shortcodeExpander func(args *service.ShortcodeArgs) (string, bool, error)
+
+// expandShortcodes replaces the shortcodes in the HTML code by the
+// results of the expander. Shortcodes not handled by the expander are
+// kept, escaped ones lose a pair of brackets. Block level results may
+// replace the paragraph enclosing a shortcode.
+func expandShortcodes(code string, expandFn shortcodeExpander) (string, error) {
+	var expandErr error
+	expanded := shortcodeRegexp.ReplaceAllStringFunc(code,
+		func(match string) string {
+			parts := shortcodeRegexp.FindStringSubmatch(match)
+			open, close := parts[1], parts[6]
+			if expandErr != nil {
+				return match
+			}
+			if parts[2] != "" && parts[5] != "" {
+				return open + "[" + parts[3] + parts[4] + "]" + close
+			}
+			replacement, handled, err := expandFn(parseShortcode(parts[3],
+				parts[4]))
+			if err != nil {
+				expandErr = fmt.Errorf("Could not expand shortcode %q: %v",
+					parts[3], err)
+				return match
+			}
+			if !handled {
+				return match
+			}
+			if open != "" && close != "" {
+				open, close = "", ""
+			}
+			return open + parts[2] + replacement + parts[5] + close
+		})
+	if expandErr != nil {
+		return "", expandErr
+	}
+	return expanded, nil
+}
+
+// shortcodeTarget returns the path of the node given by the shortcode's
+// attribute or, if missing, its first positional argument. Paths are
+// relative to the node containing the shortcode, which is also the
+// default.
+func shortcodeTarget(nodePath string, args *service.ShortcodeArgs,
+	attr string) string {
+	target := args.Attrs[attr]
+	if target == "" && len(args.Args) > 0 {
+		target = args.Args[0]
+	}
+	if strings.HasPrefix(target, "/") {
+		return path.Clean(target)
+	}
+	return path.Join(nodePath, target)
+}
+
+// childLinks returns the links to the given children, skipping hidden
+// nodes and, if public is true, unpublished ones. If nodeType is not
+// empty, only children of this type are linked. limit is the maximum
+// number of links, zero links all children. Titles are shown in the
+// given locale.
+func childLinks(children []*service.Node, nodeType string, limit int,
+	locale string, public bool, now time.Time) (navigation, error) {
+	var links navigation
+	for _, child := range children {
+		if limit > 0 && len(links) >= limit {
+			break
+		}
+		if child.Hide || (child.Type != nil && child.Type.Hide) ||
+			(nodeType != "" && (child.Type == nil || child.Type.Id != nodeType)) ||
+			(public && !isPublished(child, now)) {
+			continue
+		}
+		translated, err := translateNode(child, locale)
+		if err != nil {
+			return nil, fmt.Errorf("Could not translate child node: %v", err)
+		}
+		links = append(links, navLink{
+			Name: getNodeTitle(translated), Target: dirPath(child.Path)})
+	}
+	return links, nil
+}
+
+// galleryImage is an image shown by the gallery shortcode.
+type galleryImage struct {
+	Path, Title string
+	Image       htmlT.HTML
+}
+
+// galleryImageSizes is the sizes attribute of images of the gallery
+// shortcode.
+const galleryImageSizes = "(max-width: 40em) 50vw, 15em"
+
+// shortcode expands the shortcode contained in the given node. Besides
+// the built in shortcodes, it asks the modules handling the
+// monsti.Shortcode signal to expand the shortcodes registered by
+// them.
+func (h *nodeHandler) shortcode(c *reqContext, node *service.Node,
+	registered map[string]bool, args *service.ShortcodeArgs) (
+	string, bool, error) {
+	siteTemplates := h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name)
+	public := c.UserSession.User == nil
+	limit, _ := strconv.Atoi(args.Attrs["limit"])
+	switch args.Name {
+	case "children", "gallery":
+		target := shortcodeTarget(node.Path, args, "path")
+		children, err := c.Serv.Monsti().GetChildren(c.Site.Name, target)
+		if err != nil {
+			return "", false, fmt.Errorf("Could not get children: %v", err)
+		}
+		context := template.Context{}
+		if args.Name == "children" {
+			links, err := childLinks(children, args.Attrs["type"], limit,
+				c.Locale, public, time.Now())
+			if err != nil {
+				return "", false, err
+			}
+			context["Links"] = links
+		} else {
+			images := make([]galleryImage, 0)
+			for _, child := range children {
+				if limit > 0 && len(images) >= limit {
+					break
+				}
+				if child.Type == nil || child.Type.Id != "core.Image" ||
+					(public && !isPublished(child, time.Now())) {
+					continue
+				}
+				image, err := responsiveImage(c, child, galleryImageSizes)
+				if err != nil {
+					return "", false, err
+				}
+				images = append(images, galleryImage{Path: dirPath(child.Path),
+					Title: getNodeTitle(child), Image: image})
+			}
+			context["Images"] = images
+		}
+		rendered, err := h.Renderer.Render("shortcodes/"+args.Name, context,
+			c.UserSession.Locale, siteTemplates)
+		if err != nil {
+			return "", false, fmt.Errorf("Could not render template: %v", err)
+		}
+		return rendered, true, nil
+	case "form":
+		target := shortcodeTarget(node.Path, args, "path")
+		form, err := c.Serv.Monsti().GetNode(c.Site.Name, target)
+		if err != nil {
+			return "", false, fmt.Errorf("Could not get form node: %v", err)
+		}
+		if form == nil || (public && !isPublished(form, time.Now())) ||
+			form.Type == nil || (form.Type.Id != "core.Form" &&
+			form.Type.Id != "core.ContactForm") {
+			rendered, err := h.renderBrokenReference(c, &service.EmbedNode{
+				Id: "form", URI: relNodePath(c.Node.Path, target)})
+			return string(rendered), true, err
+		}
+		action, err := localizedNodePath(c.PathLocale, c.PathLocale != "",
+			form.Path, func(nodePath string) (*service.Node, error) {
+				return c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
+			})
+		if err != nil {
+			return "", false, fmt.Errorf("Could not get localized path: %v", err)
+		}
+		// The form is rendered as embedded node of its own, submitting
+		// it to the form node.
+		req := *c.Req
+		req.Method = "GET"
+		formContext := *c
+		formContext.Req, formContext.Node = &req, form
+		formContext.FormAction = dirPath(action)
+		rendered, err := h.RenderNode(&formContext,
+			&service.EmbedNode{Id: "form", URI: "."})
+		return string(rendered), true, err
+	}
+	if !registered[args.Name] {
+		return "", false, nil
+	}
+	args.Request, args.Site, args.Node = c.Id, c.Site.Name, node.Path
+	var ret []service.ShortcodeRet
+	err := c.Serv.Monsti().EmitSignal("monsti.Shortcode", *args, &ret)
+	if err != nil {
+		return "", false, fmt.Errorf("Could not emit signal: %v", err)
+	}
+	for _, r := range ret {
+		if r.Handled {
+			// Modules may not circumvent the site's HTML allowlist.
+			allowlist, err := getHTMLAllowlist(c.Serv, c.Site.Name)
+			if err != nil {
+				return "", false, err
+			}
+			return service.SanitizeHTML(r.HTML, allowlist), true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// expandNodeShortcodes returns a copy of the node with the shortcodes
+// in its HTML fields expanded.
+func (h *nodeHandler) expandNodeShortcodes(c *reqContext,
+	node *service.Node) (*service.Node, error) {
+	fields := node.AllFields()
+	var registered map[string]bool
+	expanded := *node
+	copied := false
+	for _, field := range fields {
+		value, ok := node.GetField(field.Id).(*service.HTMLField)
+		if !ok || !strings.Contains(string(*value), "[") {
+			continue
+		}
+		if registered == nil {
+			codes, err := c.Serv.Monsti().GetShortcodes()
+			if err != nil {
+				return nil, fmt.Errorf("Could not get shortcodes: %v", err)
+			}
+			registered = make(map[string]bool, len(codes))
+			for _, code := range codes {
+				registered[code.Name] = true
+			}
+		}
+		code, err := expandShortcodes(string(*value),
+			func(args *service.ShortcodeArgs) (string, bool, error) {
+				return h.shortcode(c, node, registered, args)
+			})
+		if err != nil {
+			return nil, err
+		}
+		if !copied {
+			copied = true
+			expanded.Fields = make(map[string]service.Field, len(node.Fields))
+			for id, field := range node.Fields {
+				expanded.Fields[id] = field
+			}
+		}
+		html := service.HTMLField(code)
+		expanded.Fields[field.Id] = &html
+	}
+	return &expanded, nil
+}
+
+func (m *MonstiService) RegisterShortcode(code *service.Shortcode,
+	reply *int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !shortcodeNameRegexp.MatchString(code.Name) {
+		return fmt.Errorf("Invalid name of shortcode: %q", code.Name)
+	}
+	if _, ok := m.Settings.Config.Shortcodes[code.Name]; ok ||
+		stringInSlice(code.Name, builtinShortcodes) {
+		return fmt.Errorf("Shortcode %q does already exist", code.Name)
+	}
+	if m.Settings.Config.Shortcodes == nil {
+		m.Settings.Config.Shortcodes = make(map[string]*service.Shortcode)
+	}
+	m.Settings.Config.Shortcodes[code.Name] = code
+	return nil
+}
+
+func (m *MonstiService) GetShortcodes(_ int, ret *[]*service.Shortcode) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	names := make([]string, 0, len(m.Settings.Config.Shortcodes))
+	for name := range m.Settings.Config.Shortcodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	*ret = make([]*service.Shortcode, 0, len(names))
+	for _, name := range names {
+		*ret = append(*ret, m.Settings.Config.Shortcodes[name])
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestParseShortcode(t *testing.T) {
+	tests := []struct {
+		Params, Args, Attrs string
+	}{
+		{"", "[]", "map[]"},
+		{" /contact", "[/contact]", "map[]"},
+		{" path=/photos limit=3", "[]", "map[limit:3 path:/photos]"},
+		{` title=&#34;Our team&#34; 'a b'&nbsp;type=core.Document`, "[a b]",
+			"map[title:Our team type:core.Document]"},
+	}
+	for _, test := range tests {
+		args := parseShortcode("foo", test.Params)
+		if args.Name != "foo" || fmt.Sprint(args.Args) != test.Args ||
+			fmt.Sprint(args.Attrs) != test.Attrs {
+			t.Errorf("parseShortcode(%q) = %v %v, should be %v %v", test.Params,
+				args.Args, args.Attrs, test.Args, test.Attrs)
+		}
+	}
+}
+
+func TestExpandShortcodes(t *testing.T) {
+	expandFn := func(args *service.ShortcodeArgs) (string, bool, error) {
+		switch args.Name {
+		case "children":
+			return "<ul>" + strings.Join(args.Args, ",") + "</ul>", true, nil
+		case "fail":
+			return "", false, fmt.Errorf("failed")
+		}
+		return "", false, nil
+	}
+	tests := []struct {
+		Code, Expanded string
+	}{
+		{"<p>No shortcodes [1].</p>", "<p>No shortcodes [1].</p>"},
+		{"<p>[children]</p>", "<ul></ul>"},
+		{"<p> [children /a /b] </p><p>Text</p>", "<ul>/a,/b</ul><p>Text</p>"},
+		{"<p>See [children /a] here.</p>", "<p>See <ul>/a</ul> here.</p>"},
+		{"<p>[[children /a]]</p>", "<p>[children /a]</p>"},
+		{"<p>[unknown x=1]</p>", "<p>[unknown x=1]</p>"},
+	}
+	for _, test := range tests {
+		expanded, err := expandShortcodes(test.Code, expandFn)
+		if err != nil {
+			t.Errorf("expandShortcodes(%q) returned error: %v", test.Code, err)
+		}
+		if expanded != test.Expanded {
+			t.Errorf("expandShortcodes(%q) = %q, should be %q", test.Code,
+				expanded, test.Expanded)
+		}
+	}
+	if _, err := expandShortcodes("[fail]", expandFn); err == nil {
+		t.Errorf("expandShortcodes should fail if the expander fails")
+	}
+}
+
+func TestShortcodeTarget(t *testing.T) {
+	tests := []struct {
+		Args   service.ShortcodeArgs
+		Target string
+	}{
+		{service.ShortcodeArgs{}, "/about"},
+		{service.ShortcodeArgs{Args: []string{"team"}}, "/about/team"},
+		{service.ShortcodeArgs{Args: []string{"../contact/"}}, "/contact"},
+		{service.ShortcodeArgs{Args: []string{"x"},
+			Attrs: map[string]string{"path": "/photos/"}}, "/photos"},
+	}
+	for _, test := range tests {
+		if target := shortcodeTarget("/about", &test.Args, "path"); target !=
+			test.Target {
+			t.Errorf("shortcodeTarget(%v) = %q, should be %q", test.Args, target,
+				test.Target)
+		}
+	}
+}
+
+func TestRegisterShortcode(t *testing.T) {
+	m := MonstiService{Settings: new(settings),
+		Logger: log.New(ioutil.Discard, "", 0)}
+	if err := m.RegisterShortcode(&service.Shortcode{Name: "map"},
+		new(int)); err != nil {
+		t.Fatalf("RegisterShortcode returned error: %v", err)
+	}
+	for _, name := range []string{"gallery", "map", "no spaces"} {
+		if err := m.RegisterShortcode(&service.Shortcode{Name: name},
+			new(int)); err == nil {
+			t.Errorf("RegisterShortcode(%q) should fail", name)
+		}
+	}
+	var codes []*service.Shortcode
+	if err := m.GetShortcodes(0, &codes); err != nil {
+		t.Fatalf("GetShortcodes returned error: %v", err)
+	}
+	if len(codes) != 1 || codes[0].Name != "map" {
+		t.Errorf("GetShortcodes returned %v, should only return map", codes)
+	}
+}
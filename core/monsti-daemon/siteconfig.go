@@ -0,0 +1,331 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/chrneumann/htmlwidgets"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// initConfigSchemas registers the configuration schema of the core
+// module.
+func initConfigSchemas(settings *settings, session *service.Session,
+	logger *log.Logger) error {
+	G := func(in string) string { return in }
+	schema := service.ConfigSchema{
+		Id:   "core",
+		Name: util.GenLanguageMap(G("General"), availableLocales),
+		Options: []*service.NodeField{
+			{
+				Id:       "core.timezone",
+				Required: true,
+				Name:     util.GenLanguageMap(G("Timezone"), availableLocales),
+				Type:     "Text",
+			},
+			{
+				Id: "core.brokenreferences",
+				Name: util.GenLanguageMap(G("Broken references (warning, hide or placeholder)"),
+					availableLocales),
+				Type: "Text",
+			},
+			{
+				Id: "core.navigation.siblingorder",
+				Name: util.GenLanguageMap(G("Order of previous and next pages (field, e.g. -PublishTime)"),
+					availableLocales),
+				Type: "Text",
+			},
+		},
+		Sections: []string{"core.image", "core.customcode", "core.locales",
+			"core.adminui", "core.search", "core.prefixlocales", "core.uploads",
+			"core.assets", "core.cache", "core.blog",
+			"core.feed", "core.comments", "core.seo", "core.errorpages",
+			"core.editor", "core.sanitize", "core.tasks"},
+	}
+	if err := session.Monsti().RegisterConfigSchema(&schema); err != nil {
+		return fmt.Errorf("Could not register core configuration schema: %v", err)
+	}
+	return nil
+}
+
+// findConfigOption returns the named option of the given schema or
+// nil if there is no such option.
+func findConfigOption(schema *service.ConfigSchema,
+	name string) *service.NodeField {
+	for _, option := range schema.Options {
+		if option.Id == name {
+			return option
+		}
+	}
+	return nil
+}
+
+// inConfigSection returns true iff the name is a section of the given
+// schema or lies within one.
+func inConfigSection(schema *service.ConfigSchema, name string) bool {
+	for _, section := range schema.Sections {
+		if name == section || strings.HasPrefix(name, section+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// isConfigPrefix returns true iff the name is the parent of some
+// option or section of the given schema, e.g. "core.mail" for
+// "core.mail.host".
+func isConfigPrefix(schema *service.ConfigSchema, name string) bool {
+	for _, option := range schema.Options {
+		if strings.HasPrefix(option.Id, name+".") {
+			return true
+		}
+	}
+	for _, section := range schema.Sections {
+		if strings.HasPrefix(section, name+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConfigName returns an error if the given name is not declared
+// by the schema.
+func checkConfigName(schema *service.ConfigSchema, site, name string) error {
+	if name == schema.Id || findConfigOption(schema, name) != nil ||
+		inConfigSection(schema, name) || isConfigPrefix(schema, name) {
+		return nil
+	}
+	return fmt.Errorf("unknown key %v under site %v", name, site)
+}
+
+// validateSiteConfig validates the given configuration values of a
+// site against the schema. The values are expected to be a
+// configuration as returned by util.ParseRawConfig.
+func validateSiteConfig(schema *service.ConfigSchema, site string,
+	config interface{}) []error {
+	var walk func(name string, value interface{}) []error
+	walk = func(name string, value interface{}) []error {
+		if findConfigOption(schema, name) != nil {
+			encoded, err := json.Marshal(value)
+			if err == nil {
+				err = validateConfigValue(schema, name, encoded)
+			}
+			if err != nil {
+				return []error{fmt.Errorf("%v under site %v", err, site)}
+			}
+			return nil
+		}
+		if inConfigSection(schema, name) {
+			return nil
+		}
+		if name != schema.Id && !isConfigPrefix(schema, name) {
+			return []error{checkConfigName(schema, site, name)}
+		}
+		section, ok := value.(map[string]interface{})
+		if !ok {
+			return []error{fmt.Errorf("key %v under site %v must be a section",
+				name, site)}
+		}
+		var errs []error
+		for key, value := range section {
+			errs = append(errs, walk(name+"."+key, value)...)
+		}
+		return errs
+	}
+	if config == nil {
+		return nil
+	}
+	return walk(schema.Id, config)
+}
+
+// sectionOptions are the options within sections whose values get
+// validated like the options of a schema.
+var sectionOptions = map[string]*service.NodeField{
+	"core.seo.robots": {Id: "core.seo.robots", Type: "Text"},
+}
+
+// validateConfigValue checks if the JSON encoded value is valid for
+// the named option of the given schema. Values within sections must
+// be valid JSON. The sectionOptions within them get validated as
+// well, also if included in the value of a parent, e.g. "robots" of a
+// "core.seo" value.
+func validateConfigValue(schema *service.ConfigSchema, name string,
+	value []byte) error {
+	option := findConfigOption(schema, name)
+	if option == nil && inConfigSection(schema, name) {
+		if option = sectionOptions[name]; option == nil {
+			return validateSectionValue(name, value)
+		}
+	}
+	if option == nil {
+		return fmt.Errorf("Unknown configuration option %q", name)
+	}
+	return validateOptionValue(option, value)
+}
+
+// validateOptionValue checks if the JSON encoded value is valid for
+// the given option.
+func validateOptionValue(option *service.NodeField, value []byte) error {
+	field := service.NewField(option.Type)
+	if field == nil {
+		return fmt.Errorf("Unknown type %q of option %q", option.Type,
+			option.Id)
+	}
+	if err := field.Load(func(in interface{}) error {
+		return json.Unmarshal(value, in)
+	}); err != nil {
+		return fmt.Errorf("Invalid value for option %q: %v", option.Id, err)
+	}
+	if option.Required && len(strings.TrimSpace(field.String())) == 0 {
+		return fmt.Errorf("Option %q is required", option.Id)
+	}
+	return nil
+}
+
+// validateSectionValue checks the JSON encoded value of the named
+// section or value within a section, including the contained
+// sectionOptions.
+func validateSectionValue(name string, value []byte) error {
+	var values map[string]*json.RawMessage
+	if err := json.Unmarshal(value, &values); err != nil {
+		var any interface{}
+		if err := json.Unmarshal(value, &any); err != nil {
+			return fmt.Errorf("Invalid value for %q: %v", name, err)
+		}
+		return nil
+	}
+	for key, value := range values {
+		child := name + "." + key
+		if value == nil {
+			continue
+		}
+		if option, ok := sectionOptions[child]; ok {
+			if err := validateOptionValue(option, *value); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := validateSectionValue(child, *value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type siteSettingsFormData struct {
+	Fields util.NestedMap
+}
+
+// SiteSettings handles the site settings form generated from the
+// registered configuration schemas.
+func (h *nodeHandler) SiteSettings(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if !isCodeEditor(c.Site, c.UserSession.User) {
+		c.ErrorMessage = G("Only code editors may change the site settings.")
+		h.serveErrorPage(c, http.StatusForbidden)
+		return nil
+	}
+	locale := c.UserSession.Locale
+	schemas, err := c.Serv.Monsti().GetConfigSchemas()
+	if err != nil {
+		return fmt.Errorf("Could not get configuration schemas: %v", err)
+	}
+	options := make([]*service.NodeField, 0)
+	for _, schema := range schemas {
+		options = append(options, schema.Options...)
+	}
+	values := service.Node{
+		Path: c.Node.Path,
+		Type: &service.NodeType{Fields: options}}
+	if err := values.InitFields(c.Serv.Monsti(), c.Site.Name); err != nil {
+		return fmt.Errorf("Could not init settings fields: %v", err)
+	}
+	data := siteSettingsFormData{Fields: make(util.NestedMap)}
+	form := htmlwidgets.NewForm(&data)
+	for _, option := range options {
+		var value interface{}
+		err := c.Serv.Monsti().GetSiteConfig(c.Site.Name, option.Id, &value)
+		if err != nil {
+			return fmt.Errorf("Could not get configuration %q: %v", option.Id, err)
+		}
+		if value != nil {
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return fmt.Errorf("Could not encode configuration %q: %v",
+					option.Id, err)
+			}
+			if err := values.GetField(option.Id).Load(func(in interface{}) error {
+				return json.Unmarshal(encoded, in)
+			}); err != nil {
+				return fmt.Errorf("Could not load configuration %q: %v",
+					option.Id, err)
+			}
+		}
+		values.GetField(option.Id).ToFormField(form, data.Fields, option, locale)
+	}
+
+	c.Req.ParseForm()
+	saved := false
+	switch c.Req.Method {
+	case "GET":
+		if _, ok := c.Req.Form["saved"]; ok {
+			saved = true
+		}
+	case "POST":
+		if form.Fill(c.Req.Form) {
+			for _, option := range options {
+				field := values.GetField(option.Id)
+				field.FromFormField(data.Fields, option)
+				err := c.Serv.Monsti().SetSiteConfig(c.Site.Name, option.Id,
+					field.Dump())
+				if err != nil {
+					return fmt.Errorf("Could not set configuration %q: %v",
+						option.Id, err)
+				}
+			}
+			http.Redirect(c.Res, c.Req, "@@settings?saved", http.StatusSeeOther)
+			return nil
+		}
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+
+	body, err := h.Renderer.Render("actions/settings",
+		template.Context{
+			"Saved": saved,
+			"Form":  form.RenderData()}, locale,
+		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render settings form: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("Settings"),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, locale, c.Serv))
+	return nil
+}
@@ -0,0 +1,186 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestValidateConfigValue(t *testing.T) {
+	schema := service.ConfigSchema{
+		Id: "foo",
+		Options: []*service.NodeField{
+			{Id: "foo.name", Type: "Text", Required: true},
+			{Id: "foo.optional", Type: "Text"},
+			{Id: "foo.time", Type: "DateTime"},
+		},
+		Sections: []string{"foo.section"},
+	}
+	tests := []struct {
+		Name, Value string
+		Valid       bool
+	}{
+		{"foo.name", `"bar"`, true},
+		{"foo.name", `""`, false},
+		{"foo.name", `42`, false},
+		{"foo.optional", `""`, true},
+		{"foo.time", `"2014-12-17T10:00:00Z"`, true},
+		{"foo.time", `"yesterday"`, false},
+		{"foo.unknown", `"bar"`, false},
+		{"foo.section", `{"bar": 42}`, true},
+		{"foo.section.bar", `"baz"`, true},
+		{"foo.section.bar", `{"baz"`, false},
+	}
+	for _, test := range tests {
+		err := validateConfigValue(&schema, test.Name, []byte(test.Value))
+		if (err == nil) != test.Valid {
+			t.Errorf("validateConfigValue(_, %q, %v) = %v, valid should be %v",
+				test.Name, test.Value, err, test.Valid)
+		}
+	}
+	core := service.ConfigSchema{Id: "core", Sections: []string{"core.seo"}}
+	for _, test := range []struct {
+		Name, Value string
+		Valid       bool
+	}{
+		{"core.seo.robots", `"User-agent: *"`, true},
+		{"core.seo.robots", `42`, false},
+		{"core.seo", `{"robots": "User-agent: *", "other": [1]}`, true},
+		{"core.seo", `{"robots": {"foo": 1}}`, false},
+	} {
+		err := validateConfigValue(&core, test.Name, []byte(test.Value))
+		if (err == nil) != test.Valid {
+			t.Errorf("validateConfigValue(_, %q, %v) = %v, valid should be %v",
+				test.Name, test.Value, err, test.Valid)
+		}
+	}
+}
+
+func TestValidateSiteConfig(t *testing.T) {
+	schema := service.ConfigSchema{
+		Id: "core",
+		Options: []*service.NodeField{
+			{Id: "core.timezone", Type: "Text", Required: true},
+			{Id: "core.mail.host", Type: "Text"},
+		},
+		Sections: []string{"core.image"},
+	}
+	tests := []struct {
+		Config string
+		Errors []string
+	}{
+		{`{}`, nil},
+		{`{"timezone": "Europe/Berlin", "mail": {"host": "localhost"},
+       "image": {"sizes": {"foo": {"Width": 200}}}}`, nil},
+		{`{"Locale": "de"}`,
+			[]string{"unknown key core.Locale under site example.com"}},
+		{`{"mail": {"port": 25}}`,
+			[]string{"unknown key core.mail.port under site example.com"}},
+		{`{"mail": "localhost"}`,
+			[]string{"key core.mail under site example.com must be a section"}},
+		{`{"timezone": ""}`,
+			[]string{`Option "core.timezone" is required under site example.com`}},
+	}
+	for i, test := range tests {
+		var config interface{}
+		if err := json.Unmarshal([]byte(test.Config), &config); err != nil {
+			t.Fatalf("Could not unmarshal test config %v: %v", i, err)
+		}
+		errs := validateSiteConfig(&schema, "example.com", config)
+		ret := make([]string, 0)
+		for _, err := range errs {
+			ret = append(ret, err.Error())
+		}
+		if len(ret) != len(test.Errors) ||
+			(len(ret) > 0 && !reflect.DeepEqual(ret, test.Errors)) {
+			t.Errorf("validateSiteConfig for test %v = %v, should be %v", i, ret,
+				test.Errors)
+		}
+	}
+	if err := checkConfigName(&schema, "example.com",
+		"core.image.sizes"); err != nil {
+		t.Errorf("checkConfigName for section returned error: %v", err)
+	}
+	if err := checkConfigName(&schema, "example.com", "core.foo"); err == nil {
+		t.Errorf("checkConfigName for unknown key should return an error")
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo.json": `{"foo":{"foobar":"foobarvalue"},"bar":"barvalue"}`,
+	}, "TestSetConfig")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		File, Name, Value, Expected string
+	}{
+		{"foo.json", "bar", `"changed"`,
+			`{"foo":{"foobar":"foobarvalue"},"bar":"changed"}`},
+		{"foo.json", "foo.new", `1`,
+			`{"foo":{"foobar":"foobarvalue","new":1},"bar":"changed"}`},
+		{"new.json", "a.b", `"c"`, `{"a":{"b":"c"}}`},
+		{"new.yaml", "a.b", `"c"`, `{"a":{"b":"c"}}`},
+		{"new.toml", "a.b", `"c"`, `{"a":{"b":"c"}}`},
+	}
+	for _, test := range tests {
+		path := filepath.Join(root, test.File)
+		if err := setConfig(path, test.Name, []byte(test.Value)); err != nil {
+			t.Errorf("setConfig(_, %q, %v) returned error: %v", test.Name,
+				test.Value, err)
+			continue
+		}
+		var ret, expected interface{}
+		if err := util.ParseConfig(path, &ret); err != nil {
+			t.Fatalf("Could not read configuration: %v", err)
+		}
+		json.Unmarshal([]byte(test.Expected), &expected)
+		if !reflect.DeepEqual(ret, expected) {
+			t.Errorf("setConfig(%q, %q, %v) resulted in `%v`, should be `%s`",
+				test.File, test.Name, test.Value, ret, test.Expected)
+		}
+	}
+}
+
+func TestSiteSettingsCodeEditors(t *testing.T) {
+	site := &util.SiteSettings{Name: "foo", CodeEditors: []string{"alice"}}
+	h := &nodeHandler{Log: log.New(ioutil.Discard, "", 0)}
+	req, _ := http.NewRequest("GET", "http://foo.com/@@settings", nil)
+	rec := httptest.NewRecorder()
+	c := &reqContext{Req: req, Res: rec, Site: site,
+		UserSession: &service.UserSession{User: &service.User{Login: "bob"}}}
+	if err := h.SiteSettings(c); err != nil {
+		t.Fatalf("SiteSettings returned error: %v", err)
+	}
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Status for other users is %v, should be %v", rec.Code,
+			http.StatusForbidden)
+	}
+}
@@ -0,0 +1,182 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// isPublished returns true iff the node may be viewed by anonymous
+// visitors at the given time.
+func isPublished(node *service.Node, now time.Time) bool {
+	return node.Public && !node.PublishTime.After(now)
+}
+
+// alternate is a language variant of a node.
+type alternate struct {
+	Locale string
+	Path   string
+	// URL is the absolute URL of the variant.
+	URL string
+}
+
+// getAlternates returns the published language variants of the given
+// node including the node itself, sorted by locale. URLs are relative
+// to the site's base URL.
+//
+// Translation links are followed transitively, so it's sufficient to
+// link the variants in a cycle. Links to missing or unpublished nodes
+// are ignored. Returns nil if the node has no published
+// translations.
+func getAlternates(node *service.Node, siteLocale, baseURL string,
+	getNodeFn getNodeFunc, now time.Time) ([]alternate, error) {
+	if len(node.Translations) == 0 {
+		return nil, nil
+	}
+	locales := map[string]string{node.GetLocale(siteLocale): node.Path}
+	visited := map[string]bool{node.Path: true}
+	queue := []*service.Node{node}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for locale, nodePath := range current.Translations {
+			if visited[nodePath] {
+				continue
+			}
+			visited[nodePath] = true
+			translation, err := getNodeFn(nodePath)
+			if err != nil {
+				return nil, fmt.Errorf("Could not get translation %q: %v", nodePath,
+					err)
+			}
+			if translation == nil || !isPublished(translation, now) {
+				continue
+			}
+			if _, ok := locales[locale]; !ok {
+				locales[locale] = nodePath
+			}
+			queue = append(queue, translation)
+		}
+	}
+	if len(locales) < 2 {
+		return nil, nil
+	}
+	ret := make([]alternate, 0, len(locales))
+	for locale, nodePath := range locales {
+		ret = append(ret, alternate{locale, nodePath,
+			baseURL + dirPath(nodePath)})
+	}
+	sort.Sort(alternatesByLocale(ret))
+	return ret, nil
+}
+
+type alternatesByLocale []alternate
+
+func (a alternatesByLocale) Len() int           { return len(a) }
+func (a alternatesByLocale) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a alternatesByLocale) Less(i, j int) bool { return a[i].Locale < a[j].Locale }
+
+// sitemapLink is an alternate language variant in a sitemap.
+type sitemapLink struct {
+	Rel      string `xml:"rel,attr"`
+	HrefLang string `xml:"hreflang,attr"`
+	Href     string `xml:"href,attr"`
+}
+
+// sitemapURL is an entry of a sitemap.
+type sitemapURL struct {
+	Loc        string        `xml:"loc"`
+	LastMod    string        `xml:"lastmod,omitempty"`
+	Alternates []sitemapLink `xml:"xhtml:link"`
+}
+
+// sitemap is a sitemap as defined by http://www.sitemaps.org/.
+type sitemap struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	XHTML   string       `xml:"xmlns:xhtml,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+// getSitemap returns the sitemap of all published nodes below root
+// (including root).
+func getSitemap(root, baseURL, siteLocale string, getNodeFn getNodeFunc,
+	getChildrenFn getChildrenFunc, now time.Time) (*sitemap, error) {
+	ret := &sitemap{
+		XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9",
+		XHTML: "http://www.w3.org/1999/xhtml",
+		URLs:  make([]sitemapURL, 0)}
+	err := walkNodes(root, getNodeFn, getChildrenFn,
+		func(node *service.Node) error {
+			if node.Type == nil || node.Type.Id == "core.Path" ||
+				!isPublished(node, now) {
+				return nil
+			}
+			entry := sitemapURL{Loc: baseURL + dirPath(node.Path)}
+			if !node.Changed.IsZero() {
+				entry.LastMod = node.Changed.UTC().Format("2006-01-02")
+			}
+			alternates, err := getAlternates(node, siteLocale, baseURL, getNodeFn,
+				now)
+			if err != nil {
+				return err
+			}
+			for _, alternate := range alternates {
+				entry.Alternates = append(entry.Alternates, sitemapLink{
+					"alternate", alternate.Locale, alternate.URL})
+			}
+			ret.URLs = append(ret.URLs, entry)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Sitemap serves the sitemap of the site.
+func (h *nodeHandler) Sitemap(c *reqContext) error {
+	if c.Node.Path != "/" {
+		h.serveErrorPage(c, http.StatusNotFound)
+		return nil
+	}
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		return c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
+	}
+	getChildrenFn := func(nodePath string) ([]*service.Node, error) {
+		return c.Serv.Monsti().GetChildren(c.Site.Name, nodePath)
+	}
+	ret, err := getSitemap("/", c.Site.BaseURL, c.Site.Locale, getNodeFn,
+		getChildrenFn, time.Now())
+	if err != nil {
+		return fmt.Errorf("Could not get sitemap: %v", err)
+	}
+	content, err := xml.MarshalIndent(ret, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not marshal sitemap: %v", err)
+	}
+	c.Res.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	c.Res.Write([]byte(xml.Header))
+	c.Res.Write(content)
+	return nil
+}
@@ -0,0 +1,108 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/xml"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestSitemap(t *testing.T) {
+	now := time.Date(2015, 1, 2, 0, 0, 0, 0, time.UTC)
+	nodeType := &service.NodeType{Id: "core.Document"}
+	pathType := &service.NodeType{Id: "core.Path"}
+	nodes := map[string]*service.Node{
+		"/":   {Path: "/", Type: nodeType, Public: true},
+		"/de": {Path: "/de", Type: pathType, Public: true},
+		"/de/ueber-uns": {Path: "/de/ueber-uns", Type: nodeType, Public: true,
+			Locale: "de", Translations: map[string]string{"en": "/about"},
+			Changed: time.Date(2015, 1, 1, 23, 0, 0, 0, time.UTC)},
+		"/about": {Path: "/about", Type: nodeType, Public: true,
+			Translations: map[string]string{"fr": "/fr/a-propos"}},
+		"/fr": {Path: "/fr", Type: pathType, Public: true},
+		"/fr/a-propos": {Path: "/fr/a-propos", Type: nodeType,
+			Public: true, Locale: "fr",
+			Translations: map[string]string{"de": "/de/ueber-uns",
+				"es": "/es/gone", "it": "/it/chi-siamo"}},
+		"/it/chi-siamo": {Path: "/it/chi-siamo", Type: nodeType,
+			Public: false, Locale: "it"},
+	}
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		return nodes[nodePath], nil
+	}
+	getChildrenFn := func(nodePath string) ([]*service.Node, error) {
+		children := make([]*service.Node, 0)
+		for _, child := range []string{"/about", "/de", "/de/ueber-uns", "/fr",
+			"/fr/a-propos"} {
+			if path.Dir(child) == nodePath {
+				children = append(children, nodes[child])
+			}
+		}
+		return children, nil
+	}
+	alternates, err := getAlternates(nodes["/de/ueber-uns"], "en",
+		"http://example.com", getNodeFn, now)
+	if err != nil {
+		t.Fatalf("getAlternates returned error: %v", err)
+	}
+	expected := []alternate{
+		{"de", "/de/ueber-uns", "http://example.com/de/ueber-uns/"},
+		{"en", "/about", "http://example.com/about/"},
+		{"fr", "/fr/a-propos", "http://example.com/fr/a-propos/"},
+	}
+	if !reflect.DeepEqual(alternates, expected) {
+		t.Errorf("getAlternates(...) = %v, should be %v", alternates, expected)
+	}
+	ret, err := getSitemap("/", "http://example.com", "en", getNodeFn,
+		getChildrenFn, now)
+	if err != nil {
+		t.Fatalf("getSitemap returned error: %v", err)
+	}
+	locs := make([]string, 0)
+	for _, entry := range ret.URLs {
+		locs = append(locs, entry.Loc)
+		if len(entry.Alternates) != 0 && len(entry.Alternates) != 3 {
+			t.Errorf("Entry %v should have three alternates, has %v", entry.Loc,
+				entry.Alternates)
+		}
+	}
+	expectedLocs := []string{"http://example.com/", "http://example.com/about/",
+		"http://example.com/de/ueber-uns/", "http://example.com/fr/a-propos/"}
+	if !reflect.DeepEqual(locs, expectedLocs) {
+		t.Errorf("getSitemap(...) contains %v, should contain %v", locs,
+			expectedLocs)
+	}
+	content, err := xml.Marshal(ret)
+	if err != nil {
+		t.Fatalf("Could not marshal sitemap: %v", err)
+	}
+	for _, part := range []string{
+		`<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9"`,
+		`<lastmod>2015-01-01</lastmod>`,
+		`<xhtml:link rel="alternate" hreflang="en" href="http://example.com/about/">`,
+	} {
+		if !strings.Contains(string(content), part) {
+			t.Errorf("Sitemap %s should contain %s", content, part)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/sites"
+)
+
+// sitesMutex serializes the creation and removal of sites.
+var sitesMutex sync.Mutex
+
+// nodesMutex is held by node RPCs accessing the node directories and
+// exclusively while PromoteSite swaps them or site exports and backups
+// archive them.
+var nodesMutex sync.RWMutex
+
+// CreateSite scaffolds the given new site. Sites are loaded on
+// startup, so the new site gets served after restarting the daemon.
+func (m *MonstiService) CreateSite(site *service.NewSite, reply *int) error {
+	sitesMutex.Lock()
+	defer sitesMutex.Unlock()
+	if err := sites.Create(&m.Settings.Monsti, site); err != nil {
+		return err
+	}
+	m.Logger.Printf("Created site %q, restart to serve it", site.Name)
+	return nil
+}
+
+// CloneSite copies the given site, e.g. to a staging site for
+// redesign work. The copy gets served after restarting the daemon.
+func (m *MonstiService) CloneSite(clone *service.SiteClone, reply *int) error {
+	sitesMutex.Lock()
+	defer sitesMutex.Unlock()
+	if err := sites.Clone(&m.Settings.Monsti, clone); err != nil {
+		return err
+	}
+	m.Logger.Printf("Cloned site %q to %q, restart to serve it", clone.Source,
+		clone.Name)
+	return nil
+}
+
+type PromoteSiteArgs struct{ Staging, Production string }
+
+// PromoteSite swaps the nodes of the staging and the production site.
+// Node RPCs wait for the swap to finish, so they see either the old or
+// the new nodes. All nodes of both sites get purged from the caches.
+func (m *MonstiService) PromoteSite(args *PromoteSiteArgs, reply *int) error {
+	sitesMutex.Lock()
+	defer sitesMutex.Unlock()
+	nodesMutex.Lock()
+	defer nodesMutex.Unlock()
+	if err := sites.Promote(&m.Settings.Monsti, args.Staging,
+		args.Production); err != nil {
+		return err
+	}
+	m.Logger.Printf("Promoted site %q to %q", args.Staging, args.Production)
+	for _, site := range []string{args.Staging, args.Production} {
+		if err := m.purgeSite(site); err != nil {
+			m.Logger.Printf("(%v) Could not purge promoted nodes: %v", site, err)
+		}
+	}
+	return nil
+}
+
+// purgeSite purges all nodes of the site from the caches. nodesMutex
+// must be held.
+func (m *MonstiService) purgeSite(site string) error {
+	root := m.Settings.Monsti.GetSiteNodesPath(site)
+	nodePaths := make([]string, 0)
+	err := filepath.Walk(root, func(file string, info os.FileInfo,
+		err error) error {
+		if err != nil || info.IsDir() || info.Name() != "node.json" {
+			return err
+		}
+		rel, err := filepath.Rel(root, filepath.Dir(file))
+		if err != nil {
+			return err
+		}
+		nodePaths = append(nodePaths, path.Clean("/"+filepath.ToSlash(rel)))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	m.purgeNodes(site, nodePaths...)
+	return nil
+}
+
+type ExportSiteArgs struct{ Site, File string }
+
+// ExportSite writes an archive of the given site to the given file.
+// Node RPCs wait until the export has finished, so the archive is
+// consistent.
+func (m *MonstiService) ExportSite(args *ExportSiteArgs, reply *int) error {
+	file, err := os.OpenFile(args.File, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("Could not create archive: %v", err)
+	}
+	nodesMutex.Lock()
+	err = sites.Export(&m.Settings.Monsti, args.Site, file)
+	nodesMutex.Unlock()
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		os.Remove(args.File)
+		return err
+	}
+	m.Logger.Printf("Exported site %q to %v", args.Site, args.File)
+	return nil
+}
+
+type ImportSiteArgs struct{ File, Name string }
+
+// ImportSite restores a site from the given archive. The site gets
+// served after restarting the daemon.
+func (m *MonstiService) ImportSite(args *ImportSiteArgs, reply *int) error {
+	file, err := os.Open(args.File)
+	if err != nil {
+		return fmt.Errorf("Could not open archive: %v", err)
+	}
+	defer file.Close()
+	sitesMutex.Lock()
+	defer sitesMutex.Unlock()
+	if err := sites.Import(&m.Settings.Monsti, file, args.Name); err != nil {
+		return err
+	}
+	m.Logger.Printf("Imported site from %v, restart to serve it", args.File)
+	return nil
+}
+
+type RemoveSiteArgs struct{ Name string }
+
+// RemoveSite removes the given site if it's not served by the daemon.
+func (m *MonstiService) RemoveSite(args *RemoveSiteArgs, reply *int) error {
+	sitesMutex.Lock()
+	defer sitesMutex.Unlock()
+	if _, ok := m.Settings.Monsti.Sites[args.Name]; ok {
+		return fmt.Errorf("Site %q is served by the daemon", args.Name)
+	}
+	if err := sites.Remove(&m.Settings.Monsti, args.Name); err != nil {
+		return err
+	}
+	m.Logger.Printf("Removed site %q", args.Name)
+	return nil
+}
+
+// ListSites returns the configured sites, marking the ones served by
+// the daemon as active.
+func (m *MonstiService) ListSites(_ int, ret *[]*service.SiteInfo) error {
+	sitesMutex.Lock()
+	defer sitesMutex.Unlock()
+	configured, err := sites.List(&m.Settings.Monsti)
+	if err != nil {
+		return fmt.Errorf("Could not list sites: %v", err)
+	}
+	for _, site := range configured {
+		_, site.Active = m.Settings.Monsti.Sites[site.Name]
+	}
+	*ret = configured
+	return nil
+}
@@ -0,0 +1,90 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestSiteRPCs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-sites")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := MonstiService{Settings: new(settings),
+		Logger: log.New(ioutil.Discard, "", 0)}
+	m.Settings.Monsti.Directories.Config = filepath.Join(dir, "config")
+	m.Settings.Monsti.Directories.Data = filepath.Join(dir, "data")
+	m.Settings.Monsti.Sites = map[string]util.SiteSettings{"served": {}}
+	for _, name := range []string{"served", "new"} {
+		if err := m.CreateSite(&service.NewSite{Name: name,
+			Hosts: []string{name + ".example.com"}, AdminPassword: "secret"},
+			new(int)); err != nil {
+			t.Fatalf("CreateSite(%q) returned error: %v", name, err)
+		}
+	}
+	var list []*service.SiteInfo
+	if err := m.ListSites(0, &list); err != nil {
+		t.Fatalf("ListSites returned error: %v", err)
+	}
+	if len(list) != 2 || list[0].Name != "new" || list[0].Active ||
+		list[1].Name != "served" || !list[1].Active {
+		t.Errorf("ListSites returned %v", list)
+	}
+	if err := m.CloneSite(&service.SiteClone{Source: "new", Name: "staging",
+		Domains: map[string]string{"new.": "staging."}}, new(int)); err != nil {
+		t.Errorf("CloneSite returned error: %v", err)
+	}
+	if err := m.PromoteSite(&PromoteSiteArgs{"staging", "new"},
+		new(int)); err != nil {
+		t.Errorf("PromoteSite returned error: %v", err)
+	}
+	archive := filepath.Join(dir, "new.tar.gz")
+	if err := m.ExportSite(&ExportSiteArgs{"new", archive}, new(int)); err != nil {
+		t.Errorf("ExportSite returned error: %v", err)
+	}
+	if err := m.ExportSite(&ExportSiteArgs{"new", archive}, new(int)); err == nil {
+		t.Errorf("ExportSite should not overwrite files")
+	}
+	if err := m.ImportSite(&ImportSiteArgs{archive, "restored"},
+		new(int)); err != nil {
+		t.Errorf("ImportSite returned error: %v", err)
+	}
+	if err := m.RemoveSite(&RemoveSiteArgs{"restored"}, new(int)); err != nil {
+		t.Errorf("RemoveSite returned error: %v", err)
+	}
+	if err := m.RemoveSite(&RemoveSiteArgs{"staging"}, new(int)); err != nil {
+		t.Errorf("RemoveSite returned error: %v", err)
+	}
+	if err := m.RemoveSite(&RemoveSiteArgs{"served"}, new(int)); err == nil {
+		t.Errorf("RemoveSite should fail for served sites")
+	}
+	if err := m.RemoveSite(&RemoveSiteArgs{"new"}, new(int)); err != nil {
+		t.Errorf("RemoveSite returned error: %v", err)
+	}
+	if err := m.ListSites(0, &list); err != nil || len(list) != 1 {
+		t.Errorf("ListSites after RemoveSite returned %v, %v", list, err)
+	}
+}
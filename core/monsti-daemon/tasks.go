@@ -0,0 +1,256 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// taskIdRegexp matches valid ids of tasks.
+var taskIdRegexp = regexp.MustCompile(`^[A-Za-z][\w.-]*$`)
+
+func (m *MonstiService) RegisterTask(task *service.Task, reply *int) error {
+	if !taskIdRegexp.MatchString(task.Id) {
+		return fmt.Errorf("Invalid id of task: %q", task.Id)
+	}
+	if _, err := parseCron(task.Schedule); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.Settings.Config.Tasks[task.Id]; ok {
+		return fmt.Errorf("Task %q does already exist", task.Id)
+	}
+	if m.Settings.Config.Tasks == nil {
+		m.Settings.Config.Tasks = make(map[string]*service.Task)
+	}
+	m.Settings.Config.Tasks[task.Id] = task
+	return nil
+}
+
+// siteTask is an entry of the core.tasks site configuration. It adds
+// a task for the site or changes the schedule of a task registered
+// with PerSite. An empty schedule disables the task for the site.
+type siteTask struct {
+	Id, Schedule string
+}
+
+// getSiteTasks returns the tasks configured for the site.
+func (i *MonstiService) getSiteTasks(site string) ([]siteTask, error) {
+	var raw []byte
+	err := i.GetSiteConfig(&GetSiteConfigArgs{site, "core.tasks"}, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get tasks: %v", err)
+	}
+	var config struct{ Value []siteTask }
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, fmt.Errorf("Could not decode tasks: %v", err)
+	}
+	return config.Value, nil
+}
+
+// scheduledTask is a task to be run for a site, if any.
+type scheduledTask struct {
+	Task, Site, Schedule string
+	schedule             *cronSchedule
+	// err is set if the schedule is invalid.
+	err error
+}
+
+func newScheduledTask(task, site, schedule string) *scheduledTask {
+	ret := &scheduledTask{Task: task, Site: site, Schedule: schedule}
+	ret.schedule, ret.err = parseCron(schedule)
+	return ret
+}
+
+func (t *scheduledTask) String() string {
+	if t.Site == "" {
+		return fmt.Sprintf("%q", t.Task)
+	}
+	return fmt.Sprintf("%q for site %q", t.Task, t.Site)
+}
+
+type scheduledTasksById []*scheduledTask
+
+func (s scheduledTasksById) Len() int      { return len(s) }
+func (s scheduledTasksById) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s scheduledTasksById) Less(i, j int) bool {
+	return s[i].Task < s[j].Task ||
+		(s[i].Task == s[j].Task && s[i].Site < s[j].Site)
+}
+
+// scheduledTasks returns the tasks registered by modules and the tasks
+// configured for the sites, ordered by id and site.
+func (i *MonstiService) scheduledTasks() []*scheduledTask {
+	i.mutex.RLock()
+	tasks := make([]*service.Task, 0, len(i.Settings.Config.Tasks))
+	for _, task := range i.Settings.Config.Tasks {
+		tasks = append(tasks, task)
+	}
+	i.mutex.RUnlock()
+	var ret []*scheduledTask
+	for _, task := range tasks {
+		if !task.PerSite {
+			ret = append(ret, newScheduledTask(task.Id, "", task.Schedule))
+		}
+	}
+	for site := range i.Settings.Monsti.Sites {
+		siteTasks, err := i.getSiteTasks(site)
+		if err != nil {
+			i.Logger.Printf("(%v) %v", site, err)
+		}
+		schedules := make(map[string]string)
+		for _, task := range tasks {
+			if task.PerSite {
+				schedules[task.Id] = task.Schedule
+			}
+		}
+		for _, task := range siteTasks {
+			schedules[task.Id] = task.Schedule
+		}
+		for id, schedule := range schedules {
+			if schedule != "" {
+				ret = append(ret, newScheduledTask(id, site, schedule))
+			}
+		}
+	}
+	sort.Sort(scheduledTasksById(ret))
+	return ret
+}
+
+// taskKey identifies a task run for a site, if any.
+type taskKey struct {
+	Task, Site string
+}
+
+// taskRuns keeps the state of the last run of each scheduled task.
+type taskRuns struct {
+	mutex sync.Mutex
+	runs  map[taskKey]service.TaskStatus
+}
+
+// start records the start of a run. It returns false if the last run
+// of the task did not finish yet.
+func (r *taskRuns) start(key taskKey, at time.Time) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.runs == nil {
+		r.runs = make(map[taskKey]service.TaskStatus)
+	}
+	if r.runs[key].Running {
+		return false
+	}
+	r.runs[key] = service.TaskStatus{Running: true, LastRun: at}
+	return true
+}
+
+// finish records the end of a run.
+func (r *taskRuns) finish(key taskKey, end time.Time, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	status := r.runs[key]
+	status.Running = false
+	status.Duration = end.Sub(status.LastRun)
+	if err != nil {
+		status.Error = err.Error()
+	}
+	r.runs[key] = status
+}
+
+// get returns the state of the last run of the task.
+func (r *taskRuns) get(key taskKey) service.TaskStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.runs[key]
+}
+
+// taskStatus returns the state of the scheduled tasks.
+func (i *MonstiService) taskStatus(now time.Time) []service.TaskStatus {
+	var ret []service.TaskStatus
+	for _, task := range i.scheduledTasks() {
+		status := i.tasks.get(taskKey{task.Task, task.Site})
+		status.Task, status.Site, status.Schedule =
+			task.Task, task.Site, task.Schedule
+		if task.err != nil {
+			status.Error = task.err.Error()
+		} else {
+			status.Next = task.schedule.next(now)
+		}
+		ret = append(ret, status)
+	}
+	return ret
+}
+
+// runTask emits the monsti.RunTask signal for the given task and
+// records the result.
+func (i *MonstiService) runTask(task *scheduledTask, at time.Time) {
+	key := taskKey{task.Task, task.Site}
+	if !i.tasks.start(key, time.Now()) {
+		i.Logger.Printf("Skipping task %v, the last run did not finish yet",
+			task)
+		return
+	}
+	err := func() error {
+		session, err := i.Handler.Sessions.New()
+		if err != nil {
+			return fmt.Errorf("Could not get session: %v", err)
+		}
+		defer i.Handler.Sessions.Free(session)
+		var ret []service.RunTaskRet
+		if err := session.Monsti().EmitSignal("monsti.RunTask",
+			service.RunTaskArgs{Task: task.Task, Site: task.Site, Time: at},
+			&ret); err != nil {
+			return err
+		}
+		for _, r := range ret {
+			if r.Handled {
+				if r.Error != "" {
+					return errors.New(r.Error)
+				}
+				return nil
+			}
+		}
+		return errors.New("No module handles the task")
+	}()
+	i.tasks.finish(key, time.Now(), err)
+	if err != nil {
+		i.Logger.Printf("Task %v failed: %v", task, err)
+	}
+}
+
+// scheduleTasks runs the scheduled tasks at the minutes given by their
+// schedules in the local time of the daemon.
+func (i *MonstiService) scheduleTasks() {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		at := time.Now().Truncate(time.Minute)
+		for _, task := range i.scheduledTasks() {
+			if task.err == nil && task.schedule.matches(at) {
+				go i.runTask(task, at)
+			}
+		}
+	}
+}
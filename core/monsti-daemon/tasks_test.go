@@ -0,0 +1,89 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestScheduledTasks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-tasks")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := MonstiService{Settings: new(settings),
+		Logger: log.New(ioutil.Discard, "", 0)}
+	m.Settings.Monsti.Directories.Config = dir
+	m.Settings.Monsti.Sites = map[string]util.SiteSettings{"a": {}, "b": {}}
+	for _, task := range []*service.Task{
+		{Id: "example.reindex", Schedule: "@daily", PerSite: true},
+		{Id: "example.cleanup", Schedule: "0 * * * *"},
+	} {
+		if err := m.RegisterTask(task, new(int)); err != nil {
+			t.Fatalf("RegisterTask(%q) returned error: %v", task.Id, err)
+		}
+	}
+	for _, task := range []*service.Task{
+		{Id: "example.cleanup", Schedule: "@daily"},
+		{Id: "", Schedule: "@daily"},
+		{Id: "example.foo", Schedule: "60 * * * *"},
+	} {
+		if err := m.RegisterTask(task, new(int)); err == nil {
+			t.Errorf("RegisterTask(%q, %q) should fail", task.Id, task.Schedule)
+		}
+	}
+	if err := setConfig(filepath.Join(m.Settings.Monsti.GetSiteConfigPath("b"),
+		"core.json"), "tasks", []byte(`[
+{"Id": "example.reindex", "Schedule": ""},
+{"Id": "b.newsletter", "Schedule": "0 8 * * 1"},
+{"Id": "b.broken", "Schedule": "foo"}]`)); err != nil {
+		t.Fatalf("Could not write site configuration: %v", err)
+	}
+	now := time.Date(2014, 6, 14, 10, 30, 0, 0, time.Local)
+	m.tasks.start(taskKey{"example.cleanup", ""}, now.Add(-time.Minute))
+	m.tasks.finish(taskKey{"example.cleanup", ""}, now, errors.New("foo"))
+	m.tasks.start(taskKey{"example.reindex", "a"}, now)
+	if m.tasks.start(taskKey{"example.reindex", "a"}, now) {
+		t.Errorf("start should fail for running tasks")
+	}
+	var ret []string
+	for _, task := range m.taskStatus(now) {
+		ret = append(ret, fmt.Sprintf("%v %v %v %v %v %v", task.Task, task.Site,
+			task.Next.Format("2006-01-02 15:04"), task.Running, task.Duration,
+			task.Error != ""))
+	}
+	expected := []string{
+		"b.broken b 0001-01-01 00:00 false 0s true",
+		"b.newsletter b 2014-06-16 08:00 false 0s false",
+		"example.cleanup  2014-06-14 11:00 false 1m0s true",
+		"example.reindex a 2014-06-15 00:00 true 0s false",
+	}
+	if fmt.Sprint(ret) != fmt.Sprint(expected) {
+		t.Errorf("taskStatus returned\n%v\nshould be\n%v", ret, expected)
+	}
+}
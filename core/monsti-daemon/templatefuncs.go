@@ -0,0 +1,112 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	htmlT "html/template"
+	"regexp"
+	"sort"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// templateFuncNameRegexp matches valid names of template functions.
+var templateFuncNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// templateFuncEmitter asks the modules to call a template function.
+type templateFuncEmitter func(args service.TemplateFuncArgs) (
+	[]service.TemplateFuncRet, error)
+
+// callTemplateFunc calls the named template function provided by a
+// module with the given arguments.
+func callTemplateFunc(name string, args []interface{},
+	emitFn templateFuncEmitter) (interface{}, error) {
+	strArgs := make([]string, 0, len(args))
+	for _, arg := range args {
+		strArgs = append(strArgs, fmt.Sprint(arg))
+	}
+	ret, err := emitFn(service.TemplateFuncArgs{Name: name, Args: strArgs})
+	if err != nil {
+		return nil, fmt.Errorf("Could not call template function %q: %v", name,
+			err)
+	}
+	for _, r := range ret {
+		if !r.Handled {
+			continue
+		}
+		if r.HTML {
+			return htmlT.HTML(r.Value), nil
+		}
+		return r.Value, nil
+	}
+	return nil, fmt.Errorf("No module handles template function %q", name)
+}
+
+// templateFunc returns the template function calling the modules
+// handling the monsti.TemplateFunc signal.
+func (m *MonstiService) templateFunc(name string) func(
+	args ...interface{}) (interface{}, error) {
+	return func(args ...interface{}) (interface{}, error) {
+		session, err := m.Handler.Sessions.New()
+		if err != nil {
+			return nil, fmt.Errorf("Could not get session: %v", err)
+		}
+		defer m.Handler.Sessions.Free(session)
+		return callTemplateFunc(name, args,
+			func(args service.TemplateFuncArgs) ([]service.TemplateFuncRet, error) {
+				var ret []service.TemplateFuncRet
+				err := session.Monsti().EmitSignal("monsti.TemplateFunc", args, &ret)
+				return ret, err
+			})
+	}
+}
+
+func (m *MonstiService) RegisterTemplateFunc(fn *service.TemplateFunc,
+	reply *int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !templateFuncNameRegexp.MatchString(fn.Name) {
+		return fmt.Errorf("Invalid name of template function: %q", fn.Name)
+	}
+	if _, ok := m.Settings.Config.TemplateFuncs[fn.Name]; ok {
+		return fmt.Errorf("Template function %q does already exist", fn.Name)
+	}
+	if m.Settings.Config.TemplateFuncs == nil {
+		m.Settings.Config.TemplateFuncs = make(map[string]*service.TemplateFunc)
+	}
+	m.Settings.Config.TemplateFuncs[fn.Name] = fn
+	template.RegisterFunc(fn.Name, m.templateFunc(fn.Name), fn.Sandboxed)
+	return nil
+}
+
+func (m *MonstiService) GetTemplateFuncs(_ int,
+	ret *[]*service.TemplateFunc) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	names := make([]string, 0, len(m.Settings.Config.TemplateFuncs))
+	for name := range m.Settings.Config.TemplateFuncs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	*ret = make([]*service.TemplateFunc, 0, len(names))
+	for _, name := range names {
+		*ret = append(*ret, m.Settings.Config.TemplateFuncs[name])
+	}
+	return nil
+}
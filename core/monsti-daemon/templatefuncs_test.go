@@ -0,0 +1,59 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	htmlT "html/template"
+	"reflect"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestCallTemplateFunc(t *testing.T) {
+	var called service.TemplateFuncArgs
+	emit := func(ret ...service.TemplateFuncRet) templateFuncEmitter {
+		return func(args service.TemplateFuncArgs) (
+			[]service.TemplateFuncRet, error) {
+			called = args
+			return ret, nil
+		}
+	}
+	value, err := callTemplateFunc("exampleShout", []interface{}{"foo", 3},
+		emit(service.TemplateFuncRet{}, service.TemplateFuncRet{
+			Handled: true, Value: "FOO 3!"}))
+	if err != nil || value != "FOO 3!" {
+		t.Errorf(`callTemplateFunc() = %v, %v, should be "FOO 3!", nil`, value,
+			err)
+	}
+	expected := service.TemplateFuncArgs{Name: "exampleShout",
+		Args: []string{"foo", "3"}}
+	if !reflect.DeepEqual(called, expected) {
+		t.Errorf("Called template function with %v, should be %v", called,
+			expected)
+	}
+	value, err = callTemplateFunc("exampleShout", nil,
+		emit(service.TemplateFuncRet{Handled: true, Value: "<b>", HTML: true}))
+	if err != nil || value != htmlT.HTML("<b>") {
+		t.Errorf(`callTemplateFunc() = %#v, %v, should be HTML "<b>"`, value,
+			err)
+	}
+	if _, err := callTemplateFunc("exampleShout", nil,
+		emit(service.TemplateFuncRet{})); err == nil {
+		t.Errorf("callTemplateFunc should fail if no module handles the function")
+	}
+}
@@ -0,0 +1,122 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// templateDir is a directory of templates.
+type templateDir struct {
+	Path string
+	// Origin is the origin of the directory's templates, see
+	// service.ThemeTemplate.
+	Origin string
+}
+
+// findTemplates returns the templates found in the given directories,
+// sorted by name. A template's origin is the first of the directories
+// containing it. Missing directories are skipped.
+func findTemplates(dirs []templateDir) ([]service.ThemeTemplate, error) {
+	origins := make(map[string]string)
+	for _, dir := range dirs {
+		err := filepath.Walk(dir.Path, func(file string, info os.FileInfo,
+			err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && file == dir.Path {
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() || !strings.HasSuffix(file, ".html") {
+				return nil
+			}
+			name, err := filepath.Rel(dir.Path, file)
+			if err != nil {
+				return err
+			}
+			name = filepath.ToSlash(strings.TrimSuffix(name, ".html"))
+			if _, ok := origins[name]; !ok {
+				origins[name] = dir.Origin
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Could not search templates: %v", err)
+		}
+	}
+	names := make([]string, 0, len(origins))
+	for name := range origins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	templates := make([]service.ThemeTemplate, 0, len(names))
+	for _, name := range names {
+		templates = append(templates, service.ThemeTemplate{Name: name,
+			Origin: origins[name]})
+	}
+	return templates, nil
+}
+
+type GetThemeArgs struct {
+	Site string
+}
+
+func (i *MonstiService) GetTheme(args *GetThemeArgs,
+	reply *service.Theme) error {
+	monsti := i.Settings.Monsti
+	site, ok := monsti.Sites[args.Site]
+	if !ok {
+		return fmt.Errorf("Unknown site %q", args.Site)
+	}
+	dirs := []templateDir{{filepath.Join(monsti.GetSiteDataPath(args.Site),
+		"templates"), "site"}}
+	reply.Name, reply.Title = site.Theme, site.Theme
+	if site.Theme != "" {
+		themePath := monsti.GetThemePath(site.Theme)
+		if _, err := os.Stat(themePath); err != nil {
+			return fmt.Errorf("Could not find theme %q: %v", site.Theme, err)
+		}
+		path, err := util.FindConfigFile(filepath.Join(themePath, "theme"))
+		if err != nil {
+			return err
+		}
+		if path != "" {
+			var settings struct{ Title, Description string }
+			if err := util.ParseConfig(path, &settings); err != nil {
+				return fmt.Errorf("Could not load theme settings: %v", err)
+			}
+			if settings.Title != "" {
+				reply.Title = settings.Title
+			}
+			reply.Description = settings.Description
+		}
+		dirs = append(dirs, templateDir{filepath.Join(themePath, "templates"),
+			"theme"})
+	}
+	dirs = append(dirs, templateDir{monsti.GetTemplatesPath(), "core"})
+	var err error
+	reply.Templates, err = findTemplates(dirs)
+	return err
+}
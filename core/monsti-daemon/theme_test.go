@@ -0,0 +1,85 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestGetTheme(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-theme")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := MonstiService{Settings: new(settings),
+		Logger: log.New(ioutil.Discard, "", 0)}
+	m.Settings.Monsti.Directories.Data = filepath.Join(dir, "data")
+	m.Settings.Monsti.Directories.Share = filepath.Join(dir, "share")
+	m.Settings.Monsti.Sites = map[string]util.SiteSettings{
+		"plain": {}, "themed": {Theme: "blue"}, "broken": {Theme: "missing"}}
+	files := map[string]string{
+		"share/templates/master.html":                    "",
+		"share/templates/blocks/footer.html":             "",
+		"share/templates/blocks/footer.include":          "",
+		"share/themes/blue/theme.yaml":                   "title: Blue\ndescription: A blue theme.\n",
+		"share/themes/blue/templates/master.html":        "",
+		"share/themes/blue/templates/blocks/teaser.html": "",
+		"data/themed/templates/blocks/footer.html":       "",
+	}
+	for file, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, file)),
+			0700); err != nil {
+			t.Fatalf("Could not create directory: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(content),
+			0600); err != nil {
+			t.Fatalf("Could not write file: %v", err)
+		}
+	}
+	var theme service.Theme
+	if err := m.GetTheme(&GetThemeArgs{"themed"}, &theme); err != nil {
+		t.Fatalf("GetTheme returned error: %v", err)
+	}
+	expected := service.Theme{Name: "blue", Title: "Blue",
+		Description: "A blue theme.", Templates: []service.ThemeTemplate{
+			{"blocks/footer", "site"}, {"blocks/teaser", "theme"},
+			{"master", "theme"}}}
+	if !reflect.DeepEqual(theme, expected) {
+		t.Errorf("GetTheme(themed) = %v, should be %v", theme, expected)
+	}
+	theme = service.Theme{}
+	if err := m.GetTheme(&GetThemeArgs{"plain"}, &theme); err != nil {
+		t.Fatalf("GetTheme returned error: %v", err)
+	}
+	expected = service.Theme{Templates: []service.ThemeTemplate{
+		{"blocks/footer", "core"}, {"master", "core"}}}
+	if !reflect.DeepEqual(theme, expected) {
+		t.Errorf("GetTheme(plain) = %v, should be %v", theme, expected)
+	}
+	if err := m.GetTheme(&GetThemeArgs{"broken"}, new(service.Theme)); err == nil {
+		t.Errorf("GetTheme should fail for missing themes")
+	}
+}
@@ -0,0 +1,488 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/chrneumann/htmlwidgets"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+	mtemplate "pkg.monsti.org/monsti/api/util/template"
+)
+
+// getContentLocales returns the languages of the site's content,
+// starting with the site's locale, followed by the languages
+// configured by core.locales.
+func getContentLocales(c *reqContext) ([]string, error) {
+	return contentLocales(c.Serv, *c.Site)
+}
+
+// contentLocales is like getContentLocales for the given site.
+func contentLocales(s *service.Session, site util.SiteSettings) ([]string,
+	error) {
+	var locales []string
+	err := s.Monsti().GetSiteConfig(site.Name, "core.locales", &locales)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get content locales: %v", err)
+	}
+	ret := []string{site.Locale}
+	for _, locale := range locales {
+		if locale != site.Locale {
+			ret = append(ret, locale)
+		}
+	}
+	return ret, nil
+}
+
+// getPrefixLocales returns true iff all URLs of the site's content
+// should start with a locale, including the site's locale
+// (core.prefixlocales).
+func getPrefixLocales(s *service.Session, site string) (bool, error) {
+	var prefix bool
+	err := s.Monsti().GetSiteConfig(site, "core.prefixlocales", &prefix)
+	if err != nil {
+		return false, fmt.Errorf("Could not get locale prefix configuration: %v",
+			err)
+	}
+	return prefix, nil
+}
+
+// prefixedLocales returns the content locales which may prefix
+// request paths. The site's locale is only included if all locales
+// are prefixed.
+func prefixedLocales(locales []string, prefixAll bool) []string {
+	if prefixAll {
+		return locales
+	}
+	return locales[1:]
+}
+
+// splitLocale splits a leading locale off the given request path,
+// e.g. "/de/about" into "de" and "/about".
+//
+// Only the given locales are recognized. Returns an empty locale and
+// the unchanged path if the path does not start with a locale.
+func splitLocale(nodePath string, locales []string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(nodePath, "/"), "/", 2)
+	for _, locale := range locales {
+		if parts[0] == locale {
+			if len(parts) == 1 || parts[1] == "" {
+				return locale, "/"
+			}
+			return locale, "/" + parts[1]
+		}
+	}
+	return "", nodePath
+}
+
+// acceptedLanguage is a language of an Accept-Language header.
+type acceptedLanguage struct {
+	Tag     string
+	Quality float64
+}
+
+type acceptedLanguagesByQuality []acceptedLanguage
+
+func (s acceptedLanguagesByQuality) Len() int      { return len(s) }
+func (s acceptedLanguagesByQuality) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s acceptedLanguagesByQuality) Less(i, j int) bool {
+	return s[i].Quality > s[j].Quality
+}
+
+// acceptedLocale returns the first of the given locales accepted by
+// the Accept-Language header value, preferring languages with higher
+// quality. Regional variants fall back to their language, e.g.
+// "de-AT" matches "de".
+//
+// Returns an empty string if none of the locales is accepted.
+func acceptedLocale(header string, locales []string) string {
+	accepted := make([]acceptedLanguage, 0)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		language := acceptedLanguage{
+			Tag: strings.ToLower(strings.TrimSpace(fields[0])), Quality: 1}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				quality, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					language.Quality = quality
+				}
+			}
+		}
+		if language.Tag != "" && language.Quality > 0 {
+			accepted = append(accepted, language)
+		}
+	}
+	sort.Stable(acceptedLanguagesByQuality(accepted))
+	for _, language := range accepted {
+		base := strings.SplitN(language.Tag, "-", 2)[0]
+		for _, candidate := range []string{language.Tag, base} {
+			for _, locale := range locales {
+				if strings.ToLower(locale) == candidate {
+					return locale
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// nodeLocales returns the given content locales the node is
+// available in, i.e. the first locale and the locales of the node's
+// field translations.
+func nodeLocales(node *service.Node, locales []string) []string {
+	ret := []string{locales[0]}
+	for _, locale := range locales[1:] {
+		if len(node.FieldTranslations[locale]) > 0 {
+			ret = append(ret, locale)
+		}
+	}
+	return ret
+}
+
+// pickLocale returns the locale to show the node in.
+//
+// pathLocale is the locale given by the request path (e.g.
+// "/de/about"), if any. Otherwise, nodes with their own locale are
+// shown in that locale. All other nodes are shown in the first
+// locale accepted by the Accept-Language header the node is
+// available in, falling back to the first of the content locales.
+func pickLocale(node *service.Node, pathLocale, acceptLanguage string,
+	locales []string) string {
+	if pathLocale != "" {
+		return pathLocale
+	}
+	if node.Locale != "" {
+		return node.Locale
+	}
+	if locale := acceptedLocale(acceptLanguage,
+		nodeLocales(node, locales)); locale != "" {
+		return locale
+	}
+	return locales[0]
+}
+
+// localizedPath returns the path of the node prefixed by the given
+// locale, if any.
+func localizedPath(locale, nodePath string) string {
+	if locale == "" {
+		return nodePath
+	}
+	return "/" + locale + nodePath
+}
+
+// localizedNodePath returns the path of the node in the given locale,
+// i.e. with the localized names of the node and its ancestors, e.g.
+// "/ueber-uns/team" for "/about/team" in "de". If prefix is true, the
+// path starts with the locale.
+func localizedNodePath(locale string, prefix bool, nodePath string,
+	getNodeFn getNodeFunc) (string, error) {
+	ret := "/"
+	current := "/"
+	for _, name := range strings.Split(strings.Trim(nodePath, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		current = path.Join(current, name)
+		node, err := getNodeFn(current)
+		if err != nil {
+			return "", fmt.Errorf("Could not get node %q: %v", current, err)
+		}
+		if node != nil && node.LocalizedNames[locale] != "" {
+			name = node.LocalizedNames[locale]
+		}
+		ret = path.Join(ret, name)
+	}
+	if prefix {
+		return localizedPath(locale, ret), nil
+	}
+	return ret, nil
+}
+
+// resolveLocalizedPath returns the path of the node with the given
+// localized path in the given locale, e.g. "/about/team" for
+// "/ueber-uns/team" in "de". Names without localization match too.
+//
+// Returns an empty string if there is no such node.
+func resolveLocalizedPath(locale, localized string,
+	getChildrenFn getChildrenFunc) (string, error) {
+	current := "/"
+	for _, name := range strings.Split(strings.Trim(localized, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		children, err := getChildrenFn(current)
+		if err != nil {
+			return "", fmt.Errorf("Could not get children of %q: %v", current, err)
+		}
+		next := ""
+		for _, child := range children {
+			if child.LocalizedNames[locale] == name {
+				next = child.Path
+				break
+			}
+			if child.Name() == name && next == "" {
+				next = child.Path
+			}
+		}
+		if next == "" {
+			return "", nil
+		}
+		current = next
+	}
+	return current, nil
+}
+
+// fieldAlternates returns the language variants of the node given by
+// its field translations, including the node itself. If prefixAll is
+// true, the variant in the site's locale is prefixed too and an
+// x-default variant links the unprefixed path, which redirects
+// visitors depending on their language.
+//
+// Returns nil if the node has not been translated.
+func fieldAlternates(node *service.Node, locales []string, prefixAll bool,
+	baseURL string, getNodeFn getNodeFunc) ([]alternate, error) {
+	available := nodeLocales(node, locales)
+	if len(available) < 2 {
+		return nil, nil
+	}
+	ret := make([]alternate, 0, len(available)+1)
+	for i, locale := range available {
+		nodePath, err := localizedNodePath(locale, i > 0 || prefixAll, node.Path,
+			getNodeFn)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, alternate{locale, nodePath,
+			baseURL + dirPath(nodePath)})
+	}
+	sort.Sort(alternatesByLocale(ret))
+	if prefixAll {
+		ret = append(ret, alternate{"x-default", node.Path,
+			baseURL + dirPath(node.Path)})
+	}
+	return ret, nil
+}
+
+// localeRedirect returns the localized path visitors of the given
+// unprefixed request should be redirected to if all content paths are
+// prefixed, or an empty string if there's no need to redirect.
+func localeRedirect(c *reqContext, locales []string, prefixAll bool,
+	getNodeFn getNodeFunc) (string, error) {
+	if !prefixAll || c.PathLocale != "" || len(locales) < 2 ||
+		c.Action != service.ViewAction || c.Req.Method != "GET" ||
+		c.Node.Locale != "" || c.Node.Type == nil ||
+		c.Node.Type.Id == "core.File" || c.Node.Type.Id == "core.Image" {
+		return "", nil
+	}
+	target, err := localizedNodePath(c.Locale, true, c.Node.Path, getNodeFn)
+	if err != nil {
+		return "", err
+	}
+	target = dirPath(target)
+	if c.Req.URL.RawQuery != "" {
+		target += "?" + c.Req.URL.RawQuery
+	}
+	return target, nil
+}
+
+// setLocalizedName sets the name of the node in URLs of the given
+// locale. An empty name removes the localized name.
+func setLocalizedName(node *service.Node, locale, name string) {
+	if name == "" {
+		delete(node.LocalizedNames, locale)
+		return
+	}
+	if node.LocalizedNames == nil {
+		node.LocalizedNames = make(map[string]string)
+	}
+	node.LocalizedNames[locale] = name
+}
+
+// translateNode returns a copy of the node with the field values
+// translated into the given locale.
+//
+// Fields without translation keep their value.
+func translateNode(node *service.Node, locale string) (*service.Node, error) {
+	values := node.FieldTranslations[locale]
+	if len(values) == 0 {
+		return node, nil
+	}
+	return withFieldValues(node, values)
+}
+
+// translatableFields returns the fields of the node which may be
+// translated.
+func translatableFields(node *service.Node) []*service.NodeField {
+	ret := make([]*service.NodeField, 0)
+	for _, field := range node.AllFields() {
+		if field.Translatable && field.Compute == "" && field.Type != "File" &&
+			field.Type != "Video" && field.Type != "Audio" {
+			ret = append(ret, field)
+		}
+	}
+	return ret
+}
+
+// setFieldTranslations stores the values of the given fields of the
+// translated node as the node's translation into the given locale.
+func setFieldTranslations(node, translated *service.Node, locale string,
+	fields []*service.NodeField) error {
+	if node.FieldTranslations == nil {
+		node.FieldTranslations = make(map[string]map[string]*json.RawMessage)
+	}
+	values := make(map[string]*json.RawMessage, len(fields))
+	for _, field := range fields {
+		dump, err := json.Marshal(translated.GetField(field.Id).Dump())
+		if err != nil {
+			return fmt.Errorf("Could not marshal field %q: %v", field.Id, err)
+		}
+		value := json.RawMessage(dump)
+		values[field.Id] = &value
+	}
+	node.FieldTranslations[locale] = values
+	return nil
+}
+
+type translationFormData struct {
+	// Name is the name of the node in URLs of the locale.
+	Name string
+	// Complete is true if the translation is finished.
+	Complete bool
+	Fields   util.NestedMap
+}
+
+// editTranslation shows and handles the form to translate the
+// request's node into the given locale.
+func (h *nodeHandler) editTranslation(c *reqContext, locale string,
+	locales []string) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	// Use fresh fields for all translatable fields to not change the
+	// values of the untranslated node.
+	fields := translatableFields(c.Node)
+	values := make(map[string]*json.RawMessage, len(fields))
+	for _, field := range fields {
+		value := c.Node.FieldTranslations[locale][field.Id]
+		if value == nil {
+			dump, err := json.Marshal(c.Node.GetField(field.Id).Dump())
+			if err != nil {
+				return fmt.Errorf("Could not marshal field %q: %v", field.Id, err)
+			}
+			raw := json.RawMessage(dump)
+			value = &raw
+		}
+		values[field.Id] = value
+	}
+	translated, err := withFieldValues(c.Node, values)
+	if err != nil {
+		return fmt.Errorf("Could not translate node: %v", err)
+	}
+	formData := translationFormData{Fields: make(util.NestedMap),
+		Name: c.Node.LocalizedNames[locale],
+		Complete: translationStatus(c.Node, locale) !=
+			service.TranslationDraft}
+	form := htmlwidgets.NewForm(&formData)
+	form.Action = "@@edit?locale=" + locale
+	if c.Node.Name() != "" {
+		form.AddWidget(&htmlwidgets.TextWidget{
+			Regexp:          `^[-\w]*$`,
+			ValidationError: G("Please enter a name consisting only of the characters A-Z, a-z, 0-9 and '-'")},
+			"Name", G("Name"),
+			G("The name as it should appear in URLs of this language. Defaults to the untranslated name."))
+	}
+	for _, field := range fields {
+		translated.GetField(field.Id).ToFormField(form, formData.Fields, field,
+			c.UserSession.Locale)
+	}
+	form.AddWidget(new(htmlwidgets.BoolWidget), "Complete",
+		G("Translation complete"),
+		G("Uncheck to mark the translation as draft in the translations overview."))
+	switch c.Req.Method {
+	case "GET":
+	case "POST":
+		if form.Fill(c.Req.Form) {
+			node := *c.Node
+			for _, field := range fields {
+				translated.GetField(field.Id).FromFormField(formData.Fields, field)
+			}
+			allowlist, err := getHTMLAllowlist(c.Serv, c.Site.Name)
+			if err != nil {
+				return err
+			}
+			sanitizeHTMLFields(translated, allowlist)
+			if err := setFieldTranslations(&node, translated, locale,
+				fields); err != nil {
+				return err
+			}
+			setLocalizedName(&node, locale, formData.Name)
+			status := service.TranslationDraft
+			if formData.Complete {
+				status = service.TranslationComplete
+			}
+			setTranslationStatus(&node, locale, status)
+			err = c.Serv.Monsti().WriteNode(c.Site.Name, node.Path, &node)
+			if err != nil {
+				return fmt.Errorf("Could not update node: %v", err)
+			}
+			if err := recordNodeEvents(c, node.Path, &service.NodeEvent{
+				Type:        service.NodeChangedEvent,
+				Description: fmt.Sprintf("Translation (%v)", locale)}); err != nil {
+				return err
+			}
+			target, err := localizedNodePath(locale, true, node.Path,
+				func(nodePath string) (*service.Node, error) {
+					if nodePath == node.Path {
+						return &node, nil
+					}
+					return c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
+				})
+			if err != nil {
+				return err
+			}
+			http.Redirect(c.Res, c.Req, dirPath(target), http.StatusSeeOther)
+			return nil
+		}
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	rendered, err := h.Renderer.Render("edit",
+		mtemplate.Context{
+			"Form":    form.RenderData(),
+			"Locale":  locale,
+			"Locales": locales}, c.UserSession.Locale,
+		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Could not render template: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   fmt.Sprintf(G("Translate \"%s\" (%v)"), c.Node.Path, locale),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(rendered), env,
+		h.Settings, *c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
@@ -0,0 +1,259 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"reflect"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestSplitLocale(t *testing.T) {
+	locales := []string{"de", "fr"}
+	tests := []struct {
+		Path, Locale, NodePath string
+	}{
+		{"/", "", "/"},
+		{"/about", "", "/about"},
+		{"/de", "de", "/"},
+		{"/de/", "de", "/"},
+		{"/de/about", "de", "/about"},
+		{"/fr/about/team", "fr", "/about/team"},
+		{"/dex/about", "", "/dex/about"},
+		{"/en/about", "", "/en/about"},
+	}
+	for _, test := range tests {
+		locale, nodePath := splitLocale(test.Path, locales)
+		if locale != test.Locale || nodePath != test.NodePath {
+			t.Errorf("splitLocale(%q, _) = %q, %q, should be %q, %q", test.Path,
+				locale, nodePath, test.Locale, test.NodePath)
+		}
+	}
+}
+
+func TestAcceptedLocale(t *testing.T) {
+	locales := []string{"en", "de", "pt-BR"}
+	tests := []struct {
+		Header, Locale string
+	}{
+		{"", ""},
+		{"fr", ""},
+		{"de", "de"},
+		{"de-AT,fr;q=0.8", "de"},
+		{"fr,en;q=0.5,de;q=0.8", "de"},
+		{"de;q=0,en", "en"},
+		{"pt-br", "pt-BR"},
+		{"es;q=0.9, EN-us;q=0.7", "en"},
+	}
+	for _, test := range tests {
+		if locale := acceptedLocale(test.Header, locales); locale != test.Locale {
+			t.Errorf("acceptedLocale(%q, _) = %q, should be %q", test.Header,
+				locale, test.Locale)
+		}
+	}
+}
+
+func TestPickLocale(t *testing.T) {
+	locales := []string{"en", "de", "fr"}
+	title := json.RawMessage(`"Über uns"`)
+	node := &service.Node{FieldTranslations: map[string]map[string]*json.RawMessage{
+		"de": {"core.Title": &title}}}
+	tests := []struct {
+		Node                       *service.Node
+		PathLocale, Header, Locale string
+	}{
+		{node, "", "", "en"},
+		{node, "fr", "de", "fr"},
+		{node, "", "de-CH,en;q=0.5", "de"},
+		// Prefer languages the node is available in.
+		{node, "", "fr,de;q=0.5", "de"},
+		{node, "", "fr", "en"},
+		{&service.Node{}, "", "de", "en"},
+		{&service.Node{Locale: "fr"}, "", "de", "fr"},
+	}
+	for i, test := range tests {
+		locale := pickLocale(test.Node, test.PathLocale, test.Header, locales)
+		if locale != test.Locale {
+			t.Errorf("%v: pickLocale(_, %q, %q, _) = %q, should be %q", i,
+				test.PathLocale, test.Header, locale, test.Locale)
+		}
+	}
+}
+
+func TestTranslateNode(t *testing.T) {
+	fields := []*service.NodeField{
+		{Id: "core.Title", Type: "Text", Translatable: true},
+		{Id: "core.Body", Type: "HTMLArea", Translatable: true},
+		{Id: "core.Order", Type: "Text"},
+	}
+	node := service.Node{Type: &service.NodeType{Fields: fields}}
+	if err := node.InitFields(nil, ""); err != nil {
+		t.Fatalf("Could not init fields: %v", err)
+	}
+	*(node.GetField("core.Title").(*service.TextField)) = "About"
+	*(node.GetField("core.Body").(*service.HTMLField)) = "<p>Hello</p>"
+	title := json.RawMessage(`"Über uns"`)
+	node.FieldTranslations = map[string]map[string]*json.RawMessage{
+		"de": {"core.Title": &title}}
+	ret, err := translateNode(&node, "de")
+	if err != nil {
+		t.Fatalf("translateNode(_, \"de\") returned error: %v", err)
+	}
+	if title := ret.GetField("core.Title").String(); title != "Über uns" {
+		t.Errorf(`Translated title is %q, should be "Über uns"`, title)
+	}
+	if body := ret.GetField("core.Body").String(); body != "<p>Hello</p>" {
+		t.Errorf(`Untranslated body is %q, should fall back to "<p>Hello</p>"`,
+			body)
+	}
+	if title := node.GetField("core.Title").String(); title != "About" {
+		t.Errorf(`Title of original node is %q, should be "About"`, title)
+	}
+	if ret, _ := translateNode(&node, "fr"); ret != &node {
+		t.Errorf("translateNode should return the node itself without translation")
+	}
+
+	translatable := translatableFields(&node)
+	if len(translatable) != 2 || translatable[0].Id != "core.Title" ||
+		translatable[1].Id != "core.Body" {
+		t.Errorf("translatableFields(_) = %v, should be core.Title, core.Body",
+			translatable)
+	}
+	*(ret.GetField("core.Title").(*service.TextField)) = "Über Uns"
+	if err := setFieldTranslations(&node, ret, "de", translatable); err != nil {
+		t.Fatalf("setFieldTranslations returned error: %v", err)
+	}
+	var stored string
+	if value := node.FieldTranslations["de"]["core.Title"]; value == nil ||
+		json.Unmarshal(*value, &stored) != nil || stored != "Über Uns" {
+		t.Errorf(`setFieldTranslations stored title %q, should be "Über Uns"`,
+			stored)
+	}
+	if node.FieldTranslations["de"]["core.Body"] == nil {
+		t.Errorf("setFieldTranslations should store all given fields")
+	}
+}
+
+func localizedTestNodes() (getNodeFunc, getChildrenFunc) {
+	title := json.RawMessage(`"Über uns"`)
+	nodes := map[string]*service.Node{
+		"/": {Path: "/"},
+		"/about": {Path: "/about",
+			LocalizedNames: map[string]string{"de": "ueber-uns"},
+			FieldTranslations: map[string]map[string]*json.RawMessage{
+				"de": {"core.Title": &title}}},
+		"/about/team": {Path: "/about/team"},
+		"/news":       {Path: "/news"},
+	}
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		return nodes[nodePath], nil
+	}
+	getChildrenFn := func(nodePath string) ([]*service.Node, error) {
+		children := make([]*service.Node, 0)
+		for _, child := range []string{"/about", "/about/team", "/news"} {
+			if path.Dir(child) == nodePath {
+				children = append(children, nodes[child])
+			}
+		}
+		return children, nil
+	}
+	return getNodeFn, getChildrenFn
+}
+
+func TestLocalizedNodePath(t *testing.T) {
+	getNodeFn, getChildrenFn := localizedTestNodes()
+	tests := []struct {
+		Locale    string
+		Prefix    bool
+		Path      string
+		Localized string
+	}{
+		{"de", true, "/", "/de/"},
+		{"de", true, "/about/team", "/de/ueber-uns/team"},
+		{"de", false, "/about", "/ueber-uns"},
+		{"en", true, "/about", "/en/about"},
+		{"en", false, "/about/team", "/about/team"},
+	}
+	for _, test := range tests {
+		localized, err := localizedNodePath(test.Locale, test.Prefix, test.Path,
+			getNodeFn)
+		if err != nil {
+			t.Fatalf("localizedNodePath returned error: %v", err)
+		}
+		if localized != test.Localized {
+			t.Errorf("localizedNodePath(%q, %v, %q, _) = %q, should be %q",
+				test.Locale, test.Prefix, test.Path, localized, test.Localized)
+		}
+		if test.Prefix {
+			_, stripped := splitLocale(localized, []string{test.Locale})
+			resolved, err := resolveLocalizedPath(test.Locale, stripped,
+				getChildrenFn)
+			if err != nil {
+				t.Fatalf("resolveLocalizedPath returned error: %v", err)
+			}
+			if resolved != test.Path {
+				t.Errorf("resolveLocalizedPath(%q, %q, _) = %q, should be %q",
+					test.Locale, stripped, resolved, test.Path)
+			}
+		}
+	}
+	for _, localized := range []string{"/ueber-uns/foo", "/missing"} {
+		if resolved, _ := resolveLocalizedPath("de", localized,
+			getChildrenFn); resolved != "" {
+			t.Errorf("resolveLocalizedPath(\"de\", %q, _) = %q, should be empty",
+				localized, resolved)
+		}
+	}
+}
+
+func TestFieldAlternates(t *testing.T) {
+	getNodeFn, _ := localizedTestNodes()
+	about, _ := getNodeFn("/about")
+	locales := []string{"en", "de", "fr"}
+	tests := []struct {
+		PrefixAll  bool
+		Alternates []alternate
+	}{
+		{false, []alternate{
+			{"de", "/de/ueber-uns", "http://example.com/de/ueber-uns/"},
+			{"en", "/about", "http://example.com/about/"}}},
+		{true, []alternate{
+			{"de", "/de/ueber-uns", "http://example.com/de/ueber-uns/"},
+			{"en", "/en/about", "http://example.com/en/about/"},
+			{"x-default", "/about", "http://example.com/about/"}}},
+	}
+	for _, test := range tests {
+		alternates, err := fieldAlternates(about, locales, test.PrefixAll,
+			"http://example.com", getNodeFn)
+		if err != nil {
+			t.Fatalf("fieldAlternates returned error: %v", err)
+		}
+		if !reflect.DeepEqual(alternates, test.Alternates) {
+			t.Errorf("fieldAlternates(_, _, %v, ...) = %v, should be %v",
+				test.PrefixAll, alternates, test.Alternates)
+		}
+	}
+	news, _ := getNodeFn("/news")
+	if alternates, _ := fieldAlternates(news, locales, true,
+		"http://example.com", getNodeFn); alternates != nil {
+		t.Errorf("fieldAlternates of untranslated node = %v, should be nil",
+			alternates)
+	}
+}
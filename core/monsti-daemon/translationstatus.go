@@ -0,0 +1,219 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// translationMissing is the status of nodes without translation into
+// a locale.
+const translationMissing = "missing"
+
+// translationStatus returns the status of the node's translation into
+// the given locale: translationMissing, service.TranslationDraft or
+// service.TranslationComplete.
+func translationStatus(node *service.Node, locale string) string {
+	if len(node.FieldTranslations[locale]) == 0 {
+		return translationMissing
+	}
+	if node.TranslationStatus[locale] == service.TranslationDraft {
+		return service.TranslationDraft
+	}
+	return service.TranslationComplete
+}
+
+// setTranslationStatus sets the status of the node's translation into
+// the given locale.
+func setTranslationStatus(node *service.Node, locale, status string) {
+	if node.TranslationStatus == nil {
+		node.TranslationStatus = make(map[string]string)
+	}
+	node.TranslationStatus[locale] = status
+}
+
+// translationEntry is a translatable node of the translation report.
+type translationEntry struct {
+	Path, Title string
+	// Status holds the status of each translation locale, in the order
+	// of the report's locales.
+	Status []string
+}
+
+// translationCoverage counts the nodes per status of a locale.
+type translationCoverage struct {
+	Locale                   string
+	Missing, Draft, Complete int
+	// Percent is the share of completely translated nodes.
+	Percent int
+}
+
+// translationReport lists the translation status of the site's
+// translatable nodes.
+type translationReport struct {
+	// Locales are the locales nodes get translated into.
+	Locales  []string
+	Coverage []translationCoverage
+	Nodes    []translationEntry
+}
+
+// getTranslationReport returns the status of the translations into the
+// given locales of all nodes below root having translatable fields.
+//
+// If incomplete is true, only nodes missing a complete translation are
+// listed. The coverage always counts all nodes.
+func getTranslationReport(root string, locales []string, incomplete bool,
+	getNodeFn getNodeFunc, getChildrenFn getChildrenFunc) (
+	*translationReport, error) {
+	report := &translationReport{Locales: locales,
+		Coverage: make([]translationCoverage, len(locales)),
+		Nodes:    make([]translationEntry, 0)}
+	for i, locale := range locales {
+		report.Coverage[i].Locale = locale
+	}
+	err := walkNodes(root, getNodeFn, getChildrenFn,
+		func(node *service.Node) error {
+			if node.Type == nil || len(translatableFields(node)) == 0 {
+				return nil
+			}
+			entry := translationEntry{Path: node.Path, Title: getNodeTitle(node),
+				Status: make([]string, len(locales))}
+			complete := true
+			for i, locale := range locales {
+				status := translationStatus(node, locale)
+				entry.Status[i] = status
+				coverage := &report.Coverage[i]
+				switch status {
+				case translationMissing:
+					coverage.Missing++
+				case service.TranslationDraft:
+					coverage.Draft++
+				default:
+					coverage.Complete++
+				}
+				complete = complete && status == service.TranslationComplete
+			}
+			if !incomplete || !complete {
+				report.Nodes = append(report.Nodes, entry)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	for i := range report.Coverage {
+		coverage := &report.Coverage[i]
+		if total := coverage.Missing + coverage.Draft +
+			coverage.Complete; total > 0 {
+			coverage.Percent = 100 * coverage.Complete / total
+		}
+	}
+	return report, nil
+}
+
+// copyTranslationSource stores the untranslated values of the node's
+// translatable fields as draft translation into the given locale.
+func copyTranslationSource(node *service.Node, locale string) error {
+	if err := setFieldTranslations(node, node, locale,
+		translatableFields(node)); err != nil {
+		return err
+	}
+	setTranslationStatus(node, locale, service.TranslationDraft)
+	return nil
+}
+
+// Translations shows the translation status of the site's nodes and
+// copies the untranslated content of nodes as starting point for new
+// translations.
+func (h *nodeHandler) Translations(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	locales, err := getContentLocales(c)
+	if err != nil {
+		return err
+	}
+	switch c.Req.Method {
+	case "GET":
+	case "POST":
+		if err := c.Req.ParseForm(); err != nil {
+			return err
+		}
+		locale := c.Req.Form.Get("locale")
+		valid := false
+		for _, contentLocale := range locales[1:] {
+			valid = valid || locale == contentLocale
+		}
+		node, err := c.Serv.Monsti().GetNode(c.Site.Name,
+			c.Req.Form.Get("node"))
+		if err != nil {
+			return fmt.Errorf("Could not get node: %v", err)
+		}
+		if !valid || node == nil || node.Type == nil {
+			http.Error(c.Res, "Invalid node or locale.", http.StatusBadRequest)
+			return nil
+		}
+		if translationStatus(node, locale) == translationMissing {
+			if err := copyTranslationSource(node, locale); err != nil {
+				return err
+			}
+			err := c.Serv.Monsti().WriteNode(c.Site.Name, node.Path, node)
+			if err != nil {
+				return fmt.Errorf("Could not update node: %v", err)
+			}
+			if err := recordNodeEvents(c, node.Path, &service.NodeEvent{
+				Type:        service.NodeChangedEvent,
+				Description: fmt.Sprintf("Translation (%v)", locale)}); err != nil {
+				return err
+			}
+		}
+		http.Redirect(c.Res, c.Req, dirPath(node.Path)+"@@edit?locale="+locale,
+			http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		return c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
+	}
+	getChildrenFn := func(nodePath string) ([]*service.Node, error) {
+		return c.Serv.Monsti().GetChildren(c.Site.Name, nodePath)
+	}
+	incomplete := c.Req.FormValue("incomplete") != ""
+	report, err := getTranslationReport("/", locales[1:], incomplete,
+		getNodeFn, getChildrenFn)
+	if err != nil {
+		return fmt.Errorf("Could not get translation report: %v", err)
+	}
+	body, err := h.Renderer.Render("actions/translations",
+		template.Context{"Report": report, "Incomplete": incomplete},
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render translation report: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("Translations"),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
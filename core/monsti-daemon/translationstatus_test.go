@@ -0,0 +1,110 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"reflect"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestGetTranslationReport(t *testing.T) {
+	docType := &service.NodeType{Id: "core.Document",
+		Fields: []*service.NodeField{
+			{Id: "core.Title", Type: "Text", Translatable: true}}}
+	pathType := &service.NodeType{Id: "core.Path"}
+	value := json.RawMessage(`"Titel"`)
+	translated := map[string]*json.RawMessage{"core.Title": &value}
+	nodes := map[string]*service.Node{
+		"/": {Path: "/", Type: docType,
+			FieldTranslations: map[string]map[string]*json.RawMessage{
+				"de": translated, "fr": translated}},
+		"/about": {Path: "/about", Type: docType,
+			FieldTranslations: map[string]map[string]*json.RawMessage{
+				"de": translated},
+			TranslationStatus: map[string]string{"de": service.TranslationDraft}},
+		"/files": {Path: "/files", Type: pathType},
+	}
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		return nodes[nodePath], nil
+	}
+	getChildrenFn := func(nodePath string) ([]*service.Node, error) {
+		children := make([]*service.Node, 0)
+		for _, child := range []string{"/about", "/files"} {
+			if path.Dir(child) == nodePath {
+				children = append(children, nodes[child])
+			}
+		}
+		return children, nil
+	}
+	report, err := getTranslationReport("/", []string{"de", "fr"}, false,
+		getNodeFn, getChildrenFn)
+	if err != nil {
+		t.Fatalf("getTranslationReport returned error: %v", err)
+	}
+	expected := &translationReport{
+		Locales: []string{"de", "fr"},
+		Coverage: []translationCoverage{
+			{Locale: "de", Draft: 1, Complete: 1, Percent: 50},
+			{Locale: "fr", Missing: 1, Complete: 1, Percent: 50}},
+		Nodes: []translationEntry{
+			{"/", "Untitled", []string{"complete", "complete"}},
+			{"/about", "Untitled", []string{"draft", "missing"}}}}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("getTranslationReport(...) = %v, should be %v", report, expected)
+	}
+	report, err = getTranslationReport("/", []string{"de", "fr"}, true,
+		getNodeFn, getChildrenFn)
+	if err != nil {
+		t.Fatalf("getTranslationReport returned error: %v", err)
+	}
+	if len(report.Nodes) != 1 || report.Nodes[0].Path != "/about" {
+		t.Errorf("getTranslationReport(_, _, true, ...) lists %v, "+
+			"should only list /about", report.Nodes)
+	}
+}
+
+func TestCopyTranslationSource(t *testing.T) {
+	node := service.Node{Type: &service.NodeType{Fields: []*service.NodeField{
+		{Id: "core.Title", Type: "Text", Translatable: true}}}}
+	if err := node.InitFields(nil, ""); err != nil {
+		t.Fatalf("Could not init fields: %v", err)
+	}
+	*(node.GetField("core.Title").(*service.TextField)) = "About"
+	if status := translationStatus(&node, "de"); status != translationMissing {
+		t.Errorf("translationStatus(_, \"de\") = %q, should be %q", status,
+			translationMissing)
+	}
+	if err := copyTranslationSource(&node, "de"); err != nil {
+		t.Fatalf("copyTranslationSource returned error: %v", err)
+	}
+	if status := translationStatus(&node, "de"); status !=
+		service.TranslationDraft {
+		t.Errorf("translationStatus(_, \"de\") = %q, should be %q", status,
+			service.TranslationDraft)
+	}
+	ret, err := translateNode(&node, "de")
+	if err != nil {
+		t.Fatalf("translateNode returned error: %v", err)
+	}
+	if title := ret.GetField("core.Title").String(); title != "About" {
+		t.Errorf("Copied title is %q, should be \"About\"", title)
+	}
+}
@@ -0,0 +1,276 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// treeEntry is a node as shown by the site tree.
+type treeEntry struct {
+	browseNode
+	Name string
+	// TypeId is the id of the node's type, e.g. "core.Image".
+	TypeId       string
+	Public, Hide bool
+}
+
+// treeResult is the response to a change made in the site tree.
+type treeResult struct {
+	// Path is the path of the changed node.
+	Path  string `json:",omitempty"`
+	Error string `json:",omitempty"`
+	// Conflict is true if a pasted node's name is already taken.
+	Conflict bool `json:",omitempty"`
+}
+
+// nodeNameRegexp matches valid node names.
+var nodeNameRegexp = regexp.MustCompile(`^[-\w]+$`)
+
+// getTreeEntries returns the site tree entries of the children of the
+// given node in listing order.
+func getTreeEntries(c *reqContext, nodePath string) ([]treeEntry, error) {
+	children, err := c.Serv.Monsti().GetChildren(c.Site.Name, nodePath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get children: %v", err)
+	}
+	entries := make([]treeEntry, 0, len(children))
+	for _, child := range children {
+		entries = append(entries, treeEntry{
+			newBrowseNode(child, c.UserSession.Locale), child.Name(),
+			child.Type.Id, child.Public, child.Hide})
+	}
+	return entries, nil
+}
+
+// freeNodeName returns the given name if there is no node of that
+// name below the parent, else the name with the lowest free suffix
+// "-2", "-3" and so on.
+func freeNodeName(exists func(nodePath string) (bool, error), parent,
+	name string) (string, error) {
+	for i := 1; ; i++ {
+		free := name
+		if i > 1 {
+			free = fmt.Sprintf("%v-%v", name, i)
+		}
+		taken, err := exists(path.Join(parent, free))
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return free, nil
+		}
+	}
+}
+
+// pasteNode moves (mode "cut") or copies (mode "copy") the node below
+// the given parent. If the node's name is already taken below the
+// parent, the node is pasted with a free name if rename is true.
+func pasteNode(c *reqContext, G func(string) string, nodePath, parent,
+	mode string, rename bool) (*treeResult, error) {
+	if nodePath == "/" || parent == nodePath ||
+		strings.HasPrefix(parent, nodePath+"/") {
+		return &treeResult{Error: G("A node can't be pasted into itself.")}, nil
+	}
+	name := path.Base(nodePath)
+	if mode == "cut" && path.Dir(nodePath) == parent {
+		return &treeResult{Path: nodePath}, nil
+	}
+	exists := func(nodePath string) (bool, error) {
+		node, err := c.Serv.Monsti().GetNode(c.Site.Name, nodePath)
+		if err != nil {
+			return false, fmt.Errorf("Could not fetch possibly existing node: %v",
+				err)
+		}
+		return node != nil, nil
+	}
+	taken, err := exists(path.Join(parent, name))
+	if err != nil {
+		return nil, err
+	}
+	if taken {
+		if !rename {
+			return &treeResult{Conflict: true, Error: fmt.Sprintf(
+				G("A node named %q does already exist below %v."), name, parent)}, nil
+		}
+		if name, err = freeNodeName(exists, parent, name); err != nil {
+			return nil, err
+		}
+	}
+	target := path.Join(parent, name)
+	event := &service.NodeEvent{Type: service.NodeCreatedEvent}
+	switch mode {
+	case "cut":
+		err = c.Serv.Monsti().RenameNode(c.Site.Name, nodePath, target)
+		event = &service.NodeEvent{Type: service.NodeRenamedEvent,
+			From: nodePath, To: target}
+	case "copy":
+		err = c.Serv.Monsti().CopyNode(c.Site.Name, nodePath, target)
+	default:
+		return nil, fmt.Errorf("Unknown paste mode %q", mode)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not paste node: %v", err)
+	}
+	if err := recordNodeEvents(c, target, event); err != nil {
+		return nil, err
+	}
+	return &treeResult{Path: target}, nil
+}
+
+// changeTree applies the change requested by the site tree: moving a
+// node below the node "Target" (form value "Op" is "move"), ordering
+// the children "Child" of a node ("order"), renaming a node to "Name"
+// ("rename") or pasting a node cut or copied ("Mode") below "Target"
+// ("paste"). The changed node is given by "Node".
+//
+// Changes refused for the user are returned as result errors.
+func changeTree(c *reqContext, G func(string) string) (*treeResult, error) {
+	nodePath := path.Clean("/" + c.Req.Form.Get("Node"))
+	switch c.Req.Form.Get("Op") {
+	case "move":
+		results, err := c.Serv.Monsti().BulkNodeOp(c.Site.Name,
+			service.BulkMove, []string{nodePath}, c.Req.Form.Get("Target"))
+		if err != nil {
+			return nil, fmt.Errorf("Could not move node: %v", err)
+		}
+		failed, err := recordBulkResults(c, service.BulkMove, results)
+		if err != nil {
+			return nil, err
+		}
+		if len(failed) > 0 {
+			return &treeResult{Error: failed[0].Error}, nil
+		}
+		return &treeResult{Path: results[0].NewPath}, nil
+	case "order":
+		children, err := c.Serv.Monsti().GetChildren(c.Site.Name, nodePath)
+		if err != nil {
+			return nil, fmt.Errorf("Could not get children: %v", err)
+		}
+		changed, err := reorderChildren(children, c.Req.Form["Child"])
+		if err != nil {
+			return &treeResult{Error: err.Error()}, nil
+		}
+		if err := writeChildOrder(c, changed); err != nil {
+			return nil, err
+		}
+		return &treeResult{Path: nodePath}, nil
+	case "rename":
+		name := c.Req.Form.Get("Name")
+		if nodePath == "/" || !nodeNameRegexp.MatchString(name) {
+			return &treeResult{Error: G("Please enter a name consisting only of the characters A-Z, a-z, 0-9 and '-'")}, nil
+		}
+		target := path.Join(path.Dir(nodePath), name)
+		if target == nodePath {
+			return &treeResult{Path: target}, nil
+		}
+		existing, err := c.Serv.Monsti().GetNode(c.Site.Name, target)
+		if err != nil {
+			return nil, fmt.Errorf("Could not fetch possibly existing node: %v", err)
+		}
+		if existing != nil {
+			return &treeResult{Error: G("A node with this name does already exist")}, nil
+		}
+		if err := c.Serv.Monsti().RenameNode(c.Site.Name, nodePath,
+			target); err != nil {
+			return nil, fmt.Errorf("Could not rename node: %v", err)
+		}
+		if err := recordNodeEvents(c, target, &service.NodeEvent{
+			Type: service.NodeRenamedEvent, From: nodePath,
+			To: target}); err != nil {
+			return nil, err
+		}
+		return &treeResult{Path: target}, nil
+	case "paste":
+		return pasteNode(c, G, nodePath,
+			path.Clean("/"+c.Req.Form.Get("Target")), c.Req.Form.Get("Mode"),
+			c.Req.Form.Get("Conflict") == "rename")
+	}
+	return nil, fmt.Errorf("Unknown tree operation %q", c.Req.Form.Get("Op"))
+}
+
+// Tree shows the site's nodes as a collapsible tree to move, order
+// and rename them.
+//
+// If the form value "format" is "json", the children of the node given
+// by the form value "node" are returned as JSON. Changes are posted by
+// the tree, see changeTree.
+func (h *nodeHandler) Tree(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if err := c.Req.ParseForm(); err != nil {
+		return err
+	}
+	var response interface{}
+	status := http.StatusOK
+	switch c.Req.Method {
+	case "GET":
+		if c.Req.Form.Get("format") == "json" {
+			entries, err := getTreeEntries(c,
+				path.Clean("/"+c.Req.Form.Get("node")))
+			if err != nil {
+				return err
+			}
+			response = entries
+		}
+	case "POST":
+		result, err := changeTree(c, G)
+		if err != nil {
+			return err
+		}
+		response = result
+		if result.Conflict {
+			status = http.StatusConflict
+		} else if result.Error != "" {
+			status = http.StatusBadRequest
+		}
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	if response != nil {
+		content, err := json.Marshal(response)
+		if err != nil {
+			return fmt.Errorf("Could not marshal tree: %v", err)
+		}
+		c.Res.Header().Set("Content-Type", "application/json")
+		c.Res.WriteHeader(status)
+		c.Res.Write(content)
+		return nil
+	}
+	body, err := h.Renderer.Render("actions/tree", template.Context{
+		"SiteTitle": c.Site.Title}, c.UserSession.Locale,
+		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render site tree: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("Site tree"),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
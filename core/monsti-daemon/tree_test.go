@@ -0,0 +1,39 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import "testing"
+
+func TestFreeNodeName(t *testing.T) {
+	existing := map[string]bool{"/foo/bar": true, "/foo/bar-2": true,
+		"/foo/baz-2": true}
+	exists := func(nodePath string) (bool, error) {
+		return existing[nodePath], nil
+	}
+	tests := []struct{ Name, Free string }{
+		{"bar", "bar-3"},
+		{"baz", "baz"},
+		{"bar-2", "bar-2-2"},
+	}
+	for i, test := range tests {
+		free, err := freeNodeName(exists, "/foo", test.Name)
+		if err != nil || free != test.Free {
+			t.Errorf("Test %v: freeNodeName(%q) = %q, %v, should be %q, nil", i,
+				test.Name, free, err, test.Free)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// uploadExpiry is the time after which unfinished chunked uploads get
+// removed.
+const uploadExpiry = 24 * time.Hour
+
+// errUploadOffset is returned by appendUpload if the chunk does not
+// start at the upload's current offset.
+var errUploadOffset = errors.New("Chunk does not match the upload offset")
+
+// chunkedUpload is a file uploaded in chunks, e.g. to resume uploads
+// over slow connections.
+//
+// Its content is stored in the uploads directory of the site's data
+// directory next to the upload's metadata.
+type chunkedUpload struct {
+	Id string `json:"-"`
+	// Name is the name of the uploaded file.
+	Name string
+	// Length is the total size of the file in bytes.
+	Length int64
+	// Login is the login of the uploading user.
+	Login   string
+	Created time.Time
+}
+
+// uploadsPath returns the path to the chunked uploads inside the given
+// site data directory.
+func uploadsPath(dataDir string) string {
+	return filepath.Join(dataDir, "uploads")
+}
+
+// validUploadId returns true iff id may be an upload id, i.e. if it
+// can't point outside of the uploads directory.
+func validUploadId(id string) bool {
+	_, err := base32.StdEncoding.DecodeString(id)
+	return id != "" && err == nil
+}
+
+// newUpload starts a new chunked upload. Expired uploads get removed.
+func newUpload(dataDir string, upload *chunkedUpload) error {
+	dir := uploadsPath(dataDir)
+	if err := removeExpiredUploads(dir, time.Now()); err != nil {
+		return err
+	}
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Errorf("Could not generate upload id: %v", err)
+	}
+	upload.Id = base32.StdEncoding.EncodeToString(buf)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Could not create uploads directory: %v", err)
+	}
+	content, err := json.Marshal(upload)
+	if err != nil {
+		return fmt.Errorf("Could not marshal upload: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, upload.Id+".json"), content,
+		0600); err != nil {
+		return fmt.Errorf("Could not write upload: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, upload.Id), nil,
+		0600); err != nil {
+		return fmt.Errorf("Could not write upload: %v", err)
+	}
+	return nil
+}
+
+// getUpload returns the chunked upload with the given id and its
+// current offset, i.e. the number of already received bytes.
+//
+// If there is no such upload, it returns nil, 0, nil.
+func getUpload(dataDir, id string) (*chunkedUpload, int64, error) {
+	if !validUploadId(id) {
+		return nil, 0, nil
+	}
+	dir := uploadsPath(dataDir)
+	content, err := ioutil.ReadFile(filepath.Join(dir, id+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, fmt.Errorf("Could not read upload: %v", err)
+	}
+	upload := &chunkedUpload{Id: id}
+	if err := json.Unmarshal(content, upload); err != nil {
+		return nil, 0, fmt.Errorf("Could not unmarshal upload: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(dir, id))
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not read upload: %v", err)
+	}
+	return upload, info.Size(), nil
+}
+
+// appendUpload appends the chunk starting at the given offset to the
+// upload. At most the missing number of bytes are read from the chunk.
+//
+// Returns the new offset.
+func appendUpload(dataDir string, upload *chunkedUpload, offset int64,
+	chunk io.Reader) (int64, error) {
+	file, err := os.OpenFile(filepath.Join(uploadsPath(dataDir), upload.Id),
+		os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("Could not open upload: %v", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("Could not read upload: %v", err)
+	}
+	if info.Size() != offset {
+		return info.Size(), errUploadOffset
+	}
+	n, err := io.Copy(file, io.LimitReader(chunk, upload.Length-offset))
+	if err != nil {
+		return offset + n, fmt.Errorf("Could not write upload: %v", err)
+	}
+	return offset + n, nil
+}
+
+// readUpload returns the content of the completed upload with the
+// given id.
+//
+// If there is no such completed upload, it returns nil, nil, nil.
+func readUpload(dataDir, id string) (*chunkedUpload, []byte, error) {
+	upload, offset, err := getUpload(dataDir, id)
+	if err != nil || upload == nil || offset != upload.Length {
+		return nil, nil, err
+	}
+	content, err := ioutil.ReadFile(filepath.Join(uploadsPath(dataDir), id))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not read upload: %v", err)
+	}
+	return upload, content, nil
+}
+
+// removeUpload removes the upload with the given id.
+func removeUpload(dataDir, id string) error {
+	if !validUploadId(id) {
+		return nil
+	}
+	dir := uploadsPath(dataDir)
+	for _, name := range []string{id, id + ".json"} {
+		err := os.Remove(filepath.Join(dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Could not remove upload: %v", err)
+		}
+	}
+	return nil
+}
+
+// removeExpiredUploads removes the uploads of the given directory
+// started more than uploadExpiry before now.
+func removeExpiredUploads(dir string, now time.Time) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Could not read uploads directory: %v", err)
+	}
+	for _, file := range files {
+		if filepath.Ext(file.Name()) == ".json" ||
+			now.Sub(file.ModTime()) < uploadExpiry {
+			continue
+		}
+		if err := removeUpload(filepath.Dir(dir), file.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Upload handles chunked, resumable uploads similar to the tus
+// protocol:
+//
+// POST starts an upload of the size given by the Upload-Length header
+// and the file name given by the form value "name". The response's
+// Location header points to the upload.
+//
+// HEAD returns the upload's current offset as Upload-Offset header.
+//
+// PATCH appends the request body to the upload given by the form
+// value "id". The Upload-Offset header must hold the current offset.
+//
+// Completed uploads may be used by the edit form instead of uploading
+// the file directly, see formFile.
+func (h *nodeHandler) Upload(c *reqContext) error {
+	if err := c.Req.ParseForm(); err != nil {
+		return err
+	}
+	dataDir := h.Settings.Monsti.GetSiteDataPath(c.Site.Name)
+	if c.Req.Method == "POST" {
+		length, err := strconv.ParseInt(c.Req.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length <= 0 {
+			http.Error(c.Res, "Invalid Upload-Length.", http.StatusBadRequest)
+			return nil
+		}
+		var maxSize int64
+		err = c.Serv.Monsti().GetSiteConfig(c.Site.Name, "core.uploads.maxsize",
+			&maxSize)
+		if err != nil {
+			return fmt.Errorf("Could not get maximum upload size: %v", err)
+		}
+		if maxSize > 0 && length > maxSize {
+			http.Error(c.Res, "Upload too large.",
+				http.StatusRequestEntityTooLarge)
+			return nil
+		}
+		upload := &chunkedUpload{
+			Name:    filepath.Base(c.Req.Form.Get("name")),
+			Length:  length,
+			Login:   c.UserSession.User.Login,
+			Created: time.Now().UTC(),
+		}
+		if err := newUpload(dataDir, upload); err != nil {
+			return err
+		}
+		c.Res.Header().Set("Location", "/@@upload?id="+upload.Id)
+		c.Res.Header().Set("Upload-Offset", "0")
+		c.Res.WriteHeader(http.StatusCreated)
+		return nil
+	}
+	upload, offset, err := getUpload(dataDir, c.Req.Form.Get("id"))
+	if err != nil {
+		return err
+	}
+	if upload == nil || upload.Login != c.UserSession.User.Login {
+		http.Error(c.Res, "Upload not found.", http.StatusNotFound)
+		return nil
+	}
+	c.Res.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Res.Header().Set("Cache-Control", "no-store")
+	switch c.Req.Method {
+	case "HEAD":
+	case "PATCH":
+		start, err := strconv.ParseInt(c.Req.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			http.Error(c.Res, "Invalid Upload-Offset.", http.StatusBadRequest)
+			return nil
+		}
+		offset, err = appendUpload(dataDir, upload, start, c.Req.Body)
+		if err == errUploadOffset {
+			c.Res.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			http.Error(c.Res, err.Error(), http.StatusConflict)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	c.Res.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.Res.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// uploadedFile is a file uploaded using the edit form.
+type uploadedFile struct {
+	Name    string
+	Content []byte
+	// Upload is the id of the chunked upload holding the file, if any.
+	Upload string
+}
+
+// formFile returns the file uploaded for the given field of the edit
+// form. The file may have been uploaded directly or as chunked upload
+// whose id is given by the form value "upload-<field>".
+//
+// Returns nil if no file has been uploaded.
+func formFile(c *reqContext, h *nodeHandler, field string) (*uploadedFile,
+	error) {
+	if id := c.Req.FormValue("upload-" + field); id != "" {
+		dataDir := h.Settings.Monsti.GetSiteDataPath(c.Site.Name)
+		upload, content, err := readUpload(dataDir, id)
+		if err != nil {
+			return nil, err
+		}
+		if upload != nil && upload.Login == c.UserSession.User.Login {
+			return &uploadedFile{upload.Name, content, id}, nil
+		}
+	}
+	if c.Req.MultipartForm == nil {
+		return nil, nil
+	}
+	file, header, err := c.Req.FormFile("Fields." + field)
+	if err != nil {
+		return nil, nil
+	}
+	defer file.Close()
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read multipart file: %v", err)
+	}
+	return &uploadedFile{Name: filepath.Base(header.Filename),
+		Content: content}, nil
+}
@@ -0,0 +1,102 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChunkedUpload(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "monsti-uploads")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dataDir)
+	upload := &chunkedUpload{Name: "foo.txt", Length: 6, Login: "admin"}
+	if err := newUpload(dataDir, upload); err != nil {
+		t.Fatalf("Could not start upload: %v", err)
+	}
+	offset, err := appendUpload(dataDir, upload, 0, strings.NewReader("foo"))
+	if err != nil || offset != 3 {
+		t.Errorf("appendUpload(first chunk) = %v, %v, should be 3, nil", offset,
+			err)
+	}
+	if _, content, err := readUpload(dataDir, upload.Id); content != nil ||
+		err != nil {
+		t.Errorf("readUpload of incomplete upload = %q, %v, should be nil, nil",
+			content, err)
+	}
+	offset, err = appendUpload(dataDir, upload, 2, strings.NewReader("xbar"))
+	if err != errUploadOffset || offset != 3 {
+		t.Errorf("appendUpload(wrong offset) = %v, %v, should be 3, %v", offset,
+			err, errUploadOffset)
+	}
+	// Excess bytes are ignored.
+	offset, err = appendUpload(dataDir, upload, 3, strings.NewReader("barbaz"))
+	if err != nil || offset != 6 {
+		t.Errorf("appendUpload(last chunk) = %v, %v, should be 6, nil", offset,
+			err)
+	}
+	ret, content, err := readUpload(dataDir, upload.Id)
+	if err != nil || ret == nil || ret.Name != "foo.txt" ||
+		string(content) != "foobar" {
+		t.Errorf("readUpload(_) = %v, %q, %v, should be the upload, \"foobar\"",
+			ret, content, err)
+	}
+	if err := removeUpload(dataDir, upload.Id); err != nil {
+		t.Fatalf("Could not remove upload: %v", err)
+	}
+	if ret, _, err := getUpload(dataDir, upload.Id); ret != nil || err != nil {
+		t.Errorf("getUpload of removed upload = %v, %v, should be nil, nil", ret,
+			err)
+	}
+	if ret, _, err := getUpload(dataDir, "../secret"); ret != nil || err != nil {
+		t.Errorf("getUpload(invalid id) = %v, %v, should be nil, nil", ret, err)
+	}
+}
+
+func TestRemoveExpiredUploads(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "monsti-uploads")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dataDir)
+	upload := &chunkedUpload{Name: "foo.txt", Length: 6}
+	if err := newUpload(dataDir, upload); err != nil {
+		t.Fatalf("Could not start upload: %v", err)
+	}
+	dir := uploadsPath(dataDir)
+	if err := removeExpiredUploads(dir, time.Now()); err != nil {
+		t.Fatalf("Could not remove expired uploads: %v", err)
+	}
+	if ret, _, _ := getUpload(dataDir, upload.Id); ret == nil {
+		t.Errorf("Fresh upload should not have been removed")
+	}
+	err = removeExpiredUploads(dir, time.Now().Add(uploadExpiry+time.Minute))
+	if err != nil {
+		t.Fatalf("Could not remove expired uploads: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expired upload has not been removed: %v",
+			filepath.Join(dir, files[0].Name()))
+	}
+}
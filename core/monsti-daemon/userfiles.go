@@ -0,0 +1,280 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chrneumann/htmlwidgets"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// errQuotaExceeded is returned by addUserFile if the file would
+// exceed the user's quota.
+var errQuotaExceeded = errors.New("Quota exceeded")
+
+// userFile is a file in a user's file area.
+type userFile struct {
+	Name    string
+	Size    int64
+	Changed time.Time
+}
+
+// userFilesPath returns the path to the file area of the given user
+// inside the given site data directory.
+func userFilesPath(dataDir, login string) string {
+	return filepath.Join(dataDir, "user-files", login)
+}
+
+// validUserFileName returns true iff the name may be used for a file
+// in a user's file area.
+func validUserFileName(name string) bool {
+	return len(name) > 0 && name[0] != '.' &&
+		!strings.ContainsAny(name, `/\`)
+}
+
+// listUserFiles returns the files in the given file area ordered by name.
+func listUserFiles(dir string) ([]userFile, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Could not read user files: %v", err)
+	}
+	files := make([]userFile, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() || !validUserFileName(info.Name()) {
+			continue
+		}
+		files = append(files, userFile{
+			Name: info.Name(), Size: info.Size(), Changed: info.ModTime()})
+	}
+	sort.Sort(userFilesByName(files))
+	return files, nil
+}
+
+type userFilesByName []userFile
+
+func (s userFilesByName) Len() int           { return len(s) }
+func (s userFilesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s userFilesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// userFilesUsage returns the total size of the given files.
+func userFilesUsage(files []userFile) int64 {
+	var usage int64
+	for _, file := range files {
+		usage += file.Size
+	}
+	return usage
+}
+
+// addUserFile writes the file to the given file area.
+//
+// An existing file with the same name will be replaced. If quota is
+// greater than zero and the file area would exceed it,
+// errQuotaExceeded is returned.
+func addUserFile(dir, name string, content []byte, quota int64) error {
+	if !validUserFileName(name) {
+		return fmt.Errorf("Invalid file name %q", name)
+	}
+	files, err := listUserFiles(dir)
+	if err != nil {
+		return err
+	}
+	usage := int64(len(content))
+	for _, file := range files {
+		if file.Name != name {
+			usage += file.Size
+		}
+	}
+	if quota > 0 && usage > quota {
+		return errQuotaExceeded
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Could not create user files directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), content,
+		0600); err != nil {
+		return fmt.Errorf("Could not write user file: %v", err)
+	}
+	return nil
+}
+
+// readUserFile returns the content of the named file in the given
+// file area.
+func readUserFile(dir, name string) ([]byte, error) {
+	if !validUserFileName(name) {
+		return nil, fmt.Errorf("Invalid file name %q", name)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read user file: %v", err)
+	}
+	return content, nil
+}
+
+// removeUserFile removes the named file from the given file area.
+func removeUserFile(dir, name string) error {
+	if !validUserFileName(name) {
+		return fmt.Errorf("Invalid file name %q", name)
+	}
+	err := os.Remove(filepath.Join(dir, name))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Could not remove user file: %v", err)
+	}
+	return nil
+}
+
+type userFilesFormData struct {
+	File string
+}
+
+// Files handles the user's file area.
+//
+// Users may upload files to stage them, remove them or promote them
+// into a file field of the current node.
+func (h *nodeHandler) Files(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if err := c.Req.ParseMultipartForm(1024 * 1024); err != nil {
+		if err != http.ErrNotMultipart {
+			return fmt.Errorf("Could not parse form: %v", err)
+		}
+	}
+	dir := userFilesPath(h.Settings.Monsti.GetSiteDataPath(c.Site.Name),
+		c.UserSession.User.Login)
+	quota := c.Site.UserFileQuota
+
+	data := userFilesFormData{}
+	form := htmlwidgets.NewForm(&data)
+	form.AddWidget(new(htmlwidgets.FileWidget), "File", G("File"), "")
+
+	fileFields := make([]string, 0)
+	for _, field := range c.Node.AllFields() {
+		if field.Type == "File" {
+			fileFields = append(fileFields, field.Id)
+		}
+	}
+
+	switch c.Req.Method {
+	case "GET":
+	case "POST":
+		switch {
+		case len(c.Req.FormValue("Remove")) > 0:
+			if err := removeUserFile(dir, c.Req.FormValue("Remove")); err != nil {
+				return err
+			}
+			http.Redirect(c.Res, c.Req, "@@files", http.StatusSeeOther)
+			return nil
+		case len(c.Req.FormValue("Promote")) > 0:
+			name := c.Req.FormValue("Promote")
+			field := c.Req.FormValue("Field")
+			known := false
+			for _, id := range fileFields {
+				known = known || id == field
+			}
+			if !known {
+				return fmt.Errorf("Node has no file field %q", field)
+			}
+			content, err := readUserFile(dir, name)
+			if err != nil {
+				return err
+			}
+			if err := c.Serv.Monsti().WriteNodeData(c.Site.Name, c.Node.Path,
+				"__file_"+field, content); err != nil {
+				return fmt.Errorf("Could not save file: %v", err)
+			}
+			if err := removeUserFile(dir, name); err != nil {
+				return err
+			}
+			http.Redirect(c.Res, c.Req, dirPath(c.Node.Path), http.StatusSeeOther)
+			return nil
+		case form.Fill(c.Req.Form):
+			if c.Req.MultipartForm == nil {
+				form.AddError("File", G("Please choose a file."))
+				break
+			}
+			file, header, err := c.Req.FormFile("File")
+			if err != nil {
+				form.AddError("File", G("Please choose a file."))
+				break
+			}
+			content, err := ioutil.ReadAll(file)
+			if err != nil {
+				return fmt.Errorf("Could not read multipart file: %v", err)
+			}
+			name := filepath.Base(header.Filename)
+			if !validUserFileName(name) {
+				form.AddError("File", G("Invalid file name."))
+				break
+			}
+			reason, err := screenUpload(c, h, quarantinedFile{Name: name}, content)
+			if err != nil {
+				return fmt.Errorf("Could not scan upload: %v", err)
+			}
+			if reason != "" {
+				form.AddError("File", fmt.Sprintf(
+					G("The file has been quarantined for review: %v"), reason))
+				break
+			}
+			switch err := addUserFile(dir, name, content, quota); {
+			case err == errQuotaExceeded:
+				form.AddError("File", G("The file exceeds your quota."))
+			case err != nil:
+				return err
+			default:
+				http.Redirect(c.Res, c.Req, "@@files", http.StatusSeeOther)
+				return nil
+			}
+		}
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+
+	files, err := listUserFiles(dir)
+	if err != nil {
+		return err
+	}
+	body, err := h.Renderer.Render("actions/files",
+		template.Context{
+			"Files":      files,
+			"Usage":      userFilesUsage(files),
+			"Quota":      quota,
+			"FileFields": fileFields,
+			"Form":       form.RenderData()}, c.UserSession.Locale,
+		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render files page: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("My files"),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
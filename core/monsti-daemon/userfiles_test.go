@@ -0,0 +1,74 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestUserFiles(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{},
+		"TestUserFiles")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	dir := filepath.Join(root, "foo")
+	files, err := listUserFiles(dir)
+	if err != nil || len(files) != 0 {
+		t.Errorf("listUserFiles for missing directory = %v, %v, should be empty",
+			files, err)
+	}
+	tests := []struct {
+		Name, Content string
+		Err           error
+		Usage         int64
+	}{
+		{"b.txt", "12345", nil, 5},
+		{"a.txt", "123", nil, 8},
+		{"c.txt", "123", errQuotaExceeded, 8},
+		{"b.txt", "1", nil, 4},
+	}
+	for _, test := range tests {
+		err := addUserFile(dir, test.Name, []byte(test.Content), 8)
+		if err != test.Err {
+			t.Errorf("addUserFile(_, %q, _, 8) = %v, should be %v", test.Name, err,
+				test.Err)
+		}
+		files, _ := listUserFiles(dir)
+		if usage := userFilesUsage(files); usage != test.Usage {
+			t.Errorf("Usage after adding %q is %v, should be %v", test.Name, usage,
+				test.Usage)
+		}
+	}
+	files, _ = listUserFiles(dir)
+	if len(files) != 2 || files[0].Name != "a.txt" || files[1].Name != "b.txt" {
+		t.Errorf("listUserFiles = %v, should be a.txt and b.txt", files)
+	}
+	if err := addUserFile(dir, "../evil", []byte(""), 0); err == nil {
+		t.Errorf("addUserFile should fail for invalid names")
+	}
+	if err := removeUserFile(dir, "a.txt"); err != nil {
+		t.Errorf("Could not remove user file: %v", err)
+	}
+	if _, err := readUserFile(dir, "a.txt"); err == nil {
+		t.Errorf("User file still exists after removal")
+	}
+}
@@ -0,0 +1,401 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.crypto/bcrypt"
+	"github.com/chrneumann/htmlwidgets"
+	"github.com/chrneumann/mimemail"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// userRecord is a user account as imported or exported. Passwords
+// never get exported.
+type userRecord struct {
+	Login string
+	Name  string
+	Email string
+	Roles []string `json:",omitempty"`
+}
+
+// userCSVHeader is the header row of exported CSV files.
+var userCSVHeader = []string{"Login", "Name", "Email", "Roles"}
+
+// exportUsers writes the given users sorted by login in the given
+// format ("csv" or "json"). Roles are separated by semicolons in CSV
+// files.
+func exportUsers(users map[string]service.User, format string,
+	w io.Writer) error {
+	logins := make([]string, 0, len(users))
+	for login := range users {
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+	records := make([]userRecord, 0, len(users))
+	for _, login := range logins {
+		user := users[login]
+		records = append(records, userRecord{login, user.Name, user.Email,
+			user.Roles})
+	}
+	switch format {
+	case "csv":
+		writer := csv.NewWriter(w)
+		writer.Write(userCSVHeader)
+		for _, record := range records {
+			writer.Write([]string{record.Login, record.Name, record.Email,
+				strings.Join(record.Roles, ";")})
+		}
+		writer.Flush()
+		return writer.Error()
+	case "json":
+		content, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			return fmt.Errorf("Could not marshal users: %v", err)
+		}
+		_, err = w.Write(content)
+		return err
+	}
+	return fmt.Errorf("Unknown format %q", format)
+}
+
+// parseUsers parses the users to import given in the given format
+// ("csv" or "json").
+//
+// CSV files must start with a header row naming the columns (Login,
+// Name, Email and Roles). The order of the columns doesn't matter.
+func parseUsers(content []byte, format string) ([]userRecord, error) {
+	records := make([]userRecord, 0)
+	switch format {
+	case "csv":
+		rows, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse CSV: %v", err)
+		}
+		if len(rows) == 0 {
+			return records, nil
+		}
+		columns := make(map[string]int)
+		for i, name := range rows[0] {
+			columns[strings.ToLower(strings.TrimSpace(name))] = i
+		}
+		for _, name := range []string{"login", "email"} {
+			if _, ok := columns[name]; !ok {
+				return nil, fmt.Errorf("Missing column %q", name)
+			}
+		}
+		get := func(row []string, name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		for _, row := range rows[1:] {
+			record := userRecord{
+				Login: get(row, "login"),
+				Name:  get(row, "name"),
+				Email: get(row, "email")}
+			for _, role := range strings.Split(get(row, "roles"), ";") {
+				if role = strings.TrimSpace(role); role != "" {
+					record.Roles = append(record.Roles, role)
+				}
+			}
+			records = append(records, record)
+		}
+	case "json":
+		if err := json.Unmarshal(content, &records); err != nil {
+			return nil, fmt.Errorf("Could not parse JSON: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown format %q", format)
+	}
+	seen := make(map[string]bool)
+	for i, record := range records {
+		switch {
+		case record.Login == "" || strings.ContainsAny(record.Login, " \t\n"):
+			return nil, fmt.Errorf("Invalid login %q of user %v", record.Login,
+				i+1)
+		case !strings.Contains(record.Email, "@"):
+			return nil, fmt.Errorf("Invalid email address %q of user %q",
+				record.Email, record.Login)
+		case seen[record.Login]:
+			return nil, fmt.Errorf("Duplicate user %q", record.Login)
+		}
+		seen[record.Login] = true
+	}
+	return records, nil
+}
+
+// userFormat returns the format of the user file with the given name.
+func userFormat(filename string) string {
+	if strings.ToLower(filepath.Ext(filename)) == ".json" {
+		return "json"
+	}
+	return "csv"
+}
+
+// importUsers adds the given users to the user database or updates
+// the existing ones. Existing users keep their passwords.
+//
+// Returns the newly created users and the number of updated users.
+func importUsers(users map[string]service.User,
+	records []userRecord) ([]*service.User, int) {
+	created := make([]*service.User, 0)
+	updated := 0
+	for _, record := range records {
+		user, exists := users[record.Login]
+		user.Login = record.Login
+		user.Name = record.Name
+		user.Email = record.Email
+		user.Roles = record.Roles
+		users[record.Login] = user
+		if exists {
+			updated++
+		} else {
+			created = append(created, &user)
+		}
+	}
+	return created, updated
+}
+
+// invitationMail returns the mail inviting a new user to choose a
+// password.
+func invitationMail(site util.SiteSettings, G func(string) string,
+	user *service.User, link string) *mimemail.Mail {
+	mail := mimemail.Mail{
+		From:    mimemail.Address{site.EmailName, site.EmailAddress},
+		Subject: fmt.Sprintf(G("Your account at %v"), site.Title),
+		Body: []byte(fmt.Sprintf(`Hello %v,
+
+an account with the login %v has been created for you at "%v".
+
+To choose your password, visit the following link:
+%v
+
+This is an automatically generated email. Please don't reply to it.
+`, user.Name, user.Login, site.Title, link))}
+	mail.To = []mimemail.Address{mimemail.Address{user.Name, user.Email}}
+	return &mail
+}
+
+// importSiteUsers imports the users into the given site's user
+// database. If invite is true, new users get an invitation mail sent
+// using the given function.
+//
+// Returns the number of created and updated users.
+func importSiteUsers(settings *settings, siteName string,
+	records []userRecord, invite bool,
+	sendMail func(*mimemail.Mail) error) (int, int, error) {
+	dataDir := settings.Monsti.GetSiteDataPath(siteName)
+	users, err := getUserDatabase(dataDir)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Could not get user database: %v", err)
+	}
+	created, updated := importUsers(users, records)
+	if err := writeUserDatabase(users, dataDir); err != nil {
+		return 0, 0, fmt.Errorf("Could not write user database: %v", err)
+	}
+	if invite {
+		for _, user := range created {
+			if err := inviteUser(settings, siteName, user, sendMail); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	return len(created), updated, nil
+}
+
+// inviteUser sends the invitation mail to the given new user of the
+// site.
+func inviteUser(settings *settings, siteName string, user *service.User,
+	sendMail func(*mimemail.Mail) error) error {
+	site := settings.Monsti.Sites[siteName]
+	G, _, _, _ := gettext.DefaultLocales.Use("", site.Locale)
+	link := site.BaseURL + "/@@change-password?token=" +
+		getRequestPasswordToken(siteName, user.Login, site.PasswordTokenKey)
+	if err := sendMail(invitationMail(site, G, user, link)); err != nil {
+		return fmt.Errorf("Could not send invitation to %q: %v", user.Login, err)
+	}
+	return nil
+}
+
+type CreateUserArgs struct {
+	Site string
+	User *service.NewUser
+}
+
+func (m *MonstiService) CreateUser(args *CreateUserArgs, reply *int) error {
+	if args.User.Login == "" {
+		return fmt.Errorf("Missing login")
+	}
+	dataDir := m.Settings.Monsti.GetSiteDataPath(args.Site)
+	users, err := getUserDatabase(dataDir)
+	if err != nil {
+		return fmt.Errorf("Could not get user database: %v", err)
+	}
+	if _, ok := users[args.User.Login]; ok {
+		return fmt.Errorf("User %q already exists", args.User.Login)
+	}
+	user := service.User{Login: args.User.Login, Name: args.User.Name,
+		Email: args.User.Email, Roles: args.User.Roles}
+	if args.User.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(args.User.Password), 0)
+		if err != nil {
+			return fmt.Errorf("Could not hash password: %v", err)
+		}
+		user.Password = string(hash)
+		user.PasswordChanged = time.Now().UTC()
+	}
+	users[user.Login] = user
+	if err := writeUserDatabase(users, dataDir); err != nil {
+		return fmt.Errorf("Could not write user database: %v", err)
+	}
+	if !args.User.Invite {
+		return nil
+	}
+	return inviteUser(m.Settings, args.Site, &user,
+		func(mail *mimemail.Mail) error {
+			return m.SendSiteMail(&SendSiteMailArgs{Site: args.Site, Mail: mail},
+				new(int))
+		})
+}
+
+type usersFormData struct {
+	File   string
+	Invite bool
+}
+
+// Users lists the user accounts of the site and handles their import
+// and export.
+func (h *nodeHandler) Users(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if err := c.Req.ParseMultipartForm(1024 * 1024); err != nil {
+		if err != http.ErrNotMultipart {
+			return fmt.Errorf("Could not parse form: %v", err)
+		}
+	}
+	dataDir := h.Settings.Monsti.GetSiteDataPath(c.Site.Name)
+	users, err := getUserDatabase(dataDir)
+	if err != nil {
+		return fmt.Errorf("Could not get user database: %v", err)
+	}
+
+	data := usersFormData{Invite: true}
+	form := htmlwidgets.NewForm(&data)
+	form.AddWidget(new(htmlwidgets.FileWidget), "File", G("File"),
+		G("CSV or JSON file with the users to import."))
+	form.AddWidget(new(htmlwidgets.BoolWidget), "Invite", G("Invite"),
+		G("Send new users a link to choose their password."))
+
+	switch c.Req.Method {
+	case "GET":
+		if format := c.Req.Form.Get("export"); format != "" {
+			var out bytes.Buffer
+			if err := exportUsers(users, format, &out); err != nil {
+				return fmt.Errorf("Could not export users: %v", err)
+			}
+			if format == "csv" {
+				c.Res.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			} else {
+				c.Res.Header().Set("Content-Type", "application/json")
+			}
+			c.Res.Header().Set("Content-Disposition",
+				fmt.Sprintf("attachment; filename=users.%v", format))
+			c.Res.Write(out.Bytes())
+			return nil
+		}
+	case "POST":
+		if !form.Fill(c.Req.Form) {
+			break
+		}
+		file, header, err := c.Req.FormFile("File")
+		if c.Req.MultipartForm == nil || err != nil {
+			form.AddError("File", G("Please choose a file."))
+			break
+		}
+		content, err := ioutil.ReadAll(file)
+		if err != nil {
+			return fmt.Errorf("Could not read multipart file: %v", err)
+		}
+		records, err := parseUsers(content, userFormat(header.Filename))
+		if err != nil {
+			form.AddError("File", fmt.Sprintf(G("Invalid file: %v"), err))
+			break
+		}
+		created, updated, err := importSiteUsers(h.Settings, c.Site.Name,
+			records, data.Invite, func(mail *mimemail.Mail) error {
+				return c.Serv.Monsti().SendSiteMail(c.Site.Name, mail)
+			})
+		if err != nil {
+			return fmt.Errorf("Could not import users: %v", err)
+		}
+		http.Redirect(c.Res, c.Req, "@@users?"+url.Values{
+			"created": {strconv.Itoa(created)},
+			"updated": {strconv.Itoa(updated)}}.Encode(), http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+
+	logins := make([]string, 0, len(users))
+	for login := range users {
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+	list := make([]service.User, 0, len(users))
+	for _, login := range logins {
+		user := users[login]
+		user.Login = login
+		list = append(list, user)
+	}
+	_, imported := c.Req.Form["created"]
+	body, err := h.Renderer.Render("actions/users",
+		template.Context{
+			"Users":    list,
+			"Imported": imported,
+			"Created":  c.Req.Form.Get("created"),
+			"Updated":  c.Req.Form.Get("updated"),
+			"Form":     form.RenderData()}, c.UserSession.Locale,
+		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render users: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("Users"),
+		Flags:   EDIT_VIEW}
+	fmt.Fprint(c.Res, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv))
+	return nil
+}
@@ -0,0 +1,107 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestExportAndParseUsers(t *testing.T) {
+	users := map[string]service.User{
+		"foo": {Name: "Foo", Email: "foo@example.com", Password: "secret",
+			Roles: []string{"editor", "admin"}},
+		"bar": {Name: "Bar, Jr.", Email: "bar@example.com"},
+	}
+	expected := []userRecord{
+		{"bar", "Bar, Jr.", "bar@example.com", nil},
+		{"foo", "Foo", "foo@example.com", []string{"editor", "admin"}},
+	}
+	for _, format := range []string{"csv", "json"} {
+		var out bytes.Buffer
+		if err := exportUsers(users, format, &out); err != nil {
+			t.Fatalf("exportUsers(_, %q, _) returned error: %v", format, err)
+		}
+		if bytes.Contains(out.Bytes(), []byte("secret")) {
+			t.Errorf("Exported %v users should not contain passwords: %s", format,
+				out.Bytes())
+		}
+		records, err := parseUsers(out.Bytes(), format)
+		if err != nil {
+			t.Fatalf("parseUsers(_, %q) returned error: %v", format, err)
+		}
+		if !reflect.DeepEqual(records, expected) {
+			t.Errorf("parseUsers(_, %q) = %v, should be %v", format, records,
+				expected)
+		}
+	}
+}
+
+func TestParseUsers(t *testing.T) {
+	tests := []struct {
+		Content string
+		Records []userRecord
+		Valid   bool
+	}{
+		{"Email,Login\nfoo@example.com,foo\n",
+			[]userRecord{{Login: "foo", Email: "foo@example.com"}}, true},
+		{"Login,Roles,Email\nfoo, a ; b ,foo@example.com\n",
+			[]userRecord{{"foo", "", "foo@example.com", []string{"a", "b"}}}, true},
+		{"Login,Name\nfoo,Foo\n", nil, false},
+		{"Login,Email\nfoo,foo\n", nil, false},
+		{"Login,Email\nfoo bar,foo@example.com\n", nil, false},
+		{"Login,Email\nfoo,foo@example.com\nfoo,bar@example.com\n", nil, false},
+	}
+	for i, test := range tests {
+		records, err := parseUsers([]byte(test.Content), "csv")
+		if test.Valid != (err == nil) {
+			t.Errorf("Test %v: parseUsers returned error %v, valid: %v", i, err,
+				test.Valid)
+			continue
+		}
+		if test.Valid && !reflect.DeepEqual(records, test.Records) {
+			t.Errorf("Test %v: parseUsers(...) = %v, should be %v", i, records,
+				test.Records)
+		}
+	}
+}
+
+func TestImportUsers(t *testing.T) {
+	users := map[string]service.User{
+		"foo": {Login: "foo", Name: "Foo", Email: "old@example.com",
+			Password: "hash"},
+	}
+	created, updated := importUsers(users, []userRecord{
+		{"foo", "Foo", "foo@example.com", []string{"editor"}},
+		{"bar", "Bar", "bar@example.com", nil},
+	})
+	if updated != 1 || len(created) != 1 || created[0].Login != "bar" {
+		t.Errorf("importUsers(...) = %v, %v, should create bar and update foo",
+			created, updated)
+	}
+	expected := service.User{Login: "foo", Name: "Foo",
+		Email: "foo@example.com", Password: "hash", Roles: []string{"editor"}}
+	if !reflect.DeepEqual(users["foo"], expected) {
+		t.Errorf("Updated user is %v, should be %v", users["foo"], expected)
+	}
+	if users["bar"].Password != "" {
+		t.Errorf("New users should not have a password")
+	}
+}
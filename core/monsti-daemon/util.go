@@ -1,5 +1,10 @@
 package main
 
+import (
+	"path"
+	"strings"
+)
+
 // inStringSlice checks if the string value is in the given string slice.
 func inStringSlice(value string, slice []string) bool {
 	for _, v := range slice {
@@ -9,3 +14,38 @@ func inStringSlice(value string, slice []string) bool {
 	}
 	return false
 }
+
+// dirPath returns the cleaned node path with a trailing slash.
+func dirPath(nodePath string) string {
+	cleaned := path.Clean("/" + nodePath)
+	if cleaned == "/" {
+		return cleaned
+	}
+	return cleaned + "/"
+}
+
+// relNodePath returns the path of the node at target relative to the
+// node at base, e.g. "../contact" for "/about" and "/contact".
+func relNodePath(base, target string) string {
+	split := func(nodePath string) []string {
+		cleaned := path.Clean("/" + nodePath)
+		if cleaned == "/" {
+			return nil
+		}
+		return strings.Split(cleaned[1:], "/")
+	}
+	from, to := split(base), split(target)
+	common := 0
+	for common < len(from) && common < len(to) && from[common] == to[common] {
+		common++
+	}
+	parts := make([]string, 0, len(from)-common+len(to)-common)
+	for range from[common:] {
+		parts = append(parts, "..")
+	}
+	parts = append(parts, to[common:]...)
+	if len(parts) == 0 {
+		return "."
+	}
+	return strings.Join(parts, "/")
+}
@@ -25,3 +25,19 @@ func TestInStringSlice(t *testing.T) {
 		}
 	}
 }
+
+func TestRelNodePath(t *testing.T) {
+	tests := []struct{ Base, Target, Expected string }{
+		{"/about", "/about", "."},
+		{"/about", "/about/contact", "contact"},
+		{"/about", "/contact", "../contact"},
+		{"/about/team", "/", "../.."},
+		{"/", "/about/team", "about/team"},
+		{"/about/", "/about/team/", "team"}}
+	for _, test := range tests {
+		if ret := relNodePath(test.Base, test.Target); ret != test.Expected {
+			t.Errorf("relNodePath(%q, %q) = %q, should be %q", test.Base,
+				test.Target, ret, test.Expected)
+		}
+	}
+}
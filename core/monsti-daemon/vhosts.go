@@ -0,0 +1,230 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// hostTable maps host patterns to site names. Patterns are hosts with
+// optional port, e.g. "example.com" or "localhost:8080", or wildcards
+// like "*.example.com" matching all subdomains of example.com.
+type hostTable map[string]string
+
+// lookup returns the name of the site of the given host, e.g. the
+// value of a Host header or a TLS server name.
+//
+// Patterns with port win over patterns without port, exact hosts over
+// wildcards, and longer wildcards over shorter ones.
+func (t hostTable) lookup(host string) (string, bool) {
+	name, _, ok := lookupHost(t, nil, host)
+	return name, ok
+}
+
+// lookupHost returns the name of the site of the given host using the
+// precedence of hostTable.lookup across the hosts and aliases tables.
+// For patterns present in both, hosts win. alias is true if the host
+// matched an alias.
+func lookupHost(hosts, aliases hostTable, host string) (site string,
+	alias, ok bool) {
+	host = strings.ToLower(host)
+	name, port := host, ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		name, port = h, p
+	}
+	candidates := []string{host, name}
+	for rest := name; strings.Contains(rest, "."); {
+		rest = rest[strings.Index(rest, ".")+1:]
+		if port != "" {
+			candidates = append(candidates, "*."+rest+":"+port)
+		}
+		candidates = append(candidates, "*."+rest)
+	}
+	for _, candidate := range candidates {
+		if site, ok := hosts[candidate]; ok {
+			return site, false, true
+		}
+		if site, ok := aliases[candidate]; ok {
+			return site, true, true
+		}
+	}
+	return "", false, false
+}
+
+// names returns the table with the ports removed from the patterns,
+// e.g. to look up TLS server names.
+func (t hostTable) names() hostTable {
+	patterns := make([]string, 0, len(t))
+	for pattern := range t {
+		patterns = append(patterns, pattern)
+	}
+	// Patterns without port come first and win.
+	sort.Strings(patterns)
+	names := make(hostTable, len(t))
+	for _, pattern := range patterns {
+		name := pattern
+		if host, _, err := net.SplitHostPort(pattern); err == nil {
+			name = host
+		}
+		if _, ok := names[name]; !ok {
+			names[name] = t[pattern]
+		}
+	}
+	return names
+}
+
+// validHostPattern returns true iff the given host pattern is valid,
+// i.e. not empty and containing a wildcard only as first label.
+func validHostPattern(pattern string) bool {
+	return pattern != "" && !strings.Contains(strings.TrimPrefix(pattern, "*."),
+		"*")
+}
+
+// newHostTables returns the tables mapping the hosts and the aliases of
+// the given sites to their names.
+func newHostTables(sites map[string]util.SiteSettings) (hostTable,
+	hostTable, error) {
+	names := make([]string, 0, len(sites))
+	for name := range sites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hosts, aliases := make(hostTable), make(hostTable)
+	for _, name := range names {
+		site := sites[name]
+		for _, table := range []struct {
+			Patterns []string
+			Table    hostTable
+		}{{site.Hosts, hosts}, {site.Aliases, aliases}} {
+			for _, pattern := range table.Patterns {
+				pattern = strings.ToLower(pattern)
+				if !validHostPattern(pattern) {
+					return nil, nil, fmt.Errorf("Invalid host %q of site %q", pattern,
+						name)
+				}
+				other, ok := hosts[pattern]
+				if !ok {
+					other, ok = aliases[pattern]
+				}
+				if ok {
+					return nil, nil, fmt.Errorf("Host %q is used by sites %q and %q",
+						pattern, other, name)
+				}
+				table.Table[pattern] = name
+			}
+		}
+	}
+	return hosts, aliases, nil
+}
+
+// canonicalURL returns the URL of the requested resource on the
+// canonical host of the given site, i.e. below the site's base URL or
+// its first host without wildcard. Returns the empty string if the
+// site has no canonical host.
+func canonicalURL(site util.SiteSettings, req *http.Request) string {
+	base := strings.TrimSuffix(site.BaseURL, "/")
+	if base == "" {
+		scheme := "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+		for _, host := range site.Hosts {
+			if !strings.HasPrefix(host, "*.") {
+				base = scheme + "://" + host
+				break
+			}
+		}
+	}
+	if base == "" {
+		return ""
+	}
+	return base + req.URL.RequestURI()
+}
+
+// siteRouter routes requests to the handlers of the sites by their
+// Host header. Requests to alias hosts get redirected to the site's
+// canonical URL, if it has one. Exact hosts and aliases win over
+// wildcards, see lookupHost.
+type siteRouter struct {
+	Hosts, Aliases hostTable
+	Settings       *settings
+	// Sites maps site names to the handlers of their requests.
+	Sites map[string]http.Handler
+	// Default handles requests to unknown hosts.
+	Default http.Handler
+}
+
+func (r *siteRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name, alias, ok := lookupHost(r.Hosts, r.Aliases, req.Host)
+	if ok && alias {
+		target := canonicalURL(r.Settings.Monsti.Sites[name], req)
+		if target != "" {
+			http.Redirect(w, req, target, http.StatusMovedPermanently)
+			return
+		}
+	}
+	if handler, found := r.Sites[name]; ok && found {
+		handler.ServeHTTP(w, req)
+		return
+	}
+	r.Default.ServeHTTP(w, req)
+}
+
+// loadSiteCertificates returns the TLS certificates of the sites
+// having one configured.
+func loadSiteCertificates(settings *settings) (map[string]*tls.Certificate,
+	error) {
+	certs := make(map[string]*tls.Certificate)
+	for name, site := range settings.Monsti.Sites {
+		if site.TLS.Certificate == "" && site.TLS.Key == "" {
+			continue
+		}
+		certFile, keyFile := site.TLS.Certificate, site.TLS.Key
+		util.MakeAbsolute(&certFile, settings.Monsti.GetSiteConfigPath(name))
+		util.MakeAbsolute(&keyFile, settings.Monsti.GetSiteConfigPath(name))
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load certificate of site %q: %v",
+				name, err)
+		}
+		certs[name] = &cert
+	}
+	return certs, nil
+}
+
+// siteTLSConfig returns the TLS configuration choosing the certificate
+// of the site by the server name requested by the client.
+func siteTLSConfig(hosts, aliases hostTable,
+	certs map[string]*tls.Certificate) *tls.Config {
+	hostNames, aliasNames := hosts.names(), aliases.names()
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate,
+			error) {
+			name, _, ok := lookupHost(hostNames, aliasNames, hello.ServerName)
+			if cert, found := certs[name]; ok && found {
+				return cert, nil
+			}
+			return nil, fmt.Errorf("No certificate for %q", hello.ServerName)
+		}}
+}
@@ -0,0 +1,192 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestHostTableLookup(t *testing.T) {
+	table := hostTable{
+		"example.com":        "a",
+		"example.com:8080":   "b",
+		"*.example.com":      "c",
+		"*.shop.example.com": "d",
+		"*.example.com:8443": "e",
+		"localhost:8080":     "f",
+	}
+	tests := []struct {
+		Host, Site string
+	}{
+		{"example.com", "a"},
+		{"EXAMPLE.com", "a"},
+		{"example.com:80", "a"},
+		{"example.com:8080", "b"},
+		{"www.example.com", "c"},
+		{"a.b.example.com", "c"},
+		{"www.shop.example.com", "d"},
+		{"shop.example.com", "c"},
+		{"www.example.com:8443", "e"},
+		{"localhost:8080", "f"},
+		{"localhost", ""},
+		{"example.org", ""},
+		{"com", ""},
+	}
+	for _, test := range tests {
+		site, ok := table.lookup(test.Host)
+		if site != test.Site || ok != (test.Site != "") {
+			t.Errorf("lookup(%q) = %q, %v, should be %q", test.Host, site, ok,
+				test.Site)
+		}
+	}
+	names := table.names()
+	if site, _ := names.lookup("localhost"); site != "f" {
+		t.Errorf("names().lookup(\"localhost\") = %q, should be \"f\"", site)
+	}
+	if site, _ := names.lookup("example.com"); site != "a" {
+		t.Errorf("names().lookup(\"example.com\") = %q, should be \"a\"", site)
+	}
+}
+
+func TestNewHostTables(t *testing.T) {
+	sites := map[string]util.SiteSettings{
+		"a": {Hosts: []string{"Example.com", "*.example.com"},
+			Aliases: []string{"example.org"}},
+		"b": {Hosts: []string{"localhost:8080"}},
+	}
+	hosts, aliases, err := newHostTables(sites)
+	if err != nil {
+		t.Fatalf("newHostTables returned error: %v", err)
+	}
+	if len(hosts) != 3 || hosts["example.com"] != "a" ||
+		hosts["*.example.com"] != "a" || hosts["localhost:8080"] != "b" {
+		t.Errorf("newHostTables returned hosts %v", hosts)
+	}
+	if len(aliases) != 1 || aliases["example.org"] != "a" {
+		t.Errorf("newHostTables returned aliases %v", aliases)
+	}
+	for _, invalid := range []map[string]util.SiteSettings{
+		{"a": {Hosts: []string{"example.com"}},
+			"b": {Aliases: []string{"example.com"}}},
+		{"a": {Hosts: []string{"www.*.example.com"}}},
+		{"a": {Hosts: []string{""}}},
+	} {
+		if _, _, err := newHostTables(invalid); err == nil {
+			t.Errorf("newHostTables(%v) should fail", invalid)
+		}
+	}
+}
+
+func TestCanonicalURL(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.org/foo/?bar=1", nil)
+	tests := []struct {
+		Site util.SiteSettings
+		URL  string
+	}{
+		{util.SiteSettings{BaseURL: "https://example.com/",
+			Hosts: []string{"example.com"}}, "https://example.com/foo/?bar=1"},
+		{util.SiteSettings{Hosts: []string{"*.example.com", "example.com"}},
+			"http://example.com/foo/?bar=1"},
+		{util.SiteSettings{Hosts: []string{"*.example.com"}}, ""},
+	}
+	for i, test := range tests {
+		if url := canonicalURL(test.Site, req); url != test.URL {
+			t.Errorf("%v: canonicalURL = %q, should be %q", i, url, test.URL)
+		}
+	}
+	req.TLS = &tls.ConnectionState{}
+	if url := canonicalURL(tests[1].Site, req); url !=
+		"https://example.com/foo/?bar=1" {
+		t.Errorf("canonicalURL for TLS request = %q", url)
+	}
+}
+
+func TestSiteRouter(t *testing.T) {
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		})
+	}
+	s := new(settings)
+	s.Monsti.Sites = map[string]util.SiteSettings{
+		"a": {Hosts: []string{"example.com"}}}
+	router := &siteRouter{
+		Hosts: hostTable{"example.com": "a", "*.example.net": "b",
+			"shop.example.org": "b"},
+		Aliases:  hostTable{"www.example.com": "a", "*.example.org": "a"},
+		Settings: s,
+		Sites:    map[string]http.Handler{"a": handler("a"), "b": handler("b")},
+		Default:  handler("default")}
+	tests := []struct {
+		Host, Body, Location string
+	}{
+		{"example.com", "a", ""},
+		{"shop.example.net:8080", "b", ""},
+		{"www.example.com", "", "http://example.com/foo?x=1"},
+		{"example.org", "default", ""},
+		{"shop.example.org", "b", ""},
+		{"blog.example.org", "", "http://example.com/foo?x=1"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://"+test.Host+"/foo?x=1", nil)
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		if test.Location != "" {
+			if res.Code != http.StatusMovedPermanently ||
+				res.Header().Get("Location") != test.Location {
+				t.Errorf("%v: Got %v to %q, should redirect to %q", test.Host,
+					res.Code, res.Header().Get("Location"), test.Location)
+			}
+			continue
+		}
+		if body := res.Body.String(); body != test.Body {
+			t.Errorf("%v: Served by %q, should be %q", test.Host, body, test.Body)
+		}
+	}
+}
+
+func TestSiteTLSConfig(t *testing.T) {
+	certA, certB := new(tls.Certificate), new(tls.Certificate)
+	config := siteTLSConfig(
+		hostTable{"example.com:8443": "a", "*.example.net": "b", "c.com": "c"},
+		hostTable{"example.org": "a", "www.example.net": "a"},
+		map[string]*tls.Certificate{"a": certA, "b": certB})
+	tests := []struct {
+		Name string
+		Cert *tls.Certificate
+	}{
+		{"example.com", certA},
+		{"example.org", certA},
+		{"www.example.net", certA},
+		{"shop.example.net", certB},
+		{"c.com", nil},
+		{"unknown.com", nil},
+	}
+	for _, test := range tests {
+		cert, err := config.GetCertificate(&tls.ClientHelloInfo{
+			ServerName: test.Name})
+		if cert != test.Cert || (err == nil) != (test.Cert != nil) {
+			t.Errorf("GetCertificate(%q) = %p, %v, should be %p", test.Name, cert,
+				err, test.Cert)
+		}
+	}
+}
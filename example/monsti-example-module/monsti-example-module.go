@@ -17,29 +17,74 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
 
 	"pkg.monsti.org/monsti/api/service"
 	"pkg.monsti.org/monsti/api/util"
 	"pkg.monsti.org/monsti/api/util/module"
 )
 
-var availableLocales = []string{"de", "en"}
+// priceFieldType is a field type for prices, stored in cents.
+type priceFieldType struct{}
+
+// cents returns the cents of the given price value.
+func (priceFieldType) cents(value []byte) int {
+	var cents int
+	if value != nil {
+		json.Unmarshal(value, &cents)
+	}
+	return cents
+}
+
+func (p priceFieldType) String(value []byte, _ *service.NodeField) (
+	string, error) {
+	cents := p.cents(value)
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100), nil
+}
+
+func (p priceFieldType) RenderHTML(value []byte, field *service.NodeField) (
+	string, error) {
+	price, _ := p.String(value, field)
+	return fmt.Sprintf(`<span class="price">%v &euro;</span>`, price), nil
+}
+
+func (p priceFieldType) FormWidget(value []byte, field *service.NodeField,
+	locale string) (*service.FieldWidget, error) {
+	price, _ := p.String(value, field)
+	return &service.FieldWidget{Value: price,
+		Description: "Price in Euro, e.g. 12.50"}, nil
+}
+
+func (priceFieldType) Parse(formValue string, _ *service.NodeField,
+	locale string) ([]byte, string, error) {
+	price, err := strconv.ParseFloat(strings.TrimSpace(formValue), 64)
+	if err != nil || price < 0 {
+		return nil, "Please enter a price like 12.50.", nil
+	}
+	value, err := json.Marshal(int(price*100 + 0.5))
+	return value, "", err
+}
 
 func setup(c *module.ModuleContext) error {
 	G := func(in string) string { return in }
 	m := c.Session.Monsti()
+	availableLocales, err := m.GetAvailableLocales()
+	if err != nil {
+		return fmt.Errorf("Could not get available locales: %v", err)
+	}
 
 	// Register a new node type
 	nodeType := service.NodeType{
-		Id:        "example.ExampleType",
-		AddableTo: []string{"."},
-		Name:      util.GenLanguageMap(G("Example node type"), availableLocales),
+		Id:   "example.ExampleType",
+		Name: util.GenLanguageMap(G("Example node type"), availableLocales),
+		// Inherit core.Title, core.Body and AddableTo of core.Document.
+		Extends: "core.Document",
 		Fields: []*service.NodeField{
-			// core.Title and core.Body are already known to the system,
-			// just specify their IDs to include them.
-			{Id: "core.Title"},
-			{Id: "core.Body"},
 			{
 				Id:   "example.Foo",
 				Name: util.GenLanguageMap(G("Foo"), availableLocales),
@@ -50,8 +95,28 @@ func setup(c *module.ModuleContext) error {
 				Name: util.GenLanguageMap(G("Bar"), availableLocales),
 				Type: "DateTime",
 			},
+			{
+				Id:   "example.Price",
+				Name: util.GenLanguageMap(G("Price"), availableLocales),
+				Type: "example.Price",
+			},
+			{
+				Id:      "example.WordCount",
+				Name:    util.GenLanguageMap(G("Word count"), availableLocales),
+				Type:    "Text",
+				Compute: "example.WordCount",
+			},
 		},
 	}
+	// Provide the example.Price field type
+	err = service.ServeFieldTypes(m,
+		c.Settings.GetServicePath("example-module-fields"),
+		map[string]service.FieldType{"example.Price": priceFieldType{}},
+		c.Logger)
+	if err != nil {
+		c.Logger.Fatalf("Could not serve field types: %v", err)
+	}
+
 	if err := m.RegisterNodeType(&nodeType); err != nil {
 		c.Logger.Fatalf("Could not register %q node type: %v", nodeType.Id, err)
 	}
@@ -80,6 +145,106 @@ func setup(c *module.ModuleContext) error {
 		c.Logger.Fatalf("Could not add signal handler: %v", err)
 	}
 
+	// Compute the word count of example nodes when they get saved
+	computeHandler := service.NewComputeFieldHandler(
+		func(args service.ComputeFieldArgs) (interface{}, error) {
+			if args.Compute != "example.WordCount" {
+				return nil, nil
+			}
+			count := len(strings.Fields(args.Values["example.Foo"]))
+			return fmt.Sprintf("%v", count), nil
+		})
+	if err := m.AddSignalHandler(computeHandler); err != nil {
+		c.Logger.Fatalf("Could not add signal handler: %v", err)
+	}
+
+	// Provide the template function exampleShout to all templates, e.g.
+	// {{exampleShout "hello"}}
+	if err := m.RegisterTemplateFunc(&service.TemplateFunc{
+		Name: "exampleShout", Sandboxed: true}); err != nil {
+		c.Logger.Fatalf("Could not register template function: %v", err)
+	}
+	templateFuncHandler := service.NewTemplateFuncHandler(
+		func(args service.TemplateFuncArgs) (interface{}, error) {
+			if args.Name != "exampleShout" {
+				return nil, nil
+			}
+			return strings.ToUpper(strings.Join(args.Args, " ")) + "!", nil
+		})
+	if err := m.AddSignalHandler(templateFuncHandler); err != nil {
+		c.Logger.Fatalf("Could not add signal handler: %v", err)
+	}
+
+	// Expand the shortcode [shout hello] in HTML fields.
+	if err := m.RegisterShortcode(&service.Shortcode{Name: "shout"}); err != nil {
+		c.Logger.Fatalf("Could not register shortcode: %v", err)
+	}
+	shortcodeHandler := service.NewShortcodeHandler(
+		func(args service.ShortcodeArgs) (string, bool, error) {
+			if args.Name != "shout" {
+				return "", false, nil
+			}
+			shout := strings.ToUpper(strings.Join(args.Args, " ")) + "!"
+			return "<strong>" + html.EscapeString(shout) + "</strong>", true, nil
+		})
+	if err := m.AddSignalHandler(shortcodeHandler); err != nil {
+		c.Logger.Fatalf("Could not add signal handler: %v", err)
+	}
+
+	// Log the number of top level nodes of each site every night.
+	if err := m.RegisterTask(&service.Task{Id: "example.CountNodes",
+		Schedule: "0 3 * * *", PerSite: true}); err != nil {
+		c.Logger.Fatalf("Could not register task: %v", err)
+	}
+	taskHandler := service.NewRunTaskHandler(
+		func(args service.RunTaskArgs) (bool, error) {
+			if args.Task != "example.CountNodes" {
+				return false, nil
+			}
+			session, err := c.Sessions.New()
+			if err != nil {
+				return true, fmt.Errorf("Could not get session: %v", err)
+			}
+			defer c.Sessions.Free(session)
+			children, err := session.Monsti().GetChildren(args.Site, "/")
+			if err != nil {
+				return true, err
+			}
+			c.Logger.Printf("Site %q has %v top level nodes", args.Site,
+				len(children))
+			return true, nil
+		})
+	if err := m.AddSignalHandler(taskHandler); err != nil {
+		c.Logger.Fatalf("Could not add signal handler: %v", err)
+	}
+
+	// Serve /example/hello on all sites.
+	hello := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, err := c.Sessions.New()
+		if err != nil {
+			http.Error(w, "Could not get session", http.StatusInternalServerError)
+			return
+		}
+		defer c.Sessions.Free(session)
+		req, err := session.Monsti().GetRouteRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		name := "stranger"
+		if req.Session.User != nil {
+			name = req.Session.User.Name
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "Hello %v! This is site %v.\n", name, req.Site)
+	})
+	if err := service.ServeRoutes(m,
+		c.Settings.GetServicePath("example-module-routes"),
+		[]*service.Route{{Prefix: "/example/hello"}}, hello,
+		c.Logger); err != nil {
+		c.Logger.Fatalf("Could not serve routes: %v", err)
+	}
+
 	return nil
 }
 
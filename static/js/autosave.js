@@ -0,0 +1,35 @@
+(function() {
+  // Interval between autosaves in milliseconds.
+  var interval = 30000;
+
+  // Returns the encoded values of the form, without files.
+  function formValues(form) {
+    if (window.tinymce) {
+      tinymce.triggerSave();
+    }
+    return form.find(":input").not("[type=file], button").serialize();
+  }
+
+  // Periodically saves drafts of edit forms marked with
+  // data-autosave if their values changed.
+  $(document).ready(function () {
+    $("form[data-autosave]").each(function() {
+      var form = $(this);
+      var saved = formValues(form);
+      var submitted = false;
+      form.submit(function() {
+        submitted = true;
+      });
+      window.setInterval(function() {
+        var values = formValues(form);
+        if (submitted || values == saved) {
+          return;
+        }
+        $.post(form.attr("action") || window.location.pathname,
+               values + "&Autosave=1", function() {
+          saved = values;
+        });
+      }, interval);
+    });
+  });
+})();
@@ -0,0 +1,8 @@
+(function() {
+  // Asks before removing blocks. Blocks are ordered by sortable.js.
+  $(document).ready(function () {
+    $("table.block-list").on("click", "button[name=Remove]", function () {
+      return window.confirm($(this).data("confirm"));
+    });
+  });
+})();
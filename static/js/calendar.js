@@ -0,0 +1,21 @@
+(function() {
+  // Reschedule nodes by dragging calendar entries to another day.
+  $(document).ready(function () {
+    var form = $("#calendar-reschedule");
+    if (form.length == 0) {
+      return;
+    }
+    $(".calendar-entry").attr("draggable", "true").on("dragstart", function (e) {
+      e.originalEvent.dataTransfer.setData("text", $(this).data("node"));
+    });
+    $(".calendar-day").on("dragover", function (e) {
+      e.preventDefault();
+    }).on("drop", function (e) {
+      e.preventDefault();
+      form.find("input[name=Node]").val(
+        e.originalEvent.dataTransfer.getData("text"));
+      form.find("input[name=Date]").val($(this).data("date"));
+      form.submit();
+    });
+  });
+})();
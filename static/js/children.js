@@ -0,0 +1,28 @@
+(function() {
+  // Selects children and shows the inputs of the chosen batch action
+  // on the children page.
+  $(document).ready(function () {
+    $("form.children-form").each(function() {
+      var form = $(this);
+      var op = form.find("select[name=Op]");
+      form.find("input.select-all").change(function() {
+        form.find("input[name=Selected]").prop("checked", this.checked);
+      });
+      function showTargets() {
+        form.find("input[name=Target]").toggle(op.val() == "move");
+        form.find("select[name=NodeType]").toggle(op.val() == "changetype");
+      }
+      op.change(showTargets);
+      showTargets();
+      form.find("button[name=Batch]").click(function() {
+        if (form.find("input[name=Selected]:checked").length == 0) {
+          return false;
+        }
+        if (op.val() == "remove") {
+          return window.confirm($(this).data("confirm"));
+        }
+        return true;
+      });
+    });
+  });
+})();
@@ -1,10 +1,67 @@
 (function() {
-  $(document).ready(function () {
-    tinymce.init({
-      selector: ".html-field textarea",
-      plugins: "anchor autosave code hr image visualchars visualblocks table paste media link",
-      tools: "inserttable",
-      height: 300,
+  // Default settings of the editor. Sites may override them with the
+  // core.editor.tinymce configuration, see blocks/headers-edit.
+  var defaults = {
+    selector: ".html-field textarea",
+    plugins: "anchor autosave code hr image visualchars visualblocks table paste media link",
+    tools: "inserttable",
+    toolbar: "undo redo | styleselect | bold italic | alignleft aligncenter alignright alignjustify | bullist numlist outdent indent | link image mediaimage",
+    height: 300,
+  };
+
+  // Shows the images of the media library. The selected image gets
+  // inserted into the editor as responsive markup.
+  function searchImages(editor, dialog, config, query) {
+    $.getJSON("/@@media", {format: "json", type: "core.Image", q: query},
+              function(items) {
+      dialog.empty();
+      var search = $('<input type="search"/>').val(query);
+      search.keypress(function(e) {
+        if (e.which == 13) {
+          searchImages(editor, dialog, config, search.val());
+          return false;
+        }
+      });
+      var entries = $('<ul class="media-items"/>');
+      $.each(items, function(i, item) {
+        var entry = $("<li/>");
+        entry.append($("<img/>").attr("src", item.Path + "/_sizes/thumbnail")
+                     .attr("alt", item.AltText), " ",
+                     $("<span/>").text(item.Title), " ",
+                     $("<small/>").text((item.Tags || []).join(", ")));
+        var select = $('<button type="button">+</button>');
+        select.click(function() {
+          $.get("/@@media", {format: "markup", node: item.Path,
+                             sizes: config.imageSizes || ""}, function(markup) {
+            editor.insertContent(markup);
+            dialog.hide();
+          });
+        });
+        entries.append(entry.append(" ", select));
+      });
+      var close = $('<button type="button">&times;</button>');
+      close.click(function() {
+        dialog.hide();
+      });
+      dialog.append(close, search, entries).show();
+      search.focus();
     });
+  }
+
+  $(document).ready(function () {
+    var config = window.monstiEditor || {};
+    var settings = $.extend({}, defaults, config.options || {});
+    settings.setup = function(editor) {
+      var dialog = $('<div class="node-browser"/>').hide();
+      $(editor.getElement()).after(dialog);
+      editor.addButton("mediaimage", {
+        icon: "image",
+        tooltip: "Insert image from media library",
+        onclick: function() {
+          searchImages(editor, dialog, config, "");
+        }
+      });
+    };
+    tinymce.init(settings);
   });
 })();
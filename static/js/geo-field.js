@@ -0,0 +1,41 @@
+(function() {
+  $(document).ready(function () {
+    $(".geo-field input").each(function() {
+      var input = $(this);
+      var container = $('<div class="geo-field-map"/>');
+      input.after(container);
+      var parts = input.val().split(",");
+      var lat = parseFloat(parts[0]) || 0;
+      var lng = parseFloat(parts[1]) || 0;
+      var zoom = parseInt(parts[2], 10) || (lat || lng ? 15 : 2);
+      var map = L.map(container[0]).setView([lat, lng], zoom);
+      L.tileLayer("https://{s}.tile.openstreetmap.org/{z}/{x}/{y}.png", {
+        attribution: '&copy; <a href="https://www.openstreetmap.org/copyright">OpenStreetMap</a>'
+      }).addTo(map);
+      var marker = L.marker([lat, lng], {draggable: true}).addTo(map);
+      function update() {
+        var pos = marker.getLatLng();
+        input.val(pos.lat.toFixed(6) + "," + pos.lng.toFixed(6) + "," +
+                  map.getZoom());
+      }
+      map.on("click", function(e) {
+        marker.setLatLng(e.latlng);
+        update();
+      });
+      marker.on("dragend", update);
+      map.on("zoomend", function() {
+        if (input.val()) {
+          update();
+        }
+      });
+      input.change(function() {
+        var parts = input.val().split(",");
+        var pos = [parseFloat(parts[0]), parseFloat(parts[1])];
+        if (!isNaN(pos[0]) && !isNaN(pos[1])) {
+          marker.setLatLng(pos);
+          map.setView(pos, parseInt(parts[2], 10) || map.getZoom());
+        }
+      });
+    });
+  });
+})();
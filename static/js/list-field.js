@@ -0,0 +1,92 @@
+(function() {
+  // Builds an input for a sub field of a list row.
+  function subInput(field, value) {
+    var input;
+    switch (field.Type) {
+    case "HTMLArea":
+      input = $("<textarea/>").val(value || "");
+      break;
+    case "DateTime":
+      input = $('<input type="datetime-local"/>');
+      if (value && value.length >= 16 && value.substr(0, 4) != "0001") {
+        input.val(value.substr(0, 16));
+      }
+      break;
+    case "Date":
+      input = $('<input type="date"/>').val(value || "");
+      break;
+    case "Time":
+      input = $('<input type="time"/>').val(value || "");
+      break;
+    case "Select":
+      input = $("<select/>");
+      $.each(field.Options || [], function(i, option) {
+        input.append($("<option/>").val(option.Value).text(option.Label));
+      });
+      if (value) {
+        input.val(value);
+      }
+      break;
+    default:
+      input = $('<input type="text"/>').val(value || "");
+    }
+    return input.attr("data-field", field.Id);
+  }
+
+  // Reads the value of a sub field input.
+  function subValue(field, input) {
+    var value = input.val();
+    if (field.Type == "DateTime") {
+      return value ? value + ":00Z" : "0001-01-01T00:00:00Z";
+    }
+    return value;
+  }
+
+  function addRow(table, fields, row) {
+    var tr = $("<tr/>");
+    $.each(fields, function(i, field) {
+      tr.append($("<td/>").append(subInput(field, row[field.Id])));
+    });
+    var remove = $('<button type="button">Remove</button>');
+    remove.click(function() {
+      tr.remove();
+    });
+    tr.append($("<td/>").append(remove));
+    table.append(tr);
+  }
+
+  $(document).ready(function () {
+    $(".list-field input[type=hidden]").each(function() {
+      var hidden = $(this);
+      var data = $.parseJSON(hidden.val());
+      var table = $('<table class="list-field"/>');
+      var head = $("<tr/>");
+      $.each(data.Fields, function(i, field) {
+        head.append($("<th/>").text(field.Name));
+      });
+      head.append("<th/>");
+      table.append(head);
+      $.each(data.Rows || [], function(i, row) {
+        addRow(table, data.Fields, row);
+      });
+      var add = $('<button type="button">Add row</button>');
+      add.click(function() {
+        addRow(table, data.Fields, {});
+      });
+      hidden.after(table, add);
+      hidden.closest("form").submit(function() {
+        var rows = [];
+        table.find("tr").slice(1).each(function() {
+          var tr = $(this);
+          var row = {};
+          $.each(data.Fields, function(i, field) {
+            row[field.Id] = subValue(field,
+              tr.find('[data-field="' + field.Id + '"]'));
+          });
+          rows.push(row);
+        });
+        hidden.val(JSON.stringify({Rows: rows}));
+      });
+    });
+  });
+})();
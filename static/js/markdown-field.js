@@ -0,0 +1,28 @@
+(function() {
+  $(document).ready(function () {
+    $(".markdown-field textarea").each(function() {
+      var textarea = $(this);
+      var preview = $('<div class="markdown-preview"/>').hide();
+      var write = $('<a href="#" class="active">Write</a>');
+      var show = $('<a href="#">Preview</a>');
+      var tabs = $('<p class="markdown-tabs"/>').append(write, " ", show);
+      textarea.before(tabs).after(preview);
+      write.click(function() {
+        preview.hide();
+        textarea.show();
+        show.removeClass("active");
+        write.addClass("active");
+        return false;
+      });
+      show.click(function() {
+        $.post("@@markdown-preview", {Source: textarea.val()}, function(html) {
+          preview.html(html).show();
+          textarea.hide();
+          write.removeClass("active");
+          show.addClass("active");
+        });
+        return false;
+      });
+    });
+  });
+})();
@@ -0,0 +1,22 @@
+(function() {
+  // Adds and removes menu entries. Entries are ordered by sortable.js.
+  $(document).ready(function () {
+    var entries = $("table.menu-entries tbody");
+    if (entries.length == 0) {
+      return;
+    }
+    entries.on("click", ".menu-entry-remove", function () {
+      var row = $(this).closest("tr");
+      if (entries.find("tr").length > 1) {
+        row.remove();
+      } else {
+        row.find("input").val("");
+      }
+    });
+    $(".menu-entry-add").click(function () {
+      var row = entries.find("tr:last").clone();
+      row.find("input").val("");
+      entries.append(row);
+    });
+  });
+})();
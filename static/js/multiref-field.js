@@ -0,0 +1,131 @@
+(function() {
+  // Returns the URL of the node browser listing for the given path.
+  function browseURL(path) {
+    return (path == "/" ? "" : path) + "/@@browse";
+  }
+
+  function addItem(list, path) {
+    var item = $("<li/>").append($("<span/>").text(path));
+    item.data("path", path);
+    var up = $('<button type="button">&uarr;</button>');
+    up.click(function() {
+      item.prev().before(item);
+    });
+    var down = $('<button type="button">&darr;</button>');
+    down.click(function() {
+      item.next().after(item);
+    });
+    var remove = $('<button type="button">&times;</button>');
+    remove.click(function() {
+      item.remove();
+    });
+    item.append(up, down, remove);
+    list.append(item);
+  }
+
+  // Shows the node browser at the given path. Selected nodes get
+  // added to the list.
+  function browse(dialog, list, path) {
+    $.getJSON(browseURL(path), function(listing) {
+      dialog.empty();
+      var entries = $("<ul/>");
+      if (listing.Parent) {
+        var parent = $('<a href="#">..</a>');
+        parent.click(function() {
+          browse(dialog, list, listing.Parent);
+          return false;
+        });
+        entries.append($("<li/>").append(parent));
+      }
+      $.each([listing].concat(listing.Children), function(i, node) {
+        var entry = $("<li/>");
+        if (i == 0) {
+          entry.append($("<strong/>").text(node.Title));
+        } else {
+          var link = $('<a href="#"/>').text(node.Title);
+          link.click(function() {
+            browse(dialog, list, node.Path);
+            return false;
+          });
+          entry.append(link);
+        }
+        entry.append(" ", $("<small/>").text(node.Path + " (" + node.Type + ")"));
+        var select = $('<button type="button">+</button>');
+        select.click(function() {
+          addItem(list, node.Path);
+        });
+        entries.append(entry.append(" ", select));
+      });
+      var close = $('<button type="button">&times;</button>');
+      close.click(function() {
+        dialog.hide();
+      });
+      dialog.append(close, entries).show();
+    });
+  }
+
+  // Shows the media library search. Selected items get added to the
+  // list.
+  function searchMedia(dialog, list, query) {
+    $.getJSON("/@@media", {format: "json", q: query}, function(items) {
+      dialog.empty();
+      var search = $('<input type="search"/>').val(query);
+      search.keypress(function(e) {
+        if (e.which == 13) {
+          searchMedia(dialog, list, search.val());
+          return false;
+        }
+      });
+      var entries = $('<ul class="media-items"/>');
+      $.each(items, function(i, item) {
+        var entry = $("<li/>");
+        if (item.Type == "core.Image") {
+          entry.append($("<img/>").attr("src", item.Path + "/_sizes/thumbnail")
+                       .attr("alt", item.AltText), " ");
+        }
+        entry.append($("<span/>").text(item.Title), " ",
+                     $("<small/>").text(item.Path + " " + (item.Tags || []).join(", ")));
+        var select = $('<button type="button">+</button>');
+        select.click(function() {
+          addItem(list, item.Path);
+        });
+        entries.append(entry.append(" ", select));
+      });
+      var close = $('<button type="button">&times;</button>');
+      close.click(function() {
+        dialog.hide();
+      });
+      dialog.append(close, search, entries).show();
+      search.focus();
+    });
+  }
+
+  $(document).ready(function () {
+    $(".multiref-field input[type=hidden]").each(function() {
+      var hidden = $(this);
+      var list = $('<ol class="multiref-field"/>');
+      $.each(hidden.val().split("\n"), function(i, path) {
+        if (path) {
+          addItem(list, path);
+        }
+      });
+      var dialog = $('<div class="node-browser"/>').hide();
+      var open = $('<button type="button">Browse</button>');
+      open.click(function() {
+        browse(dialog, list, "/");
+      });
+      var media = $('<button type="button">Media library</button>');
+      media.click(function() {
+        searchMedia(dialog, list, "");
+      });
+      hidden.after(list, open, media, dialog);
+      hidden.closest("form").submit(function() {
+        var paths = [];
+        list.children().each(function() {
+          paths.push($(this).data("path"));
+        });
+        hidden.val(paths.join("\n"));
+      });
+    });
+  });
+})();
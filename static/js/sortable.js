@@ -0,0 +1,24 @@
+(function() {
+  // Orders the rows of sortable tables by dragging them.
+  $(document).ready(function () {
+    var dragged = null;
+    $("table.sortable tbody").on("dragstart", "tr", function (e) {
+      dragged = this;
+      e.originalEvent.dataTransfer.setData("text", "");
+    }).on("dragover", "tr", function (e) {
+      e.preventDefault();
+      if (dragged == null || dragged == this ||
+          $(dragged).parent()[0] != $(this).parent()[0]) {
+        return;
+      }
+      if ($(dragged).index() < $(this).index()) {
+        $(this).after(dragged);
+      } else {
+        $(this).before(dragged);
+      }
+    }).on("drop dragend", function (e) {
+      e.preventDefault();
+      dragged = null;
+    });
+  });
+})();
@@ -0,0 +1,248 @@
+(function() {
+  // Site tree of the admin UI. Children are loaded on expanding a node.
+  // Nodes are moved and ordered by drag and drop, renamed by double
+  // clicking their name and cut or copied to be pasted below another
+  // node. The clipboard is kept in the session storage.
+  $(document).ready(function () {
+    $("ul.site-tree").each(function() {
+      var tree = $(this);
+      var error = tree.siblings(".site-tree-error");
+      var dragged = null;
+      var clipboardKey = "monsti-tree-clipboard";
+
+      function showError(xhr) {
+        var message = xhr.statusText;
+        if (xhr.responseJSON && xhr.responseJSON.Error) {
+          message = xhr.responseJSON.Error;
+        }
+        error.text(message).show();
+      }
+
+      function change(data) {
+        error.hide();
+        return $.ajax({url: "/@@tree", type: "POST", data: data,
+                       traditional: true, dataType: "json"}).fail(showError);
+      }
+
+      function entry(node) {
+        var item = $('<li class="tree-node"><div class="tree-entry" ' +
+                     'draggable="true"><span class="tree-toggle"></span>' +
+                     '<a class="tree-title"></a> <span class="tree-name">' +
+                     '</span> <span class="tree-actions"></span></div>' +
+                     '<ul class="tree-children"></ul></li>');
+        item.find(".tree-actions").append(
+          tree.find("li.tree-root .tree-actions").children().clone());
+        item.attr("data-path", node.Path);
+        item.find(".tree-entry").addClass(
+          "tree-type-" + node.TypeId.replace(/\./g, "-")).attr("title", node.Type);
+        item.find(".tree-title").text(node.Title || node.Name).attr(
+          "href", (node.Path == "/" ? "" : node.Path) + "/@@edit");
+        item.find(".tree-name").text(node.Name);
+        item.toggleClass("tree-unpublished", !node.Public);
+        return item;
+      }
+
+      // load fetches and shows the children of the given tree node.
+      function load(item) {
+        var list = item.children(".tree-children");
+        return $.getJSON("/@@tree", {format: "json", node: item.data("path")},
+                         function(children) {
+          list.empty();
+          $.each(children, function(i, child) {
+            list.append(entry(child));
+          });
+          item.addClass("tree-expanded tree-loaded");
+          setClipboard(getClipboard());
+        }).fail(showError);
+      }
+
+      function reload(path) {
+        var item = tree.find("li.tree-node").filter(function() {
+          return $(this).data("path") == path;
+        });
+        if (item.length > 0 && item.hasClass("tree-loaded")) {
+          load(item);
+        }
+      }
+
+      function parentPath(path) {
+        var parent = path.substring(0, path.lastIndexOf("/"));
+        return parent == "" ? "/" : parent;
+      }
+
+      function baseName(path) {
+        return path.substring(path.lastIndexOf("/") + 1);
+      }
+
+      tree.on("click", ".tree-toggle", function() {
+        var item = $(this).closest("li.tree-node");
+        if (item.hasClass("tree-expanded")) {
+          item.removeClass("tree-expanded");
+        } else if (item.hasClass("tree-loaded")) {
+          item.addClass("tree-expanded");
+        } else {
+          load(item);
+        }
+      });
+
+      function getClipboard() {
+        var value = window.sessionStorage.getItem(clipboardKey);
+        return value ? JSON.parse(value) : null;
+      }
+
+      function setClipboard(clipboard) {
+        if (clipboard) {
+          window.sessionStorage.setItem(clipboardKey, JSON.stringify(clipboard));
+        } else {
+          window.sessionStorage.removeItem(clipboardKey);
+        }
+        tree.toggleClass("tree-clipboard-filled", clipboard != null);
+        tree.find("li.tree-node").removeClass("tree-cut");
+        if (clipboard && clipboard.Mode == "cut") {
+          tree.find("li.tree-node").filter(function() {
+            return $(this).data("path") == clipboard.Node;
+          }).addClass("tree-cut");
+        }
+      }
+
+      tree.on("click", ".tree-cut-button, .tree-copy-button", function() {
+        setClipboard({
+          Mode: $(this).hasClass("tree-cut-button") ? "cut" : "copy",
+          Node: $(this).closest("li.tree-node").data("path")});
+      });
+
+      // paste pastes the node of the clipboard below the given parent.
+      // If the node's name is taken, the user is asked to paste it with
+      // another name.
+      function paste(parent, conflict) {
+        var clipboard = getClipboard();
+        error.hide();
+        $.ajax({url: "/@@tree", type: "POST", dataType: "json",
+                data: {Op: "paste", Node: clipboard.Node, Target: parent,
+                       Mode: clipboard.Mode, Conflict: conflict}})
+          .done(function() {
+            if (clipboard.Mode == "cut") {
+              setClipboard(null);
+              reload(parentPath(clipboard.Node));
+            }
+            reload(parent);
+          })
+          .fail(function(xhr) {
+            if (xhr.status == 409 && window.confirm(xhr.responseJSON.Error +
+                                                    " " + tree.data("conflict"))) {
+              paste(parent, "rename");
+              return;
+            }
+            showError(xhr);
+          });
+      }
+
+      tree.on("click", ".tree-paste-button", function() {
+        if (getClipboard() != null) {
+          paste($(this).closest("li.tree-node").data("path"), "");
+        }
+      });
+
+      tree.on("dblclick", ".tree-name", function() {
+        var item = $(this).closest("li.tree-node");
+        var path = item.data("path");
+        var name = window.prompt(tree.data("rename"), baseName(path));
+        if (!name || name == baseName(path)) {
+          return;
+        }
+        change({Op: "rename", Node: path, Name: name}).done(function() {
+          reload(parentPath(path));
+        });
+      });
+
+      // position returns where the dragged node would be dropped
+      // relative to the given entry: "before", "after" or "into".
+      function position(target, event) {
+        var offset = event.originalEvent.pageY - target.offset().top;
+        var height = target.outerHeight();
+        if (target.closest("li.tree-node").hasClass("tree-root")) {
+          return "into";
+        }
+        if (offset < height / 4) {
+          return "before";
+        }
+        if (offset > height * 3 / 4) {
+          return "after";
+        }
+        return "into";
+      }
+
+      tree.on("dragstart", ".tree-entry", function(event) {
+        dragged = $(this).closest("li.tree-node");
+        event.originalEvent.dataTransfer.effectAllowed = "move";
+        event.originalEvent.dataTransfer.setData("text", dragged.data("path"));
+      });
+
+      tree.on("dragend", ".tree-entry", function() {
+        dragged = null;
+        tree.find(".tree-entry").removeClass("drop-before drop-after drop-into");
+      });
+
+      tree.on("dragover", ".tree-entry", function(event) {
+        var target = $(this).closest("li.tree-node");
+        if (dragged == null || $.contains(dragged[0], target[0]) ||
+            dragged[0] == target[0]) {
+          return;
+        }
+        event.preventDefault();
+        $(this).removeClass("drop-before drop-after drop-into").addClass(
+          "drop-" + position($(this), event));
+      });
+
+      tree.on("dragleave", ".tree-entry", function() {
+        $(this).removeClass("drop-before drop-after drop-into");
+      });
+
+      tree.on("drop", ".tree-entry", function(event) {
+        event.preventDefault();
+        $(this).removeClass("drop-before drop-after drop-into");
+        if (dragged == null) {
+          return;
+        }
+        var node = dragged;
+        var target = $(this).closest("li.tree-node");
+        var where = position($(this), event);
+        var from = parentPath(node.data("path"));
+        var parent = where == "into" ? target.data("path") :
+            parentPath(target.data("path"));
+        var moved = $.Deferred().resolve({Path: node.data("path")});
+        if (parent != from) {
+          moved = change({Op: "move", Node: node.data("path"), Target: parent});
+        }
+        moved.done(function(result) {
+          if (where == "into") {
+            reload(from);
+            reload(parent);
+            return;
+          }
+          var siblings = [];
+          target.parent().children("li.tree-node").each(function() {
+            var path = $(this).data("path");
+            if (path == node.data("path")) {
+              return;
+            }
+            if (path == target.data("path") && where == "before") {
+              siblings.push(result.Path);
+            }
+            siblings.push(path);
+            if (path == target.data("path") && where == "after") {
+              siblings.push(result.Path);
+            }
+          });
+          change({Op: "order", Node: parent, Child: siblings})
+            .always(function() {
+              reload(from);
+              reload(parent);
+            });
+        });
+      });
+
+      load(tree.children("li.tree-root"));
+    });
+  });
+})();
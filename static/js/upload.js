@@ -0,0 +1,91 @@
+(function() {
+  // Size of the chunks sent to the server.
+  var chunkSize = 1024 * 1024;
+  // Number of retries of failed chunks before giving up.
+  var maxRetries = 5;
+
+  // Uploads the file in chunks to the given upload URL starting at the
+  // given offset. Calls progress with the number of sent bytes and
+  // done when finished or failed.
+  function sendChunks(url, file, offset, retries, progress, done) {
+    if (offset >= file.size) {
+      done(true);
+      return;
+    }
+    $.ajax({
+      url: url,
+      type: "PATCH",
+      data: file.slice(offset, offset + chunkSize),
+      processData: false,
+      contentType: "application/offset+octet-stream",
+      headers: {"Upload-Offset": String(offset)}
+    }).done(function(data, status, xhr) {
+      offset = parseInt(xhr.getResponseHeader("Upload-Offset"), 10);
+      progress(offset);
+      sendChunks(url, file, offset, maxRetries, progress, done);
+    }).fail(function() {
+      if (retries <= 0) {
+        done(false);
+        return;
+      }
+      // Resume at the offset known to the server.
+      setTimeout(function() {
+        $.ajax({url: url, type: "HEAD", cache: false}).done(
+          function(data, status, xhr) {
+            offset = parseInt(xhr.getResponseHeader("Upload-Offset"), 10);
+            sendChunks(url, file, offset, retries - 1, progress, done);
+          }).fail(function() {
+            sendChunks(url, file, offset, retries - 1, progress, done);
+          });
+      }, 1000);
+    });
+  }
+
+  $(document).ready(function () {
+    $("form input[type=file]").each(function() {
+      var input = $(this);
+      var field = input.attr("name").replace(/^Fields\./, "");
+      var form = input.closest("form");
+      var progress = $('<progress class="upload-progress" value="0"/>').hide();
+      var hidden = $('<input type="hidden"/>').attr("name", "upload-" + field);
+      input.after(progress, hidden);
+      input.change(function() {
+        var file = this.files && this.files[0];
+        if (!file || !window.Blob || !file.slice) {
+          return;
+        }
+        hidden.val("");
+        form.data("uploads", (form.data("uploads") || 0) + 1);
+        progress.attr("max", file.size).val(0).show();
+        $.ajax({
+          url: "/@@upload?name=" + encodeURIComponent(file.name),
+          type: "POST",
+          headers: {"Upload-Length": String(file.size)}
+        }).done(function(data, status, xhr) {
+          var url = xhr.getResponseHeader("Location");
+          sendChunks(url, file, 0, maxRetries, function(offset) {
+            progress.val(offset);
+          }, function(ok) {
+            form.data("uploads", form.data("uploads") - 1);
+            if (ok) {
+              hidden.val(url.replace(/^.*[?&]id=/, ""));
+              // Don't send the file again with the form.
+              input.val("");
+            } else {
+              progress.hide();
+            }
+          });
+        }).fail(function() {
+          form.data("uploads", form.data("uploads") - 1);
+          progress.hide();
+        });
+      });
+    });
+    $("form").has("input[type=file]").submit(function() {
+      if ($(this).data("uploads") > 0) {
+        alert("Please wait until all files have been uploaded.");
+        return false;
+      }
+    });
+  });
+})();
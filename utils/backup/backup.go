@@ -0,0 +1,434 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+// Tool to back up site data directories to S3 compatible storages.
+//
+// Each file is stored once as encrypted object named by a keyed hash
+// of its content, so subsequent backups only upload changed files.
+// Each backup set is an encrypted manifest listing the files.
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/monsti/api/util"
+	"pkg.monsti.org/monsti/api/util/s3"
+)
+
+// store is a simple object storage.
+type store interface {
+	// Put stores the content under the given key.
+	Put(key string, content []byte) error
+	// Get returns the content stored under the given key.
+	Get(key string) ([]byte, error)
+	// List returns all keys with the given prefix.
+	List(prefix string) ([]string, error)
+	// Delete removes the given key.
+	Delete(key string) error
+}
+
+// backupSet is the manifest of a backup.
+type backupSet struct {
+	Created time.Time
+	// Files maps slash separated paths relative to the backed up
+	// directory to the files' objects.
+	Files map[string]backupFile
+}
+
+// backupFile is a file of a backup set.
+type backupFile struct {
+	// Object is the name of the object holding the file's content.
+	Object string
+	Mode   os.FileMode
+}
+
+// backup backs up directories to a store.
+type backup struct {
+	Store store
+	// Prefix is prepended to all keys, e.g. "example/".
+	Prefix string
+	// Key is used to encrypt and to name objects.
+	Key []byte
+}
+
+// objectName returns the name of the object for the given content.
+func (b *backup) objectName(content []byte) string {
+	mac := hmac.New(sha256.New, b.Key)
+	mac.Write(content)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// encrypt encrypts the content using AES-GCM.
+func (b *backup) encrypt(content []byte) ([]byte, error) {
+	block, err := aes.NewCipher(b.Key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, content, nil), nil
+}
+
+// decrypt decrypts content encrypted by encrypt.
+func (b *backup) decrypt(content []byte) ([]byte, error) {
+	block, err := aes.NewCipher(b.Key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(content) < gcm.NonceSize() {
+		return nil, fmt.Errorf("Encrypted content is too short")
+	}
+	nonce := content[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, content[gcm.NonceSize():], nil)
+}
+
+// setName returns the name of the backup set created at the given time.
+func setName(created time.Time) string {
+	return created.UTC().Format("20060102T150405Z")
+}
+
+// Backup creates a new backup set of the given directory. Only
+// objects not yet in the store get uploaded.
+//
+// Returns the name of the set and the number of uploaded objects.
+func (b *backup) Backup(dir string, now time.Time) (string, int, error) {
+	existing := make(map[string]bool)
+	objects, err := b.Store.List(b.Prefix + "objects/")
+	if err != nil {
+		return "", 0, fmt.Errorf("Could not list objects: %v", err)
+	}
+	for _, object := range objects {
+		existing[strings.TrimPrefix(object, b.Prefix+"objects/")] = true
+	}
+	set := backupSet{Created: now, Files: make(map[string]backupFile)}
+	uploaded := 0
+	err = filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		name, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("Could not read %v: %v", file, err)
+		}
+		object := b.objectName(content)
+		set.Files[filepath.ToSlash(name)] = backupFile{object, info.Mode().Perm()}
+		if existing[object] {
+			return nil
+		}
+		encrypted, err := b.encrypt(content)
+		if err != nil {
+			return fmt.Errorf("Could not encrypt %v: %v", file, err)
+		}
+		if err := b.Store.Put(b.Prefix+"objects/"+object, encrypted); err != nil {
+			return fmt.Errorf("Could not upload %v: %v", file, err)
+		}
+		existing[object] = true
+		uploaded += 1
+		return nil
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	manifest, err := json.Marshal(set)
+	if err != nil {
+		return "", 0, fmt.Errorf("Could not marshal backup set: %v", err)
+	}
+	encrypted, err := b.encrypt(manifest)
+	if err != nil {
+		return "", 0, fmt.Errorf("Could not encrypt backup set: %v", err)
+	}
+	name := setName(now)
+	if err := b.Store.Put(b.Prefix+"sets/"+name, encrypted); err != nil {
+		return "", 0, fmt.Errorf("Could not upload backup set: %v", err)
+	}
+	return name, uploaded, nil
+}
+
+// Sets returns the names of all backup sets, oldest first.
+func (b *backup) Sets() ([]string, error) {
+	keys, err := b.Store.List(b.Prefix + "sets/")
+	if err != nil {
+		return nil, fmt.Errorf("Could not list backup sets: %v", err)
+	}
+	sets := make([]string, 0, len(keys))
+	for _, key := range keys {
+		sets = append(sets, strings.TrimPrefix(key, b.Prefix+"sets/"))
+	}
+	sort.Strings(sets)
+	return sets, nil
+}
+
+// getSet downloads the named backup set.
+func (b *backup) getSet(name string) (*backupSet, error) {
+	encrypted, err := b.Store.Get(b.Prefix + "sets/" + name)
+	if err != nil {
+		return nil, fmt.Errorf("Could not download backup set: %v", err)
+	}
+	manifest, err := b.decrypt(encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decrypt backup set: %v", err)
+	}
+	set := new(backupSet)
+	if err := json.Unmarshal(manifest, set); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal backup set: %v", err)
+	}
+	return set, nil
+}
+
+// Restore restores the named backup set into the given directory.
+// If the name is empty, the latest set is restored.
+func (b *backup) Restore(name, dir string) error {
+	if len(name) == 0 {
+		sets, err := b.Sets()
+		if err != nil {
+			return err
+		}
+		if len(sets) == 0 {
+			return fmt.Errorf("There are no backup sets")
+		}
+		name = sets[len(sets)-1]
+	}
+	set, err := b.getSet(name)
+	if err != nil {
+		return err
+	}
+	for file, info := range set.Files {
+		encrypted, err := b.Store.Get(b.Prefix + "objects/" + info.Object)
+		if err != nil {
+			return fmt.Errorf("Could not download %v: %v", file, err)
+		}
+		content, err := b.decrypt(encrypted)
+		if err != nil || b.objectName(content) != info.Object {
+			return fmt.Errorf("Could not decrypt %v: %v", file, err)
+		}
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return fmt.Errorf("Could not create directory: %v", err)
+		}
+		if err := ioutil.WriteFile(path, content, info.Mode); err != nil {
+			return fmt.Errorf("Could not write %v: %v", file, err)
+		}
+	}
+	return nil
+}
+
+// Prune removes backup sets which are older than maxAge, keeping at
+// least the latest keep sets. Afterwards, objects no longer referenced
+// by any set get removed.
+//
+// Returns the names of the removed sets.
+func (b *backup) Prune(keep int, maxAge time.Duration, now time.Time) (
+	[]string, error) {
+	sets, err := b.Sets()
+	if err != nil {
+		return nil, err
+	}
+	removed := make([]string, 0)
+	referenced := make(map[string]bool)
+	for i, name := range sets {
+		created, err := time.Parse("20060102T150405Z", name)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid backup set name %q", name)
+		}
+		if i < len(sets)-keep && now.Sub(created) > maxAge {
+			if err := b.Store.Delete(b.Prefix + "sets/" + name); err != nil {
+				return nil, fmt.Errorf("Could not remove backup set: %v", err)
+			}
+			removed = append(removed, name)
+			continue
+		}
+		set, err := b.getSet(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range set.Files {
+			referenced[file.Object] = true
+		}
+	}
+	objects, err := b.Store.List(b.Prefix + "objects/")
+	if err != nil {
+		return nil, fmt.Errorf("Could not list objects: %v", err)
+	}
+	for _, object := range objects {
+		if !referenced[strings.TrimPrefix(object, b.Prefix+"objects/")] {
+			if err := b.Store.Delete(object); err != nil {
+				return nil, fmt.Errorf("Could not remove object: %v", err)
+			}
+		}
+	}
+	return removed, nil
+}
+
+// backupHooks are the hooks run around the backup and restore
+// commands.
+type backupHooks struct {
+	Backup, Restore util.OperationHooks
+}
+
+// hookEnv returns the environment of the hooks of the given operation
+// on the directory.
+func hookEnv(operation, dir, prefix string) util.HookEnv {
+	return util.HookEnv{
+		Operation: operation,
+		Values:    map[string]string{"dir": dir, "prefix": prefix}}
+}
+
+// runHooks runs the hooks of the given stage. Exits if an aborting
+// hook fails.
+func runHooks(hooks []util.Hook, env util.HookEnv, stage string,
+	logger *log.Logger) {
+	env.Stage = stage
+	if err := util.RunHooks(hooks, env, nil, logger); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %v [options] <command> [arguments]
+
+Commands:
+  backup <dir>            Back up the directory.
+  list                    List all backup sets.
+  prune                   Remove old backup sets and unused objects.
+  restore <dir> [<set>]   Restore the (latest) backup set into the directory.
+
+The credentials are read from the environment variables
+MONSTI_BACKUP_ACCESS_KEY and MONSTI_BACKUP_SECRET_KEY.
+
+The hooks file may configure commands to run before (pre) and after
+(post) the backup and restore commands.
+
+Options:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	endpoint := flag.String("endpoint", "https://s3.amazonaws.com",
+		"URL of the S3 compatible storage")
+	region := flag.String("region", "us-east-1", "Region of the storage")
+	bucket := flag.String("bucket", "", "Bucket to use")
+	prefix := flag.String("prefix", "", "Prefix of all keys, e.g. the site name")
+	keyFile := flag.String("key", "",
+		"File containing the secret used to encrypt backups")
+	keep := flag.Int("keep", 7, "Number of backup sets to keep when pruning")
+	maxAge := flag.Duration("max-age", 30*24*time.Hour,
+		"Remove older backup sets when pruning")
+	hooksFile := flag.String("hooks", "",
+		"Configuration file of the backup and restore hooks")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 || len(*bucket) == 0 || len(*keyFile) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	secret, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		log.Fatalf("Could not read key file: %v", err)
+	}
+	var hooks backupHooks
+	if len(*hooksFile) > 0 {
+		if err := util.ParseConfig(*hooksFile, &hooks); err != nil {
+			log.Fatalf("Could not load hooks: %v", err)
+		}
+	}
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	key := sha256.Sum256(secret)
+	if len(*prefix) > 0 && !strings.HasSuffix(*prefix, "/") {
+		*prefix += "/"
+	}
+	b := backup{
+		Store: &s3.Store{
+			Endpoint:  *endpoint,
+			Region:    *region,
+			Bucket:    *bucket,
+			AccessKey: os.Getenv("MONSTI_BACKUP_ACCESS_KEY"),
+			SecretKey: os.Getenv("MONSTI_BACKUP_SECRET_KEY")},
+		Prefix: *prefix,
+		Key:    key[:]}
+
+	switch args := flag.Args(); {
+	case args[0] == "backup" && len(args) == 2:
+		env := hookEnv("backup", args[1], *prefix)
+		runHooks(hooks.Backup.Pre, env, "pre", logger)
+		name, uploaded, err := b.Backup(args[1], time.Now())
+		if err != nil {
+			log.Fatalf("Could not back up: %v", err)
+		}
+		log.Printf("Created backup set %v, uploaded %v files", name, uploaded)
+		env.Values["set"] = name
+		runHooks(hooks.Backup.Post, env, "post", logger)
+	case args[0] == "list" && len(args) == 1:
+		sets, err := b.Sets()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, set := range sets {
+			fmt.Println(set)
+		}
+	case args[0] == "prune" && len(args) == 1:
+		removed, err := b.Prune(*keep, *maxAge, time.Now())
+		if err != nil {
+			log.Fatalf("Could not prune: %v", err)
+		}
+		log.Printf("Removed %v backup sets", len(removed))
+	case args[0] == "restore" && (len(args) == 2 || len(args) == 3):
+		name := ""
+		if len(args) == 3 {
+			name = args[2]
+		}
+		env := hookEnv("restore", args[1], *prefix)
+		env.Values["set"] = name
+		runHooks(hooks.Restore.Pre, env, "pre", logger)
+		if err := b.Restore(name, args[1]); err != nil {
+			log.Fatalf("Could not restore: %v", err)
+		}
+		runHooks(hooks.Restore.Post, env, "post", logger)
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,134 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+// memoryStore is a store keeping objects in memory.
+type memoryStore map[string][]byte
+
+func (m memoryStore) Put(key string, content []byte) error {
+	m[key] = content
+	return nil
+}
+
+func (m memoryStore) Get(key string) ([]byte, error) {
+	content, ok := m[key]
+	if !ok {
+		return nil, fmt.Errorf("Unknown key %q", key)
+	}
+	return content, nil
+}
+
+func (m memoryStore) List(prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	for key := range m {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (m memoryStore) Delete(key string) error {
+	delete(m, key)
+	return nil
+}
+
+func TestBackup(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/site/nodes/node.json":     `{"Type":"core.Document"}`,
+		"/site/nodes/foo/node.json": `{"Type":"core.Document"}`,
+		"/site/users.json":          `{}`,
+	}, "TestBackup")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	objects := make(memoryStore)
+	b := backup{Store: objects, Prefix: "example/",
+		Key: []byte("0123456789abcdef0123456789abcdef")}
+	site := filepath.Join(root, "site")
+	start := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	first, uploaded, err := b.Backup(site, start)
+	if err != nil {
+		t.Fatalf("Could not back up: %v", err)
+	}
+	if uploaded != 2 {
+		t.Errorf("First backup uploaded %v objects, should be 2", uploaded)
+	}
+	for key, content := range objects {
+		if strings.Contains(string(content), "core.Document") {
+			t.Errorf("Object %v is not encrypted", key)
+		}
+	}
+	err = ioutil.WriteFile(filepath.Join(site, "users.json"), []byte(`{"a":{}}`),
+		0600)
+	if err != nil {
+		t.Fatalf("Could not change file: %v", err)
+	}
+	second, uploaded, err := b.Backup(site, start.Add(48*time.Hour))
+	if err != nil {
+		t.Fatalf("Could not back up: %v", err)
+	}
+	if uploaded != 1 {
+		t.Errorf("Second backup uploaded %v objects, should be 1", uploaded)
+	}
+
+	target := filepath.Join(root, "restored")
+	if err := b.Restore(first, target); err != nil {
+		t.Fatalf("Could not restore: %v", err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(target, "users.json"))
+	if err != nil || string(content) != "{}" {
+		t.Errorf("Restored users.json is %q, %v, should be `{}`", content, err)
+	}
+	content, err = ioutil.ReadFile(filepath.Join(target, "nodes", "foo",
+		"node.json"))
+	if err != nil || string(content) != `{"Type":"core.Document"}` {
+		t.Errorf("Restored foo/node.json is %q, %v", content, err)
+	}
+
+	removed, err := b.Prune(1, 24*time.Hour, start.Add(72*time.Hour))
+	if err != nil {
+		t.Fatalf("Could not prune: %v", err)
+	}
+	if len(removed) != 1 || removed[0] != first {
+		t.Errorf("Prune removed %v, should be [%v]", removed, first)
+	}
+	if keys, _ := objects.List("example/objects/"); len(keys) != 2 {
+		t.Errorf("After pruning there are %v objects, should be 2", len(keys))
+	}
+	target = filepath.Join(root, "latest")
+	if err := b.Restore("", target); err != nil {
+		t.Fatalf("Could not restore %v: %v", second, err)
+	}
+	content, err = ioutil.ReadFile(filepath.Join(target, "users.json"))
+	if err != nil || string(content) != `{"a":{}}` {
+		t.Errorf(`Restored users.json is %q, %v, should be {"a":{}}`, content, err)
+	}
+}
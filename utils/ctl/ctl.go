@@ -0,0 +1,324 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+// Tool to administrate a running Monsti instance, e.g. in scripts.
+//
+// In contrast to the monsti tool, monsti-ctl connects to the daemon's
+// service socket, so changes take effect immediately.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"code.google.com/p/gopass"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %v [options] <command> [arguments]
+
+Commands:
+  sites                List the sites served by the daemon.
+  nodes list <site> [<path>]
+                       List the children of the node (default "/"), all
+                       nodes below with -r.
+  nodes get <site> <path>...
+                       Print the JSON documents of the nodes, including
+                       all nodes below with -r. Data files are inlined
+                       base64 encoded or written below the directory
+                       given by -files.
+  nodes put <site>     Write the nodes of the JSON documents read from
+                       standard input as printed by nodes get.
+  config get <site> <name>
+                       Print the site's configuration value as JSON, e.g.
+                       "core.cache". Use the module's id to print all of
+                       its configuration.
+  config set <site> <name> <value>
+                       Set the site's configuration value to the given
+                       JSON value.
+  user create <site> <login> <email> [<name>]
+                       Create a user with the roles given by -roles. The
+                       password is read from the environment variable
+                       MONSTI_USER_PASSWORD or asked for, unless -invite
+                       sends the user a link to choose it.
+  signal <name> [<arguments>]
+                       Emit the signal with the given JSON arguments and
+                       print the answers, e.g. signal monsti.Hook
+                       '{"Operation":"deploy","Stage":"post"}'.
+  cache flush [<site> [<path>...]]
+                       Clear the template cache and purge the given paths
+                       (default "/") of the site from caching proxies.
+  logs                 Print the latest log entries of the daemon, the
+                       last -n ones. Use -f to follow the log.
+  jobs list            List the jobs of the job queue.
+  jobs retry|remove <id>...
+                       Queue the dead jobs for another attempt or remove
+                       the jobs.
+
+Options:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// signals maps the names of the signals which may be emitted to their
+// argument and answer types.
+var signals = map[string]struct{ Args, Ret interface{} }{
+	"monsti.NodeContext":     {service.NodeContextArgs{}, map[string]string{}},
+	"monsti.RequestPayment":  {service.RequestPaymentArgs{}, service.RequestPaymentRet{}},
+	"monsti.ConfirmPayment":  {service.ConfirmPaymentArgs{}, service.ConfirmPaymentRet{}},
+	"monsti.ExperimentEvent": {service.ExperimentEventArgs{}, service.ExperimentEventRet{}},
+	"monsti.NodeTypeChanged": {service.NodeTypeChangedArgs{}, service.NodeTypeChangedRet{}},
+	"monsti.ComputeField":    {service.ComputeFieldArgs{}, service.ComputeFieldRet{}},
+	"monsti.ScanUpload":      {service.ScanUploadArgs{}, service.ScanUploadRet{}},
+	"monsti.Hook":            {service.HookArgs{}, service.HookRet{}},
+	"monsti.NewComment":      {service.NewCommentArgs{}, service.NewCommentRet{}},
+	"monsti.TemplateFunc":    {service.TemplateFuncArgs{}, service.TemplateFuncRet{}},
+	"monsti.Shortcode":       {service.ShortcodeArgs{}, service.ShortcodeRet{}},
+	"monsti.MigrateNode":     {service.MigrateNodeArgs{}, service.MigrateNodeRet{}},
+	"monsti.RunTask":         {service.RunTaskArgs{}, service.RunTaskRet{}},
+}
+
+// emitSignal emits the named signal with the JSON encoded arguments
+// and returns the JSON encoded answers.
+func emitSignal(monsti *service.MonstiClient, name, args string) ([]byte,
+	error) {
+	types, ok := signals[name]
+	if !ok {
+		names := make([]string, 0, len(signals))
+		for name := range signals {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("Unknown signal %q, known signals: %v", name,
+			strings.Join(names, ", "))
+	}
+	argsV := reflect.New(reflect.TypeOf(types.Args))
+	if err := json.Unmarshal([]byte(args), argsV.Interface()); err != nil {
+		return nil, fmt.Errorf("Could not decode arguments: %v", err)
+	}
+	ret := reflect.New(reflect.SliceOf(reflect.TypeOf(types.Ret)))
+	if err := monsti.EmitSignal(name, argsV.Elem().Interface(),
+		ret.Interface()); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(ret.Elem().Interface(), "", "  ")
+}
+
+// userPassword returns the password of a new user.
+func userPassword() (string, error) {
+	if password := os.Getenv("MONSTI_USER_PASSWORD"); password != "" {
+		return password, nil
+	}
+	password, err := gopass.GetPass("Enter password of the user: ")
+	if err != nil {
+		return "", err
+	}
+	confirmation, err := gopass.GetPass("Repeat password: ")
+	if err != nil {
+		return "", err
+	}
+	if password != confirmation {
+		return "", fmt.Errorf("Passwords do not match.")
+	}
+	return password, nil
+}
+
+// printLog prints the last lines of the daemon's log and, if follow
+// is set, new entries until interrupted.
+func printLog(monsti *service.MonstiClient, lines int, follow bool) error {
+	entries, err := monsti.GetLog(-1)
+	if err != nil {
+		return err
+	}
+	if len(entries) > lines {
+		entries = entries[len(entries)-lines:]
+	}
+	last := -1
+	for {
+		for _, entry := range entries {
+			fmt.Println(entry.Line)
+			last = entry.Seq
+		}
+		if !follow {
+			return nil
+		}
+		time.Sleep(time.Second)
+		if entries, err = monsti.GetLog(last); err != nil {
+			return err
+		}
+	}
+}
+
+func main() {
+	config := flag.String("config", ".", "Monsti's configuration directory")
+	recursive := flag.Bool("r", false, "Include all nodes below the nodes")
+	files := flag.String("files", "",
+		"Directory to write the data files of printed nodes to")
+	roles := flag.String("roles", "", "Comma separated roles of the user")
+	invite := flag.Bool("invite", false,
+		"Send the created user a link to choose a password")
+	lines := flag.Int("n", 20, "Number of log entries to print")
+	follow := flag.Bool("f", false, "Print new log entries until interrupted")
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	settings, err := util.LoadMonstiSettings(util.GetConfigPath(*config))
+	if err != nil {
+		log.Fatalf("Could not load settings: %v", err)
+	}
+	monsti, err := service.NewMonstiConnection(
+		settings.GetServicePath(service.MonstiService.String()))
+	if err != nil {
+		log.Fatalf("Could not connect to Monsti: %v", err)
+	}
+
+	switch command, args := args[0], args[1:]; {
+	case command == "sites" && len(args) == 0:
+		sites, err := monsti.ListSites()
+		if err != nil {
+			log.Fatalf("Could not list sites: %v", err)
+		}
+		for _, site := range sites {
+			fmt.Printf("%v\t%v\t%v\n", site.Name, site.Title,
+				strings.Join(site.Hosts, ", "))
+		}
+	case command == "nodes" && (len(args) == 2 || len(args) == 3) &&
+		args[0] == "list":
+		nodePath := "/"
+		if len(args) == 3 {
+			nodePath = args[2]
+		}
+		if err := listNodes(monsti, args[1], nodePath, *recursive); err != nil {
+			log.Fatalf("Could not list nodes: %v", err)
+		}
+	case command == "nodes" && len(args) >= 3 && args[0] == "get":
+		if err := getNodes(monsti, args[1], args[2:], *recursive, *files,
+			os.Stdout); err != nil {
+			log.Fatalf("Could not get nodes: %v", err)
+		}
+	case command == "nodes" && len(args) == 2 && args[0] == "put":
+		if err := putNodes(monsti, args[1], os.Stdin, func(nodePath string) {
+			log.Printf("Wrote %v", nodePath)
+		}); err != nil {
+			log.Fatalf("Could not put nodes: %v", err)
+		}
+	case command == "config" && len(args) == 3 && args[0] == "get":
+		name := args[2]
+		if !strings.Contains(name, ".") {
+			// The empty name selects the whole configuration of the module.
+			name += "."
+		}
+		var value interface{}
+		if err := monsti.GetSiteConfig(args[1], name, &value); err != nil {
+			log.Fatalf("Could not get configuration: %v", err)
+		}
+		out, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			log.Fatalf("Could not encode configuration: %v", err)
+		}
+		fmt.Printf("%s\n", out)
+	case command == "config" && len(args) == 4 && args[0] == "set":
+		var value interface{}
+		if err := json.Unmarshal([]byte(args[3]), &value); err != nil {
+			log.Fatalf("Invalid value: %v", err)
+		}
+		if err := monsti.SetSiteConfig(args[1], args[2], value); err != nil {
+			log.Fatalf("Could not set configuration: %v", err)
+		}
+	case command == "user" && (len(args) == 4 || len(args) == 5) &&
+		args[0] == "create":
+		user := service.NewUser{Login: args[2], Name: args[2], Email: args[3],
+			Invite: *invite}
+		if len(args) == 5 {
+			user.Name = args[4]
+		}
+		if *roles != "" {
+			user.Roles = strings.Split(*roles, ",")
+		}
+		if !*invite {
+			if user.Password, err = userPassword(); err != nil {
+				log.Fatalf("Could not get password: %v", err)
+			}
+		}
+		if err := monsti.CreateUser(args[1], &user); err != nil {
+			log.Fatalf("Could not create user: %v", err)
+		}
+	case command == "signal" && (len(args) == 1 || len(args) == 2):
+		signalArgs := "{}"
+		if len(args) == 2 {
+			signalArgs = args[1]
+		}
+		out, err := emitSignal(monsti, args[0], signalArgs)
+		if err != nil {
+			log.Fatalf("Could not emit signal: %v", err)
+		}
+		fmt.Printf("%s\n", out)
+	case command == "cache" && len(args) >= 1 && args[0] == "flush":
+		if err := monsti.ClearTemplateCache(); err != nil {
+			log.Fatalf("Could not clear template cache: %v", err)
+		}
+		if len(args) > 1 {
+			paths := args[2:]
+			if len(paths) == 0 {
+				paths = []string{"/"}
+			}
+			if err := monsti.PurgeCache(args[1], paths); err != nil {
+				log.Fatalf("Could not purge cache: %v", err)
+			}
+		}
+	case command == "logs" && len(args) == 0:
+		if err := printLog(monsti, *lines, *follow); err != nil {
+			log.Fatalf("Could not get log: %v", err)
+		}
+	case command == "jobs" && len(args) == 1 && args[0] == "list":
+		jobs, err := monsti.GetJobQueue()
+		if err != nil {
+			log.Fatalf("Could not get job queue: %v", err)
+		}
+		for _, job := range jobs {
+			fmt.Printf("%v\t%v\t%v\t%v\t%v/%v\t%v\n", job.Id, job.Queue,
+				job.Site, job.Status, job.Attempts, job.MaxAttempts, job.Error)
+		}
+	case command == "jobs" && len(args) >= 2 && args[0] == "retry":
+		for _, id := range args[1:] {
+			if err := monsti.RetryJob(id); err != nil {
+				log.Fatalf("Could not retry job: %v", err)
+			}
+		}
+	case command == "jobs" && len(args) >= 2 && args[0] == "remove":
+		for _, id := range args[1:] {
+			if err := monsti.RemoveJob(id); err != nil {
+				log.Fatalf("Could not remove job: %v", err)
+			}
+		}
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
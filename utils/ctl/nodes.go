@@ -0,0 +1,209 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// nodeDocument is a node as written by nodes get and read by nodes
+// put.
+type nodeDocument struct {
+	Path string
+	// Node is the node's JSON document as stored in node.json files.
+	Node json.RawMessage
+	// Files maps the names of the node's data files to their content.
+	Files map[string]*nodeFile `json:",omitempty"`
+}
+
+// nodeFile is the content of a data file, either base64 encoded or
+// stored in a sidecar file.
+type nodeFile struct {
+	Base64 string `json:",omitempty"`
+	// Path is the path of the sidecar file.
+	Path string `json:",omitempty"`
+}
+
+// walkChildren calls fn for the children of the given node and, if
+// recursive, for all nodes below.
+func walkChildren(monsti *service.MonstiClient, site, nodePath string,
+	recursive bool, fn func(*service.Node) error) error {
+	children, err := monsti.GetChildren(site, nodePath)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := fn(child); err != nil {
+			return err
+		}
+		if recursive {
+			if err := walkChildren(monsti, site, child.Path, true,
+				fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// listNodes prints the children of the given node and, if recursive,
+// all nodes below.
+func listNodes(monsti *service.MonstiClient, site, nodePath string,
+	recursive bool) error {
+	return walkChildren(monsti, site, nodePath, recursive,
+		func(child *service.Node) error {
+			title := ""
+			if field := child.GetField("core.Title"); field != nil {
+				title = field.String()
+			}
+			fmt.Printf("%v\t%v\t%v\n", child.Path, child.Type.Id, title)
+			return nil
+		})
+}
+
+// getNodes writes the documents of the given nodes and, if recursive,
+// of all nodes below to w. If sidecar is not empty, data files get
+// written to the sidecar directory instead of being inlined.
+func getNodes(monsti *service.MonstiClient, site string, paths []string,
+	recursive bool, sidecar string, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	write := func(node *service.Node) error {
+		data, err := service.MarshalNode(node)
+		if err != nil {
+			return err
+		}
+		doc := nodeDocument{Path: node.Path, Node: data}
+		names, err := monsti.GetNodeFiles(site, node.Path)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			content, err := monsti.GetNodeData(site, node.Path, name)
+			if err != nil {
+				return err
+			}
+			if doc.Files == nil {
+				doc.Files = make(map[string]*nodeFile)
+			}
+			if sidecar == "" {
+				doc.Files[name] = &nodeFile{
+					Base64: base64.StdEncoding.EncodeToString(content)}
+				continue
+			}
+			file := filepath.Join(sidecar, filepath.FromSlash(node.Path[1:]),
+				name)
+			if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+				return fmt.Errorf("Could not create sidecar directory: %v", err)
+			}
+			if err := ioutil.WriteFile(file, content, 0644); err != nil {
+				return fmt.Errorf("Could not write sidecar file: %v", err)
+			}
+			doc.Files[name] = &nodeFile{Path: file}
+		}
+		return encoder.Encode(doc)
+	}
+	for _, nodePath := range paths {
+		nodePath = path.Clean("/" + nodePath)
+		node, err := monsti.GetNode(site, nodePath)
+		if err != nil {
+			return err
+		}
+		if node == nil {
+			return fmt.Errorf("Node %v does not exist", nodePath)
+		}
+		if err := write(node); err != nil {
+			return fmt.Errorf("Could not get node %v: %v", nodePath, err)
+		}
+		if recursive {
+			if err := walkChildren(monsti, site, nodePath, true,
+				write); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// putNodes writes the nodes of the documents read from r in order,
+// calling written with the path of each written node. Relative paths
+// of sidecar files are relative to the working directory.
+func putNodes(monsti *service.MonstiClient, site string, r io.Reader,
+	written func(nodePath string)) error {
+	decoder := json.NewDecoder(r)
+	for {
+		var doc nodeDocument
+		if err := decoder.Decode(&doc); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Could not decode node: %v", err)
+		}
+		if doc.Path == "" {
+			return fmt.Errorf("Missing path of node")
+		}
+		nodePath := path.Clean("/" + doc.Path)
+		if err := putNode(monsti, site, nodePath, &doc); err != nil {
+			return fmt.Errorf("Could not put node %v: %v", nodePath, err)
+		}
+		written(nodePath)
+	}
+}
+
+// putNode writes the given node and its data files.
+func putNode(monsti *service.MonstiClient, site, nodePath string,
+	doc *nodeDocument) error {
+	node, err := monsti.UnmarshalNode(site, doc.Node)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return fmt.Errorf("Missing node")
+	}
+	// Read all files first to not write incomplete nodes.
+	files := make(map[string][]byte)
+	for name, file := range doc.Files {
+		if name == "node.json" || path.Base(name) != name {
+			return fmt.Errorf("Invalid file name %q", name)
+		}
+		if file.Path != "" {
+			files[name], err = ioutil.ReadFile(file.Path)
+		} else {
+			files[name], err = base64.StdEncoding.DecodeString(file.Base64)
+		}
+		if err != nil {
+			return fmt.Errorf("Could not read file %q: %v", name, err)
+		}
+	}
+	if err := monsti.WriteNode(site, nodePath, node); err != nil {
+		return err
+	}
+	for name, content := range files {
+		if err := monsti.WriteNodeData(site, nodePath, name,
+			content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2014 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+// Command line tool to manage and back up the sites of a Monsti
+// installation.
+//
+// The site and backup commands work on the configuration and data
+// directories, so the daemon does not need to run. Restart the daemon
+// to serve created sites. The migrate and check commands need the
+// running daemon to get the node types registered by modules.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"code.google.com/p/gopass"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+	"pkg.monsti.org/monsti/api/util/sites"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %v [options] site|backup <command> [arguments]
+       %v [options] migrate|check [<site>...]
+
+Commands:
+  site create <name>   Create the site with an administrator and a home node.
+  site remove <name>   Remove the site's configuration and all of its data.
+  site list            List all sites.
+  site clone <source> <name>
+                       Copy the site's configuration, nodes and users to a
+                       new site, replacing the domains given by -domains.
+  site promote <staging> <production>
+                       Swap the nodes of the staging and the production site.
+                       Promote again to revert. Monsti must not run.
+  backup export <site> <file>
+                       Write the site's nodes, data files, configuration and
+                       users to a tar.gz archive, "-" being standard output.
+                       Stop Monsti to get a consistent archive.
+  backup import <file> [<name>]
+                       Restore a site from an archive, "-" being standard
+                       input. The site keeps its exported name by default.
+  backup restore <file> [<name>]
+                       Restore a site from a scheduled backup. Incremental
+                       backups get applied on top of their base backups.
+  migrate [<site>...]  Migrate the nodes of the given or all sites to the
+                       schema versions of their node types. Use -dry-run
+                       to only show the migrations.
+  check [<site>...]    Check the node trees of the given or all sites for
+                       malformed nodes, unknown node types, dangling
+                       references, orphaned files and mismatching paths.
+                       Use -fix to repair what can be repaired safely.
+
+The administrator's password is read from the environment variable
+MONSTI_ADMIN_PASSWORD or asked for.
+
+Options:
+`, os.Args[0], os.Args[0])
+	flag.PrintDefaults()
+}
+
+// adminPassword returns the password of a new site's administrator.
+func adminPassword() (string, error) {
+	if password := os.Getenv("MONSTI_ADMIN_PASSWORD"); password != "" {
+		return password, nil
+	}
+	password, err := gopass.GetPass("Enter password of the administrator: ")
+	if err != nil {
+		return "", err
+	}
+	confirmation, err := gopass.GetPass("Repeat password: ")
+	if err != nil {
+		return "", err
+	}
+	if password != confirmation {
+		return "", fmt.Errorf("Passwords do not match.")
+	}
+	return password, nil
+}
+
+// migrate migrates the nodes of the given sites or, if empty, of all
+// sites using the running daemon. Progress gets logged.
+//
+// Returns false if any node could not be migrated.
+func migrate(settings *util.MonstiSettings, names []string, dryRun bool) bool {
+	monsti := connect(settings)
+	ok := true
+	for _, site := range siteNames(settings, names) {
+		pending, err := monsti.PendingMigrations(site)
+		if err != nil {
+			log.Printf("(%v) %v", site, err)
+			ok = false
+			continue
+		}
+		log.Printf("(%v) %v nodes to migrate", site, len(pending))
+		for i, node := range pending {
+			result, err := monsti.MigrateNode(site, node.Path, dryRun)
+			if err != nil {
+				log.Printf("(%v) [%v/%v] %v: %v", site, i+1, len(pending), node.Path,
+					err)
+				ok = false
+				continue
+			}
+			log.Printf("(%v) [%v/%v] %v (%v): %v -> %v: %v", site, i+1,
+				len(pending), node.Path, node.NodeType, result.From, result.To,
+				strings.Join(result.Applied, "; "))
+			if dryRun {
+				fmt.Printf("%s\n", result.Data)
+			}
+		}
+	}
+	return ok
+}
+
+// connect connects to the running daemon.
+func connect(settings *util.MonstiSettings) *service.MonstiClient {
+	monsti, err := service.NewMonstiConnection(
+		settings.GetServicePath(service.MonstiService.String()))
+	if err != nil {
+		log.Fatalf("Could not connect to Monsti: %v", err)
+	}
+	return monsti
+}
+
+// siteNames returns the given site names or, if empty, the names of
+// all sites.
+func siteNames(settings *util.MonstiSettings, names []string) []string {
+	if len(names) > 0 {
+		return names
+	}
+	list, err := sites.List(settings)
+	if err != nil {
+		log.Fatalf("Could not list sites: %v", err)
+	}
+	for _, site := range list {
+		names = append(names, site.Name)
+	}
+	return names
+}
+
+// check checks the node trees of the given sites or, if empty, of all
+// sites using the running daemon and prints the found problems.
+//
+// Returns false if any problem remains.
+func check(settings *util.MonstiSettings, names []string, fix bool) bool {
+	monsti := connect(settings)
+	ok := true
+	for _, site := range siteNames(settings, names) {
+		issues, err := monsti.CheckNodes(site, fix)
+		if err != nil {
+			log.Printf("(%v) %v", site, err)
+			ok = false
+			continue
+		}
+		fixed := 0
+		for _, issue := range issues {
+			status := ""
+			if issue.Fixed {
+				status = " (fixed)"
+				fixed++
+			}
+			fmt.Printf("%v\t%v\t%v\t%v%v\n", site, issue.Path, issue.Check,
+				issue.Detail, status)
+		}
+		log.Printf("(%v) %v problems, %v fixed", site, len(issues), fixed)
+		if fixed < len(issues) {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// confirm asks the user the given question and returns true iff the
+// answer is yes.
+func confirm(question string) bool {
+	fmt.Printf("%v [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func main() {
+	config := flag.String("config", ".", "Monsti's configuration directory")
+	title := flag.String("title", "", "Title of the created site")
+	hosts := flag.String("hosts", "localhost:8080",
+		"Comma separated hosts delivering the created site")
+	locale := flag.String("locale", "en", "Locale of the created site")
+	admin := flag.String("admin", "admin",
+		"Login of the created site's administrator")
+	email := flag.String("email", "",
+		"Email address of the created site's administrator")
+	domains := flag.String("domains", "",
+		"Comma separated source=target domains replaced in cloned sites")
+	force := flag.Bool("force", false,
+		"Remove or promote sites without confirmation")
+	dryRun := flag.Bool("dry-run", false,
+		"Only show the migrations instead of writing the migrated nodes")
+	fix := flag.Bool("fix", false, "Repair the problems found by check")
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 || (args[0] != "migrate" && args[0] != "check" &&
+		(len(args) < 2 || (args[0] != "site" && args[0] != "backup"))) {
+		usage()
+		os.Exit(2)
+	}
+	settings, err := util.LoadMonstiSettings(util.GetConfigPath(*config))
+	if err != nil {
+		log.Fatalf("Could not load settings: %v", err)
+	}
+	if args[0] == "migrate" {
+		if !migrate(settings, args[1:], *dryRun) {
+			os.Exit(1)
+		}
+		return
+	}
+	if args[0] == "check" {
+		if !check(settings, args[1:], *fix) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	switch command, args := args[0], args[1:]; {
+	case command == "backup" && args[0] == "export" && len(args) == 3:
+		out := os.Stdout
+		if args[2] != "-" {
+			out, err = os.OpenFile(args[2], os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+				0600)
+			if err != nil {
+				log.Fatalf("Could not create archive: %v", err)
+			}
+		}
+		if err := sites.Export(settings, args[1], out); err != nil {
+			if out != os.Stdout {
+				os.Remove(args[2])
+			}
+			log.Fatalf("Could not export site: %v", err)
+		}
+		if err := out.Close(); err != nil {
+			log.Fatalf("Could not write archive: %v", err)
+		}
+		log.Printf("Exported site %q", args[1])
+	case command == "backup" && args[0] == "import" &&
+		(len(args) == 2 || len(args) == 3):
+		in := os.Stdin
+		if args[1] != "-" {
+			in, err = os.Open(args[1])
+			if err != nil {
+				log.Fatalf("Could not open archive: %v", err)
+			}
+			defer in.Close()
+		}
+		var name string
+		if len(args) == 3 {
+			name = args[2]
+		}
+		if err := sites.Import(settings, in, name); err != nil {
+			log.Fatalf("Could not import site: %v", err)
+		}
+		log.Printf("Imported site, restart Monsti to serve it")
+	case command == "backup" && args[0] == "restore" &&
+		(len(args) == 2 || len(args) == 3):
+		var name string
+		if len(args) == 3 {
+			name = args[2]
+		}
+		if err := sites.Restore(settings, args[1], name); err != nil {
+			log.Fatalf("Could not restore site: %v", err)
+		}
+		log.Printf("Restored site, restart Monsti to serve it")
+	case command == "backup":
+		usage()
+		os.Exit(2)
+	case args[0] == "create" && len(args) == 2:
+		password, err := adminPassword()
+		if err != nil {
+			log.Fatalf("Could not read password: %v", err)
+		}
+		site := service.NewSite{Name: args[1], Title: *title, Locale: *locale,
+			AdminLogin: *admin, AdminEmail: *email, AdminPassword: password}
+		for _, host := range strings.Split(*hosts, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				site.Hosts = append(site.Hosts, host)
+			}
+		}
+		if err := sites.Create(settings, &site); err != nil {
+			log.Fatalf("Could not create site: %v", err)
+		}
+		log.Printf("Created site %q, restart Monsti to serve it", site.Name)
+	case args[0] == "remove" && len(args) == 2:
+		if !*force && !confirm(fmt.Sprintf(
+			"Remove site %q and all of its data?", args[1])) {
+			return
+		}
+		if err := sites.Remove(settings, args[1]); err != nil {
+			log.Fatalf("Could not remove site: %v", err)
+		}
+		log.Printf("Removed site %q", args[1])
+	case args[0] == "clone" && len(args) == 3:
+		clone := service.SiteClone{Source: args[1], Name: args[2],
+			Domains: make(map[string]string)}
+		for _, pair := range strings.Split(*domains, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				log.Fatalf("Invalid domain replacement %q, use source=target", pair)
+			}
+			clone.Domains[parts[0]] = parts[1]
+		}
+		if err := sites.Clone(settings, &clone); err != nil {
+			log.Fatalf("Could not clone site: %v", err)
+		}
+		log.Printf("Cloned site %q to %q, restart Monsti to serve it",
+			clone.Source, clone.Name)
+	case args[0] == "promote" && len(args) == 3:
+		if !*force && !confirm(fmt.Sprintf(
+			"Replace the nodes of site %q by the ones of site %q?", args[2],
+			args[1])) {
+			return
+		}
+		if err := sites.Promote(settings, args[1], args[2]); err != nil {
+			log.Fatalf("Could not promote site: %v", err)
+		}
+		log.Printf("Promoted site %q to %q", args[1], args[2])
+	case args[0] == "list" && len(args) == 1:
+		list, err := sites.List(settings)
+		if err != nil {
+			log.Fatalf("Could not list sites: %v", err)
+		}
+		for _, site := range list {
+			fmt.Printf("%v\t%v\t%v\n", site.Name, strings.Join(site.Hosts, ","),
+				site.Title)
+		}
+	default:
+		usage()
+		os.Exit(2)
+	}
+}